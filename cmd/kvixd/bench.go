@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/iamBelugaa/kvix/pkg/kvix"
+	"github.com/iamBelugaa/kvix/pkg/options"
+)
+
+// benchCommand loads keys into an instance and then runs a timed mix of
+// reads and writes against it, printing throughput and latency percentiles.
+// Without -data-dir it works in a temporary directory removed afterwards, so
+// it never writes benchmark keys into a real data directory by accident.
+func benchCommand(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("bench", flag.ContinueOnError)
+	opts := registerInstanceFlags(flags)
+	keys := flags.Int("keys", 10000, "number of distinct keys, loaded before the run")
+	valueSize := flags.String("value-size", "256", "value size in bytes, or min-max for sizes uniformly distributed in that range")
+	readRatio := flags.Float64("read-ratio", 0.9, "fraction of operations that are reads, from 0 to 1")
+	concurrency := flags.Int("concurrency", 8, "number of concurrent workers")
+	duration := flags.Duration("duration", 10*time.Second, "how long to run the mix of reads and writes")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	minSize, maxSize, err := parseSizeRange(*valueSize)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case *keys <= 0:
+		return errors.New("-keys must be positive")
+	case *readRatio < 0 || *readRatio > 1:
+		return errors.New("-read-ratio must be between 0 and 1")
+	case *concurrency <= 0:
+		return errors.New("-concurrency must be positive")
+	case *duration <= 0:
+		return errors.New("-duration must be positive")
+	}
+
+	var extra []options.OptionFunc
+	if !opts.isSet("data-dir") {
+		dir, err := os.MkdirTemp("", "kvix-bench-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+
+		extra = append(extra, options.WithDataDir(dir), options.WithSegmentDir(filepath.Join(dir, "segments")))
+	}
+
+	instance, err := opts.open(ctx, extra...)
+	if err != nil {
+		return err
+	}
+	defer instance.Close()
+
+	bench := &benchmark{
+		instance: instance,
+		keys:     *keys,
+		minSize:  minSize,
+		maxSize:  maxSize,
+	}
+
+	log.Printf("Loading %d keys \n", *keys)
+	load, err := bench.load(ctx, *concurrency)
+	if err != nil {
+		return err
+	}
+	load.print("load")
+
+	log.Printf("Running for %s with %d workers, %.0f%% reads \n", *duration, *concurrency, *readRatio*100)
+	reads, writes, err := bench.run(ctx, *concurrency, *readRatio, *duration)
+	if err != nil {
+		return err
+	}
+	reads.print("read")
+	writes.print("write")
+	return nil
+}
+
+// parseSizeRange parses "n" or "min-max".
+func parseSizeRange(value string) (int, int, error) {
+	low, high, isRange := strings.Cut(value, "-")
+	if !isRange {
+		high = low
+	}
+
+	minSize, err := strconv.Atoi(strings.TrimSpace(low))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid -value-size %q", value)
+	}
+	maxSize, err := strconv.Atoi(strings.TrimSpace(high))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid -value-size %q", value)
+	}
+
+	if minSize <= 0 || maxSize < minSize {
+		return 0, 0, fmt.Errorf("invalid -value-size %q, sizes must be positive and min at most max", value)
+	}
+	return minSize, maxSize, nil
+}
+
+type benchmark struct {
+	instance *kvix.Instance
+	keys     int
+	minSize  int
+	maxSize  int
+}
+
+func (b *benchmark) key(n int) []byte {
+	return fmt.Appendf(nil, "bench:%08d", n)
+}
+
+func (b *benchmark) value(random *rand.Rand) []byte {
+	size := b.minSize
+	if b.maxSize > b.minSize {
+		size += random.IntN(b.maxSize - b.minSize + 1)
+	}
+
+	value := make([]byte, size)
+	for n := range value {
+		value[n] = byte('a' + random.IntN(26))
+	}
+	return value
+}
+
+// load writes every key once, split between workers.
+func (b *benchmark) load(ctx context.Context, workers int) (*latencies, error) {
+	var (
+		wg      sync.WaitGroup
+		next    atomic.Int64
+		mu      sync.Mutex
+		result  = &latencies{}
+		loadErr error
+	)
+
+	start := time.Now()
+	for worker := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			random := rand.New(rand.NewPCG(uint64(worker), uint64(time.Now().UnixNano())))
+			own := &latencies{}
+			defer func() {
+				mu.Lock()
+				result.merge(own)
+				mu.Unlock()
+			}()
+
+			for {
+				n := int(next.Add(1)) - 1
+				if n >= b.keys || ctx.Err() != nil {
+					return
+				}
+
+				began := time.Now()
+				if err := b.instance.Set(ctx, b.key(n), b.value(random)); err != nil {
+					mu.Lock()
+					loadErr = errors.Join(loadErr, err)
+					mu.Unlock()
+					return
+				}
+				own.add(time.Since(began))
+			}
+		}()
+	}
+
+	wg.Wait()
+	result.elapsed = time.Since(start)
+	if loadErr != nil {
+		return nil, loadErr
+	}
+	return result, ctx.Err()
+}
+
+// run issues random reads and writes over the loaded keys until duration
+// has passed.
+func (b *benchmark) run(
+	ctx context.Context, workers int, readRatio float64, duration time.Duration,
+) (*latencies, *latencies, error) {
+	ctx, cancel := context.WithTimeout(ctx, duration)
+	defer cancel()
+
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		reads  = &latencies{}
+		writes = &latencies{}
+		runErr error
+	)
+
+	start := time.Now()
+	for worker := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			random := rand.New(rand.NewPCG(uint64(worker), uint64(time.Now().UnixNano())))
+			ownReads, ownWrites := &latencies{}, &latencies{}
+			defer func() {
+				mu.Lock()
+				reads.merge(ownReads)
+				writes.merge(ownWrites)
+				mu.Unlock()
+			}()
+
+			for ctx.Err() == nil {
+				key := b.key(random.IntN(b.keys))
+
+				var err error
+				began := time.Now()
+				if random.Float64() < readRatio {
+					_, err = b.instance.Get(ctx, key)
+					ownReads.add(time.Since(began))
+				} else {
+					err = b.instance.Set(ctx, key, b.value(random))
+					ownWrites.add(time.Since(began))
+				}
+
+				if err != nil && ctx.Err() == nil {
+					mu.Lock()
+					runErr = errors.Join(runErr, err)
+					mu.Unlock()
+					return
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	elapsed := time.Since(start)
+	reads.elapsed, writes.elapsed = elapsed, elapsed
+	return reads, writes, runErr
+}
+
+// latencies records how long each operation of one kind took.
+type latencies struct {
+	samples []time.Duration
+	elapsed time.Duration
+}
+
+func (l *latencies) add(latency time.Duration) {
+	l.samples = append(l.samples, latency)
+}
+
+func (l *latencies) merge(other *latencies) {
+	l.samples = append(l.samples, other.samples...)
+}
+
+func (l *latencies) percentile(p float64) time.Duration {
+	index := int(float64(len(l.samples)-1) * p)
+	return l.samples[index]
+}
+
+// print writes one line of throughput and latency percentiles for op.
+func (l *latencies) print(op string) {
+	if len(l.samples) == 0 {
+		fmt.Printf("%-6s 0 ops\n", op)
+		return
+	}
+
+	slices.Sort(l.samples)
+	throughput := float64(len(l.samples)) / l.elapsed.Seconds()
+	fmt.Printf(
+		"%-6s %d ops in %s, %.0f ops/s, p50 %s, p90 %s, p99 %s, p99.9 %s, max %s\n",
+		op, len(l.samples), l.elapsed.Round(time.Millisecond), throughput,
+		l.percentile(0.5), l.percentile(0.9), l.percentile(0.99), l.percentile(0.999),
+		l.samples[len(l.samples)-1],
+	)
+}
@@ -0,0 +1,453 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/iamBelugaa/kvix/internal/resp"
+	kvixErrors "github.com/iamBelugaa/kvix/pkg/errors"
+	"github.com/iamBelugaa/kvix/pkg/kvix"
+)
+
+// store is what the get, set, del, scan and stats subcommands need, served
+// either by an instance opened on a local data directory or by a remote kvixd
+// over the Redis protocol.
+type store interface {
+	get(ctx context.Context, key []byte) ([]byte, bool, error)
+	set(ctx context.Context, key, value []byte, ttl time.Duration) error
+	del(ctx context.Context, key []byte) (bool, error)
+	scan(ctx context.Context, prefix []byte, fn func(key, value []byte) error) error
+	stats(ctx context.Context) (map[string]any, error)
+	close() error
+}
+
+type clientFlags struct {
+	instance *instanceFlags
+	remote   *string
+	format   *string
+}
+
+func registerClientFlags(flags *flag.FlagSet) *clientFlags {
+	return &clientFlags{
+		instance: registerInstanceFlags(flags),
+		remote:   flags.String("remote", "", "address of a kvixd server to query instead of a local data directory"),
+		format:   flags.String("format", "raw", "output format: raw, json or hex"),
+	}
+}
+
+func (f *clientFlags) open(ctx context.Context) (store, error) {
+	switch *f.format {
+	case "raw", "json", "hex":
+	default:
+		return nil, fmt.Errorf("unknown output format %q", *f.format)
+	}
+
+	if *f.remote != "" {
+		client, err := resp.Dial(ctx, *f.remote)
+		if err != nil {
+			return nil, err
+		}
+		return &remoteStore{client: client}, nil
+	}
+
+	instance, err := f.instance.open(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &localStore{instance: instance}, nil
+}
+
+func getCommand(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("get", flag.ContinueOnError)
+	opts := registerClientFlags(flags)
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if flags.NArg() != 1 {
+		return errors.New("usage: get [flags] <key>")
+	}
+
+	s, err := opts.open(ctx)
+	if err != nil {
+		return err
+	}
+	defer s.close()
+
+	key := []byte(flags.Arg(0))
+	value, ok, err := s.get(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		return fmt.Errorf("key %q not found", key)
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	return writeEntry(out, *opts.format, key, value, false)
+}
+
+func setCommand(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("set", flag.ContinueOnError)
+	opts := registerClientFlags(flags)
+	ttl := flags.Duration("ttl", 0, "expire the key after this duration (default never)")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		return errors.New("usage: set [flags] <key> [value], reading the value from stdin if omitted")
+	}
+
+	var value []byte
+	if flags.NArg() == 2 {
+		value = []byte(flags.Arg(1))
+	} else {
+		var err error
+		if value, err = io.ReadAll(os.Stdin); err != nil {
+			return err
+		}
+	}
+
+	s, err := opts.open(ctx)
+	if err != nil {
+		return err
+	}
+	defer s.close()
+
+	return s.set(ctx, []byte(flags.Arg(0)), value, *ttl)
+}
+
+func delCommand(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("del", flag.ContinueOnError)
+	opts := registerClientFlags(flags)
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if flags.NArg() == 0 {
+		return errors.New("usage: del [flags] <key>...")
+	}
+
+	s, err := opts.open(ctx)
+	if err != nil {
+		return err
+	}
+	defer s.close()
+
+	var deleted int
+	for _, key := range flags.Args() {
+		ok, err := s.del(ctx, []byte(key))
+		if err != nil {
+			return err
+		}
+
+		if ok {
+			deleted++
+		}
+	}
+
+	fmt.Println(deleted)
+	return nil
+}
+
+func scanCommand(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("scan", flag.ContinueOnError)
+	opts := registerClientFlags(flags)
+	prefix := flags.String("prefix", "", "only list keys starting with this prefix")
+	keysOnly := flags.Bool("keys-only", false, "print keys without values")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	s, err := opts.open(ctx)
+	if err != nil {
+		return err
+	}
+	defer s.close()
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+
+	return s.scan(ctx, []byte(*prefix), func(key, value []byte) error {
+		if *keysOnly {
+			value = nil
+		}
+		return writeEntry(out, *opts.format, key, value, true)
+	})
+}
+
+func statsCommand(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("stats", flag.ContinueOnError)
+	opts := registerClientFlags(flags)
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	s, err := opts.open(ctx)
+	if err != nil {
+		return err
+	}
+	defer s.close()
+
+	stats, err := s.stats(ctx)
+	if err != nil {
+		return err
+	}
+
+	if *opts.format == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(stats)
+	}
+
+	names := make([]string, 0, len(stats))
+	for name := range stats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		fmt.Printf("%s: %v\n", name, stats[name])
+	}
+	return nil
+}
+
+// writeEntry prints one key and value. In raw format a lone value is written
+// byte for byte; scans print "key<TAB>value" lines.
+func writeEntry(w *bufio.Writer, format string, key, value []byte, withKey bool) error {
+	switch format {
+	case "json":
+		entry := map[string]string{}
+		if withKey {
+			putJSON(entry, "key", key)
+		}
+		if value != nil {
+			putJSON(entry, "value", value)
+		}
+
+		encoded, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		w.Write(encoded)
+
+	case "hex":
+		if withKey {
+			w.WriteString(hex.EncodeToString(key))
+			if value != nil {
+				w.WriteByte('\t')
+			}
+		}
+		w.WriteString(hex.EncodeToString(value))
+
+	default:
+		if withKey {
+			w.Write(key)
+			if value != nil {
+				w.WriteByte('\t')
+			}
+		}
+		w.Write(value)
+	}
+
+	return w.WriteByte('\n')
+}
+
+// putJSON stores b under name when it is valid UTF-8 and base64-encoded
+// under name+"Base64" otherwise, matching the NDJSON export format.
+func putJSON(entry map[string]string, name string, b []byte) {
+	if utf8.Valid(b) {
+		entry[name] = string(b)
+		return
+	}
+
+	entry[name+"Base64"] = base64.StdEncoding.EncodeToString(b)
+}
+
+type localStore struct {
+	instance *kvix.Instance
+}
+
+func (s *localStore) get(ctx context.Context, key []byte) ([]byte, bool, error) {
+	record, err := s.instance.Get(ctx, key)
+	if err != nil {
+		if kvixErrors.GetErrorCode(err) == kvixErrors.ErrIndexKeyNotFound {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	return record.Value, true, nil
+}
+
+func (s *localStore) set(ctx context.Context, key, value []byte, ttl time.Duration) error {
+	if ttl > 0 {
+		return s.instance.SetX(ctx, key, value, ttl)
+	}
+	return s.instance.Set(ctx, key, value)
+}
+
+func (s *localStore) del(ctx context.Context, key []byte) (bool, error) {
+	return s.instance.Delete(ctx, key)
+}
+
+func (s *localStore) scan(ctx context.Context, prefix []byte, fn func(key, value []byte) error) error {
+	snapshot, err := s.instance.Snapshot(ctx)
+	if err != nil {
+		return err
+	}
+	defer snapshot.Release()
+
+	for _, key := range snapshot.Keys() {
+		if !bytes.HasPrefix([]byte(key), prefix) {
+			continue
+		}
+
+		record, err := snapshot.Get(ctx, []byte(key))
+		if err != nil {
+			if kvixErrors.GetErrorCode(err) == kvixErrors.ErrIndexKeyNotFound {
+				continue
+			}
+			return err
+		}
+
+		if err := fn([]byte(key), record.Value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *localStore) stats(ctx context.Context) (map[string]any, error) {
+	stats, err := s.instance.Stats(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	encoded, err := json.Marshal(stats)
+	if err != nil {
+		return nil, err
+	}
+
+	var fields map[string]any
+	return fields, json.Unmarshal(encoded, &fields)
+}
+
+func (s *localStore) close() error {
+	return s.instance.Close()
+}
+
+type remoteStore struct {
+	client *resp.Client
+}
+
+func (s *remoteStore) get(ctx context.Context, key []byte) ([]byte, bool, error) {
+	reply, err := s.client.Do(ctx, []byte("GET"), key)
+	if err != nil || reply == nil {
+		return nil, false, err
+	}
+
+	value, ok := reply.([]byte)
+	if !ok {
+		return nil, false, fmt.Errorf("unexpected GET reply %v", reply)
+	}
+	return value, true, nil
+}
+
+func (s *remoteStore) set(ctx context.Context, key, value []byte, ttl time.Duration) error {
+	args := [][]byte{[]byte("SET"), key, value}
+	if ttl > 0 {
+		args = append(args, []byte("PX"), fmt.Appendf(nil, "%d", max(ttl.Milliseconds(), 1)))
+	}
+
+	_, err := s.client.Do(ctx, args...)
+	return err
+}
+
+func (s *remoteStore) del(ctx context.Context, key []byte) (bool, error) {
+	reply, err := s.client.Do(ctx, []byte("DEL"), key)
+	if err != nil {
+		return false, err
+	}
+	return reply == int64(1), nil
+}
+
+// scan lists matching keys with KEYS and then fetches each value, so keys
+// deleted in between are silently skipped.
+func (s *remoteStore) scan(ctx context.Context, prefix []byte, fn func(key, value []byte) error) error {
+	pattern := make([]byte, 0, len(prefix)+1)
+	for _, c := range prefix {
+		if strings.IndexByte(`*?[]\`, c) >= 0 {
+			pattern = append(pattern, '\\')
+		}
+		pattern = append(pattern, c)
+	}
+	pattern = append(pattern, '*')
+
+	reply, err := s.client.Do(ctx, []byte("KEYS"), pattern)
+	if err != nil {
+		return err
+	}
+
+	keys, _ := reply.([]any)
+	for _, item := range keys {
+		key, _ := item.([]byte)
+
+		value, ok, err := s.get(ctx, key)
+		if err != nil {
+			return err
+		}
+
+		if !ok {
+			continue
+		}
+
+		if err := fn(key, value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *remoteStore) stats(ctx context.Context) (map[string]any, error) {
+	reply, err := s.client.Do(ctx, []byte("INFO"))
+	if err != nil {
+		return nil, err
+	}
+
+	info, _ := reply.([]byte)
+	fields := make(map[string]any)
+	for _, line := range strings.Split(string(info), "\r\n") {
+		if name, value, ok := strings.Cut(line, ":"); ok && !strings.HasPrefix(line, "#") {
+			fields[name] = value
+		}
+	}
+
+	return fields, nil
+}
+
+func (s *remoteStore) close() error {
+	return s.client.Close()
+}
@@ -0,0 +1,496 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"log"
+	"net"
+	"os"
+
+	"github.com/iamBelugaa/kvix/internal/memcache"
+	"github.com/iamBelugaa/kvix/internal/resp"
+	"github.com/iamBelugaa/kvix/pkg/encryption"
+	"github.com/iamBelugaa/kvix/pkg/kvix"
+	"github.com/iamBelugaa/kvix/pkg/logger"
+	"github.com/iamBelugaa/kvix/pkg/options"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+type command func(ctx context.Context, args []string) error
+
+var commands = map[string]command{
+	"serve":      serveCommand,
+	"restore":    restoreCommand,
+	"export":     exportCommand,
+	"import":     importCommand,
+	"import-rdb": importRDBCommand,
+	"get":        getCommand,
+	"set":        setCommand,
+	"del":        delCommand,
+	"scan":       scanCommand,
+	"stats":      statsCommand,
+	"verify":     verifyCommand,
+	"reencrypt":  reencryptCommand,
+	"bench":      benchCommand,
+	"doctor":     doctorCommand,
+}
+
+func serveCommand(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ContinueOnError)
+	opts := registerInstanceFlags(flags)
+	addr := flags.String("addr", ":6380", "address to serve the Redis protocol on")
+	memcacheAddr := flags.String("memcache-addr", "", "address to serve the memcached text protocol on (disabled if empty)")
+	replicationAddr := flags.String("replication-addr", "", "address to serve replicas on (disabled if empty)")
+	replicaOf := flags.String("replica-of", "", "replication address of a primary to follow as a read-only replica")
+	watchConfig := flags.Duration("watch-config", 0, "check the configuration file this often and reload it when it changes (disabled if 0)")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	cfg, err := opts.configFile()
+	if err != nil {
+		return err
+	}
+
+	respLog, err := opts.logger("kvixd-resp")
+	if err != nil {
+		return err
+	}
+
+	var extra []options.OptionFunc
+	if opts.isSet("replica-of") {
+		extra = append(extra, options.WithReplicaOf(*replicaOf))
+	}
+
+	instance, err := opts.open(ctx, extra...)
+	if err != nil {
+		return err
+	}
+	defer instance.Close()
+
+	var servers []func(context.Context) error
+	var listeners []net.Listener
+	closeListeners := func() {
+		for _, listener := range listeners {
+			listener.Close()
+		}
+	}
+
+	listener, err := net.Listen("tcp", opts.listenAddr("addr", *addr, cfg.respAddr))
+	if err != nil {
+		return err
+	}
+	listeners = append(listeners, listener)
+	servers = append(servers, func(ctx context.Context) error {
+		return resp.NewServer(respLog, instance).Serve(ctx, listener)
+	})
+
+	if memcacheListenAddr := opts.listenAddr("memcache-addr", *memcacheAddr, cfg.memcacheAddr); memcacheListenAddr != "" {
+		memcacheListener, err := net.Listen("tcp", memcacheListenAddr)
+		if err != nil {
+			closeListeners()
+			return err
+		}
+		listeners = append(listeners, memcacheListener)
+
+		memcacheLog, err := opts.logger("kvixd-memcache")
+		if err != nil {
+			closeListeners()
+			return err
+		}
+
+		servers = append(servers, func(ctx context.Context) error {
+			return memcache.NewServer(memcacheLog, instance).Serve(ctx, memcacheListener)
+		})
+	}
+
+	if replicationListenAddr := opts.listenAddr("replication-addr", *replicationAddr, cfg.replicationAddr); replicationListenAddr != "" {
+		replicationListener, err := net.Listen("tcp", replicationListenAddr)
+		if err != nil {
+			closeListeners()
+			return err
+		}
+		listeners = append(listeners, replicationListener)
+
+		servers = append(servers, func(ctx context.Context) error {
+			return instance.ServeReplication(ctx, replicationListener)
+		})
+	}
+
+	// Safely changeable settings are reloaded on SIGHUP without reopening
+	// the instance.
+	go opts.watchReloads(ctx, instance, *watchConfig, extra...)
+
+	if len(servers) == 1 {
+		return servers[0](ctx)
+	}
+
+	// Any server failing shuts the others down.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errs := make(chan error, len(servers))
+	for _, serve := range servers {
+		go func() {
+			errs <- serve(ctx)
+			cancel()
+		}()
+	}
+
+	var joined []error
+	for range servers {
+		joined = append(joined, <-errs)
+	}
+	return errors.Join(joined...)
+}
+
+func restoreCommand(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	from := flags.String("from", "", "path of the backup archive to restore")
+	dataDir := flags.String("data-dir", "", "empty directory to restore into")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *from == "" || *dataDir == "" {
+		flags.Usage()
+		return errors.New("both -from and -data-dir are required")
+	}
+
+	archive, err := os.Open(*from)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+
+	if err := kvix.Restore(ctx, archive, *dataDir); err != nil {
+		return err
+	}
+
+	log.Printf("Restored %s into %s \n", *from, *dataDir)
+	return nil
+}
+
+func exportCommand(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	opts := registerInstanceFlags(flags)
+	out := flags.String("out", "", "file to write NDJSON to (default stdout)")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	instance, err := opts.open(ctx)
+	if err != nil {
+		return err
+	}
+	defer instance.Close()
+
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		file, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+
+	exported, err := instance.Export(ctx, w)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Exported %d records \n", exported)
+	return nil
+}
+
+func importCommand(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	opts := registerInstanceFlags(flags)
+	in := flags.String("in", "", "NDJSON file to import (default stdin)")
+	skipExisting := flags.Bool("skip-existing", false, "keep existing keys instead of overwriting them")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	instance, err := opts.open(ctx)
+	if err != nil {
+		return err
+	}
+	defer instance.Close()
+
+	var r io.Reader = os.Stdin
+	if *in != "" {
+		file, err := os.Open(*in)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		r = file
+	}
+
+	policy := kvix.ImportOverwrite
+	if *skipExisting {
+		policy = kvix.ImportSkipExisting
+	}
+
+	result, err := instance.Import(ctx, r, policy)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Imported %d records, skipped %d \n", result.Imported, result.Skipped)
+	return nil
+}
+
+func importRDBCommand(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("import-rdb", flag.ContinueOnError)
+	opts := registerInstanceFlags(flags)
+	in := flags.String("in", "", "Redis RDB file to import (required)")
+	skipExisting := flags.Bool("skip-existing", false, "keep existing keys instead of overwriting them")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *in == "" {
+		flags.Usage()
+		return errors.New("-in is required")
+	}
+
+	file, err := os.Open(*in)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	instance, err := opts.open(ctx)
+	if err != nil {
+		return err
+	}
+	defer instance.Close()
+
+	policy := kvix.ImportOverwrite
+	if *skipExisting {
+		policy = kvix.ImportSkipExisting
+	}
+
+	result, err := instance.ImportRDB(ctx, file, policy)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Imported %d keys from RDB, skipped %d \n", result.Imported, result.Skipped)
+	return nil
+}
+
+func verifyCommand(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("verify", flag.ContinueOnError)
+	opts := registerInstanceFlags(flags)
+	repair := flags.Bool("repair", false, "truncate unreadable segment tails and drop broken index entries")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	instance, err := opts.open(ctx)
+	if err != nil {
+		return err
+	}
+	defer instance.Close()
+
+	report, err := instance.Verify(ctx, kvix.VerifyOptions{Repair: *repair})
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(report); err != nil {
+		return err
+	}
+
+	if !report.Healthy() && !report.Repaired {
+		return errors.New("corruption found, rerun with -repair to fix")
+	}
+	return nil
+}
+
+func reencryptCommand(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("reencrypt", flag.ContinueOnError)
+	opts := registerInstanceFlags(flags)
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *opts.keyEnv == "" {
+		flags.Usage()
+		return errors.New("-key-env is required")
+	}
+
+	instance, err := opts.open(ctx)
+	if err != nil {
+		return err
+	}
+	defer instance.Close()
+
+	rewritten, err := instance.Reencrypt(ctx)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Re-encrypted %d records \n", rewritten)
+	return nil
+}
+
+type instanceFlags struct {
+	flags      *flag.FlagSet
+	config     *string
+	dataDir    *string
+	segmentDir *string
+	partitions *int
+	keyEnv     *string
+
+	loaded *config
+}
+
+func registerInstanceFlags(flags *flag.FlagSet) *instanceFlags {
+	return &instanceFlags{
+		flags:      flags,
+		config:     flags.String("config", "", "configuration file; flags given on the command line take precedence"),
+		dataDir:    flags.String("data-dir", options.DefaultDataDir, "data directory of the instance"),
+		segmentDir: flags.String("segment-dir", "", "segment directory (default {data-dir}/segments)"),
+		partitions: flags.Int("partitions", 1, "number of storage partitions the instance was created with"),
+		keyEnv:     flags.String("key-env", "", "environment variable holding version:base64-key encryption keys"),
+	}
+}
+
+// configFile returns the file named by -config, or an empty configuration
+// when there is none.
+func (f *instanceFlags) configFile() (*config, error) {
+	if f.loaded != nil {
+		return f.loaded, nil
+	}
+
+	if *f.config == "" {
+		f.loaded = &config{}
+		return f.loaded, nil
+	}
+
+	cfg, err := loadConfig(*f.config)
+	if err != nil {
+		return nil, err
+	}
+	f.loaded = cfg
+	return cfg, nil
+}
+
+// isSet reports whether the flag was given on the command line rather than
+// left at its default.
+func (f *instanceFlags) isSet(name string) bool {
+	set := false
+	f.flags.Visit(func(fl *flag.Flag) {
+		if fl.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// listenAddr returns the address a server listens on: the flag when given,
+// otherwise the configuration file, otherwise the flag default.
+func (f *instanceFlags) listenAddr(flagName, flagValue, configured string) string {
+	if configured != "" && !f.isSet(flagName) {
+		return configured
+	}
+	return flagValue
+}
+
+// logger returns a server logger at the configured log level.
+func (f *instanceFlags) logger(service string) (*zap.SugaredLogger, error) {
+	cfg, err := f.configFile()
+	if err != nil {
+		return nil, err
+	}
+
+	level := zapcore.InfoLevel
+	if cfg.logLevel != nil {
+		level = *cfg.logLevel
+	}
+
+	if cfg.logFile == nil {
+		return logger.NewLeveled(service, level, 0), nil
+	}
+
+	// The file is shared with the instance's logger and stays open for the
+	// life of the process.
+	file, err := logger.OpenFile(cfg.logFile.Path, logger.Rotation{
+		MaxSize:    cfg.logFile.MaxSize,
+		MaxAge:     cfg.logFile.MaxAge,
+		MaxBackups: cfg.logFile.MaxBackups,
+		Compress:   cfg.logFile.Compress,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return logger.NewFile(service, zap.NewAtomicLevelAt(level), 0, file), nil
+}
+
+// open opens the instance with the defaults, overridden by the configuration
+// file, then by KVIX_* environment variables, then by flags given on the
+// command line. Commands pass the options of their own flags as extra.
+func (f *instanceFlags) open(ctx context.Context, extra ...options.OptionFunc) (*kvix.Instance, error) {
+	opts, err := f.options(extra...)
+	if err != nil {
+		return nil, err
+	}
+	return kvix.NewInstance(ctx, "kvixd", opts...)
+}
+
+// options returns the instance options open applies over the defaults.
+func (f *instanceFlags) options(extra ...options.OptionFunc) ([]options.OptionFunc, error) {
+	cfg, err := f.configFile()
+	if err != nil {
+		return nil, err
+	}
+
+	env, err := options.FromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	opts := append(cfg.options(), env)
+	if f.isSet("data-dir") {
+		opts = append(opts, options.WithDataDir(*f.dataDir))
+	}
+	if f.isSet("segment-dir") {
+		opts = append(opts, options.WithSegmentDir(*f.segmentDir))
+	}
+	if f.isSet("partitions") {
+		opts = append(opts, options.WithPartitions(*f.partitions))
+	}
+
+	keyEnv := cfg.keyEnv
+	if f.isSet("key-env") {
+		keyEnv = *f.keyEnv
+	}
+
+	if keyEnv != "" {
+		keys, err := encryption.EnvKeys(keyEnv)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, options.WithEncryption(keys))
+	}
+
+	return append(opts, extra...), nil
+}
@@ -0,0 +1,480 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+
+	"github.com/iamBelugaa/kvix/pkg/options"
+)
+
+// config is the kvixd configuration file. Settings it leaves out keep their
+// defaults, and flags given on the command line override it.
+//
+// The file is a subset of TOML: [table] headers, key = value pairs whose
+// values are quoted strings, integers or booleans, and # comments.
+//
+//	data_dir = "/var/lib/kvix"
+//	partitions = 4
+//	log_level = "warn"
+//	replica_of = "primary.example:6390"
+//	manifest_interval = "1s"
+//	follow_interval = "1s"
+//	slow_op_threshold = "100ms"
+//	operation_timeout = "5s"
+//	read_verification = "checksum"
+//	index_layout = "ordered"
+//
+//	[log]
+//	file = "/var/log/kvix/kvixd.log"
+//	max_size = 104_857_600
+//	max_age = "24h"
+//	max_backups = 7
+//	compress = true
+//
+//	[segment]
+//	dir = "/var/lib/kvix/segments"
+//	prefix = "segment"
+//	size = 268_435_456
+//	framing = "compact"
+//
+//	[sync]
+//	policy = "interval"
+//	interval = "500ms"
+//
+//	[encryption]
+//	key_env = "KVIX_KEYS"
+//
+//	[eviction]
+//	max_keys = 1_000_000
+//	max_live_bytes = 4_294_967_296
+//	policy = "lfu"
+//
+//	[cluster]
+//	node_id = "a"
+//	peers = "a=10.0.0.1:6391,b=10.0.0.2:6391,c=10.0.0.3:6391"
+//	election_timeout = "1s"
+//	heartbeat_interval = "100ms"
+//
+//	[listen]
+//	resp = ":6380"
+//	memcache = ":11211"
+//	grpc = ":6381"
+//	replication = ":6390"
+type config struct {
+	dataDir    string
+	partitions int
+	logLevel   *zapcore.Level
+	replicaOf  string
+
+	logFile *options.LogFileOptions
+
+	manifestInterval time.Duration
+	followInterval   time.Duration
+	slowOpThreshold  time.Duration
+	operationTimeout time.Duration
+	readVerification *options.VerifyLevel
+	indexLayout      *options.IndexLayout
+
+	segmentDir    string
+	segmentPrefix string
+	segmentSize   uint64
+	framing       *options.RecordFraming
+
+	syncPolicy   *options.SyncPolicy
+	syncInterval time.Duration
+
+	keyEnv string
+
+	maxKeys        int64
+	maxLiveBytes   int64
+	evictionPolicy *options.EvictionPolicy
+
+	clusterNodeID     string
+	clusterPeers      map[string]string
+	electionTimeout   time.Duration
+	heartbeatInterval time.Duration
+
+	respAddr        string
+	memcacheAddr    string
+	grpcAddr        string
+	replicationAddr string
+}
+
+func loadConfig(path string) (*config, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	cfg, err := parseConfig(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+func parseConfig(r io.Reader) (*config, error) {
+	cfg := &config{}
+	table := ""
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(stripComment(scanner.Text()))
+		if text == "" {
+			continue
+		}
+
+		if strings.HasPrefix(text, "[") {
+			if !strings.HasSuffix(text, "]") {
+				return nil, fmt.Errorf("line %d: unterminated table header %q", line, text)
+			}
+			table = strings.TrimSpace(text[1 : len(text)-1])
+			continue
+		}
+
+		key, raw, ok := strings.Cut(text, "=")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected key = value, got %q", line, text)
+		}
+
+		key = strings.TrimSpace(key)
+		if table != "" {
+			key = table + "." + key
+		}
+
+		value, err := parseValue(strings.TrimSpace(raw))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s: %w", line, key, err)
+		}
+
+		if err := cfg.set(key, value); err != nil {
+			return nil, fmt.Errorf("line %d: %s: %w", line, key, err)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (c *config) set(key string, value any) error {
+	switch key {
+	case "data_dir":
+		return assign(&c.dataDir, value)
+	case "partitions":
+		var partitions int64
+		if err := assign(&partitions, value); err != nil {
+			return err
+		}
+		c.partitions = int(partitions)
+	case "replica_of":
+		return assign(&c.replicaOf, value)
+	case "manifest_interval":
+		return assignDuration(&c.manifestInterval, value)
+	case "follow_interval":
+		return assignDuration(&c.followInterval, value)
+	case "slow_op_threshold":
+		return assignDuration(&c.slowOpThreshold, value)
+	case "operation_timeout":
+		return assignDuration(&c.operationTimeout, value)
+	case "read_verification":
+		var name string
+		if err := assign(&name, value); err != nil {
+			return err
+		}
+		level, err := options.ParseVerifyLevel(name)
+		if err != nil {
+			return err
+		}
+		c.readVerification = &level
+	case "index_layout":
+		var name string
+		if err := assign(&name, value); err != nil {
+			return err
+		}
+		layout, err := options.ParseIndexLayout(name)
+		if err != nil {
+			return err
+		}
+		c.indexLayout = &layout
+	case "log_level":
+		var name string
+		if err := assign(&name, value); err != nil {
+			return err
+		}
+		level, err := zapcore.ParseLevel(name)
+		if err != nil {
+			return err
+		}
+		c.logLevel = &level
+	case "log.file":
+		return assign(&c.logFileOptions().Path, value)
+	case "log.max_size":
+		return assign(&c.logFileOptions().MaxSize, value)
+	case "log.max_age":
+		return assignDuration(&c.logFileOptions().MaxAge, value)
+	case "log.max_backups":
+		var backups int64
+		if err := assign(&backups, value); err != nil {
+			return err
+		}
+		c.logFileOptions().MaxBackups = int(backups)
+	case "log.compress":
+		return assign(&c.logFileOptions().Compress, value)
+	case "segment.dir":
+		return assign(&c.segmentDir, value)
+	case "segment.prefix":
+		return assign(&c.segmentPrefix, value)
+	case "segment.size":
+		var size int64
+		if err := assign(&size, value); err != nil {
+			return err
+		}
+		if size < 0 {
+			return fmt.Errorf("size may not be negative, got %d", size)
+		}
+		c.segmentSize = uint64(size)
+	case "segment.framing":
+		var name string
+		if err := assign(&name, value); err != nil {
+			return err
+		}
+		framing, err := options.ParseRecordFraming(name)
+		if err != nil {
+			return err
+		}
+		c.framing = &framing
+	case "sync.policy":
+		var name string
+		if err := assign(&name, value); err != nil {
+			return err
+		}
+		policy, err := options.ParseSyncPolicy(name)
+		if err != nil {
+			return err
+		}
+		c.syncPolicy = &policy
+	case "sync.interval":
+		return assignDuration(&c.syncInterval, value)
+	case "encryption.key_env":
+		return assign(&c.keyEnv, value)
+	case "eviction.max_keys":
+		return assign(&c.maxKeys, value)
+	case "eviction.max_live_bytes":
+		return assign(&c.maxLiveBytes, value)
+	case "eviction.policy":
+		var name string
+		if err := assign(&name, value); err != nil {
+			return err
+		}
+		policy, err := options.ParseEvictionPolicy(name)
+		if err != nil {
+			return err
+		}
+		c.evictionPolicy = &policy
+	case "cluster.node_id":
+		return assign(&c.clusterNodeID, value)
+	case "cluster.peers":
+		var list string
+		if err := assign(&list, value); err != nil {
+			return err
+		}
+		peers, err := parsePeers(list)
+		if err != nil {
+			return err
+		}
+		c.clusterPeers = peers
+	case "cluster.election_timeout":
+		return assignDuration(&c.electionTimeout, value)
+	case "cluster.heartbeat_interval":
+		return assignDuration(&c.heartbeatInterval, value)
+	case "listen.resp":
+		return assign(&c.respAddr, value)
+	case "listen.memcache":
+		return assign(&c.memcacheAddr, value)
+	case "listen.grpc":
+		return assign(&c.grpcAddr, value)
+	case "listen.replication":
+		return assign(&c.replicationAddr, value)
+	default:
+		return fmt.Errorf("unknown setting")
+	}
+	return nil
+}
+
+// logFileOptions returns the [log] settings, creating them on first use.
+func (c *config) logFileOptions() *options.LogFileOptions {
+	if c.logFile == nil {
+		c.logFile = &options.LogFileOptions{}
+	}
+	return c.logFile
+}
+
+// options returns the instance options the file sets, to be applied over the
+// defaults and before any flags.
+func (c *config) options() []options.OptionFunc {
+	var opts []options.OptionFunc
+	if c.dataDir != "" {
+		opts = append(opts, options.WithDataDir(c.dataDir))
+	}
+	if c.partitions != 0 {
+		opts = append(opts, options.WithPartitions(c.partitions))
+	}
+	if c.logLevel != nil {
+		opts = append(opts, options.WithLogLevel(*c.logLevel))
+	}
+	if c.logFile != nil {
+		opts = append(opts, options.WithLogFile(*c.logFile))
+	}
+	if c.segmentDir != "" {
+		opts = append(opts, options.WithSegmentDir(c.segmentDir))
+	}
+	if c.segmentPrefix != "" {
+		opts = append(opts, options.WithSegmentPrefix(c.segmentPrefix))
+	}
+	if c.segmentSize != 0 {
+		opts = append(opts, options.WithSegmentSize(c.segmentSize))
+	}
+	if c.framing != nil {
+		opts = append(opts, options.WithRecordFraming(*c.framing))
+	}
+	if c.syncPolicy != nil {
+		opts = append(opts, options.WithSyncPolicy(*c.syncPolicy))
+	}
+	if c.syncInterval != 0 {
+		opts = append(opts, options.WithSyncInterval(c.syncInterval))
+	}
+	if c.replicaOf != "" {
+		opts = append(opts, options.WithReplicaOf(c.replicaOf))
+	}
+	if c.manifestInterval != 0 {
+		opts = append(opts, options.WithManifest(c.manifestInterval))
+	}
+	if c.followInterval != 0 {
+		opts = append(opts, options.WithFollower(c.followInterval))
+	}
+	if c.slowOpThreshold != 0 {
+		opts = append(opts, options.WithSlowOpThreshold(c.slowOpThreshold))
+	}
+	if c.operationTimeout != 0 {
+		opts = append(opts, options.WithOperationTimeout(c.operationTimeout))
+	}
+	if c.readVerification != nil {
+		opts = append(opts, options.WithReadVerification(*c.readVerification))
+	}
+	if c.indexLayout != nil {
+		opts = append(opts, options.WithIndexLayout(*c.indexLayout))
+	}
+	if c.maxKeys != 0 {
+		opts = append(opts, options.WithMaxKeys(int(c.maxKeys)))
+	}
+	if c.maxLiveBytes != 0 {
+		opts = append(opts, options.WithMaxLiveBytes(c.maxLiveBytes))
+	}
+	if c.evictionPolicy != nil {
+		opts = append(opts, options.WithEvictionPolicy(*c.evictionPolicy))
+	}
+	if c.clusterNodeID != "" || c.clusterPeers != nil {
+		opts = append(opts, options.WithCluster(options.ClusterOptions{
+			NodeID:            c.clusterNodeID,
+			Peers:             c.clusterPeers,
+			ElectionTimeout:   c.electionTimeout,
+			HeartbeatInterval: c.heartbeatInterval,
+		}))
+	}
+	return opts
+}
+
+// parsePeers reads a comma separated list of id=host:port members.
+func parsePeers(list string) (map[string]string, error) {
+	peers := make(map[string]string)
+	for _, member := range strings.Split(list, ",") {
+		id, address, ok := strings.Cut(strings.TrimSpace(member), "=")
+		id, address = strings.TrimSpace(id), strings.TrimSpace(address)
+		if !ok || id == "" || address == "" {
+			return nil, fmt.Errorf("expected id=host:port, got %q", member)
+		}
+
+		if _, ok := peers[id]; ok {
+			return nil, fmt.Errorf("node %q is listed twice", id)
+		}
+		peers[id] = address
+	}
+	return peers, nil
+}
+
+func assign[T string | int64 | bool](target *T, value any) error {
+	typed, ok := value.(T)
+	if !ok {
+		return fmt.Errorf("expected a %T value, got %v", *target, value)
+	}
+	*target = typed
+	return nil
+}
+
+func assignDuration(target *time.Duration, value any) error {
+	var text string
+	if err := assign(&text, value); err != nil {
+		return err
+	}
+
+	duration, err := time.ParseDuration(text)
+	if err != nil {
+		return err
+	}
+	*target = duration
+	return nil
+}
+
+// parseValue reads a quoted string, an integer or a boolean.
+func parseValue(raw string) (any, error) {
+	switch {
+	case raw == "":
+		return nil, fmt.Errorf("missing value")
+	case raw == "true" || raw == "false":
+		return raw == "true", nil
+	case strings.HasPrefix(raw, `"`):
+		return strconv.Unquote(raw)
+	case strings.HasPrefix(raw, "'"):
+		if len(raw) < 2 || !strings.HasSuffix(raw, "'") {
+			return nil, fmt.Errorf("unterminated string %s", raw)
+		}
+		return raw[1 : len(raw)-1], nil
+	}
+
+	number, err := strconv.ParseInt(strings.ReplaceAll(raw, "_", ""), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported value %s", raw)
+	}
+	return number, nil
+}
+
+// stripComment drops a # comment that is not inside a quoted string.
+func stripComment(line string) string {
+	var quote rune
+	escaped := false
+	for i, r := range line {
+		switch {
+		case escaped:
+			escaped = false
+		case quote == '"' && r == '\\':
+			escaped = true
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote == 0 && (r == '"' || r == '\''):
+			quote = r
+		case quote == 0 && r == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/iamBelugaa/kvix/pkg/filesys"
+	"github.com/iamBelugaa/kvix/pkg/options"
+	"github.com/iamBelugaa/kvix/pkg/seginfo"
+)
+
+// errFileLimitUnsupported is returned by fileLimit where the open file limit
+// cannot be read.
+var errFileLimitUnsupported = errors.New("open file limit is not reported on this platform")
+
+// minFreeSegments is how many segments worth of free space doctor expects,
+// leaving room for the active segment and a compaction pass.
+const minFreeSegments = 2
+
+type severity string
+
+const (
+	severityOK    severity = "ok"
+	severityWarn  severity = "warn"
+	severityError severity = "error"
+)
+
+// finding is the outcome of one doctor check, with the fix to apply when it
+// is not ok.
+type finding struct {
+	severity severity
+	check    string
+	message  string
+	fix      string
+}
+
+type doctor struct {
+	opts     options.Options
+	findings []finding
+}
+
+func (d *doctor) ok(check, format string, args ...any) {
+	d.findings = append(d.findings, finding{severity: severityOK, check: check, message: fmt.Sprintf(format, args...)})
+}
+
+func (d *doctor) warn(check, fix, format string, args ...any) {
+	d.findings = append(d.findings, finding{
+		severity: severityWarn, check: check, message: fmt.Sprintf(format, args...), fix: fix,
+	})
+}
+
+func (d *doctor) fail(check, fix, format string, args ...any) {
+	d.findings = append(d.findings, finding{
+		severity: severityError, check: check, message: fmt.Sprintf(format, args...), fix: fix,
+	})
+}
+
+// doctorCommand checks the environment an instance would be opened in,
+// without opening it, and prints a finding per check. It fails when any
+// check found an error.
+func doctorCommand(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("doctor", flag.ContinueOnError)
+	opts := registerInstanceFlags(flags)
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	d := &doctor{opts: options.DefaultOptions()}
+	if d.checkConfig(opts) {
+		d.checkDir("data-dir", d.opts.DataDir)
+		d.checkDir("segment-dir", d.opts.SegmentOptions.Directory)
+		d.checkFreeSpace()
+		d.checkLeftovers()
+		d.checkSegments()
+		d.checkFileLimit()
+	}
+
+	errorCount := 0
+	for _, f := range d.findings {
+		fmt.Printf("[%s] %s: %s\n", f.severity, f.check, f.message)
+		if f.fix != "" {
+			fmt.Printf("       fix: %s\n", f.fix)
+		}
+		if f.severity == severityError {
+			errorCount++
+		}
+	}
+
+	if errorCount > 0 {
+		return fmt.Errorf("%d problems found", errorCount)
+	}
+	return nil
+}
+
+// checkConfig resolves the options the instance would be opened with and
+// validates them. The remaining checks only run when they resolve.
+func (d *doctor) checkConfig(flags *instanceFlags) bool {
+	fns, err := flags.options()
+	if err != nil {
+		d.fail("config", "correct the configuration file, KVIX_* variables or -key-env", "%v", err)
+		return false
+	}
+
+	for _, fn := range fns {
+		fn(&d.opts)
+	}
+
+	err = d.opts.Validate()
+	if err == nil {
+		d.ok("config", "options are valid")
+		return true
+	}
+
+	problems := []error{err}
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		problems = joined.Unwrap()
+	}
+	for _, problem := range problems {
+		d.fail("config", "correct the option in the configuration file, KVIX_* variables or flags", "%v", problem)
+	}
+	return d.opts.SegmentOptions != nil && d.opts.DataDir != ""
+}
+
+// checkDir checks that dir is a directory kvixd can write to, or that it can
+// be created.
+func (d *doctor) checkDir(check, dir string) {
+	info, err := os.Stat(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		parent := existingParent(dir)
+		if err := probeWrite(parent); err != nil {
+			d.fail(check, fmt.Sprintf("create %s or make %s writable by this user", dir, parent),
+				"%s does not exist and cannot be created: %v", dir, err)
+			return
+		}
+		d.ok(check, "%s does not exist yet and will be created", dir)
+		return
+	}
+
+	if err != nil {
+		d.fail(check, "check the path and its permissions", "cannot access %s: %v", dir, err)
+		return
+	}
+
+	if !info.IsDir() {
+		d.fail(check, "point it at a directory", "%s is not a directory", dir)
+		return
+	}
+
+	if err := probeWrite(dir); err != nil {
+		d.fail(check, fmt.Sprintf("chown or chmod %s so this user can write to it", dir),
+			"%s is not writable: %v", dir, err)
+		return
+	}
+	d.ok(check, "%s is writable (mode %s)", dir, info.Mode().Perm())
+}
+
+// checkFreeSpace checks that the file system holding the segments has room
+// for a few more segments.
+func (d *doctor) checkFreeSpace() {
+	dir := existingParent(d.opts.SegmentOptions.Directory)
+
+	free, err := filesys.FreeSpace(dir)
+	if errors.Is(err, filesys.ErrFreeSpaceUnsupported) {
+		d.ok("free-space", "not reported on this platform")
+		return
+	}
+	if err != nil {
+		d.warn("free-space", "check the path and its permissions", "cannot read free space of %s: %v", dir, err)
+		return
+	}
+
+	needed := minFreeSegments * d.opts.SegmentOptions.Size
+	if uint64(free) < needed {
+		d.fail("free-space", "free up space or lower the segment size",
+			"%s has %s free, less than %d segments of %s",
+			dir, formatBytes(uint64(free)), minFreeSegments, formatBytes(d.opts.SegmentOptions.Size))
+		return
+	}
+	d.ok("free-space", "%s free on %s", formatBytes(uint64(free)), dir)
+}
+
+// checkLeftovers looks for temporary files left by interrupted writes and for
+// lock files, which kvix does not create and which usually mean another tool
+// manages the directory.
+func (d *doctor) checkLeftovers() {
+	found := false
+	for _, dir := range d.dirs() {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+
+		for _, entry := range entries {
+			name := entry.Name()
+			path := filepath.Join(dir, name)
+
+			switch {
+			case strings.HasSuffix(name, ".tmp"):
+				found = true
+				d.warn("leftovers", "remove it while kvixd is stopped",
+					"%s was left by an interrupted write", path)
+			case strings.HasSuffix(name, ".lock") || name == "LOCK":
+				found = true
+				d.warn("leftovers", "make sure no other process uses the data directory, then remove it",
+					"lock file %s found", path)
+			}
+		}
+	}
+
+	if !found {
+		d.ok("leftovers", "no temporary or lock files")
+	}
+}
+
+// checkSegments checks that segment files follow the configured naming, that
+// no two share an id, and that they live where the partition count expects.
+func (d *doctor) checkSegments() {
+	prefix := d.opts.SegmentOptions.Prefix
+	root := d.opts.SegmentOptions.Directory
+
+	if d.opts.Partitions > 1 {
+		if paths, _ := seginfo.ListSegmentPaths(filesys.OS, root, prefix); len(paths) > 0 {
+			d.fail("segments", "open with the partition count the data was written with",
+				"%s holds %d unpartitioned segments but %d partitions are configured", root, len(paths), d.opts.Partitions)
+		}
+	} else if matches, _ := filepath.Glob(filepath.Join(root, "p[0-9][0-9]")); len(matches) > 0 {
+		d.fail("segments", "open with -partitions set to the partition count the data was written with",
+			"%s holds partition directories but partitions are not configured", root)
+	}
+
+	total := 0
+	for _, dir := range d.segmentDirs() {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+
+		ids := make(map[uint16]string)
+		for _, entry := range entries {
+			name := entry.Name()
+			if entry.IsDir() || !strings.HasSuffix(name, ".seg") {
+				continue
+			}
+			path := filepath.Join(dir, name)
+
+			if !strings.HasPrefix(name, prefix+"_") {
+				d.warn("segments", fmt.Sprintf("set the segment prefix it was written with, or move it out of %s", dir),
+					"%s does not use the configured prefix %q and will be ignored", path, prefix)
+				continue
+			}
+
+			id, err := seginfo.ParseSegmentID(path, prefix)
+			if err == nil {
+				_, err = seginfo.ParseSegmentTimestamp(path, prefix)
+			}
+			if err != nil {
+				d.fail("segments", "rename or remove the file", "%s is not named prefix_ID_timestamp.seg: %v", path, err)
+				continue
+			}
+
+			if other, ok := ids[id]; ok {
+				d.fail("segments", "restore the directory from a backup or remove the stray copy",
+					"%s and %s share segment id %d", other, path, id)
+				continue
+			}
+			ids[id] = path
+			total++
+		}
+	}
+	d.ok("segments", "%d segment files found", total)
+}
+
+// checkFileLimit checks that the open file limit covers every segment, which
+// stays open unless WithMaxOpenSegments caps it, plus headroom for clients.
+func (d *doctor) checkFileLimit() {
+	soft, hard, err := fileLimit()
+	if errors.Is(err, errFileLimitUnsupported) {
+		d.ok("file-limit", "not reported on this platform")
+		return
+	}
+	if err != nil {
+		d.warn("file-limit", "check ulimit -n", "cannot read the open file limit: %v", err)
+		return
+	}
+
+	needed := uint64(d.opts.MaxOpenSegments)
+	if needed == 0 {
+		for _, dir := range d.segmentDirs() {
+			paths, _ := seginfo.ListSegmentPaths(filesys.OS, dir, d.opts.SegmentOptions.Prefix)
+			needed += uint64(len(paths))
+		}
+	}
+	needed += 256
+
+	if soft < needed {
+		d.warn("file-limit", fmt.Sprintf("raise it with ulimit -n (hard limit %d) or set max_open_segments", hard),
+			"open file limit %d is below the %d kvixd may need", soft, needed)
+		return
+	}
+	d.ok("file-limit", "open file limit %d covers the %d kvixd may need", soft, needed)
+}
+
+// dirs returns the data directory and every segment directory.
+func (d *doctor) dirs() []string {
+	dirs := []string{d.opts.DataDir}
+	for _, dir := range d.segmentDirs() {
+		if dir != d.opts.DataDir {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
+
+// segmentDirs returns the directories holding segments, one per partition.
+func (d *doctor) segmentDirs() []string {
+	root := d.opts.SegmentOptions.Directory
+	if d.opts.Partitions <= 1 {
+		return []string{root}
+	}
+
+	dirs := make([]string, 0, d.opts.Partitions)
+	for i := range d.opts.Partitions {
+		dirs = append(dirs, filepath.Join(root, fmt.Sprintf("p%02d", i)))
+	}
+	return dirs
+}
+
+// existingParent returns dir or its closest ancestor that exists.
+func existingParent(dir string) string {
+	for {
+		if _, err := os.Stat(dir); err == nil {
+			return dir
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return dir
+		}
+		dir = parent
+	}
+}
+
+// probeWrite creates and removes a file in dir.
+func probeWrite(dir string) error {
+	file, err := os.CreateTemp(dir, ".kvix-doctor-*")
+	if err != nil {
+		return err
+	}
+
+	file.Close()
+	return os.Remove(file.Name())
+}
+
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,8 @@
+//go:build !(linux || darwin || freebsd)
+
+package main
+
+// fileLimit returns the soft and hard limits on open files.
+func fileLimit() (uint64, uint64, error) {
+	return 0, 0, errFileLimitUnsupported
+}
@@ -0,0 +1,56 @@
+//go:build grpc
+
+package main
+
+import (
+	"context"
+	"flag"
+	"net"
+
+	"google.golang.org/grpc"
+
+	"github.com/iamBelugaa/kvix/internal/rpc"
+)
+
+func init() {
+	commands["serve-grpc"] = serveGRPCCommand
+}
+
+func serveGRPCCommand(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("serve-grpc", flag.ContinueOnError)
+	opts := registerInstanceFlags(flags)
+	addr := flags.String("addr", ":6381", "address to serve gRPC on")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	cfg, err := opts.configFile()
+	if err != nil {
+		return err
+	}
+
+	log, err := opts.logger("kvixd-grpc")
+	if err != nil {
+		return err
+	}
+
+	instance, err := opts.open(ctx)
+	if err != nil {
+		return err
+	}
+	defer instance.Close()
+
+	listener, err := net.Listen("tcp", opts.listenAddr("addr", *addr, cfg.grpcAddr))
+	if err != nil {
+		return err
+	}
+
+	server := grpc.NewServer()
+	rpc.Register(server, log, instance)
+
+	stop := context.AfterFunc(ctx, server.GracefulStop)
+	defer stop()
+
+	return server.Serve(listener)
+}
@@ -2,53 +2,36 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"log"
-
-	"github.com/iamBelugaa/kvix/pkg/errors"
-	"github.com/iamBelugaa/kvix/pkg/kvix"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
 )
 
 func main() {
-	cache, err := kvix.NewInstance(context.Background(), "kvix")
-	if err != nil {
-		if err, ok := errors.AsStorageError(err); ok {
-			log.Printf("Code: %#v \n", err.Code())
-			log.Printf("Details: %#v \n", err.Details())
-			log.Printf("Error: %#v \n", err.Error())
-			log.Printf("FileName: %#v \n", err.FileName())
-			log.Printf("Offset: %#v \n", err.Offset())
-			log.Printf("Path: %#v \n", err.Path())
-			log.Printf("SegmentId: %#v \n", err.SegmentId())
-		}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Without a subcommand kvixd runs as a server, so flags may be passed
+	// directly: kvixd -addr :6380 -data-dir /var/lib/kvix.
+	name, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
 	}
 
-	defer func() {
-		if err := cache.Close(); err != nil {
-			log.Fatalf("instance close error : %#v \n", err)
+	command, ok := commands[name]
+	if !ok {
+		names := make([]string, 0, len(commands))
+		for name := range commands {
+			names = append(names, name)
 		}
-	}()
-
-	key := []byte("user:123")
-	value := []byte("This is some personal data")
-
-	if err := cache.Set(context.Background(), key, value); err != nil {
-		log.Fatalf("set operation error : %#v \n", err)
+		sort.Strings(names)
+		log.Fatalf("unknown command %q, expected one of: %s \n", name, strings.Join(names, ", "))
 	}
 
-	record, err := cache.Get(context.Background(), key)
-	if err != nil {
-		if err, ok := errors.AsStorageError(err); ok {
-			log.Printf("Code: %#v \n", err.Code())
-			log.Printf("Details: %#v \n", err.Details())
-			log.Printf("Error: %#v \n", err.Error())
-			log.Printf("FileName: %#v \n", err.FileName())
-			log.Printf("Offset: %#v \n", err.Offset())
-			log.Printf("Path: %#v \n", err.Path())
-			log.Printf("SegmentId: %#v \n", err.SegmentId())
-		}
+	if err := command(ctx, args); err != nil {
+		log.Fatalf("%s: %v \n", name, err)
 	}
-
-	jsonData, _ := json.MarshalIndent(record, "", "  ")
-	println(string(jsonData))
 }
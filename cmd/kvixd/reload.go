@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/iamBelugaa/kvix/pkg/kvix"
+	"github.com/iamBelugaa/kvix/pkg/options"
+)
+
+// watchReloads reconfigures instance on SIGHUP, and when the configuration
+// file changes if interval is positive, until ctx is done. A reload that
+// fails, for a malformed file or a change to a setting that needs a restart,
+// is logged and leaves the instance as it was.
+func (f *instanceFlags) watchReloads(
+	ctx context.Context, instance *kvix.Instance, interval time.Duration, extra ...options.OptionFunc,
+) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+
+	var poll <-chan time.Time
+	if interval > 0 && *f.config != "" {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		poll = ticker.C
+	}
+
+	modified := f.configModified()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangup:
+		case <-poll:
+			current := f.configModified()
+			if current.Equal(modified) {
+				continue
+			}
+			modified = current
+		}
+
+		if err := f.reload(instance, extra...); err != nil {
+			log.Printf("Configuration reload failed, keeping the current settings: %v \n", err)
+			continue
+		}
+		log.Printf("Configuration reloaded \n")
+	}
+}
+
+// reload reads the configuration file again and applies the settings it,
+// the environment and the flags produce, starting from the defaults so that
+// settings removed from the file revert.
+func (f *instanceFlags) reload(instance *kvix.Instance, extra ...options.OptionFunc) error {
+	f.loaded = nil
+
+	opts, err := f.options(extra...)
+	if err != nil {
+		return err
+	}
+	return instance.Reconfigure(append([]options.OptionFunc{options.WithDefaultOptions()}, opts...)...)
+}
+
+// configModified returns when the configuration file last changed, or the
+// zero time if there is none or it cannot be read.
+func (f *instanceFlags) configModified() time.Time {
+	if *f.config == "" {
+		return time.Time{}
+	}
+
+	info, err := os.Stat(*f.config)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
@@ -0,0 +1,46 @@
+package backup
+
+import "time"
+
+const (
+	FormatVersion = 1
+
+	ManifestName   = "MANIFEST.json"
+	HintName       = "index.hint"
+	SegmentsPrefix = "segments/"
+)
+
+type Manifest struct {
+	FormatVersion int           `json:"formatVersion"`
+	CreatedAt     time.Time     `json:"createdAt"`
+	SegmentPrefix string        `json:"segmentPrefix"`
+	Partitions    int           `json:"partitions"`
+	Keys          int           `json:"keys"`
+	Files         []FileEntry   `json:"files"`
+	HighWater     []PartitionHW `json:"highWater"`
+}
+
+// FileEntry records the size and CRC32 (IEEE) of every file in the archive
+// other than the manifest itself.
+type FileEntry struct {
+	Name     string `json:"name"`
+	Size     int64  `json:"size"`
+	Checksum uint32 `json:"checksum"`
+}
+
+type PartitionHW struct {
+	Partition     uint8  `json:"partition"`
+	ActiveSegment string `json:"activeSegment"`
+	Offset        int64  `json:"offset"`
+}
+
+// HintHeader precedes the key bytes of every entry in the index hint file.
+type HintHeader struct {
+	ExpiresAt        int64
+	Offset           int64
+	SegmentTimestamp int64
+	Size             uint32
+	SegmentID        uint16
+	KeyLength        uint16
+	Partition        uint8
+}
@@ -0,0 +1,185 @@
+package backup
+
+import (
+	"archive/tar"
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	stdErrors "errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	ErrDataDirNotEmpty   = stdErrors.New("restore target directory is not empty")
+	ErrMissingManifest   = stdErrors.New("backup archive has no manifest")
+	ErrUnsupportedBackup = stdErrors.New("unsupported backup format version")
+	ErrUnsafePath        = stdErrors.New("backup archive contains an unsafe path")
+)
+
+// Restore unpacks a backup archive into dataDir, which must be empty or not
+// exist. Files are staged in a sibling directory and only moved into place
+// after every checksum in the manifest has been verified.
+func Restore(ctx context.Context, r io.Reader, dataDir string) (*Manifest, error) {
+	if entries, err := os.ReadDir(dataDir); err == nil && len(entries) > 0 {
+		return nil, ErrDataDirNotEmpty
+	} else if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	staging, err := os.MkdirTemp(filepath.Dir(filepath.Clean(dataDir)), ".kvix-restore-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(staging)
+
+	manifest, files, err := unpack(ctx, tar.NewReader(r), staging)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := verify(manifest, files); err != nil {
+		return nil, err
+	}
+
+	if err := os.Remove(dataDir); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if err := os.Rename(staging, dataDir); err != nil {
+		return nil, err
+	}
+
+	return manifest, nil
+}
+
+func unpack(ctx context.Context, tr *tar.Reader, staging string) (*Manifest, map[string]FileEntry, error) {
+	var manifest *Manifest
+	files := make(map[string]FileEntry)
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, nil, err
+		}
+
+		header, err := tr.Next()
+		if err != nil {
+			if stdErrors.Is(err, io.EOF) {
+				break
+			}
+			return nil, nil, err
+		}
+
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		if header.Name == ManifestName {
+			manifest = &Manifest{}
+			if err := json.NewDecoder(tr).Decode(manifest); err != nil {
+				return nil, nil, fmt.Errorf("failed to decode manifest: %w", err)
+			}
+			continue
+		}
+
+		name := path.Clean(header.Name)
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return nil, nil, fmt.Errorf("%w: %s", ErrUnsafePath, header.Name)
+		}
+
+		entry, err := extract(tr, filepath.Join(staging, filepath.FromSlash(name)))
+		if err != nil {
+			return nil, nil, err
+		}
+
+		entry.Name = name
+		files[name] = entry
+	}
+
+	if manifest == nil {
+		return nil, nil, ErrMissingManifest
+	}
+
+	if manifest.FormatVersion != FormatVersion {
+		return nil, nil, fmt.Errorf("%w: %d", ErrUnsupportedBackup, manifest.FormatVersion)
+	}
+
+	return manifest, files, nil
+}
+
+func extract(r io.Reader, target string) (FileEntry, error) {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return FileEntry{}, err
+	}
+
+	file, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return FileEntry{}, err
+	}
+	defer file.Close()
+
+	hash := crc32.NewIEEE()
+	size, err := io.Copy(file, io.TeeReader(r, hash))
+	if err != nil {
+		return FileEntry{}, err
+	}
+
+	if err := file.Sync(); err != nil {
+		return FileEntry{}, err
+	}
+
+	return FileEntry{Size: size, Checksum: hash.Sum32()}, nil
+}
+
+func verify(manifest *Manifest, files map[string]FileEntry) error {
+	for _, expected := range manifest.Files {
+		actual, ok := files[expected.Name]
+		if !ok {
+			return fmt.Errorf("backup archive is missing %s", expected.Name)
+		}
+
+		if actual.Size != expected.Size || actual.Checksum != expected.Checksum {
+			return fmt.Errorf(
+				"checksum mismatch for %s: expected %d bytes with crc %08x, got %d bytes with crc %08x",
+				expected.Name, expected.Size, expected.Checksum, actual.Size, actual.Checksum,
+			)
+		}
+
+		delete(files, expected.Name)
+	}
+
+	for name := range files {
+		return fmt.Errorf("backup archive contains %s, which is not listed in the manifest", name)
+	}
+
+	return nil
+}
+
+// ReadHint decodes an index hint file, calling fn for every entry.
+func ReadHint(r io.Reader, fn func(key string, header HintHeader) error) error {
+	reader := bufio.NewReader(r)
+	for {
+		var header HintHeader
+		if err := binary.Read(reader, binary.LittleEndian, &header); err != nil {
+			if stdErrors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+
+		key := make([]byte, header.KeyLength)
+		if _, err := io.ReadFull(reader, key); err != nil {
+			return err
+		}
+
+		if err := fn(string(key), header); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package backup
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"hash/crc32"
+	"io"
+	"time"
+)
+
+// Writer streams a backup archive. Files are written in the order they are
+// added and the manifest, carrying every file's checksum, is appended last.
+type Writer struct {
+	tw       *tar.Writer
+	manifest Manifest
+}
+
+func NewWriter(w io.Writer, manifest Manifest) *Writer {
+	manifest.FormatVersion = FormatVersion
+	return &Writer{tw: tar.NewWriter(w), manifest: manifest}
+}
+
+func (w *Writer) AddFile(name string, size int64, modTime time.Time, r io.Reader) error {
+	header := &tar.Header{
+		Name:     name,
+		Size:     size,
+		Mode:     0644,
+		ModTime:  modTime,
+		Typeflag: tar.TypeReg,
+	}
+
+	if err := w.tw.WriteHeader(header); err != nil {
+		return err
+	}
+
+	hash := crc32.NewIEEE()
+	written, err := io.Copy(w.tw, io.TeeReader(io.LimitReader(r, size), hash))
+	if err != nil {
+		return err
+	}
+
+	if written != size {
+		return io.ErrUnexpectedEOF
+	}
+
+	w.manifest.Files = append(w.manifest.Files, FileEntry{Name: name, Size: size, Checksum: hash.Sum32()})
+	return nil
+}
+
+func (w *Writer) Close() error {
+	data, err := json.MarshalIndent(w.manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	header := &tar.Header{
+		Name:     ManifestName,
+		Size:     int64(len(data)),
+		Mode:     0644,
+		ModTime:  w.manifest.CreatedAt,
+		Typeflag: tar.TypeReg,
+	}
+
+	if err := w.tw.WriteHeader(header); err != nil {
+		return err
+	}
+
+	if _, err := w.tw.Write(data); err != nil {
+		return err
+	}
+
+	return w.tw.Close()
+}
@@ -0,0 +1,400 @@
+package changefeed
+
+import (
+	"bufio"
+	"encoding/binary"
+	stdErrors "errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"github.com/iamBelugaa/kvix/pkg/errors"
+	"github.com/iamBelugaa/kvix/pkg/filesys"
+)
+
+// Open opens the log under dataDir on fsys, creating it on first use. A torn
+// entry left at the end by a crash is cut off. Once the files hold more than
+// retention bytes the oldest are removed. With syncEach every append is
+// fsynced before it returns.
+func Open(
+	fsys filesys.FileSystem, dataDir string, retention int64, syncEach bool, log *zap.SugaredLogger,
+) (*Log, error) {
+	dir := filepath.Join(dataDir, DirName)
+	if err := filesys.CreateDir(fsys, dir, 0755, true); err != nil {
+		return nil, errors.NewStorageError(err, errors.ErrIOGeneral, "Failed to create change feed directory").
+			WithPath(dir)
+	}
+
+	l := &Log{
+		fsys:      fsys,
+		dir:       dir,
+		retention: retention,
+		fileSize:  min(retention/4, maxFileSize),
+		syncEach:  syncEach,
+		log:       log,
+	}
+
+	files, err := listFiles(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(files) == 0 {
+		l.next = 1
+		if err := l.createFile(); err != nil {
+			return nil, err
+		}
+		return l, nil
+	}
+
+	l.files = files
+	if err := l.recoverActive(); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// SetSyncEach changes whether appends are fsynced before they return.
+func (l *Log) SetSyncEach(syncEach bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.syncEach = syncEach
+}
+
+// Append assigns entry the next sequence number and writes it. An entry that
+// fails to be written is cut off again, and its sequence number goes to the
+// next entry.
+func (l *Log) Append(entry *Entry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entry.Sequence = l.next
+	encoded := encode(entry)
+
+	current := &l.files[len(l.files)-1]
+	if current.size > 0 && current.size+int64(len(encoded)) > l.fileSize {
+		if err := l.roll(); err != nil {
+			return err
+		}
+		current = &l.files[len(l.files)-1]
+	}
+
+	if _, err := l.active.Write(encoded); err != nil {
+		l.discard(current)
+		return errors.NewStorageError(err, errors.ErrIOWriteFailed, "Failed to append to change feed").
+			WithPath(current.path)
+	}
+
+	if l.syncEach {
+		if err := l.active.Sync(); err != nil {
+			l.discard(current)
+			return errors.NewStorageError(err, errors.ErrIOSyncFailed, "Failed to sync change feed").
+				WithPath(current.path)
+		}
+	}
+
+	current.size += int64(len(encoded))
+	l.next++
+	return nil
+}
+
+// Range returns the oldest retained sequence number and the one the next
+// append will get. The log is empty when they are equal.
+func (l *Log) Range() (uint64, uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.files[0].first, l.next
+}
+
+// Read calls fn with every entry from sequence from up to the end of the log
+// as of the call, in order, and returns the sequence to continue from.
+func (l *Log) Read(from uint64, fn func(Entry) error) (uint64, error) {
+	l.mu.Lock()
+	files := slices.Clone(l.files)
+	end := l.next
+	l.mu.Unlock()
+
+	if from < files[0].first {
+		return from, ErrTruncated
+	}
+
+	if from > end {
+		return from, errors.NewValidationError(
+			nil, errors.ErrValidationInvalidData, fmt.Sprintf("Sequence %d has not been written yet", from),
+		).
+			WithProvided(from).
+			WithExpected(fmt.Sprintf("at most %d", end))
+	}
+
+	for i, file := range files {
+		if from >= end {
+			break
+		}
+
+		// Every entry of this file precedes from.
+		if i+1 < len(files) && files[i+1].first <= from {
+			continue
+		}
+
+		_, err := scanFile(l.fsys, file.path, file.size, func(entry Entry) error {
+			if entry.Sequence < from || entry.Sequence >= end {
+				return nil
+			}
+
+			if err := fn(entry); err != nil {
+				return err
+			}
+			from = entry.Sequence + 1
+			return nil
+		})
+		if os.IsNotExist(err) {
+			// Retention removed the file while it was being read.
+			return from, ErrTruncated
+		}
+		if err != nil {
+			return from, err
+		}
+	}
+
+	return from, nil
+}
+
+// Sync fsyncs the file being appended to.
+func (l *Log) Sync() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.active.Sync(); err != nil {
+		return errors.NewStorageError(err, errors.ErrIOSyncFailed, "Failed to sync change feed").
+			WithPath(l.active.Name())
+	}
+	return nil
+}
+
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.active.Sync(); err != nil {
+		l.active.Close()
+		return errors.NewStorageError(err, errors.ErrIOSyncFailed, "Failed to sync change feed").
+			WithPath(l.active.Name())
+	}
+
+	if err := l.active.Close(); err != nil {
+		return errors.NewStorageError(err, errors.ErrIOCloseFailed, "Failed to close change feed").
+			WithPath(l.active.Name())
+	}
+	return nil
+}
+
+// discard cuts the active file back to its last whole entry after a failed
+// append, so the entries appended next do not follow a torn one that would
+// end every read of the file there. Callers must hold mu.
+func (l *Log) discard(current *logFile) {
+	if err := l.active.Truncate(current.size); err != nil {
+		l.log.Errorw("Failed to cut off failed change feed append", "path", current.path, "size", current.size, "error", err)
+	}
+}
+
+// roll seals the current file, starts a new one and trims the oldest files
+// beyond retention. Callers must hold mu.
+func (l *Log) roll() error {
+	if err := l.active.Sync(); err != nil {
+		return errors.NewStorageError(err, errors.ErrIOSyncFailed, "Failed to sync change feed").
+			WithPath(l.active.Name())
+	}
+
+	if err := l.active.Close(); err != nil {
+		return errors.NewStorageError(err, errors.ErrIOCloseFailed, "Failed to close change feed file").
+			WithPath(l.active.Name())
+	}
+
+	if err := l.createFile(); err != nil {
+		return err
+	}
+
+	var total int64
+	for _, file := range l.files {
+		total += file.size
+	}
+
+	for total > l.retention && len(l.files) > 1 {
+		oldest := l.files[0]
+		if err := l.fsys.Remove(oldest.path); err != nil && !os.IsNotExist(err) {
+			l.log.Warnw("Failed to remove change feed file past retention", "path", oldest.path, "error", err)
+			break
+		}
+
+		total -= oldest.size
+		l.files = l.files[1:]
+	}
+
+	return nil
+}
+
+// createFile starts the file whose first entry will be l.next. Callers must
+// hold mu or own l exclusively.
+func (l *Log) createFile() error {
+	path := filepath.Join(l.dir, fmt.Sprintf("%020d%s", l.next, fileExtension))
+
+	file, err := l.fsys.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return errors.NewStorageError(err, errors.ErrIOGeneral, "Failed to create change feed file").
+			WithPath(path)
+	}
+
+	l.active = file
+	l.files = append(l.files, logFile{first: l.next, path: path})
+	return nil
+}
+
+// recoverActive reopens the newest file, cutting off a torn entry at its end,
+// and continues the sequence after its last entry.
+func (l *Log) recoverActive() error {
+	last := &l.files[len(l.files)-1]
+
+	l.next = last.first
+	valid, err := scanFile(l.fsys, last.path, last.size, func(entry Entry) error {
+		l.next = entry.Sequence + 1
+		return nil
+	})
+	if err != nil && err != errTorn {
+		return err
+	}
+
+	if valid < last.size {
+		l.log.Warnw("Truncating torn change feed entry", "path", last.path, "validBytes", valid, "fileBytes", last.size)
+		if err := l.fsys.Truncate(last.path, valid); err != nil {
+			return errors.NewStorageError(err, errors.ErrIOGeneral, "Failed to truncate change feed file").
+				WithPath(last.path)
+		}
+		last.size = valid
+	}
+
+	file, err := l.fsys.OpenFile(last.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return errors.NewStorageError(err, errors.ErrIOGeneral, "Failed to open change feed file").
+			WithPath(last.path)
+	}
+
+	l.active = file
+	return nil
+}
+
+func listFiles(fsys filesys.FileSystem, dir string) ([]logFile, error) {
+	paths, err := fsys.Glob(filepath.Join(dir, "*"+fileExtension))
+	if err != nil {
+		return nil, errors.NewStorageError(err, errors.ErrIOGeneral, "Failed to list change feed files").
+			WithPath(dir)
+	}
+
+	var files []logFile
+	for _, path := range paths {
+		name := filepath.Base(path)
+		first, err := strconv.ParseUint(strings.TrimSuffix(name, fileExtension), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		info, err := fsys.Stat(path)
+		if err != nil {
+			return nil, errors.NewStorageError(err, errors.ErrIOGeneral, "Failed to stat change feed file").
+				WithFileName(name)
+		}
+
+		files = append(files, logFile{first: first, path: filepath.Join(dir, name), size: info.Size()})
+	}
+
+	slices.SortFunc(files, func(a, b logFile) int {
+		switch {
+		case a.first < b.first:
+			return -1
+		case a.first > b.first:
+			return 1
+		}
+		return 0
+	})
+	return files, nil
+}
+
+func encode(entry *Entry) []byte {
+	header := entryHeader{
+		Sequence:    entry.Sequence,
+		Time:        entry.Time,
+		ExpiresAt:   entry.ExpiresAt,
+		ValueLength: uint32(len(entry.Value)),
+		KeyLength:   uint16(len(entry.Key)),
+		Type:        entry.Type,
+	}
+
+	buffer := make([]byte, 0, entryHeaderSize+int64(len(entry.Key)+len(entry.Value)))
+	buffer, _ = binary.Append(buffer, binary.LittleEndian, header)
+	buffer = append(buffer, entry.Key...)
+	buffer = append(buffer, entry.Value...)
+
+	binary.LittleEndian.PutUint32(buffer, crc32.ChecksumIEEE(buffer[4:]))
+	return buffer
+}
+
+// errTorn reports an entry cut short or failing its checksum.
+var errTorn = stdErrors.New("change feed entry is torn or corrupted")
+
+// scanFile calls fn with the entries in the first size bytes of path and
+// returns how many bytes of whole, valid entries it read. An invalid entry
+// ends the scan with errTorn.
+func scanFile(fsys filesys.FileSystem, path string, size int64, fn func(Entry) error) (int64, error) {
+	file, err := fsys.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(io.LimitReader(file, size))
+	var valid int64
+	for valid < size {
+		var header entryHeader
+		if err := binary.Read(reader, binary.LittleEndian, &header); err != nil {
+			return valid, errTorn
+		}
+
+		// The checksum is only checked once the body is read, so lengths from
+		// a corrupted header must not size the buffer past the file.
+		bodySize := int64(header.KeyLength) + int64(header.ValueLength)
+		if bodySize > size-valid-entryHeaderSize {
+			return valid, errTorn
+		}
+
+		body := make([]byte, bodySize)
+		if _, err := io.ReadFull(reader, body); err != nil {
+			return valid, errTorn
+		}
+
+		entry := Entry{
+			Sequence:  header.Sequence,
+			Time:      header.Time,
+			ExpiresAt: header.ExpiresAt,
+			Type:      header.Type,
+			Key:       body[:header.KeyLength],
+			Value:     body[header.KeyLength:],
+		}
+		if encoded := encode(&entry); binary.LittleEndian.Uint32(encoded) != header.Checksum {
+			return valid, errTorn
+		}
+
+		if err := fn(entry); err != nil {
+			return valid, err
+		}
+		valid += entryHeaderSize + int64(len(body))
+	}
+
+	return valid, nil
+}
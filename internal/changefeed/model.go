@@ -0,0 +1,71 @@
+package changefeed
+
+import (
+	"encoding/binary"
+	stdErrors "errors"
+	"sync"
+
+	"go.uber.org/zap"
+
+	"github.com/iamBelugaa/kvix/pkg/filesys"
+)
+
+const (
+	// DirName is the directory under the data directory holding the log.
+	DirName = "changes"
+
+	fileExtension = ".changes"
+
+	// maxFileSize caps one log file; smaller retentions roll files at a
+	// quarter of the retention so trimming stays fine-grained.
+	maxFileSize = 64 << 20
+)
+
+// ErrTruncated is returned when a reader asks for changes that retention has
+// already removed.
+var ErrTruncated = stdErrors.New("requested changes are no longer retained")
+
+// Entry is one change in the log.
+type Entry struct {
+	Sequence  uint64
+	Time      int64
+	ExpiresAt int64
+	Type      uint8
+	Key       []byte
+	Value     []byte
+}
+
+// entryHeader is the fixed-size prefix of every entry. The key and value
+// follow it directly; Checksum covers the rest of the header and both.
+type entryHeader struct {
+	Checksum    uint32
+	Sequence    uint64
+	Time        int64
+	ExpiresAt   int64
+	ValueLength uint32
+	KeyLength   uint16
+	Type        uint8
+}
+
+var entryHeaderSize = int64(binary.Size(entryHeader{}))
+
+type logFile struct {
+	first uint64
+	path  string
+	size  int64
+}
+
+// Log is an append-only, size-bounded record of changes. Every entry gets the
+// next sequence number, starting at 1 and continuing across restarts.
+type Log struct {
+	mu        sync.Mutex
+	fsys      filesys.FileSystem
+	dir       string
+	retention int64
+	fileSize  int64
+	syncEach  bool
+	next      uint64
+	files     []logFile
+	active    filesys.File
+	log       *zap.SugaredLogger
+}
@@ -0,0 +1,136 @@
+package dedup
+
+import "crypto/sha256"
+
+func New() *Table {
+	return &Table{
+		byDigest:   make(map[Digest]*entry),
+		byLocation: make(map[Location]*entry),
+	}
+}
+
+func Sum(value []byte) Digest {
+	return sha256.Sum256(value)
+}
+
+// Acquire returns the location of an already stored payload with the given
+// digest and takes a reference on it.
+func (t *Table) Acquire(digest Digest) (Location, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	e, ok := t.byDigest[digest]
+	if !ok {
+		return Location{}, false
+	}
+
+	e.refs++
+	return e.location, true
+}
+
+// Register records a freshly written payload holding a single reference.
+// Writes of digest share it from then on; a payload registered earlier with
+// the same digest keeps the references it has.
+func (t *Table) Register(digest Digest, location Location) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	e := &entry{digest: digest, location: location, refs: 1, shared: true}
+	t.byDigest[digest] = e
+	t.byLocation[location] = e
+}
+
+// Restore tracks the payload at location, whose digest is digest, with refs
+// references, as the index holds them when the engine opens.
+func (t *Table) Restore(digest Digest, location Location, refs uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	e := &entry{digest: digest, location: location, refs: refs, shared: true}
+	if _, ok := t.byDigest[digest]; !ok {
+		t.byDigest[digest] = e
+	}
+	t.byLocation[location] = e
+}
+
+// Track records refs references on a payload that new writes must not share,
+// such as a record rewritten for one key or one whose digest is unknown.
+func (t *Table) Track(location Location, refs uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.byLocation[location] = &entry{location: location, refs: refs}
+}
+
+// Release drops a reference on the payload stored at location. It reports
+// whether that was the last one. A payload the table does not track was
+// never referenced through it, so releasing it reports false.
+func (t *Table) Release(location Location) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	e, ok := t.byLocation[location]
+	if !ok {
+		return false
+	}
+
+	if e.refs > 1 {
+		e.refs--
+		return false
+	}
+
+	delete(t.byLocation, location)
+	if e.shared && t.byDigest[e.digest] == e {
+		delete(t.byDigest, e.digest)
+	}
+	return true
+}
+
+// Relocate moves the payload tracked at from to to, preserving its reference
+// count. Compaction calls it after copying a shared payload to a new segment.
+func (t *Table) Relocate(from, to Location) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	e, ok := t.byLocation[from]
+	if !ok {
+		return false
+	}
+
+	delete(t.byLocation, from)
+	t.byLocation[to] = e
+	e.location = to
+	return true
+}
+
+// HasSegment reports whether any payload the table tracks is stored in the
+// given segment. A sealed segment that holds none never comes to, as payloads
+// are only registered where they are written.
+func (t *Table) HasSegment(partition uint8, segmentID uint16, timestamp int64) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for location := range t.byLocation {
+		if location.Partition == partition && location.SegmentID == segmentID && location.SegmentTimestamp == timestamp {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *Table) Refs(location Location) uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	e, ok := t.byLocation[location]
+	if !ok {
+		return 0
+	}
+	return e.refs
+}
+
+func (t *Table) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.byLocation)
+}
@@ -0,0 +1,33 @@
+package dedup
+
+import (
+	"crypto/sha256"
+	"sync"
+)
+
+type Digest [sha256.Size]byte
+
+type Location struct {
+	Offset           int64
+	SegmentTimestamp int64
+	Size             uint32
+	SegmentID        uint16
+	Partition        uint8
+}
+
+// entry is a stored payload. shared is false for one tracked only for its
+// references, which is never handed to new writes.
+type entry struct {
+	digest   Digest
+	location Location
+	refs     uint64
+	shared   bool
+}
+
+// Table tracks every payload keys point at by its location, and the one new
+// writes of each digest share.
+type Table struct {
+	mu         sync.Mutex
+	byDigest   map[Digest]*entry
+	byLocation map[Location]*entry
+}
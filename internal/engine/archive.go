@@ -0,0 +1,333 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/iamBelugaa/kvix/pkg/errors"
+	"github.com/iamBelugaa/kvix/pkg/filesys"
+)
+
+// archiveName lists the segments moved to object storage. Unlike the hint it
+// is rewritten as segments are archived, since their local copies are gone.
+const archiveName = "archive.json"
+
+// ArchivedSegment is a sealed segment whose only copy is in object storage.
+type ArchivedSegment struct {
+	Partition  uint8     `json:"partition"`
+	SegmentID  uint16    `json:"segmentId"`
+	Timestamp  int64     `json:"timestamp"`
+	Object     string    `json:"object"`
+	Size       int64     `json:"size"`
+	ArchivedAt time.Time `json:"archivedAt"`
+}
+
+type archiveState struct {
+	mu       sync.RWMutex
+	segments map[segmentKey]ArchivedSegment
+}
+
+// has reports whether segment was archived. It is false for every segment
+// when archiving is off.
+func (a *archiveState) has(segment segmentKey) bool {
+	if a == nil {
+		return false
+	}
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	_, ok := a.segments[segment]
+	return ok
+}
+
+func (a *archiveState) get(segment segmentKey) (ArchivedSegment, bool) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	archived, ok := a.segments[segment]
+	return archived, ok
+}
+
+// ArchivedSegments lists the segments moved to object storage, by partition
+// and then segment order.
+func (e *Engine) ArchivedSegments() []ArchivedSegment {
+	if e.archive == nil {
+		return nil
+	}
+
+	e.archive.mu.RLock()
+	defer e.archive.mu.RUnlock()
+
+	segments := make([]ArchivedSegment, 0, len(e.archive.segments))
+	for _, segment := range e.archive.segments {
+		segments = append(segments, segment)
+	}
+
+	slices.SortFunc(segments, func(a, b ArchivedSegment) int {
+		if a.Partition != b.Partition {
+			return int(a.Partition) - int(b.Partition)
+		}
+		return int(a.SegmentID) - int(b.SegmentID)
+	})
+	return segments
+}
+
+// stopContext returns a context cancelled when the engine closes, for
+// transfers too slow for Close to wait on.
+func (e *Engine) stopContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-e.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+func (e *Engine) archivePass() {
+	ctx, cancel := e.stopContext()
+	defer cancel()
+
+	archived, err := e.archiveSegments(ctx)
+	if err != nil {
+		e.log.Errorw("Segment archival failed", "archived", archived, "error", err)
+		return
+	}
+
+	if archived > 0 {
+		e.log.Infow("Archived idle segments", "count", archived)
+	}
+}
+
+// archiveSegments uploads the sealed segments nobody has read for
+// Archive.MinIdle, then deletes their local copies. Archived segments
+// fetched back for reads are deleted again once idle, without uploading.
+func (e *Engine) archiveSegments(ctx context.Context) (int, error) {
+	e.segmentsMu.Lock()
+	defer e.segmentsMu.Unlock()
+
+	// Segments read since the instance opened carry their last read time;
+	// the others count as read when it opened.
+	cutoff := time.Now().Add(-e.options.Archive.MinIdle)
+	if e.openedAt.After(cutoff) {
+		return 0, nil
+	}
+
+	var archived int
+	for _, p := range e.partitions {
+		paths, err := p.storage.SealedSegmentPaths()
+		if err != nil {
+			return archived, err
+		}
+
+		for _, path := range paths {
+			if err := ctx.Err(); err != nil {
+				return archived, err
+			}
+
+			segment, err := e.segmentKeyOf(p.id, path)
+			if err != nil {
+				return archived, err
+			}
+
+			if lastRead, ok := p.storage.SegmentLastRead(segment.id, segment.timestamp); ok && lastRead.After(cutoff) {
+				continue
+			}
+
+			if !e.archive.has(segment) {
+				if err := e.uploadSegment(ctx, path, segment); err != nil {
+					return archived, err
+				}
+				archived++
+			}
+
+			// A copy left behind by a crash, or pinned by a snapshot taken
+			// during the upload, is removed once nothing may be reading it.
+			// Snapshots pin their segments under every partition lock.
+			p.mu.Lock()
+			if !e.pins.pinned(segment) {
+				err = p.storage.RemoveSegment(path, segment.id, segment.timestamp)
+			}
+			p.mu.Unlock()
+			if err != nil {
+				return archived, err
+			}
+		}
+	}
+
+	return archived, nil
+}
+
+// uploadSegment stores a sealed segment in object storage and records it in
+// the archive manifest. The local copy is left for the caller to remove.
+func (e *Engine) uploadSegment(ctx context.Context, path string, segment segmentKey) error {
+	file, err := e.options.FileSystem.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		return errors.NewStorageError(err, errors.ErrIOGeneral, "Failed to open segment for archival").WithPath(path)
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return errors.NewStorageError(err, errors.ErrIOGeneral, "Failed to stat segment for archival").WithPath(path)
+	}
+
+	relative, err := filepath.Rel(e.options.SegmentOptions.Directory, path)
+	if err != nil {
+		return errors.NewStorageError(err, errors.ErrIOGeneral, "Failed to name archived segment").WithPath(path)
+	}
+	object := e.options.Archive.Prefix + filepath.ToSlash(relative)
+
+	if err := e.options.Archive.Uploader.Upload(ctx, object, file, stat.Size()); err != nil {
+		return errors.NewStorageError(err, errors.ErrIOWriteFailed, "Failed to upload segment").WithPath(path)
+	}
+
+	e.archive.mu.Lock()
+	e.archive.segments[segment] = ArchivedSegment{
+		Partition:  segment.partition,
+		SegmentID:  segment.id,
+		Timestamp:  segment.timestamp,
+		Object:     object,
+		Size:       stat.Size(),
+		ArchivedAt: time.Now(),
+	}
+	e.archive.mu.Unlock()
+
+	if err := e.persistArchive(); err != nil {
+		e.archive.mu.Lock()
+		delete(e.archive.segments, segment)
+		e.archive.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// segmentFetcher restores archived segments of partition from object storage
+// into the segment directory, where they are read like any other sealed
+// segment until the archive pass finds them idle again.
+func (e *Engine) segmentFetcher(partition uint8) func(uint16, int64, string) (bool, error) {
+	return func(segmentID uint16, timestamp int64, path string) (bool, error) {
+		segment, ok := e.archive.get(segmentKey{partition, segmentID, timestamp})
+		if !ok {
+			return false, nil
+		}
+
+		ctx, cancel := e.stopContext()
+		defer cancel()
+
+		started := time.Now()
+		if err := e.downloadSegment(ctx, segment, path); err != nil {
+			e.log.Errorw("Failed to fetch archived segment", "object", segment.Object, "error", err)
+			return false, err
+		}
+
+		elapsed := time.Since(started)
+		e.counters.archiveFetches.Add(1)
+		e.counters.archiveFetchBytes.Add(uint64(segment.Size))
+		e.counters.archiveFetchNanos.Add(uint64(elapsed))
+
+		e.log.Infow("Fetched archived segment", "object", segment.Object, "size", segment.Size, "elapsed", elapsed)
+		return true, nil
+	}
+}
+
+// downloadSegment writes an archived segment to path through a temporary
+// file, so a partial download is never read as the segment.
+func (e *Engine) downloadSegment(ctx context.Context, segment ArchivedSegment, path string) error {
+	tmpPath := path + ".tmp"
+	file, err := e.options.FileSystem.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return errors.NewStorageError(err, errors.ErrIOGeneral, "Failed to create fetched segment").
+			WithPath(tmpPath)
+	}
+	defer e.options.FileSystem.Remove(tmpPath)
+
+	if err := e.options.Archive.Downloader.Download(ctx, segment.Object, file); err != nil {
+		file.Close()
+		return errors.NewStorageError(err, errors.ErrIOGeneral, "Failed to download segment").
+			WithPath(path).
+			WithDetail("object", segment.Object)
+	}
+
+	if err := file.Close(); err != nil {
+		return errors.NewStorageError(err, errors.ErrIOWriteFailed, "Failed to write fetched segment").
+			WithPath(tmpPath)
+	}
+
+	stat, err := e.options.FileSystem.Stat(tmpPath)
+	if err != nil {
+		return errors.NewStorageError(err, errors.ErrIOGeneral, "Failed to stat fetched segment").
+			WithPath(tmpPath)
+	}
+
+	if stat.Size() != segment.Size {
+		return errors.NewStorageError(nil, errors.ErrIOGeneral, "Fetched segment has the wrong size").
+			WithPath(path).
+			WithDetail("object", segment.Object).
+			WithDetail("size", stat.Size()).
+			WithDetail("expectedSize", segment.Size)
+	}
+
+	if err := e.options.FileSystem.Rename(tmpPath, path); err != nil {
+		return errors.NewStorageError(err, errors.ErrIOGeneral, "Failed to restore fetched segment").
+			WithPath(path)
+	}
+	return nil
+}
+
+// persistArchive rewrites the archive manifest through a temporary file and a
+// rename, so a crash never loses track of segments already uploaded.
+func (e *Engine) persistArchive() error {
+	data, err := json.Marshal(e.ArchivedSegments())
+	if err != nil {
+		return errors.NewStorageError(err, errors.ErrRecordSerialization, "Failed to encode archive manifest")
+	}
+
+	path := filepath.Join(e.options.DataDir, archiveName)
+	tmpPath := path + ".tmp"
+
+	if err := filesys.WriteFile(e.options.FileSystem, tmpPath, data, 0644); err != nil {
+		return errors.NewStorageError(err, errors.ErrIOWriteFailed, "Failed to write archive manifest").
+			WithPath(tmpPath)
+	}
+
+	if err := e.options.FileSystem.Rename(tmpPath, path); err != nil {
+		return errors.NewStorageError(err, errors.ErrIOGeneral, "Failed to replace archive manifest").
+			WithPath(path)
+	}
+	return nil
+}
+
+// loadArchive reads the archive manifest. It is kept when archiving is turned
+// off, so the segments it lists are still known to be archived.
+func (e *Engine) loadArchive() error {
+	path := filepath.Join(e.options.DataDir, archiveName)
+	data, err := filesys.ReadFile(e.options.FileSystem, path)
+	if os.IsNotExist(err) {
+		if e.options.Archive != nil {
+			e.archive = &archiveState{segments: make(map[segmentKey]ArchivedSegment)}
+		}
+		return nil
+	}
+	if err != nil {
+		return errors.NewStorageError(err, errors.ErrIOGeneral, "Failed to read archive manifest").WithPath(path)
+	}
+
+	var segments []ArchivedSegment
+	if err := json.Unmarshal(data, &segments); err != nil {
+		return errors.NewStorageError(err, errors.ErrRecordDeserialization, "Failed to decode archive manifest").
+			WithPath(path)
+	}
+
+	e.archive = &archiveState{segments: make(map[segmentKey]ArchivedSegment, len(segments))}
+	for _, segment := range segments {
+		e.archive.segments[segmentKey{segment.Partition, segment.SegmentID, segment.Timestamp}] = segment
+	}
+	return nil
+}
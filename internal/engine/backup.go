@@ -0,0 +1,245 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/iamBelugaa/kvix/internal/backup"
+	"github.com/iamBelugaa/kvix/internal/index"
+	"github.com/iamBelugaa/kvix/pkg/errors"
+	"github.com/iamBelugaa/kvix/pkg/filesys"
+	"github.com/iamBelugaa/kvix/pkg/options"
+)
+
+// Backup streams a snapshot of the engine to w as a tar archive holding the
+// segment files, an index hint file and a manifest. Writes continue while the
+// archive is produced; only data visible in the snapshot is included.
+func (e *Engine) Backup(ctx context.Context, w io.Writer) error {
+	snapshot, err := e.Snapshot(ctx)
+	if err != nil {
+		return err
+	}
+	defer snapshot.Release()
+
+	manifest := backup.Manifest{
+		CreatedAt:     snapshot.TakenAt(),
+		SegmentPrefix: e.options.SegmentOptions.Prefix,
+		Partitions:    len(e.partitions),
+		Keys:          snapshot.Len(),
+	}
+
+	for _, set := range snapshot.Segments() {
+		manifest.HighWater = append(manifest.HighWater, backup.PartitionHW{
+			Partition:     set.Partition,
+			ActiveSegment: e.archiveName(set.Active),
+			Offset:        set.HighWaterMark,
+		})
+	}
+
+	archive := backup.NewWriter(w, manifest)
+	for _, set := range snapshot.Segments() {
+		for _, path := range set.Sealed {
+			if err := e.archiveSegment(ctx, archive, path, -1); err != nil {
+				return err
+			}
+		}
+
+		if err := e.archiveSegment(ctx, archive, set.Active, set.HighWaterMark); err != nil {
+			return err
+		}
+	}
+
+	hint, err := encodeHint(snapshot)
+	if err != nil {
+		return errors.NewStorageError(err, errors.ErrRecordSerialization, "Failed to encode index hint")
+	}
+
+	if err := archive.AddFile(backup.HintName, int64(len(hint)), snapshot.TakenAt(), bytes.NewReader(hint)); err != nil {
+		return errors.NewStorageError(err, errors.ErrIOWriteFailed, "Failed to write index hint to backup")
+	}
+
+	if err := archive.Close(); err != nil {
+		return errors.NewStorageError(err, errors.ErrIOWriteFailed, "Failed to write backup manifest")
+	}
+
+	return nil
+}
+
+// archiveSegment copies a segment into the archive. A limit of -1 copies the
+// whole file; otherwise only the first limit bytes are included.
+func (e *Engine) archiveSegment(ctx context.Context, archive *backup.Writer, path string, limit int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	file, err := e.options.FileSystem.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		return errors.NewStorageError(err, errors.ErrIOGeneral, "Failed to open segment for backup").WithPath(path)
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return errors.NewStorageError(err, errors.ErrIOGeneral, "Failed to stat segment for backup").WithPath(path)
+	}
+
+	size := stat.Size()
+	if limit >= 0 && limit < size {
+		size = limit
+	}
+
+	if err := archive.AddFile(e.archiveName(path), size, stat.ModTime(), file); err != nil {
+		return errors.NewStorageError(err, errors.ErrIOWriteFailed, "Failed to write segment to backup").WithPath(path)
+	}
+
+	return nil
+}
+
+// archiveName maps a segment path to its name inside the archive, preserving
+// the partition subdirectory when there is one.
+func (e *Engine) archiveName(path string) string {
+	relative, err := filepath.Rel(e.options.SegmentOptions.Directory, path)
+	if err != nil {
+		relative = filepath.Base(path)
+	}
+	return backup.SegmentsPrefix + filepath.ToSlash(relative)
+}
+
+// loadHint seeds the index from an index hint left in the data directory by a
+// restore or a previous Close. Without the index log the hint is consumed:
+// once loaded it is removed so that it cannot resurrect keys deleted after
+// it was written. With the log it stays, as the base the log is replayed
+// over.
+func (e *Engine) loadHint() error {
+	path := filepath.Join(e.options.DataDir, backup.HintName)
+
+	file, err := e.options.FileSystem.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.NewStorageError(err, errors.ErrIOGeneral, "Failed to open index hint").WithPath(path)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return errors.NewStorageError(err, errors.ErrIOGeneral, "Failed to stat index hint").WithPath(path)
+	}
+	progress := e.startPhase(options.StartupIndex, info.Size())
+
+	var loaded int
+	err = backup.ReadHint(progress.reader(file), func(key string, header backup.HintHeader) error {
+		if int(header.Partition) >= len(e.partitions) {
+			return fmt.Errorf("hint references partition %d but only %d are configured", header.Partition, len(e.partitions))
+		}
+
+		pointer := &index.RecordPointer{
+			ExpiresAt:        header.ExpiresAt,
+			Offset:           header.Offset,
+			SegmentTimestamp: header.SegmentTimestamp,
+			Size:             header.Size,
+			SegmentID:        header.SegmentID,
+			Partition:        header.Partition,
+		}
+
+		if !pointer.IsExpired() {
+			e.index.Set(key, pointer)
+			loaded++
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.NewStorageError(err, errors.ErrRecordDeserialization, "Failed to load index hint").WithPath(path)
+	}
+
+	if !e.indexLogEnabled() {
+		if err := e.options.FileSystem.Remove(path); err != nil {
+			return errors.NewStorageError(err, errors.ErrIOGeneral, "Failed to remove consumed index hint").WithPath(path)
+		}
+	}
+	progress.finish()
+
+	e.log.Infow("Index seeded from hint", "keys", loaded, "path", path)
+	return nil
+}
+
+// persistHint writes the current index to the data directory so the next
+// open can seed the keyspace from it, the same way a restored backup does.
+// The file is written under a temporary name and renamed into place.
+func (e *Engine) persistHint() error {
+	for _, p := range e.partitions {
+		p.mu.Lock()
+	}
+	defer func() {
+		for _, p := range e.partitions {
+			p.mu.Unlock()
+		}
+	}()
+
+	return e.persistHintLocked()
+}
+
+// persistHintLocked is persistHint for callers already holding every
+// partition lock. With the index log it is a checkpoint: the log is rotated
+// before the index is copied and the rotated entries are dropped once the
+// hint holding them is in place.
+func (e *Engine) persistHintLocked() error {
+	if e.indexLog != nil {
+		if err := e.indexLog.Rotate(); err != nil {
+			return err
+		}
+	}
+
+	pointers, err := e.index.Snapshot()
+	if err != nil {
+		return err
+	}
+
+	hint, err := encodeHint(&Snapshot{pointers: pointers})
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(e.options.DataDir, backup.HintName)
+	if err := filesys.WriteFile(e.options.FileSystem, path+".tmp", hint, 0644); err != nil {
+		return errors.NewStorageError(err, errors.ErrIOWriteFailed, "Failed to write index hint").WithPath(path)
+	}
+
+	if err := e.options.FileSystem.Rename(path+".tmp", path); err != nil {
+		return errors.NewStorageError(err, errors.ErrIOGeneral, "Failed to install index hint").WithPath(path)
+	}
+
+	if e.indexLog != nil {
+		return e.indexLog.Checkpointed()
+	}
+	return nil
+}
+
+func encodeHint(snapshot *Snapshot) ([]byte, error) {
+	var buffer bytes.Buffer
+	for _, key := range snapshot.Keys() {
+		pointer := snapshot.pointers[key]
+		header := backup.HintHeader{
+			ExpiresAt:        pointer.ExpiresAt,
+			Offset:           pointer.Offset,
+			SegmentTimestamp: pointer.SegmentTimestamp,
+			Size:             pointer.Size,
+			SegmentID:        pointer.SegmentID,
+			KeyLength:        uint16(len(key)),
+			Partition:        pointer.Partition,
+		}
+
+		if err := binary.Write(&buffer, binary.LittleEndian, header); err != nil {
+			return nil, err
+		}
+		buffer.WriteString(key)
+	}
+
+	return buffer.Bytes(), nil
+}
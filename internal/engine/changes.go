@@ -0,0 +1,193 @@
+package engine
+
+import (
+	"context"
+	stdErrors "errors"
+	"fmt"
+	"time"
+
+	"github.com/iamBelugaa/kvix/internal/changefeed"
+	"github.com/iamBelugaa/kvix/pkg/errors"
+)
+
+var (
+	ErrChangeFeedDisabled = stdErrors.New("operation failed: change feed is not enabled")
+	// ErrChangesTruncated is returned for sequences retention has removed.
+	ErrChangesTruncated = changefeed.ErrTruncated
+)
+
+// ChangeStream delivers the change feed from a starting sequence: first the
+// retained history, then new changes as they happen.
+type ChangeStream struct {
+	events chan Event
+	err    error
+}
+
+// Events returns the changes in sequence order. It is closed when the stream
+// ends; Err then says why.
+func (s *ChangeStream) Events() <-chan Event {
+	return s.events
+}
+
+// Err returns what ended the stream: the context's error, ErrEngineClosed,
+// ErrChangesTruncated when the consumer fell behind retention, or an I/O
+// error. It must only be called after Events is closed.
+func (s *ChangeStream) Err() error {
+	return s.err
+}
+
+// ChangeRange returns the oldest retained sequence and the sequence the next
+// change will get.
+func (e *Engine) ChangeRange() (uint64, uint64, error) {
+	if e.feed == nil {
+		return 0, 0, ErrChangeFeedDisabled
+	}
+
+	first, next := e.feed.Range()
+	return first, next, nil
+}
+
+// Changes streams every change from sequence from onwards; zero starts at the
+// oldest retained change. A consumer resuming after a restart passes the
+// sequence after the last one it processed. Slow consumers do not lose
+// changes: when one falls behind the live feed it is served from disk until
+// it catches up, as long as retention still holds what it needs.
+func (e *Engine) Changes(ctx context.Context, from uint64) (*ChangeStream, error) {
+	if e.closed.Load() {
+		return nil, ErrEngineClosed
+	}
+
+	if e.feed == nil {
+		return nil, ErrChangeFeedDisabled
+	}
+
+	first, next := e.feed.Range()
+	if from == 0 {
+		from = first
+	}
+
+	if from < first {
+		return nil, errors.NewValidationError(
+			ErrChangesTruncated, errors.ErrValidationInvalidData,
+			fmt.Sprintf("Changes before sequence %d are no longer retained", first),
+		).
+			WithProvided(from).
+			WithExpected(fmt.Sprintf("%d to %d", first, next))
+	}
+
+	if from > next {
+		return nil, errors.NewValidationError(
+			nil, errors.ErrValidationInvalidData, fmt.Sprintf("Sequence %d has not been written yet", from),
+		).
+			WithProvided(from).
+			WithExpected(fmt.Sprintf("%d to %d", first, next))
+	}
+
+	stream := &ChangeStream{events: make(chan Event, 64)}
+	go e.streamChanges(ctx, stream, from)
+	return stream, nil
+}
+
+func (e *Engine) streamChanges(ctx context.Context, stream *ChangeStream, next uint64) {
+	defer close(stream.events)
+
+	send := func(event Event) error {
+		select {
+		case stream.events <- event:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-e.stop:
+			return ErrEngineClosed
+		}
+	}
+
+	for {
+		var err error
+		next, err = e.feed.Read(next, func(entry changefeed.Entry) error {
+			return send(eventFromEntry(entry))
+		})
+		if err != nil {
+			stream.err = err
+			return
+		}
+
+		w, err := e.watchFrom(next)
+		if err != nil {
+			stream.err = err
+			return
+		}
+
+		// More changes landed while reading; read them from disk too.
+		if w == nil {
+			continue
+		}
+
+		next, err = e.forwardLive(ctx, w, next, send)
+		if err != nil {
+			stream.err = err
+			return
+		}
+	}
+}
+
+// watchFrom registers a watcher on every key if the feed holds nothing from
+// next onwards, so that it receives exactly the changes from next. It returns
+// nil when the feed has moved past next.
+func (e *Engine) watchFrom(next uint64) (*watcher, error) {
+	e.publishMu.Lock()
+	defer e.publishMu.Unlock()
+
+	if _, end := e.feed.Range(); end != next {
+		return nil, nil
+	}
+	return e.addWatcher(nil)
+}
+
+// forwardLive relays w's events until it overflows, and returns the sequence
+// to resume reading the feed from.
+func (e *Engine) forwardLive(
+	ctx context.Context, w *watcher, next uint64, send func(Event) error,
+) (uint64, error) {
+	for {
+		select {
+		case <-ctx.Done():
+			e.unwatch(w)
+			return next, ctx.Err()
+		case event, ok := <-w.events:
+			if !ok {
+				return next, ErrEngineClosed
+			}
+
+			if event.Type == EventOverflow {
+				return next, nil
+			}
+
+			// Changes the feed failed to record have no sequence.
+			if event.Sequence == 0 {
+				continue
+			}
+
+			if err := send(event); err != nil {
+				e.unwatch(w)
+				return next, err
+			}
+			next = event.Sequence + 1
+		}
+	}
+}
+
+func eventFromEntry(entry changefeed.Entry) Event {
+	event := Event{
+		Sequence: entry.Sequence,
+		Type:     EventType(entry.Type),
+		Key:      entry.Key,
+		Value:    entry.Value,
+		Time:     time.Unix(0, entry.Time),
+	}
+
+	if entry.ExpiresAt != 0 {
+		event.ExpiresAt = time.Unix(0, entry.ExpiresAt)
+	}
+	return event
+}
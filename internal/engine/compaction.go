@@ -0,0 +1,323 @@
+package engine
+
+import (
+	"context"
+	stdErrors "errors"
+	"math"
+	"sync"
+	"sync/atomic"
+
+	"github.com/iamBelugaa/kvix/internal/dedup"
+	"github.com/iamBelugaa/kvix/internal/index"
+	"github.com/iamBelugaa/kvix/pkg/errors"
+	"github.com/iamBelugaa/kvix/pkg/options"
+)
+
+// ErrCompactionPaused is returned by Compact while compaction is paused, and
+// when a pass stops because PauseCompaction was called.
+var ErrCompactionPaused = stdErrors.New("operation failed: compaction is paused")
+
+// compactionControl paces compaction and lets it be paused. mu is held by
+// the pass in progress, so passes never overlap. The threshold and rates
+// can change while a pass runs, which picks them up from its next record.
+type compactionControl struct {
+	mu        sync.Mutex
+	paused    atomic.Bool
+	threshold atomic.Uint64
+	bytes     atomic.Pointer[tokenBucket]
+	records   atomic.Pointer[tokenBucket]
+}
+
+func newCompactionControl(opts *options.Options) *compactionControl {
+	c := &compactionControl{}
+	c.configure(opts)
+	return c
+}
+
+// configure applies CompactionThreshold, CompactionRate and
+// CompactionRecordRate from opts. A rate that did not change keeps its
+// bucket, and with it the debt of the pass in progress.
+func (c *compactionControl) configure(opts *options.Options) {
+	c.threshold.Store(math.Float64bits(opts.CompactionThreshold))
+	setRate(&c.bytes, float64(opts.CompactionRate))
+	setRate(&c.records, float64(opts.CompactionRecordRate))
+}
+
+func setRate(bucket *atomic.Pointer[tokenBucket], rate float64) {
+	current := bucket.Load()
+	if (current == nil && rate <= 0) || (current != nil && current.rate == rate) {
+		return
+	}
+	bucket.Store(newTokenBucket(rate))
+}
+
+func (c *compactionControl) garbageThreshold() float64 {
+	return math.Float64frombits(c.threshold.Load())
+}
+
+// pace waits until moving a record of size bytes, read once and written
+// once, fits CompactionRate and CompactionRecordRate.
+func (c *compactionControl) pace(ctx context.Context, size uint32) error {
+	if err := c.bytes.Load().take(ctx, 2*float64(size), false); err != nil {
+		return err
+	}
+	return c.records.Load().take(ctx, 1, false)
+}
+
+// PauseCompaction stops the pass in progress after the record it is moving
+// and keeps further passes from starting until ResumeCompaction. Records
+// moved so far stay moved.
+func (e *Engine) PauseCompaction() {
+	e.compaction.paused.Store(true)
+}
+
+// ResumeCompaction lets compaction run again. The next scheduled pass picks
+// up where a paused one stopped, since the segments it did not finish still
+// hold their garbage.
+func (e *Engine) ResumeCompaction() {
+	e.compaction.paused.Store(false)
+}
+
+// compactionPass starts a compaction of the segments whose garbage reached
+// the compaction threshold, unless one is running or compaction is paused.
+// The pass runs on a goroutine of its own, since a paced pass could hold up
+// the jobs of every instance sharing the scheduler.
+func (e *Engine) compactionPass() {
+	if e.compaction.paused.Load() || !e.compaction.mu.TryLock() {
+		return
+	}
+
+	e.wg.Add(1)
+	go func() {
+		defer e.wg.Done()
+		defer e.compaction.mu.Unlock()
+
+		ctx, cancel := e.stopContext()
+		defer cancel()
+
+		moved, err := e.compact(ctx)
+		switch {
+		case stdErrors.Is(err, ErrCompactionPaused):
+			e.log.Infow("Compaction paused", "records", moved)
+		case err != nil && !stdErrors.Is(err, ErrEngineClosed) && !stdErrors.Is(err, context.Canceled):
+			e.log.Errorw("Compaction failed", "records", moved, "error", err)
+		}
+	}()
+}
+
+// Compact copies the live records of every sealed segment whose tracked
+// garbage ratio reached CompactionThreshold forward to the active segment of
+// their key's partition, and returns how many it moved. The segments it
+// empties are deleted by segment garbage collection. Segments below the
+// threshold are left alone, however old, and so are segments holding
+// versions retained by the version history, which segment collection could
+// not delete anyway. It waits for a background pass in progress to finish
+// first.
+func (e *Engine) Compact(ctx context.Context) (int, error) {
+	if err := e.writable(); err != nil {
+		return 0, err
+	}
+
+	e.compaction.mu.Lock()
+	defer e.compaction.mu.Unlock()
+	return e.compact(ctx)
+}
+
+func (e *Engine) compact(ctx context.Context) (int, error) {
+	if e.compaction.paused.Load() {
+		return 0, ErrCompactionPaused
+	}
+
+	// Moving the live records out of a segment still holding retained
+	// versions would leave it pinned with the same garbage, to be picked
+	// again by every pass.
+	pinned := make(map[segmentKey]struct{})
+	e.history.segments(pinned)
+
+	var pointers map[string]index.RecordPointer
+	var moved int
+	for _, p := range e.partitions {
+		candidates, err := e.compactionCandidates(p, pinned)
+		if err != nil {
+			return moved, err
+		}
+
+		if len(candidates) == 0 {
+			continue
+		}
+
+		if pointers == nil {
+			if pointers, err = e.index.Snapshot(); err != nil {
+				return moved, err
+			}
+		}
+
+		e.runCompactionStartHooks(int(p.id))
+		opCtx, timer := e.startOp(ctx)
+		count, err := e.compactSegments(opCtx, candidates, pointers, timer)
+		e.logSlowOp(timer, "op", "compact", "partition", p.id, "segments", len(candidates), "records", count)
+		e.runCompactionEndHooks(int(p.id), err)
+		moved += count
+
+		if err != nil {
+			if !stdErrors.Is(err, ErrCompactionPaused) {
+				e.counters.recordError(err)
+			}
+			return moved, err
+		}
+
+		e.counters.compactions.Add(1)
+		e.log.Infow("Compacted segments", "partition", p.id, "segments", len(candidates), "records", count)
+	}
+
+	return moved, nil
+}
+
+// compactionCandidates returns the sealed segments of p, other than pinned
+// ones, whose garbage makes up at least CompactionThreshold of their size.
+func (e *Engine) compactionCandidates(p *partition, pinned map[segmentKey]struct{}) (map[segmentKey]struct{}, error) {
+	paths, err := p.storage.SealedSegmentPaths()
+	if err != nil {
+		return nil, err
+	}
+
+	threshold := e.compaction.garbageThreshold()
+	candidates := make(map[segmentKey]struct{})
+	for _, path := range paths {
+		segment, err := e.segmentKeyOf(p.id, path)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, ok := pinned[segment]; ok {
+			continue
+		}
+
+		garbage := e.garbage.get(segment)
+		if garbage.bytes() == 0 {
+			continue
+		}
+
+		stat, err := e.options.FileSystem.Stat(path)
+		if err != nil {
+			return nil, errors.NewStorageError(err, errors.ErrIOGeneral, "Failed to stat segment file").
+				WithPath(path)
+		}
+
+		if stat.Size() > 0 && float64(garbage.bytes())/float64(stat.Size()) >= threshold {
+			candidates[segment] = struct{}{}
+		}
+	}
+
+	return candidates, nil
+}
+
+// compactSegments moves every key of pointers that points into candidates.
+// A deduplicated record is copied once and every key sharing it is pointed
+// at the copy. Time spent pacing goes to the wait of timer.
+func (e *Engine) compactSegments(
+	ctx context.Context, candidates map[segmentKey]struct{}, pointers map[string]index.RecordPointer, timer *opTimer,
+) (int, error) {
+	copies := make(map[dedup.Location]index.RecordPointer)
+
+	var moved int
+	for key, pointer := range pointers {
+		if _, ok := candidates[pointerSegment(&pointer)]; !ok {
+			continue
+		}
+
+		if err := ctx.Err(); err != nil {
+			return moved, err
+		}
+
+		if e.closed.Load() {
+			return moved, ErrEngineClosed
+		}
+
+		if e.compaction.paused.Load() {
+			return moved, ErrCompactionPaused
+		}
+
+		ok, err := e.relocate(ctx, []byte(key), &pointer, copies)
+		if err != nil {
+			return moved, err
+		}
+
+		if !ok {
+			continue
+		}
+		moved++
+
+		timer.mark()
+		err = e.compaction.pace(ctx, pointer.Size)
+		timer.waited()
+		if err != nil {
+			return moved, err
+		}
+	}
+
+	return moved, nil
+}
+
+// relocate copies the record of key to the active segment of its partition,
+// unless the key was overwritten, deleted or expired since snapshot was
+// taken.
+func (e *Engine) relocate(
+	ctx context.Context, key []byte, snapshot *index.RecordPointer, copies map[dedup.Location]index.RecordPointer,
+) (bool, error) {
+	partition := e.partitionFor(key)
+	partition.mu.Lock()
+	defer partition.mu.Unlock()
+
+	pointer, ok := e.index.Get(string(key))
+	if !ok || !samePointer(pointer, snapshot) {
+		return false, nil
+	}
+
+	from := dedup.Location{
+		Offset:           pointer.Offset,
+		Size:             pointer.Size,
+		Partition:        pointer.Partition,
+		SegmentID:        pointer.SegmentID,
+		SegmentTimestamp: pointer.SegmentTimestamp,
+	}
+
+	relocated, copied := copies[from]
+	if !copied {
+		record, err := e.storageFor(pointer).Get(ctx, key, pointer.SegmentID, pointer.SegmentTimestamp, pointer.Offset)
+		if err != nil {
+			return false, err
+		}
+
+		stored, offset, err := partition.storage.Set(ctx, key, record.Value, record.Metadata)
+		if err != nil {
+			return false, err
+		}
+
+		relocated = index.RecordPointer{
+			Offset:           offset,
+			Size:             uint32(stored.Size()),
+			Partition:        partition.id,
+			SegmentID:        partition.storage.SegmentID(),
+			SegmentTimestamp: partition.storage.SegmentTimestamp(),
+		}
+		e.counters.bytesWritten.Add(uint64(stored.Size()))
+
+		if e.dedup != nil && e.dedup.Relocate(from, dedup.Location{
+			Offset:           relocated.Offset,
+			Size:             relocated.Size,
+			Partition:        relocated.Partition,
+			SegmentID:        relocated.SegmentID,
+			SegmentTimestamp: relocated.SegmentTimestamp,
+		}) {
+			copies[from] = relocated
+		}
+	}
+
+	relocated.ExpiresAt = pointer.ExpiresAt
+	e.index.Set(string(key), &relocated)
+	err := e.logIndexChange(string(key), &relocated)
+	e.history.relocate(string(key), pointer, &relocated)
+	e.replicate(key, &relocated)
+	return true, err
+}
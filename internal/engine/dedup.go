@@ -0,0 +1,87 @@
+package engine
+
+import (
+	"context"
+
+	"github.com/iamBelugaa/kvix/internal/dedup"
+	"github.com/iamBelugaa/kvix/internal/index"
+	"github.com/iamBelugaa/kvix/internal/storage"
+	"github.com/iamBelugaa/kvix/pkg/options"
+)
+
+// payloadDigest is the digest keys share a payload by. Metadata is stored
+// with the value, so only keys with the same of both may share one.
+func payloadDigest(value []byte, metadata *storage.Metadata) dedup.Digest {
+	if !metadata.IsEmpty() {
+		return dedup.Sum(append(storage.AppendMetadata(nil, metadata), value...))
+	}
+	return dedup.Sum(value)
+}
+
+func pointerLocation(pointer *index.RecordPointer) dedup.Location {
+	return dedup.Location{
+		Offset:           pointer.Offset,
+		Size:             pointer.Size,
+		Partition:        pointer.Partition,
+		SegmentID:        pointer.SegmentID,
+		SegmentTimestamp: pointer.SegmentTimestamp,
+	}
+}
+
+// loadDedup rebuilds the deduplication table, which lives only in memory,
+// from the loaded index: every payload keys point at, expired or not, is
+// tracked with a reference per key, under the digest of the record read
+// back. Payloads that cannot be read are tracked but not shared.
+func (e *Engine) loadDedup(ctx context.Context) error {
+	if e.dedup == nil {
+		return nil
+	}
+
+	pointers, err := e.index.Snapshot()
+	if err != nil {
+		return err
+	}
+
+	refs := make(map[dedup.Location]uint64)
+	locations := make([][]storage.RecordLocation, len(e.partitions))
+	payloads := make([][]dedup.Location, len(e.partitions))
+	for _, pointer := range pointers {
+		location := pointerLocation(&pointer)
+		if refs[location]++; refs[location] > 1 {
+			continue
+		}
+
+		locations[pointer.Partition] = append(locations[pointer.Partition], storage.RecordLocation{
+			SegmentID:        pointer.SegmentID,
+			SegmentTimestamp: pointer.SegmentTimestamp,
+			Offset:           pointer.Offset,
+		})
+		payloads[pointer.Partition] = append(payloads[pointer.Partition], location)
+	}
+
+	if len(refs) == 0 {
+		return nil
+	}
+
+	progress := e.startPhase(options.StartupDedup, int64(len(refs)))
+	for i, p := range e.partitions {
+		err := p.storage.ReadRecords(ctx, locations[i], func(j int, record *storage.Record, err error) error {
+			progress.add(1)
+			location := payloads[i][j]
+			if err != nil {
+				e.log.Warnw("Tracking unreadable record without deduplicating against it", "partition", i, "offset", location.Offset, "error", err)
+				e.dedup.Track(location, refs[location])
+				return nil
+			}
+
+			e.dedup.Restore(payloadDigest(record.Value, record.Metadata), location, refs[location])
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	progress.finish()
+	return nil
+}
@@ -0,0 +1,130 @@
+package engine
+
+import (
+	"context"
+
+	"github.com/iamBelugaa/kvix/internal/index"
+	"github.com/iamBelugaa/kvix/internal/storage"
+	"github.com/iamBelugaa/kvix/pkg/errors"
+)
+
+// RotateKey starts a new segment in every partition, so writes pick up the
+// key provider's current key version right away rather than when the next
+// segment happens to be opened.
+func (e *Engine) RotateKey(ctx context.Context) error {
+	if err := e.writable(); err != nil {
+		return err
+	}
+
+	if e.options.KeyProvider == nil {
+		return errors.NewValidationError(nil, errors.ErrSystemInvalidInput, "Key rotation requires a key provider")
+	}
+
+	for _, p := range e.partitions {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		p.mu.Lock()
+		err := p.storage.Rotate()
+		p.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Reencrypt copies every live record that is not sealed with its partition's
+// current key version forward to the active segment, the same way compaction
+// moves live records, and returns how many it rewrote. Plaintext records are
+// encrypted along the way. Once it completes, older key versions are only
+// referenced by dead records.
+func (e *Engine) Reencrypt(ctx context.Context) (int, error) {
+	if err := e.writable(); err != nil {
+		return 0, err
+	}
+
+	if e.options.KeyProvider == nil {
+		return 0, errors.NewValidationError(nil, errors.ErrSystemInvalidInput, "Re-encryption requires a key provider")
+	}
+
+	pointers, err := e.index.Snapshot()
+	if err != nil {
+		return 0, err
+	}
+
+	var rewritten int
+	for key, pointer := range pointers {
+		if err := ctx.Err(); err != nil {
+			return rewritten, err
+		}
+
+		ok, err := e.reencrypt(ctx, []byte(key), &pointer)
+		if err != nil {
+			e.counters.recordError(err)
+			return rewritten, err
+		}
+
+		if ok {
+			rewritten++
+		}
+	}
+
+	e.log.Infow("Re-encryption completed", "keys", len(pointers), "rewritten", rewritten)
+	return rewritten, nil
+}
+
+func (e *Engine) reencrypt(ctx context.Context, key []byte, snapshot *index.RecordPointer) (bool, error) {
+	partition := e.partitionFor(key)
+	partition.mu.Lock()
+	defer partition.mu.Unlock()
+
+	// Skip keys that were overwritten, deleted or expired since the snapshot.
+	pointer, ok := e.index.Get(string(key))
+	if !ok || !samePointer(pointer, snapshot) {
+		return false, nil
+	}
+
+	record, err := e.storageFor(pointer).Get(ctx, key, pointer.SegmentID, pointer.SegmentTimestamp, pointer.Offset)
+	if err != nil {
+		return false, err
+	}
+
+	if record.Header.Flags&storage.FlagEncrypted != 0 && record.Header.KeyVersion == partition.storage.KeyVersion() {
+		return false, nil
+	}
+
+	// The rewritten record is private to key, so it leaves any deduplicated
+	// payload it shared with other keys behind once the index releases it.
+	stored, offset, err := partition.storage.Set(ctx, key, record.Value, record.Metadata)
+	if err != nil {
+		return false, err
+	}
+
+	rewritten := &index.RecordPointer{
+		Offset:           offset,
+		ExpiresAt:        pointer.ExpiresAt,
+		Size:             uint32(stored.Size()),
+		Partition:        partition.id,
+		SegmentID:        partition.storage.SegmentID(),
+		SegmentTimestamp: partition.storage.SegmentTimestamp(),
+	}
+	if e.dedup != nil {
+		e.dedup.Track(pointerLocation(rewritten), 1)
+	}
+	e.index.Set(string(key), rewritten)
+	err = e.logIndexChange(string(key), rewritten)
+	e.history.relocate(string(key), pointer, rewritten)
+	e.replicate(key, rewritten)
+	e.counters.bytesWritten.Add(uint64(stored.Size()))
+	return true, err
+}
+
+func samePointer(a, b *index.RecordPointer) bool {
+	return a.Partition == b.Partition &&
+		a.SegmentID == b.SegmentID &&
+		a.SegmentTimestamp == b.SegmentTimestamp &&
+		a.Offset == b.Offset
+}
@@ -3,142 +3,1161 @@ package engine
 import (
 	"context"
 	stdErrors "errors"
+	"io"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"go.uber.org/zap"
 
+	"github.com/iamBelugaa/kvix/internal/changefeed"
+	"github.com/iamBelugaa/kvix/internal/dedup"
 	"github.com/iamBelugaa/kvix/internal/index"
+	"github.com/iamBelugaa/kvix/internal/indexlog"
+	"github.com/iamBelugaa/kvix/internal/scheduler"
+	"github.com/iamBelugaa/kvix/internal/secondary"
 	"github.com/iamBelugaa/kvix/internal/storage"
+	"github.com/iamBelugaa/kvix/internal/storage/segmentpool"
 	"github.com/iamBelugaa/kvix/pkg/errors"
+	"github.com/iamBelugaa/kvix/pkg/filesys"
 	"github.com/iamBelugaa/kvix/pkg/options"
 )
 
 var (
-	ErrEngineClosed = stdErrors.New("operation failed: cannot access closed engine")
+	ErrEngineClosed     = stdErrors.New("operation failed: cannot access closed engine")
+	ErrSnapshotReleased = stdErrors.New("operation failed: snapshot has been released")
 )
 
 type Engine struct {
-	closed  atomic.Bool
-	index   *index.Index
-	storage *storage.Storage
-	options *options.Options
+	closed     atomic.Bool
+	expired    atomic.Uint64
+	pins       segmentPins
+	counters   counters
+	lifetime   lifetimeStats
+	garbage    garbageTracker
+	compaction *compactionControl
+	index      *index.Index
+	dedup      *dedup.Table
+	partitions []*partition
+	options    *options.Options
+	log        *zap.SugaredLogger
+	stop       chan struct{}
+	wg         sync.WaitGroup
+	scheduler  *scheduler.Scheduler
+	jobs       []*scheduler.Job
+
+	loadersMu sync.RWMutex
+	loaders   map[string]Loader
+
+	watchMu  sync.Mutex
+	watchers map[*watcher]struct{}
+	watching atomic.Int64
+
+	// indexLog is nil unless changes to the index are logged.
+	indexLog *indexlog.Log
+
+	// hooks are the registered Hooks. AddHooks replaces the slice under
+	// hooksMu, so changes read it without locking.
+	hooksMu sync.Mutex
+	hooks   atomic.Pointer[[]*Hooks]
+
+	// publishMu orders appends to feed with their delivery to watchers.
+	publishMu sync.Mutex
+	feed      *changefeed.Log
+
+	// replicaMu guards replicaFeeds, the change queues of the replicas this
+	// engine serves as a primary.
+	replicaMu       sync.Mutex
+	replicaFeeds    map[*replicaFeed]struct{}
+	replicating     atomic.Int64
+	replicaSessions sync.WaitGroup
+
+	// follower is set when the engine is a replica of another.
+	follower *follower
+
+	manifestMu sync.Mutex
+	manifest   manifestState
+
+	// expirations is nil unless an expiration handler is set.
+	expirations *expirationQueue
+
+	// history is nil unless versions are retained.
+	history *history
+
+	// secondary is nil unless secondary indexes are configured, and tags
+	// unless tags are indexed.
+	secondary *secondary.Index
+	tags      *secondary.Tags
+
+	// segmentsMu keeps the passes that delete sealed segments apart.
+	// gcCandidates are the sealed segments the last GC pass found
+	// unreferenced, to be removed by the next if they still are.
+	segmentsMu   sync.Mutex
+	gcCandidates map[segmentKey]struct{}
+
+	// archive is nil unless segments were ever archived.
+	archive  *archiveState
+	throttle *throttle
+	openedAt time.Time
+
+	// The settings below can change with Reconfigure. syncMu orders changes
+	// of the sync policy, and syncJob stops the periodic sync pass.
+	syncMu          sync.Mutex
+	syncJob         func()
+	policy          atomic.Uint32
+	slowOpThreshold atomic.Int64
+
+	// startupProgress is options.StartupProgress while New loads the data,
+	// and nil once it has.
+	startupProgress options.StartupProgressFunc
 }
 
-func New(ctx context.Context, log *zap.SugaredLogger, options *options.Options) (*Engine, error) {
-	storage, err := storage.New(ctx, log, options)
+// Shared holds resources several engines in one process may share. The zero
+// value shares nothing.
+type Shared struct {
+	// SegmentBudget caps sealed segment handles open across engines.
+	SegmentBudget *segmentpool.Budget
+	// Scheduler runs background passes in place of per-engine goroutines.
+	Scheduler *scheduler.Scheduler
+}
+
+func New(ctx context.Context, log *zap.SugaredLogger, options *options.Options, shared Shared) (*Engine, error) {
+	budget := shared.SegmentBudget
+	if budget == nil {
+		budget = segmentpool.NewBudget(options.MaxOpenSegments)
+	}
+
+	// The index log, hints and stats live in the data directory, which the
+	// segment directory need not be under.
+	if err := filesys.CreateDir(options.FileSystem, options.DataDir, 0755, true); err != nil {
+		return nil, errors.NewStorageError(err, errors.ErrIOGeneral, err.Error()).WithPath(options.DataDir)
+	}
+
+	partitions, err := openPartitions(ctx, log, options, budget)
 	if err != nil {
 		return nil, err
 	}
 
-	index, err := index.New(options.DataDir)
+	index, err := index.New(log, options)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Engine{
-		options: options,
-		index:   index,
-		storage: storage,
-	}, nil
+	lifetime, err := loadLifetimeStats(options.FileSystem, options.DataDir)
+	if err != nil {
+		return nil, err
+	}
+
+	engine := &Engine{
+		log:          log,
+		options:      options,
+		index:        index,
+		partitions:   partitions,
+		stop:         make(chan struct{}),
+		lifetime:     lifetime,
+		loaders:      make(map[string]Loader),
+		watchers:     make(map[*watcher]struct{}),
+		replicaFeeds: make(map[*replicaFeed]struct{}),
+		scheduler:    shared.Scheduler,
+		history:      newHistory(options.VersionHistory),
+		throttle:     newThrottle(options),
+		compaction:   newCompactionControl(options),
+		openedAt:     time.Now(),
+
+		startupProgress: options.StartupProgress,
+	}
+	index.OnExpire(engine.notifyExpired)
+	index.LocateSpilledWith(engine.locateKey)
+	engine.policy.Store(uint32(options.SyncPolicy))
+	engine.slowOpThreshold.Store(int64(options.SlowOpThreshold))
+
+	if options.ExpirationHandler != nil {
+		engine.expirations = &expirationQueue{wake: make(chan struct{}, 1)}
+	}
+
+	if options.Deduplicate {
+		engine.dedup = dedup.New()
+	}
+
+	// A follower's index comes from the primary's manifest; the hint is the
+	// primary's to consume.
+	loadIndex := engine.loadHint
+	if options.FollowInterval > 0 {
+		loadIndex = engine.loadManifest
+	}
+
+	if err := loadIndex(); err != nil {
+		closePartitions(partitions)
+		return nil, err
+	}
+
+	if engine.indexLogEnabled() {
+		if err := engine.openIndexLog(); err != nil {
+			closePartitions(partitions)
+			return nil, err
+		}
+	}
+
+	if err := engine.loadArchive(); err != nil {
+		closePartitions(partitions)
+		return nil, err
+	}
+
+	if options.Archive != nil && options.Archive.Downloader != nil {
+		for _, p := range partitions {
+			p.storage.SetSegmentFetcher(engine.segmentFetcher(p.id))
+		}
+	}
+
+	// Followers never write, so they share nothing.
+	if options.FollowInterval == 0 {
+		if err := engine.loadDedup(ctx); err != nil {
+			closePartitions(partitions)
+			return nil, err
+		}
+	}
+
+	if err := engine.loadHistory(); err != nil {
+		closePartitions(partitions)
+		return nil, err
+	}
+
+	if err := engine.loadSecondary(ctx); err != nil {
+		closePartitions(partitions)
+		return nil, err
+	}
+
+	// A follower's index mirrors the primary's, which counts its own garbage.
+	if options.FollowInterval == 0 {
+		if err := engine.loadGarbage(); err != nil {
+			closePartitions(partitions)
+			return nil, err
+		}
+	}
+	engine.startupProgress = nil
+	engine.shed()
+
+	if options.ChangeFeedRetention > 0 {
+		feed, err := changefeed.Open(options.FileSystem, options.DataDir, options.ChangeFeedRetention, engine.syncsEachWrite(), log)
+		if err != nil {
+			closePartitions(partitions)
+			return nil, err
+		}
+		engine.feed = feed
+	}
+
+	if engine.indexLog != nil {
+		engine.schedule(indexLogCheckInterval, engine.indexLogPass)
+	}
+
+	if options.ExpirationHandler != nil {
+		go engine.runExpirationHandler(options.ExpirationHandler)
+	}
+
+	if options.ExpirationInterval > 0 {
+		engine.schedule(options.ExpirationInterval, engine.expirationPass)
+	}
+
+	// Replicas mirror the primary's segments, and followers of a manifest may
+	// still point into segments the primary no longer references.
+	if options.ReplicaOf == "" && options.FollowInterval == 0 && options.ManifestInterval == 0 {
+		if options.SegmentGCInterval > 0 {
+			engine.schedule(options.SegmentGCInterval, engine.segmentGCPass)
+			engine.schedule(options.CompactInterval, engine.compactionPass)
+		} else {
+			// Compaction only empties segments; collection deletes them, so
+			// without it compaction would just copy live records around.
+			log.Warnw(
+				"Segment garbage collection is disabled, so compaction will not run on its own",
+				"segmentGCInterval", options.SegmentGCInterval, "compactInterval", options.CompactInterval,
+			)
+		}
+	}
+
+	if options.Archive != nil {
+		engine.schedule(options.Archive.Interval, engine.archivePass)
+	}
+
+	if options.StatsFlushInterval > 0 && options.FollowInterval == 0 {
+		engine.schedule(options.StatsFlushInterval, engine.lifetimeStatsPass)
+	}
+
+	if options.ExpvarPrefix != "" {
+		engine.publishExpvar(options.ExpvarPrefix)
+	}
+
+	if options.WriteBufferSize > 0 && options.FollowInterval == 0 {
+		engine.schedule(options.WriteFlushInterval, engine.flushPass)
+	}
+
+	if engine.syncsPeriodically() && options.FollowInterval == 0 {
+		engine.syncJob = engine.schedule(options.SyncInterval, engine.syncPass)
+	}
+
+	if options.RefreshAhead > 0 && !engine.isReplica() {
+		engine.schedule(max(options.RefreshAhead/2, time.Second), engine.refreshPass)
+	}
+
+	if options.ReplicaOf != "" {
+		engine.follower = &follower{status: ReplicaStatus{Primary: options.ReplicaOf}}
+		engine.wg.Add(1)
+		go engine.followPrimary()
+	}
+
+	if options.FollowInterval > 0 {
+		engine.schedule(options.FollowInterval, engine.followPass)
+	}
+
+	if options.ManifestInterval > 0 {
+		engine.schedule(options.ManifestInterval, engine.manifestPass)
+	}
+
+	return engine, nil
 }
 
 func (e *Engine) Set(ctx context.Context, key, value []byte) error {
-	if e.closed.Load() {
-		return ErrEngineClosed
+	if err := e.writable(); err != nil {
+		return err
+	}
+
+	_, err := e.write(ctx, key, value, nil, 0)
+	return err
+}
+
+func (e *Engine) SetX(ctx context.Context, key, value []byte, ttl time.Duration) (*storage.Record, error) {
+	if err := e.writable(); err != nil {
+		return nil, err
+	}
+	return e.write(ctx, key, value, nil, time.Now().Add(ttl).UnixNano())
+}
+
+// SetXAt is SetX with an absolute expiry, so that every node applying the same
+// write agrees on when it lapses.
+func (e *Engine) SetXAt(ctx context.Context, key, value []byte, expiresAt time.Time) (*storage.Record, error) {
+	if err := e.writable(); err != nil {
+		return nil, err
+	}
+	return e.write(ctx, key, value, nil, expiresAt.UnixNano())
+}
+
+// SetWithMetadata stores value with metadata, expiring at expiresAt unless it
+// is the zero time.
+func (e *Engine) SetWithMetadata(
+	ctx context.Context, key, value []byte, metadata *storage.Metadata, expiresAt time.Time,
+) (*storage.Record, error) {
+	if err := e.writable(); err != nil {
+		return nil, err
+	}
+
+	var expiry int64
+	if !expiresAt.IsZero() {
+		expiry = expiresAt.UnixNano()
+	}
+	return e.write(ctx, key, value, metadata, expiry)
+}
+
+// Rewrite replaces the record of key with the value and metadata rewrite
+// makes of it, keeping the key's expiry. rewrite runs without the partition
+// lock and reports whether to write at all; the write is then made only if
+// key was not written, deleted or given another expiry meanwhile. Rewrite
+// reports whether it wrote.
+func (e *Engine) Rewrite(
+	ctx context.Context, key []byte,
+	rewrite func(record *storage.Record) (value []byte, metadata *storage.Metadata, write bool, err error),
+) (bool, error) {
+	if err := e.writable(); err != nil {
+		return false, err
+	}
+
+	pointer, ok := e.live(key)
+	if !ok {
+		return false, errors.NewIndexError(nil, errors.ErrIndexKeyNotFound, "Key not found in index").
+			WithKey(string(key))
 	}
 
-	_, offset, err := e.storage.Set(ctx, key, value)
+	record, err := e.storageFor(pointer).Get(ctx, key, pointer.SegmentID, pointer.SegmentTimestamp, pointer.Offset)
 	if err != nil {
+		e.counters.recordError(err)
+		return false, err
+	}
+	if e.dedup != nil {
+		record.Key = key
+	}
+
+	value, metadata, write, err := rewrite(record)
+	if err != nil || !write {
+		return false, err
+	}
+
+	written, err := e.writeIf(ctx, key, value, metadata, pointer.ExpiresAt, pointer)
+	return written != nil, err
+}
+
+// SetReader stores the size bytes read from r as the value of key, expiring
+// at expiresAt unless it is zero. The value is streamed into the active
+// segment rather than held in memory, which keeps the key's partition locked
+// until r has been read. It is read into memory and written as Set writes
+// it when something needs the whole value: deduplication, the secondary
+// index, hooks, watchers or the change feed. A watcher added while the value
+// streams sees its event without the value.
+func (e *Engine) SetReader(ctx context.Context, key []byte, r io.Reader, size int64, expiresAt int64) error {
+	if err := e.writable(); err != nil {
 		return err
 	}
 
-	e.index.Set(string(key), &index.RecordPointer{
-		ExpiresAt:        0,
+	if e.dedup != nil || e.secondary != nil || e.feed != nil || e.watching.Load() > 0 || len(e.hookList()) > 0 {
+		value := make([]byte, size)
+		if _, err := io.ReadFull(r, value); err != nil {
+			return errors.NewStorageError(err, errors.ErrRecordPayloadWriteFailed, "Failed to read value to store").
+				WithDetail("key", string(key))
+		}
+
+		_, err := e.write(ctx, key, value, nil, expiresAt)
+		return err
+	}
+
+	defer e.shed()
+
+	ctx, timer := e.startOp(ctx)
+	defer e.logSlow("setReader", key, timer)
+
+	release, err := e.admit(ctx, len(key)+int(size), false)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	partition := e.partitionFor(key)
+	partition.mu.Lock()
+	defer partition.mu.Unlock()
+	timer.waited()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	record, offset, err := partition.storage.SetReader(ctx, key, r, size)
+	if err != nil {
+		e.counters.recordError(err)
+		return err
+	}
+
+	_, err = e.commit(ctx, key, nil, nil, &index.RecordPointer{
 		Offset:           offset,
-		SegmentID:        e.storage.SegmentID(),
-		SegmentTimestamp: e.storage.SegmentTimestamp(),
+		ExpiresAt:        expiresAt,
+		Size:             uint32(record.Size()),
+		Partition:        partition.id,
+		SegmentID:        partition.storage.SegmentID(),
+		SegmentTimestamp: partition.storage.SegmentTimestamp(),
 	})
+	if err != nil {
+		e.counters.recordError(err)
+		return err
+	}
 
+	e.counters.sets.Add(1)
+	e.counters.sizes.recordWriteSize(key, size)
+	e.counters.bytesWritten.Add(uint64(record.Size()))
 	return nil
 }
 
-func (e *Engine) SetX(ctx context.Context, key, value []byte, ttl time.Duration) (*storage.Record, error) {
+// writable returns the error modifying calls fail with: ErrEngineClosed, or
+// ErrReadOnlyReplica on a replica.
+func (e *Engine) writable() error {
 	if e.closed.Load() {
-		return nil, ErrEngineClosed
+		return ErrEngineClosed
 	}
 
-	record, offset, err := e.storage.Set(ctx, key, value)
+	if e.isReplica() {
+		return ErrReadOnlyReplica
+	}
+	return nil
+}
+
+// isReplica reports whether the engine mirrors a primary, over the network
+// or from a shared data directory, and so must not change anything itself.
+func (e *Engine) isReplica() bool {
+	return e.follower != nil || e.options.FollowInterval > 0
+}
+
+func (e *Engine) write(
+	ctx context.Context, key, value []byte, metadata *storage.Metadata, expiresAt int64,
+) (*storage.Record, error) {
+	return e.writeIf(ctx, key, value, metadata, expiresAt, nil)
+}
+
+// writeIf is write, made only if key still points at the record expected
+// locates, with the same expiry, once its partition is locked, unless
+// expected is nil. A write skipped because the key moved on returns neither
+// a record nor an error.
+func (e *Engine) writeIf(
+	ctx context.Context, key, value []byte, metadata *storage.Metadata, expiresAt int64, expected *index.RecordPointer,
+) (*storage.Record, error) {
+	// Deferred first so that it runs after the partition is unlocked.
+	defer e.shed()
+
+	ctx, timer := e.startOp(ctx)
+	defer e.logSlow("set", key, timer)
+
+	// Admitted before taking the partition, so held writes do not queue up
+	// on its lock.
+	release, err := e.admit(ctx, len(key)+len(value), false)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	partition := e.partitionFor(key)
+	partition.mu.Lock()
+	defer partition.mu.Unlock()
+	timer.waited()
+
+	// The caller's deadline may have passed while waiting for the partition.
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if expected != nil {
+		current, ok := e.index.Get(string(key))
+		if !ok || !samePointer(current, expected) || current.ExpiresAt != expected.ExpiresAt {
+			return nil, nil
+		}
+	}
+
+	record, err := e.append(ctx, partition, key, value, metadata, expiresAt)
+	if err != nil {
+		e.counters.recordError(err)
+		return nil, err
+	}
+
+	e.counters.sets.Add(1)
+	e.counters.sizes.recordWrite(key, value)
+	if record.Header != nil {
+		e.counters.bytesWritten.Add(uint64(record.Size()))
+	}
+
+	return record, nil
+}
+
+func (e *Engine) append(
+	ctx context.Context, partition *partition, key, value []byte, metadata *storage.Metadata, expiresAt int64,
+) (*storage.Record, error) {
+	if e.dedup == nil {
+		record, offset, err := partition.storage.Set(ctx, key, value, metadata)
+		if err != nil {
+			return nil, err
+		}
+
+		pointer := &index.RecordPointer{
+			Offset:           offset,
+			ExpiresAt:        expiresAt,
+			Size:             uint32(record.Size()),
+			Partition:        partition.id,
+			SegmentID:        partition.storage.SegmentID(),
+			SegmentTimestamp: partition.storage.SegmentTimestamp(),
+		}
+		if _, err := e.commit(ctx, key, value, metadata, pointer); err != nil {
+			return nil, err
+		}
+		return record, nil
+	}
+
+	digest := payloadDigest(value, metadata)
+
+	if location, ok := e.dedup.Acquire(digest); ok {
+		pointer := &index.RecordPointer{
+			ExpiresAt:        expiresAt,
+			Offset:           location.Offset,
+			Size:             location.Size,
+			Partition:        location.Partition,
+			SegmentID:        location.SegmentID,
+			SegmentTimestamp: location.SegmentTimestamp,
+		}
+		// A key written again with the value it already has keeps its
+		// pointer, and with it the reference it held.
+		unchanged, err := e.commit(ctx, key, value, metadata, pointer)
+		if unchanged {
+			e.dedup.Release(location)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &storage.Record{Key: key, Value: value, Metadata: metadata}, nil
+	}
+
+	record, offset, err := partition.storage.Set(ctx, key, value, metadata)
 	if err != nil {
 		return nil, err
 	}
 
-	e.index.Set(string(key), &index.RecordPointer{
+	location := dedup.Location{
 		Offset:           offset,
-		SegmentID:        e.storage.SegmentID(),
-		SegmentTimestamp: e.storage.SegmentTimestamp(),
-		ExpiresAt:        time.Now().Add(ttl).UnixNano(),
-	})
+		Size:             uint32(record.Size()),
+		Partition:        partition.id,
+		SegmentID:        partition.storage.SegmentID(),
+		SegmentTimestamp: partition.storage.SegmentTimestamp(),
+	}
+	e.dedup.Register(digest, location)
 
+	pointer := &index.RecordPointer{
+		ExpiresAt:        expiresAt,
+		Offset:           location.Offset,
+		Size:             location.Size,
+		Partition:        location.Partition,
+		SegmentID:        location.SegmentID,
+		SegmentTimestamp: location.SegmentTimestamp,
+	}
+	if _, err := e.commit(ctx, key, value, metadata, pointer); err != nil {
+		return nil, err
+	}
 	return record, nil
 }
 
+// commit points key at its newly written value and passes the write on to
+// the index log, history, indexes, replicas and subscribers. It reports
+// whether key already pointed at the same record, and fails if the index log
+// could not record the change, which is made all the same. Under a context
+// from storage.WithDeferredSync the index log is left for the caller to sync.
+func (e *Engine) commit(
+	ctx context.Context, key, value []byte, metadata *storage.Metadata, pointer *index.RecordPointer,
+) (bool, error) {
+	unchanged := e.index.Set(string(key), pointer)
+	err := e.appendIndexLog(string(key), pointer, storage.SyncDeferred(ctx))
+	e.history.record(string(key), pointer)
+	e.reindex(key, value, metadata)
+	e.replicate(key, pointer)
+	e.notify(EventSet, key, value, pointer.ExpiresAt)
+	return unchanged, err
+}
+
 func (e *Engine) Get(ctx context.Context, key []byte) (*storage.Record, error) {
 	if e.closed.Load() {
 		return nil, ErrEngineClosed
 	}
 
-	pointer, ok := e.index.Get(string(key))
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	ctx, timer := e.startOp(ctx)
+	defer e.logSlow("get", key, timer)
+
+	e.counters.gets.Add(1)
+
+	pointer, ok := e.live(key)
+	timer.lookedUp()
 	if !ok {
+		e.counters.misses.Add(1)
 		return nil, errors.NewIndexError(
 			nil, errors.ErrIndexKeyNotFound, "Key not found in index",
 		).
 			WithKey(string(key))
 	}
 
-	record, err := e.storage.Get(ctx, key, pointer.SegmentID, pointer.SegmentTimestamp, pointer.Offset)
+	record, err := e.storageFor(pointer).Get(ctx, key, pointer.SegmentID, pointer.SegmentTimestamp, pointer.Offset)
 	if err != nil {
+		e.counters.recordError(err)
 		return nil, err
 	}
 
+	if e.dedup != nil {
+		record.Key = key
+	}
+	e.counters.sizes.recordRead(key, record.Value)
+	e.slideExpiry(key, pointer)
+
 	return record, nil
 }
 
-func (e *Engine) Delete(ctx context.Context, key []byte) (bool, error) {
+// GetValue appends the value of key to dst and returns the extended slice,
+// without building the record Get returns. It is for hot paths that need
+// neither the header nor the metadata.
+func (e *Engine) GetValue(ctx context.Context, dst, key []byte) ([]byte, error) {
 	if e.closed.Load() {
-		return false, ErrEngineClosed
+		return dst, ErrEngineClosed
+	}
+
+	if err := ctx.Err(); err != nil {
+		return dst, err
+	}
+
+	ctx, timer := e.startOp(ctx)
+	defer e.logSlow("getValue", key, timer)
+
+	e.counters.gets.Add(1)
+
+	pointer, ok := e.live(key)
+	timer.lookedUp()
+	if !ok {
+		e.counters.misses.Add(1)
+		return dst, errors.NewIndexError(
+			nil, errors.ErrIndexKeyNotFound, "Key not found in index",
+		).
+			WithKey(string(key))
+	}
+
+	start := len(dst)
+	dst, err := e.storageFor(pointer).GetValue(ctx, dst, key, pointer.SegmentID, pointer.SegmentTimestamp, pointer.Offset)
+	if err != nil {
+		e.counters.recordError(err)
+		return dst, err
 	}
-	return e.index.Delete(string(key)), nil
+
+	e.counters.sizes.recordRead(key, dst[start:])
+	e.slideExpiry(key, pointer)
+
+	return dst, nil
+}
+
+// GetReader streams the value of key from its segment instead of reading it
+// into memory; see storage.Storage.GetReader. The reader must be closed.
+func (e *Engine) GetReader(ctx context.Context, key []byte) (io.ReadCloser, error) {
+	if e.closed.Load() {
+		return nil, ErrEngineClosed
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	ctx, timer := e.startOp(ctx)
+	defer e.logSlow("getReader", key, timer)
+
+	e.counters.gets.Add(1)
+
+	pointer, ok := e.live(key)
+	timer.lookedUp()
+	if !ok {
+		e.counters.misses.Add(1)
+		return nil, errors.NewIndexError(
+			nil, errors.ErrIndexKeyNotFound, "Key not found in index",
+		).
+			WithKey(string(key))
+	}
+
+	reader, err := e.storageFor(pointer).GetReader(ctx, key, pointer.SegmentID, pointer.SegmentTimestamp, pointer.Offset)
+	if err != nil {
+		e.counters.recordError(err)
+		return nil, err
+	}
+
+	e.slideExpiry(key, pointer)
+	return reader, nil
+}
+
+// slideExpiry pushes the expiry of key, just read, SlidingTTL into the
+// future if it has one.
+func (e *Engine) slideExpiry(key []byte, pointer *index.RecordPointer) {
+	// Replicas follow the primary's TTLs rather than sliding their own.
+	if e.options.SlidingTTL > 0 && pointer.ExpiresAt != 0 && !e.isReplica() {
+		e.setExpiresAt(key, time.Now().Add(e.options.SlidingTTL).UnixNano())
+	}
+}
+
+// Result is the outcome of a single key in a batch read.
+type Result struct {
+	Key   []byte
+	Entry *storage.Record
+	Err   error
+}
+
+// MGet reads every key independently so that a missing or corrupted record
+// only fails its own Result.
+func (e *Engine) MGet(ctx context.Context, keys [][]byte) ([]Result, error) {
+	if e.closed.Load() {
+		return nil, ErrEngineClosed
+	}
+
+	results := make([]Result, len(keys))
+	for idx, key := range keys {
+		record, err := e.Get(ctx, key)
+		results[idx] = Result{Key: key, Entry: record, Err: err}
+	}
+
+	return results, nil
+}
+
+func (e *Engine) GetStale(ctx context.Context, key []byte) (*storage.Record, bool, error) {
+	if e.closed.Load() {
+		return nil, false, ErrEngineClosed
+	}
+
+	ctx, timer := e.startOp(ctx)
+	defer e.logSlow("getStale", key, timer)
+
+	e.counters.gets.Add(1)
+
+	pointer, stale, ok := e.index.GetStale(string(key))
+	timer.lookedUp()
+	if !ok {
+		e.counters.misses.Add(1)
+		return nil, false, errors.NewIndexError(
+			nil, errors.ErrIndexKeyNotFound, "Key not found in index",
+		).
+			WithKey(string(key))
+	}
+
+	record, err := e.storageFor(pointer).Get(ctx, key, pointer.SegmentID, pointer.SegmentTimestamp, pointer.Offset)
+	if err != nil {
+		e.counters.recordError(err)
+		return nil, false, err
+	}
+
+	if e.dedup != nil {
+		record.Key = key
+	}
+	e.counters.sizes.recordRead(key, record.Value)
+
+	return record, stale, nil
+}
+
+func (e *Engine) Delete(ctx context.Context, key []byte) (bool, error) {
+	if err := e.writable(); err != nil {
+		return false, err
+	}
+
+	partition := e.partitionFor(key)
+	partition.mu.Lock()
+	defer partition.mu.Unlock()
+
+	if !e.index.Delete(string(key)) {
+		return false, nil
+	}
+
+	err := e.logIndexChange(string(key), nil)
+	e.counters.deletes.Add(1)
+	e.history.delete(string(key))
+	e.unindex(string(key))
+	e.replicate(key, nil)
+	e.notify(EventDelete, key, nil, 0)
+	if err != nil {
+		e.counters.recordError(err)
+		return true, err
+	}
+	return true, nil
 }
 
 func (e *Engine) Exists(ctx context.Context, key []byte) (bool, error) {
 	if e.closed.Load() {
 		return false, ErrEngineClosed
 	}
-	_, exists := e.index.Get(string(key))
+	_, exists := e.live(key)
 	return exists, nil
 }
 
-func (e *Engine) CleanupExpired(ctx context.Context) error {
+func (e *Engine) TTL(ctx context.Context, key []byte) (time.Duration, error) {
+	if e.closed.Load() {
+		return 0, ErrEngineClosed
+	}
+
+	pointer, ok := e.live(key)
+	if !ok {
+		return 0, errors.NewIndexError(
+			nil, errors.ErrIndexKeyNotFound, "Key not found in index",
+		).
+			WithKey(string(key))
+	}
+
+	return pointer.TTL(), nil
+}
+
+func (e *Engine) Expire(ctx context.Context, key []byte, ttl time.Duration) (bool, error) {
+	if err := e.writable(); err != nil {
+		return false, err
+	}
+	return e.setExpiresAt(key, time.Now().Add(ttl).UnixNano())
+}
+
+func (e *Engine) Touch(ctx context.Context, key []byte, ttl time.Duration) (bool, error) {
+	if err := e.writable(); err != nil {
+		return false, err
+	}
+	return e.setExpiresAt(key, time.Now().Add(ttl).UnixNano())
+}
+
+func (e *Engine) Persist(ctx context.Context, key []byte) (bool, error) {
+	if err := e.writable(); err != nil {
+		return false, err
+	}
+	return e.setExpiresAt(key, 0)
+}
+
+// ExpireAt is Expire with an absolute expiry.
+func (e *Engine) ExpireAt(ctx context.Context, key []byte, expiresAt time.Time) (bool, error) {
+	if err := e.writable(); err != nil {
+		return false, err
+	}
+	return e.setExpiresAt(key, expiresAt.UnixNano())
+}
+
+// setExpiresAt changes the expiry of key under its partition lock, so that
+// it cannot land on a version written or deleted concurrently.
+func (e *Engine) setExpiresAt(key []byte, expiresAt int64) (bool, error) {
+	partition := e.partitionFor(key)
+	partition.mu.Lock()
+	defer partition.mu.Unlock()
+
+	if !e.index.SetExpiresAt(string(key), expiresAt) {
+		return false, nil
+	}
+
+	var err error
+	if pointer, ok := e.index.Peek(string(key)); ok {
+		err = e.logIndexChange(string(key), pointer)
+	}
+	e.replicateExpiry(key)
+	if err != nil {
+		e.counters.recordError(err)
+		return true, err
+	}
+	return true, nil
+}
+
+func (e *Engine) CleanupExpired(ctx context.Context) (int, error) {
+	if e.closed.Load() {
+		return 0, ErrEngineClosed
+	}
+
+	byPartition := make(map[*partition][]string)
+	for _, key := range e.index.ExpiredKeys() {
+		partition := e.partitionFor([]byte(key))
+		byPartition[partition] = append(byPartition[partition], key)
+	}
+
+	var removed int
+	for partition, keys := range byPartition {
+		partition.mu.Lock()
+		for _, key := range keys {
+			if e.index.RemoveExpired(key) {
+				removed++
+			}
+		}
+		partition.mu.Unlock()
+	}
+
+	e.expired.Add(uint64(removed))
+	return removed, nil
+}
+
+func (e *Engine) ExpiredCount() uint64 {
+	return e.expired.Load()
+}
+
+func (e *Engine) expirationPass() {
+	removed, err := e.CleanupExpired(context.Background())
+	if err != nil {
+		return
+	}
+
+	if removed > 0 {
+		e.log.Debugw("Expired keys removed", "removed", removed, "totalExpired", e.expired.Load())
+	}
+}
+
+func (e *Engine) syncPolicy() options.SyncPolicy {
+	return options.SyncPolicy(e.policy.Load())
+}
+
+func (e *Engine) syncsEachWrite() bool {
+	return e.syncPolicy() == options.SyncAlways
+}
+
+func (e *Engine) syncsPeriodically() bool {
+	return e.syncPolicy() == options.SyncInterval
+}
+
+// flushPartitions writes out the write buffer of every partition.
+func (e *Engine) flushPartitions() error {
+	for _, p := range e.partitions {
+		p.mu.Lock()
+		err := p.storage.Flush()
+		p.mu.Unlock()
+
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *Engine) flushPass() {
+	if err := e.flushPartitions(); err != nil {
+		e.counters.recordError(err)
+		e.log.Errorw("Write buffer flush failed", "error", err)
+	}
+}
+
+// Sync writes out buffered records and fsyncs the active segment of every
+// partition, the index log and the change feed, so every write acknowledged
+// before the call survives a crash whatever the sync policy.
+func (e *Engine) Sync(ctx context.Context) error {
 	if e.closed.Load() {
 		return ErrEngineClosed
 	}
-	e.index.CleanupExpired()
+
+	for _, p := range e.partitions {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		p.mu.Lock()
+		err := p.storage.Sync()
+		p.mu.Unlock()
+
+		if err != nil {
+			e.counters.recordError(err)
+			return err
+		}
+	}
+
+	if e.indexLog != nil {
+		if err := e.indexLog.Sync(); err != nil {
+			e.counters.recordError(err)
+			return err
+		}
+	}
+
+	if e.feed != nil {
+		if err := e.feed.Sync(); err != nil {
+			e.counters.recordError(err)
+			return err
+		}
+	}
 	return nil
 }
 
+// syncPass fsyncs the active segment of every partition, then the logs
+// pointing into them.
+func (e *Engine) syncPass() {
+	for _, p := range e.partitions {
+		p.mu.Lock()
+		err := p.storage.Sync()
+		p.mu.Unlock()
+
+		if err != nil {
+			e.counters.recordError(err)
+			e.log.Errorw("Periodic sync failed", "partition", p.id, "error", err)
+		}
+	}
+
+	if e.indexLog != nil {
+		if err := e.indexLog.Sync(); err != nil {
+			e.counters.recordError(err)
+			e.log.Errorw("Periodic index log sync failed", "error", err)
+		}
+	}
+
+	if e.feed != nil {
+		if err := e.feed.Sync(); err != nil {
+			e.counters.recordError(err)
+			e.log.Errorw("Periodic change feed sync failed", "error", err)
+		}
+	}
+}
+
+// schedule runs fn every interval until the engine is closed, on the shared
+// scheduler when there is one and on a goroutine of its own otherwise. The
+// returned function stops it sooner and waits for a run in progress.
+func (e *Engine) schedule(interval time.Duration, fn func()) func() {
+	if e.scheduler != nil {
+		job := e.scheduler.Every(interval, fn)
+		e.jobs = append(e.jobs, job)
+		return func() { e.scheduler.Cancel(job) }
+	}
+
+	cancel := make(chan struct{})
+	done := make(chan struct{})
+
+	e.wg.Add(1)
+	go func() {
+		defer e.wg.Done()
+		defer close(done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-e.stop:
+				return
+			case <-cancel:
+				return
+			case <-ticker.C:
+				fn()
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(cancel) })
+		<-done
+	}
+}
+
 func (e *Engine) Close() error {
 	if !e.closed.CompareAndSwap(false, true) {
 		return ErrEngineClosed
 	}
 
+	close(e.stop)
+	e.closeWatchers()
+
+	// Reconfigure schedules sync passes under syncMu.
+	e.syncMu.Lock()
+	for _, job := range e.jobs {
+		e.scheduler.Cancel(job)
+	}
+	e.wg.Wait()
+	e.syncMu.Unlock()
+	e.waitReplicaSessions()
+
+	if e.options.ExpvarPrefix != "" {
+		e.unpublishExpvar(e.options.ExpvarPrefix)
+	}
+
+	// A follower leaves the directory it shares to its primary.
+	if e.options.FollowInterval == 0 {
+		if err := e.persistLifetimeStats(); err != nil {
+			e.log.Errorw("Failed to persist lifetime stats", "error", err)
+		}
+
+		if err := e.persistGarbage(); err != nil {
+			e.log.Errorw("Failed to persist segment garbage", "error", err)
+		}
+
+		if err := e.persistHint(); err != nil {
+			e.log.Errorw("Failed to persist index hint", "error", err)
+		}
+
+		if err := e.persistHistory(); err != nil {
+			e.log.Errorw("Failed to persist version history", "error", err)
+		}
+	}
+
+	if e.options.ManifestInterval > 0 {
+		if err := e.publishManifest(); err != nil {
+			e.log.Errorw("Failed to publish index manifest", "error", err)
+		}
+	}
+
+	if e.indexLog != nil {
+		if err := e.indexLog.Close(); err != nil {
+			e.log.Errorw("Failed to close index log", "error", err)
+		}
+	}
+
 	if err := e.index.Close(); err != nil {
 		return err
 	}
 
-	if err := e.storage.Close(); err != nil {
+	if err := closePartitions(e.partitions); err != nil {
 		return err
 	}
 
+	if e.feed != nil {
+		return e.feed.Close()
+	}
+
 	return nil
 }
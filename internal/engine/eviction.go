@@ -0,0 +1,34 @@
+package engine
+
+// shed evicts keys until the index is back within MaxKeys and MaxLiveBytes.
+// It runs after every write, once the writer's partition lock is released,
+// so the write that went over the bound may itself be evicted when nothing
+// colder remains.
+func (e *Engine) shed() {
+	for e.index.OverCapacity() {
+		key, ok := e.index.EvictionVictim()
+		if !ok {
+			return
+		}
+		e.evict([]byte(key))
+	}
+}
+
+// evict removes key like Delete does, reporting it to watchers and the change
+// feed as EventEvict.
+func (e *Engine) evict(key []byte) {
+	partition := e.partitionFor(key)
+	partition.mu.Lock()
+	defer partition.mu.Unlock()
+
+	if e.index.Delete(string(key)) {
+		if err := e.logIndexChange(string(key), nil); err != nil {
+			e.counters.recordError(err)
+		}
+		e.counters.evictions.Add(1)
+		e.history.forget(string(key))
+		e.unindex(string(key))
+		e.replicate(key, nil)
+		e.notify(EventEvict, key, nil, 0)
+	}
+}
@@ -0,0 +1,127 @@
+package engine
+
+import (
+	"sync"
+	"time"
+
+	"github.com/iamBelugaa/kvix/internal/index"
+	"github.com/iamBelugaa/kvix/pkg/options"
+)
+
+// expirationQueueLimit is the most expired keys kept for a handler that has
+// fallen behind. Keys expiring while the queue is full are dropped, so a slow
+// handler cannot make the queue grow without bound.
+const expirationQueueLimit = 64 * 1024
+
+// expiredKey is a key waiting to be handed to the expiration handler.
+type expiredKey struct {
+	key  []byte
+	meta options.RecordMeta
+}
+
+// expirationQueue holds expired keys for the expiration handler, which runs
+// on a goroutine of its own: keys expire under the instance's locks, and the
+// handler may call back into the instance.
+type expirationQueue struct {
+	mu   sync.Mutex
+	keys []expiredKey
+	// dropped counts the keys pushed while the queue was full since the
+	// last take.
+	dropped int
+	wake    chan struct{}
+}
+
+func (q *expirationQueue) push(expired expiredKey) {
+	q.mu.Lock()
+	if len(q.keys) < expirationQueueLimit {
+		q.keys = append(q.keys, expired)
+	} else {
+		q.dropped++
+	}
+	q.mu.Unlock()
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// take empties the queue, returning the keys it held and how many were
+// dropped since the last take.
+func (q *expirationQueue) take() ([]expiredKey, int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	keys, dropped := q.keys, q.dropped
+	q.keys, q.dropped = nil, 0
+	return keys, dropped
+}
+
+// live returns the entry of key unless it is missing or expired, removing it
+// if it expired longer ago than the stale grace period.
+func (e *Engine) live(key []byte) (*index.RecordPointer, bool) {
+	pointer, ok := e.index.Peek(string(key))
+	if !ok {
+		return nil, false
+	}
+
+	if pointer.IsExpired() {
+		if !pointer.IsStale(e.options.StaleGracePeriod) {
+			e.removeExpired(key)
+		}
+		return nil, false
+	}
+	return pointer, true
+}
+
+// removeExpired removes key if it expired, under its partition lock so that
+// its expiration is ordered with the writes to it.
+func (e *Engine) removeExpired(key []byte) {
+	partition := e.partitionFor(key)
+	partition.mu.Lock()
+	defer partition.mu.Unlock()
+
+	e.index.RemoveExpired(string(key))
+}
+
+// notifyExpired is the index's expiration hook, called under the partition
+// lock of key.
+func (e *Engine) notifyExpired(key string, pointer *index.RecordPointer) {
+	if err := e.logIndexChange(key, nil); err != nil {
+		e.counters.recordError(err)
+	}
+	e.unindex(key)
+	e.notify(EventExpire, []byte(key), nil, 0)
+
+	if e.expirations != nil {
+		e.expirations.push(expiredKey{
+			key:  []byte(key),
+			meta: options.RecordMeta{ExpiresAt: time.Unix(0, pointer.ExpiresAt), Size: pointer.Size},
+		})
+	}
+}
+
+// runExpirationHandler hands queued keys to handler until the engine closes.
+// Close does not wait for it, since a handler calling back into the instance
+// may be waiting on the lock held while closing.
+func (e *Engine) runExpirationHandler(handler options.ExpirationHandler) {
+	for {
+		select {
+		case <-e.stop:
+			return
+		case <-e.expirations.wake:
+		}
+
+		keys, dropped := e.expirations.take()
+		if dropped > 0 {
+			e.log.Warnw("Expiration handler fell behind, expired keys were not reported", "dropped", dropped)
+		}
+
+		for _, expired := range keys {
+			if e.closed.Load() {
+				return
+			}
+			handler(expired.key, expired.meta)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package engine
+
+import (
+	"expvar"
+	"sync"
+	"sync/atomic"
+)
+
+// expvarTargets maps each published prefix to the engine currently serving
+// it. expvar names cannot be unpublished, so reopening an instance under the
+// same prefix rebinds the existing variable instead of publishing a new one.
+var expvarTargets sync.Map
+
+func (e *Engine) publishExpvar(prefix string) {
+	target, loaded := expvarTargets.LoadOrStore(prefix, new(atomic.Pointer[Engine]))
+	pointer := target.(*atomic.Pointer[Engine])
+	pointer.Store(e)
+
+	if loaded {
+		return
+	}
+
+	expvar.Publish(prefix, expvar.Func(func() any {
+		engine := pointer.Load()
+		if engine == nil || engine.closed.Load() {
+			return nil
+		}
+		return engine.expvarSnapshot()
+	}))
+}
+
+func (e *Engine) unpublishExpvar(prefix string) {
+	if target, ok := expvarTargets.Load(prefix); ok {
+		target.(*atomic.Pointer[Engine]).CompareAndSwap(e, nil)
+	}
+}
+
+func (e *Engine) expvarSnapshot() map[string]any {
+	snapshot := map[string]any{
+		"sets":            e.counters.sets.Load(),
+		"gets":            e.counters.gets.Load(),
+		"misses":          e.counters.misses.Load(),
+		"deletes":         e.counters.deletes.Load(),
+		"expired":         e.expired.Load(),
+		"evictions":       e.counters.evictions.Load(),
+		"errors":          e.counters.errors.Load(),
+		"errorsByCode":    e.counters.errorsByCode(),
+		"partitions":      len(e.partitions),
+		"activeSegmentId": e.partitions[0].storage.SegmentID(),
+		"activeOffset":    e.partitions[0].storage.Offset(),
+	}
+
+	pool := e.segmentPoolStats()
+	snapshot["segmentPool"] = map[string]any{
+		"hits":        pool.Hits,
+		"misses":      pool.Misses,
+		"opens":       pool.Opens,
+		"closes":      pool.Closes,
+		"openHandles": pool.Open,
+	}
+
+	snapshot["sizes"] = map[string]any{
+		"keysWritten":   e.counters.sizes.keysWritten.snapshot(),
+		"valuesWritten": e.counters.sizes.valuesWritten.snapshot(),
+		"keysRead":      e.counters.sizes.keysRead.snapshot(),
+		"valuesRead":    e.counters.sizes.valuesRead.snapshot(),
+	}
+
+	if segments, _, err := e.segmentUsage(); err == nil {
+		snapshot["segments"] = segments
+	}
+
+	return snapshot
+}
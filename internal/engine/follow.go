@@ -0,0 +1,448 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/iamBelugaa/kvix/internal/replication"
+	"github.com/iamBelugaa/kvix/pkg/errors"
+	"github.com/iamBelugaa/kvix/pkg/filesys"
+	"github.com/iamBelugaa/kvix/pkg/options"
+	"github.com/iamBelugaa/kvix/pkg/seginfo"
+)
+
+const (
+	followRetryMin = 100 * time.Millisecond
+	followRetryMax = 5 * time.Second
+)
+
+// ReplicaStatus describes a replica's link to its primary.
+type ReplicaStatus struct {
+	Primary   string
+	Connected bool
+	// Synced is set once the current connection finished its initial sync;
+	// from then on reads trail the primary only by replication lag.
+	Synced      bool
+	LastContact time.Time
+}
+
+// follower is the state of an engine opened as a replica.
+type follower struct {
+	mu     sync.Mutex
+	status ReplicaStatus
+}
+
+func (f *follower) update(fn func(status *ReplicaStatus)) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	fn(&f.status)
+}
+
+// ReplicaStatus returns the state of the link to the primary, and false when
+// the engine is not a replica.
+func (e *Engine) ReplicaStatus() (ReplicaStatus, bool) {
+	if e.follower == nil {
+		return ReplicaStatus{}, false
+	}
+
+	e.follower.mu.Lock()
+	defer e.follower.mu.Unlock()
+	return e.follower.status, true
+}
+
+// followPrimary keeps a connection to the primary open until the engine
+// closes, reconnecting with backoff whenever it drops.
+func (e *Engine) followPrimary() {
+	defer e.wg.Done()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		select {
+		case <-e.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	retry := followRetryMin
+	for {
+		synced, err := e.follow(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+
+		if synced {
+			retry = followRetryMin
+		}
+
+		e.log.Warnw("Replication from primary interrupted", "primary", e.options.ReplicaOf, "retryIn", retry, "error", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retry):
+		}
+		retry = min(retry*2, followRetryMax)
+	}
+}
+
+// follow runs one connection to the primary and reports whether it got as
+// far as finishing the initial sync.
+func (e *Engine) follow(ctx context.Context) (bool, error) {
+	dialer := net.Dialer{Timeout: replication.Timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", e.options.ReplicaOf)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	hello, err := e.replicaHello()
+	if err != nil {
+		return false, err
+	}
+
+	rc := replication.NewConn(conn)
+	conn.SetWriteDeadline(time.Now().Add(replication.Timeout))
+	if err := rc.WriteHello(hello); err != nil {
+		return false, err
+	}
+	if err := rc.Flush(); err != nil {
+		return false, err
+	}
+
+	e.follower.update(func(status *ReplicaStatus) { status.Connected = true })
+	defer e.follower.update(func(status *ReplicaStatus) {
+		status.Connected = false
+		status.Synced = false
+	})
+
+	session := &followSession{
+		engine:  e,
+		syncing: true,
+		files:   make(map[string]filesys.File),
+		seen:    make(map[string]struct{}),
+		lists:   make(map[uint8][]string),
+	}
+	defer session.close()
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(replication.Timeout))
+		message, err := rc.Read()
+		if err != nil {
+			return !session.syncing, err
+		}
+
+		e.follower.update(func(status *ReplicaStatus) { status.LastContact = time.Now() })
+		if err := session.apply(message); err != nil {
+			return !session.syncing, err
+		}
+	}
+}
+
+// replicaHello names the segments the replica already holds, so the primary
+// only sends what is missing.
+func (e *Engine) replicaHello() (*replication.Hello, error) {
+	hello := &replication.Hello{
+		Partitions: uint8(len(e.partitions)),
+		Prefix:     e.options.SegmentOptions.Prefix,
+	}
+
+	for _, p := range e.partitions {
+		paths, err := p.storage.SegmentPaths()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, path := range paths {
+			segment, err := describeSegment(e.options.FileSystem, p.id, path)
+			if err != nil {
+				return nil, err
+			}
+			hello.Segments = append(hello.Segments, segment)
+		}
+	}
+
+	return hello, nil
+}
+
+func describeSegment(fsys filesys.FileSystem, partition uint8, path string) (replication.SegmentFile, error) {
+	file, err := fsys.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		return replication.SegmentFile{}, errors.NewStorageError(err, errors.ErrIOGeneral, "Failed to open segment").
+			WithPath(path)
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return replication.SegmentFile{}, errors.NewStorageError(err, errors.ErrIOGeneral, "Failed to stat segment").
+			WithPath(path)
+	}
+
+	checksum, err := tailChecksum(file, stat.Size())
+	if err != nil {
+		return replication.SegmentFile{}, errors.NewStorageError(err, errors.ErrIOGeneral, "Failed to read segment").
+			WithPath(path)
+	}
+
+	return replication.SegmentFile{
+		Partition:    partition,
+		Name:         filepath.Base(path),
+		Size:         stat.Size(),
+		TailChecksum: checksum,
+	}, nil
+}
+
+// followSession applies what one connection to the primary sends.
+type followSession struct {
+	engine  *Engine
+	syncing bool
+	files   map[string]filesys.File
+	dirty   []filesys.File
+	// seen and lists collect the keys and segments of the initial sync.
+	seen  map[string]struct{}
+	lists map[uint8][]string
+}
+
+func (s *followSession) apply(message *replication.Message) error {
+	e := s.engine
+
+	switch message.Type {
+	case replication.MessageError:
+		return fmt.Errorf("primary ended replication: %s", message.Error)
+
+	case replication.MessageSegment:
+		return s.writeSegment(message)
+
+	case replication.MessageSegmentList:
+		if int(message.Partition) >= len(e.partitions) {
+			return fmt.Errorf("%w: segment list for partition %d", replication.ErrProtocol, message.Partition)
+		}
+		s.lists[message.Partition] = message.Segments
+
+	case replication.MessagePut:
+		if int(message.Pointer.Partition) >= len(e.partitions) {
+			return fmt.Errorf("%w: key points at partition %d", replication.ErrProtocol, message.Pointer.Partition)
+		}
+		s.put(message)
+
+	case replication.MessageDelete:
+		s.delete(message.Key)
+
+	case replication.MessageSynced:
+		return s.finishSync()
+
+	case replication.MessageHeartbeat:
+		if e.syncPolicy() != options.SyncNone {
+			return s.syncFiles()
+		}
+
+	default:
+		return fmt.Errorf("%w: unexpected message type %d", replication.ErrProtocol, message.Type)
+	}
+
+	return nil
+}
+
+func (s *followSession) put(message *replication.Message) {
+	e := s.engine
+	key := message.Key
+	pointer := message.Pointer
+
+	partition := e.partitionFor(key)
+	partition.mu.Lock()
+	defer partition.mu.Unlock()
+
+	e.index.Set(string(key), &pointer)
+	if s.syncing {
+		s.seen[string(key)] = struct{}{}
+		return
+	}
+
+	if e.watching.Load() == 0 {
+		return
+	}
+
+	record, err := e.storageFor(&pointer).Get(
+		context.Background(), key, pointer.SegmentID, pointer.SegmentTimestamp, pointer.Offset,
+	)
+	if err != nil {
+		e.log.Warnw("Failed to read replicated record for watchers", "key", string(key), "error", err)
+		return
+	}
+	e.notify(EventSet, key, record.Value, pointer.ExpiresAt)
+}
+
+func (s *followSession) delete(key []byte) {
+	e := s.engine
+
+	partition := e.partitionFor(key)
+	partition.mu.Lock()
+	defer partition.mu.Unlock()
+
+	if e.index.Delete(string(key)) && !s.syncing {
+		e.notify(EventDelete, key, nil, 0)
+	}
+}
+
+// writeSegment writes shipped bytes into the replica's copy of a segment,
+// cutting the copy off at the chunk's offset first.
+func (s *followSession) writeSegment(message *replication.Message) error {
+	e := s.engine
+	if int(message.Partition) >= len(e.partitions) {
+		return fmt.Errorf("%w: segment for partition %d", replication.ErrProtocol, message.Partition)
+	}
+
+	name := message.Segment
+	if _, err := seginfo.ParseSegmentTimestamp(name, e.options.SegmentOptions.Prefix); err != nil ||
+		filepath.Base(name) != name || filepath.Ext(name) != ".seg" {
+		return fmt.Errorf("%w: invalid segment name %q", replication.ErrProtocol, name)
+	}
+
+	p := e.partitions[message.Partition]
+	path := filepath.Join(filepath.Dir(p.storage.ActiveSegmentPath()), name)
+
+	file, ok := s.files[path]
+	if !ok {
+		var err error
+		file, err = e.options.FileSystem.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+		if err != nil {
+			return errors.NewStorageError(err, errors.ErrIOGeneral, "Failed to open replicated segment").WithPath(path)
+		}
+		s.files[path] = file
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return errors.NewStorageError(err, errors.ErrIOGeneral, "Failed to stat replicated segment").WithPath(path)
+	}
+
+	if message.Offset > stat.Size() {
+		return fmt.Errorf(
+			"%w: chunk of %s at offset %d leaves a gap after %d bytes",
+			replication.ErrProtocol, name, message.Offset, stat.Size(),
+		)
+	}
+
+	if message.Offset < stat.Size() {
+		if err := file.Truncate(message.Offset); err != nil {
+			return errors.NewStorageError(err, errors.ErrIOGeneral, "Failed to truncate replicated segment").
+				WithPath(path)
+		}
+	}
+
+	if _, err := file.WriteAt(message.Data, message.Offset); err != nil {
+		return errors.NewStorageError(err, errors.ErrIOWriteFailed, "Failed to write replicated segment").
+			WithPath(path).
+			WithDetail("offset", message.Offset)
+	}
+
+	if path == p.storage.ActiveSegmentPath() {
+		p.storage.SetOffset(message.Offset + int64(len(message.Data)))
+	}
+
+	if e.syncsEachWrite() {
+		if err := file.Sync(); err != nil {
+			return errors.NewStorageError(err, errors.ErrIOSyncFailed, "Failed to sync replicated segment").
+				WithPath(path)
+		}
+	} else if !slices.Contains(s.dirty, file) {
+		s.dirty = append(s.dirty, file)
+	}
+
+	return nil
+}
+
+// finishSync drops the keys the primary no longer has and the segments it
+// no longer lists, which a previous connection may have left behind.
+func (s *followSession) finishSync() error {
+	e := s.engine
+
+	pointers, err := e.index.Snapshot()
+	if err != nil {
+		return err
+	}
+
+	var dropped int
+	for key := range pointers {
+		if _, ok := s.seen[key]; ok {
+			continue
+		}
+
+		partition := e.partitionFor([]byte(key))
+		partition.mu.Lock()
+		if e.index.Delete(key) {
+			dropped++
+		}
+		partition.mu.Unlock()
+	}
+
+	for partition, names := range s.lists {
+		p := e.partitions[partition]
+		paths, err := p.storage.SegmentPaths()
+		if err != nil {
+			return err
+		}
+
+		for _, path := range paths {
+			if slices.Contains(names, filepath.Base(path)) || path == p.storage.ActiveSegmentPath() {
+				continue
+			}
+
+			if file, ok := s.files[path]; ok {
+				file.Close()
+				delete(s.files, path)
+				s.dirty = slices.DeleteFunc(s.dirty, func(dirty filesys.File) bool { return dirty == file })
+			}
+
+			if err := e.options.FileSystem.Remove(path); err != nil && !os.IsNotExist(err) {
+				return errors.NewStorageError(err, errors.ErrIOGeneral, "Failed to remove segment dropped by primary").
+					WithPath(path)
+			}
+		}
+	}
+
+	s.syncing = false
+	s.seen = nil
+	s.lists = nil
+	e.follower.update(func(status *ReplicaStatus) { status.Synced = true })
+
+	e.log.Infow("Replica synced with primary", "primary", e.options.ReplicaOf, "keys", len(pointers)-dropped, "dropped", dropped)
+	return s.syncFiles()
+}
+
+// syncFiles fsyncs the segments written since the last call.
+func (s *followSession) syncFiles() error {
+	for _, file := range s.dirty {
+		if err := file.Sync(); err != nil {
+			return errors.NewStorageError(err, errors.ErrIOSyncFailed, "Failed to sync replicated segment").
+				WithPath(file.Name())
+		}
+	}
+
+	s.dirty = s.dirty[:0]
+	return nil
+}
+
+func (s *followSession) close() {
+	if err := s.syncFiles(); err != nil {
+		s.engine.log.Errorw("Failed to sync replicated segments", "error", err)
+	}
+
+	for _, file := range s.files {
+		file.Close()
+	}
+}
@@ -0,0 +1,233 @@
+package engine
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/iamBelugaa/kvix/internal/index"
+	"github.com/iamBelugaa/kvix/pkg/errors"
+	"github.com/iamBelugaa/kvix/pkg/filesys"
+)
+
+const segmentGarbageFile = "garbage.json"
+
+// segmentGarbage counts the bytes of one segment's records that keys stopped
+// pointing at, by why they did.
+type segmentGarbage struct {
+	overwritten int64
+	deleted     int64
+	expired     int64
+	records     int64
+}
+
+func (g segmentGarbage) bytes() int64 {
+	return g.overwritten + g.deleted + g.expired
+}
+
+// garbageTracker keeps segmentGarbage per segment, updated as index pointers
+// move rather than recomputed from the index, and carried across restarts in
+// the data directory.
+type garbageTracker struct {
+	mu       sync.Mutex
+	segments map[segmentKey]*segmentGarbage
+}
+
+func (g *garbageTracker) add(segment segmentKey, size int64, reason index.Release) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.segments == nil {
+		g.segments = make(map[segmentKey]*segmentGarbage)
+	}
+
+	garbage := g.segments[segment]
+	if garbage == nil {
+		garbage = &segmentGarbage{}
+		g.segments[segment] = garbage
+	}
+
+	switch reason {
+	case index.ReleaseOverwritten:
+		garbage.overwritten += size
+	case index.ReleaseDeleted:
+		garbage.deleted += size
+	case index.ReleaseExpired:
+		garbage.expired += size
+	}
+	garbage.records++
+}
+
+func (g *garbageTracker) get(segment segmentKey) segmentGarbage {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if garbage := g.segments[segment]; garbage != nil {
+		return *garbage
+	}
+	return segmentGarbage{}
+}
+
+func (g *garbageTracker) drop(segment segmentKey) {
+	g.mu.Lock()
+	delete(g.segments, segment)
+	g.mu.Unlock()
+}
+
+// retain forgets the segments missing from existing, which were removed
+// since they were counted.
+func (g *garbageTracker) retain(existing map[segmentKey]struct{}) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for segment := range g.segments {
+		if _, ok := existing[segment]; !ok {
+			delete(g.segments, segment)
+		}
+	}
+}
+
+// garbageEntry is the persisted form of one segment's garbage.
+type garbageEntry struct {
+	Partition        uint8  `json:"partition"`
+	SegmentID        uint16 `json:"segmentId"`
+	SegmentTimestamp int64  `json:"segmentTimestamp"`
+	OverwrittenBytes int64  `json:"overwrittenBytes"`
+	DeletedBytes     int64  `json:"deletedBytes"`
+	ExpiredBytes     int64  `json:"expiredBytes"`
+	Records          int64  `json:"records"`
+}
+
+func (g *garbageTracker) entries() []garbageEntry {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	entries := make([]garbageEntry, 0, len(g.segments))
+	for segment, garbage := range g.segments {
+		entries = append(entries, garbageEntry{
+			Partition:        segment.partition,
+			SegmentID:        segment.id,
+			SegmentTimestamp: segment.timestamp,
+			OverwrittenBytes: garbage.overwritten,
+			DeletedBytes:     garbage.deleted,
+			ExpiredBytes:     garbage.expired,
+			Records:          garbage.records,
+		})
+	}
+	return entries
+}
+
+// recordGarbage is the index's release hook. It drops the deduplication
+// reference the key held on the record, and counts the record against its
+// segment once no key points at it any more: a deduplicated record still
+// shared by other keys is not garbage until the last of them lets go, whether
+// it was overwritten, deleted or expired.
+func (e *Engine) recordGarbage(pointer *index.RecordPointer, reason index.Release) {
+	if e.dedup != nil && !e.dedup.Release(pointerLocation(pointer)) {
+		return
+	}
+
+	e.garbage.add(pointerSegment(pointer), int64(pointer.Size), reason)
+}
+
+// loadGarbage restores the counts persisted by the previous run, for the
+// segments that still exist, and starts counting. It runs once the index is
+// loaded, so rebuilding it does not count the records it skips over again.
+func (e *Engine) loadGarbage() error {
+	data, err := filesys.ReadFile(e.options.FileSystem, filepath.Join(e.options.DataDir, segmentGarbageFile))
+	if err != nil && !os.IsNotExist(err) {
+		return errors.NewStorageError(err, errors.ErrIOGeneral, "Failed to read segment garbage file").
+			WithPath(e.options.DataDir).
+			WithFileName(segmentGarbageFile)
+	}
+
+	if err == nil {
+		var entries []garbageEntry
+		if err := json.Unmarshal(data, &entries); err != nil {
+			return errors.NewStorageError(err, errors.ErrRecordDeserialization, "Failed to decode segment garbage file").
+				WithPath(e.options.DataDir).
+				WithFileName(segmentGarbageFile)
+		}
+
+		segments := make(map[segmentKey]*segmentGarbage, len(entries))
+		for _, entry := range entries {
+			segments[segmentKey{partition: entry.Partition, id: entry.SegmentID, timestamp: entry.SegmentTimestamp}] =
+				&segmentGarbage{
+					overwritten: entry.OverwrittenBytes,
+					deleted:     entry.DeletedBytes,
+					expired:     entry.ExpiredBytes,
+					records:     entry.Records,
+				}
+		}
+		e.garbage.segments = segments
+
+		existing, err := e.existingSegments()
+		if err != nil {
+			return err
+		}
+		e.garbage.retain(existing)
+	}
+
+	// Only the dedup table needs to know which record of a segment was
+	// released.
+	e.index.OnRelease(e.recordGarbage, e.dedup != nil)
+	return nil
+}
+
+// persistGarbage writes the per-segment counts through a temporary file and a
+// rename, dropping segments removed since they were counted.
+func (e *Engine) persistGarbage() error {
+	existing, err := e.existingSegments()
+	if err != nil {
+		return err
+	}
+	e.garbage.retain(existing)
+
+	data, err := json.Marshal(e.garbage.entries())
+	if err != nil {
+		return errors.NewStorageError(err, errors.ErrRecordSerialization, "Failed to encode segment garbage file")
+	}
+
+	if err := filesys.CreateDir(e.options.FileSystem, e.options.DataDir, 0755, true); err != nil {
+		return errors.NewStorageError(err, errors.ErrIOGeneral, err.Error()).WithPath(e.options.DataDir)
+	}
+
+	path := filepath.Join(e.options.DataDir, segmentGarbageFile)
+	tmpPath := path + ".tmp"
+
+	if err := filesys.WriteFile(e.options.FileSystem, tmpPath, data, 0644); err != nil {
+		return errors.NewStorageError(err, errors.ErrIOWriteFailed, "Failed to write segment garbage file").
+			WithPath(tmpPath)
+	}
+
+	if err := e.options.FileSystem.Rename(tmpPath, path); err != nil {
+		return errors.NewStorageError(err, errors.ErrIOGeneral, "Failed to replace segment garbage file").
+			WithPath(path)
+	}
+
+	return nil
+}
+
+// existingSegments returns every segment of every partition, the active ones
+// included.
+func (e *Engine) existingSegments() (map[segmentKey]struct{}, error) {
+	existing := make(map[segmentKey]struct{})
+	for _, p := range e.partitions {
+		paths, err := p.storage.SealedSegmentPaths()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, path := range paths {
+			segment, err := e.segmentKeyOf(p.id, path)
+			if err != nil {
+				return nil, err
+			}
+			existing[segment] = struct{}{}
+		}
+
+		existing[segmentKey{partition: p.id, id: p.storage.SegmentID(), timestamp: p.storage.SegmentTimestamp()}] = struct{}{}
+	}
+	return existing, nil
+}
@@ -0,0 +1,440 @@
+package engine
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/iamBelugaa/kvix/internal/backup"
+	"github.com/iamBelugaa/kvix/internal/index"
+	"github.com/iamBelugaa/kvix/internal/storage"
+	"github.com/iamBelugaa/kvix/pkg/errors"
+	"github.com/iamBelugaa/kvix/pkg/filesys"
+	"github.com/iamBelugaa/kvix/pkg/options"
+)
+
+// historyName keeps retained versions across restarts, each a historyEntry
+// followed by its key, newest first per key. Like the index hint it is written
+// by Close and consumed on open.
+const historyName = "index.history"
+
+// historyEntry is the on-disk form of a version.
+type historyEntry struct {
+	WrittenAt int64
+	Deleted   bool
+	Pointer   backup.HintHeader
+}
+
+// Version is one retained change of a key: a write, or a Delete.
+type Version struct {
+	// Record is nil for deletions.
+	Record *storage.Record
+	// ExpiresAt is the zero time for versions written without a TTL.
+	ExpiresAt time.Time
+	WrittenAt time.Time
+	Deleted   bool
+	// Current marks the version Get returns. Older versions, and every
+	// version of a deleted or expired key, are not current.
+	Current bool
+}
+
+// version is where a retained version is stored and when it was made.
+type version struct {
+	pointer   index.RecordPointer
+	writtenAt int64
+	deleted   bool
+}
+
+// history remembers where the last limit versions of every key are stored.
+// Appends never overwrite records, so older versions stay readable for as
+// long as their segments exist.
+type history struct {
+	mu       sync.RWMutex
+	limit    int
+	versions map[string][]version
+}
+
+func newHistory(limit int) *history {
+	if limit <= 0 {
+		return nil
+	}
+	return &history{limit: limit, versions: make(map[string][]version)}
+}
+
+// record makes pointer the newest version of key.
+func (h *history) record(key string, pointer *index.RecordPointer) {
+	if h == nil {
+		return
+	}
+	h.push(key, version{pointer: *pointer, writtenAt: time.Now().UnixNano()})
+}
+
+// delete records that key was deleted.
+func (h *history) delete(key string) {
+	if h == nil {
+		return
+	}
+	h.push(key, version{writtenAt: time.Now().UnixNano(), deleted: true})
+}
+
+func (h *history) push(key string, v version) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	versions := h.versions[key]
+	if len(versions) < h.limit {
+		versions = append(versions, version{})
+	}
+	copy(versions[1:], versions)
+	versions[0] = v
+	h.versions[key] = versions
+}
+
+// relocate points the version stored at from to its copy at to.
+func (h *history) relocate(key string, from, to *index.RecordPointer) {
+	if h == nil {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i := range h.versions[key] {
+		if v := &h.versions[key][i]; !v.deleted && samePointer(&v.pointer, from) {
+			v.pointer = *to
+		}
+	}
+}
+
+func (h *history) forget(key string) {
+	if h == nil {
+		return
+	}
+
+	h.mu.Lock()
+	delete(h.versions, key)
+	h.mu.Unlock()
+}
+
+// segments adds the segments holding retained versions to referenced.
+func (h *history) segments(referenced map[segmentKey]struct{}) {
+	if h == nil {
+		return
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for _, versions := range h.versions {
+		for i := range versions {
+			if !versions[i].deleted {
+				referenced[pointerSegment(&versions[i].pointer)] = struct{}{}
+			}
+		}
+	}
+}
+
+func (h *history) get(key string) []version {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return slices.Clone(h.versions[key])
+}
+
+// History returns the retained versions of key, newest first, including
+// versions of a key that has since been deleted or expired.
+func (e *Engine) History(ctx context.Context, key []byte) ([]Version, error) {
+	if e.closed.Load() {
+		return nil, ErrEngineClosed
+	}
+
+	if e.history == nil {
+		return nil, errHistoryDisabled()
+	}
+
+	retained := e.history.get(string(key))
+	if len(retained) == 0 {
+		return nil, errors.NewIndexError(nil, errors.ErrIndexKeyNotFound, "Key has no retained versions").
+			WithKey(string(key))
+	}
+
+	current, live := e.index.Get(string(key))
+	versions := make([]Version, 0, len(retained))
+	for i := range retained {
+		version, err := e.readVersion(ctx, key, &retained[i])
+		if err != nil {
+			return nil, err
+		}
+
+		if live && i == 0 && !retained[i].deleted && samePointer(current, &retained[i].pointer) {
+			version.Current = true
+			version.ExpiresAt = expiryTime(current.ExpiresAt)
+		}
+		versions = append(versions, version)
+	}
+
+	return versions, nil
+}
+
+// GetVersion returns the record of the nth most recent retained version of
+// key, where 0 is the latest. Deletions have no record to return.
+func (e *Engine) GetVersion(ctx context.Context, key []byte, n int) (*storage.Record, error) {
+	if e.closed.Load() {
+		return nil, ErrEngineClosed
+	}
+
+	if e.history == nil {
+		return nil, errHistoryDisabled()
+	}
+
+	retained := e.history.get(string(key))
+	if n < 0 || n >= len(retained) {
+		return nil, errors.NewIndexError(nil, errors.ErrIndexKeyNotFound, "Version not retained").
+			WithKey(string(key)).
+			WithDetail("version", n).
+			WithDetail("retained", len(retained))
+	}
+
+	if retained[n].deleted {
+		return nil, errors.NewIndexError(nil, errors.ErrIndexKeyNotFound, "Version is a deletion").
+			WithKey(string(key)).
+			WithDetail("version", n)
+	}
+
+	version, err := e.readVersion(ctx, key, &retained[n])
+	if err != nil {
+		return nil, err
+	}
+	return version.Record, nil
+}
+
+// GetAsOf returns the record key held at t: the newest retained version
+// written at or before t, unless that version was a deletion or its TTL ran
+// out by t. Reading several keys as of the same t gives a consistent view of
+// them. Keys written before their history began are resolved from the
+// current record's timestamp, to the second.
+func (e *Engine) GetAsOf(ctx context.Context, key []byte, t time.Time) (*storage.Record, error) {
+	if e.closed.Load() {
+		return nil, ErrEngineClosed
+	}
+
+	if e.history == nil {
+		return nil, errHistoryDisabled()
+	}
+
+	notFound := func(message string) error {
+		return errors.NewIndexError(nil, errors.ErrIndexKeyNotFound, message).
+			WithKey(string(key)).
+			WithDetail("asOf", t)
+	}
+
+	asOf := t.UnixNano()
+	retained := e.history.get(string(key))
+	if len(retained) == 0 {
+		record, err := e.Get(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+
+		if record.Header.Timestamp > t.Unix() {
+			return nil, notFound("Key did not exist at the requested time")
+		}
+		return record, nil
+	}
+
+	for i := range retained {
+		v := &retained[i]
+		if v.writtenAt > asOf {
+			continue
+		}
+
+		if v.deleted {
+			return nil, notFound("Key was deleted at the requested time")
+		}
+
+		if v.pointer.ExpiresAt != 0 && asOf > v.pointer.ExpiresAt {
+			return nil, notFound("Key had expired at the requested time")
+		}
+
+		version, err := e.readVersion(ctx, key, v)
+		if err != nil {
+			return nil, err
+		}
+		return version.Record, nil
+	}
+
+	if len(retained) == e.history.limit {
+		return nil, notFound("Key's version at the requested time is no longer retained")
+	}
+	return nil, notFound("Key did not exist at the requested time")
+}
+
+func (e *Engine) readVersion(ctx context.Context, key []byte, v *version) (Version, error) {
+	if v.deleted {
+		return Version{WrittenAt: time.Unix(0, v.writtenAt), Deleted: true}, nil
+	}
+
+	pointer := &v.pointer
+	record, err := e.storageFor(pointer).Get(ctx, key, pointer.SegmentID, pointer.SegmentTimestamp, pointer.Offset)
+	if err != nil {
+		e.counters.recordError(err)
+		return Version{}, err
+	}
+
+	if e.dedup != nil {
+		record.Key = key
+	}
+
+	return Version{
+		Record:    record,
+		ExpiresAt: expiryTime(pointer.ExpiresAt),
+		WrittenAt: time.Unix(0, v.writtenAt),
+	}, nil
+}
+
+func expiryTime(expiresAt int64) time.Time {
+	if expiresAt == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, expiresAt)
+}
+
+func errHistoryDisabled() error {
+	return errors.NewValidationError(
+		nil, errors.ErrSystemInvalidInput, "Version history is disabled; open the instance WithVersionHistory",
+	)
+}
+
+// persistHistory writes the retained versions for the next open to load.
+func (e *Engine) persistHistory() error {
+	if e.history == nil {
+		return nil
+	}
+
+	e.history.mu.RLock()
+	keys := make([]string, 0, len(e.history.versions))
+	for key := range e.history.versions {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	var buffer bytes.Buffer
+	for _, key := range keys {
+		for _, v := range e.history.versions[key] {
+			entry := historyEntry{
+				WrittenAt: v.writtenAt,
+				Deleted:   v.deleted,
+				Pointer: backup.HintHeader{
+					ExpiresAt:        v.pointer.ExpiresAt,
+					Offset:           v.pointer.Offset,
+					SegmentTimestamp: v.pointer.SegmentTimestamp,
+					Size:             v.pointer.Size,
+					SegmentID:        v.pointer.SegmentID,
+					KeyLength:        uint16(len(key)),
+					Partition:        v.pointer.Partition,
+				},
+			}
+
+			if err := binary.Write(&buffer, binary.LittleEndian, entry); err != nil {
+				e.history.mu.RUnlock()
+				return errors.NewStorageError(err, errors.ErrRecordSerialization, "Failed to encode version history")
+			}
+			buffer.WriteString(key)
+		}
+	}
+	e.history.mu.RUnlock()
+
+	path := filepath.Join(e.options.DataDir, historyName)
+	if err := filesys.WriteFile(e.options.FileSystem, path+".tmp", buffer.Bytes(), 0644); err != nil {
+		return errors.NewStorageError(err, errors.ErrIOWriteFailed, "Failed to write version history").WithPath(path)
+	}
+
+	if err := e.options.FileSystem.Rename(path+".tmp", path); err != nil {
+		return errors.NewStorageError(err, errors.ErrIOGeneral, "Failed to install version history").WithPath(path)
+	}
+	return nil
+}
+
+// loadHistory consumes the versions persisted by the last Close. A history
+// that is missing, after a crash or when the option was just enabled, starts
+// empty.
+func (e *Engine) loadHistory() error {
+	if e.history == nil {
+		return nil
+	}
+
+	path := filepath.Join(e.options.DataDir, historyName)
+	file, err := e.options.FileSystem.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.NewStorageError(err, errors.ErrIOGeneral, "Failed to open version history").WithPath(path)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return errors.NewStorageError(err, errors.ErrIOGeneral, "Failed to stat version history").WithPath(path)
+	}
+	progress := e.startPhase(options.StartupHistory, info.Size())
+
+	if err := e.readHistory(bufio.NewReader(progress.reader(file))); err != nil {
+		return errors.NewStorageError(err, errors.ErrRecordDeserialization, "Failed to load version history").WithPath(path)
+	}
+
+	if err := e.options.FileSystem.Remove(path); err != nil {
+		return errors.NewStorageError(err, errors.ErrIOGeneral, "Failed to remove consumed version history").WithPath(path)
+	}
+	progress.finish()
+
+	e.log.Infow("Version history loaded", "keys", len(e.history.versions), "path", path)
+	return nil
+}
+
+func (e *Engine) readHistory(r io.Reader) error {
+	for {
+		var entry historyEntry
+		if err := binary.Read(r, binary.LittleEndian, &entry); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		key := make([]byte, entry.Pointer.KeyLength)
+		if _, err := io.ReadFull(r, key); err != nil {
+			return err
+		}
+
+		header := &entry.Pointer
+		if int(header.Partition) >= len(e.partitions) {
+			return fmt.Errorf("history references partition %d but only %d are configured", header.Partition, len(e.partitions))
+		}
+
+		versions := e.history.versions[string(key)]
+		if len(versions) == e.history.limit {
+			continue
+		}
+
+		e.history.versions[string(key)] = append(versions, version{
+			writtenAt: entry.WrittenAt,
+			deleted:   entry.Deleted,
+			pointer: index.RecordPointer{
+				ExpiresAt:        header.ExpiresAt,
+				Offset:           header.Offset,
+				SegmentTimestamp: header.SegmentTimestamp,
+				Size:             header.Size,
+				SegmentID:        header.SegmentID,
+				Partition:        header.Partition,
+			},
+		})
+	}
+}
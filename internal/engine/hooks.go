@@ -0,0 +1,104 @@
+package engine
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// Hooks are called as keys change, so embedders can invalidate caches, feed
+// other systems or count what happens without forking the engine. Any of
+// them may be nil.
+//
+// The key hooks run on the goroutine making the change, after it is applied
+// and while the key's partition is still held, so the changes of a key reach
+// them in the order they were made. They must return quickly and must not
+// change keys of the instance themselves. Key and value are only valid during
+// the call.
+type Hooks struct {
+	// OnSet is called after a write; expiresAt is zero when the key does
+	// not expire.
+	OnSet func(key, value []byte, expiresAt time.Time)
+	// OnDelete is called after a key is removed by Delete, a repair or, on a
+	// bounded instance, eviction.
+	OnDelete func(key []byte)
+	// OnExpire is called after a key is removed because its TTL ran out,
+	// whether the expiration pass or a read found it expired.
+	OnExpire func(key []byte)
+	// OnCompactionStart is called before a partition is compacted.
+	OnCompactionStart func(partition int)
+	// OnCompactionEnd is called after a partition was compacted, with the
+	// error that ended the compaction early, if any.
+	OnCompactionEnd func(partition int, err error)
+}
+
+// AddHooks registers hooks and returns a function that unregisters them.
+func (e *Engine) AddHooks(hooks Hooks) func() {
+	registered := &hooks
+
+	e.hooksMu.Lock()
+	defer e.hooksMu.Unlock()
+
+	all := append(slices.Clone(e.hookList()), registered)
+	e.hooks.Store(&all)
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			e.hooksMu.Lock()
+			defer e.hooksMu.Unlock()
+
+			remaining := slices.DeleteFunc(slices.Clone(e.hookList()), func(h *Hooks) bool {
+				return h == registered
+			})
+			e.hooks.Store(&remaining)
+		})
+	}
+}
+
+func (e *Engine) hookList() []*Hooks {
+	if hooks := e.hooks.Load(); hooks != nil {
+		return *hooks
+	}
+	return nil
+}
+
+// runHooks calls the key hooks registered for a change of type eventType.
+func (e *Engine) runHooks(eventType EventType, key, value []byte, expiresAt int64) {
+	for _, hooks := range e.hookList() {
+		switch eventType {
+		case EventSet:
+			if hooks.OnSet != nil {
+				var expiry time.Time
+				if expiresAt != 0 {
+					expiry = time.Unix(0, expiresAt)
+				}
+				hooks.OnSet(key, value, expiry)
+			}
+		case EventDelete, EventEvict:
+			if hooks.OnDelete != nil {
+				hooks.OnDelete(key)
+			}
+		case EventExpire:
+			if hooks.OnExpire != nil {
+				hooks.OnExpire(key)
+			}
+		}
+	}
+}
+
+func (e *Engine) runCompactionStartHooks(partition int) {
+	for _, hooks := range e.hookList() {
+		if hooks.OnCompactionStart != nil {
+			hooks.OnCompactionStart(partition)
+		}
+	}
+}
+
+func (e *Engine) runCompactionEndHooks(partition int, err error) {
+	for _, hooks := range e.hookList() {
+		if hooks.OnCompactionEnd != nil {
+			hooks.OnCompactionEnd(partition, err)
+		}
+	}
+}
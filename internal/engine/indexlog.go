@@ -0,0 +1,123 @@
+package engine
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/iamBelugaa/kvix/internal/index"
+	"github.com/iamBelugaa/kvix/internal/indexlog"
+	"github.com/iamBelugaa/kvix/pkg/options"
+)
+
+// indexLogCheckInterval is how often the index log's size is compared with
+// IndexLogSize.
+const indexLogCheckInterval = time.Second
+
+// indexLogEnabled reports whether keydir changes are logged. A follower's
+// index comes from its primary's manifest and is never logged.
+func (e *Engine) indexLogEnabled() bool {
+	return e.options.IndexLogSize > 0 && e.options.FollowInterval == 0
+}
+
+// openIndexLog replays the index log a crash left behind over the index
+// loaded from the hint, folds the result into a new hint and starts an empty
+// log recording every further change to the index.
+func (e *Engine) openIndexLog() error {
+	var progress *phaseProgress
+	if size := indexlog.Size(e.options.FileSystem, e.options.DataDir); size > 0 {
+		progress = e.startPhase(options.StartupRecovery, size)
+	}
+
+	replayed, err := indexlog.Replay(e.options.FileSystem, e.options.DataDir, progress.reader, e.replayIndexChange)
+	if err != nil {
+		return err
+	}
+	progress.finish()
+
+	if replayed > 0 {
+		if err := e.persistHintLocked(); err != nil {
+			return err
+		}
+		e.log.Infow("Index recovered from index log", "entries", replayed)
+	}
+
+	log, err := indexlog.Open(e.options.FileSystem, e.options.DataDir, e.syncsEachWrite())
+	if err != nil {
+		return err
+	}
+
+	e.indexLog = log
+	return nil
+}
+
+// replayIndexChange applies one logged change to the index. A pointer past
+// the end of its partition's active segment refers to a record the crash
+// lost, and leaves the key as it was.
+func (e *Engine) replayIndexChange(key string, pointer *index.RecordPointer) error {
+	if pointer == nil {
+		e.index.Delete(key)
+		return nil
+	}
+
+	if int(pointer.Partition) >= len(e.partitions) {
+		return fmt.Errorf("index log references partition %d but only %d are configured", pointer.Partition, len(e.partitions))
+	}
+
+	storage := e.partitions[pointer.Partition].storage
+	if pointer.SegmentID == storage.SegmentID() && pointer.SegmentTimestamp == storage.SegmentTimestamp() &&
+		pointer.Offset+int64(pointer.Size) > storage.Offset() {
+		return nil
+	}
+
+	if pointer.IsExpired() {
+		e.index.Delete(key)
+		return nil
+	}
+
+	e.index.Set(key, pointer)
+	return nil
+}
+
+// logIndexChange appends a change of key's index entry to the index log:
+// its new pointer, or nil once the key is gone. Every change to the index
+// after opening, whether a write, a deletion, an eviction, an expiration or a
+// record moved by compaction, goes through here. Callers must hold the key's
+// partition lock, which keeps the changes to a key in the order they were
+// made, and return the error where they have a caller to return it to; the
+// change is then in the index but will not survive a crash.
+func (e *Engine) logIndexChange(key string, pointer *index.RecordPointer) error {
+	return e.appendIndexLog(key, pointer, false)
+}
+
+// appendIndexLog is logIndexChange, leaving the fsync to the caller when
+// unsynced is set.
+func (e *Engine) appendIndexLog(key string, pointer *index.RecordPointer, unsynced bool) error {
+	if e.indexLog == nil {
+		return nil
+	}
+
+	write := e.indexLog.Append
+	if unsynced {
+		write = e.indexLog.AppendUnsynced
+	}
+
+	if err := write(key, pointer); err != nil {
+		e.counters.recordError(err)
+		e.log.Errorw("Failed to append to index log", "key", key, "error", err)
+		return err
+	}
+	return nil
+}
+
+// indexLogPass folds the index log into the index hint once it outgrows
+// IndexLogSize.
+func (e *Engine) indexLogPass() {
+	if e.indexLog.Size() < e.options.IndexLogSize {
+		return
+	}
+
+	if err := e.persistHint(); err != nil {
+		e.counters.recordError(err)
+		e.log.Errorw("Failed to checkpoint index log", "error", err)
+	}
+}
@@ -0,0 +1,101 @@
+package engine
+
+import (
+	"context"
+
+	"github.com/iamBelugaa/kvix/internal/storage"
+)
+
+// Iterator walks the keys of a snapshot in lexicographic order, reading each
+// record as it gets to it. It sees the keyspace as the snapshot does: keys
+// written or deleted after it was taken are not seen, and the segments its
+// records live in stay pinned until it is closed.
+type Iterator struct {
+	snapshot *Snapshot
+	// owned is set when the iterator took its snapshot itself, and
+	// releases it on Close.
+	owned  bool
+	keys   []string
+	next   int
+	key    []byte
+	record *storage.Record
+	err    error
+}
+
+// Iterator returns an iterator over the keys starting with prefix, on a
+// snapshot of its own that Close releases.
+func (e *Engine) Iterator(ctx context.Context, prefix []byte) (*Iterator, error) {
+	snapshot, err := e.Snapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	iterator := snapshot.Iterator(prefix)
+	iterator.owned = true
+	return iterator, nil
+}
+
+// Iterator returns an iterator over the snapshot's keys starting with
+// prefix. The snapshot must outlive it.
+func (s *Snapshot) Iterator(prefix []byte) *Iterator {
+	return &Iterator{snapshot: s, keys: s.KeysWithPrefix(string(prefix))}
+}
+
+// Next moves to the next key and reads its record. It returns false once the
+// keys run out or a read fails, which Err then reports. Keys that have expired
+// since the snapshot was taken are skipped.
+func (it *Iterator) Next(ctx context.Context) bool {
+	it.key, it.record = nil, nil
+
+	for it.err == nil && it.next < len(it.keys) {
+		if it.snapshot.released.Load() {
+			it.err = ErrSnapshotReleased
+			break
+		}
+		if it.err = ctx.Err(); it.err != nil {
+			break
+		}
+
+		key := it.keys[it.next]
+		it.next++
+
+		if pointer := it.snapshot.pointers[key]; pointer.IsExpired() {
+			continue
+		}
+
+		record, err := it.snapshot.Get(ctx, []byte(key))
+		if err != nil {
+			it.err = err
+			break
+		}
+
+		it.key, it.record = []byte(key), record
+		return true
+	}
+	return false
+}
+
+// Key returns the key Next moved to.
+func (it *Iterator) Key() []byte {
+	return it.key
+}
+
+// Record returns the record of the key Next moved to.
+func (it *Iterator) Record() *storage.Record {
+	return it.record
+}
+
+// Err returns the error that ended the iteration, if any.
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// Close ends the iteration, releasing the snapshot if the iterator took it.
+// It is safe to call more than once.
+func (it *Iterator) Close() {
+	it.keys, it.next = nil, 0
+	it.key, it.record = nil, nil
+	if it.owned {
+		it.snapshot.Release()
+	}
+}
@@ -0,0 +1,90 @@
+package engine
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"github.com/iamBelugaa/kvix/pkg/errors"
+	"github.com/iamBelugaa/kvix/pkg/filesys"
+)
+
+const lifetimeStatsFile = "stats.json"
+
+// lifetimeStats are cumulative counters carried across restarts in the data
+// directory.
+type lifetimeStats struct {
+	Writes       uint64 `json:"writes"`
+	BytesWritten uint64 `json:"bytesWritten"`
+	Compactions  uint64 `json:"compactions"`
+	Corruptions  uint64 `json:"corruptions"`
+}
+
+func loadLifetimeStats(fsys filesys.FileSystem, dataDir string) (lifetimeStats, error) {
+	var stats lifetimeStats
+
+	data, err := filesys.ReadFile(fsys, filepath.Join(dataDir, lifetimeStatsFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return stats, nil
+		}
+		return stats, errors.NewStorageError(err, errors.ErrIOGeneral, "Failed to read stats file").
+			WithPath(dataDir).
+			WithFileName(lifetimeStatsFile)
+	}
+
+	if err := json.Unmarshal(data, &stats); err != nil {
+		return stats, errors.NewStorageError(err, errors.ErrRecordDeserialization, "Failed to decode stats file").
+			WithPath(dataDir).
+			WithFileName(lifetimeStatsFile)
+	}
+
+	return stats, nil
+}
+
+func (e *Engine) lifetimeStats() lifetimeStats {
+	return lifetimeStats{
+		Writes:       e.lifetime.Writes + e.counters.sets.Load(),
+		BytesWritten: e.lifetime.BytesWritten + e.counters.bytesWritten.Load(),
+		Compactions:  e.lifetime.Compactions + e.counters.compactions.Load(),
+		Corruptions:  e.lifetime.Corruptions + e.counters.corruptions.Load(),
+	}
+}
+
+// persistLifetimeStats writes the cumulative counters through a temporary
+// file and a rename so a crash never leaves a truncated stats file behind.
+func (e *Engine) persistLifetimeStats() error {
+	data, err := json.Marshal(e.lifetimeStats())
+	if err != nil {
+		return errors.NewStorageError(err, errors.ErrRecordSerialization, "Failed to encode stats file")
+	}
+
+	if err := filesys.CreateDir(e.options.FileSystem, e.options.DataDir, 0755, true); err != nil {
+		return errors.NewStorageError(err, errors.ErrIOGeneral, err.Error()).WithPath(e.options.DataDir)
+	}
+
+	path := filepath.Join(e.options.DataDir, lifetimeStatsFile)
+	tmpPath := path + ".tmp"
+
+	if err := filesys.WriteFile(e.options.FileSystem, tmpPath, data, 0644); err != nil {
+		return errors.NewStorageError(err, errors.ErrIOWriteFailed, "Failed to write stats file").
+			WithPath(tmpPath)
+	}
+
+	if err := e.options.FileSystem.Rename(tmpPath, path); err != nil {
+		return errors.NewStorageError(err, errors.ErrIOGeneral, "Failed to replace stats file").
+			WithPath(path)
+	}
+
+	return nil
+}
+
+func (e *Engine) lifetimeStatsPass() {
+	if err := e.persistLifetimeStats(); err != nil {
+		e.log.Errorw("Failed to persist lifetime stats", "error", err)
+	}
+
+	if err := e.persistGarbage(); err != nil {
+		e.log.Errorw("Failed to persist segment garbage", "error", err)
+	}
+}
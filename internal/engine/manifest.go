@@ -0,0 +1,412 @@
+package engine
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	stdErrors "errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/iamBelugaa/kvix/internal/backup"
+	"github.com/iamBelugaa/kvix/internal/index"
+	"github.com/iamBelugaa/kvix/pkg/errors"
+	"github.com/iamBelugaa/kvix/pkg/filesys"
+	"github.com/iamBelugaa/kvix/pkg/options"
+)
+
+// manifestName is the index a primary publishes for followers sharing its
+// data directory, in the index hint format. Unlike the hint it is never
+// consumed: followers read it as often as it changes.
+//
+// Each pass appends only the keys that changed since the previous one, a
+// later entry of a key overriding earlier ones and an entry with a zero Size
+// removing it. Once the appended entries outgrow the full index the file was
+// last written with, it is written again from the index.
+const manifestName = "index.manifest"
+
+// manifestState tracks the manifest on either side. A primary keeps the keys
+// changed since the last pass and the size of the file it publishes; a
+// follower keeps the file it loaded and how much of it it has read.
+type manifestState struct {
+	fresh bool
+
+	dirtyMu  sync.Mutex
+	dirty    map[string]struct{}
+	base     int64
+	appended int64
+
+	file os.FileInfo
+	read int64
+}
+
+// markDirty records that key changed, for the next pass to publish.
+func (m *manifestState) markDirty(key []byte) {
+	m.dirtyMu.Lock()
+	defer m.dirtyMu.Unlock()
+
+	if m.dirty == nil {
+		m.dirty = make(map[string]struct{})
+	}
+	m.dirty[string(key)] = struct{}{}
+}
+
+func (m *manifestState) takeDirty() map[string]struct{} {
+	m.dirtyMu.Lock()
+	defer m.dirtyMu.Unlock()
+
+	dirty := m.dirty
+	m.dirty = nil
+	return dirty
+}
+
+// manifestPass publishes the keys that changed since the last pass.
+func (e *Engine) manifestPass() {
+	if err := e.publishManifest(); err != nil {
+		e.counters.recordError(err)
+		e.log.Errorw("Failed to publish index manifest", "error", err)
+	}
+}
+
+// publishManifest appends the keys that changed since the last call to the
+// manifest, or writes the whole index to it when that is due. The first call
+// always writes the whole index: after a crash the index may have lost keys
+// the previous manifest still lists.
+func (e *Engine) publishManifest() error {
+	e.manifestMu.Lock()
+	defer e.manifestMu.Unlock()
+
+	dirty := e.manifest.takeDirty()
+	if !e.manifest.fresh || e.manifest.appended > e.manifest.base {
+		return e.writeManifest()
+	}
+
+	if len(dirty) == 0 {
+		return nil
+	}
+
+	pointers := make(map[string]index.RecordPointer, len(dirty))
+	var removed []string
+	for key := range dirty {
+		if pointer, ok := e.index.Peek(key); ok {
+			pointers[key] = *pointer
+		} else {
+			removed = append(removed, key)
+		}
+	}
+
+	// Records the pointers lead to may still be in write buffers, where
+	// followers cannot read them.
+	if err := e.flushPartitions(); err != nil {
+		e.manifest.fresh = false
+		return err
+	}
+
+	encoded, err := encodeHint(&Snapshot{pointers: pointers})
+	if err != nil {
+		e.manifest.fresh = false
+		return err
+	}
+	encoded, err = appendManifestRemovals(encoded, removed)
+	if err != nil {
+		e.manifest.fresh = false
+		return err
+	}
+
+	path := filepath.Join(e.options.DataDir, manifestName)
+	file, err := e.options.FileSystem.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err == nil {
+		_, err = file.Write(encoded)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		// The changes taken are lost from the dirty set, and the file may
+		// end in part of them, so the next pass writes the whole index.
+		e.manifest.fresh = false
+		return errors.NewStorageError(err, errors.ErrIOWriteFailed, "Failed to append to index manifest").WithPath(path)
+	}
+
+	e.manifest.appended += int64(len(encoded))
+	e.log.Debugw("Index manifest changes published", "changed", len(pointers), "removed", len(removed), "path", path)
+	return nil
+}
+
+// writeManifest writes the whole index to the manifest under a temporary name
+// and renames it into place, so followers never see a partial file. Callers
+// hold manifestMu and have taken the dirty set: keys changing from then on
+// are published again by the next pass.
+func (e *Engine) writeManifest() error {
+	pointers, err := e.index.Snapshot()
+	if err != nil {
+		return err
+	}
+
+	if err := e.flushPartitions(); err != nil {
+		return err
+	}
+
+	encoded, err := encodeHint(&Snapshot{pointers: pointers})
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(e.options.DataDir, manifestName)
+	if err := filesys.WriteFile(e.options.FileSystem, path+".tmp", encoded, 0644); err != nil {
+		return errors.NewStorageError(err, errors.ErrIOWriteFailed, "Failed to write index manifest").WithPath(path)
+	}
+
+	if err := e.options.FileSystem.Rename(path+".tmp", path); err != nil {
+		return errors.NewStorageError(err, errors.ErrIOGeneral, "Failed to install index manifest").WithPath(path)
+	}
+
+	e.manifest.base = int64(len(encoded))
+	e.manifest.appended = 0
+	e.manifest.fresh = true
+	e.log.Debugw("Index manifest published", "keys", len(pointers), "path", path)
+	return nil
+}
+
+// appendManifestRemovals appends an entry with a zero Size for each key, which
+// removes it from followers.
+func appendManifestRemovals(buffer []byte, keys []string) ([]byte, error) {
+	for _, key := range keys {
+		var err error
+		buffer, err = binary.Append(buffer, binary.LittleEndian, backup.HintHeader{KeyLength: uint16(len(key))})
+		if err != nil {
+			return nil, err
+		}
+		buffer = append(buffer, key...)
+	}
+	return buffer, nil
+}
+
+// readManifest calls fn with each entry of the manifest in r and returns how
+// many bytes of whole entries it read. An entry cut short ends the read
+// without an error: the primary may be appending it.
+func readManifest(r io.Reader, fn func(key string, header backup.HintHeader) error) (int64, error) {
+	reader := bufio.NewReader(r)
+	var read int64
+	for {
+		var header backup.HintHeader
+		if err := binary.Read(reader, binary.LittleEndian, &header); err != nil {
+			if stdErrors.Is(err, io.EOF) || stdErrors.Is(err, io.ErrUnexpectedEOF) {
+				return read, nil
+			}
+			return read, err
+		}
+
+		key := make([]byte, header.KeyLength)
+		if _, err := io.ReadFull(reader, key); err != nil {
+			if stdErrors.Is(err, io.EOF) || stdErrors.Is(err, io.ErrUnexpectedEOF) {
+				return read, nil
+			}
+			return read, err
+		}
+
+		if err := fn(string(key), header); err != nil {
+			return read, err
+		}
+		read += int64(binary.Size(header)) + int64(header.KeyLength)
+	}
+}
+
+// followPass reloads the manifest when the primary has published a new one.
+func (e *Engine) followPass() {
+	if err := e.loadManifest(); err != nil {
+		e.counters.recordError(err)
+		e.log.Warnw("Failed to load index manifest", "error", err)
+	}
+}
+
+// loadManifest brings the index in line with the primary's manifest, if it
+// changed since the last load. Entries appended to the file loaded last are
+// applied on their own; a file written anew is loaded whole, and keys it no
+// longer lists are removed. Watchers hear of every key that changed.
+func (e *Engine) loadManifest() error {
+	e.manifestMu.Lock()
+	defer e.manifestMu.Unlock()
+
+	path := filepath.Join(e.options.DataDir, manifestName)
+	file, err := e.options.FileSystem.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		if os.IsNotExist(err) {
+			if !e.manifest.fresh {
+				e.log.Warnw("No index manifest published yet; is the primary running WithManifest?", "path", path)
+				e.manifest.fresh = true
+			}
+			return nil
+		}
+		return errors.NewStorageError(err, errors.ErrIOGeneral, "Failed to open index manifest").WithPath(path)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return errors.NewStorageError(err, errors.ErrIOGeneral, "Failed to stat index manifest").WithPath(path)
+	}
+
+	if e.manifest.file != nil && filesys.SameFile(info, e.manifest.file) && info.Size() >= e.manifest.read {
+		if info.Size() == e.manifest.read {
+			return nil
+		}
+		return e.loadManifestChanges(file, path)
+	}
+
+	progress := e.startPhase(options.StartupIndex, info.Size())
+
+	loaded := make(map[string]index.RecordPointer)
+	read, err := readManifest(progress.reader(file), func(key string, header backup.HintHeader) error {
+		if header.Size == 0 {
+			delete(loaded, key)
+			return nil
+		}
+
+		pointer, err := e.manifestPointer(header, path)
+		if err != nil {
+			return err
+		}
+		loaded[key] = pointer
+		return nil
+	})
+	if err != nil {
+		return manifestReadError(err, path)
+	}
+
+	current, err := e.index.Snapshot()
+	if err != nil {
+		return err
+	}
+
+	var changed, removed int
+	for key, pointer := range loaded {
+		if previous, ok := current[key]; ok && previous == pointer {
+			continue
+		}
+
+		e.followSet([]byte(key), &pointer)
+		changed++
+	}
+
+	for key := range current {
+		if _, ok := loaded[key]; ok {
+			continue
+		}
+
+		if e.followDelete(key) {
+			removed++
+		}
+	}
+
+	e.manifest.file = info
+	e.manifest.read = read
+	e.manifest.fresh = true
+	progress.finish()
+	e.log.Debugw("Index manifest loaded", "keys", len(loaded), "changed", changed, "removed", removed)
+	return nil
+}
+
+// loadManifestChanges applies the entries appended to the manifest since it
+// was last read.
+func (e *Engine) loadManifestChanges(file filesys.File, path string) error {
+	if _, err := file.Seek(e.manifest.read, io.SeekStart); err != nil {
+		return errors.NewStorageError(err, errors.ErrIOGeneral, "Failed to seek in index manifest").WithPath(path)
+	}
+
+	var changed, removed int
+	read, err := readManifest(file, func(key string, header backup.HintHeader) error {
+		if header.Size == 0 {
+			if e.followDelete(key) {
+				removed++
+			}
+			return nil
+		}
+
+		pointer, err := e.manifestPointer(header, path)
+		if err != nil {
+			return err
+		}
+
+		if previous, ok := e.index.Peek(key); ok && *previous == pointer {
+			return nil
+		}
+
+		e.followSet([]byte(key), &pointer)
+		changed++
+		return nil
+	})
+
+	// Entries applied before a failure are not applied twice.
+	e.manifest.read += read
+	if err != nil {
+		return manifestReadError(err, path)
+	}
+
+	e.log.Debugw("Index manifest changes loaded", "changed", changed, "removed", removed)
+	return nil
+}
+
+// manifestPointer turns a manifest entry into the pointer it stands for.
+func (e *Engine) manifestPointer(header backup.HintHeader, path string) (index.RecordPointer, error) {
+	if int(header.Partition) >= len(e.partitions) {
+		return index.RecordPointer{}, errors.NewValidationError(
+			nil, errors.ErrValidationInvalidData, "Index manifest references a partition that is not configured",
+		).
+			WithProvided(header.Partition).
+			WithExpected(len(e.partitions)).
+			WithDetail("path", path)
+	}
+
+	return index.RecordPointer{
+		ExpiresAt:        header.ExpiresAt,
+		Offset:           header.Offset,
+		SegmentTimestamp: header.SegmentTimestamp,
+		Size:             header.Size,
+		SegmentID:        header.SegmentID,
+		Partition:        header.Partition,
+	}, nil
+}
+
+func manifestReadError(err error, path string) error {
+	var validationErr *errors.ValidationError
+	if stdErrors.As(err, &validationErr) {
+		return err
+	}
+	return errors.NewStorageError(err, errors.ErrRecordDeserialization, "Failed to read index manifest").WithPath(path)
+}
+
+// followDelete removes key the primary no longer has.
+func (e *Engine) followDelete(key string) bool {
+	partition := e.partitionFor([]byte(key))
+	partition.mu.Lock()
+	defer partition.mu.Unlock()
+
+	if !e.index.Delete(key) {
+		return false
+	}
+	e.notify(EventDelete, []byte(key), nil, 0)
+	return true
+}
+
+func (e *Engine) followSet(key []byte, pointer *index.RecordPointer) {
+	partition := e.partitionFor(key)
+	partition.mu.Lock()
+	defer partition.mu.Unlock()
+
+	e.index.Set(string(key), pointer)
+	if e.watching.Load() == 0 {
+		return
+	}
+
+	record, err := e.storageFor(pointer).Get(
+		context.Background(), key, pointer.SegmentID, pointer.SegmentTimestamp, pointer.Offset,
+	)
+	if err != nil {
+		e.log.Warnw("Failed to read followed record for watchers", "key", string(key), "error", err)
+		return
+	}
+	e.notify(EventSet, key, record.Value, pointer.ExpiresAt)
+}
@@ -0,0 +1,88 @@
+package engine
+
+import (
+	"context"
+
+	"github.com/iamBelugaa/kvix/internal/index"
+)
+
+// KeyRange returns the live keys from start up to but excluding end, in
+// lexicographic order, stopping after limit keys unless limit is zero or
+// less. An empty end leaves the range open. With the ordered index layout
+// only the keys returned are walked; otherwise the whole keydir is collected
+// and sorted.
+func (e *Engine) KeyRange(ctx context.Context, start, end []byte, limit int) ([][]byte, error) {
+	return e.keyRange(ctx, string(start), string(end), limit, false)
+}
+
+// KeyRangeReverse is KeyRange from the largest key of the range down.
+func (e *Engine) KeyRangeReverse(ctx context.Context, start, end []byte, limit int) ([][]byte, error) {
+	return e.keyRange(ctx, string(start), string(end), limit, true)
+}
+
+// KeysWithPrefix returns the live keys starting with prefix, in
+// lexicographic order, stopping after limit keys unless limit is zero or
+// less.
+func (e *Engine) KeysWithPrefix(ctx context.Context, prefix []byte, limit int) ([][]byte, error) {
+	return e.keyRange(ctx, string(prefix), prefixEnd(string(prefix)), limit, false)
+}
+
+// FirstKey returns the smallest live key, reporting false if there is none.
+func (e *Engine) FirstKey(ctx context.Context) ([]byte, bool, error) {
+	keys, err := e.keyRange(ctx, "", "", 1, false)
+	if err != nil || len(keys) == 0 {
+		return nil, false, err
+	}
+	return keys[0], true, nil
+}
+
+// LastKey returns the largest live key, reporting false if there is none.
+func (e *Engine) LastKey(ctx context.Context) ([]byte, bool, error) {
+	keys, err := e.keyRange(ctx, "", "", 1, true)
+	if err != nil || len(keys) == 0 {
+		return nil, false, err
+	}
+	return keys[0], true, nil
+}
+
+func (e *Engine) keyRange(ctx context.Context, start, end string, limit int, reverse bool) ([][]byte, error) {
+	if e.closed.Load() {
+		return nil, ErrEngineClosed
+	}
+
+	walk := e.index.Ascend
+	if reverse {
+		walk = e.index.Descend
+	}
+
+	var keys [][]byte
+	var cancelled error
+	err := walk(start, end, func(key string, _ *index.RecordPointer) bool {
+		if cancelled = ctx.Err(); cancelled != nil {
+			return false
+		}
+
+		keys = append(keys, []byte(key))
+		return limit <= 0 || len(keys) < limit
+	})
+	if err != nil {
+		return nil, err
+	}
+	if cancelled != nil {
+		return nil, cancelled
+	}
+	return keys, nil
+}
+
+// prefixEnd returns the smallest key greater than every key starting with
+// prefix, or "" if there is none.
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}
@@ -0,0 +1,112 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"hash/crc32"
+	"path/filepath"
+	"sync"
+
+	"go.uber.org/zap"
+
+	"github.com/iamBelugaa/kvix/internal/index"
+	"github.com/iamBelugaa/kvix/internal/storage"
+	"github.com/iamBelugaa/kvix/internal/storage/segmentpool"
+	"github.com/iamBelugaa/kvix/pkg/options"
+)
+
+// partition is an independent append point: its own storage, active segment
+// and write lock. Keys are assigned to partitions by hash.
+type partition struct {
+	mu      sync.Mutex
+	id      uint8
+	storage *storage.Storage
+}
+
+func openPartitions(
+	ctx context.Context, log *zap.SugaredLogger, opts *options.Options, budget *segmentpool.Budget,
+) ([]*partition, error) {
+	if opts.Partitions <= 1 {
+		storage, err := storage.New(ctx, log, opts, budget)
+		if err != nil {
+			return nil, err
+		}
+		return []*partition{{storage: storage}}, nil
+	}
+
+	partitions := make([]*partition, 0, opts.Partitions)
+	for i := range opts.Partitions {
+		partitionOpts := *opts
+		segmentOpts := *opts.SegmentOptions
+		segmentOpts.Directory = filepath.Join(opts.SegmentOptions.Directory, fmt.Sprintf("p%02d", i))
+		partitionOpts.SegmentOptions = &segmentOpts
+
+		storage, err := storage.New(ctx, log.With("partition", i), &partitionOpts, budget)
+		if err != nil {
+			closePartitions(partitions)
+			return nil, err
+		}
+
+		partitions = append(partitions, &partition{id: uint8(i), storage: storage})
+	}
+
+	return partitions, nil
+}
+
+func closePartitions(partitions []*partition) error {
+	var firstErr error
+	for _, p := range partitions {
+		if err := p.storage.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (e *Engine) partitionFor(key []byte) *partition {
+	if len(e.partitions) == 1 {
+		return e.partitions[0]
+	}
+	return e.partitions[crc32.ChecksumIEEE(key)%uint32(len(e.partitions))]
+}
+
+func (e *Engine) storageFor(pointer *index.RecordPointer) *storage.Storage {
+	return e.partitions[pointer.Partition].storage
+}
+
+// locateKey finds the latest record of key in the sealed segment pointer
+// points into through the segment's key table. Without fetch, archived
+// segments report no key table rather than being fetched back for it.
+func (e *Engine) locateKey(key string, pointer *index.RecordPointer, fetch bool) (int64, bool, bool, error) {
+	if !fetch && e.archive.has(pointerSegment(pointer)) {
+		return 0, false, false, nil
+	}
+	return e.storageFor(pointer).FindKey(context.Background(), pointer.SegmentID, pointer.SegmentTimestamp, []byte(key))
+}
+
+// segmentUsage sums segment counts and on-disk bytes across partitions.
+func (e *Engine) segmentUsage() (int, int64, error) {
+	var segments int
+	var diskBytes int64
+
+	for _, p := range e.partitions {
+		count, bytes, err := p.storage.SegmentUsage()
+		if err != nil {
+			return 0, 0, err
+		}
+
+		segments += count
+		diskBytes += bytes
+	}
+
+	return segments, diskBytes, nil
+}
+
+// segmentPoolStats sums the segment pool counters of every partition.
+func (e *Engine) segmentPoolStats() segmentpool.Stats {
+	var stats segmentpool.Stats
+	for _, p := range e.partitions {
+		stats = stats.Add(p.storage.SegmentPoolStats())
+	}
+	return stats
+}
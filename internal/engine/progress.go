@@ -0,0 +1,71 @@
+package engine
+
+import (
+	"io"
+	"time"
+
+	"github.com/iamBelugaa/kvix/pkg/options"
+)
+
+// progressInterval is the least time between reports of one startup phase.
+const progressInterval = 100 * time.Millisecond
+
+// phaseProgress reports a startup phase to StartupProgress. It is nil unless
+// that option is set, and its methods then do nothing.
+type phaseProgress struct {
+	report   options.StartupProgressFunc
+	phase    string
+	done     int64
+	total    int64
+	reported time.Time
+}
+
+// startPhase reports phase as started, with total units of work to do. Once
+// the engine is open, phases are no longer reported.
+func (e *Engine) startPhase(phase string, total int64) *phaseProgress {
+	if e.startupProgress == nil {
+		return nil
+	}
+
+	p := &phaseProgress{report: e.startupProgress, phase: phase, total: total, reported: time.Now()}
+	p.report(phase, 0, total)
+	return p
+}
+
+func (p *phaseProgress) add(n int64) {
+	if p == nil {
+		return
+	}
+
+	p.done = min(p.done+n, p.total)
+	if now := time.Now(); now.Sub(p.reported) >= progressInterval {
+		p.reported = now
+		p.report(p.phase, p.done, p.total)
+	}
+}
+
+// finish reports the phase as done, including work it skipped.
+func (p *phaseProgress) finish() {
+	if p != nil {
+		p.report(p.phase, p.total, p.total)
+	}
+}
+
+// reader counts the bytes read through r as progress.
+func (p *phaseProgress) reader(r io.Reader) io.Reader {
+	if p == nil {
+		return r
+	}
+	return &progressReader{reader: r, progress: p}
+}
+
+type progressReader struct {
+	reader   io.Reader
+	progress *phaseProgress
+}
+
+func (r *progressReader) Read(buffer []byte) (int, error) {
+	n, err := r.reader.Read(buffer)
+	r.progress.add(int64(n))
+	return n, err
+}
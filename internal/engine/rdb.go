@@ -0,0 +1,70 @@
+package engine
+
+import (
+	"context"
+	stdErrors "errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/iamBelugaa/kvix/internal/rdb"
+	"github.com/iamBelugaa/kvix/pkg/errors"
+)
+
+// ImportRDB loads the string keys of a Redis RDB file through the same
+// batched path as Import. Keys from every Redis database land in the one
+// keyspace; keys already expired at import time and non-string values are
+// counted as skipped.
+func (e *Engine) ImportRDB(
+	ctx context.Context, r io.Reader, policy ImportPolicy, validate func(key, value []byte) error,
+) (ImportResult, error) {
+	var result ImportResult
+	if err := e.writable(); err != nil {
+		return result, err
+	}
+
+	batch := make([]NDJSONRecord, 0, importBatchSize)
+	stats, err := rdb.Parse(ctx, r, func(entry rdb.Entry) error {
+		record := NDJSONRecord{KeyBase64: entry.Key, Value: entry.Value}
+		if entry.ExpiresAt != 0 {
+			record.TTLMillis = entry.ExpiresAt - time.Now().UnixMilli()
+			if record.TTLMillis <= 0 {
+				result.Skipped++
+				return nil
+			}
+		}
+
+		if err := validate(entry.Key, entry.Value); err != nil {
+			return errors.NewValidationError(
+				err, errors.ErrValidationInvalidData, fmt.Sprintf("Invalid RDB key %q: %v", entry.Key, err),
+			).
+				WithDetail("db", entry.DB)
+		}
+
+		batch = append(batch, record)
+		if len(batch) < importBatchSize {
+			return nil
+		}
+
+		err := e.importBatch(ctx, batch, policy, &result)
+		batch = batch[:0]
+		return err
+	})
+	result.Skipped += stats.Skipped
+
+	if stdErrors.Is(err, rdb.ErrInvalidMagic) || stdErrors.Is(err, rdb.ErrUnsupportedVersion) ||
+		stdErrors.Is(err, rdb.ErrUnsupportedType) || stdErrors.Is(err, rdb.ErrCorrupt) {
+		return result, errors.NewValidationError(err, errors.ErrRecordDeserialization, "Failed to parse RDB file")
+	}
+
+	if err != nil {
+		return result, err
+	}
+
+	if err := e.importBatch(ctx, batch, policy, &result); err != nil {
+		return result, err
+	}
+
+	e.log.Infow("RDB import completed", "imported", result.Imported, "skipped", result.Skipped)
+	return result, nil
+}
@@ -0,0 +1,85 @@
+package engine
+
+import (
+	"time"
+
+	"github.com/iamBelugaa/kvix/pkg/errors"
+	"github.com/iamBelugaa/kvix/pkg/options"
+)
+
+// Reconfigure applies the settings of next that can change while the engine
+// runs: the sync policy and interval, the eviction limits and policy, the
+// slow operation threshold, the read verification level and the compaction
+// threshold and rates. The caller
+// validates next and makes sure nothing else in it changed.
+func (e *Engine) Reconfigure(next *options.Options) error {
+	if e.closed.Load() {
+		return ErrEngineClosed
+	}
+
+	bounded := next.MaxKeys != 0 || next.MaxLiveBytes != 0
+	if !e.index.SetBounds(next.MaxKeys, next.MaxLiveBytes, next.EvictionPolicy) && bounded {
+		return errors.NewValidationError(
+			nil, errors.ErrSystemInvalidInput,
+			"Eviction limits can only change on instances opened with them",
+		).
+			WithProvided(next.MaxKeys).
+			WithExpected("0 on an unbounded instance")
+	}
+
+	e.slowOpThreshold.Store(int64(next.SlowOpThreshold))
+	e.compaction.configure(next)
+	for _, p := range e.partitions {
+		p.storage.SetVerifyLevel(next.ReadVerification)
+	}
+	if err := e.setSyncPolicy(next.SyncPolicy, next.SyncInterval); err != nil {
+		return err
+	}
+
+	// Lowered limits take effect at once rather than on the next write.
+	e.shed()
+	return nil
+}
+
+// setSyncPolicy switches every partition and the logs to policy,
+// restarting the periodic sync pass for SyncInterval.
+func (e *Engine) setSyncPolicy(policy options.SyncPolicy, interval time.Duration) error {
+	e.syncMu.Lock()
+	defer e.syncMu.Unlock()
+
+	if e.closed.Load() {
+		return ErrEngineClosed
+	}
+
+	if e.syncJob != nil {
+		e.syncJob()
+		e.syncJob = nil
+	}
+
+	e.policy.Store(uint32(policy))
+	for _, p := range e.partitions {
+		p.storage.SetSyncPolicy(policy)
+	}
+
+	if e.indexLog != nil {
+		e.indexLog.SetSyncEach(policy == options.SyncAlways)
+	}
+
+	if e.feed != nil {
+		e.feed.SetSyncEach(policy == options.SyncAlways)
+	}
+
+	// Followers write nothing of their own to sync.
+	if policy == options.SyncNone || e.options.FollowInterval > 0 {
+		return nil
+	}
+
+	// Writes made under the old policy are synced before the new one
+	// applies.
+	e.syncPass()
+
+	if policy == options.SyncInterval {
+		e.syncJob = e.schedule(interval, e.syncPass)
+	}
+	return nil
+}
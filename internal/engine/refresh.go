@@ -0,0 +1,125 @@
+package engine
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+// Loader produces a fresh value and TTL for key. It is invoked by the
+// refresh-ahead worker for keys that are about to expire.
+type Loader func(ctx context.Context, key []byte) ([]byte, time.Duration, error)
+
+func (e *Engine) RegisterLoader(prefix string, loader Loader) {
+	e.loadersMu.Lock()
+	defer e.loadersMu.Unlock()
+
+	if loader == nil {
+		delete(e.loaders, prefix)
+		return
+	}
+	e.loaders[prefix] = loader
+}
+
+// loaderFor returns the loader registered under the longest prefix of key.
+func (e *Engine) loaderFor(key string) Loader {
+	e.loadersMu.RLock()
+	defer e.loadersMu.RUnlock()
+
+	var match string
+	var loader Loader
+	for prefix, candidate := range e.loaders {
+		if strings.HasPrefix(key, prefix) && (loader == nil || len(prefix) > len(match)) {
+			match = prefix
+			loader = candidate
+		}
+	}
+
+	return loader
+}
+
+// RefreshAhead re-loads the keys that expire within the refresh-ahead window
+// and have a loader, returning how many it rewrote. A key whose loader or
+// write fails is logged and left to expire; the others are still refreshed.
+func (e *Engine) RefreshAhead(ctx context.Context) (int, error) {
+	if e.closed.Load() {
+		return 0, ErrEngineClosed
+	}
+
+	var refreshed, failed int
+	for _, key := range e.index.ExpiringWithin(e.options.RefreshAhead) {
+		if err := ctx.Err(); err != nil {
+			return refreshed, err
+		}
+
+		loader := e.loaderFor(key)
+		if loader == nil {
+			continue
+		}
+
+		written, err := e.refresh(ctx, key, loader)
+		if err != nil {
+			e.log.Warnw("Refresh-ahead failed", "key", key, "error", err)
+			failed++
+			continue
+		}
+		if written {
+			refreshed++
+		}
+	}
+
+	if failed > 0 {
+		e.log.Warnw("Refresh-ahead pass left keys to expire", "refreshed", refreshed, "failed", failed)
+	}
+	return refreshed, nil
+}
+
+// refresh re-loads key with loader and writes the value it returns, keeping
+// the metadata of the record it replaces. It reports whether it wrote one.
+func (e *Engine) refresh(ctx context.Context, key string, loader Loader) (bool, error) {
+	pointer, ok := e.index.Get(key)
+	if !ok {
+		return false, nil
+	}
+
+	record, err := e.storageFor(pointer).Get(ctx, []byte(key), pointer.SegmentID, pointer.SegmentTimestamp, pointer.Offset)
+	if err != nil {
+		e.counters.recordError(err)
+		return false, err
+	}
+
+	loaderCtx, cancel := ctx, context.CancelFunc(func() {})
+	if e.options.RefreshLoaderTimeout > 0 {
+		loaderCtx, cancel = context.WithTimeout(ctx, e.options.RefreshLoaderTimeout)
+	}
+	value, ttl, err := loader(loaderCtx, []byte(key))
+	cancel()
+	if err != nil {
+		return false, err
+	}
+
+	if len(value) == 0 || ttl <= 0 {
+		return false, nil
+	}
+
+	// The loader ran without the partition lock, so the key may have been
+	// deleted or written since; the refreshed value must not bring it back
+	// or overwrite the newer one.
+	written, err := e.writeIf(ctx, []byte(key), value, record.Metadata, time.Now().Add(ttl).UnixNano(), pointer)
+	return written != nil, err
+}
+
+func (e *Engine) refreshPass() {
+	ctx, cancel := e.stopContext()
+	defer cancel()
+
+	refreshed, err := e.RefreshAhead(ctx)
+	if err != nil {
+		e.log.Errorw("Refresh-ahead pass failed", "refreshed", refreshed, "error", err)
+		return
+	}
+
+	if refreshed > 0 {
+		e.log.Debugw("Keys refreshed ahead of expiration", "refreshed", refreshed)
+	}
+}
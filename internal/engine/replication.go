@@ -0,0 +1,530 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	stdErrors "errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/iamBelugaa/kvix/internal/index"
+	"github.com/iamBelugaa/kvix/internal/replication"
+	"github.com/iamBelugaa/kvix/pkg/errors"
+	"github.com/iamBelugaa/kvix/pkg/filesys"
+)
+
+// ReplicaBacklog is how many index changes a replica may fall behind before
+// the primary drops it. The replica then reconnects and syncs again.
+const ReplicaBacklog = 1 << 16
+
+var (
+	ErrReadOnlyReplica = stdErrors.New("operation failed: replicas are read-only")
+	ErrReplicaBehind   = stdErrors.New("replica fell too far behind the primary")
+)
+
+// replicaChange is an index change waiting to be sent to a replica: key now
+// points at pointer, or is gone when deleted is set.
+type replicaChange struct {
+	key     []byte
+	pointer index.RecordPointer
+	deleted bool
+}
+
+// replicaFeed queues the index changes of one replica connection.
+type replicaFeed struct {
+	mu       sync.Mutex
+	changes  []replicaChange
+	overflow bool
+	wake     chan struct{}
+}
+
+func (f *replicaFeed) push(change replicaChange) {
+	f.mu.Lock()
+	if !f.overflow {
+		if len(f.changes) < ReplicaBacklog {
+			f.changes = append(f.changes, change)
+		} else {
+			f.overflow = true
+			f.changes = nil
+		}
+	}
+	f.mu.Unlock()
+
+	select {
+	case f.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (f *replicaFeed) take() ([]replicaChange, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	changes := f.changes
+	f.changes = nil
+	return changes, f.overflow
+}
+
+// replicate queues a change to key for every connected replica, and for the
+// next manifest when publishing one; a nil pointer deletes it. Callers hold
+// the partition lock of key, which keeps the changes of each key in the order
+// they were made.
+func (e *Engine) replicate(key []byte, pointer *index.RecordPointer) {
+	if e.options.ManifestInterval > 0 {
+		e.manifest.markDirty(key)
+	}
+	if e.replicating.Load() == 0 {
+		return
+	}
+
+	change := replicaChange{key: bytes.Clone(key), deleted: pointer == nil}
+	if pointer != nil {
+		change.pointer = *pointer
+	}
+
+	e.replicaMu.Lock()
+	defer e.replicaMu.Unlock()
+
+	for feed := range e.replicaFeeds {
+		feed.push(change)
+	}
+}
+
+// replicateExpiry sends key's current pointer to replicas after its TTL
+// changed. Callers must hold the key's partition lock.
+func (e *Engine) replicateExpiry(key []byte) {
+	if e.options.ManifestInterval > 0 {
+		e.manifest.markDirty(key)
+	}
+	if e.replicating.Load() == 0 {
+		return
+	}
+
+	pointer, _, _ := e.index.GetStale(string(key))
+	e.replicate(key, pointer)
+}
+
+func (e *Engine) addReplicaFeed() (*replicaFeed, error) {
+	e.replicaMu.Lock()
+	defer e.replicaMu.Unlock()
+
+	if e.closed.Load() {
+		return nil, ErrEngineClosed
+	}
+
+	feed := &replicaFeed{wake: make(chan struct{}, 1)}
+	e.replicaFeeds[feed] = struct{}{}
+	e.replicating.Add(1)
+	e.replicaSessions.Add(1)
+	return feed, nil
+}
+
+func (e *Engine) removeReplicaFeed(feed *replicaFeed) {
+	e.replicaMu.Lock()
+	defer e.replicaMu.Unlock()
+
+	delete(e.replicaFeeds, feed)
+	e.replicating.Add(-1)
+	e.replicaSessions.Done()
+}
+
+// waitReplicaSessions waits for the replica connections to notice the engine
+// closed. No new ones start once closed is set.
+func (e *Engine) waitReplicaSessions() {
+	e.replicaMu.Lock()
+	e.replicaMu.Unlock()
+	e.replicaSessions.Wait()
+}
+
+// ServeReplication accepts replica connections on listener and streams this
+// engine's segments and index changes to each, until ctx is done or the
+// engine closes. A replica that cannot keep up is disconnected and syncs
+// again when it reconnects.
+func (e *Engine) ServeReplication(ctx context.Context, listener net.Listener) error {
+	if e.closed.Load() {
+		return ErrEngineClosed
+	}
+
+	if e.isReplica() {
+		return errors.NewValidationError(nil, errors.ErrSystemInvalidInput, "A replica cannot serve replicas of its own")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go func() {
+		select {
+		case <-e.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+		listener.Close()
+	}()
+
+	e.log.Infow("Replication listening", "addr", listener.Addr().String())
+
+	var sessions sync.WaitGroup
+	defer sessions.Wait()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if e.closed.Load() {
+				return nil
+			}
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+
+		sessions.Add(1)
+		go func() {
+			defer sessions.Done()
+
+			replica := conn.RemoteAddr().String()
+			err := e.serveReplica(ctx, conn)
+			if err != nil && !e.closed.Load() && ctx.Err() == nil {
+				e.log.Warnw("Replica disconnected", "replica", replica, "error", err)
+				return
+			}
+			e.log.Infow("Replica disconnected", "replica", replica)
+		}()
+	}
+}
+
+// segmentCursor is how far a replica has been sent the active segment of one
+// partition.
+type segmentCursor struct {
+	path   string
+	offset int64
+}
+
+type replicaSession struct {
+	engine  *Engine
+	conn    net.Conn
+	rc      *replication.Conn
+	cursors []segmentCursor
+	sent    bool
+}
+
+func (e *Engine) serveReplica(ctx context.Context, conn net.Conn) error {
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	session := &replicaSession{
+		engine:  e,
+		conn:    conn,
+		rc:      replication.NewConn(conn),
+		cursors: make([]segmentCursor, len(e.partitions)),
+	}
+
+	conn.SetReadDeadline(time.Now().Add(replication.Timeout))
+	message, err := session.rc.Read()
+	if err != nil {
+		return err
+	}
+
+	if message.Type != replication.MessageHello {
+		return fmt.Errorf("%w: expected a hello, got message type %d", replication.ErrProtocol, message.Type)
+	}
+
+	// Replicas only listen from here on. A dead one shows up as a failed write.
+	conn.SetReadDeadline(time.Time{})
+
+	hello := message.Hello
+	if int(hello.Partitions) != len(e.partitions) || hello.Prefix != e.options.SegmentOptions.Prefix {
+		reason := fmt.Sprintf(
+			"replica has %d partitions and segment prefix %q but the primary has %d and %q",
+			hello.Partitions, hello.Prefix, len(e.partitions), e.options.SegmentOptions.Prefix,
+		)
+		session.send(func() error { return session.rc.WriteError(reason) })
+		session.flush()
+		return errors.NewValidationError(nil, errors.ErrValidationInvalidData, reason).
+			WithProvided(hello.Partitions).
+			WithExpected(len(e.partitions))
+	}
+
+	feed, err := e.addReplicaFeed()
+	if err != nil {
+		return err
+	}
+	defer e.removeReplicaFeed(feed)
+
+	if err := session.sync(ctx, hello); err != nil {
+		return err
+	}
+	e.log.Infow("Replica synced", "replica", conn.RemoteAddr().String())
+
+	ticker := time.NewTicker(replication.HeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := session.ship(feed); err != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-e.stop:
+			return ErrEngineClosed
+		case <-feed.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// sync brings a replica up to a snapshot of the engine: the segment bytes it
+// lacks, every key of the snapshot and the list of segments to keep. Changes
+// made after the feed was registered follow through ship.
+func (s *replicaSession) sync(ctx context.Context, hello *replication.Hello) error {
+	held := make(map[string]replication.SegmentFile, len(hello.Segments))
+	for _, segment := range hello.Segments {
+		held[fmt.Sprintf("%d/%s", segment.Partition, segment.Name)] = segment
+	}
+
+	snapshot, err := s.engine.Snapshot(ctx)
+	if err != nil {
+		return err
+	}
+	defer snapshot.Release()
+
+	lists := make(map[uint8][]string, len(snapshot.Segments()))
+	for _, set := range snapshot.Segments() {
+		paths := append(slices.Clone(set.Sealed), set.Active)
+		for _, path := range paths {
+			name := filepath.Base(path)
+			lists[set.Partition] = append(lists[set.Partition], name)
+
+			limit := int64(-1)
+			if path == set.Active {
+				limit = set.HighWaterMark
+			}
+
+			replicaCopy, ok := held[fmt.Sprintf("%d/%s", set.Partition, name)]
+			if err := s.shipFile(set.Partition, path, replicaCopy, ok, limit); err != nil {
+				return err
+			}
+		}
+
+		s.cursors[set.Partition] = segmentCursor{path: set.Active, offset: set.HighWaterMark}
+	}
+
+	for key, pointer := range snapshot.pointers {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if err := s.send(func() error { return s.rc.WritePut([]byte(key), &pointer) }); err != nil {
+			return err
+		}
+	}
+
+	for partition, names := range lists {
+		if err := s.send(func() error { return s.rc.WriteSegmentList(partition, names) }); err != nil {
+			return err
+		}
+	}
+
+	if err := s.send(s.rc.WriteSynced); err != nil {
+		return err
+	}
+	return s.flush()
+}
+
+// shipFile sends a segment up to limit bytes, or all of it for -1. Only the
+// bytes past the replica's copy are sent when that copy's tail matches.
+func (s *replicaSession) shipFile(
+	partition uint8, path string, replicaCopy replication.SegmentFile, held bool, limit int64,
+) error {
+	file, err := s.engine.options.FileSystem.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		return errors.NewStorageError(err, errors.ErrIOGeneral, "Failed to open segment for replication").WithPath(path)
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return errors.NewStorageError(err, errors.ErrIOGeneral, "Failed to stat segment for replication").WithPath(path)
+	}
+
+	end := stat.Size()
+	if limit >= 0 && limit < end {
+		end = limit
+	}
+
+	var from int64
+	if held && replicaCopy.Size <= end {
+		matches, err := tailMatches(file, replicaCopy)
+		if err != nil {
+			return errors.NewStorageError(err, errors.ErrIOGeneral, "Failed to read segment for replication").
+				WithPath(path)
+		}
+		if matches {
+			from = replicaCopy.Size
+		}
+	}
+
+	return s.shipRange(partition, file, from, end)
+}
+
+// shipRange sends bytes from to end of file. At least one chunk is sent, so
+// that the replica's copy is cut off at end even when nothing is new.
+func (s *replicaSession) shipRange(partition uint8, file filesys.File, from, end int64) error {
+	name := filepath.Base(file.Name())
+	if from >= end {
+		return s.send(func() error { return s.rc.WriteSegment(partition, name, end, nil) })
+	}
+
+	buffer := make([]byte, replication.ChunkSize)
+	for offset := from; offset < end; {
+		chunk := buffer[:min(int64(len(buffer)), end-offset)]
+		if _, err := file.ReadAt(chunk, offset); err != nil {
+			return errors.NewStorageError(err, errors.ErrIOGeneral, "Failed to read segment for replication").
+				WithPath(file.Name()).
+				WithDetail("offset", offset)
+		}
+
+		if err := s.send(func() error { return s.rc.WriteSegment(partition, name, offset, chunk) }); err != nil {
+			return err
+		}
+		offset += int64(len(chunk))
+	}
+
+	return nil
+}
+
+// ship sends what changed since the last call: the segment bytes appended to
+// every partition, then the queued index changes, which only reference bytes
+// already sent. An idle connection gets a heartbeat instead.
+func (s *replicaSession) ship(feed *replicaFeed) error {
+	changes, overflow := feed.take()
+	if overflow {
+		reason := fmt.Sprintf("replica fell more than %d changes behind", ReplicaBacklog)
+		s.send(func() error { return s.rc.WriteError(reason) })
+		s.flush()
+		return ErrReplicaBehind
+	}
+
+	for i := range s.engine.partitions {
+		if err := s.shipTail(i); err != nil {
+			return err
+		}
+	}
+
+	for _, change := range changes {
+		err := s.send(func() error {
+			if change.deleted {
+				return s.rc.WriteDelete(change.key)
+			}
+			return s.rc.WritePut(change.key, &change.pointer)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if !s.sent {
+		if err := s.send(s.rc.WriteHeartbeat); err != nil {
+			return err
+		}
+	}
+	return s.flush()
+}
+
+// shipTail sends the bytes appended to one partition's active segment. When
+// the partition moved to a new segment, the rest of the old one and any
+// segment sealed in between are sent first.
+func (s *replicaSession) shipTail(i int) error {
+	p := s.engine.partitions[i]
+	cursor := &s.cursors[i]
+
+	p.mu.Lock()
+	err := p.storage.Flush()
+	active := p.storage.ActiveSegmentPath()
+	end := p.storage.Offset()
+	p.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if active != cursor.path {
+		paths, err := p.storage.SegmentPaths()
+		if err != nil {
+			return err
+		}
+
+		for _, path := range paths {
+			switch {
+			case path == cursor.path:
+				err = s.shipFile(p.id, path, replication.SegmentFile{Size: cursor.offset}, true, -1)
+			case path > cursor.path && path != active:
+				err = s.shipFile(p.id, path, replication.SegmentFile{}, false, -1)
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		*cursor = segmentCursor{path: active}
+	}
+
+	if end == cursor.offset {
+		return nil
+	}
+
+	file, err := s.engine.options.FileSystem.OpenFile(active, os.O_RDONLY, 0)
+	if err != nil {
+		return errors.NewStorageError(err, errors.ErrIOGeneral, "Failed to open segment for replication").WithPath(active)
+	}
+	defer file.Close()
+
+	if err := s.shipRange(p.id, file, min(cursor.offset, end), end); err != nil {
+		return err
+	}
+
+	cursor.offset = end
+	return nil
+}
+
+func (s *replicaSession) send(write func() error) error {
+	s.conn.SetWriteDeadline(time.Now().Add(replication.Timeout))
+	s.sent = true
+	return write()
+}
+
+func (s *replicaSession) flush() error {
+	s.conn.SetWriteDeadline(time.Now().Add(replication.Timeout))
+	s.sent = false
+	return s.rc.Flush()
+}
+
+// tailMatches reports whether file holds the bytes the tail checksum of a
+// replica's copy was taken over.
+func tailMatches(file filesys.File, replicaCopy replication.SegmentFile) (bool, error) {
+	checksum, err := tailChecksum(file, replicaCopy.Size)
+	if err != nil {
+		return false, err
+	}
+	return checksum == replicaCopy.TailChecksum, nil
+}
+
+// tailChecksum is the CRC32 (IEEE) of the TailCheckSize bytes of file ending
+// at size.
+func tailChecksum(file io.ReaderAt, size int64) (uint32, error) {
+	length := min(size, replication.TailCheckSize)
+	tail := make([]byte, length)
+	if _, err := file.ReadAt(tail, size-length); err != nil {
+		return 0, err
+	}
+	return crc32.ChecksumIEEE(tail), nil
+}
@@ -0,0 +1,130 @@
+package engine
+
+import (
+	"context"
+
+	"github.com/iamBelugaa/kvix/internal/secondary"
+	"github.com/iamBelugaa/kvix/internal/storage"
+	"github.com/iamBelugaa/kvix/pkg/errors"
+	"github.com/iamBelugaa/kvix/pkg/options"
+)
+
+// Query returns the live keys whose JSON value holds value at path, sorted.
+// Strings match by their contents; numbers, booleans and null by their JSON
+// text. A path that resolves to an array matches each of its elements.
+func (e *Engine) Query(ctx context.Context, path, value string) ([][]byte, error) {
+	if e.closed.Load() {
+		return nil, ErrEngineClosed
+	}
+
+	if e.secondary == nil {
+		return nil, errors.NewValidationError(
+			nil, errors.ErrSystemInvalidInput, "No secondary indexes; open the instance WithSecondaryIndex",
+		).WithProvided(path)
+	}
+
+	candidates, ok := e.secondary.Query(path, value)
+	if !ok {
+		return nil, errors.NewValidationError(nil, errors.ErrSystemInvalidInput, "Path is not indexed").
+			WithProvided(path).
+			WithExpected(e.secondary.Paths())
+	}
+	return e.liveKeys(ctx, candidates)
+}
+
+// FindByTag returns the live keys whose metadata carries a tag named tag,
+// sorted.
+func (e *Engine) FindByTag(ctx context.Context, tag string) ([][]byte, error) {
+	if e.closed.Load() {
+		return nil, ErrEngineClosed
+	}
+
+	if e.tags == nil {
+		return nil, errors.NewValidationError(
+			nil, errors.ErrSystemInvalidInput, "Tags are not indexed; open the instance WithTagIndex",
+		).WithProvided(tag)
+	}
+	return e.liveKeys(ctx, e.tags.Find(tag))
+}
+
+func (e *Engine) liveKeys(ctx context.Context, candidates []string) ([][]byte, error) {
+	keys := make([][]byte, 0, len(candidates))
+	for _, key := range candidates {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		// Expired keys stay indexed until the index notices they expired.
+		if _, ok := e.index.Get(key); ok {
+			keys = append(keys, []byte(key))
+		}
+	}
+	return keys, nil
+}
+
+func (e *Engine) reindex(key, value []byte, metadata *storage.Metadata) {
+	if e.secondary != nil {
+		e.secondary.Update(string(key), value)
+	}
+
+	if e.tags != nil {
+		var tags map[string]string
+		if metadata != nil {
+			tags = metadata.Tags
+		}
+		e.tags.Update(string(key), tags)
+	}
+}
+
+func (e *Engine) unindex(key string) {
+	if e.secondary != nil {
+		e.secondary.Remove(key)
+	}
+
+	if e.tags != nil {
+		e.tags.Remove(key)
+	}
+}
+
+// loadSecondary builds the secondary and tag indexes from the live records,
+// which they are not persisted apart from.
+func (e *Engine) loadSecondary(ctx context.Context) error {
+	if len(e.options.SecondaryIndexes) == 0 && !e.options.TagIndex {
+		return nil
+	}
+
+	if len(e.options.SecondaryIndexes) != 0 {
+		idx, err := secondary.New(e.options.SecondaryIndexes)
+		if err != nil {
+			return err
+		}
+		e.secondary = idx
+	}
+
+	if e.options.TagIndex {
+		e.tags = secondary.NewTags()
+	}
+
+	pointers, err := e.index.Snapshot()
+	if err != nil {
+		return err
+	}
+
+	progress := e.startPhase(options.StartupSecondary, int64(len(pointers)))
+	err = e.scanRecords(ctx, pointers, func(key string, record *storage.Record, err error) error {
+		progress.add(1)
+		if err != nil {
+			e.log.Warnw("Skipping unreadable record while building secondary indexes", "key", key, "error", err)
+			return nil
+		}
+
+		e.reindex([]byte(key), record.Value, record.Metadata)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	progress.finish()
+	return nil
+}
@@ -0,0 +1,351 @@
+package engine
+
+import (
+	"context"
+	stdErrors "errors"
+	"io/fs"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/iamBelugaa/kvix/internal/index"
+	"github.com/iamBelugaa/kvix/pkg/errors"
+	"github.com/iamBelugaa/kvix/pkg/filesys"
+	"github.com/iamBelugaa/kvix/pkg/seginfo"
+)
+
+// SegmentStats describes how much of one segment file the index still points
+// at. Records of overwritten, deleted and expired keys make up the rest, and
+// are reclaimable by compaction.
+type SegmentStats struct {
+	Path        string    `json:"path"`
+	Partition   uint8     `json:"partition"`
+	SegmentID   uint16    `json:"segmentId"`
+	CreatedAt   time.Time `json:"createdAt"`
+	Active      bool      `json:"active"`
+	TotalBytes  int64     `json:"totalBytes"`
+	LiveBytes   int64     `json:"liveBytes"`
+	StaleBytes  int64     `json:"staleBytes"`
+	LiveRecords int       `json:"liveRecords"`
+
+	// OverwrittenBytes, DeletedBytes and ExpiredBytes are the tracked
+	// counterpart of StaleBytes: the records keys stopped pointing at since
+	// the segment was written, by why, counted as it happened and kept
+	// across restarts. GarbageRatio is their share of TotalBytes.
+	OverwrittenBytes int64   `json:"overwrittenBytes"`
+	DeletedBytes     int64   `json:"deletedBytes"`
+	ExpiredBytes     int64   `json:"expiredBytes"`
+	GarbageRecords   int64   `json:"garbageRecords"`
+	GarbageRatio     float64 `json:"garbageRatio"`
+}
+
+func pointerSegment(pointer *index.RecordPointer) segmentKey {
+	return segmentKey{partition: pointer.Partition, id: pointer.SegmentID, timestamp: pointer.SegmentTimestamp}
+}
+
+// SegmentStats returns the live and stale bytes of every segment file, by
+// partition and then segment order. Keys that expired past any stale grace
+// period count as stale, and records shared by deduplicated keys are counted
+// once.
+func (e *Engine) SegmentStats(ctx context.Context) ([]SegmentStats, error) {
+	snapshot, err := e.Snapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer snapshot.Release()
+
+	type usage struct {
+		bytes   int64
+		records int
+	}
+
+	live := make(map[segmentKey]*usage)
+	seen := make(map[index.RecordPointer]struct{}, len(snapshot.pointers))
+	for _, pointer := range snapshot.pointers {
+		if pointer.IsExpired() && !pointer.IsStale(e.options.StaleGracePeriod) {
+			continue
+		}
+
+		location := index.RecordPointer{
+			Offset:           pointer.Offset,
+			SegmentTimestamp: pointer.SegmentTimestamp,
+			SegmentID:        pointer.SegmentID,
+			Partition:        pointer.Partition,
+		}
+		if _, ok := seen[location]; ok {
+			continue
+		}
+		seen[location] = struct{}{}
+
+		segment := pointerSegment(&pointer)
+		if live[segment] == nil {
+			live[segment] = &usage{}
+		}
+		live[segment].bytes += int64(pointer.Size)
+		live[segment].records++
+	}
+
+	var stats []SegmentStats
+	for _, set := range snapshot.Segments() {
+		paths := slices.Concat(set.Sealed, []string{set.Active})
+		for i, path := range paths {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+
+			active := i == len(paths)-1
+			size := set.HighWaterMark
+			if !active {
+				stat, err := e.options.FileSystem.Stat(path)
+				if err != nil {
+					return nil, errors.NewStorageError(err, errors.ErrIOGeneral, "Failed to stat segment file").
+						WithPath(path)
+				}
+				size = stat.Size()
+			}
+
+			segment, err := e.segmentKeyOf(set.Partition, path)
+			if err != nil {
+				return nil, err
+			}
+
+			entry := SegmentStats{
+				Path:       path,
+				Partition:  set.Partition,
+				SegmentID:  segment.id,
+				CreatedAt:  time.Unix(0, segment.timestamp),
+				Active:     active,
+				TotalBytes: size,
+			}
+			if used := live[segment]; used != nil {
+				entry.LiveBytes = used.bytes
+				entry.LiveRecords = used.records
+			}
+			entry.StaleBytes = max(entry.TotalBytes-entry.LiveBytes, 0)
+
+			garbage := e.garbage.get(segment)
+			entry.OverwrittenBytes = garbage.overwritten
+			entry.DeletedBytes = garbage.deleted
+			entry.ExpiredBytes = garbage.expired
+			entry.GarbageRecords = garbage.records
+			if entry.TotalBytes > 0 {
+				entry.GarbageRatio = min(float64(garbage.bytes())/float64(entry.TotalBytes), 1)
+			}
+			stats = append(stats, entry)
+		}
+	}
+
+	return stats, nil
+}
+
+func (e *Engine) segmentKeyOf(partition uint8, path string) (segmentKey, error) {
+	prefix := e.options.SegmentOptions.Prefix
+
+	id, err := seginfo.ParseSegmentID(path, prefix)
+	if err != nil {
+		return segmentKey{}, errors.NewStorageError(err, errors.ErrIOGeneral, "Failed to parse segment file name").
+			WithPath(path)
+	}
+
+	timestamp, err := seginfo.ParseSegmentTimestamp(path, prefix)
+	if err != nil {
+		return segmentKey{}, errors.NewStorageError(err, errors.ErrIOGeneral, "Failed to parse segment file name").
+			WithPath(path)
+	}
+
+	return segmentKey{partition: partition, id: id, timestamp: timestamp}, nil
+}
+
+// DiskUsage summarizes the disk space an instance takes.
+type DiskUsage struct {
+	// TotalBytes counts every file under the data and segment directories.
+	TotalBytes   int64 `json:"totalBytes"`
+	SegmentBytes int64 `json:"segmentBytes"`
+	// OtherBytes is the hint, change feed, raft log and other files.
+	OtherBytes int64 `json:"otherBytes"`
+	LiveBytes  int64 `json:"liveBytes"`
+	// ReclaimableBytes is what compacting every segment would free.
+	ReclaimableBytes int64 `json:"reclaimableBytes"`
+	// FreeBytes is left on the file system holding the segments, or -1 where
+	// the platform does not report it.
+	FreeBytes int64          `json:"freeBytes"`
+	Segments  []SegmentStats `json:"segments"`
+}
+
+// DiskUsage reports the bytes the instance has on disk, how many of them are
+// live or reclaimable, and the free space left, with the SegmentStats they are
+// totalled from.
+func (e *Engine) DiskUsage(ctx context.Context) (*DiskUsage, error) {
+	segments, err := e.SegmentStats(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	usage := &DiskUsage{Segments: segments}
+	for _, segment := range segments {
+		usage.SegmentBytes += segment.TotalBytes
+		usage.LiveBytes += segment.LiveBytes
+		usage.ReclaimableBytes += segment.StaleBytes
+	}
+
+	dirs := []string{e.options.DataDir}
+	segmentDir := e.options.SegmentOptions.Directory
+	if relative, err := filepath.Rel(e.options.DataDir, segmentDir); err != nil || strings.HasPrefix(relative, "..") {
+		dirs = append(dirs, segmentDir)
+	}
+
+	for _, dir := range dirs {
+		size, err := dirSize(dir)
+		if err != nil {
+			return nil, errors.NewStorageError(err, errors.ErrIOGeneral, "Failed to measure directory").
+				WithPath(dir)
+		}
+		usage.TotalBytes += size
+	}
+	// The active segment is measured at its high-water mark, which may trail
+	// the file while a write is in flight.
+	usage.TotalBytes = max(usage.TotalBytes, usage.SegmentBytes)
+	usage.OtherBytes = usage.TotalBytes - usage.SegmentBytes
+
+	usage.FreeBytes, err = filesys.FreeSpace(segmentDir)
+	if err != nil {
+		if !stdErrors.Is(err, filesys.ErrFreeSpaceUnsupported) {
+			return nil, errors.NewStorageError(err, errors.ErrIOGeneral, "Failed to read free disk space").
+				WithPath(segmentDir)
+		}
+		usage.FreeBytes = -1
+	}
+
+	return usage, nil
+}
+
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			// Files such as rotated change feed segments may go away while
+			// the walk runs.
+			if stdErrors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			if stdErrors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		size += info.Size()
+		return nil
+	})
+	return size, err
+}
+
+// segmentGCPass deletes sealed segments that no key points into any more,
+// without rewriting anything.
+func (e *Engine) segmentGCPass() {
+	removed, err := e.collectSegments()
+	if err != nil {
+		e.log.Errorw("Segment garbage collection failed", "error", err)
+		return
+	}
+
+	if removed > 0 {
+		e.log.Infow("Removed fully stale segments", "count", removed)
+	}
+}
+
+// collectSegments removes the sealed segments found unreferenced by the
+// previous pass as well as this one. Reads look a pointer up before opening
+// its segment without holding a lock, so a segment is only removed once it
+// has gone a whole interval without a reference.
+//
+// The index is copied without blocking writes. Writes only point keys into
+// active segments, or at payloads the dedup table tracks, so a segment
+// unreferenced in the copy stays so unless the table tracks a payload in it,
+// which is checked again under the partition lock when removing it.
+func (e *Engine) collectSegments() (int, error) {
+	e.segmentsMu.Lock()
+	defer e.segmentsMu.Unlock()
+
+	pointers, err := e.index.Snapshot()
+	if err != nil {
+		return 0, err
+	}
+
+	referenced := make(map[segmentKey]struct{})
+	for _, pointer := range pointers {
+		referenced[pointerSegment(&pointer)] = struct{}{}
+	}
+	e.history.segments(referenced)
+
+	var removed int
+	candidates := make(map[segmentKey]struct{})
+	for _, p := range e.partitions {
+		p.mu.Lock()
+		paths, err := p.storage.SealedSegmentPaths()
+		p.mu.Unlock()
+		if err != nil {
+			return removed, err
+		}
+
+		for _, path := range paths {
+			segment, err := e.segmentKeyOf(p.id, path)
+			if err != nil {
+				return removed, err
+			}
+
+			// Snapshots, and the backups and replica syncs built on them,
+			// may read any segment that existed when they were taken.
+			if _, ok := referenced[segment]; ok || e.pins.pinned(segment) {
+				continue
+			}
+
+			if _, ok := e.gcCandidates[segment]; !ok {
+				candidates[segment] = struct{}{}
+				continue
+			}
+
+			ok, err := e.removeUnreferenced(p, path, segment)
+			if err != nil {
+				return removed, err
+			}
+			if ok {
+				removed++
+			}
+		}
+	}
+
+	e.gcCandidates = candidates
+	return removed, nil
+}
+
+// removeUnreferenced removes a segment collectSegments found unreferenced,
+// unless a write or snapshot has come to use it since.
+func (e *Engine) removeUnreferenced(p *partition, path string, segment segmentKey) (bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// Snapshots pin segments under every partition lock.
+	if e.pins.pinned(segment) {
+		return false, nil
+	}
+	if e.dedup != nil && e.dedup.HasSegment(segment.partition, segment.id, segment.timestamp) {
+		return false, nil
+	}
+
+	if err := p.storage.RemoveSegment(path, segment.id, segment.timestamp); err != nil {
+		return false, err
+	}
+
+	e.garbage.drop(segment)
+	return true, nil
+}
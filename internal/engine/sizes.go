@@ -0,0 +1,126 @@
+package engine
+
+import (
+	"math/bits"
+	"sync/atomic"
+)
+
+// SizeHistogram is the distribution of the key or value sizes an instance has
+// written or read since it was opened. Percentiles are the upper bound of the
+// power-of-two bucket they fall in, capped at Max.
+type SizeHistogram struct {
+	Count      uint64       `json:"count"`
+	TotalBytes uint64       `json:"totalBytes"`
+	Max        uint64       `json:"max"`
+	P50        uint64       `json:"p50"`
+	P90        uint64       `json:"p90"`
+	P99        uint64       `json:"p99"`
+	Buckets    []SizeBucket `json:"buckets"`
+}
+
+// SizeBucket counts the sizes of at most UpTo bytes that are larger than the
+// previous bucket's UpTo. Empty buckets are left out.
+type SizeBucket struct {
+	UpTo  uint64 `json:"upTo"`
+	Count uint64 `json:"count"`
+}
+
+// Mean returns the average size, or 0 when nothing was recorded.
+func (h SizeHistogram) Mean() float64 {
+	if h.Count == 0 {
+		return 0
+	}
+	return float64(h.TotalBytes) / float64(h.Count)
+}
+
+// sizeHistogram records sizes into buckets by bit length, so bucket n holds
+// the sizes from 2^(n-1) to 2^n-1 and bucket 0 holds empty keys and values.
+type sizeHistogram struct {
+	buckets [65]atomic.Uint64
+	count   atomic.Uint64
+	total   atomic.Uint64
+	max     atomic.Uint64
+}
+
+func (h *sizeHistogram) record(size int) {
+	n := uint64(size)
+	h.buckets[bits.Len64(n)].Add(1)
+	h.count.Add(1)
+	h.total.Add(n)
+
+	for {
+		current := h.max.Load()
+		if n <= current || h.max.CompareAndSwap(current, n) {
+			return
+		}
+	}
+}
+
+func (h *sizeHistogram) snapshot() SizeHistogram {
+	snapshot := SizeHistogram{
+		TotalBytes: h.total.Load(),
+		Max:        h.max.Load(),
+		Buckets:    []SizeBucket{},
+	}
+
+	for i := range h.buckets {
+		count := h.buckets[i].Load()
+		if count == 0 {
+			continue
+		}
+
+		upTo := uint64(1)<<i - 1
+		if i == len(h.buckets)-1 {
+			upTo = ^uint64(0)
+		}
+		snapshot.Buckets = append(snapshot.Buckets, SizeBucket{UpTo: upTo, Count: count})
+		// Summed from the buckets, so that the percentiles agree with them
+		// while records land concurrently.
+		snapshot.Count += count
+	}
+
+	snapshot.P50 = snapshot.percentile(0.50)
+	snapshot.P90 = snapshot.percentile(0.90)
+	snapshot.P99 = snapshot.percentile(0.99)
+	return snapshot
+}
+
+func (h SizeHistogram) percentile(p float64) uint64 {
+	if h.Count == 0 {
+		return 0
+	}
+
+	rank := uint64(p * float64(h.Count))
+	var seen uint64
+	for _, bucket := range h.Buckets {
+		seen += bucket.Count
+		if seen > rank {
+			return min(bucket.UpTo, h.Max)
+		}
+	}
+	return h.Max
+}
+
+// sizeCounters holds the key and value size distributions of writes and
+// reads.
+type sizeCounters struct {
+	keysWritten   sizeHistogram
+	valuesWritten sizeHistogram
+	keysRead      sizeHistogram
+	valuesRead    sizeHistogram
+}
+
+func (s *sizeCounters) recordWrite(key, value []byte) {
+	s.recordWriteSize(key, int64(len(value)))
+}
+
+// recordWriteSize records a write whose value was streamed rather than held.
+func (s *sizeCounters) recordWriteSize(key []byte, size int64) {
+	s.keysWritten.record(len(key))
+	s.valuesWritten.record(int(size))
+}
+
+func (s *sizeCounters) recordRead(key, value []byte) {
+	s.keysRead.record(len(key))
+	s.valuesRead.record(len(value))
+}
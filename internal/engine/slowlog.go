@@ -0,0 +1,101 @@
+package engine
+
+import (
+	"context"
+	"time"
+
+	"github.com/iamBelugaa/kvix/internal/storage"
+)
+
+// opTimer times a Get, a Set or a compaction pass for the slow operation log.
+// It is nil unless SlowOpThreshold is set, and its methods then do nothing.
+type opTimer struct {
+	start time.Time
+	last  time.Time
+	// index is spent looking the key up, wait on backpressure, pacing and
+	// the partition lock, and storage below the engine.
+	index   time.Duration
+	wait    time.Duration
+	storage storage.Timings
+}
+
+// startOp returns ctx set up to collect storage timings into the returned
+// timer.
+func (e *Engine) startOp(ctx context.Context) (context.Context, *opTimer) {
+	if e.slowOpThreshold.Load() <= 0 {
+		return ctx, nil
+	}
+
+	now := time.Now()
+	timer := &opTimer{start: now, last: now}
+	return storage.WithTimings(ctx, &timer.storage), timer
+}
+
+func (t *opTimer) lap() time.Duration {
+	now := time.Now()
+	elapsed := now.Sub(t.last)
+	t.last = now
+	return elapsed
+}
+
+// mark starts a phase, leaving the time since the last one uncounted.
+func (t *opTimer) mark() {
+	if t != nil {
+		t.lap()
+	}
+}
+
+func (t *opTimer) lookedUp() {
+	if t != nil {
+		t.index += t.lap()
+	}
+}
+
+func (t *opTimer) waited() {
+	if t != nil {
+		t.wait += t.lap()
+	}
+}
+
+// logSlow logs op at Warn if it took longer than SlowOpThreshold, with the
+// phases it spent time in.
+func (e *Engine) logSlow(op string, key []byte, timer *opTimer) {
+	e.logSlowOp(timer, "op", op, "key", string(key))
+}
+
+// logSlowOp is logSlow for operations on something other than a key,
+// described by fields.
+func (e *Engine) logSlowOp(timer *opTimer, fields ...any) {
+	if timer == nil {
+		return
+	}
+
+	// The threshold may have changed since the operation started.
+	threshold := time.Duration(e.slowOpThreshold.Load())
+	elapsed := time.Since(timer.start)
+	if threshold <= 0 || elapsed < threshold {
+		return
+	}
+
+	fields = append(fields, "duration", elapsed)
+	for _, phase := range []struct {
+		name     string
+		duration time.Duration
+	}{
+		{"indexLookup", timer.index},
+		{"wait", timer.wait},
+		{"segmentOpen", timer.storage.Open},
+		{"diskRead", timer.storage.Read},
+		{"decode", timer.storage.Decode},
+		{"checksum", timer.storage.Checksum},
+		{"encode", timer.storage.Encode},
+		{"diskWrite", timer.storage.Write},
+		{"sync", timer.storage.Sync},
+	} {
+		if phase.duration > 0 {
+			fields = append(fields, phase.name, phase.duration)
+		}
+	}
+
+	e.log.Warnw("Slow operation", fields...)
+}
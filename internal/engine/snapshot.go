@@ -0,0 +1,263 @@
+package engine
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/iamBelugaa/kvix/internal/index"
+	"github.com/iamBelugaa/kvix/internal/storage"
+	"github.com/iamBelugaa/kvix/pkg/errors"
+)
+
+// SegmentSet describes the segments of one partition as of a snapshot: the
+// sealed files plus the active file up to its high-water mark.
+type SegmentSet struct {
+	Partition     uint8
+	Sealed        []string
+	Active        string
+	HighWaterMark int64
+}
+
+// Snapshot is a frozen, read-only view of the keyspace. Segments are
+// append-only, so records it points at stay readable while writes continue,
+// and the segments it was taken over are pinned until it is released, so
+// compaction cannot remove them from under it.
+type Snapshot struct {
+	engine   *Engine
+	takenAt  time.Time
+	pointers map[string]index.RecordPointer
+	segments []SegmentSet
+	pinned   []segmentKey
+	released atomic.Bool
+}
+
+// segmentPins counts the open snapshots that may read each segment. Passes
+// that delete sealed segments leave pinned ones alone.
+type segmentPins struct {
+	mu     sync.Mutex
+	counts map[segmentKey]int
+}
+
+func (p *segmentPins) pin(segments []segmentKey) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.counts == nil {
+		p.counts = make(map[segmentKey]int)
+	}
+	for _, segment := range segments {
+		p.counts[segment]++
+	}
+}
+
+func (p *segmentPins) unpin(segments []segmentKey) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, segment := range segments {
+		if p.counts[segment]--; p.counts[segment] <= 0 {
+			delete(p.counts, segment)
+		}
+	}
+}
+
+func (p *segmentPins) pinned(segment segmentKey) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.counts[segment] > 0
+}
+
+func (e *Engine) Snapshot(ctx context.Context) (*Snapshot, error) {
+	if e.closed.Load() {
+		return nil, ErrEngineClosed
+	}
+
+	// Holding every partition lock keeps the index copy and the high-water
+	// marks in agreement with each other.
+	for _, p := range e.partitions {
+		p.mu.Lock()
+	}
+	defer func() {
+		for _, p := range e.partitions {
+			p.mu.Unlock()
+		}
+	}()
+
+	pointers, err := e.index.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	// The active segment is pinned as well, since it may be sealed and
+	// found stale while the snapshot is still reading it.
+	segments := make([]SegmentSet, 0, len(e.partitions))
+	var pinned []segmentKey
+	for _, p := range e.partitions {
+		if err := p.storage.Flush(); err != nil {
+			return nil, err
+		}
+
+		sealed, err := p.storage.SealedSegmentPaths()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, path := range sealed {
+			segment, err := e.segmentKeyOf(p.id, path)
+			if err != nil {
+				return nil, err
+			}
+			pinned = append(pinned, segment)
+		}
+		pinned = append(pinned, segmentKey{p.id, p.storage.SegmentID(), p.storage.SegmentTimestamp()})
+
+		segments = append(segments, SegmentSet{
+			Partition:     p.id,
+			Sealed:        sealed,
+			Active:        p.storage.ActiveSegmentPath(),
+			HighWaterMark: p.storage.Offset(),
+		})
+	}
+
+	e.pins.pin(pinned)
+	return &Snapshot{
+		engine:   e,
+		takenAt:  time.Now(),
+		pointers: pointers,
+		segments: segments,
+		pinned:   pinned,
+	}, nil
+}
+
+func (s *Snapshot) TakenAt() time.Time {
+	return s.takenAt
+}
+
+func (s *Snapshot) Len() int {
+	return len(s.pointers)
+}
+
+// Keys returns the snapshot's keys in lexicographic order.
+func (s *Snapshot) Keys() []string {
+	keys := make([]string, 0, len(s.pointers))
+	for key := range s.pointers {
+		keys = append(keys, key)
+	}
+
+	slices.Sort(keys)
+	return keys
+}
+
+// KeysWithPrefix returns the snapshot's keys starting with prefix, in
+// lexicographic order.
+func (s *Snapshot) KeysWithPrefix(prefix string) []string {
+	keys := make([]string, 0)
+	for key := range s.pointers {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+
+	slices.Sort(keys)
+	return keys
+}
+
+func (s *Snapshot) Segments() []SegmentSet {
+	return s.segments
+}
+
+func (s *Snapshot) Get(ctx context.Context, key []byte) (*storage.Record, error) {
+	if s.released.Load() || s.engine.closed.Load() {
+		return nil, ErrSnapshotReleased
+	}
+
+	pointer, ok := s.pointers[string(key)]
+	if !ok {
+		return nil, errors.NewIndexError(
+			nil, errors.ErrIndexKeyNotFound, "Key not found in snapshot",
+		).
+			WithKey(string(key))
+	}
+
+	record, err := s.engine.storageFor(&pointer).Get(
+		ctx, key, pointer.SegmentID, pointer.SegmentTimestamp, pointer.Offset,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.engine.dedup != nil {
+		record.Key = key
+	}
+
+	return record, nil
+}
+
+// Scan calls fn with every live key of the snapshot and its record, in the
+// order the records are stored rather than key order. Records are read a
+// segment at a time through a read-ahead buffer, so scanning the whole
+// keyspace runs at close to sequential disk throughput. An error returned by
+// fn, or from reading a record, ends the scan.
+func (s *Snapshot) Scan(ctx context.Context, fn func(key []byte, record *storage.Record) error) error {
+	if s.released.Load() || s.engine.closed.Load() {
+		return ErrSnapshotReleased
+	}
+
+	return s.engine.scanRecords(ctx, s.pointers, func(key string, record *storage.Record, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if s.engine.dedup != nil {
+			record.Key = []byte(key)
+		}
+		return fn([]byte(key), record)
+	})
+}
+
+// scanRecords reads the records of the unexpired pointers through
+// ReadRecords, a partition at a time, and calls fn with each key and its
+// record or the error reading it.
+func (e *Engine) scanRecords(
+	ctx context.Context, pointers map[string]index.RecordPointer,
+	fn func(key string, record *storage.Record, err error) error,
+) error {
+	keys := make([][]string, len(e.partitions))
+	locations := make([][]storage.RecordLocation, len(e.partitions))
+
+	for key, pointer := range pointers {
+		if pointer.IsExpired() {
+			continue
+		}
+
+		keys[pointer.Partition] = append(keys[pointer.Partition], key)
+		locations[pointer.Partition] = append(locations[pointer.Partition], storage.RecordLocation{
+			SegmentID:        pointer.SegmentID,
+			SegmentTimestamp: pointer.SegmentTimestamp,
+			Offset:           pointer.Offset,
+		})
+	}
+
+	for i, p := range e.partitions {
+		err := p.storage.ReadRecords(ctx, locations[i], func(j int, record *storage.Record, err error) error {
+			return fn(keys[i][j], record, err)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Release frees the snapshot and unpins its segments, which may then be
+// reclaimed once no other open snapshot pins them.
+func (s *Snapshot) Release() {
+	if s.released.CompareAndSwap(false, true) {
+		s.pointers = nil
+		s.engine.pins.unpin(s.pinned)
+	}
+}
@@ -0,0 +1,193 @@
+package engine
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/iamBelugaa/kvix/pkg/errors"
+)
+
+type Stats struct {
+	Keys             int               `json:"keys"`
+	LiveDataBytes    int64             `json:"liveDataBytes"`
+	TotalDiskBytes   int64             `json:"totalDiskBytes"`
+	Segments         int               `json:"segments"`
+	Partitions       int               `json:"partitions"`
+	ActiveSegmentID  uint16            `json:"activeSegmentId"`
+	ActiveOffset     int64             `json:"activeOffset"`
+	IndexMemoryBytes int64             `json:"indexMemoryBytes"`
+	Sets             uint64            `json:"sets"`
+	Gets             uint64            `json:"gets"`
+	Misses           uint64            `json:"misses"`
+	Deletes          uint64            `json:"deletes"`
+	Expired          uint64            `json:"expired"`
+	Evictions        uint64            `json:"evictions"`
+	Errors           uint64            `json:"errors"`
+	ErrorsByCode     map[string]uint64 `json:"errorsByCode"`
+
+	LifetimeWrites       uint64 `json:"lifetimeWrites"`
+	LifetimeBytesWritten uint64 `json:"lifetimeBytesWritten"`
+	LifetimeCompactions  uint64 `json:"lifetimeCompactions"`
+	LifetimeCorruptions  uint64 `json:"lifetimeCorruptions"`
+
+	ArchiveFetches    uint64        `json:"archiveFetches"`
+	ArchiveFetchBytes uint64        `json:"archiveFetchBytes"`
+	ArchiveFetchTime  time.Duration `json:"archiveFetchTime"`
+
+	ThrottledWrites  uint64        `json:"throttledWrites"`
+	ThrottleWaitTime time.Duration `json:"throttleWaitTime"`
+
+	CompactionPaused bool `json:"compactionPaused"`
+
+	SegmentPoolHits        uint64 `json:"segmentPoolHits"`
+	SegmentPoolMisses      uint64 `json:"segmentPoolMisses"`
+	SegmentPoolOpens       uint64 `json:"segmentPoolOpens"`
+	SegmentPoolCloses      uint64 `json:"segmentPoolCloses"`
+	SegmentPoolOpenHandles int    `json:"segmentPoolOpenHandles"`
+
+	KeySizesWritten   SizeHistogram `json:"keySizesWritten"`
+	ValueSizesWritten SizeHistogram `json:"valueSizesWritten"`
+	KeySizesRead      SizeHistogram `json:"keySizesRead"`
+	ValueSizesRead    SizeHistogram `json:"valueSizesRead"`
+}
+
+// KeyspaceStats summarizes the live keys that share a prefix.
+type KeyspaceStats struct {
+	Keys          int   `json:"keys"`
+	LiveDataBytes int64 `json:"liveDataBytes"`
+}
+
+type counters struct {
+	sets    atomic.Uint64
+	gets    atomic.Uint64
+	misses  atomic.Uint64
+	deletes atomic.Uint64
+	errors  atomic.Uint64
+	byCode  sync.Map
+
+	evictions atomic.Uint64
+
+	bytesWritten atomic.Uint64
+	compactions  atomic.Uint64
+	corruptions  atomic.Uint64
+
+	archiveFetches    atomic.Uint64
+	archiveFetchBytes atomic.Uint64
+	archiveFetchNanos atomic.Uint64
+
+	throttledWrites   atomic.Uint64
+	throttleWaitNanos atomic.Uint64
+
+	sizes sizeCounters
+}
+
+func (c *counters) recordError(err error) {
+	c.errors.Add(1)
+
+	code := errors.GetErrorCode(err)
+	if code == "" {
+		code = errors.ErrSystemInternal
+	}
+
+	if code == errors.ErrRecordChecksumMismatch || code == errors.ErrRecordDeserialization ||
+		code == errors.ErrRecordHeaderCorrupted {
+		c.corruptions.Add(1)
+	}
+
+	counter, _ := c.byCode.LoadOrStore(code, new(atomic.Uint64))
+	counter.(*atomic.Uint64).Add(1)
+}
+
+func (c *counters) errorsByCode() map[string]uint64 {
+	byCode := make(map[string]uint64)
+	c.byCode.Range(func(code, counter any) bool {
+		byCode[string(code.(errors.ErrorCode))] = counter.(*atomic.Uint64).Load()
+		return true
+	})
+	return byCode
+}
+
+func (e *Engine) Stats(ctx context.Context) (*Stats, error) {
+	if e.closed.Load() {
+		return nil, ErrEngineClosed
+	}
+
+	segments, diskBytes, err := e.segmentUsage()
+	if err != nil {
+		return nil, err
+	}
+
+	usage := e.index.Usage()
+	lifetime := e.lifetimeStats()
+	pool := e.segmentPoolStats()
+
+	return &Stats{
+		Keys:             usage.Keys,
+		LiveDataBytes:    usage.LiveBytes,
+		TotalDiskBytes:   diskBytes,
+		Segments:         segments,
+		Partitions:       len(e.partitions),
+		ActiveSegmentID:  e.partitions[0].storage.SegmentID(),
+		ActiveOffset:     e.partitions[0].storage.Offset(),
+		IndexMemoryBytes: usage.MemoryBytes,
+		Sets:             e.counters.sets.Load(),
+		Gets:             e.counters.gets.Load(),
+		Misses:           e.counters.misses.Load(),
+		Deletes:          e.counters.deletes.Load(),
+		Expired:          e.expired.Load(),
+		Evictions:        e.counters.evictions.Load(),
+		Errors:           e.counters.errors.Load(),
+		ErrorsByCode:     e.counters.errorsByCode(),
+
+		LifetimeWrites:       lifetime.Writes,
+		LifetimeBytesWritten: lifetime.BytesWritten,
+		LifetimeCompactions:  lifetime.Compactions,
+		LifetimeCorruptions:  lifetime.Corruptions,
+
+		ArchiveFetches:    e.counters.archiveFetches.Load(),
+		ArchiveFetchBytes: e.counters.archiveFetchBytes.Load(),
+		ArchiveFetchTime:  time.Duration(e.counters.archiveFetchNanos.Load()),
+
+		ThrottledWrites:  e.counters.throttledWrites.Load(),
+		ThrottleWaitTime: time.Duration(e.counters.throttleWaitNanos.Load()),
+
+		CompactionPaused: e.compaction.paused.Load(),
+
+		SegmentPoolHits:        pool.Hits,
+		SegmentPoolMisses:      pool.Misses,
+		SegmentPoolOpens:       pool.Opens,
+		SegmentPoolCloses:      pool.Closes,
+		SegmentPoolOpenHandles: pool.Open,
+
+		KeySizesWritten:   e.counters.sizes.keysWritten.snapshot(),
+		ValueSizesWritten: e.counters.sizes.valuesWritten.snapshot(),
+		KeySizesRead:      e.counters.sizes.keysRead.snapshot(),
+		ValueSizesRead:    e.counters.sizes.valuesRead.snapshot(),
+	}, nil
+}
+
+// PrefixStats counts the live keys starting with prefix and the bytes their
+// records occupy, including keys spilled out of memory.
+func (e *Engine) PrefixStats(ctx context.Context, prefix string) (*KeyspaceStats, error) {
+	if e.closed.Load() {
+		return nil, ErrEngineClosed
+	}
+
+	pointers, err := e.index.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	var stats KeyspaceStats
+	for key, pointer := range pointers {
+		if strings.HasPrefix(key, prefix) {
+			stats.Keys++
+			stats.LiveDataBytes += int64(pointer.Size)
+		}
+	}
+
+	return &stats, nil
+}
@@ -0,0 +1,158 @@
+package engine
+
+import (
+	"context"
+	stdErrors "errors"
+	"sync"
+	"time"
+
+	"github.com/iamBelugaa/kvix/pkg/options"
+)
+
+// ErrWriteThrottled is returned for writes over WithMaxWriteRate or
+// WithMaxInflightWrites under BackpressureReject.
+var ErrWriteThrottled = stdErrors.New("operation failed: write throttled, the instance is over its write limits")
+
+// throttle applies backpressure to writes. It is nil unless MaxWriteRate or
+// MaxInflightWrites is set.
+type throttle struct {
+	reject bool
+	// slots holds a token per write in progress when MaxInflightWrites is set.
+	slots chan struct{}
+	// bytes is nil when MaxWriteRate is not set.
+	bytes *tokenBucket
+}
+
+func newThrottle(opts *options.Options) *throttle {
+	if opts.MaxWriteRate <= 0 && opts.MaxInflightWrites <= 0 {
+		return nil
+	}
+
+	t := &throttle{
+		reject: opts.WriteBackpressure == options.BackpressureReject,
+		bytes:  newTokenBucket(float64(opts.MaxWriteRate)),
+	}
+	if opts.MaxInflightWrites > 0 {
+		t.slots = make(chan struct{}, opts.MaxInflightWrites)
+	}
+	return t
+}
+
+// tokenBucket refills at rate tokens per second, holding up to a second's
+// worth. tokens may go negative: a taker is admitted while the bucket is not
+// in debt, so that takes larger than a second's worth still get through.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket returns nil, which never holds anyone up, unless rate is
+// positive.
+func newTokenBucket(rate float64) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	return &tokenBucket{rate: rate, tokens: rate, last: time.Now()}
+}
+
+// acquire admits a write of size bytes, waiting for room unless reject is
+// set, and returns the function that ends it.
+func (t *throttle) acquire(ctx context.Context, size int, reject bool) (func(), error) {
+	if t.slots != nil {
+		if err := t.takeSlot(ctx, reject); err != nil {
+			return nil, err
+		}
+	}
+
+	if t.bytes != nil {
+		if err := t.bytes.take(ctx, float64(size), reject); err != nil {
+			t.releaseSlot()
+			return nil, err
+		}
+	}
+
+	return t.releaseSlot, nil
+}
+
+func (t *throttle) takeSlot(ctx context.Context, reject bool) error {
+	select {
+	case t.slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	if reject {
+		return ErrWriteThrottled
+	}
+
+	select {
+	case t.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (t *throttle) releaseSlot() {
+	if t.slots != nil {
+		<-t.slots
+	}
+}
+
+// take takes n tokens from the bucket once it is out of debt, waiting for it
+// to refill unless reject is set.
+func (b *tokenBucket) take(ctx context.Context, n float64, reject bool) error {
+	if b == nil {
+		return nil
+	}
+
+	for {
+		b.mu.Lock()
+		now := time.Now()
+		b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*b.rate, b.rate)
+		b.last = now
+
+		if b.tokens >= 0 {
+			b.tokens -= n
+			b.mu.Unlock()
+			return nil
+		}
+
+		debt := b.tokens
+		b.mu.Unlock()
+
+		if reject {
+			return ErrWriteThrottled
+		}
+
+		timer := time.NewTimer(time.Duration(-debt / b.rate * float64(time.Second)))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// admit passes a write of size bytes through the throttle, counting the
+// writes it rejects and the time writes spend held by it. wait holds the
+// write even under BackpressureReject, for imports that would otherwise stop
+// halfway.
+func (e *Engine) admit(ctx context.Context, size int, wait bool) (func(), error) {
+	if e.throttle == nil {
+		return func() {}, nil
+	}
+
+	start := time.Now()
+	release, err := e.throttle.acquire(ctx, size, e.throttle.reject && !wait)
+	if stdErrors.Is(err, ErrWriteThrottled) {
+		e.counters.throttledWrites.Add(1)
+		return nil, err
+	}
+
+	e.counters.throttleWaitNanos.Add(uint64(time.Since(start)))
+	return release, err
+}
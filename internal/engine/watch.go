@@ -0,0 +1,197 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"time"
+
+	"github.com/iamBelugaa/kvix/internal/changefeed"
+)
+
+// WatchBuffer is how many events a watcher may fall behind before it is
+// closed.
+const WatchBuffer = 1024
+
+// EventType says what happened to the key of an Event.
+type EventType uint8
+
+const (
+	// EventSet reports a write; Value and ExpiresAt describe the new version.
+	EventSet EventType = iota + 1
+	// EventDelete reports a key removed by Delete or by a repair.
+	EventDelete
+	// EventExpire reports a key removed because its TTL ran out. Keys are
+	// removed by the expiration sweeper or when read after expiring, so the
+	// event may trail the expiration time.
+	EventExpire
+	// EventOverflow is the last event of a watcher that fell WatchBuffer
+	// events behind. Events after it were dropped; re-read the keys of
+	// interest and watch again.
+	EventOverflow
+	// EventEvict reports a key removed to keep a bounded instance within
+	// MaxKeys or MaxLiveBytes.
+	EventEvict
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventSet:
+		return "set"
+	case EventDelete:
+		return "delete"
+	case EventExpire:
+		return "expire"
+	case EventOverflow:
+		return "overflow"
+	case EventEvict:
+		return "evict"
+	}
+	return "unknown"
+}
+
+// Event is a change to one key. Key and Value are copies owned by the
+// receiver. Sequence is the change's position in the change feed, or zero
+// when the feed is disabled.
+type Event struct {
+	Sequence  uint64
+	Type      EventType
+	Key       []byte
+	Value     []byte
+	ExpiresAt time.Time
+	Time      time.Time
+}
+
+type watcher struct {
+	prefix []byte
+	events chan Event
+	// closed is guarded by the engine's watchMu.
+	closed bool
+}
+
+// Watch returns a channel of changes to keys starting with prefix; an empty
+// prefix watches every key. Events for one key arrive in the order the
+// changes were made. The channel is closed when ctx is done, when the engine
+// closes, or after an EventOverflow when the receiver falls behind.
+func (e *Engine) Watch(ctx context.Context, prefix []byte) (<-chan Event, error) {
+	if e.closed.Load() {
+		return nil, ErrEngineClosed
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	w, err := e.addWatcher(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	context.AfterFunc(ctx, func() { e.unwatch(w) })
+	return w.events, nil
+}
+
+func (e *Engine) addWatcher(prefix []byte) (*watcher, error) {
+	// One slot beyond the buffer is kept for the overflow event.
+	w := &watcher{prefix: bytes.Clone(prefix), events: make(chan Event, WatchBuffer+1)}
+
+	e.watchMu.Lock()
+	defer e.watchMu.Unlock()
+
+	if e.closed.Load() {
+		return nil, ErrEngineClosed
+	}
+
+	e.watchers[w] = struct{}{}
+	e.watching.Add(1)
+	return w, nil
+}
+
+// notify runs the hooks for a change, records it in the change feed, when
+// enabled, and delivers it to every matching watcher without blocking.
+// Callers hold the partition lock of key, which orders the events of each
+// key; with a change feed, events of all keys are delivered in sequence
+// order.
+func (e *Engine) notify(eventType EventType, key, value []byte, expiresAt int64) {
+	e.runHooks(eventType, key, value, expiresAt)
+
+	now := time.Now()
+	if e.feed == nil {
+		if e.watching.Load() > 0 {
+			e.deliver(Event{Type: eventType, Key: key, Value: value, Time: now}, expiresAt)
+		}
+		return
+	}
+
+	e.publishMu.Lock()
+	defer e.publishMu.Unlock()
+
+	entry := changefeed.Entry{Time: now.UnixNano(), ExpiresAt: expiresAt, Type: uint8(eventType), Key: key, Value: value}
+	if err := e.feed.Append(&entry); err != nil {
+		// Watchers only get what the change feed holds, so that a watcher
+		// resuming from a sequence number misses nothing it was sent.
+		e.counters.recordError(err)
+		e.log.Errorw("Failed to record change in change feed", "key", string(key), "type", eventType, "error", err)
+		return
+	}
+
+	if e.watching.Load() > 0 {
+		e.deliver(Event{Sequence: entry.Sequence, Type: eventType, Key: key, Value: value, Time: now}, expiresAt)
+	}
+}
+
+// deliver sends copies of event to the watchers whose prefix matches.
+func (e *Engine) deliver(event Event, expiresAt int64) {
+	e.watchMu.Lock()
+	defer e.watchMu.Unlock()
+
+	copied := false
+	for w := range e.watchers {
+		if !bytes.HasPrefix(event.Key, w.prefix) {
+			continue
+		}
+
+		if !copied {
+			event.Key = bytes.Clone(event.Key)
+			event.Value = bytes.Clone(event.Value)
+			if expiresAt != 0 {
+				event.ExpiresAt = time.Unix(0, expiresAt)
+			}
+			copied = true
+		}
+
+		if len(w.events) < WatchBuffer {
+			w.events <- event
+			continue
+		}
+
+		w.events <- Event{Type: EventOverflow, Time: event.Time}
+		e.unwatchLocked(w)
+	}
+}
+
+func (e *Engine) unwatch(w *watcher) {
+	e.watchMu.Lock()
+	defer e.watchMu.Unlock()
+	e.unwatchLocked(w)
+}
+
+func (e *Engine) unwatchLocked(w *watcher) {
+	if w.closed {
+		return
+	}
+
+	w.closed = true
+	delete(e.watchers, w)
+	e.watching.Add(-1)
+	close(w.events)
+}
+
+// closeWatchers ends every watch when the engine closes.
+func (e *Engine) closeWatchers() {
+	e.watchMu.Lock()
+	defer e.watchMu.Unlock()
+
+	for w := range e.watchers {
+		e.unwatchLocked(w)
+	}
+}
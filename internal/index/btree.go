@@ -0,0 +1,309 @@
+package index
+
+import (
+	"slices"
+	"sort"
+	"sync"
+	"unsafe"
+
+	"github.com/iamBelugaa/kvix/pkg/options"
+)
+
+// treeEntryOverhead approximates the memory a key takes in a keyTree: the
+// string header in its node, whose bytes are shared with the shard's map.
+const treeEntryOverhead = int64(unsafe.Sizeof(""))
+
+// treeDegree is the minimum degree of keyTree: nodes other than the root
+// hold between treeDegree-1 and 2*treeDegree-1 keys.
+const treeDegree = 32
+
+// keyTree is a B-tree of the live keys in lexicographic order. An ordered
+// index keeps one next to its shards, so that keys can be walked in order
+// without collecting and sorting the whole keydir.
+type keyTree struct {
+	mu   sync.RWMutex
+	root *treeNode
+	size int
+}
+
+// newKeyTree returns the key tree of an index with layout, or nil unless the
+// layout is ordered.
+func newKeyTree(layout options.IndexLayout) *keyTree {
+	if layout != options.IndexOrdered {
+		return nil
+	}
+	return &keyTree{}
+}
+
+type treeNode struct {
+	keys []string
+	// children is nil for leaves, and otherwise holds one more node than
+	// keys: children[i] holds the keys between keys[i-1] and keys[i].
+	children []*treeNode
+}
+
+// insert adds key, reporting false if it was already there. Like remove
+// and clear, it does nothing on a nil tree.
+func (t *keyTree) insert(key string) bool {
+	if t == nil {
+		return false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.root == nil {
+		t.root = &treeNode{keys: []string{key}}
+		t.size = 1
+		return true
+	}
+
+	if t.root.contains(key) {
+		return false
+	}
+
+	if len(t.root.keys) == 2*treeDegree-1 {
+		root := &treeNode{children: []*treeNode{t.root}}
+		root.split(0)
+		t.root = root
+	}
+
+	t.root.insert(key)
+	t.size++
+	return true
+}
+
+// remove drops key, reporting false if it was not there.
+func (t *keyTree) remove(key string) bool {
+	if t == nil {
+		return false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.root == nil || !t.root.remove(key) {
+		return false
+	}
+
+	if len(t.root.keys) == 0 {
+		if t.root.children != nil {
+			t.root = t.root.children[0]
+		} else {
+			t.root = nil
+		}
+	}
+	t.size--
+	return true
+}
+
+// ascend calls fn with the keys from start on, in ascending order, until fn
+// returns false. Callers must hold mu.
+func (t *keyTree) ascend(start string, fn func(key string) bool) {
+	if t.root != nil {
+		t.root.ascend(start, fn)
+	}
+}
+
+// descend calls fn with the keys up to and including end, or all of them
+// unless bounded, in descending order until fn returns false. Callers must
+// hold mu.
+func (t *keyTree) descend(end string, bounded bool, fn func(key string) bool) {
+	if t.root != nil {
+		t.root.descend(end, bounded, fn)
+	}
+}
+
+func (t *keyTree) clear() {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.root = nil
+	t.size = 0
+}
+
+func (n *treeNode) contains(key string) bool {
+	for {
+		i, found := slices.BinarySearch(n.keys, key)
+		if found {
+			return true
+		}
+		if n.children == nil {
+			return false
+		}
+		n = n.children[i]
+	}
+}
+
+// split moves the upper half of the full child i into a new sibling, lifting
+// its middle key into n.
+func (n *treeNode) split(i int) {
+	child := n.children[i]
+	middle := treeDegree - 1
+
+	sibling := &treeNode{keys: slices.Clone(child.keys[middle+1:])}
+	if child.children != nil {
+		sibling.children = slices.Clone(child.children[middle+1:])
+		clear(child.children[middle+1:])
+		child.children = child.children[:middle+1]
+	}
+
+	lifted := child.keys[middle]
+	clear(child.keys[middle:])
+	child.keys = child.keys[:middle]
+
+	n.keys = slices.Insert(n.keys, i, lifted)
+	n.children = slices.Insert(n.children, i+1, sibling)
+}
+
+// insert adds key below n, which is not full and does not hold it.
+func (n *treeNode) insert(key string) {
+	for {
+		i := sort.SearchStrings(n.keys, key)
+		if n.children == nil {
+			n.keys = slices.Insert(n.keys, i, key)
+			return
+		}
+
+		if len(n.children[i].keys) == 2*treeDegree-1 {
+			n.split(i)
+			if key > n.keys[i] {
+				i++
+			}
+		}
+		n = n.children[i]
+	}
+}
+
+// remove drops key from below n. n is the root or holds at least treeDegree
+// keys, so a key can be taken from it without leaving it short.
+func (n *treeNode) remove(key string) bool {
+	i, found := slices.BinarySearch(n.keys, key)
+	if n.children == nil {
+		if found {
+			n.keys = slices.Delete(n.keys, i, i+1)
+		}
+		return found
+	}
+
+	if !found {
+		if len(n.children[i].keys) < treeDegree {
+			i = n.fill(i)
+		}
+		return n.children[i].remove(key)
+	}
+
+	// key sits between two children: replace it with its neighbour from
+	// whichever child can spare a key, or merge the two and remove it there.
+	switch {
+	case len(n.children[i].keys) >= treeDegree:
+		predecessor := n.children[i].last()
+		n.keys[i] = predecessor
+		return n.children[i].remove(predecessor)
+	case len(n.children[i+1].keys) >= treeDegree:
+		successor := n.children[i+1].first()
+		n.keys[i] = successor
+		return n.children[i+1].remove(successor)
+	default:
+		n.merge(i)
+		return n.children[i].remove(key)
+	}
+}
+
+// fill brings child i up to treeDegree keys, borrowing from a sibling or
+// merging with one, and returns the index of the child now covering its keys.
+func (n *treeNode) fill(i int) int {
+	switch {
+	case i > 0 && len(n.children[i-1].keys) >= treeDegree:
+		child, sibling := n.children[i], n.children[i-1]
+		child.keys = slices.Insert(child.keys, 0, n.keys[i-1])
+		n.keys[i-1] = sibling.keys[len(sibling.keys)-1]
+		sibling.keys = slices.Delete(sibling.keys, len(sibling.keys)-1, len(sibling.keys))
+		if child.children != nil {
+			child.children = slices.Insert(child.children, 0, sibling.children[len(sibling.children)-1])
+			sibling.children = slices.Delete(sibling.children, len(sibling.children)-1, len(sibling.children))
+		}
+		return i
+	case i < len(n.keys) && len(n.children[i+1].keys) >= treeDegree:
+		child, sibling := n.children[i], n.children[i+1]
+		child.keys = append(child.keys, n.keys[i])
+		n.keys[i] = sibling.keys[0]
+		sibling.keys = slices.Delete(sibling.keys, 0, 1)
+		if child.children != nil {
+			child.children = append(child.children, sibling.children[0])
+			sibling.children = slices.Delete(sibling.children, 0, 1)
+		}
+		return i
+	case i < len(n.keys):
+		n.merge(i)
+		return i
+	default:
+		n.merge(i - 1)
+		return i - 1
+	}
+}
+
+// merge folds key i and child i+1 into child i.
+func (n *treeNode) merge(i int) {
+	child, sibling := n.children[i], n.children[i+1]
+	child.keys = append(append(child.keys, n.keys[i]), sibling.keys...)
+	child.children = append(child.children, sibling.children...)
+
+	n.keys = slices.Delete(n.keys, i, i+1)
+	n.children = slices.Delete(n.children, i+1, i+2)
+}
+
+func (n *treeNode) first() string {
+	for n.children != nil {
+		n = n.children[0]
+	}
+	return n.keys[0]
+}
+
+func (n *treeNode) last() string {
+	for n.children != nil {
+		n = n.children[len(n.children)-1]
+	}
+	return n.keys[len(n.keys)-1]
+}
+
+func (n *treeNode) ascend(start string, fn func(key string) bool) bool {
+	i := sort.SearchStrings(n.keys, start)
+	for ; i < len(n.keys); i++ {
+		if n.children != nil && !n.children[i].ascend(start, fn) {
+			return false
+		}
+		if !fn(n.keys[i]) {
+			return false
+		}
+	}
+
+	if n.children != nil {
+		return n.children[len(n.keys)].ascend(start, fn)
+	}
+	return true
+}
+
+func (n *treeNode) descend(end string, bounded bool, fn func(key string) bool) bool {
+	i := len(n.keys)
+	if bounded {
+		i = sort.Search(len(n.keys), func(j int) bool { return n.keys[j] > end })
+	}
+
+	if n.children != nil && !n.children[i].descend(end, bounded, fn) {
+		return false
+	}
+	for i--; i >= 0; i-- {
+		if !fn(n.keys[i]) {
+			return false
+		}
+		if n.children != nil && !n.children[i].descend(end, bounded, fn) {
+			return false
+		}
+	}
+	return true
+}
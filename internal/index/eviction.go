@@ -0,0 +1,141 @@
+package index
+
+import (
+	"math"
+	"math/rand/v2"
+	"sync/atomic"
+	"time"
+
+	"github.com/iamBelugaa/kvix/pkg/options"
+)
+
+// evictionSamples is how many entries EvictionVictim compares. Like Redis,
+// the index approximates LRU and LFU by sampling rather than keeping every key
+// in order, which would serialize all reads on one list.
+const evictionSamples = 16
+
+// samplesPerShard spreads a sample over several shards, since entries are
+// visited in map order.
+const samplesPerShard = 4
+
+// lfuDecay halves the use count of a key for every period it goes unused, so
+// keys that were popular once do not stay forever.
+const lfuDecay = time.Minute
+
+// access records when and how often a key was used. It is updated under the
+// shard's read lock, hence the atomics.
+type access struct {
+	last atomic.Int64
+	hits atomic.Uint32
+}
+
+func (a *access) record(now int64) {
+	a.last.Store(now)
+	if a.hits.Load() < math.MaxUint32 {
+		a.hits.Add(1)
+	}
+}
+
+// score orders keys for eviction: the lowest goes first.
+func (a *access) score(policy options.EvictionPolicy, now int64) (uint64, int64) {
+	last := a.last.Load()
+	if policy != options.EvictLFU {
+		return 0, last
+	}
+
+	periods := min((now-last)/int64(lfuDecay), 32)
+	return uint64(a.hits.Load()) >> periods, last
+}
+
+// bounds limits the index and counts what it holds. The limits and policy
+// can change while the index is in use, hence the atomics.
+type bounds struct {
+	policy   atomic.Uint32
+	maxKeys  atomic.Int64
+	maxBytes atomic.Int64
+	keys     atomic.Int64
+	bytes    atomic.Int64
+}
+
+func newBounds(options *options.Options) *bounds {
+	if options.MaxKeys <= 0 && options.MaxLiveBytes <= 0 {
+		return nil
+	}
+
+	b := &bounds{}
+	b.set(options.MaxKeys, options.MaxLiveBytes, options.EvictionPolicy)
+	return b
+}
+
+func (b *bounds) set(maxKeys int, maxBytes int64, policy options.EvictionPolicy) {
+	b.maxKeys.Store(int64(maxKeys))
+	b.maxBytes.Store(maxBytes)
+	b.policy.Store(uint32(policy))
+}
+
+// SetBounds changes the limits and eviction policy of a bounded index, and
+// returns false for an index opened without limits, which does not track key
+// use to evict by.
+func (idx *Index) SetBounds(maxKeys int, maxBytes int64, policy options.EvictionPolicy) bool {
+	if idx.bounds == nil {
+		return false
+	}
+
+	idx.bounds.set(maxKeys, maxBytes, policy)
+	return true
+}
+
+// OverCapacity reports whether the index holds more keys or record bytes than
+// the instance allows. Expired keys count until they are removed.
+func (idx *Index) OverCapacity() bool {
+	b := idx.bounds
+	if b == nil {
+		return false
+	}
+	maxKeys, maxBytes := b.maxKeys.Load(), b.maxBytes.Load()
+	return (maxKeys > 0 && b.keys.Load() > maxKeys) || (maxBytes > 0 && b.bytes.Load() > maxBytes)
+}
+
+// EvictionVictim picks the key to evict next from a random sample, favoring
+// expired keys, and false when the index is empty.
+func (idx *Index) EvictionVictim() (string, bool) {
+	if idx.bounds == nil {
+		return "", false
+	}
+
+	var victim string
+	var bestScore uint64
+	var bestLast int64
+	found := false
+	sampled := 0
+	now := time.Now().UnixNano()
+	policy := options.EvictionPolicy(idx.bounds.policy.Load())
+	start := rand.IntN(shardCount)
+
+	for i := 0; i < shardCount && sampled < evictionSamples; i++ {
+		shard := idx.shards[(start+i)%shardCount]
+
+		shard.mu.RLock()
+		taken := 0
+		for key, pointer := range shard.recordPointer {
+			if pointer.IsExpired() {
+				shard.mu.RUnlock()
+				return key, true
+			}
+
+			score, last := shard.access[key].score(policy, now)
+			if !found || score < bestScore || (score == bestScore && last < bestLast) {
+				victim, found, bestScore, bestLast = key, true, score, last
+			}
+
+			sampled++
+			taken++
+			if taken == samplesPerShard || sampled == evictionSamples {
+				break
+			}
+		}
+		shard.mu.RUnlock()
+	}
+
+	return victim, found
+}
@@ -0,0 +1,141 @@
+package index
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// expiryQueue is a min-heap of the keys with a TTL, ordered by when they
+// expire. An index that refreshes ahead keeps one next to its shards, so that
+// the keys about to expire are found without visiting every other key.
+type expiryQueue struct {
+	mu       sync.Mutex
+	entries  []expiryEntry
+	position map[string]int
+}
+
+type expiryEntry struct {
+	key       string
+	expiresAt int64
+}
+
+// newExpiryQueue returns the expiry queue of an index refreshing window ahead
+// of expiry, or nil if it does not refresh ahead.
+func newExpiryQueue(window time.Duration) *expiryQueue {
+	if window <= 0 {
+		return nil
+	}
+	return &expiryQueue{position: make(map[string]int)}
+}
+
+// set queues key to expire at expiresAt, or drops it from the queue if
+// expiresAt is zero. Like remove, within and clear, it does nothing on a nil
+// queue.
+func (q *expiryQueue) set(key string, expiresAt int64) {
+	if q == nil {
+		return
+	}
+	if expiresAt == 0 {
+		q.remove(key)
+		return
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if i, ok := q.position[key]; ok {
+		q.entries[i].expiresAt = expiresAt
+		heap.Fix((*expiryHeap)(q), i)
+		return
+	}
+	heap.Push((*expiryHeap)(q), expiryEntry{key: key, expiresAt: expiresAt})
+}
+
+func (q *expiryQueue) remove(key string) {
+	if q == nil {
+		return
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if i, ok := q.position[key]; ok {
+		heap.Remove((*expiryHeap)(q), i)
+	}
+}
+
+// within returns the keys expiring after now but at most window from now. It
+// only visits those and the keys that already expired, which RemoveExpired
+// takes out of the queue.
+func (q *expiryQueue) within(window time.Duration) []string {
+	if q == nil {
+		return nil
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now().UnixNano()
+	deadline := now + int64(window)
+
+	var keys []string
+	stack := []int{0}
+	for len(stack) > 0 {
+		i := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if i >= len(q.entries) || q.entries[i].expiresAt > deadline {
+			continue
+		}
+
+		if q.entries[i].expiresAt >= now {
+			keys = append(keys, q.entries[i].key)
+		}
+		stack = append(stack, 2*i+1, 2*i+2)
+	}
+	return keys
+}
+
+func (q *expiryQueue) clear() {
+	if q == nil {
+		return
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.entries = nil
+	clear(q.position)
+}
+
+// expiryHeap implements heap.Interface over an expiryQueue, keeping its
+// positions in step with its entries. Callers must hold the queue's mu.
+type expiryHeap expiryQueue
+
+func (h *expiryHeap) Len() int {
+	return len(h.entries)
+}
+
+func (h *expiryHeap) Less(i, j int) bool {
+	return h.entries[i].expiresAt < h.entries[j].expiresAt
+}
+
+func (h *expiryHeap) Swap(i, j int) {
+	h.entries[i], h.entries[j] = h.entries[j], h.entries[i]
+	h.position[h.entries[i].key] = i
+	h.position[h.entries[j].key] = j
+}
+
+func (h *expiryHeap) Push(x any) {
+	entry := x.(expiryEntry)
+	h.position[entry.key] = len(h.entries)
+	h.entries = append(h.entries, entry)
+}
+
+func (h *expiryHeap) Pop() any {
+	last := len(h.entries) - 1
+	entry := h.entries[last]
+	h.entries = h.entries[:last]
+	delete(h.position, entry.key)
+	return entry
+}
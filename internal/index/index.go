@@ -1,64 +1,427 @@
 package index
 
-func New(dataDir string) (*Index, error) {
-	return &Index{
-		dataDir:       dataDir,
-		recordPointer: make(map[string]*RecordPointer),
-	}, nil
+import (
+	"time"
+	"unsafe"
+
+	"go.uber.org/zap"
+
+	"github.com/iamBelugaa/kvix/pkg/options"
+)
+
+// entryOverhead approximates the memory held by one index entry besides the
+// key bytes: the pointer struct, the string header and the map slot.
+const entryOverhead = int64(unsafe.Sizeof(RecordPointer{})) + int64(unsafe.Sizeof("")) + 2*int64(unsafe.Sizeof(uintptr(0)))
+
+func New(log *zap.SugaredLogger, options *options.Options) (*Index, error) {
+	idx := &Index{
+		log:        log,
+		dataDir:    options.DataDir,
+		staleGrace: options.StaleGracePeriod,
+		bounds:     newBounds(options),
+		ordered:    newKeyTree(options.IndexLayout),
+		expiries:   newExpiryQueue(options.RefreshAhead),
+	}
+
+	var shardCapacity int
+	if options.MaxResidentKeys > 0 {
+		spill, err := newSpillStore(log, options.FileSystem, options.DataDir)
+		if err != nil {
+			return nil, err
+		}
+
+		idx.spill = spill
+		shardCapacity = max(1, (options.MaxResidentKeys+shardCount-1)/shardCount)
+	}
+
+	for i := range idx.shards {
+		idx.shards[i] = newShard(shardCapacity, idx.bounds)
+	}
+
+	return idx, nil
 }
 
-func (idx *Index) Set(key string, pointer *RecordPointer) {
-	idx.mu.Lock()
-	idx.recordPointer[key] = pointer
-	idx.mu.Unlock()
+// Set points key at pointer, releasing the record it pointed at before. It
+// reports whether key already pointed at the same record, which is then not
+// released.
+func (idx *Index) Set(key string, pointer *RecordPointer) bool {
+	shard := idx.shardFor(key)
+
+	shard.mu.Lock()
+	previous, ok := shard.recordPointer[key]
+	if !ok {
+		previous = idx.dropSpilled(key, pointer)
+	}
+	shard.put(key, pointer)
+	idx.ordered.insert(key)
+	idx.expiries.set(key, pointer.ExpiresAt)
+	idx.spillEvicted(shard)
+	shard.mu.Unlock()
+
+	if previous == nil {
+		return false
+	}
+	if previous.sameRecord(pointer) {
+		return true
+	}
+
+	idx.release(previous, ReleaseOverwritten)
+	return false
 }
 
+// Get returns the entry of key unless it is missing or expired. Expired
+// entries are left for RemoveExpired.
 func (idx *Index) Get(key string) (*RecordPointer, bool) {
-	pointer, ok := idx.recordPointer[key]
-	if !ok {
+	pointer, ok := idx.lookup(key)
+	if !ok || pointer.IsExpired() {
 		return nil, false
 	}
+	return pointer, true
+}
+
+// Peek returns the entry of key like Get does, except that it also returns
+// entries that have expired.
+func (idx *Index) Peek(key string) (*RecordPointer, bool) {
+	return idx.lookup(key)
+}
+
+// GetStale behaves like Get but also returns pointers that expired within the
+// configured grace period, reporting them as stale.
+func (idx *Index) GetStale(key string) (*RecordPointer, bool, bool) {
+	pointer, ok := idx.lookup(key)
+	if !ok {
+		return nil, false, false
+	}
+
+	if pointer.IsStale(idx.staleGrace) {
+		return pointer, true, true
+	}
 
 	if pointer.IsExpired() {
-		idx.mu.Lock()
-		delete(idx.recordPointer, key)
-		idx.mu.Unlock()
-		return nil, false
+		return nil, false, false
 	}
 
-	return pointer, true
+	return pointer, false, true
 }
 
 func (idx *Index) Delete(key string) bool {
-	_, ok := idx.recordPointer[key]
+	shard := idx.shardFor(key)
+	shard.mu.Lock()
+	pointer, ok := shard.recordPointer[key]
 	if !ok {
+		pointer = idx.dropSpilled(key, nil)
+	}
+	if pointer == nil {
+		shard.mu.Unlock()
+		return false
+	}
+
+	shard.remove(key)
+	idx.ordered.remove(key)
+	idx.expiries.remove(key)
+	shard.mu.Unlock()
+
+	idx.release(pointer, ReleaseDeleted)
+	return true
+}
+
+func (idx *Index) SetExpiresAt(key string, expiresAt int64) bool {
+	shard := idx.shardFor(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	pointer, ok := idx.promote(shard, key)
+	if !ok {
+		return false
+	}
+	defer idx.spillEvicted(shard)
+
+	if pointer.IsExpired() {
+		return false
+	}
+
+	// Pointers handed out by Get are read without the shard lock, so they are
+	// replaced rather than mutated in place.
+	updated := *pointer
+	updated.ExpiresAt = expiresAt
+	shard.recordPointer[key] = &updated
+	idx.expiries.set(key, expiresAt)
+	return true
+}
+
+// LocateSpilledWith has entries spilled to disk found through the key tables
+// of sealed segments where those lead to the same record, instead of being
+// written to the index blocks. It only matters with MaxResidentKeys set, and
+// must be set before the index is used.
+func (idx *Index) LocateSpilledWith(fn KeyLocator) {
+	if idx.spill != nil {
+		idx.spill.locate = fn
+	}
+}
+
+// OnExpire registers fn to be called with every key RemoveExpired removes,
+// and the pointer it held. It must be set before the index is used.
+func (idx *Index) OnExpire(fn func(key string, pointer *RecordPointer)) {
+	idx.onExpire = fn
+}
+
+// OnRelease registers fn to be called with every record a key stopped
+// pointing at, and why: overwritten by Set, removed by Delete, or expired.
+// Pointers moved to the same record, as SetExpiresAt does, are not reported.
+// Records of keys that had already expired are reported as expired. Unless
+// exact is set, fn only needs the segment and size of the records: those of
+// spilled keys are then reported without reading their entries back from
+// disk, with an Offset of -1. It must be set before the index is shared.
+func (idx *Index) OnRelease(fn func(pointer *RecordPointer, reason Release), exact bool) {
+	idx.onRelease = fn
+	idx.exactRelease = exact
+}
+
+func (idx *Index) release(pointer *RecordPointer, reason Release) {
+	if idx.onRelease == nil {
+		return
+	}
+
+	if pointer.IsExpired() {
+		reason = ReleaseExpired
+	}
+	idx.onRelease(pointer, reason)
+}
+
+// ExpiredKeys returns the keys whose entries expired longer ago than the
+// stale grace period, for RemoveExpired.
+func (idx *Index) ExpiredKeys() []string {
+	var keys []string
+	for _, shard := range idx.shards {
+		shard.mu.RLock()
+		for key, rp := range shard.recordPointer {
+			if rp.IsExpired() && !rp.IsStale(idx.staleGrace) {
+				keys = append(keys, key)
+			}
+		}
+		shard.mu.RUnlock()
+	}
+
+	if idx.spill != nil {
+		keys = append(keys, idx.spill.Expired(idx.staleGrace)...)
+	}
+	return keys
+}
+
+// RemoveExpired removes key if its entry expired longer ago than the stale
+// grace period, reporting it to the expiration and release hooks. Callers
+// hold whatever orders changes to key, so that the hooks see its removal in
+// order with them.
+func (idx *Index) RemoveExpired(key string) bool {
+	shard := idx.shardFor(key)
+	shard.mu.Lock()
+	pointer, ok := idx.promote(shard, key)
+	if !ok || !pointer.IsExpired() || pointer.IsStale(idx.staleGrace) {
+		if ok {
+			idx.spillEvicted(shard)
+		}
+		shard.mu.Unlock()
 		return false
 	}
 
-	idx.mu.Lock()
-	delete(idx.recordPointer, key)
-	idx.mu.Unlock()
+	shard.remove(key)
+	idx.ordered.remove(key)
+	idx.expiries.remove(key)
+	shard.mu.Unlock()
 
+	if idx.onExpire != nil {
+		idx.onExpire(key, pointer)
+	}
+	idx.release(pointer, ReleaseExpired)
 	return true
 }
 
-func (idx *Index) CleanupExpired() {
-	idx.mu.Lock()
-	defer idx.mu.Unlock()
+// ExpiringWithin returns the live keys whose remaining TTL is at most window.
+// It only finds them if the index refreshes ahead.
+func (idx *Index) ExpiringWithin(window time.Duration) []string {
+	return idx.expiries.within(window)
+}
 
-	for key, rp := range idx.recordPointer {
+// Snapshot copies every live entry, including those spilled to disk in
+// partial mode. Callers that need a consistent copy must block writers while
+// it runs.
+func (idx *Index) Snapshot() (map[string]RecordPointer, error) {
+	entries := make(map[string]RecordPointer)
+
+	if idx.spill != nil {
+		spilled, err := idx.spill.All()
+		if err != nil {
+			return nil, err
+		}
+		entries = spilled
+	}
+
+	for _, shard := range idx.shards {
+		shard.mu.RLock()
+		for key, rp := range shard.recordPointer {
+			entries[key] = *rp
+		}
+		shard.mu.RUnlock()
+	}
+
+	for key, rp := range entries {
 		if rp.IsExpired() {
-			delete(idx.recordPointer, key)
+			delete(entries, key)
 		}
 	}
+
+	return entries, nil
+}
+
+func (idx *Index) Usage() Usage {
+	var usage Usage
+	for _, shard := range idx.shards {
+		shard.mu.RLock()
+		for key, rp := range shard.recordPointer {
+			if rp.IsExpired() {
+				continue
+			}
+
+			usage.Keys++
+			usage.LiveBytes += int64(rp.Size)
+			usage.MemoryBytes += entryOverhead + int64(len(key))
+			if idx.ordered != nil {
+				usage.MemoryBytes += treeEntryOverhead
+			}
+		}
+		shard.mu.RUnlock()
+	}
+
+	if idx.spill != nil {
+		spilled := idx.spill.Usage()
+		usage.Keys += spilled.Keys
+		usage.LiveBytes += spilled.LiveBytes
+		usage.MemoryBytes += spilled.MemoryBytes
+	}
+	return usage
 }
 
 func (idx *Index) Close() error {
-	idx.mu.Lock()
-	defer idx.mu.Unlock()
+	for _, shard := range idx.shards {
+		shard.mu.Lock()
+		clear(shard.recordPointer)
+		shard.recordPointer = nil
+		shard.lru = nil
+		shard.elements = nil
+		shard.access = nil
+		shard.mu.Unlock()
+	}
 
-	clear(idx.recordPointer)
-	idx.recordPointer = nil
+	idx.ordered.clear()
+	idx.expiries.clear()
+	if idx.spill != nil {
+		return idx.spill.Close()
+	}
 
 	return nil
 }
+
+// lookup finds key in memory and, in partial mode, falls back to the on-disk
+// index blocks, promoting the entry back into memory when found there.
+func (idx *Index) lookup(key string) (*RecordPointer, bool) {
+	shard := idx.shardFor(key)
+
+	if idx.spill == nil {
+		shard.mu.RLock()
+		pointer, ok := shard.recordPointer[key]
+		if ok && shard.access != nil {
+			shard.access[key].record(time.Now().UnixNano())
+		}
+		shard.mu.RUnlock()
+		return pointer, ok
+	}
+
+	// The shard stays locked from the lookup to the spilling of whatever
+	// the promotion evicts, so the key is never in neither place.
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	_, resident := shard.recordPointer[key]
+	pointer, ok := idx.promote(shard, key)
+	if !ok {
+		return nil, false
+	}
+
+	// An entry promoted from disk is counted as used when it is put back;
+	// one already in memory is counted here, as without spilling, so that
+	// eviction policies see every read.
+	if resident && shard.access != nil {
+		shard.access[key].record(time.Now().UnixNano())
+	}
+	idx.spillEvicted(shard)
+	return pointer, true
+}
+
+// promote returns the entry of key, moving it back into memory if it was
+// spilled to the index blocks. Callers must hold the shard's write lock, and
+// spill whatever it pushes over capacity with spillEvicted.
+func (idx *Index) promote(shard *shard, key string) (*RecordPointer, bool) {
+	if pointer, ok := shard.recordPointer[key]; ok {
+		shard.touch(key)
+		return pointer, true
+	}
+
+	pointer := idx.takeSpilled(key)
+	if pointer == nil {
+		return nil, false
+	}
+
+	shard.put(key, pointer)
+	return pointer, true
+}
+
+// takeSpilled removes the entry of key from the index blocks and returns it,
+// or nil if it was not spilled. Callers must hold the shard's write lock.
+func (idx *Index) takeSpilled(key string) *RecordPointer {
+	if idx.spill == nil {
+		return nil
+	}
+
+	pointer, ok, err := idx.spill.Take(key)
+	if err != nil {
+		idx.log.Errorw("Failed to read index block", "key", key, "error", err)
+		return nil
+	}
+	if !ok {
+		return nil
+	}
+	return pointer
+}
+
+// dropSpilled removes the spilled entry of key and returns it for release, or
+// nil if it was not spilled. Unless released records must be exact, its
+// offset is left out rather than read back; next, when set, is what key is
+// about to point at, and a spilled entry that may be the same record is read
+// in full. Callers must hold the shard's write lock.
+func (idx *Index) dropSpilled(key string, next *RecordPointer) *RecordPointer {
+	if idx.spill == nil || idx.exactRelease {
+		return idx.takeSpilled(key)
+	}
+
+	pointer, ok, err := idx.spill.Drop(key, next)
+	if err != nil {
+		idx.log.Errorw("Failed to read index block", "key", key, "error", err)
+		return nil
+	}
+	if !ok {
+		return nil
+	}
+	return pointer
+}
+
+// spillEvicted moves the entries above the shard's capacity to the index
+// blocks. Callers must hold the shard's write lock, so that an evicted key is
+// in one place or the other whenever the shard can be read.
+func (idx *Index) spillEvicted(shard *shard) {
+	for key, pointer := range shard.evict() {
+		if err := idx.spill.Put(key, pointer); err != nil {
+			idx.log.Errorw("Failed to write evicted entry to index block, keeping it resident", "key", key, "error", err)
+			shard.put(key, pointer)
+		}
+	}
+}
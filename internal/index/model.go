@@ -1,26 +1,118 @@
 package index
 
 import (
+	"container/list"
 	"sync"
 	"time"
+
+	"go.uber.org/zap"
 )
 
+// NoExpiration is reported as the remaining TTL of keys that never expire.
+const NoExpiration time.Duration = -1
+
 type RecordPointer struct {
 	ExpiresAt        int64
 	Offset           int64
 	SegmentTimestamp int64
+	Size             uint32
 	SegmentID        uint16
+	Partition        uint8
 }
 
 func (rp *RecordPointer) IsExpired() bool {
 	if rp.ExpiresAt == 0 {
 		return false
 	}
-	return time.Now().UnixMilli() > rp.ExpiresAt
+	return time.Now().UnixNano() > rp.ExpiresAt
 }
 
-type Index struct {
-	dataDir       string
+// IsStale reports whether the pointer has expired but is still inside the
+// given grace period.
+func (rp *RecordPointer) IsStale(grace time.Duration) bool {
+	if !rp.IsExpired() || grace <= 0 {
+		return false
+	}
+	return time.Now().UnixNano() <= rp.ExpiresAt+int64(grace)
+}
+
+func (rp *RecordPointer) TTL() time.Duration {
+	if rp.ExpiresAt == 0 {
+		return NoExpiration
+	}
+
+	remaining := time.Duration(rp.ExpiresAt - time.Now().UnixNano())
+	if remaining < 0 {
+		return 0
+	}
+	return remaining
+}
+
+// KeyLocator looks key up in the key table of the sealed segment pointer
+// points into and returns the offset of its latest record there. indexed is
+// false for segments without a key table. Without fetch the lookup is only
+// worth it if the segment is at hand, and indexed may be false for segments
+// that are not.
+type KeyLocator func(key string, pointer *RecordPointer, fetch bool) (offset int64, found, indexed bool, err error)
+
+// Release is why a key stopped pointing at a record.
+type Release uint8
+
+const (
+	// ReleaseOverwritten is a record replaced by a newer write of its key.
+	ReleaseOverwritten Release = iota
+	// ReleaseDeleted is a record whose key was deleted.
+	ReleaseDeleted
+	// ReleaseExpired is a record whose key expired.
+	ReleaseExpired
+)
+
+// sameRecord reports whether rp and other locate the same record.
+func (rp *RecordPointer) sameRecord(other *RecordPointer) bool {
+	return rp.Offset == other.Offset && rp.SegmentTimestamp == other.SegmentTimestamp &&
+		rp.SegmentID == other.SegmentID && rp.Partition == other.Partition
+}
+
+type Usage struct {
+	Keys        int
+	LiveBytes   int64
+	MemoryBytes int64
+}
+
+// shard owns a slice of the keyspace behind its own lock. In partial mode it
+// also tracks recency so it can keep at most capacity entries resident. When
+// the instance is bounded it records how each key is used, for eviction.
+type shard struct {
 	mu            sync.RWMutex
 	recordPointer map[string]*RecordPointer
+	capacity      int
+	lru           *list.List
+	elements      map[string]*list.Element
+	bounds        *bounds
+	access        map[string]*access
+}
+
+type Index struct {
+	dataDir    string
+	staleGrace time.Duration
+	log        *zap.SugaredLogger
+	shards     [shardCount]*shard
+	spill      *spillStore
+	bounds     *bounds
+	// ordered is nil unless the index keeps its keys sorted. It is changed
+	// under the shard lock of the key, so it agrees with the shards.
+	ordered *keyTree
+	// expiries is nil unless the index refreshes ahead. Like ordered, it is
+	// changed under the shard lock of the key.
+	expiries *expiryQueue
+	// onExpire, when set, is called outside shard locks, but under the
+	// caller's locks, with each key RemoveExpired removes and the pointer it
+	// held.
+	onExpire func(key string, pointer *RecordPointer)
+	// onRelease, when set, is called outside shard locks with every record a
+	// key stopped pointing at.
+	onRelease func(pointer *RecordPointer, reason Release)
+	// exactRelease is set when onRelease needs the offsets of the records
+	// it gets.
+	exactRelease bool
 }
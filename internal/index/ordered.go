@@ -0,0 +1,128 @@
+package index
+
+import "slices"
+
+// orderedBatch is how many keys an ordered walk copies out of the key tree
+// at a time, so that writers are not held up while callers handle them.
+const orderedBatch = 128
+
+// Ordered reports whether the index keeps its keys sorted, so that Ascend
+// and Descend walk only the keys they visit.
+func (idx *Index) Ordered() bool {
+	return idx.ordered != nil
+}
+
+// Ascend calls fn with the live keys from start up to but excluding end, and
+// their pointers, in ascending order until fn returns false. An empty end
+// leaves the range open. Without the ordered layout the keys are collected
+// from a snapshot of the whole index and sorted first. Keys written during
+// the walk may or may not be seen.
+func (idx *Index) Ascend(start, end string, fn func(key string, pointer *RecordPointer) bool) error {
+	if idx.ordered == nil {
+		return idx.walkSorted(start, end, false, fn)
+	}
+
+	batch := make([]string, 0, orderedBatch)
+	for cursor := start; ; {
+		batch = batch[:0]
+		idx.ordered.mu.RLock()
+		idx.ordered.ascend(cursor, func(key string) bool {
+			if end != "" && key >= end {
+				return false
+			}
+			batch = append(batch, key)
+			return len(batch) < orderedBatch
+		})
+		idx.ordered.mu.RUnlock()
+
+		for _, key := range batch {
+			if !idx.visit(key, fn) {
+				return nil
+			}
+		}
+
+		if len(batch) < orderedBatch {
+			return nil
+		}
+		// The smallest key after the last one visited.
+		cursor = batch[len(batch)-1] + "\x00"
+	}
+}
+
+// Descend is Ascend from the largest key of the range down.
+func (idx *Index) Descend(start, end string, fn func(key string, pointer *RecordPointer) bool) error {
+	if idx.ordered == nil {
+		return idx.walkSorted(start, end, true, fn)
+	}
+
+	batch := make([]string, 0, orderedBatch)
+	for cursor, bounded := end, end != ""; ; {
+		batch = batch[:0]
+		idx.ordered.mu.RLock()
+		idx.ordered.descend(cursor, bounded, func(key string) bool {
+			// The cursor is either the end of the range, which is
+			// excluded, or the last key visited.
+			if bounded && key == cursor {
+				return true
+			}
+			if key < start {
+				return false
+			}
+			batch = append(batch, key)
+			return len(batch) < orderedBatch
+		})
+		idx.ordered.mu.RUnlock()
+
+		for _, key := range batch {
+			if !idx.visit(key, fn) {
+				return nil
+			}
+		}
+
+		if len(batch) < orderedBatch {
+			return nil
+		}
+		cursor, bounded = batch[len(batch)-1], true
+	}
+}
+
+// visit calls fn with key and its pointer unless it was deleted or expired
+// since it was read from the key tree.
+func (idx *Index) visit(key string, fn func(key string, pointer *RecordPointer) bool) bool {
+	pointer, ok := idx.lookup(key)
+	if !ok || pointer.IsExpired() {
+		return true
+	}
+	return fn(key, pointer)
+}
+
+// walkSorted serves Ascend and Descend for an index without the ordered
+// layout.
+func (idx *Index) walkSorted(
+	start, end string, descending bool, fn func(key string, pointer *RecordPointer) bool,
+) error {
+	entries, err := idx.Snapshot()
+	if err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(entries))
+	for key := range entries {
+		if key >= start && (end == "" || key < end) {
+			keys = append(keys, key)
+		}
+	}
+
+	slices.Sort(keys)
+	if descending {
+		slices.Reverse(keys)
+	}
+
+	for _, key := range keys {
+		pointer := entries[key]
+		if !fn(key, &pointer) {
+			return nil
+		}
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package index
+
+import (
+	"container/list"
+	"time"
+)
+
+const shardCount = 256
+
+func newShard(capacity int, bounds *bounds) *shard {
+	s := &shard{
+		capacity:      capacity,
+		recordPointer: make(map[string]*RecordPointer),
+		bounds:        bounds,
+	}
+
+	if bounds != nil {
+		s.access = make(map[string]*access)
+	}
+
+	if capacity > 0 {
+		s.lru = list.New()
+		s.elements = make(map[string]*list.Element)
+	}
+
+	return s
+}
+
+// shardFor picks the shard owning key using FNV-1a, computed inline to avoid
+// allocating a hash.Hash per lookup.
+func (idx *Index) shardFor(key string) *shard {
+	hash := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		hash ^= uint32(key[i])
+		hash *= 16777619
+	}
+	return idx.shards[hash%shardCount]
+}
+
+// touch marks key as most recently used. Callers must hold mu.
+func (s *shard) touch(key string) {
+	if s.lru == nil {
+		return
+	}
+
+	if element, ok := s.elements[key]; ok {
+		s.lru.MoveToFront(element)
+		return
+	}
+	s.elements[key] = s.lru.PushFront(key)
+}
+
+// put stores pointer as the entry of key and counts it as a use. Callers must
+// hold mu.
+func (s *shard) put(key string, pointer *RecordPointer) {
+	if s.bounds != nil {
+		if previous, ok := s.recordPointer[key]; ok {
+			s.bounds.bytes.Add(int64(pointer.Size) - int64(previous.Size))
+		} else {
+			s.bounds.keys.Add(1)
+			s.bounds.bytes.Add(int64(pointer.Size))
+		}
+
+		a, ok := s.access[key]
+		if !ok {
+			a = &access{}
+			s.access[key] = a
+		}
+		a.record(time.Now().UnixNano())
+	}
+
+	s.recordPointer[key] = pointer
+	s.touch(key)
+}
+
+// remove drops key from memory. Callers must hold mu.
+func (s *shard) remove(key string) {
+	if s.bounds != nil {
+		if pointer, ok := s.recordPointer[key]; ok {
+			s.bounds.keys.Add(-1)
+			s.bounds.bytes.Add(-int64(pointer.Size))
+		}
+		delete(s.access, key)
+	}
+
+	delete(s.recordPointer, key)
+
+	if s.lru == nil {
+		return
+	}
+
+	if element, ok := s.elements[key]; ok {
+		s.lru.Remove(element)
+		delete(s.elements, key)
+	}
+}
+
+// evict removes the least recently used entries above capacity and returns
+// them so they can be written to disk once mu is released. Callers must hold
+// mu.
+func (s *shard) evict() map[string]*RecordPointer {
+	if s.lru == nil || s.lru.Len() <= s.capacity {
+		return nil
+	}
+
+	evicted := make(map[string]*RecordPointer)
+	for s.lru.Len() > s.capacity {
+		key := s.lru.Back().Value.(string)
+		evicted[key] = s.recordPointer[key]
+		s.remove(key)
+	}
+
+	return evicted
+}
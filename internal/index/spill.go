@@ -0,0 +1,546 @@
+package index
+
+import (
+	"bufio"
+	"encoding/binary"
+	stdErrors "errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+	"unsafe"
+
+	"go.uber.org/zap"
+
+	"github.com/iamBelugaa/kvix/pkg/filesys"
+)
+
+const (
+	spillDirName = "keydir"
+
+	// spillCompactMin is how many superseded entries an index block holds
+	// before it is rewritten without them, once they outnumber the current
+	// ones.
+	spillCompactMin = 1024
+)
+
+// spillSlotOverhead approximates the memory a spilled key still takes: its
+// slot, the string header and the map slot.
+const spillSlotOverhead = int64(unsafe.Sizeof(spillSlot{})) + int64(unsafe.Sizeof("")) + 2*int64(unsafe.Sizeof(uintptr(0)))
+
+// spillEntryHeader is the fixed-size prefix of every entry in an index block.
+// The key bytes follow it directly.
+type spillEntryHeader struct {
+	ExpiresAt        int64
+	Offset           int64
+	SegmentTimestamp int64
+	Size             uint32
+	SegmentID        uint16
+	KeyLength        uint16
+	Partition        uint8
+}
+
+var spillEntryHeaderSize = int64(binary.Size(spillEntryHeader{}))
+
+// locatedEntry is the offset of slots whose entry is not written to an index
+// block: the key table of their sealed segment holds it instead.
+const locatedEntry = -1
+
+// spillBlock is the index block of one segment: the entries of evicted keys
+// whose records live in it, appended as they are evicted. Its file is only
+// created once an entry has to be written.
+type spillBlock struct {
+	name             string
+	partition        uint8
+	segmentID        uint16
+	segmentTimestamp int64
+	file             filesys.File
+	size             int64
+	// live counts the entries still current for their key, and dead the
+	// ones superseded since, which compaction drops. located counts the
+	// spilled keys of the segment found through its key table.
+	live    int
+	dead    int
+	located int
+}
+
+// spillSlot locates the current entry of a spilled key. The expiry and size
+// are kept in memory as well, so that expiry sweeps and usage do not read the
+// blocks.
+type spillSlot struct {
+	block     *spillBlock
+	offset    int64
+	expiresAt int64
+	size      uint32
+}
+
+// pointer rebuilds the entry of the slot with the given record offset.
+func (slot spillSlot) pointer(offset int64) *RecordPointer {
+	return &RecordPointer{
+		ExpiresAt:        slot.expiresAt,
+		Offset:           offset,
+		SegmentTimestamp: slot.block.segmentTimestamp,
+		Size:             slot.size,
+		SegmentID:        slot.block.segmentID,
+		Partition:        slot.block.partition,
+	}
+}
+
+// spillStore keeps index entries evicted from memory in per-segment index
+// blocks on disk, and where the current entry of each key is in memory, so a
+// lookup reads at most one entry. An entry is superseded when its key is
+// spilled again or taken back into memory, and a block mostly made of
+// superseded entries is rewritten without them.
+//
+// With a locator, keys whose record the key table of their sealed segment
+// already leads to are not written at all, and are looked up in that table.
+type spillStore struct {
+	mu     sync.Mutex
+	log    *zap.SugaredLogger
+	fsys   filesys.FileSystem
+	dir    string
+	locate KeyLocator
+	blocks map[string]*spillBlock
+	slots  map[string]spillSlot
+}
+
+func newSpillStore(log *zap.SugaredLogger, fsys filesys.FileSystem, dataDir string) (*spillStore, error) {
+	dir := filepath.Join(dataDir, spillDirName)
+
+	// The in-memory index is rebuilt from scratch on every start, so blocks
+	// left behind by a previous run no longer describe it.
+	if err := filesys.RemoveAll(fsys, dir); err != nil {
+		return nil, err
+	}
+
+	if err := filesys.CreateDir(fsys, dir, 0755, true); err != nil {
+		return nil, err
+	}
+
+	return &spillStore{
+		log:    log,
+		fsys:   fsys,
+		dir:    dir,
+		blocks: make(map[string]*spillBlock),
+		slots:  make(map[string]spillSlot),
+	}, nil
+}
+
+// Put writes the entry of key to the index block of its segment, superseding
+// any entry it had.
+func (ss *spillStore) Put(key string, pointer *RecordPointer) error {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	block := ss.blockFor(pointer)
+	slot := spillSlot{block: block, offset: locatedEntry, expiresAt: pointer.ExpiresAt, size: pointer.Size}
+
+	if ss.locatable(key, pointer) {
+		block.located++
+	} else {
+		if block.file == nil {
+			file, err := ss.fsys.OpenFile(filepath.Join(ss.dir, block.name), os.O_CREATE|os.O_RDWR|os.O_TRUNC|os.O_APPEND, 0644)
+			if err != nil {
+				ss.dropIfUnused(block)
+				return err
+			}
+			block.file = file
+		}
+
+		offset := block.size
+		written, err := writeEntry(block.file, key, pointer)
+		block.size += int64(written)
+		if err != nil {
+			ss.dropIfUnused(block)
+			return err
+		}
+
+		slot.offset = offset
+		block.live++
+	}
+
+	// The new slot is counted first, so that superseding an entry of the
+	// same block does not remove it.
+	if previous, ok := ss.slots[key]; ok {
+		ss.supersede(previous)
+	}
+	ss.slots[key] = slot
+	return nil
+}
+
+// blockFor returns the index block of the segment pointer points into,
+// without creating its file. Callers must hold mu.
+func (ss *spillStore) blockFor(pointer *RecordPointer) *spillBlock {
+	name := fmt.Sprintf("%03d_%05d_%d.keys", pointer.Partition, pointer.SegmentID, pointer.SegmentTimestamp)
+	block, ok := ss.blocks[name]
+	if !ok {
+		block = &spillBlock{
+			name:             name,
+			partition:        pointer.Partition,
+			segmentID:        pointer.SegmentID,
+			segmentTimestamp: pointer.SegmentTimestamp,
+		}
+		ss.blocks[name] = block
+	}
+	return block
+}
+
+// locatable reports whether the key table of pointer's segment leads to the
+// very record pointer does. A deduplicated key may share the record of
+// another key, and is written to the index block instead.
+func (ss *spillStore) locatable(key string, pointer *RecordPointer) bool {
+	if ss.locate == nil {
+		return false
+	}
+
+	offset, found, indexed, err := ss.locate(key, pointer, false)
+	return err == nil && indexed && found && offset == pointer.Offset
+}
+
+// find returns the entry of a spilled key, reading it from its index block or
+// looking its offset up in the key table of its segment. Callers must hold
+// mu.
+func (ss *spillStore) find(key string, slot spillSlot) (*RecordPointer, error) {
+	if slot.offset != locatedEntry {
+		return readEntry(slot.block.file, slot.offset, key)
+	}
+
+	pointer := slot.pointer(0)
+	offset, found, indexed, err := ss.locate(key, pointer, true)
+	if err != nil {
+		return nil, err
+	}
+	if !indexed || !found {
+		return nil, fmt.Errorf("key %q is missing from the key table of segment %d", key, pointer.SegmentID)
+	}
+
+	pointer.Offset = offset
+	return pointer, nil
+}
+
+// Take returns the spilled entry of key and forgets it, for the caller to
+// hold in memory or drop.
+func (ss *spillStore) Take(key string) (*RecordPointer, bool, error) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	slot, ok := ss.slots[key]
+	if !ok {
+		return nil, false, nil
+	}
+
+	pointer, err := ss.find(key, slot)
+	if err != nil {
+		return nil, false, err
+	}
+
+	delete(ss.slots, key)
+	ss.supersede(slot)
+	return pointer, true, nil
+}
+
+// Drop forgets the spilled entry of key and returns it without reading it
+// back: all but its offset is kept in memory, and Offset is -1. Only when next
+// points into the same segment, and may be the same record, is the entry read
+// in full.
+func (ss *spillStore) Drop(key string, next *RecordPointer) (*RecordPointer, bool, error) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	slot, ok := ss.slots[key]
+	if !ok {
+		return nil, false, nil
+	}
+
+	pointer := slot.pointer(locatedEntry)
+	if next != nil && next.Partition == pointer.Partition && next.SegmentID == pointer.SegmentID &&
+		next.SegmentTimestamp == pointer.SegmentTimestamp {
+		var err error
+		if pointer, err = ss.find(key, slot); err != nil {
+			return nil, false, err
+		}
+	}
+
+	delete(ss.slots, key)
+	ss.supersede(slot)
+	return pointer, true, nil
+}
+
+// Expired returns the spilled keys that expired more than grace ago.
+func (ss *spillStore) Expired(grace time.Duration) []string {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	var keys []string
+	now := time.Now().UnixNano()
+	for key, slot := range ss.slots {
+		if slot.expiresAt != 0 && now > slot.expiresAt+int64(max(grace, 0)) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// Usage counts the live spilled keys, the bytes of their records and the
+// memory their slots take.
+func (ss *spillStore) Usage() Usage {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	var usage Usage
+	now := time.Now().UnixNano()
+	for key, slot := range ss.slots {
+		if slot.expiresAt != 0 && now > slot.expiresAt {
+			continue
+		}
+
+		usage.Keys++
+		usage.LiveBytes += int64(slot.size)
+		usage.MemoryBytes += spillSlotOverhead + int64(len(key))
+	}
+	return usage
+}
+
+// All returns the current entry of every spilled key, reading each block once
+// from start to end and looking the rest up in key tables.
+func (ss *spillStore) All() (map[string]RecordPointer, error) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	entries := make(map[string]RecordPointer, len(ss.slots))
+	for key, slot := range ss.slots {
+		if slot.offset != locatedEntry {
+			continue
+		}
+
+		pointer, err := ss.find(key, slot)
+		if err != nil {
+			return nil, err
+		}
+		entries[key] = *pointer
+	}
+
+	for _, block := range ss.blocks {
+		if block.file == nil {
+			continue
+		}
+
+		err := walkBlock(block, func(key []byte, offset int64, header spillEntryHeader) error {
+			if slot, ok := ss.slots[string(key)]; ok && slot.block == block && slot.offset == offset {
+				entries[string(key)] = header.pointer()
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return entries, nil
+}
+
+// supersede counts the entry at slot as no longer current, removing the file
+// of its block once nothing in it is and compacting it once it is mostly
+// superseded. Callers must hold mu.
+func (ss *spillStore) supersede(slot spillSlot) {
+	block := slot.block
+	if slot.offset == locatedEntry {
+		block.located--
+		ss.dropIfUnused(block)
+		return
+	}
+
+	block.live--
+	block.dead++
+
+	if block.live == 0 {
+		ss.removeFile(block)
+		ss.dropIfUnused(block)
+		return
+	}
+
+	if block.dead >= spillCompactMin && block.dead > block.live {
+		if err := ss.compact(block); err != nil {
+			ss.log.Warnw("Failed to compact index block, keeping it as is", "block", block.name, "error", err)
+		}
+	}
+}
+
+// dropIfUnused forgets block once no spilled key is in its segment. Callers
+// must hold mu.
+func (ss *spillStore) dropIfUnused(block *spillBlock) {
+	if block.live > 0 || block.located > 0 {
+		return
+	}
+
+	ss.removeFile(block)
+	delete(ss.blocks, block.name)
+}
+
+// removeFile removes the file of a block none of whose entries are current.
+// Callers must hold mu.
+func (ss *spillStore) removeFile(block *spillBlock) {
+	if block.file == nil {
+		return
+	}
+
+	block.file.Close()
+	if err := ss.fsys.Remove(filepath.Join(ss.dir, block.name)); err != nil {
+		ss.log.Warnw("Failed to remove empty index block", "block", block.name, "error", err)
+	}
+
+	block.file = nil
+	block.size = 0
+	block.dead = 0
+}
+
+// compact rewrites block with only its current entries, through a temporary
+// file renamed over it. Callers must hold mu.
+func (ss *spillStore) compact(block *spillBlock) error {
+	path := filepath.Join(ss.dir, block.name)
+	tmpPath := path + ".tmp"
+
+	file, err := ss.fsys.OpenFile(tmpPath, os.O_CREATE|os.O_RDWR|os.O_TRUNC|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	var size int64
+	moved := make(map[string]int64, block.live)
+	err = walkBlock(block, func(key []byte, offset int64, header spillEntryHeader) error {
+		slot, ok := ss.slots[string(key)]
+		if !ok || slot.block != block || slot.offset != offset {
+			return nil
+		}
+
+		pointer := header.pointer()
+		written, err := writeEntry(file, string(key), &pointer)
+		moved[string(key)] = size
+		size += int64(written)
+		return err
+	})
+	if err == nil {
+		err = ss.fsys.Rename(tmpPath, path)
+	}
+	if err != nil {
+		file.Close()
+		ss.fsys.Remove(tmpPath)
+		return err
+	}
+
+	for key, offset := range moved {
+		slot := ss.slots[key]
+		slot.offset = offset
+		ss.slots[key] = slot
+	}
+
+	block.file.Close()
+	block.file = file
+	block.size = size
+	block.dead = 0
+	return nil
+}
+
+func (header spillEntryHeader) pointer() RecordPointer {
+	return RecordPointer{
+		ExpiresAt:        header.ExpiresAt,
+		Offset:           header.Offset,
+		SegmentTimestamp: header.SegmentTimestamp,
+		Size:             header.Size,
+		SegmentID:        header.SegmentID,
+		Partition:        header.Partition,
+	}
+}
+
+func writeEntry(w io.Writer, key string, pointer *RecordPointer) (int, error) {
+	header := spillEntryHeader{
+		ExpiresAt:        pointer.ExpiresAt,
+		Offset:           pointer.Offset,
+		SegmentTimestamp: pointer.SegmentTimestamp,
+		Size:             pointer.Size,
+		SegmentID:        pointer.SegmentID,
+		KeyLength:        uint16(len(key)),
+		Partition:        pointer.Partition,
+	}
+
+	buffer := make([]byte, 0, spillEntryHeaderSize+int64(len(key)))
+	buffer, err := binary.Append(buffer, binary.LittleEndian, header)
+	if err != nil {
+		return 0, err
+	}
+
+	return w.Write(append(buffer, key...))
+}
+
+// readEntry reads the entry at offset of an index block, which must belong to
+// key.
+func readEntry(r io.ReaderAt, offset int64, key string) (*RecordPointer, error) {
+	buffer := make([]byte, spillEntryHeaderSize+int64(len(key)))
+	if _, err := r.ReadAt(buffer, offset); err != nil {
+		return nil, err
+	}
+
+	var header spillEntryHeader
+	if _, err := binary.Decode(buffer, binary.LittleEndian, &header); err != nil {
+		return nil, err
+	}
+
+	if int(header.KeyLength) != len(key) || string(buffer[spillEntryHeaderSize:]) != key {
+		return nil, fmt.Errorf("index block entry at offset %d does not belong to key %q", offset, key)
+	}
+
+	pointer := header.pointer()
+	return &pointer, nil
+}
+
+// walkBlock calls fn for every entry of an index block with its offset, until
+// fn returns an error. The key slice is only valid for the duration of the
+// call.
+func walkBlock(block *spillBlock, fn func(key []byte, offset int64, header spillEntryHeader) error) error {
+	reader := bufio.NewReader(io.NewSectionReader(block.file, 0, block.size))
+	var keyBuffer []byte
+
+	for offset := int64(0); ; {
+		var header spillEntryHeader
+		if err := binary.Read(reader, binary.LittleEndian, &header); err != nil {
+			if stdErrors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+
+		if cap(keyBuffer) < int(header.KeyLength) {
+			keyBuffer = make([]byte, header.KeyLength)
+		}
+
+		keyBuffer = keyBuffer[:header.KeyLength]
+		if _, err := io.ReadFull(reader, keyBuffer); err != nil {
+			return err
+		}
+
+		if err := fn(keyBuffer, offset, header); err != nil {
+			return err
+		}
+		offset += spillEntryHeaderSize + int64(header.KeyLength)
+	}
+}
+
+func (ss *spillStore) Close() error {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	var closeErrors []error
+	for name, block := range ss.blocks {
+		if block.file != nil {
+			if err := block.file.Close(); err != nil {
+				closeErrors = append(closeErrors, err)
+			}
+		}
+		delete(ss.blocks, name)
+	}
+	clear(ss.slots)
+
+	return stdErrors.Join(closeErrors...)
+}
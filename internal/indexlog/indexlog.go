@@ -0,0 +1,364 @@
+package indexlog
+
+import (
+	"bufio"
+	"encoding/binary"
+	stdErrors "errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/iamBelugaa/kvix/internal/index"
+	"github.com/iamBelugaa/kvix/pkg/errors"
+	"github.com/iamBelugaa/kvix/pkg/filesys"
+)
+
+// Replay calls fn, in the order they were logged, with every mutation in the
+// log under dataDir on fsys: the key with its record pointer, or with nil for a
+// deletion. A checkpoint interrupted by a crash leaves its rotated file
+// behind, which is replayed first. A torn entry ends its file. The files are
+// read through wrap, which may count the bytes read against Size. Replay
+// returns how many entries it read.
+func Replay(
+	fsys filesys.FileSystem, dataDir string, wrap func(io.Reader) io.Reader,
+	fn func(key string, pointer *index.RecordPointer) error,
+) (int, error) {
+	path := filepath.Join(dataDir, FileName)
+
+	var replayed int
+	for _, name := range []string{path + rotatedSuffix, path} {
+		count, err := scanFile(fsys, name, wrap, fn)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return replayed, errors.NewStorageError(err, errors.ErrRecordDeserialization, "Failed to replay index log").
+				WithPath(name)
+		}
+		replayed += count
+	}
+
+	return replayed, nil
+}
+
+// Size returns the bytes Replay would read under dataDir on fsys.
+func Size(fsys filesys.FileSystem, dataDir string) int64 {
+	path := filepath.Join(dataDir, FileName)
+
+	var size int64
+	for _, name := range []string{path + rotatedSuffix, path} {
+		if info, err := fsys.Stat(name); err == nil {
+			size += info.Size()
+		}
+	}
+	return size
+}
+
+// Open starts an empty log under dataDir on fsys, discarding what an earlier
+// one held, so it must only be opened once the index covers that. With
+// syncEach every append is fsynced before it returns.
+func Open(fsys filesys.FileSystem, dataDir string, syncEach bool) (*Log, error) {
+	l := &Log{fsys: fsys, path: filepath.Join(dataDir, FileName), syncEach: syncEach}
+
+	if err := fsys.Remove(l.path + rotatedSuffix); err != nil && !os.IsNotExist(err) {
+		return nil, errors.NewStorageError(err, errors.ErrIOGeneral, "Failed to remove rotated index log").
+			WithPath(l.path + rotatedSuffix)
+	}
+
+	file, err := l.fsys.OpenFile(l.path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, errors.NewStorageError(err, errors.ErrIOGeneral, "Failed to create index log").
+			WithPath(l.path)
+	}
+
+	l.file = file
+	return l, nil
+}
+
+// SetSyncEach changes whether appends are fsynced before they return.
+func (l *Log) SetSyncEach(syncEach bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.syncEach = syncEach
+}
+
+// Append logs that key now points at pointer, or was deleted when pointer is
+// nil. With syncEach the entry is fsynced before Append returns, outside the
+// lock other appends take, so that appends made meanwhile share the fsync.
+func (l *Log) Append(key string, pointer *index.RecordPointer) error {
+	end, syncEach, err := l.write(key, pointer)
+	if err != nil || !syncEach {
+		return err
+	}
+	return l.syncTo(end)
+}
+
+// AppendUnsynced is Append without the fsync, for callers that log a batch
+// and Sync once at its end.
+func (l *Log) AppendUnsynced(key string, pointer *index.RecordPointer) error {
+	_, _, err := l.write(key, pointer)
+	return err
+}
+
+// write appends the entry for key and returns where it ends, counted as
+// written counts it, and whether appends are to be synced.
+func (l *Log) write(key string, pointer *index.RecordPointer) (int64, bool, error) {
+	encoded := encode(key, pointer)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil {
+		return 0, false, errors.NewStorageError(os.ErrClosed, errors.ErrIOWriteFailed, "Failed to append to index log").
+			WithPath(l.path)
+	}
+
+	if _, err := l.file.Write(encoded); err != nil {
+		return 0, false, errors.NewStorageError(err, errors.ErrIOWriteFailed, "Failed to append to index log").
+			WithPath(l.path)
+	}
+	l.size += int64(len(encoded))
+	l.written += int64(len(encoded))
+	return l.written, l.syncEach, nil
+}
+
+// syncTo fsyncs the log unless everything up to end, counted as written
+// counts it, is already on disk.
+func (l *Log) syncTo(end int64) error {
+	l.syncMu.Lock()
+	defer l.syncMu.Unlock()
+
+	if l.synced >= end {
+		return nil
+	}
+
+	l.mu.Lock()
+	file, written := l.file, l.written
+	l.mu.Unlock()
+
+	if file == nil {
+		return errors.NewStorageError(os.ErrClosed, errors.ErrIOSyncFailed, "Failed to sync index log").
+			WithPath(l.path)
+	}
+
+	if err := file.Sync(); err != nil {
+		return errors.NewStorageError(err, errors.ErrIOSyncFailed, "Failed to sync index log").
+			WithPath(l.path)
+	}
+	l.synced = written
+	return nil
+}
+
+// Size returns the bytes logged since the log was opened or last rotated.
+func (l *Log) Size() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.size
+}
+
+// Rotate begins a checkpoint: the entries logged so far are moved aside and
+// the log starts over, so the index can be written out while appends go on.
+// Callers must make sure nothing reaches the index between Rotate and the
+// snapshot they persist without being appended after the rotation. Entries
+// left aside by an unfinished checkpoint are kept ahead of the new ones.
+func (l *Log) Rotate() error {
+	l.syncMu.Lock()
+	defer l.syncMu.Unlock()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil {
+		return errors.NewStorageError(os.ErrClosed, errors.ErrIOGeneral, "Failed to rotate index log").
+			WithPath(l.path)
+	}
+
+	if err := l.file.Sync(); err != nil {
+		return errors.NewStorageError(err, errors.ErrIOSyncFailed, "Failed to sync index log").
+			WithPath(l.path)
+	}
+	l.synced = l.written
+
+	if err := l.file.Close(); err != nil {
+		return errors.NewStorageError(err, errors.ErrIOCloseFailed, "Failed to close index log").
+			WithPath(l.path)
+	}
+	l.file = nil
+
+	rotated := l.path + rotatedSuffix
+	if _, err := l.fsys.Stat(rotated); err == nil {
+		if err := appendFile(l.fsys, rotated, l.path); err != nil {
+			return errors.NewStorageError(err, errors.ErrIOWriteFailed, "Failed to rotate index log").
+				WithPath(rotated)
+		}
+	} else if err := l.fsys.Rename(l.path, rotated); err != nil {
+		return errors.NewStorageError(err, errors.ErrIOGeneral, "Failed to rotate index log").
+			WithPath(l.path)
+	}
+
+	file, err := l.fsys.OpenFile(l.path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return errors.NewStorageError(err, errors.ErrIOGeneral, "Failed to create index log").
+			WithPath(l.path)
+	}
+
+	l.file = file
+	l.size = 0
+	return nil
+}
+
+// Checkpointed ends a checkpoint once the index hint covering the rotated
+// entries is in place, removing them.
+func (l *Log) Checkpointed() error {
+	rotated := l.path + rotatedSuffix
+	if err := l.fsys.Remove(rotated); err != nil && !os.IsNotExist(err) {
+		return errors.NewStorageError(err, errors.ErrIOGeneral, "Failed to remove rotated index log").
+			WithPath(rotated)
+	}
+	return nil
+}
+
+// Sync fsyncs the log.
+func (l *Log) Sync() error {
+	l.mu.Lock()
+	end := l.written
+	l.mu.Unlock()
+
+	return l.syncTo(end)
+}
+
+func (l *Log) Close() error {
+	l.syncMu.Lock()
+	defer l.syncMu.Unlock()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil {
+		return nil
+	}
+
+	file := l.file
+	l.file = nil
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return errors.NewStorageError(err, errors.ErrIOSyncFailed, "Failed to sync index log").
+			WithPath(l.path)
+	}
+	l.synced = l.written
+
+	if err := file.Close(); err != nil {
+		return errors.NewStorageError(err, errors.ErrIOCloseFailed, "Failed to close index log").
+			WithPath(l.path)
+	}
+	return nil
+}
+
+// appendFile appends the contents of source to target and fsyncs it.
+func appendFile(fsys filesys.FileSystem, target, source string) error {
+	in, err := fsys.OpenFile(source, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := fsys.OpenFile(target, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func encode(key string, pointer *index.RecordPointer) []byte {
+	header := entryHeader{KeyLength: uint16(len(key)), Kind: kindDelete}
+	if pointer != nil {
+		header.Kind = kindSet
+		header.Offset = pointer.Offset
+		header.SegmentTimestamp = pointer.SegmentTimestamp
+		header.ExpiresAt = pointer.ExpiresAt
+		header.Size = pointer.Size
+		header.SegmentID = pointer.SegmentID
+		header.Partition = pointer.Partition
+	}
+
+	buffer := make([]byte, 0, entryHeaderSize+int64(len(key)))
+	buffer, _ = binary.Append(buffer, binary.LittleEndian, header)
+	buffer = append(buffer, key...)
+
+	binary.LittleEndian.PutUint32(buffer, crc32.ChecksumIEEE(buffer[4:]))
+	return buffer
+}
+
+// errTorn reports an entry cut short or failing its checksum.
+var errTorn = stdErrors.New("index log entry is torn or corrupted")
+
+// scanFile calls fn with the entries of path and returns how many it read. A
+// torn entry ends the scan: nothing after it was acknowledged.
+func scanFile(
+	fsys filesys.FileSystem, path string, wrap func(io.Reader) io.Reader,
+	fn func(key string, pointer *index.RecordPointer) error,
+) (int, error) {
+	file, err := fsys.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(wrap(file))
+	var count int
+	for {
+		var header entryHeader
+		if err := binary.Read(reader, binary.LittleEndian, &header); err != nil {
+			if err == io.EOF {
+				return count, nil
+			}
+			return count, scanEnd(err)
+		}
+
+		key := make([]byte, header.KeyLength)
+		if _, err := io.ReadFull(reader, key); err != nil {
+			return count, scanEnd(err)
+		}
+
+		var pointer *index.RecordPointer
+		if header.Kind == kindSet {
+			pointer = &index.RecordPointer{
+				ExpiresAt:        header.ExpiresAt,
+				Offset:           header.Offset,
+				SegmentTimestamp: header.SegmentTimestamp,
+				Size:             header.Size,
+				SegmentID:        header.SegmentID,
+				Partition:        header.Partition,
+			}
+		}
+
+		if binary.LittleEndian.Uint32(encode(string(key), pointer)) != header.Checksum ||
+			(header.Kind != kindSet && header.Kind != kindDelete) {
+			return count, scanEnd(errTorn)
+		}
+
+		if err := fn(string(key), pointer); err != nil {
+			return count, err
+		}
+		count++
+	}
+}
+
+// scanEnd turns a torn tail into the end of the log; other failures are
+// passed on.
+func scanEnd(err error) error {
+	if err == errTorn || stdErrors.Is(err, io.ErrUnexpectedEOF) || err == io.EOF {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,60 @@
+package indexlog
+
+import (
+	"encoding/binary"
+	"sync"
+
+	"github.com/iamBelugaa/kvix/pkg/filesys"
+)
+
+const (
+	// FileName is the log's file in the data directory.
+	FileName = "index.wal"
+
+	// rotatedSuffix names the file a checkpoint moves the log to until the
+	// index hint covering it is in place.
+	rotatedSuffix = ".old"
+)
+
+const (
+	kindSet uint8 = iota + 1
+	kindDelete
+)
+
+// entryHeader is the fixed-size prefix of every entry. The key follows it
+// directly; Checksum covers the rest of the header and the key.
+type entryHeader struct {
+	Checksum         uint32
+	Offset           int64
+	SegmentTimestamp int64
+	ExpiresAt        int64
+	Size             uint32
+	SegmentID        uint16
+	KeyLength        uint16
+	Partition        uint8
+	Kind             uint8
+}
+
+var entryHeaderSize = int64(binary.Size(entryHeader{}))
+
+// Log is the write-ahead log of index mutations. Every change to the keydir
+// is appended as the key with its new record pointer, or as a tombstone, so
+// replaying the log over the last index hint recovers the keydir a crash
+// left behind.
+type Log struct {
+	mu       sync.Mutex
+	fsys     filesys.FileSystem
+	path     string
+	file     filesys.File
+	size     int64
+	syncEach bool
+
+	// written counts every byte appended since Open, across rotations, and
+	// is guarded by mu. synced is how much of it is known to be on disk and
+	// is guarded by syncMu, which is taken before mu when both are held.
+	// Appenders waiting on syncMu find their entries covered by an fsync
+	// another one issued, so concurrent appends share fsyncs.
+	written int64
+	syncMu  sync.Mutex
+	synced  int64
+}
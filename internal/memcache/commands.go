@@ -0,0 +1,264 @@
+package memcache
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/iamBelugaa/kvix/pkg/errors"
+	"github.com/iamBelugaa/kvix/pkg/kvix"
+	"github.com/iamBelugaa/kvix/pkg/options"
+)
+
+// Version is reported by the version command. Clients only use it for
+// logging, so it names kvix rather than impersonating a memcached release.
+const Version = "kvix-memcache-1"
+
+// dispatch runs a single command and reports whether the connection should
+// be closed. A non-nil error means the stream can no longer be parsed.
+func (s *Server) dispatch(ctx context.Context, r *bufio.Reader, w *bufio.Writer, fields []string) (bool, error) {
+	switch fields[0] {
+	case "get":
+		s.get(ctx, w, fields[1:])
+	case "set":
+		return false, s.set(ctx, r, w, fields[1:])
+	case "delete":
+		s.delete(ctx, w, fields[1:])
+	case "touch":
+		s.touch(ctx, w, fields[1:])
+	case "version":
+		w.WriteString("VERSION " + Version + "\r\n")
+	case "quit":
+		return true, nil
+	default:
+		w.WriteString("ERROR\r\n")
+	}
+
+	return false, nil
+}
+
+func (s *Server) get(ctx context.Context, w *bufio.Writer, keys []string) {
+	if len(keys) == 0 {
+		w.WriteString("ERROR\r\n")
+		return
+	}
+
+	for _, key := range keys {
+		if !validKey(key) {
+			w.WriteString("CLIENT_ERROR bad command line format\r\n")
+			return
+		}
+	}
+
+	for _, key := range keys {
+		record, err := s.instance.Get(ctx, []byte(key))
+		if err != nil {
+			if errors.GetErrorCode(err) == errors.ErrIndexKeyNotFound {
+				continue
+			}
+			writeServerError(w, err)
+			return
+		}
+
+		flags := "0"
+		if record.Metadata != nil {
+			if stored, ok := record.Metadata.Tags[flagsTag]; ok {
+				flags = stored
+			}
+		}
+
+		w.WriteString("VALUE " + key + " " + flags + " " + strconv.Itoa(len(record.Value)) + "\r\n")
+		w.Write(record.Value)
+		w.WriteString("\r\n")
+	}
+
+	w.WriteString("END\r\n")
+}
+
+// set handles `set <key> <flags> <exptime> <bytes> [noreply]` followed by a
+// data block. The data block is always consumed, even when the command is
+// rejected, so the connection stays in sync.
+func (s *Server) set(ctx context.Context, r *bufio.Reader, w *bufio.Writer, args []string) error {
+	noreply := len(args) == 5 && args[4] == "noreply"
+	if len(args) != 4 && !noreply {
+		w.WriteString("ERROR\r\n")
+		return nil
+	}
+
+	size, err := strconv.Atoi(args[3])
+	if err != nil || size < 0 {
+		w.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return nil
+	}
+
+	if size > int(options.MaxValueSize) {
+		if _, err := io.CopyN(io.Discard, r, int64(size)+2); err != nil {
+			return err
+		}
+		w.WriteString("SERVER_ERROR object too large for cache\r\n")
+		return nil
+	}
+
+	data := make([]byte, size+2)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return err
+	}
+
+	if data[size] != '\r' || data[size+1] != '\n' {
+		w.WriteString("CLIENT_ERROR bad data chunk\r\n")
+		return nil
+	}
+	data = data[:size]
+
+	reply := func(msg string) {
+		if !noreply {
+			w.WriteString(msg)
+		}
+	}
+
+	if !validKey(args[0]) {
+		reply("CLIENT_ERROR bad command line format\r\n")
+		return nil
+	}
+
+	flags, err := strconv.ParseUint(args[1], 10, 32)
+	if err != nil {
+		reply("CLIENT_ERROR bad command line format\r\n")
+		return nil
+	}
+
+	ttl, expired, ok := parseExptime(args[2])
+	if !ok {
+		reply("CLIENT_ERROR bad command line format\r\n")
+		return nil
+	}
+
+	key := []byte(args[0])
+	switch {
+	case expired:
+		// memcached stores the item and expires it at once; dropping any
+		// previous value has the same visible effect.
+		_, err = s.instance.Delete(ctx, key)
+	case flags != 0:
+		metadata := kvix.Metadata{Tags: map[string]string{flagsTag: strconv.FormatUint(flags, 10)}}
+		err = s.instance.SetWithMetadata(ctx, key, data, metadata, ttl)
+	case ttl > 0:
+		err = s.instance.SetX(ctx, key, data, ttl)
+	default:
+		err = s.instance.Set(ctx, key, data)
+	}
+
+	if err != nil {
+		if !noreply {
+			writeServerError(w, err)
+		}
+		return nil
+	}
+
+	reply("STORED\r\n")
+	return nil
+}
+
+func (s *Server) delete(ctx context.Context, w *bufio.Writer, args []string) {
+	noreply := len(args) == 2 && args[1] == "noreply"
+	if len(args) != 1 && !noreply {
+		w.WriteString("ERROR\r\n")
+		return
+	}
+
+	if !validKey(args[0]) {
+		w.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return
+	}
+
+	deleted, err := s.instance.Delete(ctx, []byte(args[0]))
+	if noreply {
+		return
+	}
+
+	switch {
+	case err != nil:
+		writeServerError(w, err)
+	case deleted:
+		w.WriteString("DELETED\r\n")
+	default:
+		w.WriteString("NOT_FOUND\r\n")
+	}
+}
+
+func (s *Server) touch(ctx context.Context, w *bufio.Writer, args []string) {
+	noreply := len(args) == 3 && args[2] == "noreply"
+	if len(args) != 2 && !noreply {
+		w.WriteString("ERROR\r\n")
+		return
+	}
+
+	ttl, expired, ok := parseExptime(args[1])
+	if !validKey(args[0]) || !ok {
+		w.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return
+	}
+
+	key := []byte(args[0])
+
+	var touched bool
+	var err error
+	switch {
+	case expired:
+		touched, err = s.instance.Delete(ctx, key)
+	case ttl > 0:
+		touched, err = s.instance.Touch(ctx, key, ttl)
+	default:
+		touched, err = s.instance.Persist(ctx, key)
+	}
+
+	if noreply {
+		return
+	}
+
+	switch {
+	case err != nil:
+		writeServerError(w, err)
+	case touched:
+		w.WriteString("TOUCHED\r\n")
+	default:
+		w.WriteString("NOT_FOUND\r\n")
+	}
+}
+
+// parseExptime interprets a memcached exptime: 0 never expires, values up to
+// 30 days are relative seconds, larger values are absolute Unix timestamps and
+// negative values expire the item immediately.
+func parseExptime(arg string) (ttl time.Duration, expired bool, ok bool) {
+	exptime, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		return 0, false, false
+	}
+
+	switch {
+	case exptime < 0:
+		return 0, true, true
+	case exptime == 0:
+		return 0, false, true
+	case time.Duration(exptime)*time.Second <= relativeExptimeLimit:
+		return time.Duration(exptime) * time.Second, false, true
+	}
+
+	ttl = time.Until(time.Unix(exptime, 0))
+	return ttl, ttl <= 0, true
+}
+
+func validKey(key string) bool {
+	if len(key) == 0 || len(key) > MaxKeyLength {
+		return false
+	}
+
+	return !strings.ContainsFunc(key, func(r rune) bool { return r <= ' ' || r == 0x7f })
+}
+
+func writeServerError(w *bufio.Writer, err error) {
+	w.WriteString("SERVER_ERROR " + strings.ReplaceAll(err.Error(), "\r\n", " ") + "\r\n")
+}
@@ -0,0 +1,42 @@
+package memcache
+
+import (
+	stdErrors "errors"
+	"net"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/iamBelugaa/kvix/pkg/kvix"
+)
+
+const (
+	// MaxKeyLength is the memcached limit on key length.
+	MaxKeyLength = 250
+	// MaxLineLength bounds a command line, which at most carries a handful of
+	// keys for get.
+	MaxLineLength = 64 << 10
+	// relativeExptimeLimit is the largest exptime memcached treats as an offset
+	// from now; anything larger is an absolute Unix timestamp.
+	relativeExptimeLimit = 30 * 24 * time.Hour
+	// flagsTag is the metadata tag non-zero item flags are stored under.
+	// Items stored with flags of 0 carry no metadata.
+	flagsTag = "memcache.flags"
+)
+
+var ErrServerClosed = stdErrors.New("memcache: server closed")
+
+// Server speaks the memcached text protocol: get, set, delete and touch with
+// exptime, plus version and quit. Non-zero item flags are kept in the
+// record's metadata and reported back by get.
+type Server struct {
+	instance *kvix.Instance
+	log      *zap.SugaredLogger
+
+	mu       sync.Mutex
+	closed   bool
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	wg       sync.WaitGroup
+}
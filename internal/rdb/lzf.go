@@ -0,0 +1,52 @@
+package rdb
+
+// decompressLZF expands an LZF block into exactly length bytes, which is how
+// Redis stores compressed strings.
+func decompressLZF(in []byte, length int) ([]byte, error) {
+	out := make([]byte, 0, length)
+
+	for i := 0; i < len(in); {
+		ctrl := int(in[i])
+		i++
+
+		if ctrl < 1<<5 {
+			literal := ctrl + 1
+			if i+literal > len(in) {
+				return nil, ErrCorrupt
+			}
+			out = append(out, in[i:i+literal]...)
+			i += literal
+			continue
+		}
+
+		size := ctrl >> 5
+		if size == 7 {
+			if i >= len(in) {
+				return nil, ErrCorrupt
+			}
+			size += int(in[i])
+			i++
+		}
+
+		if i >= len(in) {
+			return nil, ErrCorrupt
+		}
+
+		ref := len(out) - ((ctrl & 0x1f) << 8) - int(in[i]) - 1
+		i++
+		if ref < 0 {
+			return nil, ErrCorrupt
+		}
+
+		// Back references may overlap the bytes they produce, so copy one at
+		// a time.
+		for n := 0; n < size+2; n++ {
+			out = append(out, out[ref+n])
+		}
+	}
+
+	if len(out) != length {
+		return nil, ErrCorrupt
+	}
+	return out, nil
+}
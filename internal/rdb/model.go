@@ -0,0 +1,85 @@
+package rdb
+
+import stdErrors "errors"
+
+const (
+	magic = "REDIS"
+
+	// MaxVersion is the newest RDB format version the parser understands.
+	MaxVersion = 12
+)
+
+// Opcodes that introduce non-key sections of the file.
+const (
+	opFunction2    = 0xF5
+	opModuleAux    = 0xF7
+	opIdle         = 0xF8
+	opFreq         = 0xF9
+	opAux          = 0xFA
+	opResizeDB     = 0xFB
+	opExpireTimeMs = 0xFC
+	opExpireTime   = 0xFD
+	opSelectDB     = 0xFE
+	opEOF          = 0xFF
+)
+
+// Value type bytes. Only typeString is loaded; the rest are parsed so they
+// can be skipped.
+const (
+	typeString         = 0
+	typeList           = 1
+	typeSet            = 2
+	typeZSet           = 3
+	typeHash           = 4
+	typeZSet2          = 5
+	typeHashZipmap     = 9
+	typeListZiplist    = 10
+	typeSetIntset      = 11
+	typeZSetZiplist    = 12
+	typeHashZiplist    = 13
+	typeListQuicklist  = 14
+	typeHashListpack   = 16
+	typeZSetListpack   = 17
+	typeListQuicklist2 = 18
+	typeSetListpack    = 20
+)
+
+// The top two bits of a length byte select how the length is stored. The
+// special form marks an integer or LZF-compressed string instead.
+const (
+	length6Bit    = 0
+	length14Bit   = 1
+	lengthWide    = 2
+	lengthSpecial = 3
+
+	length32Bit = 0x80
+	length64Bit = 0x81
+
+	encodingInt8  = 0
+	encodingInt16 = 1
+	encodingInt32 = 2
+	encodingLZF   = 3
+)
+
+var (
+	ErrInvalidMagic       = stdErrors.New("input is not an RDB file")
+	ErrUnsupportedVersion = stdErrors.New("unsupported RDB version")
+	ErrUnsupportedType    = stdErrors.New("unsupported RDB value type")
+	ErrCorrupt            = stdErrors.New("corrupt RDB file")
+)
+
+// Entry is a single string key read from an RDB file.
+type Entry struct {
+	DB    int
+	Key   []byte
+	Value []byte
+	// ExpiresAt is the absolute expiry in Unix milliseconds, or 0 if the key
+	// does not expire.
+	ExpiresAt int64
+}
+
+// Stats counts what the parser saw beyond the entries it handed out.
+type Stats struct {
+	Strings int
+	Skipped int
+}
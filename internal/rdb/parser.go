@@ -0,0 +1,363 @@
+package rdb
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+type parser struct {
+	r *bufio.Reader
+}
+
+// Parse reads an RDB file and calls fn for every string key it contains.
+// Lists, sets, sorted sets and hashes are decoded far enough to be skipped and
+// counted in Stats.Skipped; streams and module types abort the parse with
+// ErrUnsupportedType. The trailing CRC64 is read but not verified.
+func Parse(ctx context.Context, r io.Reader, fn func(Entry) error) (Stats, error) {
+	var stats Stats
+	p := &parser{r: bufio.NewReader(r)}
+
+	header := make([]byte, 9)
+	if _, err := io.ReadFull(p.r, header); err != nil {
+		return stats, ErrInvalidMagic
+	}
+
+	if string(header[:5]) != magic {
+		return stats, ErrInvalidMagic
+	}
+
+	version, err := strconv.Atoi(string(header[5:]))
+	if err != nil {
+		return stats, ErrInvalidMagic
+	}
+
+	if version < 1 || version > MaxVersion {
+		return stats, fmt.Errorf("%w: %d", ErrUnsupportedVersion, version)
+	}
+
+	var db int
+	var expiresAt int64
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return stats, err
+		}
+
+		op, err := p.r.ReadByte()
+		if err != nil {
+			return stats, p.corrupt(err)
+		}
+
+		switch op {
+		case opEOF:
+			if version >= 5 {
+				if _, err := io.ReadFull(p.r, make([]byte, 8)); err != nil {
+					return stats, p.corrupt(err)
+				}
+			}
+			return stats, nil
+
+		case opSelectDB:
+			n, err := p.readLength()
+			if err != nil {
+				return stats, err
+			}
+			db = int(n)
+
+		case opResizeDB:
+			if _, err := p.readLength(); err != nil {
+				return stats, err
+			}
+			if _, err := p.readLength(); err != nil {
+				return stats, err
+			}
+
+		case opAux:
+			if err := p.skipStrings(2); err != nil {
+				return stats, err
+			}
+
+		case opFunction2:
+			if err := p.skipStrings(1); err != nil {
+				return stats, err
+			}
+
+		case opExpireTime:
+			var seconds uint32
+			if err := binary.Read(p.r, binary.LittleEndian, &seconds); err != nil {
+				return stats, p.corrupt(err)
+			}
+			expiresAt = int64(seconds) * 1000
+
+		case opExpireTimeMs:
+			var millis uint64
+			if err := binary.Read(p.r, binary.LittleEndian, &millis); err != nil {
+				return stats, p.corrupt(err)
+			}
+			expiresAt = int64(millis)
+
+		case opIdle:
+			if _, err := p.readLength(); err != nil {
+				return stats, err
+			}
+
+		case opFreq:
+			if _, err := p.r.ReadByte(); err != nil {
+				return stats, p.corrupt(err)
+			}
+
+		case opModuleAux:
+			return stats, fmt.Errorf("%w: module aux data", ErrUnsupportedType)
+
+		default:
+			key, err := p.readString()
+			if err != nil {
+				return stats, err
+			}
+
+			if op != typeString {
+				if err := p.skipValue(op); err != nil {
+					return stats, err
+				}
+				stats.Skipped++
+				expiresAt = 0
+				continue
+			}
+
+			value, err := p.readString()
+			if err != nil {
+				return stats, err
+			}
+
+			stats.Strings++
+			if err := fn(Entry{DB: db, Key: key, Value: value, ExpiresAt: expiresAt}); err != nil {
+				return stats, err
+			}
+			expiresAt = 0
+		}
+	}
+}
+
+func (p *parser) skipValue(valueType byte) error {
+	switch valueType {
+	case typeList, typeSet, typeListQuicklist:
+		n, err := p.readLength()
+		if err != nil {
+			return err
+		}
+		return p.skipStrings(n)
+
+	case typeHash:
+		n, err := p.readLength()
+		if err != nil {
+			return err
+		}
+		return p.skipStrings(n * 2)
+
+	case typeZSet:
+		n, err := p.readLength()
+		if err != nil {
+			return err
+		}
+
+		for i := uint64(0); i < n; i++ {
+			if err := p.skipStrings(1); err != nil {
+				return err
+			}
+
+			// Legacy scores are a length-prefixed ASCII double, with 253-255
+			// reserved for NaN and the infinities.
+			size, err := p.r.ReadByte()
+			if err != nil {
+				return p.corrupt(err)
+			}
+			if size < 253 {
+				if _, err := p.r.Discard(int(size)); err != nil {
+					return p.corrupt(err)
+				}
+			}
+		}
+		return nil
+
+	case typeZSet2:
+		n, err := p.readLength()
+		if err != nil {
+			return err
+		}
+
+		for i := uint64(0); i < n; i++ {
+			if err := p.skipStrings(1); err != nil {
+				return err
+			}
+			if _, err := p.r.Discard(8); err != nil {
+				return p.corrupt(err)
+			}
+		}
+		return nil
+
+	case typeListQuicklist2:
+		n, err := p.readLength()
+		if err != nil {
+			return err
+		}
+
+		for i := uint64(0); i < n; i++ {
+			if _, err := p.readLength(); err != nil {
+				return err
+			}
+			if err := p.skipStrings(1); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case typeHashZipmap, typeListZiplist, typeSetIntset, typeZSetZiplist, typeHashZiplist,
+		typeHashListpack, typeZSetListpack, typeSetListpack:
+		return p.skipStrings(1)
+	}
+
+	return fmt.Errorf("%w: %d", ErrUnsupportedType, valueType)
+}
+
+func (p *parser) skipStrings(n uint64) error {
+	for i := uint64(0); i < n; i++ {
+		if _, err := p.readString(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readLength decodes a length that must not use the special string encoding.
+func (p *parser) readLength() (uint64, error) {
+	n, special, err := p.readEncodedLength()
+	if err != nil {
+		return 0, err
+	}
+
+	if special {
+		return 0, ErrCorrupt
+	}
+	return n, nil
+}
+
+// readEncodedLength decodes a length prefix. When special is true the
+// returned value is the string encoding rather than a length.
+func (p *parser) readEncodedLength() (uint64, bool, error) {
+	first, err := p.r.ReadByte()
+	if err != nil {
+		return 0, false, p.corrupt(err)
+	}
+
+	switch first >> 6 {
+	case length6Bit:
+		return uint64(first & 0x3f), false, nil
+
+	case length14Bit:
+		next, err := p.r.ReadByte()
+		if err != nil {
+			return 0, false, p.corrupt(err)
+		}
+		return uint64(first&0x3f)<<8 | uint64(next), false, nil
+
+	case lengthSpecial:
+		return uint64(first & 0x3f), true, nil
+	}
+
+	switch first {
+	case length32Bit:
+		var n uint32
+		if err := binary.Read(p.r, binary.BigEndian, &n); err != nil {
+			return 0, false, p.corrupt(err)
+		}
+		return uint64(n), false, nil
+
+	case length64Bit:
+		var n uint64
+		if err := binary.Read(p.r, binary.BigEndian, &n); err != nil {
+			return 0, false, p.corrupt(err)
+		}
+		return n, false, nil
+	}
+
+	return 0, false, ErrCorrupt
+}
+
+func (p *parser) readString() ([]byte, error) {
+	n, special, err := p.readEncodedLength()
+	if err != nil {
+		return nil, err
+	}
+
+	if !special {
+		return p.readBytes(n)
+	}
+
+	switch n {
+	case encodingInt8:
+		b, err := p.r.ReadByte()
+		if err != nil {
+			return nil, p.corrupt(err)
+		}
+		return strconv.AppendInt(nil, int64(int8(b)), 10), nil
+
+	case encodingInt16:
+		var v int16
+		if err := binary.Read(p.r, binary.LittleEndian, &v); err != nil {
+			return nil, p.corrupt(err)
+		}
+		return strconv.AppendInt(nil, int64(v), 10), nil
+
+	case encodingInt32:
+		var v int32
+		if err := binary.Read(p.r, binary.LittleEndian, &v); err != nil {
+			return nil, p.corrupt(err)
+		}
+		return strconv.AppendInt(nil, int64(v), 10), nil
+
+	case encodingLZF:
+		compressed, err := p.readLength()
+		if err != nil {
+			return nil, err
+		}
+
+		length, err := p.readLength()
+		if err != nil {
+			return nil, err
+		}
+
+		data, err := p.readBytes(compressed)
+		if err != nil {
+			return nil, err
+		}
+		return decompressLZF(data, int(length))
+	}
+
+	return nil, ErrCorrupt
+}
+
+func (p *parser) readBytes(n uint64) ([]byte, error) {
+	// Grow the buffer as bytes arrive rather than trusting a length that a
+	// corrupt file could set to anything.
+	buf := make([]byte, 0, min(n, 1<<20))
+	for uint64(len(buf)) < n {
+		chunk := min(n-uint64(len(buf)), 1<<20)
+		start := len(buf)
+		buf = append(buf, make([]byte, chunk)...)
+		if _, err := io.ReadFull(p.r, buf[start:]); err != nil {
+			return nil, p.corrupt(err)
+		}
+	}
+	return buf, nil
+}
+
+func (p *parser) corrupt(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("%w: unexpected end of file", ErrCorrupt)
+	}
+	return err
+}
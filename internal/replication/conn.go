@@ -0,0 +1,267 @@
+package replication
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/iamBelugaa/kvix/internal/index"
+)
+
+// Conn frames replication messages over a byte stream. Writes are buffered
+// until Flush. A Conn is not safe for concurrent use.
+type Conn struct {
+	reader  *bufio.Reader
+	writer  *bufio.Writer
+	payload bytes.Buffer
+}
+
+func NewConn(rw io.ReadWriter) *Conn {
+	return &Conn{reader: bufio.NewReader(rw), writer: bufio.NewWriterSize(rw, ChunkSize+4096)}
+}
+
+func (c *Conn) Flush() error {
+	return c.writer.Flush()
+}
+
+func (c *Conn) WriteHello(hello *Hello) error {
+	c.payload.Reset()
+	binary.Write(&c.payload, binary.LittleEndian, helloHeader{
+		Magic:        magic,
+		Version:      Version,
+		Partitions:   hello.Partitions,
+		PrefixLength: uint16(len(hello.Prefix)),
+		Segments:     uint32(len(hello.Segments)),
+	})
+	c.payload.WriteString(hello.Prefix)
+
+	for _, segment := range hello.Segments {
+		binary.Write(&c.payload, binary.LittleEndian, fileHeader{
+			Size:         segment.Size,
+			TailChecksum: segment.TailChecksum,
+			NameLength:   uint16(len(segment.Name)),
+			Partition:    segment.Partition,
+		})
+		c.payload.WriteString(segment.Name)
+	}
+
+	return c.writeFrame(MessageHello)
+}
+
+func (c *Conn) WriteError(reason string) error {
+	c.payload.Reset()
+	c.payload.WriteString(reason)
+	return c.writeFrame(MessageError)
+}
+
+func (c *Conn) WriteSegment(partition uint8, name string, offset int64, data []byte) error {
+	c.payload.Reset()
+	binary.Write(&c.payload, binary.LittleEndian, chunkHeader{
+		Offset:     offset,
+		NameLength: uint16(len(name)),
+		Partition:  partition,
+	})
+	c.payload.WriteString(name)
+	c.payload.Write(data)
+	return c.writeFrame(MessageSegment)
+}
+
+func (c *Conn) WriteSegmentList(partition uint8, names []string) error {
+	c.payload.Reset()
+	binary.Write(&c.payload, binary.LittleEndian, listHeader{Count: uint32(len(names)), Partition: partition})
+	for _, name := range names {
+		binary.Write(&c.payload, binary.LittleEndian, uint16(len(name)))
+		c.payload.WriteString(name)
+	}
+	return c.writeFrame(MessageSegmentList)
+}
+
+func (c *Conn) WritePut(key []byte, pointer *index.RecordPointer) error {
+	c.payload.Reset()
+	binary.Write(&c.payload, binary.LittleEndian, putHeader{
+		ExpiresAt:        pointer.ExpiresAt,
+		Offset:           pointer.Offset,
+		SegmentTimestamp: pointer.SegmentTimestamp,
+		Size:             pointer.Size,
+		SegmentID:        pointer.SegmentID,
+		KeyLength:        uint16(len(key)),
+		Partition:        pointer.Partition,
+	})
+	c.payload.Write(key)
+	return c.writeFrame(MessagePut)
+}
+
+func (c *Conn) WriteDelete(key []byte) error {
+	c.payload.Reset()
+	c.payload.Write(key)
+	return c.writeFrame(MessageDelete)
+}
+
+func (c *Conn) WriteSynced() error {
+	c.payload.Reset()
+	return c.writeFrame(MessageSynced)
+}
+
+func (c *Conn) WriteHeartbeat() error {
+	c.payload.Reset()
+	return c.writeFrame(MessageHeartbeat)
+}
+
+func (c *Conn) writeFrame(messageType MessageType) error {
+	header := frameHeader{Type: uint8(messageType), Length: uint32(c.payload.Len())}
+	if err := binary.Write(c.writer, binary.LittleEndian, header); err != nil {
+		return err
+	}
+
+	_, err := c.writer.Write(c.payload.Bytes())
+	return err
+}
+
+// Read returns the next message. Its byte slices are owned by the caller.
+func (c *Conn) Read() (*Message, error) {
+	var header frameHeader
+	if err := binary.Read(c.reader, binary.LittleEndian, &header); err != nil {
+		return nil, err
+	}
+
+	if header.Length > maxPayload {
+		return nil, fmt.Errorf("%w: %d byte message exceeds %d bytes", ErrProtocol, header.Length, maxPayload)
+	}
+
+	payload := make([]byte, header.Length)
+	if _, err := io.ReadFull(c.reader, payload); err != nil {
+		return nil, err
+	}
+
+	message, err := decode(MessageType(header.Type), payload)
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed message of type %d: %v", ErrProtocol, header.Type, err)
+	}
+	return message, nil
+}
+
+func decode(messageType MessageType, payload []byte) (*Message, error) {
+	message := &Message{Type: messageType}
+	reader := bytes.NewReader(payload)
+
+	switch messageType {
+	case MessageHello:
+		var header helloHeader
+		if err := binary.Read(reader, binary.LittleEndian, &header); err != nil {
+			return nil, err
+		}
+
+		if header.Magic != magic {
+			return nil, fmt.Errorf("not a replication hello")
+		}
+
+		if header.Version != Version {
+			return nil, fmt.Errorf("unsupported protocol version %d, expected %d", header.Version, Version)
+		}
+
+		prefix, err := readString(reader, int(header.PrefixLength))
+		if err != nil {
+			return nil, err
+		}
+
+		hello := &Hello{Partitions: header.Partitions, Prefix: prefix}
+		for range header.Segments {
+			var file fileHeader
+			if err := binary.Read(reader, binary.LittleEndian, &file); err != nil {
+				return nil, err
+			}
+
+			name, err := readString(reader, int(file.NameLength))
+			if err != nil {
+				return nil, err
+			}
+
+			hello.Segments = append(hello.Segments, SegmentFile{
+				Partition:    file.Partition,
+				Name:         name,
+				Size:         file.Size,
+				TailChecksum: file.TailChecksum,
+			})
+		}
+		message.Hello = hello
+
+	case MessageError:
+		message.Error = string(payload)
+
+	case MessageSegment:
+		var header chunkHeader
+		if err := binary.Read(reader, binary.LittleEndian, &header); err != nil {
+			return nil, err
+		}
+
+		name, err := readString(reader, int(header.NameLength))
+		if err != nil {
+			return nil, err
+		}
+
+		message.Partition = header.Partition
+		message.Segment = name
+		message.Offset = header.Offset
+		message.Data = payload[len(payload)-reader.Len():]
+
+	case MessageSegmentList:
+		var header listHeader
+		if err := binary.Read(reader, binary.LittleEndian, &header); err != nil {
+			return nil, err
+		}
+
+		message.Partition = header.Partition
+		for range header.Count {
+			var length uint16
+			if err := binary.Read(reader, binary.LittleEndian, &length); err != nil {
+				return nil, err
+			}
+
+			name, err := readString(reader, int(length))
+			if err != nil {
+				return nil, err
+			}
+			message.Segments = append(message.Segments, name)
+		}
+
+	case MessagePut:
+		var header putHeader
+		if err := binary.Read(reader, binary.LittleEndian, &header); err != nil {
+			return nil, err
+		}
+
+		if reader.Len() != int(header.KeyLength) {
+			return nil, fmt.Errorf("key length %d does not match the %d bytes left", header.KeyLength, reader.Len())
+		}
+
+		message.Key = payload[len(payload)-reader.Len():]
+		message.Pointer = index.RecordPointer{
+			ExpiresAt:        header.ExpiresAt,
+			Offset:           header.Offset,
+			SegmentTimestamp: header.SegmentTimestamp,
+			Size:             header.Size,
+			SegmentID:        header.SegmentID,
+			Partition:        header.Partition,
+		}
+
+	case MessageDelete:
+		message.Key = payload
+
+	case MessageSynced, MessageHeartbeat:
+
+	default:
+		return nil, fmt.Errorf("unknown message type")
+	}
+
+	return message, nil
+}
+
+func readString(reader *bytes.Reader, length int) (string, error) {
+	buffer := make([]byte, length)
+	if _, err := io.ReadFull(reader, buffer); err != nil {
+		return "", err
+	}
+	return string(buffer), nil
+}
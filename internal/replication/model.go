@@ -0,0 +1,131 @@
+package replication
+
+import (
+	stdErrors "errors"
+	"time"
+
+	"github.com/iamBelugaa/kvix/internal/index"
+)
+
+const (
+	Version uint16 = 1
+
+	// ChunkSize caps the segment bytes carried by one message.
+	ChunkSize = 1 << 20
+
+	// HeartbeatInterval is how often an idle primary tells its replicas it is
+	// still there.
+	HeartbeatInterval = time.Second
+
+	// Timeout is how long either side waits on the other before dropping the
+	// connection.
+	Timeout = 10 * time.Second
+
+	// TailCheckSize is how many trailing bytes of each segment a replica
+	// checksums in its Hello, so the primary can tell a copy that diverged
+	// from one that is merely short.
+	TailCheckSize = 64 << 10
+
+	maxPayload = 16 << 20
+)
+
+var magic = [8]byte{'K', 'V', 'I', 'X', 'R', 'E', 'P', 'L'}
+
+// ErrProtocol is returned for messages that do not follow the protocol.
+var ErrProtocol = stdErrors.New("replication protocol violation")
+
+// MessageType says what a Message carries.
+type MessageType uint8
+
+const (
+	// MessageHello opens a connection: the replica names the segments it
+	// already holds.
+	MessageHello MessageType = iota + 1
+	// MessageError is the primary's reason for ending the connection.
+	MessageError
+	// MessageSegment carries segment bytes to write at Offset. The replica
+	// first cuts the file off at Offset, so an empty chunk truncates it.
+	MessageSegment
+	// MessageSegmentList names every segment of one partition as of the sync.
+	MessageSegmentList
+	// MessagePut points Key at a record in the shipped segments.
+	MessagePut
+	// MessageDelete removes Key.
+	MessageDelete
+	// MessageSynced ends the initial sync; every key not put since the Hello
+	// is gone.
+	MessageSynced
+	// MessageHeartbeat keeps an idle connection alive.
+	MessageHeartbeat
+)
+
+// SegmentFile describes a segment held by a replica.
+type SegmentFile struct {
+	Partition uint8
+	Name      string
+	Size      int64
+	// TailChecksum is the CRC32 (IEEE) of the last TailCheckSize bytes of the
+	// file, or of all of it when shorter.
+	TailChecksum uint32
+}
+
+type Hello struct {
+	Partitions uint8
+	Prefix     string
+	Segments   []SegmentFile
+}
+
+// Message is one decoded message. Which fields are set depends on Type.
+type Message struct {
+	Type      MessageType
+	Hello     *Hello
+	Error     string
+	Partition uint8
+	Segment   string
+	Segments  []string
+	Offset    int64
+	Data      []byte
+	Key       []byte
+	Pointer   index.RecordPointer
+}
+
+type frameHeader struct {
+	Type   uint8
+	Length uint32
+}
+
+type helloHeader struct {
+	Magic        [8]byte
+	Version      uint16
+	Partitions   uint8
+	PrefixLength uint16
+	Segments     uint32
+}
+
+type fileHeader struct {
+	Size         int64
+	TailChecksum uint32
+	NameLength   uint16
+	Partition    uint8
+}
+
+type chunkHeader struct {
+	Offset     int64
+	NameLength uint16
+	Partition  uint8
+}
+
+type listHeader struct {
+	Count     uint32
+	Partition uint8
+}
+
+type putHeader struct {
+	ExpiresAt        int64
+	Offset           int64
+	SegmentTimestamp int64
+	Size             uint32
+	SegmentID        uint16
+	KeyLength        uint16
+	Partition        uint8
+}
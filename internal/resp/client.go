@@ -0,0 +1,118 @@
+package resp
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+// ReplyError is an error reply ("-ERR ...") sent by the server.
+type ReplyError string
+
+func (e ReplyError) Error() string {
+	return string(e)
+}
+
+// Client is a minimal, single-connection RESP2 client. It is not safe for
+// concurrent use.
+type Client struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	writer *Writer
+}
+
+func Dial(ctx context.Context, addr string) (*Client, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Client{
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+		writer: NewWriter(bufio.NewWriter(conn)),
+	}, nil
+}
+
+// Do sends a command and reads its reply. Replies decode to string for simple
+// strings, []byte for bulk strings, int64 for integers, []any for arrays and
+// nil for null. An error reply is returned as a ReplyError.
+func (c *Client) Do(ctx context.Context, args ...[]byte) (any, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		c.conn.SetDeadline(deadline)
+		defer c.conn.SetDeadline(time.Time{})
+	}
+
+	c.writer.ArrayHeader(len(args))
+	for _, arg := range args {
+		c.writer.Bulk(arg)
+	}
+
+	if err := c.writer.Flush(); err != nil {
+		return nil, err
+	}
+
+	return c.readReply()
+}
+
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+func (c *Client) readReply() (any, error) {
+	line, err := readLine(c.reader)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(line) == 0 {
+		return nil, fmt.Errorf("%w: empty reply", ErrProtocol)
+	}
+
+	switch line[0] {
+	case '+':
+		return string(line[1:]), nil
+
+	case '-':
+		return nil, ReplyError(line[1:])
+
+	case ':':
+		n, err := strconv.ParseInt(string(line[1:]), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid integer reply", ErrProtocol)
+		}
+		return n, nil
+
+	case '$':
+		if string(line) == "$-1" {
+			return nil, nil
+		}
+		return readBulkBody(c.reader, line)
+
+	case '*':
+		if string(line) == "*-1" {
+			return nil, nil
+		}
+
+		count, err := strconv.Atoi(string(line[1:]))
+		if err != nil || count < 0 || count > MaxArguments {
+			return nil, fmt.Errorf("%w: invalid multibulk length", ErrProtocol)
+		}
+
+		items := make([]any, 0, count)
+		for range count {
+			item, err := c.readReply()
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+		return items, nil
+	}
+
+	return nil, fmt.Errorf("%w: unexpected reply type '%c'", ErrProtocol, line[0])
+}
@@ -0,0 +1,305 @@
+package resp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/iamBelugaa/kvix/pkg/errors"
+	"github.com/iamBelugaa/kvix/pkg/kvix"
+)
+
+type handler struct {
+	// arity is the exact argument count including the command name when
+	// positive, or the minimum count when negative, as in Redis.
+	arity int
+	run   func(ctx context.Context, s *Server, w *Writer, args [][]byte)
+}
+
+var handlers = map[string]handler{
+	"PING":    {arity: -1, run: ping},
+	"ECHO":    {arity: 2, run: echo},
+	"COMMAND": {arity: -1, run: command},
+	"GET":     {arity: 2, run: get},
+	"SET":     {arity: -3, run: set},
+	"SETEX":   {arity: 4, run: setex},
+	"DEL":     {arity: -2, run: del},
+	"EXISTS":  {arity: -2, run: exists},
+	"TTL":     {arity: 2, run: ttl},
+	"KEYS":    {arity: 2, run: keys},
+	"INFO":    {arity: -1, run: info},
+}
+
+// dispatch runs a single command and reports whether the connection should
+// be closed afterwards.
+func (s *Server) dispatch(ctx context.Context, w *Writer, args [][]byte) bool {
+	name := strings.ToUpper(string(args[0]))
+	if name == "QUIT" {
+		w.SimpleString("OK")
+		return true
+	}
+
+	h, ok := handlers[name]
+	if !ok {
+		w.Error("ERR unknown command '" + string(args[0]) + "'")
+		return false
+	}
+
+	if (h.arity > 0 && len(args) != h.arity) || (h.arity < 0 && len(args) < -h.arity) {
+		w.Error("ERR wrong number of arguments for '" + strings.ToLower(name) + "' command")
+		return false
+	}
+
+	h.run(ctx, s, w, args)
+	return false
+}
+
+func ping(ctx context.Context, s *Server, w *Writer, args [][]byte) {
+	switch len(args) {
+	case 1:
+		w.SimpleString("PONG")
+	case 2:
+		w.Bulk(args[1])
+	default:
+		w.Error("ERR wrong number of arguments for 'ping' command")
+	}
+}
+
+func echo(ctx context.Context, s *Server, w *Writer, args [][]byte) {
+	w.Bulk(args[1])
+}
+
+// command answers the introspection clients such as redis-cli issue on
+// connect with an empty list rather than an error.
+func command(ctx context.Context, s *Server, w *Writer, args [][]byte) {
+	w.ArrayHeader(0)
+}
+
+func get(ctx context.Context, s *Server, w *Writer, args [][]byte) {
+	record, err := s.instance.Get(ctx, args[1])
+	if err != nil {
+		if errors.GetErrorCode(err) == errors.ErrIndexKeyNotFound {
+			w.Null()
+			return
+		}
+		writeError(w, err)
+		return
+	}
+
+	w.Bulk(record.Value)
+}
+
+// set supports the EX and PX expiration arguments. NX, XX and the other
+// conditional forms are rejected as syntax errors.
+func set(ctx context.Context, s *Server, w *Writer, args [][]byte) {
+	var ttl time.Duration
+
+	for i := 3; i < len(args); i++ {
+		unit := time.Duration(0)
+		switch strings.ToUpper(string(args[i])) {
+		case "EX":
+			unit = time.Second
+		case "PX":
+			unit = time.Millisecond
+		default:
+			w.Error("ERR syntax error")
+			return
+		}
+
+		if ttl != 0 || i+1 == len(args) {
+			w.Error("ERR syntax error")
+			return
+		}
+
+		n, ok := parsePositive(w, args[i+1])
+		if !ok {
+			return
+		}
+
+		ttl = time.Duration(n) * unit
+		i++
+	}
+
+	writeSet(ctx, s, w, args[1], args[2], ttl)
+}
+
+func setex(ctx context.Context, s *Server, w *Writer, args [][]byte) {
+	seconds, ok := parsePositive(w, args[2])
+	if !ok {
+		return
+	}
+
+	writeSet(ctx, s, w, args[1], args[3], time.Duration(seconds)*time.Second)
+}
+
+func writeSet(ctx context.Context, s *Server, w *Writer, key, value []byte, ttl time.Duration) {
+	var err error
+	if ttl > 0 {
+		err = s.instance.SetX(ctx, key, value, ttl)
+	} else {
+		err = s.instance.Set(ctx, key, value)
+	}
+
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.SimpleString("OK")
+}
+
+func del(ctx context.Context, s *Server, w *Writer, args [][]byte) {
+	var deleted int64
+	for _, key := range args[1:] {
+		ok, err := s.instance.Delete(ctx, key)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		if ok {
+			deleted++
+		}
+	}
+
+	w.Integer(deleted)
+}
+
+func exists(ctx context.Context, s *Server, w *Writer, args [][]byte) {
+	var found int64
+	for _, key := range args[1:] {
+		ok, err := s.instance.Exists(ctx, key)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		if ok {
+			found++
+		}
+	}
+
+	w.Integer(found)
+}
+
+// ttl follows Redis: -2 for a missing key, -1 for a key without an
+// expiration, otherwise the remaining seconds rounded up.
+func ttl(ctx context.Context, s *Server, w *Writer, args [][]byte) {
+	remaining, err := s.instance.TTL(ctx, args[1])
+	if err != nil {
+		if errors.GetErrorCode(err) == errors.ErrIndexKeyNotFound {
+			w.Integer(-2)
+			return
+		}
+		writeError(w, err)
+		return
+	}
+
+	if remaining == kvix.NoExpiration {
+		w.Integer(-1)
+		return
+	}
+
+	w.Integer(int64((remaining + time.Second - 1) / time.Second))
+}
+
+// keys lists the live keys matching a glob pattern from a snapshot, in key
+// order. Like Redis KEYS it walks the whole keyspace and is meant for
+// debugging rather than production traffic.
+func keys(ctx context.Context, s *Server, w *Writer, args [][]byte) {
+	snapshot, err := s.instance.Snapshot(ctx)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	defer snapshot.Release()
+
+	var matched [][]byte
+	for _, key := range snapshot.Keys() {
+		if match(args[1], []byte(key)) {
+			matched = append(matched, []byte(key))
+		}
+	}
+
+	w.ArrayHeader(len(matched))
+	for _, key := range matched {
+		w.Bulk(key)
+	}
+}
+
+// info reports instance statistics as Redis-style "field:value" lines, using
+// the JSON field names of kvix.Stats. Nested fields are flattened to
+// "parent_field". Any section argument is ignored.
+func info(ctx context.Context, s *Server, w *Writer, args [][]byte) {
+	stats, err := s.instance.Stats(ctx)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	encoded, err := json.Marshal(stats)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	var fields map[string]any
+	if err := json.Unmarshal(encoded, &fields); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	byCode, _ := fields["errorsByCode"].(map[string]any)
+	delete(fields, "errorsByCode")
+	for code, count := range byCode {
+		fields["errors_"+code] = count
+	}
+
+	// Size histograms are reported by their summary fields, without buckets.
+	for _, name := range []string{"keySizesWritten", "valueSizesWritten", "keySizesRead", "valueSizesRead"} {
+		histogram, _ := fields[name].(map[string]any)
+		delete(fields, name)
+		delete(histogram, "buckets")
+		for field, value := range histogram {
+			fields[name+"_"+field] = value
+		}
+	}
+
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	buf.WriteString("# kvix\r\n")
+	for _, name := range names {
+		fmt.Fprintf(&buf, "%s:%v\r\n", name, fields[name])
+	}
+
+	w.Bulk(buf.Bytes())
+}
+
+func parsePositive(w *Writer, arg []byte) (int64, bool) {
+	n, err := strconv.ParseInt(string(arg), 10, 64)
+	if err != nil {
+		w.Error("ERR value is not an integer or out of range")
+		return 0, false
+	}
+
+	if n <= 0 {
+		w.Error("ERR invalid expire time")
+		return 0, false
+	}
+
+	return n, true
+}
+
+func writeError(w *Writer, err error) {
+	w.Error("ERR " + strings.ReplaceAll(err.Error(), "\r\n", " "))
+}
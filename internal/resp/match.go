@@ -0,0 +1,106 @@
+package resp
+
+// match reports whether key matches a Redis glob pattern. It supports '*',
+// '?', character classes with ranges and negation ("[a-c]", "[^x]"), and
+// backslash escapes.
+func match(pattern, key []byte) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+
+			if len(pattern) == 1 {
+				return true
+			}
+
+			for i := 0; i <= len(key); i++ {
+				if match(pattern[1:], key[i:]) {
+					return true
+				}
+			}
+			return false
+
+		case '?':
+			if len(key) == 0 {
+				return false
+			}
+
+		case '[':
+			if len(key) == 0 {
+				return false
+			}
+
+			matched, rest, ok := matchClass(pattern[1:], key[0])
+			if !ok {
+				// An unterminated class matches the literal '['.
+				if key[0] != '[' {
+					return false
+				}
+			} else {
+				if !matched {
+					return false
+				}
+				pattern = rest
+				key = key[1:]
+				continue
+			}
+
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+
+		default:
+			if len(key) == 0 || pattern[0] != key[0] {
+				return false
+			}
+		}
+
+		pattern = pattern[1:]
+		key = key[1:]
+	}
+
+	return len(key) == 0
+}
+
+// matchClass matches c against the body of a character class and returns the
+// pattern following the closing ']'.
+func matchClass(pattern []byte, c byte) (matched bool, rest []byte, ok bool) {
+	negate := len(pattern) > 0 && pattern[0] == '^'
+	if negate {
+		pattern = pattern[1:]
+	}
+
+	for i := 0; i < len(pattern); i++ {
+		switch {
+		case pattern[i] == ']':
+			return matched != negate, pattern[i+1:], true
+
+		case pattern[i] == '\\' && i+1 < len(pattern):
+			i++
+			if pattern[i] == c {
+				matched = true
+			}
+
+		case i+2 < len(pattern) && pattern[i+1] == '-' && pattern[i+2] != ']':
+			lo, hi := pattern[i], pattern[i+2]
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+			if c >= lo && c <= hi {
+				matched = true
+			}
+			i += 2
+
+		default:
+			if pattern[i] == c {
+				matched = true
+			}
+		}
+	}
+
+	return false, nil, false
+}
@@ -0,0 +1,38 @@
+package resp
+
+import (
+	stdErrors "errors"
+	"net"
+	"sync"
+
+	"go.uber.org/zap"
+
+	"github.com/iamBelugaa/kvix/pkg/kvix"
+)
+
+const (
+	// MaxBulkLength bounds a single bulk string read from a client. It leaves
+	// room above the largest value kvix accepts for the command framing.
+	MaxBulkLength = 64 << 20
+	// MaxArguments bounds the number of arguments in a single command.
+	MaxArguments = 1 << 16
+)
+
+var (
+	ErrProtocol     = stdErrors.New("protocol error")
+	ErrServerClosed = stdErrors.New("resp: server closed")
+)
+
+// Server speaks the subset of the Redis protocol that maps onto kvix:
+// GET, SET, SETEX, DEL, EXISTS and TTL, plus PING, ECHO, COMMAND and QUIT so
+// that stock clients can connect.
+type Server struct {
+	instance *kvix.Instance
+	log      *zap.SugaredLogger
+
+	mu       sync.Mutex
+	closed   bool
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	wg       sync.WaitGroup
+}
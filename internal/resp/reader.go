@@ -0,0 +1,87 @@
+package resp
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// ReadCommand reads one client command, either as a RESP array of bulk
+// strings or as an inline, space-separated line.
+func ReadCommand(r *bufio.Reader) ([][]byte, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(line) == 0 {
+		return nil, nil
+	}
+
+	if line[0] != '*' {
+		return bytes.Fields(line), nil
+	}
+
+	count, err := strconv.Atoi(string(line[1:]))
+	if err != nil || count > MaxArguments {
+		return nil, fmt.Errorf("%w: invalid multibulk length", ErrProtocol)
+	}
+
+	args := make([][]byte, 0, max(count, 0))
+	for range count {
+		arg, err := readBulk(r)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+
+	return args, nil
+}
+
+func readBulk(r *bufio.Reader) ([]byte, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(line) == 0 || line[0] != '$' {
+		return nil, fmt.Errorf("%w: expected '$', got '%s'", ErrProtocol, line)
+	}
+
+	return readBulkBody(r, line)
+}
+
+// readBulkBody reads the payload announced by a "$<length>" line.
+func readBulkBody(r *bufio.Reader, line []byte) ([]byte, error) {
+	length, err := strconv.Atoi(string(line[1:]))
+	if err != nil || length < 0 || length > MaxBulkLength {
+		return nil, fmt.Errorf("%w: invalid bulk length", ErrProtocol)
+	}
+
+	buf := make([]byte, length+2)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+
+	if buf[length] != '\r' || buf[length+1] != '\n' {
+		return nil, fmt.Errorf("%w: bulk string not terminated by CRLF", ErrProtocol)
+	}
+
+	return buf[:length], nil
+}
+
+func readLine(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return nil, fmt.Errorf("%w: line too long", ErrProtocol)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return bytes.TrimRight(line, "\r\n"), nil
+}
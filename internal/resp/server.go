@@ -0,0 +1,142 @@
+package resp
+
+import (
+	"bufio"
+	"context"
+	stdErrors "errors"
+	"io"
+	"net"
+
+	"go.uber.org/zap"
+
+	"github.com/iamBelugaa/kvix/pkg/kvix"
+)
+
+func NewServer(log *zap.SugaredLogger, instance *kvix.Instance) *Server {
+	return &Server{
+		log:      log,
+		instance: instance,
+		conns:    make(map[net.Conn]struct{}),
+	}
+}
+
+// Serve accepts connections on listener until ctx is cancelled or Close is
+// called, then waits for in-flight connections to finish. It returns nil after
+// a clean shutdown.
+func (s *Server) Serve(ctx context.Context, listener net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrServerClosed
+	}
+	s.listener = listener
+	s.mu.Unlock()
+
+	stop := context.AfterFunc(ctx, func() { s.Close() })
+	defer stop()
+
+	s.log.Infow("RESP server listening", "addr", listener.Addr().String())
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+
+			if closed {
+				s.wg.Wait()
+				return nil
+			}
+			return err
+		}
+
+		if !s.track(conn) {
+			conn.Close()
+			continue
+		}
+
+		s.wg.Add(1)
+		go s.handle(ctx, conn)
+	}
+}
+
+// Close stops accepting connections and closes every open connection.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return ErrServerClosed
+	}
+	s.closed = true
+
+	for conn := range s.conns {
+		conn.Close()
+	}
+
+	if s.listener != nil {
+		return s.listener.Close()
+	}
+	return nil
+}
+
+func (s *Server) track(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	return true
+}
+
+func (s *Server) untrack(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, conn)
+}
+
+func (s *Server) handle(ctx context.Context, conn net.Conn) {
+	defer s.wg.Done()
+	defer s.untrack(conn)
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	writer := NewWriter(bufio.NewWriter(conn))
+
+	for {
+		args, err := ReadCommand(reader)
+		if err != nil {
+			if stdErrors.Is(err, ErrProtocol) {
+				writer.Error("ERR " + err.Error())
+				writer.Flush()
+			} else if err != io.EOF && !stdErrors.Is(err, net.ErrClosed) {
+				s.log.Debugw("RESP connection error", "remote", conn.RemoteAddr().String(), "error", err)
+			}
+			return
+		}
+
+		if len(args) == 0 {
+			if reader.Buffered() == 0 && writer.Flush() != nil {
+				return
+			}
+			continue
+		}
+
+		quit := s.dispatch(ctx, writer, args)
+
+		// Only flush once the client has no further pipelined commands
+		// buffered.
+		if quit || reader.Buffered() == 0 {
+			if err := writer.Flush(); err != nil {
+				return
+			}
+		}
+
+		if quit {
+			return
+		}
+	}
+}
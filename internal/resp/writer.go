@@ -0,0 +1,56 @@
+package resp
+
+import (
+	"bufio"
+	"strconv"
+)
+
+// Writer encodes RESP2 replies. Callers flush once per command so pipelined
+// requests are answered in as few writes as possible.
+type Writer struct {
+	w *bufio.Writer
+}
+
+func NewWriter(w *bufio.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+func (w *Writer) SimpleString(s string) {
+	w.w.WriteByte('+')
+	w.w.WriteString(s)
+	w.w.WriteString("\r\n")
+}
+
+func (w *Writer) Error(msg string) {
+	w.w.WriteByte('-')
+	w.w.WriteString(msg)
+	w.w.WriteString("\r\n")
+}
+
+func (w *Writer) Integer(n int64) {
+	w.w.WriteByte(':')
+	w.w.WriteString(strconv.FormatInt(n, 10))
+	w.w.WriteString("\r\n")
+}
+
+func (w *Writer) Bulk(b []byte) {
+	w.w.WriteByte('$')
+	w.w.WriteString(strconv.Itoa(len(b)))
+	w.w.WriteString("\r\n")
+	w.w.Write(b)
+	w.w.WriteString("\r\n")
+}
+
+func (w *Writer) Null() {
+	w.w.WriteString("$-1\r\n")
+}
+
+func (w *Writer) ArrayHeader(n int) {
+	w.w.WriteByte('*')
+	w.w.WriteString(strconv.Itoa(n))
+	w.w.WriteString("\r\n")
+}
+
+func (w *Writer) Flush() error {
+	return w.w.Flush()
+}
@@ -0,0 +1,184 @@
+//go:build grpc
+
+// Package rpc serves an instance over gRPC using the service defined in
+// pkg/proto/kvix.proto, whose stubs `make gen-pb` generates into __proto__.
+// It is only built with the grpc build tag, so that kvixd links gRPC in only
+// when asked to.
+package rpc
+
+import (
+	"bytes"
+	"context"
+	stdErrors "errors"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/iamBelugaa/kvix/internal/engine"
+	kvixrpcpb "github.com/iamBelugaa/kvix/internal/rpc/__proto__"
+	"github.com/iamBelugaa/kvix/pkg/errors"
+	"github.com/iamBelugaa/kvix/pkg/kvix"
+)
+
+type Server struct {
+	kvixrpcpb.UnimplementedKvixServer
+
+	instance *kvix.Instance
+	log      *zap.SugaredLogger
+}
+
+// Register attaches a kvix service backed by instance to registrar.
+func Register(registrar grpc.ServiceRegistrar, log *zap.SugaredLogger, instance *kvix.Instance) {
+	kvixrpcpb.RegisterKvixServer(registrar, &Server{instance: instance, log: log})
+}
+
+// Every handler passes the request context straight to the instance, so a
+// client deadline or cancellation stops the engine before it touches storage.
+
+func (s *Server) Set(ctx context.Context, req *kvixrpcpb.SetRequest) (*kvixrpcpb.SetResponse, error) {
+	if err := s.instance.Set(ctx, req.GetKey(), req.GetValue()); err != nil {
+		return nil, toStatus(err)
+	}
+	return &kvixrpcpb.SetResponse{}, nil
+}
+
+func (s *Server) SetX(ctx context.Context, req *kvixrpcpb.SetXRequest) (*kvixrpcpb.SetResponse, error) {
+	ttl := time.Duration(req.GetTtlMs()) * time.Millisecond
+	if err := s.instance.SetX(ctx, req.GetKey(), req.GetValue(), ttl); err != nil {
+		return nil, toStatus(err)
+	}
+	return &kvixrpcpb.SetResponse{}, nil
+}
+
+func (s *Server) Get(ctx context.Context, req *kvixrpcpb.GetRequest) (*kvixrpcpb.GetResponse, error) {
+	record, err := s.instance.Get(ctx, req.GetKey())
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return &kvixrpcpb.GetResponse{Value: record.Value, Timestamp: record.Header.Timestamp}, nil
+}
+
+func (s *Server) Delete(ctx context.Context, req *kvixrpcpb.DeleteRequest) (*kvixrpcpb.DeleteResponse, error) {
+	deleted, err := s.instance.Delete(ctx, req.GetKey())
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return &kvixrpcpb.DeleteResponse{Deleted: deleted}, nil
+}
+
+func (s *Server) Exists(ctx context.Context, req *kvixrpcpb.ExistsRequest) (*kvixrpcpb.ExistsResponse, error) {
+	exists, err := s.instance.Exists(ctx, req.GetKey())
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return &kvixrpcpb.ExistsResponse{Exists: exists}, nil
+}
+
+// Scan streams the keys matching a prefix from a snapshot, in key order, so
+// concurrent writes never show up half-way through a scan.
+func (s *Server) Scan(req *kvixrpcpb.ScanRequest, stream kvixrpcpb.Kvix_ScanServer) error {
+	ctx := stream.Context()
+
+	snapshot, err := s.instance.Snapshot(ctx)
+	if err != nil {
+		return toStatus(err)
+	}
+	defer snapshot.Release()
+
+	var sent uint32
+	for _, key := range snapshot.Keys() {
+		if req.GetLimit() > 0 && sent == req.GetLimit() {
+			break
+		}
+
+		if !bytes.HasPrefix([]byte(key), req.GetPrefix()) {
+			continue
+		}
+
+		record, err := snapshot.Get(ctx, []byte(key))
+		if err != nil {
+			if errors.GetErrorCode(err) == errors.ErrIndexKeyNotFound {
+				continue
+			}
+			return toStatus(err)
+		}
+
+		if err := stream.Send(&kvixrpcpb.KeyValue{Key: []byte(key), Value: record.Value}); err != nil {
+			return err
+		}
+		sent++
+	}
+
+	return nil
+}
+
+// Watch streams changes to keys matching a prefix until the client goes
+// away. A client that falls behind receives TYPE_OVERFLOW and the stream ends
+// with RESOURCE_EXHAUSTED.
+func (s *Server) Watch(req *kvixrpcpb.WatchRequest, stream kvixrpcpb.Kvix_WatchServer) error {
+	ctx := stream.Context()
+
+	events, err := s.instance.Watch(ctx, req.GetPrefix())
+	if err != nil {
+		return toStatus(err)
+	}
+
+	for event := range events {
+		message := &kvixrpcpb.WatchEvent{Type: watchEventType(event.Type), Key: event.Key, Value: event.Value}
+		if !event.ExpiresAt.IsZero() {
+			message.ExpiresAtMs = event.ExpiresAt.UnixMilli()
+		}
+
+		if err := stream.Send(message); err != nil {
+			return err
+		}
+
+		if event.Type == kvix.EventOverflow {
+			return status.Error(codes.ResourceExhausted, "watcher fell too far behind")
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return status.FromContextError(err).Err()
+	}
+	return status.Error(codes.Unavailable, "instance closed")
+}
+
+func watchEventType(eventType kvix.EventType) kvixrpcpb.WatchEvent_Type {
+	switch eventType {
+	case kvix.EventSet:
+		return kvixrpcpb.WatchEvent_TYPE_SET
+	case kvix.EventDelete, kvix.EventEvict:
+		// The wire protocol has no eviction type; to a client an evicted
+		// key is gone like a deleted one.
+		return kvixrpcpb.WatchEvent_TYPE_DELETE
+	case kvix.EventExpire:
+		return kvixrpcpb.WatchEvent_TYPE_EXPIRE
+	case kvix.EventOverflow:
+		return kvixrpcpb.WatchEvent_TYPE_OVERFLOW
+	}
+	return kvixrpcpb.WatchEvent_TYPE_UNSPECIFIED
+}
+
+func toStatus(err error) error {
+	if stdErrors.Is(err, context.DeadlineExceeded) || stdErrors.Is(err, context.Canceled) {
+		return status.FromContextError(err).Err()
+	}
+
+	if stdErrors.Is(err, engine.ErrEngineClosed) {
+		return status.Error(codes.Unavailable, err.Error())
+	}
+
+	if errors.GetErrorCode(err) == errors.ErrIndexKeyNotFound {
+		return status.Error(codes.NotFound, err.Error())
+	}
+
+	if _, ok := errors.AsValidationError(err); ok {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	return status.Error(codes.Internal, err.Error())
+}
@@ -0,0 +1,156 @@
+package scheduler
+
+import (
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Scheduler runs periodic jobs on a single goroutine, so many instances can
+// share one background worker instead of starting tickers of their own. Jobs
+// run one at a time; a slow job delays the others.
+type Scheduler struct {
+	log  *zap.SugaredLogger
+	mu   sync.Mutex
+	jobs map[*Job]struct{}
+	wake chan struct{}
+	stop chan struct{}
+	done chan struct{}
+}
+
+// Job is a registered periodic function.
+type Job struct {
+	interval time.Duration
+	fn       func()
+	next     time.Time
+
+	// running is held while fn runs, so Cancel can wait for it to finish.
+	running sync.Mutex
+	removed bool
+}
+
+func New(log *zap.SugaredLogger) *Scheduler {
+	s := &Scheduler{
+		log:  log,
+		jobs: make(map[*Job]struct{}),
+		wake: make(chan struct{}, 1),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+
+	go s.run()
+	return s
+}
+
+// Every runs fn every interval, starting one interval from now.
+func (s *Scheduler) Every(interval time.Duration, fn func()) *Job {
+	job := &Job{interval: interval, fn: fn, next: time.Now().Add(interval)}
+
+	s.mu.Lock()
+	s.jobs[job] = struct{}{}
+	s.mu.Unlock()
+
+	s.notify()
+	return job
+}
+
+// Cancel removes job and waits for a run that is in progress to return.
+func (s *Scheduler) Cancel(job *Job) {
+	s.mu.Lock()
+	delete(s.jobs, job)
+	s.mu.Unlock()
+
+	job.running.Lock()
+	job.removed = true
+	job.running.Unlock()
+}
+
+// Close stops the scheduler after the job in progress, if any, returns.
+// Jobs still registered are dropped.
+func (s *Scheduler) Close() {
+	select {
+	case <-s.stop:
+		return
+	default:
+		close(s.stop)
+	}
+	<-s.done
+}
+
+func (s *Scheduler) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Scheduler) run() {
+	defer close(s.done)
+
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		default:
+		}
+
+		due, wait := s.due(time.Now())
+		for _, job := range due {
+			s.runJob(job)
+		}
+
+		if len(due) > 0 {
+			continue
+		}
+
+		// Since Go 1.23, Reset discards a pending expiry, so the timer needs
+		// no draining when a wake-up wins the race.
+		timer.Reset(wait)
+		select {
+		case <-s.stop:
+			return
+		case <-s.wake:
+		case <-timer.C:
+		}
+	}
+}
+
+// due collects the jobs whose time has come and reschedules them, returning
+// how long to sleep when none are due.
+func (s *Scheduler) due(now time.Time) ([]*Job, time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var due []*Job
+	wait := time.Hour
+	for job := range s.jobs {
+		if !job.next.After(now) {
+			due = append(due, job)
+			job.next = now.Add(job.interval)
+			continue
+		}
+		wait = min(wait, job.next.Sub(now))
+	}
+
+	return due, wait
+}
+
+func (s *Scheduler) runJob(job *Job) {
+	job.running.Lock()
+	defer job.running.Unlock()
+
+	if job.removed {
+		return
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			s.log.Errorw("Scheduled job panicked", "panic", r)
+		}
+	}()
+	job.fn()
+}
@@ -0,0 +1,26 @@
+package secondary
+
+import "sync"
+
+// field indexes the values found at one JSON path.
+type field struct {
+	path    string
+	members []string
+	keys    map[string]map[string]struct{} // Value to the keys holding it
+}
+
+type Index struct {
+	mu     sync.RWMutex
+	fields []*field
+	byPath map[string]*field
+	// values remembers what every indexed key contributed, per field, so a
+	// rewrite or delete can take it back out.
+	values map[string][][]string
+}
+
+// Tags indexes records by the names of their metadata tags.
+type Tags struct {
+	mu    sync.RWMutex
+	keys  map[string]map[string]struct{} // Tag to the keys carrying it
+	byKey map[string][]string
+}
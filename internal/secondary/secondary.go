@@ -0,0 +1,182 @@
+package secondary
+
+import (
+	"bytes"
+	"encoding/json"
+	"slices"
+
+	"github.com/iamBelugaa/kvix/pkg/options"
+)
+
+// New indexes the values found at paths, which must be valid for
+// options.SplitJSONPath.
+func New(paths []string) (*Index, error) {
+	idx := &Index{
+		byPath: make(map[string]*field, len(paths)),
+		values: make(map[string][][]string),
+	}
+
+	for _, path := range paths {
+		members, err := options.SplitJSONPath(path)
+		if err != nil {
+			return nil, err
+		}
+
+		f := &field{path: path, members: members, keys: make(map[string]map[string]struct{})}
+		idx.fields = append(idx.fields, f)
+		idx.byPath[path] = f
+	}
+	return idx, nil
+}
+
+// Paths returns the indexed paths in the order they were configured.
+func (idx *Index) Paths() []string {
+	paths := make([]string, len(idx.fields))
+	for i, f := range idx.fields {
+		paths[i] = f.path
+	}
+	return paths
+}
+
+// Update replaces what key contributes to the index with the values found in
+// value.
+func (idx *Index) Update(key string, value []byte) {
+	extracted := idx.extract(value)
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	idx.removeLocked(key)
+	if extracted == nil {
+		return
+	}
+
+	idx.values[key] = extracted
+	for i, f := range idx.fields {
+		for _, v := range extracted[i] {
+			keys := f.keys[v]
+			if keys == nil {
+				keys = make(map[string]struct{})
+				f.keys[v] = keys
+			}
+			keys[key] = struct{}{}
+		}
+	}
+}
+
+// Remove takes key out of the index.
+func (idx *Index) Remove(key string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.removeLocked(key)
+}
+
+func (idx *Index) removeLocked(key string) {
+	extracted, ok := idx.values[key]
+	if !ok {
+		return
+	}
+
+	delete(idx.values, key)
+	for i, f := range idx.fields {
+		for _, v := range extracted[i] {
+			delete(f.keys[v], key)
+			if len(f.keys[v]) == 0 {
+				delete(f.keys, v)
+			}
+		}
+	}
+}
+
+// Query returns the keys whose value holds value at path, sorted. The boolean
+// is false when path is not indexed.
+func (idx *Index) Query(path, value string) ([]string, bool) {
+	f, ok := idx.byPath[path]
+	if !ok {
+		return nil, false
+	}
+
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	keys := make([]string, 0, len(f.keys[value]))
+	for key := range f.keys[value] {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys, true
+}
+
+// extract returns the values of every field found in value, or nil if value
+// is not a JSON object or has none of them.
+func (idx *Index) extract(value []byte) [][]string {
+	decoder := json.NewDecoder(bytes.NewReader(value))
+	decoder.UseNumber()
+
+	var document map[string]any
+	if err := decoder.Decode(&document); err != nil {
+		return nil
+	}
+
+	var found bool
+	extracted := make([][]string, len(idx.fields))
+	for i, f := range idx.fields {
+		extracted[i] = lookup(document, f.members)
+		found = found || len(extracted[i]) != 0
+	}
+
+	if !found {
+		return nil
+	}
+	return extracted
+}
+
+// lookup descends through members and returns the scalar found there, or the
+// scalars of the array found there.
+func lookup(document map[string]any, members []string) []string {
+	var node any = document
+	for _, member := range members {
+		object, ok := node.(map[string]any)
+		if !ok {
+			return nil
+		}
+
+		if node, ok = object[member]; !ok {
+			return nil
+		}
+	}
+
+	if array, ok := node.([]any); ok {
+		var values []string
+		for _, element := range array {
+			if v, ok := scalar(element); ok && !slices.Contains(values, v) {
+				values = append(values, v)
+			}
+		}
+		return values
+	}
+
+	if v, ok := scalar(node); ok {
+		return []string{v}
+	}
+	return nil
+}
+
+// scalar renders a JSON scalar the way Query matches it: strings by their
+// contents and numbers, booleans and null by their JSON text.
+func scalar(node any) (string, bool) {
+	switch v := node.(type) {
+	case string:
+		return v, true
+	case json.Number:
+		return v.String(), true
+	case bool:
+		if v {
+			return "true", true
+		}
+		return "false", true
+	case nil:
+		return "null", true
+	}
+	return "", false
+}
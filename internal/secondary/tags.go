@@ -0,0 +1,64 @@
+package secondary
+
+import "slices"
+
+func NewTags() *Tags {
+	return &Tags{
+		keys:  make(map[string]map[string]struct{}),
+		byKey: make(map[string][]string),
+	}
+}
+
+// Update replaces the tags indexed for key with the names in tags.
+func (t *Tags) Update(key string, tags map[string]string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.removeLocked(key)
+	if len(tags) == 0 {
+		return
+	}
+
+	names := make([]string, 0, len(tags))
+	for name := range tags {
+		names = append(names, name)
+
+		keys := t.keys[name]
+		if keys == nil {
+			keys = make(map[string]struct{})
+			t.keys[name] = keys
+		}
+		keys[key] = struct{}{}
+	}
+	t.byKey[key] = names
+}
+
+// Remove takes key out of the index.
+func (t *Tags) Remove(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.removeLocked(key)
+}
+
+func (t *Tags) removeLocked(key string) {
+	for _, name := range t.byKey[key] {
+		delete(t.keys[name], key)
+		if len(t.keys[name]) == 0 {
+			delete(t.keys, name)
+		}
+	}
+	delete(t.byKey, key)
+}
+
+// Find returns the keys carrying tag, sorted.
+func (t *Tags) Find(tag string) []string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	keys := make([]string, 0, len(t.keys[tag]))
+	for key := range t.keys[tag] {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
@@ -0,0 +1,346 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	stdErrors "errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+
+	"github.com/iamBelugaa/kvix/pkg/errors"
+	"github.com/iamBelugaa/kvix/pkg/options"
+)
+
+// A value too large for one record is stored chunked: a FlagChunked record,
+// whose value is the manifest of the chunks and which carries the metadata,
+// followed straight after by FlagChunkPart records of the same key holding
+// the value a piece at a time. The index points at the first of them with
+// the size of all of them, so the whole value lies between the pointer's
+// offset and its end like any other record.
+//
+// The manifest is laid out as
+//
+//	value size  uvarint
+//	chunk count uvarint
+
+// chunkValueSize is the most of a value one chunk holds, leaving room in
+// the record's payload for the key and the framing around the value.
+const chunkValueSize = int64(options.MaxValueSize) - int64(options.MaxKeySize) - 1024
+
+// isChunkedSize reports whether a value of size bytes with metadata has to
+// be stored chunked.
+func isChunkedSize(size int64, metadata *Metadata) bool {
+	if !metadata.IsEmpty() {
+		size += int64(metadata.EncodedSize())
+	}
+	return size > chunkValueSize
+}
+
+type chunkManifest struct {
+	size   int64
+	chunks int
+}
+
+func appendManifest(buffer []byte, manifest chunkManifest) []byte {
+	buffer = binary.AppendUvarint(buffer, uint64(manifest.size))
+	return binary.AppendUvarint(buffer, uint64(manifest.chunks))
+}
+
+func parseManifest(data []byte) (chunkManifest, error) {
+	size, err := readUvarint(&data)
+	if err != nil {
+		return chunkManifest{}, err
+	}
+
+	chunks, err := readUvarint(&data)
+	if err != nil {
+		return chunkManifest{}, err
+	}
+
+	if size == 0 || size > uint64(options.MaxChunkedValueSize) || chunks == 0 || chunks > size || len(data) != 0 {
+		return chunkManifest{}, fmt.Errorf("manifest of %d bytes in %d chunks is malformed", size, chunks)
+	}
+	return chunkManifest{size: int64(size), chunks: int(chunks)}, nil
+}
+
+func manifestError(err error, segmentID uint16, offset int64) error {
+	return errors.NewStorageError(err, errors.ErrRecordDeserialization, "Failed to decode chunked value manifest").
+		WithDetail("offset", offset).
+		WithSegmentID(int(segmentID))
+}
+
+func chunkError(message string, segmentID uint16, offset int64) error {
+	return errors.NewStorageError(nil, errors.ErrRecordDeserialization, message).
+		WithDetail("offset", offset).
+		WithSegmentID(int(segmentID))
+}
+
+// setChunked appends a chunked record for a value of size bytes: the
+// manifest, then a chunk for each chunkValueSize bytes of the value, each
+// written by writeChunk. If any of it fails the segment is cut back to where
+// the manifest began, so a chunked value is either whole or not there. The
+// record returned is the manifest's, sized to cover the chunks as well.
+func (s *Storage) setChunked(
+	ctx context.Context, key []byte, size int64, metadata *Metadata, writeChunk func(size int64) error,
+) (*Record, int64, error) {
+	manifest := chunkManifest{size: size, chunks: int((size + chunkValueSize - 1) / chunkValueSize)}
+
+	record, recordOffset, err := s.set(ctx, key, appendManifest(nil, manifest), metadata, FlagChunked)
+	for remaining := size; err == nil && remaining > 0; remaining -= chunkValueSize {
+		err = writeChunk(min(remaining, chunkValueSize))
+	}
+
+	// Chunks are streamed straight from the file, so none of the value is
+	// left in the write buffer.
+	if err == nil {
+		err = s.Flush()
+	}
+	if err != nil {
+		if record != nil {
+			if truncateErr := s.TruncateSegment(s.ActiveSegmentPath(), s.activeSegmentID, s.activeSegmentCreatedAt, recordOffset); truncateErr != nil {
+				s.log.Errorw("Failed to cut back partly written chunked record", "offset", recordOffset, "error", truncateErr)
+			}
+		}
+		return nil, 0, err
+	}
+
+	record.chunkBytes = s.currentOffset.Load() - recordOffset - record.Size()
+	if err := s.syncWrite(ctx); err != nil {
+		return nil, 0, err
+	}
+
+	s.log.Debugw(
+		"Chunked record written successfully",
+		"valueSize", size,
+		"chunks", manifest.chunks,
+		"totalBytes", record.Size(),
+	)
+
+	return record, recordOffset, nil
+}
+
+// assembleChunks replaces the manifest value of record, a chunked record read
+// from offset, with the value its chunks hold.
+func (s *Storage) assembleChunks(
+	record *Record, segmentFile io.ReaderAt, compact bool, segmentID uint16, offset int64,
+	level options.VerifyLevel, watch *stopwatch,
+) error {
+	manifest, err := parseManifest(record.Value)
+	if err != nil {
+		return manifestError(err, segmentID, offset)
+	}
+
+	value, err := s.appendChunks(nil, manifest, record, segmentFile, compact, segmentID, offset, level, watch)
+	if err != nil {
+		return err
+	}
+
+	record.Value = value
+	return nil
+}
+
+// appendChunks reads the chunks that follow record, a chunked record read
+// from offset, and appends the value they hold to dst.
+func (s *Storage) appendChunks(
+	dst []byte, manifest chunkManifest, record *Record, segmentFile io.ReaderAt, compact bool, segmentID uint16,
+	offset int64, level options.VerifyLevel, watch *stopwatch,
+) ([]byte, error) {
+	dst = slices.Grow(dst, int(manifest.size))
+	start := len(dst)
+
+	first := offset + record.Header.EncodedSize() + int64(record.Header.PayloadSize)
+	next := first
+	for range manifest.chunks {
+		header, payload, pooled, err := s.readPayload(segmentFile, compact, segmentID, next, level, watch)
+		if err != nil {
+			return dst, err
+		}
+
+		chunk := Record{Header: &header}
+		err = s.decodeRecord(&chunk, payload, true, segmentID, next, watch)
+		if err == nil && (header.Flags&FlagChunkPart == 0 || !bytes.Equal(chunk.Key, record.Key)) {
+			err = chunkError("Record after a chunked record is not one of its chunks", segmentID, next)
+		}
+		if err == nil {
+			dst = append(dst, chunk.Value...)
+		}
+		if pooled != nil {
+			putBuffer(pooled)
+		}
+		if err != nil {
+			return dst, err
+		}
+
+		next += header.EncodedSize() + int64(header.PayloadSize)
+	}
+
+	if int64(len(dst)-start) != manifest.size {
+		return dst, chunkError(
+			fmt.Sprintf("Chunks hold %d bytes of a %d byte value", len(dst)-start, manifest.size), segmentID, offset,
+		)
+	}
+
+	record.chunkBytes = next - first
+	return dst, nil
+}
+
+// chunkReader returns a reader streaming the value of the chunked record at
+// offset a chunk at a time. It takes over release, and the caller must hold
+// segmentMu.
+func (s *Storage) chunkReader(
+	ctx context.Context, key []byte, segmentFile io.ReaderAt, compact bool, segmentID uint16, segmentTimestamp int64,
+	offset int64, release func(),
+) (io.ReadCloser, error) {
+	record, err := s.readRecord(segmentFile, compact, segmentID, offset, s.verifyLevelFor(ctx), nil)
+	if err == nil && s.verifiesKey(ctx) && !bytes.Equal(record.Key, key) {
+		err = keyMismatchError(record.Key, segmentID, offset)
+	}
+	if err != nil {
+		release()
+		return nil, err
+	}
+
+	manifest, err := parseManifest(record.Value)
+	if err != nil {
+		release()
+		return nil, manifestError(err, segmentID, offset)
+	}
+
+	// As for a single record, the active segment is read through a handle
+	// of its own so that Rotate cannot close it underneath the reader.
+	if s.isActive(segmentID, segmentTimestamp) {
+		file, err := s.options.FileSystem.OpenFile(s.ActiveSegmentPath(), os.O_RDONLY, 0644)
+		if err != nil {
+			release()
+			return nil, errors.NewStorageError(err, errors.ErrIOGeneral, "Failed to open active segment for streaming").
+				WithSegmentID(int(segmentID))
+		}
+		segmentFile, release = file, func() { file.Close() }
+	}
+
+	return &chunkStream{
+		storage:     s,
+		ctx:         ctx,
+		key:         record.Key,
+		segmentFile: segmentFile,
+		compact:     compact,
+		segmentID:   segmentID,
+		offset:      offset,
+		next:        offset + record.Header.EncodedSize() + int64(record.Header.PayloadSize),
+		remaining:   manifest.chunks,
+		size:        manifest.size,
+		release:     release,
+	}, nil
+}
+
+// chunkStream reads a chunked value by streaming each of its chunks in turn,
+// all from the one segment file it holds open.
+type chunkStream struct {
+	storage *Storage
+	// ctx is only consulted for the verify level of each chunk. key is the
+	// manifest's, which every chunk carries; under Deduplicate it need not
+	// be the key the value was read for.
+	ctx         context.Context
+	key         []byte
+	segmentFile io.ReaderAt
+	compact     bool
+	segmentID   uint16
+	offset      int64
+	next        int64
+	remaining   int
+	size        int64
+	read        int64
+	current     io.ReadCloser
+	release     func()
+	err         error
+}
+
+func (c *chunkStream) Read(p []byte) (int, error) {
+	for c.err == nil {
+		if c.current == nil {
+			if c.err = c.openChunk(); c.err != nil {
+				break
+			}
+		}
+
+		n, err := c.current.Read(p)
+		c.read += int64(n)
+		if stdErrors.Is(err, io.EOF) {
+			c.current.Close()
+			c.current = nil
+			err = nil
+			if n == 0 {
+				continue
+			}
+		}
+
+		c.err = err
+		return n, err
+	}
+	return 0, c.err
+}
+
+// openChunk opens the next chunk, or returns io.EOF once all of them have
+// been read and add up to the value.
+func (c *chunkStream) openChunk() error {
+	if c.remaining == 0 {
+		if c.read != c.size {
+			return chunkError(fmt.Sprintf("Chunks hold %d bytes of a %d byte value", c.read, c.size), c.segmentID, c.offset)
+		}
+		return io.EOF
+	}
+
+	s := c.storage
+	s.segmentMu.RLock()
+	defer s.segmentMu.RUnlock()
+
+	header, err := s.readHeader(c.segmentFile, c.compact, c.segmentID, c.next)
+	if err != nil {
+		return err
+	}
+	if header.Flags&FlagChunkPart == 0 {
+		return chunkError("Record after a chunked record is not one of its chunks", c.segmentID, c.next)
+	}
+
+	if header.Flags&FlagEncrypted != 0 {
+		record, err := s.readRecord(c.segmentFile, c.compact, c.segmentID, c.next, s.verifyLevelFor(c.ctx), nil)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(record.Key, c.key) {
+			return keyMismatchError(record.Key, c.segmentID, c.next)
+		}
+		c.current = io.NopCloser(bytes.NewReader(record.Value))
+	} else {
+		stream := &valueStream{header: header, segmentID: c.segmentID, offset: c.next, release: func() {}}
+		if err := s.openStream(c.ctx, stream, c.segmentFile, c.key, c.next+header.EncodedSize()); err != nil {
+			stream.Close()
+			return err
+		}
+		c.current = stream
+	}
+
+	c.next += header.EncodedSize() + int64(header.PayloadSize)
+	c.remaining--
+	return nil
+}
+
+// Close releases the segment file the value was streamed from. It is safe
+// to call more than once.
+func (c *chunkStream) Close() error {
+	if c.release == nil {
+		return nil
+	}
+
+	if c.current != nil {
+		c.current.Close()
+		c.current = nil
+	}
+	c.release()
+	c.release = nil
+	c.err = os.ErrClosed
+	return nil
+}
@@ -0,0 +1,224 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/binary"
+	stdErrors "errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+
+	"github.com/iamBelugaa/kvix/pkg/checksum"
+	"github.com/iamBelugaa/kvix/pkg/options"
+)
+
+// Records of segments created with options.FramingCompact carry a header of
+// CompactSchemaVersion, laid out as
+//
+//	version      1 byte, CompactSchemaVersion
+//	flags        1 byte
+//	algorithm    1 byte
+//	payload size uvarint
+//	timestamp    varint
+//	checksum     4 or 8 bytes, as wide as the algorithm's
+//	key version  uvarint, encrypted records only
+//	header CRC   4 bytes, a CRC32 of the bytes before it
+//
+// and a payload of the key's length as a uvarint, the key and the value,
+// which runs to the end of the payload.
+
+// maxCompactRecordHeaderSize is the largest encoded compact header.
+const maxCompactRecordHeaderSize = 3 + binary.MaxVarintLen32 + binary.MaxVarintLen64 + 8 + binary.MaxVarintLen32 + 4
+
+// isCompact reports whether h is a compact header.
+func (h *RecordHeader) isCompact() bool {
+	return h.Version == options.CompactSchemaVersion
+}
+
+func (h *RecordHeader) compactSize() int64 {
+	size := 3 + uvarintSize(uint64(h.PayloadSize)) + varintSize(h.Timestamp) + h.ChecksumAlgorithm.Size() + 4
+	if h.Flags&FlagEncrypted != 0 {
+		size += uvarintSize(uint64(h.KeyVersion))
+	}
+	return int64(size)
+}
+
+func (h *RecordHeader) appendCompact(buffer []byte) []byte {
+	start := len(buffer)
+	buffer = append(buffer, h.Version, byte(h.Flags), byte(h.ChecksumAlgorithm))
+	buffer = binary.AppendUvarint(buffer, uint64(h.PayloadSize))
+	buffer = binary.AppendVarint(buffer, h.Timestamp)
+
+	if h.ChecksumAlgorithm.Size() == 8 {
+		buffer = binary.LittleEndian.AppendUint64(buffer, h.Checksum)
+	} else {
+		buffer = binary.LittleEndian.AppendUint32(buffer, uint32(h.Checksum))
+	}
+
+	if h.Flags&FlagEncrypted != 0 {
+		buffer = binary.AppendUvarint(buffer, uint64(h.KeyVersion))
+	}
+	return binary.LittleEndian.AppendUint32(buffer, crc32.ChecksumIEEE(buffer[start:]))
+}
+
+// decodeCompactHeader decodes the compact header at the start of buffer,
+// which may hold more bytes than the header. It fails with
+// io.ErrUnexpectedEOF when buffer ends inside the header, and with
+// ErrCorruptHeader when the bytes cannot be a compact header.
+func decodeCompactHeader(buffer []byte) (RecordHeader, error) {
+	if len(buffer) < 3 {
+		return RecordHeader{}, io.ErrUnexpectedEOF
+	}
+
+	header := RecordHeader{
+		Version:           buffer[0],
+		Flags:             RecordFlags(buffer[1]),
+		ChecksumAlgorithm: checksum.Algorithm(buffer[2]),
+	}
+	if header.Version != options.CompactSchemaVersion {
+		return header, fmt.Errorf("%w: schema version %d in a compact segment", ErrCorruptHeader, header.Version)
+	}
+
+	rest := buffer[3:]
+	payloadSize, err := readUvarint(&rest)
+	if err != nil {
+		return header, err
+	}
+	if payloadSize > uint64(^uint32(0)) {
+		return header, fmt.Errorf("%w: payload size overflows", ErrCorruptHeader)
+	}
+	header.PayloadSize = uint32(payloadSize)
+
+	timestamp, read := binary.Varint(rest)
+	if read <= 0 {
+		return header, varintError(read)
+	}
+	header.Timestamp = timestamp
+	rest = rest[read:]
+
+	width := header.ChecksumAlgorithm.Size()
+	if len(rest) < width {
+		return header, io.ErrUnexpectedEOF
+	}
+	if width == 8 {
+		header.Checksum = binary.LittleEndian.Uint64(rest)
+	} else {
+		header.Checksum = uint64(binary.LittleEndian.Uint32(rest))
+	}
+	rest = rest[width:]
+
+	if header.Flags&FlagEncrypted != 0 {
+		keyVersion, err := readUvarint(&rest)
+		if err != nil {
+			return header, err
+		}
+		header.KeyVersion = uint32(keyVersion)
+	}
+
+	if len(rest) < 4 {
+		return header, io.ErrUnexpectedEOF
+	}
+
+	size := len(buffer) - len(rest)
+	if crc32.ChecksumIEEE(buffer[:size]) != binary.LittleEndian.Uint32(rest) {
+		return header, fmt.Errorf("%w: header checksum mismatch", ErrCorruptHeader)
+	}
+	return header, nil
+}
+
+// readRecordHeaderAt reads the header of the record at offset of a segment
+// whose records are compact or not.
+func readRecordHeaderAt(r io.ReaderAt, offset int64, compact bool) (RecordHeader, error) {
+	if !compact {
+		return readRecordHeader(io.NewSectionReader(r, offset, MaxRecordHeaderSize))
+	}
+
+	buffer := make([]byte, maxCompactRecordHeaderSize)
+	read, err := r.ReadAt(buffer, offset)
+	if read == 0 {
+		return RecordHeader{}, err
+	}
+	if err != nil && !stdErrors.Is(err, io.EOF) {
+		return RecordHeader{}, err
+	}
+	return decodeCompactHeader(buffer[:read])
+}
+
+// scanRecordHeader reads the header of the next record of a segment scanned
+// through r.
+func scanRecordHeader(r *bufio.Reader, compact bool) (RecordHeader, error) {
+	if !compact {
+		return readRecordHeader(r)
+	}
+
+	buffer, err := r.Peek(maxCompactRecordHeaderSize)
+	if len(buffer) == 0 {
+		return RecordHeader{}, err
+	}
+
+	header, err := decodeCompactHeader(buffer)
+	if err != nil {
+		return header, err
+	}
+
+	_, err = r.Discard(int(header.compactSize()))
+	return header, err
+}
+
+func (r *Record) appendCompactPayload(buffer []byte) []byte {
+	buffer = binary.AppendUvarint(buffer, uint64(len(r.Key)))
+	buffer = append(buffer, r.Key...)
+	return append(buffer, r.Value...)
+}
+
+// unmarshalCompact decodes data into r in place: the key and value are
+// slices of data.
+func (r *Record) unmarshalCompact(data []byte) error {
+	keySize, read := binary.Uvarint(data)
+	if read <= 0 {
+		return stdErrors.New("malformed key length")
+	}
+	data = data[read:]
+
+	if keySize == 0 || keySize > uint64(len(data)) {
+		return ErrNilKey
+	}
+	if keySize == uint64(len(data)) {
+		return ErrNilValue
+	}
+
+	r.Key = data[:keySize]
+	r.Value = data[keySize:]
+	return nil
+}
+
+// detach copies the key and value of r, decoded in place, into memory of
+// their own, so the buffer they were decoded from can be reused.
+func (r *Record) detach() {
+	owned := make([]byte, len(r.Key)+len(r.Value))
+	n := copy(owned, r.Key)
+	copy(owned[n:], r.Value)
+	r.Key, r.Value = owned[:n:n], owned[n:]
+}
+
+// readUvarint decodes a uvarint from the start of buffer and moves buffer
+// past it.
+func readUvarint(buffer *[]byte) (uint64, error) {
+	value, read := binary.Uvarint(*buffer)
+	if read <= 0 {
+		return 0, varintError(read)
+	}
+	*buffer = (*buffer)[read:]
+	return value, nil
+}
+
+func varintError(read int) error {
+	if read == 0 {
+		return io.ErrUnexpectedEOF
+	}
+	return fmt.Errorf("%w: varint overflows", ErrCorruptHeader)
+}
+
+func varintSize(value int64) int {
+	return uvarintSize(uint64(value<<1) ^ uint64(value>>63))
+}
@@ -0,0 +1,56 @@
+package storage
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+
+	"github.com/iamBelugaa/kvix/pkg/options"
+)
+
+// compressValue deflates value when compression is enabled and the value is
+// at least the configured threshold. It reports false, leaving the value to be
+// stored as is, when the compressed form would not be smaller.
+func (s *Storage) compressValue(value []byte) ([]byte, bool, error) {
+	threshold := s.options.CompressionThreshold
+	if threshold <= 0 || len(value) < threshold {
+		return value, false, nil
+	}
+
+	var buffer bytes.Buffer
+	writer, err := flate.NewWriter(&buffer, flate.BestSpeed)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if _, err := writer.Write(value); err != nil {
+		return nil, false, err
+	}
+
+	if err := writer.Close(); err != nil {
+		return nil, false, err
+	}
+
+	if buffer.Len() >= len(value) {
+		return value, false, nil
+	}
+	return buffer.Bytes(), true, nil
+}
+
+func decompressValue(compressed []byte) ([]byte, error) {
+	reader := flate.NewReader(bytes.NewReader(compressed))
+	defer reader.Close()
+
+	// A corrupted stream must not be able to inflate past the largest value
+	// kvix would ever have accepted.
+	value, err := io.ReadAll(io.LimitReader(reader, int64(options.MaxValueSize)+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(value) > int(options.MaxValueSize) {
+		return nil, fmt.Errorf("decompressed value exceeds %d bytes", options.MaxValueSize)
+	}
+	return value, nil
+}
@@ -0,0 +1,139 @@
+package storage
+
+import (
+	stdErrors "errors"
+	"io"
+	"os"
+
+	"github.com/iamBelugaa/kvix/pkg/filesys"
+)
+
+// directWriter appends to a segment opened for direct I/O, which only takes
+// whole aligned blocks written from aligned memory. It keeps the partially
+// filled last block in memory, writes it again together with each append,
+// and truncates the zero padding of the final block off again.
+type directWriter struct {
+	file filesys.File
+	size int64
+	// tail holds the block size falls into; its first size%alignment bytes
+	// are the segment's.
+	tail   []byte
+	buffer []byte
+}
+
+func newDirectWriter(file filesys.File, size int64) (*directWriter, error) {
+	writer := &directWriter{file: file, tail: filesys.AlignedBuffer(filesys.DirectIOAlignment)}
+	if err := writer.reset(size); err != nil {
+		return nil, err
+	}
+	return writer, nil
+}
+
+// reset continues appending at size, after the segment was truncated.
+func (w *directWriter) reset(size int64) error {
+	w.size = size
+	clear(w.tail)
+
+	start := filesys.AlignDown(size)
+	if start == size {
+		return nil
+	}
+
+	if _, err := w.file.ReadAt(w.tail, start); err != nil && !stdErrors.Is(err, io.EOF) {
+		return err
+	}
+	return nil
+}
+
+// patch overwrites the segment at offset with p, which must end before the
+// end of the segment, rewriting the blocks it falls into.
+func (w *directWriter) patch(p []byte, offset int64) error {
+	start := filesys.AlignDown(offset)
+	buffer := filesys.AlignedBuffer(int(filesys.AlignUp(offset+int64(len(p))) - start))
+	if _, err := w.file.ReadAt(buffer, start); err != nil && !stdErrors.Is(err, io.EOF) {
+		return err
+	}
+
+	copy(buffer[offset-start:], p)
+	if _, err := w.file.WriteAt(buffer, start); err != nil {
+		return err
+	}
+	if err := w.file.Truncate(w.size); err != nil {
+		return err
+	}
+
+	// The last block is written again from tail by the next append.
+	if tailStart := filesys.AlignDown(w.size); tailStart < start+int64(len(buffer)) {
+		copy(w.tail, buffer[tailStart-start:])
+	}
+	return nil
+}
+
+// append writes chunks one after another at the end of the segment.
+func (w *directWriter) append(chunks ...[]byte) error {
+	start := filesys.AlignDown(w.size)
+	length := int(w.size - start)
+	for _, chunk := range chunks {
+		length += len(chunk)
+	}
+
+	blocks := int(filesys.AlignUp(int64(length)))
+	if cap(w.buffer) < blocks {
+		w.buffer = filesys.AlignedBuffer(blocks)
+	}
+	buffer := w.buffer[:blocks]
+
+	n := copy(buffer, w.tail[:w.size-start])
+	for _, chunk := range chunks {
+		n += copy(buffer[n:], chunk)
+	}
+	clear(buffer[n:])
+
+	if _, err := w.file.WriteAt(buffer, start); err != nil {
+		return err
+	}
+
+	end := start + int64(n)
+	if err := w.file.Truncate(end); err != nil {
+		return err
+	}
+
+	clear(w.tail)
+	copy(w.tail, buffer[filesys.AlignDown(end)-start:])
+	w.size = end
+	return nil
+}
+
+// useDirectIO reopens the active segment at path for direct I/O when
+// DirectIO is set, and returns the file to keep with the writer to append
+// through. Where direct I/O is unavailable it keeps file, with a nil writer.
+func (s *Storage) useDirectIO(file filesys.File, path string, size int64) (filesys.File, *directWriter) {
+	if !s.options.DirectIO {
+		return file, nil
+	}
+
+	// Appends are positioned writes, which files opened with O_APPEND
+	// refuse, so the segment is opened a second time.
+	direct, err := s.options.FileSystem.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		s.log.Warnw("Falling back to buffered I/O for segment", "path", path, "error", err)
+		return file, nil
+	}
+
+	var writer *directWriter
+	if err = filesys.SetDirectIO(direct); err == nil {
+		writer, err = newDirectWriter(direct, size)
+	}
+	if err != nil {
+		s.log.Warnw("Falling back to buffered I/O for segment", "path", path, "error", err)
+		if closeErr := direct.Close(); closeErr != nil {
+			s.log.Warnw("Failed to close direct segment handle", "path", path, "error", closeErr)
+		}
+		return file, nil
+	}
+
+	if err := file.Close(); err != nil {
+		s.log.Warnw("Failed to close buffered segment handle", "path", path, "error", err)
+	}
+	return direct, writer
+}
@@ -0,0 +1,113 @@
+package storage
+
+import (
+	stdErrors "errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/iamBelugaa/kvix/pkg/errors"
+	"github.com/iamBelugaa/kvix/pkg/seginfo"
+)
+
+var ErrNoKeyProvider = stdErrors.New("record is encrypted but no key provider is configured")
+
+// KeyVersion returns the key new records are encrypted with, or zero when
+// encryption is disabled.
+func (s *Storage) KeyVersion() uint32 {
+	return s.keyVersion
+}
+
+// currentKeyVersion asks the key provider for its current version and makes
+// sure the key behind it is usable before any record is written with it.
+func (s *Storage) currentKeyVersion() (uint32, error) {
+	version := s.cipher.CurrentVersion()
+	if _, err := s.cipher.Seal(version, nil, nil); err != nil {
+		return 0, errors.NewValidationError(
+			err, errors.ErrSystemInvalidInput, fmt.Sprintf("Encryption key version %d is not usable", version),
+		)
+	}
+	return version, nil
+}
+
+func (s *Storage) openValue(record *Record) ([]byte, error) {
+	if s.cipher == nil {
+		return nil, ErrNoKeyProvider
+	}
+	return s.cipher.Open(record.Header.KeyVersion, record.Value, record.Key)
+}
+
+// Rotate seals the active segment and continues in a new one, which is
+// written with the key provider's current key version. Records in older
+// segments keep the version they were written with. The caller must keep
+// writers away while the segment is swapped.
+func (s *Storage) Rotate() error {
+	if s.activeSegmentID == math.MaxUint16 {
+		return errors.NewStorageError(nil, errors.ErrSystemInternal, "Segment IDs are exhausted").
+			WithSegmentID(int(s.activeSegmentID))
+	}
+
+	keyVersion := s.keyVersion
+	if s.cipher != nil {
+		var err error
+		if keyVersion, err = s.currentKeyVersion(); err != nil {
+			return err
+		}
+	}
+
+	segmentID := s.activeSegmentID + 1
+	timestamp := time.Now().UnixNano()
+	fileName := seginfo.GenerateNameWithTimestamp(segmentID, s.options.SegmentOptions.Prefix, timestamp)
+	filePath := filepath.Join(s.options.SegmentOptions.Directory, fileName)
+
+	if err := s.Sync(); err != nil {
+		return err
+	}
+
+	file, err := s.options.FileSystem.OpenFile(filePath, os.O_CREATE|os.O_EXCL|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return errors.NewStorageError(err, errors.ErrIOGeneral, "Failed to create segment file").
+			WithPath(filePath).
+			WithFileName(fileName)
+	}
+
+	offset, err := s.writeSegmentHeader(file, segmentID, timestamp)
+	if err != nil {
+		if closeErr := file.Close(); closeErr != nil {
+			s.log.Warnw("Failed to close segment after header error", "fileName", fileName, "error", closeErr)
+		}
+		return err
+	}
+
+	file, direct := s.useDirectIO(file, filePath, offset)
+
+	previousID, previousTimestamp, previousPath := s.activeSegmentID, s.activeSegmentCreatedAt, s.ActiveSegmentPath()
+
+	s.segmentMu.Lock()
+	previous := s.activeSegment
+	s.activeSegment = file
+	s.direct = direct
+	if s.buffer != nil {
+		s.buffer.reset(offset)
+	}
+	s.activeSegmentID = segmentID
+	s.activeSegmentCreatedAt = timestamp
+	s.activeCompact = s.compactFraming()
+	s.currentOffset.Store(offset)
+	s.keyVersion = keyVersion
+	s.segmentMu.Unlock()
+
+	if err := previous.Close(); err != nil {
+		return errors.NewStorageError(err, errors.ErrIOCloseFailed, "Failed to close sealed segment").
+			WithFileName(previous.Name())
+	}
+
+	if err := s.sealSegment(previousPath, previousID, previousTimestamp); err != nil {
+		return err
+	}
+
+	s.log.Infow("Rotated active segment", "segmentID", segmentID, "keyVersion", keyVersion)
+	return nil
+}
@@ -0,0 +1,149 @@
+package storage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"slices"
+
+	"github.com/iamBelugaa/kvix/pkg/options"
+)
+
+// Metadata describes a value for the application that stored it, such as
+// its encoding, without being part of the value itself.
+type Metadata struct {
+	ContentType string            `json:"contentType,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"`
+}
+
+// IsEmpty reports whether m carries nothing worth storing.
+func (m *Metadata) IsEmpty() bool {
+	return m == nil || (m.ContentType == "" && len(m.Tags) == 0)
+}
+
+// Validate checks m against MaxContentTypeSize, MaxMetadataTags and
+// MaxMetadataSize.
+func (m *Metadata) Validate() error {
+	if m == nil {
+		return nil
+	}
+
+	if len(m.ContentType) > options.MaxContentTypeSize {
+		return fmt.Errorf("content type is %d bytes, more than the %d allowed", len(m.ContentType), options.MaxContentTypeSize)
+	}
+
+	if len(m.Tags) > options.MaxMetadataTags {
+		return fmt.Errorf("metadata has %d tags, more than the %d allowed", len(m.Tags), options.MaxMetadataTags)
+	}
+
+	for name := range m.Tags {
+		if name == "" {
+			return fmt.Errorf("metadata tag names cannot be empty")
+		}
+	}
+
+	if size := m.EncodedSize(); size > options.MaxMetadataSize {
+		return fmt.Errorf("metadata encodes to %d bytes, more than the %d allowed", size, options.MaxMetadataSize)
+	}
+	return nil
+}
+
+// EncodedSize returns the bytes AppendMetadata adds ahead of a value.
+func (m *Metadata) EncodedSize() int {
+	body := m.bodySize()
+	return uvarintSize(uint64(body)) + body
+}
+
+func (m *Metadata) bodySize() int {
+	size := uvarintSize(uint64(len(m.ContentType))) + len(m.ContentType) + uvarintSize(uint64(len(m.Tags)))
+	for name, value := range m.Tags {
+		size += uvarintSize(uint64(len(name))) + len(name) + uvarintSize(uint64(len(value))) + len(value)
+	}
+	return size
+}
+
+// AppendMetadata frames m ahead of a value, as stored in records carrying
+// FlagMetadata: the length of the block, then the content type and the tags
+// in name order, each string prefixed with its length.
+func AppendMetadata(buffer []byte, m *Metadata) []byte {
+	buffer = binary.AppendUvarint(buffer, uint64(m.bodySize()))
+	buffer = appendString(buffer, m.ContentType)
+	buffer = binary.AppendUvarint(buffer, uint64(len(m.Tags)))
+
+	names := make([]string, 0, len(m.Tags))
+	for name := range m.Tags {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	for _, name := range names {
+		buffer = appendString(buffer, name)
+		buffer = appendString(buffer, m.Tags[name])
+	}
+	return buffer
+}
+
+// SplitMetadata separates the metadata framed by AppendMetadata from the
+// value that follows it.
+func SplitMetadata(data []byte) (*Metadata, []byte, error) {
+	size, n := binary.Uvarint(data)
+	if n <= 0 || size > uint64(len(data)-n) {
+		return nil, nil, fmt.Errorf("metadata block is truncated")
+	}
+
+	block := data[n : n+int(size)]
+	value := data[n+int(size):]
+
+	contentType, block, err := readString(block)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	count, n := binary.Uvarint(block)
+	if n <= 0 || count > uint64(len(block)) {
+		return nil, nil, fmt.Errorf("metadata tag count is corrupt")
+	}
+	block = block[n:]
+
+	metadata := &Metadata{ContentType: contentType}
+	if count > 0 {
+		metadata.Tags = make(map[string]string, count)
+	}
+
+	for range count {
+		var name, tag string
+		if name, block, err = readString(block); err != nil {
+			return nil, nil, err
+		}
+		if tag, block, err = readString(block); err != nil {
+			return nil, nil, err
+		}
+		metadata.Tags[name] = tag
+	}
+
+	if len(block) != 0 {
+		return nil, nil, fmt.Errorf("metadata block has %d trailing bytes", len(block))
+	}
+	return metadata, value, nil
+}
+
+func appendString(buffer []byte, s string) []byte {
+	buffer = binary.AppendUvarint(buffer, uint64(len(s)))
+	return append(buffer, s...)
+}
+
+func readString(data []byte) (string, []byte, error) {
+	length, n := binary.Uvarint(data)
+	if n <= 0 || length > uint64(len(data)-n) {
+		return "", nil, fmt.Errorf("metadata string is truncated")
+	}
+	return string(data[n : n+int(length)]), data[n+int(length):], nil
+}
+
+func uvarintSize(v uint64) int {
+	size := 1
+	for v >= 0x80 {
+		v >>= 7
+		size++
+	}
+	return size
+}
@@ -1,15 +1,24 @@
 package storage
 
 import (
+	"encoding/binary"
 	stdErrors "errors"
-	"os"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sync"
+	"sync/atomic"
 
 	"go.uber.org/zap"
+	"google.golang.org/protobuf/encoding/protowire"
 	"google.golang.org/protobuf/proto"
 
 	kvixpb "github.com/iamBelugaa/kvix/internal/storage/__proto__"
 	"github.com/iamBelugaa/kvix/internal/storage/segmentpool"
 	"github.com/iamBelugaa/kvix/pkg/checksum"
+	"github.com/iamBelugaa/kvix/pkg/encryption"
+	"github.com/iamBelugaa/kvix/pkg/errors"
+	"github.com/iamBelugaa/kvix/pkg/filesys"
 	"github.com/iamBelugaa/kvix/pkg/options"
 )
 
@@ -18,46 +27,361 @@ var (
 	ErrNilValue        = stdErrors.New("nil value")
 	ErrNilHeader       = stdErrors.New("nil header")
 	ErrInvalidChecksum = stdErrors.New("invalid checksum")
+	// ErrCorruptHeader is returned for MagicSchemaVersion headers whose
+	// marker or header checksum does not match: the bytes read are not a
+	// record header, because the offset is wrong or the segment is damaged.
+	ErrCorruptHeader = stdErrors.New("corrupt record header")
 )
 
 type Storage struct {
 	options                *options.Options
 	log                    *zap.SugaredLogger
-	currentOffset          int64
+	currentOffset          atomic.Int64
 	activeSegmentCreatedAt int64
 	activeSegmentID        uint16
-	activeSegment          *os.File
-	checksummer            *checksum.CRC32IEEE
+	activeSegment          filesys.File
+	checksummer            checksum.Checksummer
+	checksummers           map[checksum.Algorithm]checksum.Checksummer
 	segmentPool            *segmentpool.SegmentPool
+	// cipher is nil unless a key provider is configured. keyVersion is the
+	// key the active segment is written with.
+	cipher     *encryption.Cipher
+	keyVersion uint32
+	// activeCompact is set when the active segment's records use the
+	// compact framing.
+	activeCompact bool
+	// direct appends to activeSegment when it was opened for direct I/O.
+	direct *directWriter
+	// buffer is nil unless WriteBufferSize is set.
+	buffer *writeBuffer
+	// syncAlways starts out as SyncPolicy == SyncAlways and follows
+	// SetSyncPolicy.
+	syncAlways atomic.Bool
+	// verifyLevel starts out as ReadVerification and follows SetVerifyLevel.
+	verifyLevel atomic.Uint32
+	// segmentMu lets Rotate swap the active segment while Get reads it.
+	segmentMu sync.RWMutex
 }
 
 type Record struct {
 	Header *RecordHeader
 	Key    []byte
 	Value  []byte
+	// Metadata is nil unless the value was stored with some.
+	Metadata *Metadata
+	// chunkBytes is the size of the chunk records written after a chunked
+	// record by Set.
+	chunkBytes int64
 }
 
 type RecordHeader struct {
+	// Checksum holds 32-bit checksums in its lower half. The upper half is
+	// only stored for 64-bit algorithms.
+	Checksum    uint64
+	PayloadSize uint32
+	Timestamp   int64
+	Version     uint8
+	// ChecksumAlgorithm is only stored by ChecksumSchemaVersion headers;
+	// older records are always CRC32-IEEE.
+	ChecksumAlgorithm checksum.Algorithm
+	// Flags are only stored by FlagsSchemaVersion headers.
+	Flags RecordFlags
+	// KeyVersion names the encryption key of the value and is only stored
+	// when FlagEncrypted is set.
+	KeyVersion uint32
+}
+
+// RecordFlags describe how a record's payload was stored.
+type RecordFlags uint8
+
+const (
+	// FlagCompressed marks a value stored DEFLATE-compressed.
+	FlagCompressed RecordFlags = 1 << iota
+	// FlagEncrypted marks a value sealed with AES-GCM. Compressed values are
+	// compressed before they are encrypted.
+	FlagEncrypted
+	// FlagMetadata marks a value preceded by its Metadata, framed by
+	// AppendMetadata. The frame is compressed and encrypted with the value.
+	FlagMetadata
+	// FlagChunked marks a value too large for one record, whose stored value
+	// is the manifest of the FlagChunkPart records holding it.
+	FlagChunked
+	// FlagChunkPart marks a record holding one piece of a chunked value. It
+	// is only read through the manifest that precedes it.
+	FlagChunkPart
+)
+
+// recordHeaderPrefix is the fixed layout every header starts with. Version
+// comes last, so readers learn whether more header bytes follow.
+type recordHeaderPrefix struct {
 	Checksum    uint32
 	PayloadSize uint32
 	Timestamp   int64
 	Version     uint8
 }
 
-func (r *Record) MarshalProto() ([]byte, error) {
-	record := kvixpb.Record{
-		Key:   r.Key,
-		Value: r.Value,
+var recordHeaderPrefixSize = int64(binary.Size(recordHeaderPrefix{}))
+
+// recordMagic ends every MagicSchemaVersion header, ahead of the header
+// checksum. It is "KV" when read as bytes.
+const recordMagic uint16 = 0x564B
+
+// recordTrailerSize is the magic and header checksum of MagicSchemaVersion
+// headers.
+const recordTrailerSize = 2 + 4
+
+// MaxRecordHeaderSize is the largest encoded header of any schema version
+// other than CompactSchemaVersion: the prefix, the algorithm and flags bytes,
+// the upper half of a 64-bit checksum, the key version of an encrypted value
+// and the trailer.
+var MaxRecordHeaderSize = recordHeaderPrefixSize + 1 + 1 + 4 + 4 + recordTrailerSize
+
+// EncodedSize returns the number of bytes the header occupies on disk.
+func (h *RecordHeader) EncodedSize() int64 {
+	if h.isCompact() {
+		return h.compactSize()
+	}
+
+	size := recordHeaderPrefixSize
+	if h.Version >= options.ChecksumSchemaVersion {
+		size++
+		if h.ChecksumAlgorithm.Size() == 8 {
+			size += 4
+		}
+	}
+
+	if h.Version >= options.FlagsSchemaVersion {
+		size++
+		if h.Flags&FlagEncrypted != 0 {
+			size += 4
+		}
+	}
+
+	if h.Version >= options.MagicSchemaVersion {
+		size += recordTrailerSize
+	}
+	return size
+}
+
+func (h *RecordHeader) MarshalBinary() ([]byte, error) {
+	return h.appendBinary(make([]byte, 0, h.EncodedSize())), nil
+}
+
+// appendBinary appends the encoded header to buffer.
+func (h *RecordHeader) appendBinary(buffer []byte) []byte {
+	if h.isCompact() {
+		return h.appendCompact(buffer)
+	}
+
+	start := len(buffer)
+	buffer = h.appendFields(buffer)
+	if h.Version >= options.MagicSchemaVersion {
+		buffer = binary.LittleEndian.AppendUint32(buffer, crc32.ChecksumIEEE(buffer[start:]))
+	}
+	return buffer
+}
+
+// appendFields appends the header to buffer up to, and not including, the
+// header checksum. The prefix is laid out field by field as
+// recordHeaderPrefix, which readers decode.
+func (h *RecordHeader) appendFields(buffer []byte) []byte {
+	buffer = binary.LittleEndian.AppendUint32(buffer, uint32(h.Checksum))
+	buffer = binary.LittleEndian.AppendUint32(buffer, h.PayloadSize)
+	buffer = binary.LittleEndian.AppendUint64(buffer, uint64(h.Timestamp))
+	buffer = append(buffer, h.Version)
+
+	if h.Version >= options.ChecksumSchemaVersion {
+		buffer = append(buffer, byte(h.ChecksumAlgorithm))
+		if h.Version >= options.FlagsSchemaVersion {
+			buffer = append(buffer, byte(h.Flags))
+		}
+
+		if h.ChecksumAlgorithm.Size() == 8 {
+			buffer = binary.LittleEndian.AppendUint32(buffer, uint32(h.Checksum>>32))
+		}
+
+		if h.Version >= options.FlagsSchemaVersion && h.Flags&FlagEncrypted != 0 {
+			buffer = binary.LittleEndian.AppendUint32(buffer, h.KeyVersion)
+		}
+	}
+
+	if h.Version >= options.MagicSchemaVersion {
+		buffer = binary.LittleEndian.AppendUint16(buffer, recordMagic)
+	}
+	return buffer
+}
+
+// readRecordHeader decodes a header of any supported schema version. It
+// fails with ErrCorruptHeader when the bytes read cannot be a header, so the
+// payload size they hold is never acted on.
+func readRecordHeader(r io.Reader) (RecordHeader, error) {
+	var prefix recordHeaderPrefix
+	if err := binary.Read(r, binary.LittleEndian, &prefix); err != nil {
+		return RecordHeader{}, err
+	}
+
+	header := RecordHeader{
+		Checksum:          uint64(prefix.Checksum),
+		PayloadSize:       prefix.PayloadSize,
+		Timestamp:         prefix.Timestamp,
+		Version:           prefix.Version,
+		ChecksumAlgorithm: checksum.AlgorithmCRC32IEEE,
+	}
+
+	// Callers reject versions they do not know; nothing after the prefix
+	// can be read for them.
+	if header.Version > options.MaxSchemaVersion {
+		return header, nil
+	}
+
+	if header.Version == options.CompactSchemaVersion {
+		return header, fmt.Errorf("%w: compact schema version in a standard segment", ErrCorruptHeader)
+	}
+
+	if header.Version >= options.ChecksumSchemaVersion {
+		var algorithm [1]byte
+		if _, err := io.ReadFull(r, algorithm[:]); err != nil {
+			return RecordHeader{}, err
+		}
+		header.ChecksumAlgorithm = checksum.Algorithm(algorithm[0])
+
+		if header.Version >= options.FlagsSchemaVersion {
+			var flags [1]byte
+			if _, err := io.ReadFull(r, flags[:]); err != nil {
+				return RecordHeader{}, err
+			}
+			header.Flags = RecordFlags(flags[0])
+		}
+
+		if header.ChecksumAlgorithm.Size() == 8 {
+			var high uint32
+			if err := binary.Read(r, binary.LittleEndian, &high); err != nil {
+				return RecordHeader{}, err
+			}
+			header.Checksum |= uint64(high) << 32
+		}
+
+		if header.Version >= options.FlagsSchemaVersion && header.Flags&FlagEncrypted != 0 {
+			if err := binary.Read(r, binary.LittleEndian, &header.KeyVersion); err != nil {
+				return RecordHeader{}, err
+			}
+		}
+	}
+
+	if header.Version >= options.MagicSchemaVersion {
+		var trailer struct {
+			Magic    uint16
+			Checksum uint32
+		}
+		if err := binary.Read(r, binary.LittleEndian, &trailer); err != nil {
+			return RecordHeader{}, err
+		}
+
+		if trailer.Magic != recordMagic {
+			return header, fmt.Errorf("%w: magic %#04x", ErrCorruptHeader, trailer.Magic)
+		}
+
+		if crc32.ChecksumIEEE(header.appendFields(nil)) != trailer.Checksum {
+			return header, fmt.Errorf("%w: header checksum mismatch", ErrCorruptHeader)
+		}
+	}
+
+	return header, nil
+}
+
+// Size returns the number of bytes the record occupies on disk.
+func (r *Record) Size() int64 {
+	return r.Header.EncodedSize() + int64(r.Header.PayloadSize) + r.chunkBytes
+}
+
+// appendPayload appends the payload of r, laid out as its header's schema
+// version says, to buffer.
+func (r *Record) appendPayload(buffer []byte) ([]byte, error) {
+	if r.Header != nil && r.Header.isCompact() {
+		return r.appendCompactPayload(buffer), nil
+	}
+	return r.appendProto(buffer)
+}
+
+// unmarshalPayload decodes data, laid out as r's header's schema version
+// says, into r.
+func (r *Record) unmarshalPayload(data []byte) error {
+	if r.Header != nil && r.Header.isCompact() {
+		return r.unmarshalCompact(data)
+	}
+	return r.UnMarshalProto(data)
+}
+
+// unmarshalInPlace decodes data into r without copying: the key and value
+// are slices of data.
+func (r *Record) unmarshalInPlace(data []byte) error {
+	if r.Header != nil && r.Header.isCompact() {
+		return r.unmarshalCompact(data)
+	}
+
+	// Walks the wire format of kvixpb.Record by hand, which unlike
+	// proto.Unmarshal leaves the bytes fields pointing into data.
+	var key, value []byte
+	for len(data) > 0 {
+		number, kind, read := protowire.ConsumeTag(data)
+		if read < 0 {
+			return protowire.ParseError(read)
+		}
+		data = data[read:]
+
+		if kind == protowire.BytesType && (number == 1 || number == 2) {
+			field, read := protowire.ConsumeBytes(data)
+			if read < 0 {
+				return protowire.ParseError(read)
+			}
+			if number == 1 {
+				key = field
+			} else {
+				value = field
+			}
+			data = data[read:]
+			continue
+		}
+
+		read = protowire.ConsumeFieldValue(number, kind, data)
+		if read < 0 {
+			return protowire.ParseError(read)
+		}
+		data = data[read:]
+	}
+
+	if key == nil {
+		return ErrNilKey
 	}
+	if value == nil {
+		return ErrNilValue
+	}
+
+	r.Key, r.Value = key, value
+	return nil
+}
+
+func (r *Record) MarshalProto() ([]byte, error) {
+	return r.appendProto(nil)
+}
+
+func (r *Record) appendProto(buffer []byte) ([]byte, error) {
+	record := protoRecords.Get().(*kvixpb.Record)
+	defer putProtoRecord(record)
+
+	record.Key, record.Value = r.Key, r.Value
 	opts := proto.MarshalOptions{Deterministic: true}
-	return opts.Marshal(&record)
+	return opts.MarshalAppend(buffer, record)
 }
 
+// UnMarshalProto decodes data into r. The key and value are copies, so data
+// may be reused afterwards.
 func (r *Record) UnMarshalProto(data []byte) error {
-	var record kvixpb.Record
+	record := protoRecords.Get().(*kvixpb.Record)
+	defer putProtoRecord(record)
 	opts := proto.UnmarshalOptions{DiscardUnknown: true}
 
-	if err := opts.Unmarshal(data, &record); err != nil {
+	if err := opts.Unmarshal(data, record); err != nil {
 		return err
 	}
 
@@ -73,3 +397,30 @@ func (r *Record) UnMarshalProto(data []byte) error {
 	r.Value = record.Value
 	return nil
 }
+
+// SegmentCheck is the result of scanning one segment file record by record.
+// FramedBytes is where the last record with a readable frame ends; anything
+// after it cannot be parsed, because records carry no sync marker to resume
+// from. Records whose frame is intact but whose payload is damaged are listed
+// in Findings and scanning continues past them.
+type SegmentCheck struct {
+	Path        string
+	SegmentID   uint16
+	Timestamp   int64
+	Size        int64
+	FramedBytes int64
+	Records     int
+	Findings    []SegmentFinding
+	Damaged     map[int64]struct{}
+}
+
+type SegmentFinding struct {
+	Offset int64            `json:"offset"`
+	Code   errors.ErrorCode `json:"code"`
+	Reason string           `json:"reason"`
+}
+
+// TrailingGarbage reports how many bytes follow the last readable record.
+func (c *SegmentCheck) TrailingGarbage() int64 {
+	return c.Size - c.FramedBytes
+}
@@ -0,0 +1,49 @@
+package storage
+
+import (
+	"sync"
+
+	kvixpb "github.com/iamBelugaa/kvix/internal/storage/__proto__"
+)
+
+// maxPooledBuffer is the largest buffer put back into the pool. Larger ones,
+// grown for a rare big value, are left to the garbage collector rather than
+// kept alive for small records.
+const maxPooledBuffer = 1 << 20
+
+// buffers holds the scratch space records are encoded into on Set and read
+// into on Get, so busy instances do not allocate a payload per operation.
+var buffers = sync.Pool{
+	New: func() any { return new([]byte) },
+}
+
+// getBuffer returns a pooled buffer holding size bytes. Callers that append
+// to it store the result back through the pointer, so the grown slice is what
+// returns to the pool.
+func getBuffer(size int) *[]byte {
+	buffer := buffers.Get().(*[]byte)
+	if cap(*buffer) < size {
+		*buffer = make([]byte, size)
+	}
+	*buffer = (*buffer)[:size]
+	return buffer
+}
+
+// putBuffer returns buffer to the pool. Nothing may refer to its bytes after.
+func putBuffer(buffer *[]byte) {
+	if cap(*buffer) > maxPooledBuffer {
+		return
+	}
+	buffers.Put(buffer)
+}
+
+// protoRecords holds the messages records are marshalled from and
+// unmarshalled into.
+var protoRecords = sync.Pool{
+	New: func() any { return new(kvixpb.Record) },
+}
+
+func putProtoRecord(message *kvixpb.Record) {
+	message.Reset()
+	protoRecords.Put(message)
+}
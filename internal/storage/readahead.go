@@ -0,0 +1,149 @@
+package storage
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"io"
+	"slices"
+)
+
+// RecordLocation is where ReadRecords finds a record.
+type RecordLocation struct {
+	SegmentID        uint16
+	SegmentTimestamp int64
+	Offset           int64
+}
+
+// readAhead serves reads at increasing offsets from a window of a segment,
+// which it refills with one large read whenever a read falls outside it.
+type readAhead struct {
+	reader io.ReaderAt
+	window []byte
+	start  int64
+}
+
+func (r *readAhead) ReadAt(p []byte, offset int64) (int, error) {
+	if len(p) > cap(r.window) {
+		return r.reader.ReadAt(p, offset)
+	}
+
+	if offset < r.start || offset+int64(len(p)) > r.start+int64(len(r.window)) {
+		read, err := r.reader.ReadAt(r.window[:cap(r.window)], offset)
+		r.window = r.window[:read]
+		r.start = offset
+
+		if read < len(p) {
+			return copy(p, r.window), err
+		}
+	}
+
+	return copy(p, r.window[offset-r.start:]), nil
+}
+
+// scanReader returns a reader for scanning file front to back.
+func (s *Storage) scanReader(file io.Reader) *bufio.Reader {
+	if s.options.ReadAheadSize <= 0 {
+		return bufio.NewReader(file)
+	}
+	return bufio.NewReaderSize(file, s.options.ReadAheadSize)
+}
+
+// ReadRecords reads the records at locations and calls fn with the index of
+// each location and its record, or the error reading it. Locations are
+// visited by segment and then offset, and each segment is read through a
+// read-ahead window of ReadAheadSize bytes, so that reading many records of
+// a segment costs a few large reads instead of a couple per record. An
+// error returned by fn ends the scan.
+func (s *Storage) ReadRecords(
+	ctx context.Context, locations []RecordLocation, fn func(i int, record *Record, err error) error,
+) error {
+	order := make([]int, len(locations))
+	for i := range order {
+		order[i] = i
+	}
+
+	slices.SortFunc(order, func(a, b int) int {
+		x, y := locations[a], locations[b]
+		return cmp.Or(
+			cmp.Compare(x.SegmentID, y.SegmentID),
+			cmp.Compare(x.SegmentTimestamp, y.SegmentTimestamp),
+			cmp.Compare(x.Offset, y.Offset),
+		)
+	})
+
+	var window []byte
+	if s.options.ReadAheadSize > 0 {
+		window = make([]byte, 0, s.options.ReadAheadSize)
+	}
+
+	for len(order) > 0 {
+		first := locations[order[0]]
+		end := 1
+		for end < len(order) {
+			next := locations[order[end]]
+			if next.SegmentID != first.SegmentID || next.SegmentTimestamp != first.SegmentTimestamp {
+				break
+			}
+			end++
+		}
+
+		if err := s.readSegmentRecords(ctx, locations, order[:end], window, fn); err != nil {
+			return err
+		}
+		order = order[end:]
+	}
+
+	return nil
+}
+
+// readSegmentRecords reads the records of one segment for ReadRecords.
+func (s *Storage) readSegmentRecords(
+	ctx context.Context, locations []RecordLocation, order []int, window []byte,
+	fn func(i int, record *Record, err error) error,
+) error {
+	segment := locations[order[0]]
+
+	s.segmentMu.RLock()
+	defer s.segmentMu.RUnlock()
+
+	var segmentFile io.ReaderAt
+	var compact bool
+	if segment.SegmentID == s.activeSegmentID && segment.SegmentTimestamp == s.activeSegmentCreatedAt {
+		segmentFile, compact = s.activeReader(), s.activeCompact
+	} else {
+		reader, readerCompact, release, err := s.segmentPool.GetSegmentReader(ctx, segment.SegmentID, segment.SegmentTimestamp)
+		if err != nil {
+			for _, i := range order {
+				if err := fn(i, nil, err); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		defer release()
+		segmentFile, compact = reader, readerCompact
+	}
+
+	if window != nil {
+		segmentFile = &readAhead{reader: segmentFile, window: window[:0]}
+	}
+
+	level := s.verifyLevelFor(ctx)
+	for _, i := range order {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		record, err := s.readRecord(segmentFile, compact, segment.SegmentID, locations[i].Offset, level, nil)
+		if err == nil && record.Header.Flags&FlagChunked != 0 {
+			if err = s.assembleChunks(record, segmentFile, compact, segment.SegmentID, locations[i].Offset, level, nil); err != nil {
+				record = nil
+			}
+		}
+		if err := fn(i, record, err); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/iamBelugaa/kvix/pkg/errors"
+	"github.com/iamBelugaa/kvix/pkg/options"
+	"github.com/iamBelugaa/kvix/pkg/seginfo"
+)
+
+// sealFullSegment seals the segment name, which filled up while it was
+// active, before a new one is started.
+func (s *Storage) sealFullSegment(segmentID uint16, name string) error {
+	path := filepath.Join(s.options.SegmentOptions.Directory, name)
+	timestamp, err := seginfo.ParseSegmentTimestamp(name, s.options.SegmentOptions.Prefix)
+	if err != nil {
+		return errors.NewStorageError(err, errors.ErrSystemInternal, "Failed to parse segment timestamp").WithPath(path)
+	}
+	return s.sealSegment(path, segmentID, timestamp)
+}
+
+// sealSegment appends a footer to a segment that has stopped taking writes,
+// preceded by its key table unless KeyIndexInterval is negative. It reads
+// every record to build them, so it costs a scan of the segment. Segments
+// already sealed are left alone, and so are segments that do not scan
+// cleanly to their end, whose footer would sit behind damage that Verify is
+// meant to cut off.
+func (s *Storage) sealSegment(path string, segmentID uint16, timestamp int64) error {
+	file, err := s.options.FileSystem.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		return errors.NewStorageError(err, errors.ErrIOGeneral, "Failed to open segment for sealing").WithPath(path)
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return errors.NewStorageError(err, errors.ErrIOGeneral, "Failed to stat segment for sealing").WithPath(path)
+	}
+	size := stat.Size()
+
+	if footer, _, err := seginfo.ReadFooter(file, size); footer != nil && err == nil {
+		return nil
+	}
+
+	segmentHeader, start, err := seginfo.CheckHeader(file, segmentID, timestamp)
+	if err != nil {
+		if !isHeaderDamage(err) {
+			return segmentHeaderError(err, path, segmentID)
+		}
+		start = seginfo.HeaderSize
+	}
+
+	indexKeys := s.options.KeyIndexInterval > 0
+	reader := s.scanReader(io.NewSectionReader(file, start, size-start))
+	footer := &seginfo.Footer{}
+	var keys []seginfo.KeyEntry
+	var payload []byte
+	offset := start
+	compact := segmentHeader.CompactRecords()
+
+	for offset < size {
+		header, err := scanRecordHeader(reader, compact)
+		if err == nil && (header.Version < options.MinSchemaVersion || header.Version > options.MaxSchemaVersion) {
+			err = fmt.Errorf("invalid schema version %d", header.Version)
+		}
+		if err == nil && !indexKeys {
+			_, err = reader.Discard(int(header.PayloadSize))
+		}
+		if err == nil && indexKeys {
+			payload = slices.Grow(payload[:0], int(header.PayloadSize))[:header.PayloadSize]
+			if _, err = io.ReadFull(reader, payload); err == nil {
+				record := &Record{Header: &header}
+				// A chunk is found through the record ahead of it, so only
+				// that record goes into the key table.
+				if err = record.unmarshalPayload(payload); err == nil && header.Flags&FlagChunkPart == 0 {
+					keys = append(keys, seginfo.KeyEntry{Key: slices.Clone(record.Key), Offset: offset})
+				}
+			}
+		}
+		if err != nil {
+			s.log.Warnw("Leaving segment unsealed, it does not scan cleanly", "path", path, "offset", offset, "error", err)
+			return nil
+		}
+
+		footer.Add(offset, header.Timestamp)
+		offset += header.EncodedSize() + int64(header.PayloadSize)
+	}
+
+	if offset != size {
+		s.log.Warnw("Leaving segment unsealed, its last record is truncated", "path", path, "size", size)
+		return nil
+	}
+
+	var table []byte
+	if len(keys) > 0 {
+		if table, footer.Keys, err = seginfo.BuildKeyTable(keys, size, s.options.KeyIndexInterval); err != nil {
+			return errors.NewStorageError(err, errors.ErrRecordSerialization, "Failed to encode segment key table").
+				WithPath(path)
+		}
+	}
+
+	encoded, err := footer.MarshalBinary()
+	if err != nil {
+		return errors.NewStorageError(err, errors.ErrRecordSerialization, "Failed to encode segment footer").
+			WithPath(path)
+	}
+
+	if _, err := file.WriteAt(append(table, encoded...), size); err != nil {
+		return errors.NewStorageError(err, errors.ErrIOWriteFailed, "Failed to write segment footer").WithPath(path)
+	}
+
+	if err := file.Sync(); err != nil {
+		return errors.NewStorageError(err, errors.ErrIOSyncFailed, "Failed to sync segment footer").WithPath(path)
+	}
+
+	s.log.Infow("Segment sealed", "path", path, "records", footer.Records)
+	return nil
+}
+
+// FindKey looks key up in the key table of a sealed segment and returns the
+// offset of its latest record there, so a lookup does not have to scan the
+// segment. indexed is false for the active segment and for segments sealed
+// without a key table.
+func (s *Storage) FindKey(
+	ctx context.Context, segmentID uint16, timestamp int64, key []byte,
+) (offset int64, found, indexed bool, err error) {
+	s.segmentMu.RLock()
+	defer s.segmentMu.RUnlock()
+
+	if segmentID == s.activeSegmentID && timestamp == s.activeSegmentCreatedAt {
+		return 0, false, false, nil
+	}
+	return s.segmentPool.FindKey(ctx, segmentID, timestamp, key)
+}
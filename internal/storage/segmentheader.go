@@ -0,0 +1,61 @@
+package storage
+
+import (
+	stdErrors "errors"
+
+	"github.com/iamBelugaa/kvix/pkg/errors"
+	"github.com/iamBelugaa/kvix/pkg/filesys"
+	"github.com/iamBelugaa/kvix/pkg/options"
+	"github.com/iamBelugaa/kvix/pkg/seginfo"
+)
+
+// writeSegmentHeader writes the header of a new, empty segment, whose records
+// take the configured framing, and returns the offset its first record goes
+// at.
+func (s *Storage) writeSegmentHeader(file filesys.File, segmentID uint16, timestamp int64) (int64, error) {
+	var flags seginfo.HeaderFlags
+	if s.compactFraming() {
+		flags |= seginfo.FlagCompactRecords
+	}
+
+	header, err := seginfo.NewHeader(segmentID, timestamp, s.checksummer.Algorithm(), flags).MarshalBinary()
+	if err != nil {
+		return 0, errors.NewStorageError(err, errors.ErrRecordSerialization, "Failed to encode segment header").
+			WithFileName(file.Name()).
+			WithSegmentID(int(segmentID))
+	}
+
+	if _, err := file.Write(header); err != nil {
+		return 0, errors.NewStorageError(err, errors.ErrIOWriteFailed, "Failed to write segment header").
+			WithFileName(file.Name()).
+			WithSegmentID(int(segmentID))
+	}
+	return seginfo.HeaderSize, nil
+}
+
+// compactFraming reports whether new segments take the compact framing.
+func (s *Storage) compactFraming() bool {
+	return s.options.RecordFraming == options.FramingCompact
+}
+
+// isHeaderDamage reports whether err is a header that is there but does not
+// check out, as opposed to one that could not be read.
+func isHeaderDamage(err error) bool {
+	return stdErrors.Is(err, seginfo.ErrHeaderCorrupt) || stdErrors.Is(err, seginfo.ErrHeaderMismatch)
+}
+
+// segmentHeaderError describes a segment whose header failed
+// seginfo.CheckHeader.
+func segmentHeaderError(err error, path string, segmentID uint16) error {
+	code := errors.ErrSegmentHeaderInvalid
+	switch {
+	case stdErrors.Is(err, seginfo.ErrFormatUnsupported):
+		code = errors.ErrSystemUnsupportedVersion
+	case !isHeaderDamage(err):
+		code = errors.ErrIOGeneral
+	}
+
+	return errors.NewStorageError(err, code, "Segment header is invalid").
+		WithPath(path).
+		WithSegmentID(int(segmentID))
+}
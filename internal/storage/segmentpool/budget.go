@@ -0,0 +1,85 @@
+package segmentpool
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Budget caps the number of segment handles open across every pool that
+// shares it. When the cap is reached, the least recently used handle of any
+// pool is evicted to make room. The cap is soft: a handle is still opened if
+// every other handle is being opened at the same moment and none can be
+// evicted.
+type Budget struct {
+	limit int64
+	open  atomic.Int64
+
+	// mu serializes reservations and guards pools. It is never taken while a
+	// pool's own lock is held.
+	mu    sync.Mutex
+	pools map[*SegmentPool]struct{}
+}
+
+// NewBudget returns a budget of limit handles, or nil, meaning no cap, when
+// limit is not positive.
+func NewBudget(limit int) *Budget {
+	if limit <= 0 {
+		return nil
+	}
+	return &Budget{limit: int64(limit), pools: make(map[*SegmentPool]struct{})}
+}
+
+// Open returns the number of handles currently charged to the budget.
+func (b *Budget) Open() int {
+	return int(b.open.Load())
+}
+
+func (b *Budget) Limit() int {
+	return int(b.limit)
+}
+
+func (b *Budget) register(pool *SegmentPool) {
+	b.mu.Lock()
+	b.pools[pool] = struct{}{}
+	b.mu.Unlock()
+}
+
+func (b *Budget) unregister(pool *SegmentPool) {
+	b.mu.Lock()
+	delete(b.pools, pool)
+	b.mu.Unlock()
+}
+
+// reserve charges one handle, evicting least recently used handles until
+// the budget has room.
+func (b *Budget) reserve() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for b.open.Load() >= b.limit {
+		var victimPool *SegmentPool
+		var victimKey string
+		var victimUsed int64
+
+		for pool := range b.pools {
+			key, lastUsed, ok := pool.leastRecentlyUsed()
+			if ok && (victimPool == nil || lastUsed < victimUsed) {
+				victimPool, victimKey, victimUsed = pool, key, lastUsed
+			}
+		}
+
+		if victimPool == nil {
+			break
+		}
+
+		if err := victimPool.evictKey(victimKey); err != nil {
+			victimPool.log.Warnw("Failed to evict segment handle over budget", "segment", victimKey, "error", err)
+		}
+	}
+
+	b.open.Add(1)
+}
+
+func (b *Budget) release() {
+	b.open.Add(-1)
+}
@@ -0,0 +1,73 @@
+package segmentpool
+
+import (
+	"context"
+	stdErrors "errors"
+
+	"github.com/iamBelugaa/kvix/pkg/errors"
+	"github.com/iamBelugaa/kvix/pkg/seginfo"
+)
+
+// FindKey looks key up in the key table of a sealed segment and returns the
+// offset of its latest record there. indexed is false for segments without
+// a key table, because they were not sealed or were sealed without one;
+// those have to be scanned instead. The key index is read from the footer
+// once per handle.
+func (sp *SegmentPool) FindKey(
+	ctx context.Context, segmentID uint16, timestamp int64, key []byte,
+) (offset int64, found, indexed bool, err error) {
+	handle, err := sp.getHandle(ctx, segmentID, timestamp)
+	if err != nil {
+		return 0, false, false, err
+	}
+	defer sp.unpin(handle)
+
+	keys := handle.keys.Load()
+	if keys == nil {
+		if keys, err = readKeyIndex(handle); err != nil {
+			return 0, false, false, errors.NewStorageError(err, keyIndexErrorCode(err), "Failed to read segment key index").
+				WithFileName(handle.file.Name()).
+				WithSegmentID(int(segmentID))
+		}
+		if keys == nil {
+			return 0, false, false, nil
+		}
+		handle.keys.Store(keys)
+	}
+
+	offset, found, err = keys.Search(handle.reader(), key)
+	if err != nil {
+		return 0, false, true, errors.NewStorageError(err, keyIndexErrorCode(err), "Failed to search segment key index").
+			WithFileName(handle.file.Name()).
+			WithSegmentID(int(segmentID))
+	}
+	return offset, found, true, nil
+}
+
+// readKeyIndex reads the key index from the footer of handle's segment. It
+// returns nil for segments without one.
+func readKeyIndex(handle *SegmentHandle) (*seginfo.KeyIndex, error) {
+	size := int64(len(handle.mapping))
+	if handle.mapping == nil {
+		stat, err := handle.file.Stat()
+		if err != nil {
+			return nil, err
+		}
+		size = stat.Size()
+	}
+
+	footer, _, err := seginfo.ReadFooter(handle.reader(), size)
+	if err != nil || footer == nil {
+		return nil, err
+	}
+	return footer.Keys, nil
+}
+
+// keyIndexErrorCode tells a damaged key index from one that could not be
+// read.
+func keyIndexErrorCode(err error) errors.ErrorCode {
+	if stdErrors.Is(err, seginfo.ErrFooterCorrupt) || stdErrors.Is(err, seginfo.ErrKeyIndexCorrupt) {
+		return errors.ErrSegmentKeyIndexInvalid
+	}
+	return errors.ErrIOGeneral
+}
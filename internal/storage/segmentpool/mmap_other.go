@@ -0,0 +1,13 @@
+//go:build !unix
+
+package segmentpool
+
+import "github.com/iamBelugaa/kvix/pkg/filesys"
+
+func mapFile(file filesys.File) ([]byte, error) {
+	return nil, errMmapUnsupported
+}
+
+func unmapFile(data []byte) error {
+	return nil
+}
@@ -0,0 +1,32 @@
+//go:build unix
+
+package segmentpool
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/iamBelugaa/kvix/pkg/filesys"
+)
+
+func mapFile(file filesys.File) ([]byte, error) {
+	osFile, ok := file.(*os.File)
+	if !ok {
+		return nil, errMmapUnsupported
+	}
+
+	stat, err := osFile.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	if stat.Size() == 0 {
+		return nil, errEmptySegment
+	}
+
+	return syscall.Mmap(int(osFile.Fd()), 0, int(stat.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+func unmapFile(data []byte) error {
+	return syscall.Munmap(data)
+}
@@ -1,20 +1,95 @@
 package segmentpool
 
 import (
-	"os"
+	"errors"
 	"sync"
+	"sync/atomic"
 
+	"github.com/iamBelugaa/kvix/pkg/filesys"
 	"github.com/iamBelugaa/kvix/pkg/options"
+	"github.com/iamBelugaa/kvix/pkg/seginfo"
+	"go.uber.org/zap"
 )
 
+var (
+	errEmptySegment    = errors.New("cannot map an empty segment")
+	errMmapUnsupported = errors.New("mmap is not supported on this platform or file system")
+)
+
+// Fetcher restores the file of a sealed segment missing from disk to path,
+// such as one moved to object storage. It returns false if it holds no copy
+// of the segment either.
+type Fetcher func(segmentID uint16, timestamp int64, path string) (bool, error)
+
+// fetchCall is a fetch in progress, shared by every reader of the segment.
+type fetchCall struct {
+	done    chan struct{}
+	fetched bool
+	err     error
+}
+
 type SegmentHandle struct {
 	lastUsed int64
-	file     *os.File
+	file     filesys.File
+	mapping  []byte
+	// direct is set when file was opened for direct I/O, which needs
+	// aligned reads.
+	direct bool
+	// compact is set when the segment header marks its records compact.
+	compact bool
+	// keys caches the key index of the segment once its footer was read.
+	keys atomic.Pointer[seginfo.KeyIndex]
+
+	// refs counts readers between GetSegmentReader and their release. A
+	// handle evicted while read from is closed by its last reader.
+	refs      int32
+	evicted   int32
+	closeOnce sync.Once
+	closeErr  error
 }
 
 type SegmentPool struct {
 	maxIdleTime int64
 	mu          sync.RWMutex
 	options     *options.Options
+	log         *zap.SugaredLogger
 	handles     map[string]*SegmentHandle
+	budget      *Budget
+	// evictedUse keeps the lastUsed time of handles that were closed, so
+	// LastUsed still knows when their segment was read.
+	evictedUse map[string]int64
+	fetcher    Fetcher
+	fetches    map[string]*fetchCall
+
+	// stop ends the cleanup goroutine, which closes cleanupDone on return.
+	stop        chan struct{}
+	stopOnce    sync.Once
+	cleanupDone chan struct{}
+
+	hits   atomic.Uint64
+	misses atomic.Uint64
+	opens  atomic.Uint64
+	closes atomic.Uint64
+}
+
+// Stats counts how segment reads were served by a pool since it was created.
+// A hit found the segment already open, a miss had to open it. Open is the
+// number of handles held at the moment, pinned or idle.
+type Stats struct {
+	Hits   uint64
+	Misses uint64
+	Opens  uint64
+	Closes uint64
+	Open   int
+}
+
+// Add returns the sum of s and other, for reporting across pools.
+func (s Stats) Add(other Stats) Stats {
+	return Stats{
+		Hits:   s.Hits + other.Hits,
+		Misses: s.Misses + other.Misses,
+		Opens:  s.Opens + other.Opens,
+		Closes: s.Closes + other.Closes,
+		Open:   s.Open + other.Open,
+	}
 }
@@ -1,47 +1,162 @@
 package segmentpool
 
 import (
+	"bytes"
+	"context"
+	stdErrors "errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"sync/atomic"
 	"time"
 
 	"github.com/iamBelugaa/kvix/pkg/errors"
+	"github.com/iamBelugaa/kvix/pkg/filesys"
 	"github.com/iamBelugaa/kvix/pkg/options"
 	"github.com/iamBelugaa/kvix/pkg/seginfo"
 	"go.uber.org/zap"
 )
 
-func New(maxIdleTime int64, options *options.Options, log *zap.SugaredLogger) *SegmentPool {
+// New returns a pool of sealed segment handles. Handles count against budget
+// when it is not nil. Handles left unread for maxIdleTime seconds are closed
+// in the background until the pool is closed.
+func New(maxIdleTime int64, options *options.Options, log *zap.SugaredLogger, budget *Budget) *SegmentPool {
 	if maxIdleTime <= 0 {
 		maxIdleTime = int64((time.Minute * 30).Seconds())
 	}
 
-	return &SegmentPool{
+	pool := &SegmentPool{
+		log:         log,
 		options:     options,
+		budget:      budget,
 		maxIdleTime: maxIdleTime,
 		handles:     make(map[string]*SegmentHandle),
+		evictedUse:  make(map[string]int64),
+		fetches:     make(map[string]*fetchCall),
+		stop:        make(chan struct{}),
+		cleanupDone: make(chan struct{}),
+	}
+
+	if budget != nil {
+		budget.register(pool)
+	}
+
+	go pool.cleanupLoop(time.Duration(maxIdleTime) * time.Second / 2)
+	return pool
+}
+
+func (sp *SegmentPool) cleanupLoop(interval time.Duration) {
+	defer close(sp.cleanupDone)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-sp.stop:
+			return
+		case <-ticker.C:
+			sp.CleanupIdleHandles()
+		}
 	}
 }
 
-func (sp *SegmentPool) GetSegmentHandle(segmentID uint16, timestamp int64) (*os.File, error) {
+// CleanupIdleHandles closes the handles that have not been read for the
+// pool's idle time. Handles being read from are left open.
+func (sp *SegmentPool) CleanupIdleHandles() {
+	cutoff := time.Now().Add(-time.Duration(sp.maxIdleTime) * time.Second).UnixNano()
+
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	// Readers pin handles under the read lock, so refs cannot rise while the
+	// write lock is held.
+	closed := 0
+	for cacheKey, handle := range sp.handles {
+		lastUsed := atomic.LoadInt64(&handle.lastUsed)
+		if atomic.LoadInt32(&handle.refs) > 0 || lastUsed > cutoff {
+			continue
+		}
+
+		delete(sp.handles, cacheKey)
+		sp.evictedUse[cacheKey] = lastUsed
+		atomic.StoreInt32(&handle.evicted, 1)
+		if err := sp.closeHandle(handle); err != nil {
+			sp.log.Warnw("Failed to close idle segment handle", "fileName", cacheKey, "error", err)
+		}
+		closed++
+	}
+
+	if closed > 0 {
+		sp.log.Debugw("Closed idle segment handles", "count", closed, "open", len(sp.handles))
+	}
+}
+
+// GetSegmentHandle returns the file of a sealed segment without pinning it,
+// so it may be closed by an eviction at any time. Prefer GetSegmentReader.
+func (sp *SegmentPool) GetSegmentHandle(segmentID uint16, timestamp int64) (filesys.File, error) {
+	handle, err := sp.getHandle(context.Background(), segmentID, timestamp)
+	if err != nil {
+		return nil, err
+	}
+
+	file := handle.file
+	sp.unpin(handle)
+	return file, nil
+}
+
+// GetSegmentReader returns a reader over a sealed segment. When memory mapping
+// is enabled and succeeds, reads are served from the mapping without syscalls;
+// otherwise the file handle itself is returned. The segment stays open until
+// release is called, even if it is evicted meanwhile. A segment missing from
+// disk is restored by the fetcher, if one is set; ctx bounds the wait.
+// compact reports whether the segment's records use the compact framing.
+func (sp *SegmentPool) GetSegmentReader(
+	ctx context.Context, segmentID uint16, timestamp int64,
+) (reader io.ReaderAt, compact bool, release func(), err error) {
+	handle, err := sp.getHandle(ctx, segmentID, timestamp)
+	if err != nil {
+		return nil, false, nil, err
+	}
+
+	return handle.reader(), handle.compact, func() { sp.unpin(handle) }, nil
+}
+
+func (sp *SegmentPool) getHandle(ctx context.Context, segmentID uint16, timestamp int64) (*SegmentHandle, error) {
 	cacheKey := seginfo.GenerateNameWithTimestamp(segmentID, sp.options.SegmentOptions.Prefix, timestamp)
 
 	sp.mu.RLock()
 	if handle, exists := sp.handles[cacheKey]; exists {
-		file := handle.file
-		handle.lastUsed = time.Now().Unix()
+		atomic.StoreInt64(&handle.lastUsed, time.Now().UnixNano())
+		atomic.AddInt32(&handle.refs, 1)
 		sp.mu.RUnlock()
-		return file, nil
+		sp.hits.Add(1)
+		return handle, nil
 	}
 
 	sp.mu.RUnlock()
+	sp.misses.Add(1)
 
 	fileName := seginfo.GenerateNameWithTimestamp(segmentID, sp.options.SegmentOptions.Prefix, timestamp)
 	filePath := filepath.Join(sp.options.SegmentOptions.Directory, fileName)
 
-	file, err := os.OpenFile(filePath, os.O_RDONLY, 0644)
+	if sp.budget != nil {
+		sp.budget.reserve()
+	}
+
+	file, err := sp.options.FileSystem.OpenFile(filePath, os.O_RDONLY, 0644)
+	if stdErrors.Is(err, fs.ErrNotExist) {
+		var fetched bool
+		if fetched, err = sp.fetch(ctx, cacheKey, segmentID, timestamp, filePath); fetched {
+			file, err = sp.options.FileSystem.OpenFile(filePath, os.O_RDONLY, 0644)
+		} else if err == nil {
+			err = fs.ErrNotExist
+		}
+	}
 	if err != nil {
+		sp.releaseBudget()
 		return nil, errors.NewStorageError(
 			err, errors.ErrIOGeneral, fmt.Sprintf("Failed to open segment file: %s", fileName),
 		).
@@ -49,14 +164,209 @@ func (sp *SegmentPool) GetSegmentHandle(segmentID uint16, timestamp int64) (*os.
 			WithSegmentID(int(segmentID))
 	}
 
+	header, _, err := seginfo.CheckHeader(file, segmentID, timestamp)
+	if err != nil {
+		code := errors.ErrSegmentHeaderInvalid
+		if stdErrors.Is(err, seginfo.ErrFormatUnsupported) {
+			code = errors.ErrSystemUnsupportedVersion
+		}
+
+		if closeErr := file.Close(); closeErr != nil {
+			sp.log.Warnw("Failed to close segment with an invalid header", "fileName", fileName, "error", closeErr)
+		}
+		sp.releaseBudget()
+		return nil, errors.NewStorageError(err, code, fmt.Sprintf("Segment header is invalid: %s", fileName)).
+			WithPath(filePath).
+			WithSegmentID(int(segmentID))
+	}
+
+	sp.opens.Add(1)
+	handle := &SegmentHandle{file: file, lastUsed: time.Now().UnixNano(), compact: header.CompactRecords()}
+	if sp.options.DirectIO {
+		if err := filesys.SetDirectIO(file); err != nil {
+			sp.log.Warnw("Falling back to buffered reads for segment", "fileName", fileName, "error", err)
+		} else {
+			handle.direct = true
+		}
+	}
+
+	if sp.options.MmapSealedSegments {
+		mapping, err := mapFile(file)
+		if err != nil {
+			sp.log.Warnw("Falling back to file reads for segment", "fileName", fileName, "error", err)
+		} else {
+			handle.mapping = mapping
+		}
+	}
+
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	if existing, exists := sp.handles[cacheKey]; exists {
+		if err := sp.closeHandle(handle); err != nil {
+			sp.log.Warnw("Failed to release duplicate segment handle", "fileName", fileName, "error", err)
+		}
+		atomic.AddInt32(&existing.refs, 1)
+		return existing, nil
+	}
+
+	handle.refs = 1
+	sp.handles[cacheKey] = handle
+	return handle, nil
+}
+
+// SetFetcher makes the pool restore segments missing from disk through
+// fetcher.
+func (sp *SegmentPool) SetFetcher(fetcher Fetcher) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	sp.fetcher = fetcher
+}
+
+// fetch restores a missing segment, joining a fetch of the same segment
+// already in progress. The fetch carries on for later readers when ctx is
+// done first.
+func (sp *SegmentPool) fetch(
+	ctx context.Context, cacheKey string, segmentID uint16, timestamp int64, path string,
+) (bool, error) {
 	sp.mu.Lock()
-	sp.handles[cacheKey] = &SegmentHandle{file: file, lastUsed: time.Now().Unix()}
+	if sp.fetcher == nil {
+		sp.mu.Unlock()
+		return false, nil
+	}
+
+	call, exists := sp.fetches[cacheKey]
+	if !exists {
+		call = &fetchCall{done: make(chan struct{})}
+		sp.fetches[cacheKey] = call
+
+		go func(fetcher Fetcher) {
+			call.fetched, call.err = fetcher(segmentID, timestamp, path)
+
+			sp.mu.Lock()
+			delete(sp.fetches, cacheKey)
+			sp.mu.Unlock()
+			close(call.done)
+		}(sp.fetcher)
+	}
 	sp.mu.Unlock()
 
-	return file, nil
+	select {
+	case <-call.done:
+		return call.fetched, call.err
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+}
+
+// Evict closes and unmaps the handle for a segment, if open. Segments must be
+// evicted before their files are removed or rewritten.
+func (sp *SegmentPool) Evict(segmentID uint16, timestamp int64) error {
+	cacheKey := seginfo.GenerateNameWithTimestamp(segmentID, sp.options.SegmentOptions.Prefix, timestamp)
+
+	return sp.evictKey(cacheKey)
+}
+
+func (sp *SegmentPool) evictKey(cacheKey string) error {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	handle, exists := sp.handles[cacheKey]
+	if !exists {
+		return nil
+	}
+
+	delete(sp.handles, cacheKey)
+	sp.evictedUse[cacheKey] = atomic.LoadInt64(&handle.lastUsed)
+	atomic.StoreInt32(&handle.evicted, 1)
+	if atomic.LoadInt32(&handle.refs) > 0 {
+		return nil
+	}
+	return sp.closeHandle(handle)
+}
+
+// LastUsed returns when a segment was last read through the pool, or false
+// if it has not been since the pool was created.
+func (sp *SegmentPool) LastUsed(segmentID uint16, timestamp int64) (time.Time, bool) {
+	cacheKey := seginfo.GenerateNameWithTimestamp(segmentID, sp.options.SegmentOptions.Prefix, timestamp)
+
+	sp.mu.RLock()
+	defer sp.mu.RUnlock()
+
+	if handle, exists := sp.handles[cacheKey]; exists {
+		return time.Unix(0, atomic.LoadInt64(&handle.lastUsed)), true
+	}
+
+	if lastUsed, exists := sp.evictedUse[cacheKey]; exists {
+		return time.Unix(0, lastUsed), true
+	}
+	return time.Time{}, false
+}
+
+// Stats returns the pool's counters. Handles opened and closed together by
+// concurrent misses of the same segment count as one open and one close.
+func (sp *SegmentPool) Stats() Stats {
+	closes := sp.closes.Load()
+	opens := sp.opens.Load()
+	return Stats{
+		Hits:   sp.hits.Load(),
+		Misses: sp.misses.Load(),
+		Opens:  opens,
+		Closes: closes,
+		Open:   int(opens - closes),
+	}
+}
+
+func (sp *SegmentPool) unpin(handle *SegmentHandle) {
+	if atomic.AddInt32(&handle.refs, -1) == 0 && atomic.LoadInt32(&handle.evicted) == 1 {
+		if err := sp.closeHandle(handle); err != nil {
+			sp.log.Warnw("Failed to close evicted segment handle", "fileName", handle.file.Name(), "error", err)
+		}
+	}
+}
+
+// closeHandle releases handle exactly once and returns its charge to the
+// budget.
+func (sp *SegmentPool) closeHandle(handle *SegmentHandle) error {
+	handle.closeOnce.Do(func() {
+		handle.closeErr = handle.release()
+		sp.closes.Add(1)
+		sp.releaseBudget()
+	})
+	return handle.closeErr
+}
+
+// leastRecentlyUsed returns the cache key of the idle handle used longest
+// ago. Handles being read from are skipped.
+func (sp *SegmentPool) leastRecentlyUsed() (string, int64, bool) {
+	sp.mu.RLock()
+	defer sp.mu.RUnlock()
+
+	var oldestKey string
+	var oldestUsed int64
+	for key, handle := range sp.handles {
+		if atomic.LoadInt32(&handle.refs) > 0 {
+			continue
+		}
+
+		if lastUsed := atomic.LoadInt64(&handle.lastUsed); oldestKey == "" || lastUsed < oldestUsed {
+			oldestKey, oldestUsed = key, lastUsed
+		}
+	}
+
+	return oldestKey, oldestUsed, oldestKey != ""
+}
+
+func (sp *SegmentPool) releaseBudget() {
+	if sp.budget != nil {
+		sp.budget.release()
+	}
 }
 
 func (sp *SegmentPool) Close() error {
+	sp.stopOnce.Do(func() { close(sp.stop) })
+	<-sp.cleanupDone
+
 	sp.mu.Lock()
 	defer sp.mu.Unlock()
 
@@ -64,13 +374,15 @@ func (sp *SegmentPool) Close() error {
 	handleCount := len(sp.handles)
 
 	for _, handle := range sp.handles {
-		if err := handle.file.Close(); err != nil {
+		if err := sp.closeHandle(handle); err != nil {
 			closeErrors = append(closeErrors, err)
 		}
-		handle = nil
 	}
 
 	clear(sp.handles)
+	if sp.budget != nil {
+		sp.budget.unregister(sp)
+	}
 	if len(closeErrors) > 0 {
 		return fmt.Errorf(
 			"failed to close %d out of %d segment handles during shutdown", len(closeErrors), handleCount,
@@ -79,3 +391,25 @@ func (sp *SegmentPool) Close() error {
 
 	return nil
 }
+
+// reader returns a reader over the handle's segment, through its mapping if
+// it has one.
+func (h *SegmentHandle) reader() io.ReaderAt {
+	if h.mapping != nil {
+		return bytes.NewReader(h.mapping)
+	}
+	if h.direct {
+		return filesys.DirectReader(h.file)
+	}
+	return h.file
+}
+
+func (h *SegmentHandle) release() error {
+	if h.mapping != nil {
+		if err := unmapFile(h.mapping); err != nil {
+			return err
+		}
+		h.mapping = nil
+	}
+	return h.file.Close()
+}
@@ -3,7 +3,6 @@ package storage
 import (
 	"bytes"
 	"context"
-	"encoding/binary"
 	stdErrors "errors"
 	"fmt"
 	"io"
@@ -15,27 +14,67 @@ import (
 
 	"github.com/iamBelugaa/kvix/internal/storage/segmentpool"
 	"github.com/iamBelugaa/kvix/pkg/checksum"
+	"github.com/iamBelugaa/kvix/pkg/encryption"
 	"github.com/iamBelugaa/kvix/pkg/errors"
 	"github.com/iamBelugaa/kvix/pkg/filesys"
 	"github.com/iamBelugaa/kvix/pkg/options"
 	"github.com/iamBelugaa/kvix/pkg/seginfo"
 )
 
-func New(ctx context.Context, log *zap.SugaredLogger, options *options.Options) (*Storage, error) {
+// New opens the storage of one partition. Sealed segment handles count
+// against budget, which may be shared with other storages or nil.
+func New(
+	ctx context.Context, log *zap.SugaredLogger, options *options.Options, budget *segmentpool.Budget,
+) (*Storage, error) {
 	segmentDirPath := filepath.Join(options.SegmentOptions.Directory)
-	if err := filesys.CreateDir(segmentDirPath, 0755, true); err != nil {
-		return nil, errors.NewStorageError(err, errors.ErrIOGeneral, err.Error())
+	readOnly := options.FollowInterval > 0
+	if !readOnly {
+		if err := filesys.CreateDir(options.FileSystem, segmentDirPath, 0755, true); err != nil {
+			return nil, errors.NewStorageError(err, errors.ErrIOGeneral, err.Error())
+		}
+	}
+
+	checksummers := make(map[checksum.Algorithm]checksum.Checksummer)
+	for _, algorithm := range checksum.Supported() {
+		checksummers[algorithm], _ = checksum.New(algorithm)
+	}
+
+	checksummer, ok := checksummers[options.ChecksumAlgorithm]
+	if !ok {
+		return nil, errors.NewValidationError(
+			nil, errors.ErrSystemInvalidInput, fmt.Sprintf("Unsupported checksum algorithm %s", options.ChecksumAlgorithm),
+		)
 	}
 
-	segmentPool := segmentpool.New(int64((time.Minute * 30).Seconds()), options, log)
+	segmentPool := segmentpool.New(int64((time.Minute * 30).Seconds()), options, log, budget)
 	storage := &Storage{
-		log:         log,
-		options:     options,
-		segmentPool: segmentPool,
-		checksummer: checksum.NewCRC32IEEE(),
+		log:          log,
+		options:      options,
+		segmentPool:  segmentPool,
+		checksummer:  checksummer,
+		checksummers: checksummers,
+	}
+	storage.SetSyncPolicy(options.SyncPolicy)
+	storage.SetVerifyLevel(options.ReadVerification)
+
+	if options.KeyProvider != nil {
+		storage.cipher = encryption.NewCipher(options.KeyProvider)
+		keyVersion, err := storage.currentKeyVersion()
+		if err != nil {
+			return nil, err
+		}
+		storage.keyVersion = keyVersion
+	}
+
+	// A follower reads the segments another process appends to, so it opens
+	// none for writing and every read goes through the segment pool.
+	if readOnly {
+		log.Infow("Storage opened read-only", "directory", segmentDirPath)
+		return storage, nil
 	}
 
 	lastSegmentID, lastSegmentInfo, err := seginfo.GetLastSegmentInfo(
+		options.FileSystem,
 		options.SegmentOptions.Directory,
 		options.SegmentOptions.Prefix,
 	)
@@ -68,6 +107,14 @@ func New(ctx context.Context, log *zap.SugaredLogger, options *options.Options)
 				"newSegmentID", targetSegmentID,
 				"currentSegmentID", lastSegmentID,
 			)
+
+			// A replica's segments are copies of the primary's, which seals
+			// them itself.
+			if options.ReplicaOf == "" {
+				if err := storage.sealFullSegment(lastSegmentID, lastSegmentInfo.Name()); err != nil {
+					return nil, err
+				}
+			}
 		} else {
 			targetSegmentID = lastSegmentID
 
@@ -101,7 +148,7 @@ func New(ctx context.Context, log *zap.SugaredLogger, options *options.Options)
 		flags = os.O_RDWR | os.O_APPEND
 	}
 
-	file, err := os.OpenFile(filePath, flags, 0644)
+	file, err := options.FileSystem.OpenFile(filePath, flags, 0644)
 	if err != nil {
 		return nil, errors.NewStorageError(err, errors.ErrIOGeneral, err.Error())
 	}
@@ -121,15 +168,41 @@ func New(ctx context.Context, log *zap.SugaredLogger, options *options.Options)
 			WithDetail("whence", io.SeekEnd)
 	}
 
-	storage.activeSegment = file
-	storage.currentOffset = targetOffset
+	// Appending to a segment of a newer format would corrupt it. A damaged
+	// header only fails reads that need it, and is left for Verify to report,
+	// so it does not keep the instance from opening.
+	// Records go on in the framing the segment was created with.
+	var segmentHeader *seginfo.Header
+	if isNewSegment {
+		targetOffset, err = storage.writeSegmentHeader(file, targetSegmentID, segmentTimestamp)
+		storage.activeCompact = storage.compactFraming()
+	} else if segmentHeader, _, err = seginfo.CheckHeader(file, targetSegmentID, segmentTimestamp); err != nil {
+		if stdErrors.Is(err, seginfo.ErrFormatUnsupported) || !isHeaderDamage(err) {
+			err = segmentHeaderError(err, filePath, targetSegmentID)
+		} else {
+			log.Warnw("Active segment header is invalid; run Verify", "fileName", fileName, "error", err)
+			err = nil
+		}
+	} else {
+		storage.activeCompact = segmentHeader.CompactRecords()
+	}
+	if err != nil {
+		if closeErr := file.Close(); closeErr != nil {
+			log.Errorw("Failed to close file after segment header error", "headerError", err, "closeError", closeErr)
+		}
+		return nil, err
+	}
+
+	storage.activeSegment, storage.direct = storage.useDirectIO(file, filePath, targetOffset)
+	storage.buffer = storage.newWriteBuffer(targetOffset)
+	storage.currentOffset.Store(targetOffset)
 	storage.activeSegmentID = targetSegmentID
 	storage.activeSegmentCreatedAt = segmentTimestamp
 
 	log.Infow(
 		"Storage system initialized successfully",
 		"currentOffset", targetOffset,
-		"isNewSegment", targetOffset == 0,
+		"isNewSegment", isNewSegment,
 		"activeSegmentID", targetSegmentID,
 		"activeSegmentTimestamp", segmentTimestamp,
 	)
@@ -142,25 +215,173 @@ func (s *Storage) SegmentID() uint16 {
 }
 
 func (s *Storage) Offset() int64 {
-	return s.currentOffset
+	return s.currentOffset.Load()
+}
+
+// SetOffset records where the active segment ends after a replica wrote
+// shipped bytes to it directly. The caller must keep writers away.
+func (s *Storage) SetOffset(offset int64) {
+	s.currentOffset.Store(offset)
 }
 
 func (s *Storage) SegmentTimestamp() int64 {
 	return s.activeSegmentCreatedAt
 }
 
-func (s *Storage) Set(ctx context.Context, key, value []byte) (*Record, int64, error) {
-	recordOffset := s.currentOffset
+func (s *Storage) ActiveSegmentPath() string {
+	name := seginfo.GenerateNameWithTimestamp(s.activeSegmentID, s.options.SegmentOptions.Prefix, s.activeSegmentCreatedAt)
+	return filepath.Join(s.options.SegmentOptions.Directory, name)
+}
+
+// SealedSegmentPaths lists every segment file other than the active one, in
+// segment order.
+func (s *Storage) SealedSegmentPaths() ([]string, error) {
+	paths, err := seginfo.ListSegmentPaths(s.options.FileSystem, s.options.SegmentOptions.Directory, s.options.SegmentOptions.Prefix)
+	if err != nil {
+		return nil, errors.NewStorageError(err, errors.ErrIOGeneral, "Failed to list segment files").
+			WithPath(s.options.SegmentOptions.Directory)
+	}
+
+	active := s.ActiveSegmentPath()
+	sealed := make([]string, 0, len(paths))
+	for _, path := range paths {
+		if path != active {
+			sealed = append(sealed, path)
+		}
+	}
+
+	return sealed, nil
+}
+
+func (s *Storage) SegmentUsage() (int, int64, error) {
+	paths, err := seginfo.ListSegmentPaths(s.options.FileSystem, s.options.SegmentOptions.Directory, s.options.SegmentOptions.Prefix)
+	if err != nil {
+		return 0, 0, errors.NewStorageError(err, errors.ErrIOGeneral, "Failed to list segment files").
+			WithPath(s.options.SegmentOptions.Directory)
+	}
+
+	var totalBytes int64
+	for _, path := range paths {
+		stat, err := s.options.FileSystem.Stat(path)
+		if err != nil {
+			return 0, 0, errors.NewStorageError(err, errors.ErrIOGeneral, "Failed to stat segment file").
+				WithPath(path)
+		}
+		totalBytes += stat.Size()
+	}
+
+	return len(paths), totalBytes, nil
+}
+
+// SegmentLastRead returns when a sealed segment was last read, or false if
+// it has not been since the storage was opened.
+func (s *Storage) SegmentLastRead(segmentID uint16, timestamp int64) (time.Time, bool) {
+	return s.segmentPool.LastUsed(segmentID, timestamp)
+}
+
+// SegmentPoolStats returns the counters of the pool serving sealed segment
+// reads.
+func (s *Storage) SegmentPoolStats() segmentpool.Stats {
+	return s.segmentPool.Stats()
+}
+
+// SetSegmentFetcher restores sealed segments missing from disk through
+// fetcher when they are read.
+func (s *Storage) SetSegmentFetcher(fetcher segmentpool.Fetcher) {
+	s.segmentPool.SetFetcher(fetcher)
+}
+
+// Set appends a record for key. metadata may be nil. Values too large for
+// one record are split over several, see setChunked.
+func (s *Storage) Set(ctx context.Context, key, value []byte, metadata *Metadata) (*Record, int64, error) {
+	if isChunkedSize(int64(len(value)), metadata) {
+		var written int64
+		record, recordOffset, err := s.setChunked(ctx, key, int64(len(value)), metadata, func(size int64) error {
+			_, _, err := s.set(ctx, key, value[written:written+size], nil, FlagChunkPart)
+			written += size
+			return err
+		})
+		if err != nil {
+			return nil, 0, err
+		}
+
+		record.Value = value
+		return record, recordOffset, nil
+	}
+
+	record, recordOffset, err := s.set(ctx, key, value, metadata, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if err := s.syncWrite(ctx); err != nil {
+		return nil, 0, err
+	}
+	return record, recordOffset, nil
+}
+
+// set appends a single record for key carrying flags, without syncing it.
+func (s *Storage) set(
+	ctx context.Context, key, value []byte, metadata *Metadata, flags RecordFlags,
+) (*Record, int64, error) {
+	watch := startStopwatch(ctx)
+	recordOffset := s.currentOffset.Load()
 	record := &Record{
 		Key:   key,
 		Value: value,
 		Header: &RecordHeader{
-			Timestamp: time.Now().Unix(),
-			Version:   options.CurrentSchemaVersion,
+			Flags:             flags,
+			Timestamp:         time.Now().Unix(),
+			Version:           options.CurrentSchemaVersion,
+			ChecksumAlgorithm: s.checksummer.Algorithm(),
 		},
 	}
+	if s.activeCompact {
+		record.Header.Version = options.CompactSchemaVersion
+	}
 
-	encoded, err := record.MarshalProto()
+	// The metadata frame, payload and header are encoded into pooled
+	// buffers, which are free again once the record has been appended.
+	framed := value
+	if !metadata.IsEmpty() {
+		frame := getBuffer(0)
+		defer putBuffer(frame)
+
+		*frame = append(AppendMetadata(*frame, metadata), value...)
+		framed = *frame
+		record.Metadata = metadata
+		record.Header.Flags |= FlagMetadata
+	}
+
+	stored, compressed, err := s.compressValue(framed)
+	if err != nil {
+		return nil, 0, errors.NewStorageError(
+			err, errors.ErrRecordSerialization, "Failed to compress value",
+		).
+			WithDetail("valueSize", len(framed))
+	}
+
+	if compressed {
+		record.Header.Flags |= FlagCompressed
+	}
+
+	if s.cipher != nil {
+		if stored, err = s.cipher.Seal(s.keyVersion, stored, key); err != nil {
+			return nil, 0, errors.NewStorageError(
+				err, errors.ErrRecordSerialization, "Failed to encrypt value",
+			).
+				WithDetail("keyVersion", s.keyVersion)
+		}
+
+		record.Header.Flags |= FlagEncrypted
+		record.Header.KeyVersion = s.keyVersion
+	}
+
+	payload := getBuffer(0)
+	defer putBuffer(payload)
+
+	encoded, err := (&Record{Header: record.Header, Key: key, Value: stored}).appendPayload(*payload)
+	*payload = encoded
 	if err != nil {
 		return nil, 0, errors.NewStorageError(
 			err, errors.ErrRecordSerialization, "Failed to marshal payload",
@@ -171,98 +392,296 @@ func (s *Storage) Set(ctx context.Context, key, value []byte) (*Record, int64, e
 	record.Header.PayloadSize = uint32(len(encoded))
 	record.Header.Checksum = s.checksummer.Calculate(encoded)
 
-	s.log.Infow(
+	s.log.Debugw(
 		"Record prepared successfully",
 		"version", record.Header.Version,
 		"checksum", record.Header.Checksum,
 		"payloadSize", record.Header.PayloadSize,
 	)
 
-	s.log.Infow(
+	headerBuffer := getBuffer(0)
+	defer putBuffer(headerBuffer)
+
+	header := record.Header.appendBinary(*headerBuffer)
+	*headerBuffer = header
+
+	s.log.Debugw(
 		"Writing record to active segment",
 		"actualPayloadLength", len(encoded),
-		"binaryHeaderSize", binary.Size(record.Header),
+		"binaryHeaderSize", len(header),
 		"headerPayloadSize", record.Header.PayloadSize,
 	)
 
-	headerSize := binary.Size(record.Header)
+	headerSize := len(header)
 	totalSize := headerSize + len(encoded)
+	watch.lap(phaseEncode)
 
-	if err := binary.Write(s.activeSegment, binary.LittleEndian, record.Header); err != nil {
-		return nil, 0, errors.NewStorageError(
-			err, errors.ErrRecordHeaderWriteFailed, "Failed to write record header",
-		).
-			WithFileName(s.activeSegment.Name()).
-			WithSegmentID(int(s.activeSegmentID)).
-			WithPath(s.options.SegmentOptions.Directory)
+	if err := s.appendRecord(header, encoded); err != nil {
+		return nil, 0, err
 	}
 
-	bytesWritten, err := s.activeSegment.Write(encoded)
-	if err != nil {
-		return nil, 0, errors.NewStorageError(
-			err, errors.ErrRecordPayloadWriteFailed, "Failed to write record",
-		).
-			WithFileName(s.activeSegment.Name()).
-			WithSegmentID(int(s.activeSegmentID)).
-			WithPath(s.options.SegmentOptions.Directory)
-	}
+	s.currentOffset.Add(int64(totalSize))
+	watch.lap(phaseWrite)
 
-	if bytesWritten != len(encoded) {
-		return nil, 0, errors.NewStorageError(
-			err, errors.ErrIOWriteFailed,
-			fmt.Sprintf("Short write occurred: %d written, expected %d", bytesWritten, len(encoded)),
-		).
-			WithFileName(s.activeSegment.Name()).
-			WithSegmentID(int(s.activeSegmentID)).
-			WithPath(s.options.SegmentOptions.Directory)
-	}
-
-	s.log.Infow(
+	s.log.Debugw(
 		"Record written successfully",
 		"headerBytes", headerSize,
 		"totalBytes", totalSize,
-		"currentOffset", s.currentOffset,
+		"currentOffset", s.currentOffset.Load(),
 	)
 
 	return record, recordOffset, nil
 }
 
+// syncWrite fsyncs the active segment after a write if the sync policy asks
+// for it and ctx does not defer it.
+func (s *Storage) syncWrite(ctx context.Context) error {
+	if !s.syncAlways.Load() || SyncDeferred(ctx) {
+		return nil
+	}
+
+	watch := startStopwatch(ctx)
+	if err := s.Sync(); err != nil {
+		return err
+	}
+	watch.lap(phaseSync)
+	return nil
+}
+
 func (s *Storage) Get(
 	ctx context.Context, key []byte, segmentID uint16, segmentTimestamp int64, offset int64,
 ) (record *Record, err error) {
-	s.log.Infow("Starting Get operation", "requestedKey", string(key), "readOffset", offset)
+	s.log.Debugw("Starting Get operation", "requestedKey", string(key), "readOffset", offset)
+	watch := startStopwatch(ctx)
+
+	s.segmentMu.RLock()
+	defer s.segmentMu.RUnlock()
+
+	segmentFile, compact, release, err := s.segmentReader(ctx, segmentID, segmentTimestamp)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	watch.lap(phaseOpen)
+
+	level := s.verifyLevelFor(ctx)
+	record, err = s.readRecord(segmentFile, compact, segmentID, offset, level, &watch)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.verifiesKey(ctx) && !bytes.Equal(record.Key, key) {
+		return nil, keyMismatchError(record.Key, segmentID, offset)
+	}
+
+	if record.Header.Flags&FlagChunked != 0 {
+		if err := s.assembleChunks(record, segmentFile, compact, segmentID, offset, level, &watch); err != nil {
+			return nil, err
+		}
+	}
+	return record, nil
+}
+
+// GetValue reads the record at offset like Get, but appends only its value
+// to dst and returns the extended slice. The payload is decoded in place, so
+// the value is the only thing copied out of the segment.
+func (s *Storage) GetValue(
+	ctx context.Context, dst, key []byte, segmentID uint16, segmentTimestamp int64, offset int64,
+) ([]byte, error) {
+	s.log.Debugw("Starting GetValue operation", "requestedKey", string(key), "readOffset", offset)
+	watch := startStopwatch(ctx)
+
+	s.segmentMu.RLock()
+	defer s.segmentMu.RUnlock()
+
+	segmentFile, compact, release, err := s.segmentReader(ctx, segmentID, segmentTimestamp)
+	if err != nil {
+		return dst, err
+	}
+	defer release()
+	watch.lap(phaseOpen)
+
+	level := s.verifyLevelFor(ctx)
+	header, payload, pooled, err := s.readPayload(segmentFile, compact, segmentID, offset, level, &watch)
+	if err != nil {
+		return dst, err
+	}
+	if pooled != nil {
+		defer putBuffer(pooled)
+	}
 
-	isActiveSegment := segmentID == s.activeSegmentID
-	if isActiveSegment {
-		defer func() {
-			_, err = s.activeSegment.Seek(0, io.SeekEnd)
-		}()
+	record := Record{Header: &header}
+	if err := s.decodeRecord(&record, payload, true, segmentID, offset, &watch); err != nil {
+		return dst, err
 	}
 
-	var segmentFile *os.File
-	if isActiveSegment {
-		segmentFile = s.activeSegment
+	if s.verifiesKey(ctx) && !bytes.Equal(record.Key, key) {
+		return dst, keyMismatchError(record.Key, segmentID, offset)
+	}
+
+	if header.Flags&FlagChunked != 0 {
+		manifest, err := parseManifest(record.Value)
+		if err != nil {
+			return dst, manifestError(err, segmentID, offset)
+		}
+		return s.appendChunks(dst, manifest, &record, segmentFile, compact, segmentID, offset, level, &watch)
+	}
+	return append(dst, record.Value...), nil
+}
+
+// segmentReader returns a reader over the segment a record lives in, and
+// whether its records are compact. The caller must hold segmentMu and call
+// release once done reading.
+func (s *Storage) segmentReader(
+	ctx context.Context, segmentID uint16, segmentTimestamp int64,
+) (segmentFile io.ReaderAt, compact bool, release func(), err error) {
+	// Reads only use ReadAt, which never moves the file offset, so they can run
+	// alongside appends to the active segment.
+	// A replica holds segments shipped from its primary alongside one it
+	// created itself, so the ID alone does not identify the active segment.
+	if s.isActive(segmentID, segmentTimestamp) {
+		return s.activeReader(), s.activeCompact, func() {}, nil
+	}
+	return s.segmentPool.GetSegmentReader(ctx, segmentID, segmentTimestamp)
+}
+
+func (s *Storage) isActive(segmentID uint16, segmentTimestamp int64) bool {
+	return segmentID == s.activeSegmentID && segmentTimestamp == s.activeSegmentCreatedAt
+}
+
+func keyMismatchError(recordKey []byte, segmentID uint16, offset int64) error {
+	return errors.NewStorageError(
+		nil, errors.ErrRecordKeyMismatch, "Record read belongs to another key",
+	).
+		WithDetail("offset", offset).
+		WithDetail("recordKey", string(recordKey)).
+		WithSegmentID(int(segmentID))
+}
+
+// readRecord reads and decodes the record at offset of a segment, charging
+// its phases to watch unless that is nil. compact tells the segment's
+// framing. The payload checksum is checked unless level is VerifyNone.
+func (s *Storage) readRecord(
+	segmentFile io.ReaderAt, compact bool, segmentID uint16, offset int64, level options.VerifyLevel, watch *stopwatch,
+) (*Record, error) {
+	header, payload, pooled, err := s.readPayload(segmentFile, compact, segmentID, offset, level, watch)
+	if err != nil {
+		return nil, err
+	}
+
+	// Nothing returned may refer to a pooled buffer, but a payload read into
+	// memory of its own can be decoded in place.
+	if pooled != nil {
+		defer putBuffer(pooled)
+	}
+
+	record := &Record{Header: &header}
+	if err := s.decodeRecord(record, payload, pooled == nil, segmentID, offset, watch); err != nil {
+		return nil, err
+	}
+
+	s.log.Debugw(
+		"Get operation completed successfully",
+		"keyLength", len(record.Key),
+		"valueLength", len(record.Value),
+		"payloadSize", record.Header.PayloadSize,
+	)
+
+	return record, nil
+}
+
+// readPayload reads the header and payload of the record at offset, checking
+// the payload checksum unless level is VerifyNone. Small payloads are read
+// into a buffer taken from the pool, which is returned as pooled for the
+// caller to put back once nothing refers to the payload any more.
+func (s *Storage) readPayload(
+	segmentFile io.ReaderAt, compact bool, segmentID uint16, offset int64, level options.VerifyLevel, watch *stopwatch,
+) (header RecordHeader, payload []byte, pooled *[]byte, err error) {
+	if header, err = s.readHeader(segmentFile, compact, segmentID, offset); err != nil {
+		return header, nil, nil, err
+	}
+
+	payloadOffset := offset + header.EncodedSize()
+	payloadSize := int64(header.PayloadSize)
+
+	if payloadSize < 1048576 {
+		pooled = getBuffer(int(payloadSize))
+		payload = *pooled
+		if err := s.readSmallPayload(segmentFile, payloadOffset, payload); err != nil {
+			putBuffer(pooled)
+			return header, nil, nil, err
+		}
 	} else {
-		segmentFile, err = s.segmentPool.GetSegmentHandle(segmentID, segmentTimestamp)
+		payloadSectionReader := io.NewSectionReader(segmentFile, payloadOffset, payloadSize)
+		payload, err = s.readLargePayload(payloadSectionReader, payloadSize)
 		if err != nil {
-			return nil, err
+			if stdErrors.Is(err, io.EOF) || stdErrors.Is(err, io.ErrUnexpectedEOF) {
+				return header, nil, nil, errors.NewStorageError(
+					err, errors.ErrSystemInternal, "Reached end of file while reading record payload",
+				).
+					WithDetail("offset", payloadOffset).
+					WithSegmentID(int(s.activeSegmentID)).
+					WithDetail("expectedBytes", payloadSize)
+			}
+
+			return header, nil, nil, errors.NewStorageError(
+				err, errors.ErrRecordPayloadReadFailed, "Failed to read record payload.",
+			).
+				WithDetail("offset", payloadOffset).
+				WithSegmentID(int(s.activeSegmentID)).
+				WithDetail("payloadSize", payloadSize)
+		}
+	}
+
+	watch.lap(phaseRead)
+
+	// The checksum covers the payload exactly as it was written, so it is
+	// checked against the bytes read before anything is decoded from them.
+	if level != options.VerifyNone {
+		isValid, err := s.VerifyChecksum(&header, payload)
+		if (err != nil || !isValid) && pooled != nil {
+			putBuffer(pooled)
+		}
+		if err != nil {
+			return header, nil, nil, err
+		} else if !isValid {
+			return header, nil, nil, errors.NewValidationError(
+				ErrInvalidChecksum, errors.ErrRecordChecksumMismatch,
+				"Record checksum validation failed",
+			).
+				WithDetail("offset", offset).
+				WithDetail("storedChecksum", header.Checksum)
 		}
+		watch.lap(phaseChecksum)
 	}
 
-	var header RecordHeader
-	headerSize := int64(binary.Size(header))
-	headerReader := io.NewSectionReader(segmentFile, offset, headerSize)
+	return header, payload, pooled, nil
+}
+
+// readHeader reads the header of the record at offset and checks that it
+// describes a payload kvix could have written.
+func (s *Storage) readHeader(segmentFile io.ReaderAt, compact bool, segmentID uint16, offset int64) (RecordHeader, error) {
+	header, err := readRecordHeaderAt(segmentFile, offset, compact)
+	headerSize := header.EncodedSize()
+	if err != nil {
+		if stdErrors.Is(err, ErrCorruptHeader) {
+			return header, errors.NewStorageError(
+				err, errors.ErrRecordHeaderCorrupted,
+				"No valid record header at offset, the offset is wrong or the segment is damaged",
+			).
+				WithOffset(int(offset)).
+				WithSegmentID(int(segmentID))
+		}
 
-	if err := binary.Read(headerReader, binary.LittleEndian, &header); err != nil {
 		if stdErrors.Is(err, io.EOF) {
-			return nil, errors.NewStorageError(
+			return header, errors.NewStorageError(
 				err, errors.ErrSystemInternal, "Reached end of file while reading record header",
 			).
 				WithDetail("offset", offset).
 				WithSegmentID(int(s.activeSegmentID))
 		}
 
-		return nil, errors.NewStorageError(
+		return header, errors.NewStorageError(
 			err, errors.ErrRecordHeaderReadFailed,
 			"Failed to read record header from segment file",
 		).
@@ -271,7 +690,7 @@ func (s *Storage) Get(
 			WithSegmentID(int(s.activeSegmentID))
 	}
 
-	s.log.Infow(
+	s.log.Debugw(
 		"Header read successfully",
 		"version", header.Version,
 		"checksum", header.Checksum,
@@ -279,8 +698,17 @@ func (s *Storage) Get(
 		"payloadSize", header.PayloadSize,
 	)
 
+	if header.Version < options.MinSchemaVersion || header.Version > options.MaxSchemaVersion {
+		return header, errors.NewValidationError(
+			nil, errors.ErrSystemUnsupportedVersion, "Unsupported schema version",
+		).
+			WithDetail("version", header.Version).
+			WithDetail("minVersion", options.MinSchemaVersion).
+			WithDetail("maxSchemaVersion", options.MaxSchemaVersion)
+	}
+
 	if header.PayloadSize == 0 {
-		return nil, errors.NewValidationError(
+		return header, errors.NewValidationError(
 			nil, errors.ErrValidationInvalidData, "Record header contains zero payload size",
 		).
 			WithDetail("header", header).
@@ -288,7 +716,7 @@ func (s *Storage) Get(
 	}
 
 	if header.PayloadSize > options.MaxValueSize {
-		return nil, errors.NewValidationError(
+		return header, errors.NewValidationError(
 			nil, errors.ErrRecordPayloadTooLarge,
 			fmt.Sprintf("Payload size %d exceeds maximum allowed size %d", header.PayloadSize, options.MaxValueSize),
 		).
@@ -296,88 +724,125 @@ func (s *Storage) Get(
 			WithDetail("payloadSize", header.PayloadSize)
 	}
 
-	if header.Version < options.MinSchemaVersion || header.Version > options.MaxSchemaVersion {
-		return nil, errors.NewValidationError(
-			nil, errors.ErrSystemUnsupportedVersion, "Unsupported schema version",
+	return header, nil
+}
+
+// decodeRecord decodes payload into record and turns its stored value back
+// into the value that was written. With inPlace the key and value may be
+// slices of payload; otherwise they are memory of their own.
+func (s *Storage) decodeRecord(
+	record *Record, payload []byte, inPlace bool, segmentID uint16, offset int64, watch *stopwatch,
+) (err error) {
+	if inPlace {
+		err = record.unmarshalInPlace(payload)
+	} else if err = record.unmarshalPayload(payload); err == nil && record.Header.isCompact() {
+		record.detach()
+	}
+	if err != nil {
+		return errors.NewStorageError(
+			err, errors.ErrRecordDeserialization,
+			"Failed to decode record payload",
 		).
-			WithDetail("version", header.Version).
-			WithDetail("minVersion", options.MinSchemaVersion).
-			WithDetail("maxSchemaVersion", options.MaxSchemaVersion)
+			WithDetail("offset", offset).
+			WithSegmentID(int(s.activeSegmentID)).
+			WithDetail("payloadSize", len(payload))
 	}
 
-	var payloadBuffer []byte
-	payloadOffset := offset + headerSize
-	payloadSize := int64(header.PayloadSize)
+	watch.lap(phaseDecode)
 
-	if payloadSize < 1048576 {
-		payloadBuffer, err = s.readSmallPayload(segmentFile, payloadOffset, payloadSize)
-		if err != nil {
-			return nil, err
+	// The checksum covers the stored form, so decrypt and decompress only
+	// once it has been verified.
+	if record.Header.Flags&FlagEncrypted != 0 {
+		if record.Value, err = s.openValue(record); err != nil {
+			return errors.NewStorageError(
+				err, errors.ErrRecordDeserialization, "Failed to decrypt record value",
+			).
+				WithDetail("offset", offset).
+				WithDetail("keyVersion", record.Header.KeyVersion).
+				WithSegmentID(int(segmentID))
 		}
-	} else {
-		payloadSectionReader := io.NewSectionReader(segmentFile, payloadOffset, payloadSize)
-		payloadBuffer, err = s.readLargePayload(payloadSectionReader, payloadSize)
-		if err != nil {
-			if stdErrors.Is(err, io.EOF) || stdErrors.Is(err, io.ErrUnexpectedEOF) {
-				return nil, errors.NewStorageError(
-					err, errors.ErrSystemInternal, "Reached end of file while reading record payload",
-				).
-					WithDetail("offset", payloadOffset).
-					WithSegmentID(int(s.activeSegmentID)).
-					WithDetail("expectedBytes", payloadSize)
-			}
+	}
 
-			return nil, errors.NewStorageError(
-				err, errors.ErrRecordPayloadReadFailed, "Failed to read record payload.",
+	if record.Header.Flags&FlagCompressed != 0 {
+		if record.Value, err = decompressValue(record.Value); err != nil {
+			return errors.NewStorageError(
+				err, errors.ErrRecordDeserialization, "Failed to decompress record value",
 			).
-				WithDetail("offset", payloadOffset).
-				WithSegmentID(int(s.activeSegmentID)).
-				WithDetail("payloadSize", payloadSize)
+				WithDetail("offset", offset).
+				WithSegmentID(int(segmentID))
 		}
 	}
 
-	record = &Record{Header: &header}
-	if err := record.UnMarshalProto(payloadBuffer); err != nil {
-		return nil, errors.NewStorageError(
-			err, errors.ErrRecordDeserialization,
-			"Failed to deserialize record from protobuf payload",
-		).
-			WithDetail("offset", offset).
-			WithSegmentID(int(s.activeSegmentID)).
-			WithDetail("payloadSize", len(payloadBuffer))
+	if record.Header.Flags&FlagMetadata != 0 {
+		if record.Metadata, record.Value, err = SplitMetadata(record.Value); err != nil {
+			return errors.NewStorageError(
+				err, errors.ErrRecordDeserialization, "Failed to decode record metadata",
+			).
+				WithDetail("offset", offset).
+				WithSegmentID(int(segmentID))
+		}
 	}
 
-	if isValid, err := s.VerifyChecksum(record); err != nil {
-		return nil, err
-	} else if !isValid {
-		return nil, errors.NewValidationError(
-			ErrInvalidChecksum, errors.ErrRecordChecksumMismatch,
-			"Record checksum validation failed",
-		).
-			WithDetail("offset", offset).
-			WithDetail("storedChecksum", record.Header.Checksum)
+	watch.lap(phaseDecode)
+	return nil
+}
+
+// SetSyncPolicy changes whether Set fsyncs after every record.
+func (s *Storage) SetSyncPolicy(policy options.SyncPolicy) {
+	s.syncAlways.Store(policy == options.SyncAlways)
+}
+
+// SetVerifyLevel changes how much reads verify from now on. Reads under a
+// context from WithVerifyLevel keep the level it carries.
+func (s *Storage) SetVerifyLevel(level options.VerifyLevel) {
+	s.verifyLevel.Store(uint32(level))
+}
+
+func (s *Storage) verifyLevelFor(ctx context.Context) options.VerifyLevel {
+	if level, ok := ctx.Value(verifyLevelKey{}).(options.VerifyLevel); ok {
+		return level
 	}
+	return options.VerifyLevel(s.verifyLevel.Load())
+}
 
-	s.log.Infow(
-		"Get operation completed successfully",
-		"keyLength", len(record.Key),
-		"valueLength", len(record.Value),
-		"payloadSize", record.Header.PayloadSize,
-	)
+// verifiesKey reports whether a read under ctx checks that the record read
+// belongs to the key asked for. Deduplicated records are shared between
+// keys, so they never are.
+func (s *Storage) verifiesKey(ctx context.Context) bool {
+	return s.verifyLevelFor(ctx) == options.VerifyFull && !s.options.Deduplicate
+}
 
-	return record, nil
+type verifyLevelKey struct{}
+
+// WithVerifyLevel returns a context under which reads verify records at
+// level instead of the storage's own.
+func WithVerifyLevel(ctx context.Context, level options.VerifyLevel) context.Context {
+	return context.WithValue(ctx, verifyLevelKey{}, level)
+}
+
+type deferSyncKey struct{}
+
+// WithDeferredSync returns a context under which writes are not fsynced, even
+// under SyncAlways, for callers that write a batch and Sync once at its end.
+func WithDeferredSync(ctx context.Context) context.Context {
+	return context.WithValue(ctx, deferSyncKey{}, true)
+}
+
+// SyncDeferred reports whether ctx came from WithDeferredSync.
+func SyncDeferred(ctx context.Context) bool {
+	deferred, _ := ctx.Value(deferSyncKey{}).(bool)
+	return deferred
 }
 
-func (s *Storage) VerifyChecksum(record *Record) (bool, error) {
-	encoded, err := record.MarshalProto()
+// VerifyChecksum checks payload, the bytes of a record as read from its
+// segment, against the checksum in header.
+func (s *Storage) VerifyChecksum(header *RecordHeader, payload []byte) (bool, error) {
+	checksummer, err := s.checksummerFor(header)
 	if err != nil {
-		return false, errors.NewStorageError(
-			err, errors.ErrRecordSerialization, "Failed to marshal payload for checksum verification",
-		).
-			WithDetail("record", record)
+		return false, err
 	}
 
-	if s.checksummer.Verify(encoded, record.Header.Checksum) {
+	if checksummer.Verify(payload, header.Checksum) {
 		return true, nil
 	}
 
@@ -386,8 +851,46 @@ func (s *Storage) VerifyChecksum(record *Record) (bool, error) {
 	)
 }
 
+func (s *Storage) checksummerFor(header *RecordHeader) (checksum.Checksummer, error) {
+	checksummer, ok := s.checksummers[header.ChecksumAlgorithm]
+	if !ok {
+		return nil, errors.NewValidationError(
+			nil, errors.ErrSystemUnsupportedVersion, "Unsupported checksum algorithm",
+		).
+			WithDetail("algorithm", header.ChecksumAlgorithm.String())
+	}
+	return checksummer, nil
+}
+
+// Sync flushes the active segment to stable storage. The caller must keep
+// writers away while it runs.
+func (s *Storage) Sync() error {
+	if s.activeSegment == nil {
+		return nil
+	}
+
+	if err := s.Flush(); err != nil {
+		return err
+	}
+
+	if err := s.activeSegment.Sync(); err != nil {
+		return errors.NewStorageError(err, errors.ErrIOSyncFailed, "Failed to sync active segment").
+			WithFileName(s.activeSegment.Name()).
+			WithSegmentID(int(s.activeSegmentID))
+	}
+	return nil
+}
+
 func (s *Storage) Close() error {
-	s.log.Infow("Closing storage system")
+	s.log.Debugw("Closing storage system")
+
+	if s.activeSegment == nil {
+		if err := s.segmentPool.Close(); err != nil {
+			return errors.NewStorageError(err, errors.ErrIOCloseFailed, err.Error()).
+				WithPath(s.options.SegmentOptions.Directory)
+		}
+		return nil
+	}
 
 	var currentFileName string
 	var currentFilePath string
@@ -396,8 +899,12 @@ func (s *Storage) Close() error {
 		currentFilePath = filepath.Join(s.options.SegmentOptions.Directory, currentFileName)
 	}
 
+	if err := s.Flush(); err != nil {
+		s.log.Errorw("Failed to flush write buffer before closing", "error", err, "fileName", currentFileName)
+	}
+
 	if err := s.activeSegment.Sync(); err != nil {
-		s.log.Infow(
+		s.log.Errorw(
 			"Failed to sync file before closing",
 			"error", err,
 			"fileName", currentFileName,
@@ -405,7 +912,7 @@ func (s *Storage) Close() error {
 		)
 
 		if closeErr := s.activeSegment.Close(); closeErr != nil {
-			s.log.Infow(
+			s.log.Errorw(
 				"Failed to close file after sync error",
 				"syncError", err,
 				"closeError", closeErr,
@@ -425,26 +932,30 @@ func (s *Storage) Close() error {
 			WithFileName(currentFileName)
 	}
 
+	if err := s.segmentPool.Close(); err != nil {
+		return errors.NewStorageError(err, errors.ErrIOCloseFailed, err.Error()).
+			WithPath(s.options.SegmentOptions.Directory)
+	}
+
 	s.activeSegment = nil
 	s.log.Infow("Storage system closed successfully", "fileName", currentFileName, "filePath", currentFilePath)
 	return nil
 }
 
-func (s *Storage) readSmallPayload(file *os.File, offset, size int64) ([]byte, error) {
-	buffer := make([]byte, size)
-
+// readSmallPayload fills buffer with the payload at offset.
+func (s *Storage) readSmallPayload(file io.ReaderAt, offset int64, buffer []byte) error {
 	n, err := file.ReadAt(buffer, offset)
 	if err != nil {
-		if stdErrors.Is(err, io.EOF) && int64(n) == size {
-			return buffer, nil
+		if stdErrors.Is(err, io.EOF) && n == len(buffer) {
+			return nil
 		}
-		return nil, errors.NewStorageError(err, errors.ErrRecordPayloadReadFailed, "Failed to read payload")
+		return errors.NewStorageError(err, errors.ErrRecordPayloadReadFailed, "Failed to read payload")
 	}
 
-	if int64(n) != size {
-		return nil, errors.NewStorageError(nil, errors.ErrRecordPayloadReadFailed, "Incomplete read of payload")
+	if n != len(buffer) {
+		return errors.NewStorageError(nil, errors.ErrRecordPayloadReadFailed, "Incomplete read of payload")
 	}
-	return buffer, nil
+	return nil
 }
 
 func (s *Storage) readLargePayload(reader io.Reader, expectedSize int64) ([]byte, error) {
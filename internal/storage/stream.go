@@ -0,0 +1,504 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"context"
+	"encoding/binary"
+	stdErrors "errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/iamBelugaa/kvix/pkg/errors"
+	"github.com/iamBelugaa/kvix/pkg/options"
+)
+
+// GetReader streams the value of the record at offset from its segment, so
+// values too large to hold in memory comfortably never have to be. The
+// payload checksum is computed as the value is read and checked once all of
+// it has been: the Read that reaches the end of the value returns the
+// mismatch instead of io.EOF, so a value is only known to be intact once
+// reading it ends in io.EOF. Encrypted values, which only authenticate as a
+// whole, and records still in the write buffer are read into memory as Get
+// reads them. Chunked values are streamed a chunk at a time, each checked as
+// it ends.
+//
+// The reader keeps its segment file open until it is closed.
+func (s *Storage) GetReader(
+	ctx context.Context, key []byte, segmentID uint16, segmentTimestamp int64, offset int64,
+) (io.ReadCloser, error) {
+	s.log.Debugw("Starting GetReader operation", "requestedKey", string(key), "readOffset", offset)
+
+	s.segmentMu.RLock()
+	defer s.segmentMu.RUnlock()
+
+	segmentFile, compact, release, err := s.segmentReader(ctx, segmentID, segmentTimestamp)
+	if err != nil {
+		return nil, err
+	}
+
+	header, err := s.readHeader(segmentFile, compact, segmentID, offset)
+	if err != nil {
+		release()
+		return nil, err
+	}
+
+	if header.Flags&FlagChunked != 0 {
+		return s.chunkReader(ctx, key, segmentFile, compact, segmentID, segmentTimestamp, offset, release)
+	}
+
+	payloadOffset := offset + header.EncodedSize()
+	active := s.isActive(segmentID, segmentTimestamp)
+	if header.Flags&FlagEncrypted != 0 || (active && s.buffer != nil && s.buffer.holds(payloadOffset+int64(header.PayloadSize))) {
+		defer release()
+
+		record, err := s.readRecord(segmentFile, compact, segmentID, offset, s.verifyLevelFor(ctx), nil)
+		if err != nil {
+			return nil, err
+		}
+		if s.verifiesKey(ctx) && !bytes.Equal(record.Key, key) {
+			return nil, keyMismatchError(record.Key, segmentID, offset)
+		}
+		return io.NopCloser(bytes.NewReader(record.Value)), nil
+	}
+
+	// The active segment is closed when Rotate swaps it, so the stream reads
+	// it through a handle of its own.
+	if active {
+		file, err := s.options.FileSystem.OpenFile(s.ActiveSegmentPath(), os.O_RDONLY, 0644)
+		if err != nil {
+			return nil, errors.NewStorageError(err, errors.ErrIOGeneral, "Failed to open active segment for streaming").
+				WithSegmentID(int(segmentID))
+		}
+		segmentFile, release = file, func() { file.Close() }
+	}
+
+	stream := &valueStream{
+		header:    header,
+		segmentID: segmentID,
+		offset:    offset,
+		release:   release,
+	}
+	if err := s.openStream(ctx, stream, segmentFile, key, payloadOffset); err != nil {
+		stream.Close()
+		return nil, err
+	}
+	return stream, nil
+}
+
+// valueStream reads a value out of its record's payload. Everything read
+// from the payload goes through hash, when the checksum is verified, and
+// whatever of the payload follows the value is read once the value ends,
+// so that the whole payload is covered.
+type valueStream struct {
+	header    RecordHeader
+	segmentID uint16
+	offset    int64
+	section   *io.SectionReader
+	payload   *bufio.Reader
+	hash      hash.Hash64
+	value     io.Reader
+	inflater  io.ReadCloser
+	release   func()
+	err       error
+}
+
+// openStream positions stream at the start of the value of its record, whose
+// payload starts at payloadOffset of segmentFile.
+func (s *Storage) openStream(
+	ctx context.Context, stream *valueStream, segmentFile io.ReaderAt, key []byte, payloadOffset int64,
+) error {
+	header := &stream.header
+	if s.verifyLevelFor(ctx) != options.VerifyNone {
+		checksummer, err := s.checksummerFor(header)
+		if err != nil {
+			return err
+		}
+		stream.hash = checksummer.New()
+	}
+
+	stream.section = io.NewSectionReader(segmentFile, payloadOffset, int64(header.PayloadSize))
+	var raw io.Reader = stream.section
+	if stream.hash != nil {
+		raw = io.TeeReader(raw, stream.hash)
+	}
+	stream.payload = s.scanReader(raw)
+
+	recordKey, valueSize, err := stream.seekValue(s.verifiesKey(ctx))
+	if err != nil {
+		return stream.decodeError(err)
+	}
+	if recordKey != nil && !bytes.Equal(recordKey, key) {
+		return keyMismatchError(recordKey, stream.segmentID, stream.offset)
+	}
+
+	stream.value = io.LimitReader(stream.payload, valueSize)
+	if header.Flags&FlagCompressed != 0 {
+		stream.inflater = flate.NewReader(stream.value)
+		stream.value = stream.inflater
+	}
+
+	if header.Flags&FlagMetadata != 0 {
+		metadata := bufio.NewReader(stream.value)
+		size, err := binary.ReadUvarint(metadata)
+		if err == nil {
+			_, err = metadata.Discard(int(min(size, uint64(options.MaxValueSize)+1)))
+		}
+		if err != nil {
+			return stream.decodeError(fmt.Errorf("metadata block is truncated: %w", err))
+		}
+		stream.value = metadata
+	}
+	return nil
+}
+
+// seekValue reads the payload up to the start of the value and returns its
+// stored size. The record's key is returned only when withKey is set.
+func (v *valueStream) seekValue(withKey bool) (recordKey []byte, valueSize int64, err error) {
+	if v.header.isCompact() {
+		keySize, err := binary.ReadUvarint(v.payload)
+		if err != nil {
+			return nil, 0, err
+		}
+		if keySize == 0 || keySize > uint64(options.MaxKeySize) {
+			return nil, 0, ErrNilKey
+		}
+		if recordKey, err = v.readField(keySize, withKey); err != nil {
+			return nil, 0, err
+		}
+
+		valueSize = int64(v.header.PayloadSize) - v.consumed()
+		if valueSize <= 0 {
+			return nil, 0, ErrNilValue
+		}
+		return recordKey, valueSize, nil
+	}
+
+	// Walks the wire format of kvixpb.Record as unmarshalInPlace does, up to
+	// the value field.
+	var sawKey bool
+	for {
+		tag, err := binary.ReadUvarint(v.payload)
+		if stdErrors.Is(err, io.EOF) {
+			return nil, 0, ErrNilValue
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+
+		number, kind := protowire.DecodeTag(tag)
+		switch kind {
+		case protowire.BytesType:
+			size, err := binary.ReadUvarint(v.payload)
+			if err != nil {
+				return nil, 0, err
+			}
+			if size > uint64(int64(v.header.PayloadSize)-v.consumed()) {
+				return nil, 0, io.ErrUnexpectedEOF
+			}
+
+			switch number {
+			case 1:
+				if size > uint64(options.MaxKeySize) {
+					return nil, 0, ErrNilKey
+				}
+				if recordKey, err = v.readField(size, withKey); err != nil {
+					return nil, 0, err
+				}
+				sawKey = true
+			case 2:
+				if !sawKey {
+					return nil, 0, ErrNilKey
+				}
+				return recordKey, int64(size), nil
+			default:
+				_, err = v.payload.Discard(int(size))
+			}
+		case protowire.VarintType:
+			_, err = binary.ReadUvarint(v.payload)
+		case protowire.Fixed32Type:
+			_, err = v.payload.Discard(4)
+		case protowire.Fixed64Type:
+			_, err = v.payload.Discard(8)
+		default:
+			err = fmt.Errorf("unexpected wire type %d", kind)
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+}
+
+// readField reads the next size bytes of the payload, returning them only
+// when keep is set.
+func (v *valueStream) readField(size uint64, keep bool) ([]byte, error) {
+	if !keep {
+		_, err := v.payload.Discard(int(size))
+		return nil, err
+	}
+
+	field := make([]byte, size)
+	_, err := io.ReadFull(v.payload, field)
+	return field, err
+}
+
+// consumed returns how much of the payload has been read past.
+func (v *valueStream) consumed() int64 {
+	position, _ := v.section.Seek(0, io.SeekCurrent)
+	return position - int64(v.payload.Buffered())
+}
+
+func (v *valueStream) Read(p []byte) (int, error) {
+	if v.err != nil {
+		return 0, v.err
+	}
+
+	n, err := v.value.Read(p)
+	if stdErrors.Is(err, io.EOF) {
+		err = v.finish()
+	} else if err != nil {
+		err = errors.NewStorageError(err, errors.ErrRecordPayloadReadFailed, "Failed to stream record value").
+			WithDetail("offset", v.offset).
+			WithSegmentID(int(v.segmentID))
+	}
+
+	v.err = err
+	return n, err
+}
+
+// finish reads the rest of the payload and checks its checksum, returning
+// io.EOF if it matches.
+func (v *valueStream) finish() error {
+	if _, err := io.Copy(io.Discard, v.payload); err != nil {
+		return errors.NewStorageError(err, errors.ErrRecordPayloadReadFailed, "Failed to stream record payload").
+			WithDetail("offset", v.offset).
+			WithSegmentID(int(v.segmentID))
+	}
+
+	if v.consumed() != int64(v.header.PayloadSize) {
+		return errors.NewStorageError(
+			io.ErrUnexpectedEOF, errors.ErrSystemInternal, "Reached end of file while reading record payload",
+		).
+			WithDetail("offset", v.offset).
+			WithSegmentID(int(v.segmentID))
+	}
+
+	if v.hash != nil && v.hash.Sum64() != v.header.Checksum {
+		return errors.NewValidationError(
+			ErrInvalidChecksum, errors.ErrRecordChecksumMismatch,
+			"Record checksum validation failed",
+		).
+			WithDetail("offset", v.offset).
+			WithDetail("storedChecksum", v.header.Checksum)
+	}
+	return io.EOF
+}
+
+func (v *valueStream) decodeError(err error) error {
+	return errors.NewStorageError(
+		err, errors.ErrRecordDeserialization,
+		"Failed to decode record payload",
+	).
+		WithDetail("offset", v.offset).
+		WithSegmentID(int(v.segmentID)).
+		WithDetail("payloadSize", v.header.PayloadSize)
+}
+
+// Close releases the segment file the value was streamed from. It is safe
+// to call more than once.
+func (v *valueStream) Close() error {
+	if v.release == nil {
+		return nil
+	}
+
+	if v.inflater != nil {
+		v.inflater.Close()
+	}
+	v.release()
+	v.release = nil
+	v.err = os.ErrClosed
+	return nil
+}
+
+// SetReader appends a record whose value is the size bytes read from r,
+// streamed into the active segment and checksummed as it goes, and returns
+// it without its value together with its offset. The header is written with
+// the payload's size up front and rewritten with its checksum once the value
+// has been read; if reading or writing fails the segment is cut back to
+// where the record began. Streamed values are stored uncompressed. Encrypted
+// values are sealed whole, so with a key provider the value is read into
+// memory and written by Set. Values too large for one record are streamed
+// into the chunks of a chunked record.
+func (s *Storage) SetReader(ctx context.Context, key []byte, r io.Reader, size int64) (*Record, int64, error) {
+	if s.cipher != nil {
+		value := make([]byte, size)
+		if _, err := io.ReadFull(r, value); err != nil {
+			return nil, 0, errors.NewStorageError(err, errors.ErrRecordPayloadWriteFailed, "Failed to read value to store").
+				WithDetail("valueSize", size)
+		}
+		return s.Set(ctx, key, value, nil)
+	}
+
+	if isChunkedSize(size, nil) {
+		return s.setChunked(ctx, key, size, nil, func(size int64) error {
+			_, _, err := s.setStream(ctx, key, r, size, FlagChunkPart)
+			return err
+		})
+	}
+
+	record, recordOffset, err := s.setStream(ctx, key, r, size, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if err := s.syncWrite(ctx); err != nil {
+		return nil, 0, err
+	}
+	return record, recordOffset, nil
+}
+
+// setStream streams a single record for key carrying flags, without
+// syncing it.
+func (s *Storage) setStream(
+	ctx context.Context, key []byte, r io.Reader, size int64, flags RecordFlags,
+) (*Record, int64, error) {
+	watch := startStopwatch(ctx)
+	recordOffset := s.currentOffset.Load()
+	header := &RecordHeader{
+		Flags:             flags,
+		Timestamp:         time.Now().Unix(),
+		Version:           options.CurrentSchemaVersion,
+		ChecksumAlgorithm: s.checksummer.Algorithm(),
+	}
+	if s.activeCompact {
+		header.Version = options.CompactSchemaVersion
+	}
+
+	// Everything of the payload before the value, laid out as
+	// appendPayload would.
+	var prefix []byte
+	if header.isCompact() {
+		prefix = binary.AppendUvarint(prefix, uint64(len(key)))
+		prefix = append(prefix, key...)
+	} else {
+		prefix = protowire.AppendTag(prefix, 1, protowire.BytesType)
+		prefix = protowire.AppendBytes(prefix, key)
+		prefix = protowire.AppendTag(prefix, 2, protowire.BytesType)
+		prefix = protowire.AppendVarint(prefix, uint64(size))
+	}
+
+	payloadSize := int64(len(prefix)) + size
+	if payloadSize > int64(options.MaxValueSize) {
+		return nil, 0, errors.NewValidationError(
+			nil, errors.ErrRecordPayloadTooLarge,
+			fmt.Sprintf("Payload size %d exceeds maximum allowed size %d", payloadSize, options.MaxValueSize),
+		).
+			WithDetail("payloadSize", payloadSize)
+	}
+	header.PayloadSize = uint32(payloadSize)
+
+	// The record goes straight to the file, where its header can be
+	// rewritten, so whatever is buffered has to be written ahead of it.
+	if err := s.Flush(); err != nil {
+		return nil, 0, err
+	}
+
+	hash := s.checksummer.New()
+	hash.Write(prefix)
+	encodedHeader := header.appendBinary(nil)
+	watch.lap(phaseEncode)
+
+	err := s.streamRecord(ctx, encodedHeader, prefix, r, size, hash)
+	if err == nil {
+		header.Checksum = hash.Sum64()
+		err = s.patchActive(header.appendBinary(encodedHeader[:0]), recordOffset)
+	}
+	if err != nil {
+		if truncateErr := s.TruncateSegment(s.ActiveSegmentPath(), s.activeSegmentID, s.activeSegmentCreatedAt, recordOffset); truncateErr != nil {
+			s.log.Errorw("Failed to cut back partly streamed record", "offset", recordOffset, "error", truncateErr)
+		}
+		return nil, 0, err
+	}
+
+	totalSize := int64(len(encodedHeader)) + payloadSize
+	if s.buffer != nil {
+		s.buffer.reset(recordOffset + totalSize)
+	}
+	s.currentOffset.Add(totalSize)
+	watch.lap(phaseWrite)
+
+	s.log.Debugw(
+		"Streamed record written successfully",
+		"headerBytes", len(encodedHeader),
+		"totalBytes", totalSize,
+		"currentOffset", s.currentOffset.Load(),
+	)
+
+	return &Record{Header: header, Key: key}, recordOffset, nil
+}
+
+// streamRecord writes the header and payload prefix of a record followed by
+// size bytes read from r, adding everything after the header to hash.
+func (s *Storage) streamRecord(
+	ctx context.Context, header, prefix []byte, r io.Reader, size int64, hash hash.Hash64,
+) error {
+	if err := s.writeActive(errors.ErrRecordHeaderWriteFailed, "Failed to write record header", header, prefix); err != nil {
+		return err
+	}
+
+	buffer := getBuffer(int(min(size, streamChunkSize)))
+	defer putBuffer(buffer)
+
+	for remaining := size; remaining > 0; {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		chunk := (*buffer)[:min(remaining, int64(len(*buffer)))]
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			return errors.NewStorageError(err, errors.ErrRecordPayloadWriteFailed, "Failed to read value to store").
+				WithDetail("valueSize", size).
+				WithDetail("missingBytes", remaining)
+		}
+
+		hash.Write(chunk)
+		if err := s.writeActive(errors.ErrRecordPayloadWriteFailed, "Failed to write record", chunk); err != nil {
+			return err
+		}
+		remaining -= int64(len(chunk))
+	}
+	return nil
+}
+
+// streamChunkSize is how much of a streamed value is read and written at a
+// time.
+const streamChunkSize = 256 << 10
+
+// patchActive overwrites the active segment at offset with p, which must lie
+// within what has been written. The active segment is append-only, so p is
+// written through a handle of its own unless the segment uses direct I/O.
+func (s *Storage) patchActive(p []byte, offset int64) error {
+	if s.direct != nil {
+		if err := s.direct.patch(p, offset); err != nil {
+			return s.writeError(err, errors.ErrRecordHeaderWriteFailed, "Failed to rewrite record header")
+		}
+		return nil
+	}
+
+	file, err := s.options.FileSystem.OpenFile(s.ActiveSegmentPath(), os.O_WRONLY, 0644)
+	if err != nil {
+		return s.writeError(err, errors.ErrRecordHeaderWriteFailed, "Failed to open active segment to rewrite record header")
+	}
+	defer file.Close()
+
+	if _, err := file.WriteAt(p, offset); err != nil {
+		return s.writeError(err, errors.ErrRecordHeaderWriteFailed, "Failed to rewrite record header")
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package storage
+
+import (
+	"context"
+	"time"
+)
+
+// Timings breaks down where Get and Set calls spent their time, for the slow
+// operation log. Phases add up across calls that share one.
+type Timings struct {
+	// Open is spent getting a handle on a sealed segment, fetching it back
+	// from the archive included.
+	Open time.Duration
+	// Read is spent reading the record header and payload.
+	Read time.Duration
+	// Decode is spent unmarshalling, decrypting and decompressing a record
+	// read, and Checksum verifying it.
+	Decode   time.Duration
+	Checksum time.Duration
+	// Encode is spent compressing, encrypting and marshalling a record
+	// written, Write appending it to the segment and Sync on fsync.
+	Encode time.Duration
+	Write  time.Duration
+	Sync   time.Duration
+}
+
+type timingsKey struct{}
+
+// WithTimings returns a context under which storage calls add their phases
+// to timings.
+func WithTimings(ctx context.Context, timings *Timings) context.Context {
+	return context.WithValue(ctx, timingsKey{}, timings)
+}
+
+type phase uint8
+
+const (
+	phaseOpen phase = iota
+	phaseRead
+	phaseDecode
+	phaseChecksum
+	phaseEncode
+	phaseWrite
+	phaseSync
+)
+
+// stopwatch splits a call into phases. It does nothing without Timings, or
+// when nil, so untimed calls never read the clock.
+type stopwatch struct {
+	timings *Timings
+	last    time.Time
+}
+
+func startStopwatch(ctx context.Context) stopwatch {
+	timings, _ := ctx.Value(timingsKey{}).(*Timings)
+	return timings.stopwatch()
+}
+
+func (t *Timings) stopwatch() stopwatch {
+	if t == nil {
+		return stopwatch{}
+	}
+	return stopwatch{timings: t, last: time.Now()}
+}
+
+// lap charges the time since the previous lap to p.
+func (s *stopwatch) lap(p phase) {
+	if s == nil || s.timings == nil {
+		return
+	}
+
+	now := time.Now()
+	elapsed := now.Sub(s.last)
+	s.last = now
+
+	switch p {
+	case phaseOpen:
+		s.timings.Open += elapsed
+	case phaseRead:
+		s.timings.Read += elapsed
+	case phaseDecode:
+		s.timings.Decode += elapsed
+	case phaseChecksum:
+		s.timings.Checksum += elapsed
+	case phaseEncode:
+		s.timings.Encode += elapsed
+	case phaseWrite:
+		s.timings.Write += elapsed
+	case phaseSync:
+		s.timings.Sync += elapsed
+	}
+}
@@ -0,0 +1,275 @@
+package storage
+
+import (
+	"context"
+	stdErrors "errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/iamBelugaa/kvix/pkg/encryption"
+	"github.com/iamBelugaa/kvix/pkg/errors"
+	"github.com/iamBelugaa/kvix/pkg/options"
+	"github.com/iamBelugaa/kvix/pkg/seginfo"
+)
+
+// SegmentPaths lists every segment file of this storage, the active one
+// included, in segment order.
+func (s *Storage) SegmentPaths() ([]string, error) {
+	paths, err := seginfo.ListSegmentPaths(s.options.FileSystem, s.options.SegmentOptions.Directory, s.options.SegmentOptions.Prefix)
+	if err != nil {
+		return nil, errors.NewStorageError(err, errors.ErrIOGeneral, "Failed to list segment files").
+			WithPath(s.options.SegmentOptions.Directory)
+	}
+	return paths, nil
+}
+
+// CheckSegment reads a segment from start to end, validating each header
+// and payload the same way Get does. The caller must keep writers away from
+// the segment while it is scanned.
+func (s *Storage) CheckSegment(ctx context.Context, path string) (*SegmentCheck, error) {
+	segmentID, err := seginfo.ParseSegmentID(path, s.options.SegmentOptions.Prefix)
+	if err != nil {
+		return nil, errors.NewStorageError(err, errors.ErrSystemInternal, "Failed to parse segment ID").WithPath(path)
+	}
+
+	timestamp, err := seginfo.ParseSegmentTimestamp(path, s.options.SegmentOptions.Prefix)
+	if err != nil {
+		return nil, errors.NewStorageError(err, errors.ErrSystemInternal, "Failed to parse segment timestamp").
+			WithPath(path)
+	}
+
+	file, err := s.options.FileSystem.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, errors.NewStorageError(err, errors.ErrIOGeneral, "Failed to open segment").WithPath(path)
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, errors.NewStorageError(err, errors.ErrIOGeneral, "Failed to stat segment").WithPath(path)
+	}
+
+	check := &SegmentCheck{
+		Path:      path,
+		SegmentID: segmentID,
+		Timestamp: timestamp,
+		Size:      stat.Size(),
+		Damaged:   make(map[int64]struct{}),
+	}
+
+	// A header that does not check out is reported, and the records after
+	// it still scanned. Segments of a newer format are not scanned at all, so
+	// a repair cannot cut them.
+	segmentHeader, start, err := seginfo.CheckHeader(file, segmentID, timestamp)
+	if err != nil && !isHeaderDamage(err) {
+		return nil, segmentHeaderError(err, path, segmentID)
+	}
+	if err != nil {
+		check.addDamaged(0, errors.ErrSegmentHeaderInvalid, err.Error())
+		start = seginfo.HeaderSize
+	}
+	check.FramedBytes = min(start, check.Size)
+
+	// Records of a sealed segment end where its key table or footer starts.
+	// A damaged footer is scanned as records, and reported as the garbage
+	// it is.
+	footer, end, err := seginfo.ReadFooter(file, check.Size)
+	if err != nil && !stdErrors.Is(err, seginfo.ErrFooterCorrupt) {
+		return nil, errors.NewStorageError(err, errors.ErrIOGeneral, "Failed to read segment footer").WithPath(path)
+	}
+
+	if _, err := file.Seek(start, io.SeekStart); err != nil {
+		return nil, errors.NewStorageError(err, errors.ErrIOSeekFailed, "Failed to seek past segment header").
+			WithPath(path)
+	}
+	reader := s.scanReader(file)
+	compact := segmentHeader.CompactRecords()
+
+	for offset := start; offset < end; {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		header, err := scanRecordHeader(reader, compact)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			check.addTail(offset, errors.ErrRecordHeaderReadFailed, "truncated record header")
+			break
+		}
+
+		if stdErrors.Is(err, ErrCorruptHeader) {
+			check.addTail(offset, errors.ErrRecordHeaderCorrupted, "corrupt record header")
+			break
+		}
+
+		if err != nil {
+			return nil, errors.NewStorageError(err, errors.ErrRecordHeaderReadFailed, "Failed to read record header").
+				WithPath(path).
+				WithOffset(int(offset))
+		}
+
+		headerSize := header.EncodedSize()
+
+		if header.Version < options.MinSchemaVersion || header.Version > options.MaxSchemaVersion {
+			check.addTail(offset, errors.ErrSystemUnsupportedVersion, fmt.Sprintf("invalid schema version %d", header.Version))
+			break
+		}
+
+		if header.PayloadSize == 0 || header.PayloadSize > options.MaxValueSize {
+			check.addTail(offset, errors.ErrRecordPayloadTooLarge, fmt.Sprintf("invalid payload size %d", header.PayloadSize))
+			break
+		}
+
+		recordEnd := offset + headerSize + int64(header.PayloadSize)
+		if recordEnd > end {
+			check.addTail(offset, errors.ErrRecordPayloadReadFailed, "truncated record payload")
+			break
+		}
+
+		payload := make([]byte, header.PayloadSize)
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			return nil, errors.NewStorageError(err, errors.ErrRecordPayloadReadFailed, "Failed to read record payload").
+				WithPath(path).
+				WithOffset(int(offset))
+		}
+
+		record := &Record{Header: &header}
+		checksummer, supported := s.checksummers[header.ChecksumAlgorithm]
+		switch {
+		case !supported:
+			check.addDamaged(offset, errors.ErrSystemUnsupportedVersion, "unknown checksum algorithm "+header.ChecksumAlgorithm.String())
+		case !checksummer.Verify(payload, header.Checksum):
+			check.addDamaged(offset, errors.ErrRecordChecksumMismatch, "checksum mismatch")
+		case record.unmarshalPayload(payload) != nil:
+			check.addDamaged(offset, errors.ErrRecordDeserialization, "payload does not decode")
+		default:
+			if reason := s.valueDamage(record); reason != "" {
+				check.addDamaged(offset, errors.ErrRecordDeserialization, reason)
+				break
+			}
+			check.Records++
+		}
+
+		offset = recordEnd
+		check.FramedBytes = recordEnd
+	}
+
+	if footer != nil && check.FramedBytes == end {
+		check.FramedBytes = check.Size
+	}
+
+	return check, nil
+}
+
+func (c *SegmentCheck) addDamaged(offset int64, code errors.ErrorCode, reason string) {
+	c.Damaged[offset] = struct{}{}
+	c.Findings = append(c.Findings, SegmentFinding{Offset: offset, Code: code, Reason: reason})
+}
+
+func (c *SegmentCheck) addTail(offset int64, code errors.ErrorCode, reason string) {
+	c.Findings = append(c.Findings, SegmentFinding{
+		Offset: offset,
+		Code:   code,
+		Reason: fmt.Sprintf("%s, %d unreadable bytes follow", reason, c.Size-offset),
+	})
+}
+
+// TruncateSegment cuts a segment back to size. Truncating the active segment
+// also moves the append offset, so the next write lands right after the last
+// intact record. The caller must hold off writers.
+func (s *Storage) TruncateSegment(path string, segmentID uint16, timestamp int64, size int64) error {
+	if path == s.ActiveSegmentPath() {
+		if err := s.Flush(); err != nil {
+			return err
+		}
+
+		if err := s.activeSegment.Truncate(size); err != nil {
+			return errors.NewStorageError(err, errors.ErrIOWriteFailed, "Failed to truncate active segment").
+				WithPath(path)
+		}
+
+		if err := s.activeSegment.Sync(); err != nil {
+			return errors.NewStorageError(err, errors.ErrIOSyncFailed, "Failed to sync active segment").WithPath(path)
+		}
+
+		if s.direct != nil {
+			if err := s.direct.reset(size); err != nil {
+				return errors.NewStorageError(err, errors.ErrIOGeneral, "Failed to read active segment tail").
+					WithPath(path)
+			}
+		}
+
+		if s.buffer != nil {
+			s.buffer.reset(size)
+		}
+
+		s.currentOffset.Store(size)
+		return nil
+	}
+
+	if err := s.segmentPool.Evict(segmentID, timestamp); err != nil {
+		return err
+	}
+
+	if err := s.options.FileSystem.Truncate(path, size); err != nil {
+		return errors.NewStorageError(err, errors.ErrIOWriteFailed, "Failed to truncate segment").WithPath(path)
+	}
+
+	return nil
+}
+
+// RemoveSegment deletes a sealed segment file. The caller makes sure nothing
+// points into it any more.
+func (s *Storage) RemoveSegment(path string, segmentID uint16, timestamp int64) error {
+	if path == s.ActiveSegmentPath() {
+		return errors.NewStorageError(nil, errors.ErrSystemInvalidInput, "Cannot remove the active segment").
+			WithPath(path)
+	}
+
+	if err := s.segmentPool.Evict(segmentID, timestamp); err != nil {
+		return err
+	}
+
+	if err := s.options.FileSystem.Remove(path); err != nil {
+		return errors.NewStorageError(err, errors.ErrIOGeneral, "Failed to remove segment").WithPath(path)
+	}
+	return nil
+}
+
+// valueDamage reports why the stored value of record cannot be turned back
+// into the value that was written, or "" if it can. Values sealed with a key
+// the provider cannot supply are not counted as damage, since dropping them
+// would not bring the key back.
+func (s *Storage) valueDamage(record *Record) string {
+	value := record.Value
+	if record.Header.Flags&FlagEncrypted != 0 {
+		if s.cipher == nil {
+			return ""
+		}
+
+		opened, err := s.openValue(record)
+		if stdErrors.Is(err, encryption.ErrKeyUnavailable) {
+			return ""
+		}
+
+		if err != nil {
+			return "encrypted value does not authenticate"
+		}
+		value = opened
+	}
+
+	if record.Header.Flags&FlagCompressed != 0 {
+		inflated, err := decompressValue(value)
+		if err != nil {
+			return "compressed value does not inflate"
+		}
+		value = inflated
+	}
+
+	if record.Header.Flags&FlagMetadata != 0 {
+		if _, _, err := SplitMetadata(value); err != nil {
+			return "metadata does not decode"
+		}
+	}
+	return ""
+}
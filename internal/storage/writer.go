@@ -0,0 +1,214 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/iamBelugaa/kvix/pkg/errors"
+	"github.com/iamBelugaa/kvix/pkg/filesys"
+)
+
+// writeBuffer holds records appended to the active segment until it fills
+// up or is flushed, so that runs of small records reach the file in one
+// write. Reads of the active segment are served from it as well.
+type writeBuffer struct {
+	mu   sync.Mutex
+	data []byte
+	// start is the segment offset of data[0]; everything before it is in
+	// the file.
+	start int64
+	write func(chunks ...[]byte) error
+}
+
+// holds reports whether any of the segment before end is still in the
+// buffer rather than the file.
+func (b *writeBuffer) holds(end int64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return end > b.start
+}
+
+// append adds chunks to the buffer, flushing it first if they do not fit.
+// Chunks larger than the whole buffer are written straight through.
+func (b *writeBuffer) append(chunks ...[]byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var length int
+	for _, chunk := range chunks {
+		length += len(chunk)
+	}
+
+	if len(b.data)+length > cap(b.data) {
+		if err := b.flushLocked(); err != nil {
+			return err
+		}
+	}
+
+	if length > cap(b.data) {
+		if err := b.write(chunks...); err != nil {
+			return err
+		}
+		b.start += int64(length)
+		return nil
+	}
+
+	for _, chunk := range chunks {
+		b.data = append(b.data, chunk...)
+	}
+	return nil
+}
+
+func (b *writeBuffer) flush() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.flushLocked()
+}
+
+// flushLocked writes the buffer to the file. The buffer is kept when the
+// write fails, so the records in it stay readable.
+func (b *writeBuffer) flushLocked() error {
+	if len(b.data) == 0 {
+		return nil
+	}
+
+	if err := b.write(b.data); err != nil {
+		return err
+	}
+
+	b.start += int64(len(b.data))
+	b.data = b.data[:0]
+	return nil
+}
+
+// reset empties the buffer for a segment whose file ends at start.
+func (b *writeBuffer) reset(start int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.data = b.data[:0]
+	b.start = start
+}
+
+// newWriteBuffer returns the write buffer of an active segment whose file
+// ends at start, or nil if WriteBufferSize is not set.
+func (s *Storage) newWriteBuffer(start int64) *writeBuffer {
+	if s.options.WriteBufferSize <= 0 {
+		return nil
+	}
+
+	return &writeBuffer{
+		data:  make([]byte, 0, s.options.WriteBufferSize),
+		start: start,
+		write: func(chunks ...[]byte) error {
+			return s.writeActive(errors.ErrRecordPayloadWriteFailed, "Failed to write buffered records", chunks...)
+		},
+	}
+}
+
+// bufferedReader reads the active segment, taking bytes still in the write
+// buffer from there.
+type bufferedReader struct {
+	buffer *writeBuffer
+	file   io.ReaderAt
+}
+
+func (r bufferedReader) ReadAt(p []byte, offset int64) (int, error) {
+	r.buffer.mu.Lock()
+	// Flushed bytes do not change, so they are read without holding up
+	// writers.
+	if offset+int64(len(p)) <= r.buffer.start {
+		r.buffer.mu.Unlock()
+		return r.file.ReadAt(p, offset)
+	}
+	defer r.buffer.mu.Unlock()
+
+	var n int
+	if offset < r.buffer.start {
+		fromFile := p[:min(int64(len(p)), r.buffer.start-offset)]
+
+		read, err := r.file.ReadAt(fromFile, offset)
+		if read < len(fromFile) || read == len(p) {
+			return read, err
+		}
+
+		n = read
+		offset += int64(read)
+	}
+
+	n += copy(p[n:], r.buffer.data[min(offset-r.buffer.start, int64(len(r.buffer.data))):])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// activeReader returns a reader over the active segment.
+func (s *Storage) activeReader() io.ReaderAt {
+	var file io.ReaderAt = s.activeSegment
+	if s.direct != nil {
+		file = filesys.DirectReader(s.activeSegment)
+	}
+
+	if s.buffer != nil {
+		return bufferedReader{buffer: s.buffer, file: file}
+	}
+	return file
+}
+
+// appendRecord writes an encoded record to the end of the active segment,
+// through the write buffer when there is one.
+func (s *Storage) appendRecord(header, payload []byte) error {
+	switch {
+	case s.buffer != nil:
+		return s.buffer.append(header, payload)
+	case s.direct != nil:
+		return s.writeActive(errors.ErrRecordPayloadWriteFailed, "Failed to write record", header, payload)
+	}
+
+	if err := s.writeActive(errors.ErrRecordHeaderWriteFailed, "Failed to write record header", header); err != nil {
+		return err
+	}
+	return s.writeActive(errors.ErrRecordPayloadWriteFailed, "Failed to write record", payload)
+}
+
+// writeActive writes chunks to the end of the active segment file.
+func (s *Storage) writeActive(code errors.ErrorCode, message string, chunks ...[]byte) error {
+	if s.direct != nil {
+		if err := s.direct.append(chunks...); err != nil {
+			return s.writeError(err, code, message)
+		}
+		return nil
+	}
+
+	for _, chunk := range chunks {
+		written, err := s.activeSegment.Write(chunk)
+		if err != nil {
+			return s.writeError(err, code, message)
+		}
+
+		if written != len(chunk) {
+			return s.writeError(
+				nil, errors.ErrIOWriteFailed, fmt.Sprintf("Short write occurred: %d written, expected %d", written, len(chunk)),
+			)
+		}
+	}
+	return nil
+}
+
+func (s *Storage) writeError(err error, code errors.ErrorCode, message string) error {
+	return errors.NewStorageError(err, code, message).
+		WithFileName(s.activeSegment.Name()).
+		WithSegmentID(int(s.activeSegmentID)).
+		WithPath(s.options.SegmentOptions.Directory)
+}
+
+// Flush writes records held in the write buffer to the active segment file,
+// for readers that open the file directly.
+func (s *Storage) Flush() error {
+	if s.buffer == nil {
+		return nil
+	}
+	return s.buffer.flush()
+}
@@ -0,0 +1,91 @@
+package archive
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Uploader stores sealed segments in object storage, such as an S3 compatible
+// bucket. Object names are slash separated paths relative to the segment
+// directory, with any configured prefix in front.
+type Uploader interface {
+	// Upload stores the size bytes read from r as the object name, replacing
+	// any object already there. It must only return nil once the object is
+	// durably stored, since the local copy is deleted afterwards.
+	Upload(ctx context.Context, name string, r io.Reader, size int64) error
+}
+
+// Downloader reads back objects stored by an Uploader, so reads of archived
+// segments can be served.
+type Downloader interface {
+	// Download writes the object name to w.
+	Download(ctx context.Context, name string, w io.Writer) error
+}
+
+type dir struct {
+	root string
+}
+
+// Dir stores objects as files under root, for archiving to a mounted network
+// file system or for trying archival out without a bucket. It is also a
+// Downloader.
+func Dir(root string) Uploader {
+	return &dir{root: root}
+}
+
+func (d *dir) Upload(ctx context.Context, name string, r io.Reader, size int64) error {
+	path := filepath.Join(d.root, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	tmpPath := path + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+
+	written, err := io.Copy(file, &contextReader{ctx: ctx, r: r})
+	if err == nil && written != size {
+		err = fmt.Errorf("archive: wrote %d bytes of %s, expected %d", written, name, size)
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
+}
+
+func (d *dir) Download(ctx context.Context, name string, w io.Writer) error {
+	file, err := os.Open(filepath.Join(d.root, filepath.FromSlash(name)))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(w, &contextReader{ctx: ctx, r: file})
+	return err
+}
+
+// contextReader stops a copy once ctx is done.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
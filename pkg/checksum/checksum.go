@@ -1,9 +1,75 @@
 package checksum
 
 import (
+	"fmt"
+	"hash"
 	"hash/crc32"
 )
 
+// Algorithm identifies a checksum implementation on disk. Values are stored
+// in record headers and must never be renumbered.
+type Algorithm uint8
+
+const (
+	AlgorithmCRC32IEEE Algorithm = 1
+	// AlgorithmCRC32C is CRC32 with the Castagnoli polynomial, which the
+	// standard library computes with SSE4.2 or ARMv8 CRC instructions where
+	// available.
+	AlgorithmCRC32C Algorithm = 2
+	// AlgorithmXXHash64 is the 64-bit xxHash.
+	AlgorithmXXHash64 Algorithm = 3
+)
+
+func (a Algorithm) String() string {
+	switch a {
+	case AlgorithmCRC32IEEE:
+		return "crc32-ieee"
+	case AlgorithmCRC32C:
+		return "crc32c"
+	case AlgorithmXXHash64:
+		return "xxhash64"
+	}
+	return fmt.Sprintf("algorithm(%d)", uint8(a))
+}
+
+// Size returns the width of the algorithm's checksum in bytes.
+func (a Algorithm) Size() int {
+	if a == AlgorithmXXHash64 {
+		return 8
+	}
+	return 4
+}
+
+// Supported lists every algorithm New accepts.
+func Supported() []Algorithm {
+	return []Algorithm{AlgorithmCRC32IEEE, AlgorithmCRC32C, AlgorithmXXHash64}
+}
+
+// Checksummer computes record checksums. Results are widened to uint64;
+// 32-bit algorithms leave the upper half zero.
+type Checksummer interface {
+	Algorithm() Algorithm
+	Calculate(data []byte) uint64
+	Verify(data []byte, expected uint64) bool
+	// New returns a hash whose Sum64 is the checksum of everything written
+	// to it, for data that is never held in memory at once.
+	New() hash.Hash64
+}
+
+// New returns the checksummer for algorithm. Checksummers are stateless and
+// safe for concurrent use.
+func New(algorithm Algorithm) (Checksummer, error) {
+	switch algorithm {
+	case AlgorithmCRC32IEEE:
+		return NewCRC32IEEE(), nil
+	case AlgorithmCRC32C:
+		return NewCRC32C(), nil
+	case AlgorithmXXHash64:
+		return NewXXHash64(), nil
+	}
+	return nil, fmt.Errorf("unsupported checksum algorithm %d", uint8(algorithm))
+}
+
 type CRC32IEEE struct {
 	table *crc32.Table
 }
@@ -12,11 +78,52 @@ func NewCRC32IEEE() *CRC32IEEE {
 	return &CRC32IEEE{table: crc32.MakeTable(crc32.IEEE)}
 }
 
-func (c *CRC32IEEE) Calculate(data []byte) uint32 {
-	return crc32.Checksum(data, c.table)
+func (c *CRC32IEEE) Algorithm() Algorithm {
+	return AlgorithmCRC32IEEE
 }
 
-func (c *CRC32IEEE) Verify(data []byte, expected uint32) bool {
+func (c *CRC32IEEE) Calculate(data []byte) uint64 {
+	return uint64(crc32.Checksum(data, c.table))
+}
+
+func (c *CRC32IEEE) Verify(data []byte, expected uint64) bool {
 	checksum := crc32.Checksum(data, c.table)
-	return checksum == expected
+	return uint64(checksum) == expected
+}
+
+func (c *CRC32IEEE) New() hash.Hash64 {
+	return crc32Hash{crc32.New(c.table)}
+}
+
+type CRC32C struct {
+	table *crc32.Table
+}
+
+func NewCRC32C() *CRC32C {
+	return &CRC32C{table: crc32.MakeTable(crc32.Castagnoli)}
+}
+
+func (c *CRC32C) Algorithm() Algorithm {
+	return AlgorithmCRC32C
+}
+
+func (c *CRC32C) Calculate(data []byte) uint64 {
+	return uint64(crc32.Checksum(data, c.table))
+}
+
+func (c *CRC32C) Verify(data []byte, expected uint64) bool {
+	return uint64(crc32.Checksum(data, c.table)) == expected
+}
+
+func (c *CRC32C) New() hash.Hash64 {
+	return crc32Hash{crc32.New(c.table)}
+}
+
+// crc32Hash widens a CRC32 hash to the 64-bit results of Checksummer.
+type crc32Hash struct {
+	hash.Hash32
+}
+
+func (h crc32Hash) Sum64() uint64 {
+	return uint64(h.Sum32())
 }
@@ -0,0 +1,181 @@
+package checksum
+
+import (
+	"encoding/binary"
+	"hash"
+	"math/bits"
+)
+
+// The primes are variables so that the wrapping arithmetic in the seed setup is
+// done at run time instead of being rejected as constant overflow.
+var (
+	xxPrime1 uint64 = 11400714785074694791
+	xxPrime2 uint64 = 14029467366897019727
+	xxPrime3 uint64 = 1609587929392839161
+	xxPrime4 uint64 = 9650029242287828579
+	xxPrime5 uint64 = 2870177450012600261
+)
+
+// XXHash64 is the 64-bit xxHash (XXH64) with a zero seed. It is not a CRC,
+// but it is fast in software and its 64-bit output makes accidental matches
+// on corrupted data far less likely than with a 32-bit checksum.
+type XXHash64 struct{}
+
+func NewXXHash64() *XXHash64 {
+	return &XXHash64{}
+}
+
+func (x *XXHash64) Algorithm() Algorithm {
+	return AlgorithmXXHash64
+}
+
+func (x *XXHash64) Calculate(data []byte) uint64 {
+	return xxhash64(data)
+}
+
+func (x *XXHash64) Verify(data []byte, expected uint64) bool {
+	return xxhash64(data) == expected
+}
+
+func (x *XXHash64) New() hash.Hash64 {
+	d := &xxDigest{}
+	d.Reset()
+	return d
+}
+
+// xxDigest computes xxhash64 over data written in pieces. It keeps the
+// four lanes of the 32-byte stripes and buffers a partial stripe.
+type xxDigest struct {
+	v1, v2, v3, v4 uint64
+	total          uint64
+	buffer         [32]byte
+	buffered       int
+}
+
+func (d *xxDigest) Reset() {
+	d.v1 = xxPrime1 + xxPrime2
+	d.v2 = xxPrime2
+	d.v3 = 0
+	d.v4 = -xxPrime1
+	d.total = 0
+	d.buffered = 0
+}
+
+func (d *xxDigest) Size() int      { return 8 }
+func (d *xxDigest) BlockSize() int { return 32 }
+
+func (d *xxDigest) Write(b []byte) (int, error) {
+	n := len(b)
+	d.total += uint64(n)
+
+	if d.buffered > 0 {
+		copied := copy(d.buffer[d.buffered:], b)
+		d.buffered += copied
+		b = b[copied:]
+		if d.buffered < 32 {
+			return n, nil
+		}
+		d.stripe(d.buffer[:])
+		d.buffered = 0
+	}
+
+	for len(b) >= 32 {
+		d.stripe(b[:32])
+		b = b[32:]
+	}
+	d.buffered = copy(d.buffer[:], b)
+	return n, nil
+}
+
+func (d *xxDigest) stripe(b []byte) {
+	d.v1 = xxRound(d.v1, binary.LittleEndian.Uint64(b[0:8]))
+	d.v2 = xxRound(d.v2, binary.LittleEndian.Uint64(b[8:16]))
+	d.v3 = xxRound(d.v3, binary.LittleEndian.Uint64(b[16:24]))
+	d.v4 = xxRound(d.v4, binary.LittleEndian.Uint64(b[24:32]))
+}
+
+func (d *xxDigest) Sum64() uint64 {
+	var h uint64
+	if d.total >= 32 {
+		h = xxMergeLanes(d.v1, d.v2, d.v3, d.v4)
+	} else {
+		h = xxPrime5
+	}
+	return xxFinish(h+d.total, d.buffer[:d.buffered])
+}
+
+func (d *xxDigest) Sum(b []byte) []byte {
+	return binary.BigEndian.AppendUint64(b, d.Sum64())
+}
+
+func xxhash64(b []byte) uint64 {
+	n := len(b)
+	var h uint64
+
+	if n >= 32 {
+		v1 := xxPrime1 + xxPrime2
+		v2 := xxPrime2
+		v3 := uint64(0)
+		v4 := -xxPrime1
+
+		for len(b) >= 32 {
+			v1 = xxRound(v1, binary.LittleEndian.Uint64(b[0:8]))
+			v2 = xxRound(v2, binary.LittleEndian.Uint64(b[8:16]))
+			v3 = xxRound(v3, binary.LittleEndian.Uint64(b[16:24]))
+			v4 = xxRound(v4, binary.LittleEndian.Uint64(b[24:32]))
+			b = b[32:]
+		}
+
+		h = xxMergeLanes(v1, v2, v3, v4)
+	} else {
+		h = xxPrime5
+	}
+	return xxFinish(h+uint64(n), b)
+}
+
+func xxMergeLanes(v1, v2, v3, v4 uint64) uint64 {
+	h := bits.RotateLeft64(v1, 1) + bits.RotateLeft64(v2, 7) + bits.RotateLeft64(v3, 12) + bits.RotateLeft64(v4, 18)
+	h = xxMergeRound(h, v1)
+	h = xxMergeRound(h, v2)
+	h = xxMergeRound(h, v3)
+	return xxMergeRound(h, v4)
+}
+
+// xxFinish mixes the trailing bytes of the input, fewer than a stripe, into
+// h and avalanches the result.
+func xxFinish(h uint64, b []byte) uint64 {
+	for ; len(b) >= 8; b = b[8:] {
+		h ^= xxRound(0, binary.LittleEndian.Uint64(b[:8]))
+		h = bits.RotateLeft64(h, 27)*xxPrime1 + xxPrime4
+	}
+
+	if len(b) >= 4 {
+		h ^= uint64(binary.LittleEndian.Uint32(b[:4])) * xxPrime1
+		h = bits.RotateLeft64(h, 23)*xxPrime2 + xxPrime3
+		b = b[4:]
+	}
+
+	for _, c := range b {
+		h ^= uint64(c) * xxPrime5
+		h = bits.RotateLeft64(h, 11) * xxPrime1
+	}
+
+	h ^= h >> 33
+	h *= xxPrime2
+	h ^= h >> 29
+	h *= xxPrime3
+	h ^= h >> 32
+	return h
+}
+
+func xxRound(acc, input uint64) uint64 {
+	acc += input * xxPrime2
+	acc = bits.RotateLeft64(acc, 31)
+	return acc * xxPrime1
+}
+
+func xxMergeRound(acc, val uint64) uint64 {
+	val = xxRound(0, val)
+	acc ^= val
+	return acc*xxPrime1 + xxPrime4
+}
@@ -0,0 +1,84 @@
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"sync"
+)
+
+// Cipher seals values with AES-GCM under the keys of a KeyProvider, keeping
+// one AEAD per key version. It is safe for concurrent use.
+type Cipher struct {
+	provider KeyProvider
+
+	mu    sync.RWMutex
+	aeads map[uint32]cipher.AEAD
+}
+
+func NewCipher(provider KeyProvider) *Cipher {
+	return &Cipher{provider: provider, aeads: make(map[uint32]cipher.AEAD)}
+}
+
+func (c *Cipher) CurrentVersion() uint32 {
+	return c.provider.CurrentVersion()
+}
+
+// Seal encrypts plaintext with key version and returns the random nonce
+// followed by the ciphertext. additional is authenticated but not stored.
+func (c *Cipher) Seal(version uint32, plaintext, additional []byte) ([]byte, error) {
+	aead, err := c.aead(version)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, additional), nil
+}
+
+// Open reverses Seal, failing if sealed or additional were altered.
+func (c *Cipher) Open(version uint32, sealed, additional []byte) ([]byte, error) {
+	aead, err := c.aead(version)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < aead.NonceSize()+aead.Overhead() {
+		return nil, fmt.Errorf("sealed value of %d bytes is too short", len(sealed))
+	}
+
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, additional)
+}
+
+func (c *Cipher) aead(version uint32) (cipher.AEAD, error) {
+	c.mu.RLock()
+	aead, ok := c.aeads[version]
+	c.mu.RUnlock()
+	if ok {
+		return aead, nil
+	}
+
+	key, err := c.provider.Key(version)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("%w: version %d: %v", ErrKeyUnavailable, version, err)
+	}
+
+	if aead, err = cipher.NewGCM(block); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.aeads[version] = aead
+	c.mu.Unlock()
+	return aead, nil
+}
@@ -0,0 +1,138 @@
+package encryption
+
+import (
+	"encoding/base64"
+	stdErrors "errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ErrKeyUnavailable is returned when a provider has no key for a version.
+var ErrKeyUnavailable = stdErrors.New("encryption key unavailable")
+
+// KeyProvider supplies AES keys by version. Versions are stored with every
+// encrypted record, so a provider must keep serving old versions for as long
+// as records encrypted with them may exist.
+type KeyProvider interface {
+	// CurrentVersion names the key new segments are encrypted with.
+	CurrentVersion() uint32
+	// Key returns the 16, 24 or 32 byte key of version, selecting AES-128,
+	// AES-192 or AES-256.
+	Key(version uint32) ([]byte, error)
+}
+
+type staticKey struct {
+	key []byte
+}
+
+// StaticKey serves a single key as version 1.
+func StaticKey(key []byte) KeyProvider {
+	return &staticKey{key: key}
+}
+
+func (s *staticKey) CurrentVersion() uint32 {
+	return 1
+}
+
+func (s *staticKey) Key(version uint32) ([]byte, error) {
+	if version != 1 {
+		return nil, fmt.Errorf("%w: version %d", ErrKeyUnavailable, version)
+	}
+	return s.key, nil
+}
+
+type keyring struct {
+	current uint32
+	keys    map[uint32][]byte
+}
+
+// EnvKeys reads keys from the environment variable name, formatted as a
+// comma separated list of version:base64-key pairs such as "1:...,2:...".
+// The highest version is the current one, so rotating is a matter of
+// appending a new pair and restarting.
+func EnvKeys(name string) (KeyProvider, error) {
+	value, ok := os.LookupEnv(name)
+	if !ok || strings.TrimSpace(value) == "" {
+		return nil, fmt.Errorf("environment variable %s is not set", name)
+	}
+
+	ring := &keyring{keys: make(map[uint32][]byte)}
+	for _, pair := range strings.Split(value, ",") {
+		versionText, encoded, ok := strings.Cut(strings.TrimSpace(pair), ":")
+		if !ok {
+			return nil, fmt.Errorf("%s: expected version:key, got %q", name, pair)
+		}
+
+		version, err := strconv.ParseUint(versionText, 10, 32)
+		if err != nil || version == 0 {
+			return nil, fmt.Errorf("%s: invalid key version %q", name, versionText)
+		}
+
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("%s: key version %d is not valid base64: %w", name, version, err)
+		}
+
+		if _, exists := ring.keys[uint32(version)]; exists {
+			return nil, fmt.Errorf("%s: duplicate key version %d", name, version)
+		}
+
+		ring.keys[uint32(version)] = key
+		ring.current = max(ring.current, uint32(version))
+	}
+
+	return ring, nil
+}
+
+func (k *keyring) CurrentVersion() uint32 {
+	return k.current
+}
+
+func (k *keyring) Key(version uint32) ([]byte, error) {
+	key, ok := k.keys[version]
+	if !ok {
+		return nil, fmt.Errorf("%w: version %d", ErrKeyUnavailable, version)
+	}
+	return key, nil
+}
+
+type callback struct {
+	current func() uint32
+	fetch   func(version uint32) ([]byte, error)
+
+	mu    sync.Mutex
+	cache map[uint32][]byte
+}
+
+// Callback adapts an external key service such as a KMS. current is asked
+// for the active version whenever a segment is opened; fetch is called at
+// most once per version that is read or written, and its keys are cached
+// for the life of the provider. fetch should wrap ErrKeyUnavailable when it
+// does not know a version.
+func Callback(current func() uint32, fetch func(version uint32) ([]byte, error)) KeyProvider {
+	return &callback{current: current, fetch: fetch, cache: make(map[uint32][]byte)}
+}
+
+func (c *callback) CurrentVersion() uint32 {
+	return c.current()
+}
+
+func (c *callback) Key(version uint32) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if key, ok := c.cache[version]; ok {
+		return key, nil
+	}
+
+	key, err := c.fetch(version)
+	if err != nil {
+		return nil, err
+	}
+
+	c.cache[version] = key
+	return key, nil
+}
@@ -1,15 +1,66 @@
 package errors
 
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"sync/atomic"
+)
+
+// maxStackDepth bounds the frames captured for an error.
+const maxStackDepth = 32
+
+// captureStacks is off by default: walking the stack costs a few
+// microseconds per error, which hot paths that create and discard errors
+// should not pay. stackHolders counts the AcquireStackTraces calls not yet
+// released; stacks are captured while either is set.
+var (
+	captureStacks atomic.Bool
+	stackHolders  atomic.Int64
+)
+
+// SetStackTraces turns capturing a stack trace with every new error on or
+// off, for the whole process. Turning it off leaves it on while holders of
+// AcquireStackTraces remain.
+func SetStackTraces(enabled bool) {
+	captureStacks.Store(enabled)
+}
+
+// AcquireStackTraces turns capturing stack traces on for the whole process
+// until it is matched by ReleaseStackTraces. Every instance opened with
+// stack traces holds it until it closes, so the last one to close turns
+// capturing back off.
+func AcquireStackTraces() {
+	stackHolders.Add(1)
+}
+
+// ReleaseStackTraces drops a hold taken by AcquireStackTraces.
+func ReleaseStackTraces() {
+	if stackHolders.Add(-1) < 0 {
+		stackHolders.Add(1)
+	}
+}
+
+func capturingStacks() bool {
+	return captureStacks.Load() || stackHolders.Load() > 0
+}
+
 // baseError is a custom error type that can hold extra information.
 type baseError struct {
 	cause   error          // The original error that caused this one.
 	message string         // The error message that will be displayed to users.
 	code    ErrorCode      // Error code for categorizing the error type programmatically.
 	details map[string]any // Additional context information like request IDs, timestamps, etc.
+	stack   []uintptr      // Program counters of the call path, when stack traces are on.
 }
 
 func NewBaseError(err error, code ErrorCode, msg string) *baseError {
-	return &baseError{cause: err, code: code, message: msg}
+	be := &baseError{cause: err, code: code, message: msg}
+	if capturingStacks() {
+		pcs := make([]uintptr, maxStackDepth)
+		be.stack = pcs[:runtime.Callers(2, pcs)]
+	}
+	return be
 }
 
 func (be *baseError) WithMessage(msg string) *baseError {
@@ -45,3 +96,26 @@ func (b *baseError) Code() ErrorCode {
 func (b *baseError) Details() map[string]any {
 	return b.details
 }
+
+// StackTrace returns the call path the error was created on, one frame per
+// line pair as in a panic, starting at the caller of its constructor. It is
+// empty unless stack traces were on when the error was created.
+func (b *baseError) StackTrace() string {
+	if len(b.stack) == 0 {
+		return ""
+	}
+
+	var trace strings.Builder
+	frames := runtime.CallersFrames(b.stack)
+	for {
+		frame, more := frames.Next()
+		// Constructors of this package are not part of the call path.
+		if trace.Len() > 0 || !strings.HasPrefix(frame.Function, packagePath+".") {
+			fmt.Fprintf(&trace, "%s\n\t%s:%d\n", frame.Function, frame.File, frame.Line)
+		}
+		if !more {
+			break
+		}
+	}
+	return trace.String()
+}
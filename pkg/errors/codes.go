@@ -18,6 +18,7 @@ const (
 
 	ErrRecordKeyMismatch        ErrorCode = "RECORD_KEY_MISMATCH"
 	ErrRecordHeaderReadFailed   ErrorCode = "RECORD_HEADER_READ_FAILED"
+	ErrRecordHeaderCorrupted    ErrorCode = "RECORD_HEADER_CORRUPTED"
 	ErrRecordHeaderWriteFailed  ErrorCode = "RECORD_HEADER_WRITE_FAILED"
 	ErrRecordSerialization      ErrorCode = "RECORD_SERIALIZATION"
 	ErrRecordDeserialization    ErrorCode = "RECORD_DESERIALIZATION"
@@ -25,4 +26,7 @@ const (
 	ErrRecordPayloadTooLarge    ErrorCode = "RECORD_PAYLOAD_TOO_LARGE"
 	ErrRecordPayloadReadFailed  ErrorCode = "RECORD_PAYLOAD_READ_FAILED"
 	ErrRecordPayloadWriteFailed ErrorCode = "RECORD_PAYLOAD_WRITE_FAILED"
+
+	ErrSegmentHeaderInvalid   ErrorCode = "SEGMENT_HEADER_INVALID"
+	ErrSegmentKeyIndexInvalid ErrorCode = "SEGMENT_KEY_INDEX_INVALID"
 )
@@ -4,6 +4,10 @@ import (
 	stdErrors "errors"
 )
 
+// packagePath is the import path of this package, as it appears in the
+// function names of stack frames.
+const packagePath = "github.com/iamBelugaa/kvix/pkg/errors"
+
 func AsValidationError(err error) (*ValidationError, bool) {
 	var ve *ValidationError
 	if stdErrors.As(err, &ve) {
@@ -27,3 +31,27 @@ func AsIndexError(err error) (*IndexError, bool) {
 	}
 	return nil, false
 }
+
+// GetErrorCode returns the code carried by err, or an empty code when err is
+// not one of the package's error types.
+func GetErrorCode(err error) ErrorCode {
+	var coded interface{ Code() ErrorCode }
+	if stdErrors.As(err, &coded) {
+		return coded.Code()
+	}
+	return ""
+}
+
+// GetStackTrace returns the stack trace of the first error in err's chain
+// that carries one, or an empty string if none does.
+func GetStackTrace(err error) string {
+	for err != nil {
+		if traced, ok := err.(interface{ StackTrace() string }); ok {
+			if trace := traced.StackTrace(); trace != "" {
+				return trace
+			}
+		}
+		err = stdErrors.Unwrap(err)
+	}
+	return ""
+}
@@ -0,0 +1,68 @@
+package filesys
+
+import (
+	"io"
+	"unsafe"
+)
+
+// DirectIOAlignment is the block size direct I/O offsets, lengths and buffer
+// addresses are aligned to. It covers the logical block size of common disks.
+const DirectIOAlignment = 4096
+
+// AlignedBuffer returns a zeroed buffer of size bytes starting at a
+// DirectIOAlignment boundary in memory.
+func AlignedBuffer(size int) []byte {
+	buffer := make([]byte, size+DirectIOAlignment)
+	shift := 0
+	if remainder := int(uintptr(unsafe.Pointer(&buffer[0])) & (DirectIOAlignment - 1)); remainder != 0 {
+		shift = DirectIOAlignment - remainder
+	}
+	return buffer[shift : shift+size : shift+size]
+}
+
+// AlignDown rounds offset down to a DirectIOAlignment boundary.
+func AlignDown(offset int64) int64 {
+	return offset &^ (DirectIOAlignment - 1)
+}
+
+// AlignUp rounds offset up to a DirectIOAlignment boundary.
+func AlignUp(offset int64) int64 {
+	return AlignDown(offset + DirectIOAlignment - 1)
+}
+
+type directReader struct {
+	file io.ReaderAt
+}
+
+// DirectReader reads from a file opened for direct I/O at any offset and
+// length, by reading the aligned blocks around them into an aligned buffer.
+func DirectReader(file io.ReaderAt) io.ReaderAt {
+	return directReader{file: file}
+}
+
+func (r directReader) ReadAt(p []byte, offset int64) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	start := AlignDown(offset)
+	buffer := AlignedBuffer(int(AlignUp(offset+int64(len(p))) - start))
+
+	read, err := r.file.ReadAt(buffer, start)
+	skip := int(offset - start)
+	if read <= skip {
+		if err == nil {
+			err = io.EOF
+		}
+		return 0, err
+	}
+
+	n := copy(p, buffer[skip:read])
+	if n == len(p) {
+		return n, nil
+	}
+	if err == nil {
+		err = io.EOF
+	}
+	return n, err
+}
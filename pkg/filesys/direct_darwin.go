@@ -0,0 +1,34 @@
+//go:build darwin
+
+package filesys
+
+import (
+	"os"
+	"syscall"
+)
+
+// SetDirectIO makes reads and writes of file bypass the unified buffer
+// cache. Unlike O_DIRECT, F_NOCACHE does not require aligned I/O. Files other
+// than *os.File are not supported.
+func SetDirectIO(file File) error {
+	osFile, ok := file.(*os.File)
+	if !ok {
+		return ErrDirectIOUnsupported
+	}
+
+	conn, err := osFile.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var fcntlErr error
+	err = conn.Control(func(fd uintptr) {
+		if _, _, errno := syscall.Syscall(syscall.SYS_FCNTL, fd, syscall.F_NOCACHE, 1); errno != 0 {
+			fcntlErr = errno
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return fcntlErr
+}
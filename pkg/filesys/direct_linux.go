@@ -0,0 +1,40 @@
+//go:build linux
+
+package filesys
+
+import (
+	"os"
+	"syscall"
+)
+
+// SetDirectIO makes reads and writes of file bypass the page cache. Files
+// other than *os.File are not supported. File systems without direct I/O,
+// such as older tmpfs, fail it with EINVAL and leave file as it was.
+func SetDirectIO(file File) error {
+	osFile, ok := file.(*os.File)
+	if !ok {
+		return ErrDirectIOUnsupported
+	}
+
+	conn, err := osFile.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var fcntlErr error
+	err = conn.Control(func(fd uintptr) {
+		flags, _, errno := syscall.Syscall(syscall.SYS_FCNTL, fd, syscall.F_GETFL, 0)
+		if errno != 0 {
+			fcntlErr = errno
+			return
+		}
+
+		if _, _, errno = syscall.Syscall(syscall.SYS_FCNTL, fd, syscall.F_SETFL, flags|syscall.O_DIRECT); errno != 0 {
+			fcntlErr = errno
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return fcntlErr
+}
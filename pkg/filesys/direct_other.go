@@ -0,0 +1,8 @@
+//go:build !(linux || darwin)
+
+package filesys
+
+// SetDirectIO makes reads and writes of file bypass the page cache.
+func SetDirectIO(file File) error {
+	return ErrDirectIOUnsupported
+}
@@ -2,16 +2,24 @@ package filesys
 
 import (
 	"errors"
+	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
 )
 
 var (
-	ErrIsNotDir = errors.New("path isn't a directory")
+	ErrIsNotDir             = errors.New("path isn't a directory")
+	ErrIsDir                = errors.New("path is a directory")
+	ErrDirNotEmpty          = errors.New("directory is not empty")
+	ErrBadMode              = errors.New("file was not opened for this operation")
+	ErrWriteAtInAppendMode  = errors.New("WriteAt is not allowed on files opened with O_APPEND")
+	ErrFreeSpaceUnsupported = errors.New("free space is not reported on this platform")
+	ErrDirectIOUnsupported  = errors.New("direct I/O is not supported on this platform")
 )
 
-func CreateDir(dirPath string, permission os.FileMode, force bool) error {
-	stat, err := os.Stat(dirPath)
+func CreateDir(fsys FileSystem, dirPath string, permission os.FileMode, force bool) error {
+	stat, err := fsys.Stat(dirPath)
 	if !force && !os.IsNotExist(err) {
 		return err
 	}
@@ -20,14 +28,80 @@ func CreateDir(dirPath string, permission os.FileMode, force bool) error {
 		return ErrIsNotDir
 	}
 
-	if err := os.MkdirAll(dirPath, permission); err != nil {
+	if err := fsys.MkdirAll(dirPath, permission); err != nil {
 		return err
 	}
 
-	return os.Chmod(dirPath, 0755)
+	return fsys.Chmod(dirPath, 0755)
 }
 
-func ReadDir(dirName string) ([]string, error) {
-	files, err := filepath.Glob(dirName)
+func ReadDir(fsys FileSystem, dirName string) ([]string, error) {
+	files, err := fsys.Glob(dirName)
 	return files, err
 }
+
+// ReadFile returns the contents of name on fsys, as os.ReadFile does.
+func ReadFile(fsys FileSystem, name string) ([]byte, error) {
+	file, err := fsys.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return io.ReadAll(file)
+}
+
+// WriteFile writes data to name on fsys, creating or truncating it, as
+// os.WriteFile does.
+func WriteFile(fsys FileSystem, name string, data []byte, perm os.FileMode) error {
+	file, err := fsys.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// RemoveAll removes path on fsys and everything under it, as os.RemoveAll
+// does. A missing path is not an error.
+func RemoveAll(fsys FileSystem, path string) error {
+	info, err := fsys.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if info.IsDir() {
+		children, err := fsys.Glob(filepath.Join(path, "*"))
+		if err != nil {
+			return err
+		}
+
+		for _, child := range children {
+			if err := RemoveAll(fsys, child); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := fsys.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// SameFile reports whether a and b, returned by Stat or File.Stat of the same
+// file system, describe the same file, as os.SameFile does for OS. A file
+// replaced through a rename is not the same file as the one it replaced.
+func SameFile(a, b fs.FileInfo) bool {
+	if data, ok := a.Sys().(*memData); ok {
+		return data == b.Sys()
+	}
+	return os.SameFile(a, b)
+}
@@ -0,0 +1,500 @@
+package filesys
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// memFileSystem keeps files in memory. Like on Unix, a removed or renamed
+// file stays readable and writable through handles opened before.
+type memFileSystem struct {
+	mu    sync.Mutex
+	files map[string]*memData
+	dirs  map[string]*memInfo
+}
+
+// memData is the content of one file, shared by its handles.
+type memData struct {
+	mu   sync.RWMutex
+	data []byte
+	info memInfo
+}
+
+// NewMemFS returns an empty file system held in memory, whose root directory
+// exists.
+func NewMemFS() FileSystem {
+	root := string(filepath.Separator)
+	return &memFileSystem{
+		files: make(map[string]*memData),
+		dirs: map[string]*memInfo{
+			root: {name: root, mode: fs.ModeDir | 0755, modTime: time.Now()},
+		},
+	}
+}
+
+// clean returns the absolute, cleaned form of name, under which it is kept.
+func clean(name string) string {
+	if abs, err := filepath.Abs(name); err == nil {
+		return abs
+	}
+	return filepath.Clean(name)
+}
+
+func pathError(op, name string, err error) error {
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+func (m *memFileSystem) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	path := clean(name)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.dirs[path]; ok {
+		if flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+			return nil, pathError("open", name, fs.ErrInvalid)
+		}
+		return nil, pathError("open", name, ErrIsDir)
+	}
+
+	data, exists := m.files[path]
+	switch {
+	case exists && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, pathError("open", name, fs.ErrExist)
+	case !exists && flag&os.O_CREATE == 0:
+		return nil, pathError("open", name, fs.ErrNotExist)
+	case !exists:
+		if _, ok := m.dirs[filepath.Dir(path)]; !ok {
+			return nil, pathError("open", name, fs.ErrNotExist)
+		}
+		data = &memData{info: memInfo{name: filepath.Base(path), mode: perm.Perm(), modTime: time.Now()}}
+		m.files[path] = data
+	}
+
+	if flag&os.O_TRUNC != 0 && flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		data.mu.Lock()
+		data.data = nil
+		data.info.modTime = time.Now()
+		data.mu.Unlock()
+	}
+
+	return &memFile{name: name, data: data, flag: flag}, nil
+}
+
+func (m *memFileSystem) Stat(name string) (fs.FileInfo, error) {
+	path := clean(name)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if dir, ok := m.dirs[path]; ok {
+		info := *dir
+		return &info, nil
+	}
+
+	data, ok := m.files[path]
+	if !ok {
+		return nil, pathError("stat", name, fs.ErrNotExist)
+	}
+	return data.stat(), nil
+}
+
+func (m *memFileSystem) Rename(oldPath, newPath string) error {
+	from, to := clean(oldPath), clean(newPath)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	data, ok := m.files[from]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldPath, New: newPath, Err: fs.ErrNotExist}
+	}
+	if _, ok := m.dirs[filepath.Dir(to)]; !ok {
+		return &os.LinkError{Op: "rename", Old: oldPath, New: newPath, Err: fs.ErrNotExist}
+	}
+	if _, ok := m.dirs[to]; ok {
+		return &os.LinkError{Op: "rename", Old: oldPath, New: newPath, Err: ErrIsDir}
+	}
+
+	delete(m.files, from)
+	m.files[to] = data
+
+	data.mu.Lock()
+	data.info.name = filepath.Base(to)
+	data.mu.Unlock()
+	return nil
+}
+
+func (m *memFileSystem) Remove(name string) error {
+	path := clean(name)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.files[path]; ok {
+		delete(m.files, path)
+		return nil
+	}
+
+	if _, ok := m.dirs[path]; !ok {
+		return pathError("remove", name, fs.ErrNotExist)
+	}
+
+	for other := range m.files {
+		if filepath.Dir(other) == path {
+			return pathError("remove", name, ErrDirNotEmpty)
+		}
+	}
+	for other := range m.dirs {
+		if other != path && filepath.Dir(other) == path {
+			return pathError("remove", name, ErrDirNotEmpty)
+		}
+	}
+
+	delete(m.dirs, path)
+	return nil
+}
+
+func (m *memFileSystem) Truncate(name string, size int64) error {
+	path := clean(name)
+
+	m.mu.Lock()
+	data, ok := m.files[path]
+	m.mu.Unlock()
+
+	if !ok {
+		return pathError("truncate", name, fs.ErrNotExist)
+	}
+	if size < 0 {
+		return pathError("truncate", name, fs.ErrInvalid)
+	}
+
+	data.truncate(size)
+	return nil
+}
+
+func (m *memFileSystem) MkdirAll(path string, perm fs.FileMode) error {
+	dir := clean(path)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var missing []string
+	for {
+		if _, ok := m.files[dir]; ok {
+			return pathError("mkdir", path, ErrIsNotDir)
+		}
+		if _, ok := m.dirs[dir]; ok {
+			break
+		}
+
+		missing = append(missing, dir)
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			break
+		}
+		dir = parent
+	}
+
+	now := time.Now()
+	for _, dir := range missing {
+		m.dirs[dir] = &memInfo{name: filepath.Base(dir), mode: fs.ModeDir | perm.Perm(), modTime: now}
+	}
+	return nil
+}
+
+func (m *memFileSystem) Chmod(name string, mode fs.FileMode) error {
+	path := clean(name)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if dir, ok := m.dirs[path]; ok {
+		dir.mode = fs.ModeDir | mode.Perm()
+		return nil
+	}
+
+	data, ok := m.files[path]
+	if !ok {
+		return pathError("chmod", name, fs.ErrNotExist)
+	}
+
+	data.mu.Lock()
+	data.info.mode = mode.Perm()
+	data.mu.Unlock()
+	return nil
+}
+
+func (m *memFileSystem) Glob(pattern string) ([]string, error) {
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+
+	absolute := filepath.IsAbs(pattern)
+	pattern = clean(pattern)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var matches []string
+	add := func(path string) {
+		if ok, _ := filepath.Match(pattern, path); !ok {
+			return
+		}
+		if !absolute {
+			if rel, err := filepath.Rel(clean("."), path); err == nil {
+				path = rel
+			}
+		}
+		matches = append(matches, path)
+	}
+
+	for path := range m.files {
+		add(path)
+	}
+	for path := range m.dirs {
+		add(path)
+	}
+
+	slices.Sort(matches)
+	return matches, nil
+}
+
+func (d *memData) stat() fs.FileInfo {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	info := d.info
+	info.size = int64(len(d.data))
+	info.sys = d
+	return &info
+}
+
+func (d *memData) truncate(size int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if size <= int64(len(d.data)) {
+		d.data = d.data[:size]
+	} else {
+		d.data = append(d.data, make([]byte, size-int64(len(d.data)))...)
+	}
+	d.info.modTime = time.Now()
+}
+
+// writeAt writes p at offset, growing the file as needed.
+func (d *memData) writeAt(p []byte, offset int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if end := offset + int64(len(p)); end > int64(len(d.data)) {
+		d.data = append(d.data, make([]byte, end-int64(len(d.data)))...)
+	}
+	copy(d.data[offset:], p)
+	d.info.modTime = time.Now()
+}
+
+// memFile is a handle on a memData, with its own offset.
+type memFile struct {
+	mu     sync.Mutex
+	name   string
+	data   *memData
+	flag   int
+	offset int64
+	closed bool
+}
+
+func (f *memFile) check(op string, write bool) error {
+	if f.closed {
+		return pathError(op, f.name, fs.ErrClosed)
+	}
+
+	writable := f.flag&(os.O_WRONLY|os.O_RDWR) != 0
+	readable := f.flag&os.O_WRONLY == 0
+	if (write && !writable) || (!write && !readable) {
+		return pathError(op, f.name, ErrBadMode)
+	}
+	return nil
+}
+
+func (f *memFile) Name() string {
+	return f.name
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.check("read", false); err != nil {
+		return 0, err
+	}
+
+	n, err := f.readAt(p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *memFile) ReadAt(p []byte, offset int64) (int, error) {
+	f.mu.Lock()
+	if err := f.check("read", false); err != nil {
+		f.mu.Unlock()
+		return 0, err
+	}
+	f.mu.Unlock()
+
+	if offset < 0 {
+		return 0, pathError("read", f.name, fs.ErrInvalid)
+	}
+	return f.readAt(p, offset)
+}
+
+func (f *memFile) readAt(p []byte, offset int64) (int, error) {
+	f.data.mu.RLock()
+	defer f.data.mu.RUnlock()
+
+	if offset >= int64(len(f.data.data)) {
+		if len(p) == 0 {
+			return 0, nil
+		}
+		return 0, io.EOF
+	}
+
+	n := copy(p, f.data.data[offset:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.check("write", true); err != nil {
+		return 0, err
+	}
+
+	if f.flag&os.O_APPEND != 0 {
+		f.data.mu.Lock()
+		f.data.data = append(f.data.data, p...)
+		f.data.info.modTime = time.Now()
+		f.offset = int64(len(f.data.data))
+		f.data.mu.Unlock()
+		return len(p), nil
+	}
+
+	f.data.writeAt(p, f.offset)
+	f.offset += int64(len(p))
+	return len(p), nil
+}
+
+func (f *memFile) WriteAt(p []byte, offset int64) (int, error) {
+	f.mu.Lock()
+	if err := f.check("write", true); err != nil {
+		f.mu.Unlock()
+		return 0, err
+	}
+	f.mu.Unlock()
+
+	if f.flag&os.O_APPEND != 0 {
+		return 0, pathError("write", f.name, ErrWriteAtInAppendMode)
+	}
+	if offset < 0 {
+		return 0, pathError("write", f.name, fs.ErrInvalid)
+	}
+
+	f.data.writeAt(p, offset)
+	return len(p), nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return 0, pathError("seek", f.name, fs.ErrClosed)
+	}
+
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		f.data.mu.RLock()
+		offset += int64(len(f.data.data))
+		f.data.mu.RUnlock()
+	}
+
+	if offset < 0 {
+		return 0, pathError("seek", f.name, fs.ErrInvalid)
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *memFile) Stat() (fs.FileInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return nil, pathError("stat", f.name, fs.ErrClosed)
+	}
+	return f.data.stat(), nil
+}
+
+func (f *memFile) Sync() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return pathError("sync", f.name, fs.ErrClosed)
+	}
+	return nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.check("truncate", true); err != nil {
+		return err
+	}
+	if size < 0 {
+		return pathError("truncate", f.name, fs.ErrInvalid)
+	}
+
+	f.data.truncate(size)
+	return nil
+}
+
+func (f *memFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return pathError("close", f.name, fs.ErrClosed)
+	}
+	f.closed = true
+	return nil
+}
+
+// memInfo describes a file or directory of a memFileSystem.
+type memInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+	// sys is the memData of a file, which tells files apart for SameFile.
+	sys any
+}
+
+func (i *memInfo) Name() string       { return i.name }
+func (i *memInfo) Size() int64        { return i.size }
+func (i *memInfo) Mode() fs.FileMode  { return i.mode }
+func (i *memInfo) ModTime() time.Time { return i.modTime }
+func (i *memInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i *memInfo) Sys() any           { return i.sys }
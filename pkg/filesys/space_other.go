@@ -0,0 +1,9 @@
+//go:build !(linux || darwin || freebsd)
+
+package filesys
+
+// FreeSpace returns the bytes available to unprivileged users on the file
+// system holding path.
+func FreeSpace(path string) (int64, error) {
+	return 0, ErrFreeSpaceUnsupported
+}
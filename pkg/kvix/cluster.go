@@ -0,0 +1,238 @@
+package kvix
+
+import (
+	"context"
+	"encoding/binary"
+	stdErrors "errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/iamBelugaa/kvix/internal/engine"
+	"github.com/iamBelugaa/kvix/internal/storage"
+	"github.com/iamBelugaa/kvix/pkg/errors"
+	"github.com/iamBelugaa/kvix/pkg/raft"
+)
+
+// appliedName records, next to the raft log, the last entry the index hint
+// written by the same Close reflects. Like the hint it is consumed on open:
+// after a crash both are missing and the whole log is applied again.
+const appliedName = "applied"
+
+// ClusterStatus describes this member's view of the raft cluster.
+type ClusterStatus = raft.Status
+
+const (
+	commandSet byte = iota + 1
+	commandDelete
+	commandExpire
+	commandPersist
+	// commandSetMetadata carries the value framed by storage.AppendMetadata.
+	commandSetMetadata
+)
+
+// commandHeaderSize covers the op, the absolute expiry in Unix nanoseconds
+// and the key length. The key and then the value follow.
+const commandHeaderSize = 11
+
+func encodeCommand(op byte, key, value []byte, expiresAt int64) []byte {
+	command := make([]byte, commandHeaderSize, commandHeaderSize+len(key)+len(value))
+	command[0] = op
+	binary.LittleEndian.PutUint64(command[1:9], uint64(expiresAt))
+	binary.LittleEndian.PutUint16(command[9:11], uint16(len(key)))
+	command = append(command, key...)
+	return append(command, value...)
+}
+
+// joinCluster starts the raft node that every write of the instance goes
+// through.
+func (i *Instance) joinCluster() error {
+	cluster := i.options.Cluster
+	dir := filepath.Join(i.options.DataDir, "raft")
+
+	applied, err := consumeApplied(dir)
+	if err != nil {
+		return err
+	}
+
+	transport := cluster.Transport
+	if transport == nil {
+		tcp, err := raft.NewTCPTransport(cluster.Peers[cluster.NodeID], cluster.Peers)
+		if err != nil {
+			return errors.NewStorageError(err, errors.ErrIOGeneral, "Failed to listen for cluster traffic").
+				WithDetail("address", cluster.Peers[cluster.NodeID])
+		}
+		transport = tcp
+	}
+
+	peers := make([]string, 0, len(cluster.Peers))
+	for id := range cluster.Peers {
+		if id != cluster.NodeID {
+			peers = append(peers, id)
+		}
+	}
+	slices.Sort(peers)
+
+	node, err := raft.New(raft.Config{
+		ID:                cluster.NodeID,
+		Peers:             peers,
+		Dir:               dir,
+		Transport:         transport,
+		Apply:             i.apply,
+		Applied:           applied,
+		ElectionTimeout:   cluster.ElectionTimeout,
+		HeartbeatInterval: cluster.HeartbeatInterval,
+		Log:               i.log,
+	})
+	if err != nil {
+		transport.Close()
+		return errors.NewStorageError(err, errors.ErrIOGeneral, "Failed to start raft node").WithPath(dir)
+	}
+
+	i.node = node
+	return nil
+}
+
+// leaveCluster stops the raft node and, when the engine closed cleanly,
+// records how much of the log its hint reflects. Callers hold mu exclusively.
+func (i *Instance) leaveCluster(closeEngine func() error) error {
+	if err := i.node.Close(); err != nil && !stdErrors.Is(err, raft.ErrClosed) {
+		i.log.Warnw("Failed to stop raft node cleanly", "error", err)
+	}
+
+	if err := closeEngine(); err != nil {
+		return err
+	}
+
+	path := filepath.Join(i.options.DataDir, "raft", appliedName)
+	applied := binary.LittleEndian.AppendUint64(nil, i.node.Status().Applied)
+	if err := os.WriteFile(path, applied, 0644); err != nil {
+		return errors.NewStorageError(err, errors.ErrIOWriteFailed, "Failed to record applied raft index").WithPath(path)
+	}
+	return nil
+}
+
+func consumeApplied(dir string) (uint64, error) {
+	path := filepath.Join(dir, appliedName)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, errors.NewStorageError(err, errors.ErrIOGeneral, "Failed to read applied raft index").WithPath(path)
+	}
+
+	if err := os.Remove(path); err != nil {
+		return 0, errors.NewStorageError(err, errors.ErrIOGeneral, "Failed to remove applied raft index").WithPath(path)
+	}
+
+	if len(data) != 8 {
+		return 0, nil
+	}
+	return binary.LittleEndian.Uint64(data), nil
+}
+
+// propose commits a write through the cluster and returns its result once
+// this member has applied it. mu is not held while waiting: Close stops the
+// node first, which ends the wait.
+func (i *Instance) propose(context context.Context, op byte, key, value []byte, expiresAt int64) (any, error) {
+	result, err := i.node.Propose(context, encodeCommand(op, key, value, expiresAt))
+	if stdErrors.Is(err, raft.ErrClosed) {
+		return nil, engine.ErrEngineClosed
+	}
+	return result, err
+}
+
+func (i *Instance) proposeBool(context context.Context, op byte, key []byte, expiresAt int64) (bool, error) {
+	result, err := i.propose(context, op, key, nil, expiresAt)
+	if err != nil {
+		return false, err
+	}
+	return result.(bool), nil
+}
+
+// apply is the raft state machine: it runs committed commands against the
+// engine, on every member, in log order.
+func (i *Instance) apply(index uint64, data []byte) (any, error) {
+	if len(data) < commandHeaderSize {
+		return nil, fmt.Errorf("raft entry %d is too short to be a command", index)
+	}
+
+	op := data[0]
+	expiresAt := int64(binary.LittleEndian.Uint64(data[1:9]))
+	keyLength := int(binary.LittleEndian.Uint16(data[9:11]))
+	if len(data) < commandHeaderSize+keyLength {
+		return nil, fmt.Errorf("raft entry %d has a truncated key", index)
+	}
+
+	key := data[commandHeaderSize : commandHeaderSize+keyLength]
+	value := data[commandHeaderSize+keyLength:]
+	context := context.Background()
+
+	switch op {
+	case commandSet:
+		if expiresAt == 0 {
+			return nil, i.engine.Set(context, key, value)
+		}
+		_, err := i.engine.SetXAt(context, key, value, time.Unix(0, expiresAt))
+		return nil, err
+
+	case commandSetMetadata:
+		metadata, value, err := storage.SplitMetadata(value)
+		if err != nil {
+			return nil, fmt.Errorf("raft entry %d has corrupt metadata: %w", index, err)
+		}
+
+		var expiry time.Time
+		if expiresAt != 0 {
+			expiry = time.Unix(0, expiresAt)
+		}
+		_, err = i.engine.SetWithMetadata(context, key, value, metadata, expiry)
+		return nil, err
+
+	case commandDelete:
+		return i.engine.Delete(context, key)
+
+	case commandExpire:
+		return i.engine.ExpireAt(context, key, time.Unix(0, expiresAt))
+
+	case commandPersist:
+		return i.engine.Persist(context, key)
+	}
+
+	return nil, fmt.Errorf("raft entry %d has unknown command %d", index, op)
+}
+
+// Barrier waits until every write committed to the cluster before the call
+// has been applied locally. Called on the leader, it makes the reads that
+// follow linearizable. Outside a cluster it returns at once.
+func (i *Instance) Barrier(context context.Context) error {
+	if i.node == nil {
+		return nil
+	}
+
+	err := i.node.Barrier(context)
+	if stdErrors.Is(err, raft.ErrClosed) {
+		return engine.ErrEngineClosed
+	}
+	return err
+}
+
+// ClusterStatus reports this member's view of the cluster, and false when
+// the instance was not opened WithCluster.
+func (i *Instance) ClusterStatus() (ClusterStatus, bool) {
+	if i.node == nil {
+		return ClusterStatus{}, false
+	}
+	return i.node.Status(), true
+}
+
+func errClusterImport() error {
+	return errors.NewValidationError(
+		nil, errors.ErrSystemInvalidInput,
+		"Imports bypass the replicated log and are not supported on cluster members",
+	)
+}
@@ -0,0 +1,37 @@
+package kvix
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+// SetJSON stores value encoded as JSON under key, recording ContentTypeJSON
+// in its metadata. A zero ttl stores the key without expiration.
+func (i *Instance) SetJSON(context context.Context, key []byte, value any, ttl time.Duration) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return errEncodeValue(err, key, ContentTypeJSON)
+	}
+
+	return i.SetWithMetadata(context, key, data, Metadata{ContentType: ContentTypeJSON}, ttl)
+}
+
+// GetJSON decodes the value of key into target, which must be a non-nil
+// pointer. A value recorded with another content type, or one that is not
+// valid JSON for target, fails with a ValidationError.
+func (i *Instance) GetJSON(context context.Context, key []byte, target any) error {
+	record, err := i.Get(context, key)
+	if err != nil {
+		return err
+	}
+
+	if err := checkContentType(key, record, ContentTypeJSON); err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(record.Value, target); err != nil {
+		return errDecodeValue(err, key, ContentTypeJSON)
+	}
+	return nil
+}
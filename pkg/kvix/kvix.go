@@ -2,28 +2,162 @@ package kvix
 
 import (
 	"context"
+	stdErrors "errors"
 	"fmt"
+	"io"
+	"net"
+	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/iamBelugaa/kvix/internal/backup"
 	"github.com/iamBelugaa/kvix/internal/engine"
+	"github.com/iamBelugaa/kvix/internal/index"
 	"github.com/iamBelugaa/kvix/internal/storage"
 	"github.com/iamBelugaa/kvix/pkg/errors"
 	"github.com/iamBelugaa/kvix/pkg/logger"
 	"github.com/iamBelugaa/kvix/pkg/options"
+	"github.com/iamBelugaa/kvix/pkg/raft"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 )
 
+// NoExpiration is returned by TTL for keys that have no expiration set.
+const NoExpiration = index.NoExpiration
+
+// Stats is a point-in-time summary of an instance's data and activity.
+type Stats = engine.Stats
+
+// SizeHistogram is the distribution of key or value sizes reported in Stats.
+type SizeHistogram = engine.SizeHistogram
+
+// SizeBucket is one bucket of a SizeHistogram.
+type SizeBucket = engine.SizeBucket
+
+// SegmentStats is the live and stale usage of one segment file.
+type SegmentStats = engine.SegmentStats
+
+// DiskUsage is the disk space taken by an instance.
+type DiskUsage = engine.DiskUsage
+
+// ArchivedSegment is a segment moved to object storage by WithArchive.
+type ArchivedSegment = engine.ArchivedSegment
+
+// Metadata is a content type and user tags stored alongside a value and
+// returned with its record.
+type Metadata = storage.Metadata
+
+// Record is a stored value with its header and metadata, as returned by Get
+// and passed to Snapshot.Scan.
+type Record = storage.Record
+
+// Version is one retained write of a key, as returned by History.
+type Version = engine.Version
+
+// Result holds the record or error for one key of an MGet call.
+type Result = engine.Result
+
+// ImportPolicy decides what Import does with keys that already exist.
+type ImportPolicy = engine.ImportPolicy
+
+const (
+	ImportOverwrite    = engine.ImportOverwrite
+	ImportSkipExisting = engine.ImportSkipExisting
+)
+
+// ImportResult counts the records written and skipped by Import.
+type ImportResult = engine.ImportResult
+
+// VerifyOptions controls whether Verify repairs what it finds.
+type VerifyOptions = engine.VerifyOptions
+
+// VerifyReport lists per-segment findings and index entries Verify could not
+// resolve.
+type VerifyReport = engine.VerifyReport
+
+// Snapshot is a consistent, read-only view of an instance at a point in time.
+type Snapshot = engine.Snapshot
+
+// Iterator walks the keys of a snapshot in order. See Instance.Iterator.
+type Iterator = engine.Iterator
+
+// Loader supplies a fresh value and TTL for keys refreshed ahead of expiry.
+type Loader = engine.Loader
+
+// Event is a change to a watched key.
+type Event = engine.Event
+
+// EventType says what happened to the key of an Event.
+type EventType = engine.EventType
+
+// Hooks are called as keys change and partitions are compacted.
+type Hooks = engine.Hooks
+
+// ChangeStream delivers the change feed from a starting sequence.
+type ChangeStream = engine.ChangeStream
+
+// ReplicaStatus describes a replica's link to its primary.
+type ReplicaStatus = engine.ReplicaStatus
+
+var (
+	// ErrChangeFeedDisabled is returned by Changes unless the instance was
+	// opened WithChangeFeed.
+	ErrChangeFeedDisabled = engine.ErrChangeFeedDisabled
+	// ErrChangesTruncated means the requested changes are past retention.
+	ErrChangesTruncated = engine.ErrChangesTruncated
+	// ErrReadOnlyReplica is returned by modifying calls on a replica.
+	ErrReadOnlyReplica = engine.ErrReadOnlyReplica
+	// ErrWriteThrottled is returned by writes over WithMaxWriteRate or
+	// WithMaxInflightWrites under options.BackpressureReject.
+	ErrWriteThrottled = engine.ErrWriteThrottled
+	// ErrCompactionPaused is returned by Compact while compaction is paused.
+	ErrCompactionPaused = engine.ErrCompactionPaused
+	// ErrNotLeader is returned by writes to a cluster member that is not the
+	// leader.
+	ErrNotLeader = raft.ErrNotLeader
+)
+
+const (
+	EventSet      = engine.EventSet
+	EventDelete   = engine.EventDelete
+	EventExpire   = engine.EventExpire
+	EventOverflow = engine.EventOverflow
+	EventEvict    = engine.EventEvict
+)
+
+// Instance is safe for concurrent use. Operations share mu for reading and
+// only Close takes it exclusively; the engine serializes appends internally,
+// so reads proceed while a write is in flight.
 type Instance struct {
 	mu      sync.RWMutex
 	engine  *engine.Engine
 	options *options.Options
 	log     *zap.SugaredLogger
-}
+	// level is nil when the instance logs through a logger it did not build.
+	level *zap.AtomicLevel
+	// logFile is set when the instance logs to a file of WithLogFile, which
+	// Close closes.
+	logFile *logger.File
+	// onClose is set by the Manager that opened the instance.
+	onClose func()
+	// ephemeralDir is the data directory of WithEphemeralDataDir, which
+	// Close removes.
+	ephemeralDir string
+	// node is set when the instance is a cluster member.
+	node *raft.Node
 
-func NewInstance(context context.Context, service string, opts ...options.OptionFunc) (*Instance, error) {
-	log := logger.New(service)
+	// settings are the options in effect, which Reconfigure changes under
+	// reloadMu; options keeps those the instance was opened with.
+	reloadMu         sync.Mutex
+	settings         options.Options
+	operationTimeout atomic.Int64
+	// interceptor chains the interceptors set WithInterceptors; nil when
+	// there are none.
+	interceptor options.Interceptor
+}
 
+func NewInstance(ctx context.Context, service string, opts ...options.OptionFunc) (*Instance, error) {
 	defaultOpts := options.DefaultOptions()
 	if len(opts) > 0 {
 		for _, opt := range opts {
@@ -31,23 +165,114 @@ func NewInstance(context context.Context, service string, opts ...options.Option
 		}
 	}
 
-	eng, err := engine.New(context, log, &defaultOpts)
+	ephemeralDir, err := useEphemeralDataDir(&defaultOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	instance, err := newInstance(ctx, service, defaultOpts)
+	if err != nil {
+		if ephemeralDir != "" {
+			os.RemoveAll(ephemeralDir)
+		}
+		return nil, err
+	}
+
+	instance.ephemeralDir = ephemeralDir
+	return instance, nil
+}
+
+// newInstance validates defaultOpts and opens an instance with its own
+// logger.
+func newInstance(ctx context.Context, service string, defaultOpts options.Options) (*Instance, error) {
+	if err := defaultOpts.Validate(); err != nil {
+		return nil, err
+	}
+
+	if defaultOpts.Logger != nil {
+		return openInstance(ctx, service, defaultOpts.Logger.With("service", service), &defaultOpts, engine.Shared{})
+	}
+
+	level := zap.NewAtomicLevelAt(defaultOpts.LogLevel)
+	if defaultOpts.LogFile == nil {
+		log := logger.NewAtomic(service, level, defaultOpts.LogSampling)
+		instance, err := openInstance(ctx, service, log, &defaultOpts, engine.Shared{})
+		if err != nil {
+			return nil, err
+		}
+
+		instance.level = &level
+		return instance, nil
+	}
+
+	logFile, err := logger.OpenFile(defaultOpts.LogFile.Path, logger.Rotation{
+		MaxSize:    defaultOpts.LogFile.MaxSize,
+		MaxAge:     defaultOpts.LogFile.MaxAge,
+		MaxBackups: defaultOpts.LogFile.MaxBackups,
+		Compress:   defaultOpts.LogFile.Compress,
+	})
 	if err != nil {
+		return nil, errors.NewStorageError(err, errors.ErrIOGeneral, "Failed to open log file").
+			WithPath(defaultOpts.LogFile.Path)
+	}
+
+	log := logger.NewFile(service, level, defaultOpts.LogSampling, logFile)
+	instance, err := openInstance(ctx, service, log, &defaultOpts, engine.Shared{})
+	if err != nil {
+		logFile.Close()
+		return nil, err
+	}
+
+	instance.level = &level
+	instance.logFile = logFile
+	return instance, nil
+}
+
+func openInstance(
+	ctx context.Context, service string, log *zap.SugaredLogger, opts *options.Options, shared engine.Shared,
+) (*Instance, error) {
+	// Released by Close, or below if the instance fails to open.
+	if opts.ErrorStackTraces {
+		errors.AcquireStackTraces()
+	}
+
+	eng, err := engine.New(ctx, log, opts, shared)
+	if err != nil {
+		releaseStackTraces(opts)
 		return nil, fmt.Errorf("failed to initialize kvix: %w", err)
 	}
 
 	log.Infow(
 		"Kvix database instance initialized successfully",
 		"service", service,
-		"dataDir", defaultOpts.DataDir,
-		"maxSegmentSize", defaultOpts.SegmentOptions.Size,
+		"dataDir", opts.DataDir,
+		"maxSegmentSize", opts.SegmentOptions.Size,
 	)
 
-	return &Instance{engine: eng, options: &defaultOpts, log: log}, nil
+	instance := &Instance{engine: eng, options: opts, log: log, settings: *opts}
+	instance.operationTimeout.Store(int64(opts.OperationTimeout))
+	instance.interceptor = chainInterceptors(opts.Interceptors)
+	if opts.Cluster != nil {
+		if err := instance.joinCluster(); err != nil {
+			eng.Close()
+			releaseStackTraces(opts)
+			return nil, fmt.Errorf("failed to join cluster: %w", err)
+		}
+	}
+
+	return instance, nil
+}
+
+// releaseStackTraces drops the hold on error stack traces an instance opened
+// with opts took.
+func releaseStackTraces(opts *options.Options) {
+	if opts.ErrorStackTraces {
+		errors.ReleaseStackTraces()
+	}
 }
 
-func (i *Instance) Set(context context.Context, key []byte, value []byte) error {
-	i.log.Infow("Set request received", "key", string(key))
+func (i *Instance) Set(ctx context.Context, key []byte, value []byte) error {
+	i.log.Debugw("Set request received", "key", string(key))
 
 	if err := isValidKey(key); err != nil {
 		return err
@@ -57,13 +282,60 @@ func (i *Instance) Set(context context.Context, key []byte, value []byte) error
 		return err
 	}
 
-	i.mu.Lock()
-	defer i.mu.Unlock()
-	return i.engine.Set(context, key, value)
+	ctx, cancel := i.withDeadline(ctx)
+	defer cancel()
+
+	return boundedErr(i, ctx, "Set", key, func(ctx context.Context) error {
+		if i.node != nil {
+			_, err := i.propose(ctx, commandSet, key, value, 0)
+			return err
+		}
+
+		i.mu.RLock()
+		defer i.mu.RUnlock()
+		return i.engine.Set(ctx, key, value)
+	})
+}
+
+// SetReader stores the size bytes read from r as the value of key. The value
+// is streamed into its segment and checksummed on the way rather than copied
+// into memory first, which makes it the way to store values of tens or
+// hundreds of megabytes. Writes to keys of the same partition wait until r
+// has been read, and the operation timeout covers the whole transfer.
+// Streamed values are stored uncompressed. The value is still read into
+// memory when it has to be whole: for encryption, deduplication, the
+// secondary index, hooks, watchers, the change feed and clustered instances.
+func (i *Instance) SetReader(ctx context.Context, key []byte, r io.Reader, size int64) error {
+	i.log.Debugw("SetReader request received", "key", string(key), "size", size)
+
+	if err := isValidKey(key); err != nil {
+		return err
+	}
+
+	if err := isValidValueSize(size); err != nil {
+		return err
+	}
+
+	if i.node != nil {
+		value := make([]byte, size)
+		if _, err := io.ReadFull(r, value); err != nil {
+			return errors.NewValidationError(err, errors.ErrSystemInvalidInput, "Failed to read value to store")
+		}
+		return i.Set(ctx, key, value)
+	}
+
+	ctx, cancel := i.withDeadline(ctx)
+	defer cancel()
+
+	return boundedErr(i, ctx, "SetReader", key, func(ctx context.Context) error {
+		i.mu.RLock()
+		defer i.mu.RUnlock()
+		return i.engine.SetReader(ctx, key, r, size, 0)
+	})
 }
 
-func (i *Instance) SetX(context context.Context, key []byte, value []byte, ttl time.Duration) error {
-	i.log.Infow("SetX request received", "key", string(key))
+func (i *Instance) SetX(ctx context.Context, key []byte, value []byte, ttl time.Duration) error {
+	i.log.Debugw("SetX request received", "key", string(key))
 
 	if err := isValidKey(key); err != nil {
 		return err
@@ -73,53 +345,854 @@ func (i *Instance) SetX(context context.Context, key []byte, value []byte, ttl t
 		return err
 	}
 
-	if ttl <= 0 {
-		return errors.NewValidationError(
-			nil, errors.ErrValidationInvalidData, fmt.Sprintf("ttl must be positive, got %v", ttl),
-		)
+	if err := isValidTTL(ttl); err != nil {
+		return err
 	}
 
-	i.mu.Lock()
-	defer i.mu.Unlock()
+	ctx, cancel := i.withDeadline(ctx)
+	defer cancel()
 
-	_, err := i.engine.SetX(context, key, value, ttl)
-	return err
+	return boundedErr(i, ctx, "SetX", key, func(ctx context.Context) error {
+		if i.node != nil {
+			_, err := i.propose(ctx, commandSet, key, value, time.Now().Add(ttl).UnixNano())
+			return err
+		}
+
+		i.mu.RLock()
+		defer i.mu.RUnlock()
+
+		_, err := i.engine.SetX(ctx, key, value, ttl)
+		return err
+	})
 }
 
-func (i *Instance) Get(context context.Context, key []byte) (*storage.Record, error) {
-	i.log.Infow("Get request received", "key", string(key))
+// SetEXAt stores key with an absolute expiry, for deadlines such as token or
+// lease expiry that would otherwise drift when converted to a TTL.
+func (i *Instance) SetEXAt(ctx context.Context, key []byte, value []byte, expireAt time.Time) error {
+	i.log.Debugw("SetEXAt request received", "key", string(key))
+
+	if err := isValidKey(key); err != nil {
+		return err
+	}
+
+	if err := isValidValue(value); err != nil {
+		return err
+	}
+
+	if err := isValidExpireAt(expireAt); err != nil {
+		return err
+	}
+
+	ctx, cancel := i.withDeadline(ctx)
+	defer cancel()
+
+	return boundedErr(i, ctx, "SetEXAt", key, func(ctx context.Context) error {
+		if i.node != nil {
+			_, err := i.propose(ctx, commandSet, key, value, expireAt.UnixNano())
+			return err
+		}
+
+		i.mu.RLock()
+		defer i.mu.RUnlock()
+
+		_, err := i.engine.SetXAt(ctx, key, value, expireAt)
+		return err
+	})
+}
+
+// SetWithMetadata stores value together with metadata, such as its content
+// type, which Get returns in the record's Metadata. A zero ttl stores the key
+// without expiration.
+func (i *Instance) SetWithMetadata(
+	ctx context.Context, key []byte, value []byte, metadata Metadata, ttl time.Duration,
+) error {
+	i.log.Debugw("SetWithMetadata request received", "key", string(key))
+
+	if err := isValidKey(key); err != nil {
+		return err
+	}
+
+	if err := isValidValue(value); err != nil {
+		return err
+	}
+
+	if err := isValidMetadata(&metadata, value); err != nil {
+		return err
+	}
+
+	var expiresAt time.Time
+	if ttl != 0 {
+		if err := isValidTTL(ttl); err != nil {
+			return err
+		}
+		expiresAt = time.Now().Add(ttl)
+	}
+
+	ctx, cancel := i.withDeadline(ctx)
+	defer cancel()
+
+	return boundedErr(i, ctx, "SetWithMetadata", key, func(ctx context.Context) error {
+		if i.node != nil {
+			var expiry int64
+			if !expiresAt.IsZero() {
+				expiry = expiresAt.UnixNano()
+			}
+
+			framed := append(storage.AppendMetadata(nil, &metadata), value...)
+			_, err := i.propose(ctx, commandSetMetadata, key, framed, expiry)
+			return err
+		}
+
+		i.mu.RLock()
+		defer i.mu.RUnlock()
+
+		_, err := i.engine.SetWithMetadata(ctx, key, value, &metadata, expiresAt)
+		return err
+	})
+}
+
+// WithVerifyLevel returns a context under which reads check records at level
+// instead of the instance's WithReadVerification setting.
+func WithVerifyLevel(ctx context.Context, level options.VerifyLevel) context.Context {
+	return storage.WithVerifyLevel(ctx, level)
+}
+
+func (i *Instance) Get(ctx context.Context, key []byte) (*storage.Record, error) {
+	i.log.Debugw("Get request received", "key", string(key))
 
 	if err := isValidKey(key); err != nil {
 		return nil, err
 	}
 
-	i.mu.RLock()
-	defer i.mu.RUnlock()
-	return i.engine.Get(context, key)
+	ctx, cancel := i.withDeadline(ctx)
+	defer cancel()
+
+	return bounded(i, ctx, "Get", key, func(ctx context.Context) (*storage.Record, error) {
+		i.mu.RLock()
+		defer i.mu.RUnlock()
+		return i.engine.Get(ctx, key)
+	})
+}
+
+// GetValue returns the value of key alone, without the header and metadata
+// Get reads along with it.
+func (i *Instance) GetValue(ctx context.Context, key []byte) ([]byte, error) {
+	return i.AppendValue(ctx, nil, key)
+}
+
+// AppendValue appends the value of key to dst and returns the extended
+// slice. Reusing dst across calls saves growing a new slice for every value
+// read. dst is returned as it was when the call fails, including when it
+// times out while the read carries on.
+func (i *Instance) AppendValue(ctx context.Context, dst, key []byte) ([]byte, error) {
+	i.log.Debugw("GetValue request received", "key", string(key))
+
+	if err := isValidKey(key); err != nil {
+		return dst, err
+	}
+
+	ctx, cancel := i.withDeadline(ctx)
+	defer cancel()
+
+	// Read into a slice of its own: an op abandoned on timeout must not
+	// write to dst once the caller has it back.
+	value, err := bounded(i, ctx, "GetValue", key, func(ctx context.Context) ([]byte, error) {
+		i.mu.RLock()
+		defer i.mu.RUnlock()
+		return i.engine.GetValue(ctx, nil, key)
+	})
+	if err != nil {
+		return dst, err
+	}
+	return append(dst, value...), nil
+}
+
+// GetReader streams the value of key from disk rather than reading it into
+// memory, for values too large to buffer. The checksum is verified as the
+// value is read, and a mismatch is returned by the Read reaching its end, so
+// only a value read through to io.EOF is known to be intact. Encrypted
+// values are still read whole. The reader holds its segment file open and
+// must be closed, before the instance is.
+func (i *Instance) GetReader(ctx context.Context, key []byte) (io.ReadCloser, error) {
+	i.log.Debugw("GetReader request received", "key", string(key))
+
+	if err := isValidKey(key); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := i.withDeadline(ctx)
+	defer cancel()
+
+	// A reader opened after the caller gave up would never be closed by it.
+	return boundedRelease(i, ctx, "GetReader", key, func(ctx context.Context) (io.ReadCloser, error) {
+		i.mu.RLock()
+		defer i.mu.RUnlock()
+		return i.engine.GetReader(ctx, key)
+	}, func(reader io.ReadCloser) { reader.Close() })
+}
+
+// GetVersion returns the nth most recent version of key retained by
+// WithVersionHistory, where 0 is the latest. Versions of deleted and expired
+// keys stay readable.
+func (i *Instance) GetVersion(ctx context.Context, key []byte, n int) (*storage.Record, error) {
+	i.log.Debugw("GetVersion request received", "key", string(key), "version", n)
+
+	if err := isValidKey(key); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := i.withDeadline(ctx)
+	defer cancel()
+
+	return bounded(i, ctx, "GetVersion", key, func(ctx context.Context) (*storage.Record, error) {
+		i.mu.RLock()
+		defer i.mu.RUnlock()
+		return i.engine.GetVersion(ctx, key, n)
+	})
 }
 
-func (i *Instance) Exists(context context.Context, key []byte) (bool, error) {
-	i.log.Infow("Exists request received", "key", string(key))
+// History returns every retained version of key, newest first.
+func (i *Instance) History(ctx context.Context, key []byte) ([]Version, error) {
+	i.log.Debugw("History request received", "key", string(key))
+
+	if err := isValidKey(key); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := i.withDeadline(ctx)
+	defer cancel()
+
+	return bounded(i, ctx, "History", key, func(ctx context.Context) ([]Version, error) {
+		i.mu.RLock()
+		defer i.mu.RUnlock()
+		return i.engine.History(ctx, key)
+	})
+}
+
+// GetAsOf returns the value key held at t, resolved from the versions kept by
+// WithVersionHistory.
+func (i *Instance) GetAsOf(ctx context.Context, key []byte, t time.Time) (*storage.Record, error) {
+	i.log.Debugw("GetAsOf request received", "key", string(key), "asOf", t)
+
+	if err := isValidKey(key); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := i.withDeadline(ctx)
+	defer cancel()
+
+	return bounded(i, ctx, "GetAsOf", key, func(ctx context.Context) (*storage.Record, error) {
+		i.mu.RLock()
+		defer i.mu.RUnlock()
+		return i.engine.GetAsOf(ctx, key, t)
+	})
+}
+
+// Query returns the keys whose JSON value holds value at path, one of the
+// paths registered WithSecondaryIndex, in key order.
+func (i *Instance) Query(ctx context.Context, path, value string) ([][]byte, error) {
+	i.log.Debugw("Query request received", "path", path, "value", value)
+
+	ctx, cancel := i.withDeadline(ctx)
+	defer cancel()
+
+	return bounded(i, ctx, "Query", nil, func(ctx context.Context) ([][]byte, error) {
+		i.mu.RLock()
+		defer i.mu.RUnlock()
+		return i.engine.Query(ctx, path, value)
+	})
+}
+
+// FindByTag returns the keys whose metadata carries a tag named tag, in key
+// order. It needs WithTagIndex.
+func (i *Instance) FindByTag(ctx context.Context, tag string) ([][]byte, error) {
+	i.log.Debugw("FindByTag request received", "tag", tag)
+
+	ctx, cancel := i.withDeadline(ctx)
+	defer cancel()
+
+	return bounded(i, ctx, "FindByTag", nil, func(ctx context.Context) ([][]byte, error) {
+		i.mu.RLock()
+		defer i.mu.RUnlock()
+		return i.engine.FindByTag(ctx, tag)
+	})
+}
+
+// KeyRange returns up to limit live keys from start up to but excluding end,
+// in key order. An empty end leaves the range open, and a limit of zero or
+// less returns every key in range. Opened WithIndexLayout(IndexOrdered) it
+// only walks the keys it returns.
+func (i *Instance) KeyRange(ctx context.Context, start, end []byte, limit int) ([][]byte, error) {
+	i.log.Debugw("KeyRange request received", "start", string(start), "end", string(end), "limit", limit)
+
+	ctx, cancel := i.withDeadline(ctx)
+	defer cancel()
+
+	return bounded(i, ctx, "KeyRange", nil, func(ctx context.Context) ([][]byte, error) {
+		i.mu.RLock()
+		defer i.mu.RUnlock()
+		return i.engine.KeyRange(ctx, start, end, limit)
+	})
+}
+
+// KeyRangeReverse is KeyRange in descending key order.
+func (i *Instance) KeyRangeReverse(ctx context.Context, start, end []byte, limit int) ([][]byte, error) {
+	i.log.Debugw("KeyRangeReverse request received", "start", string(start), "end", string(end), "limit", limit)
+
+	ctx, cancel := i.withDeadline(ctx)
+	defer cancel()
+
+	return bounded(i, ctx, "KeyRangeReverse", nil, func(ctx context.Context) ([][]byte, error) {
+		i.mu.RLock()
+		defer i.mu.RUnlock()
+		return i.engine.KeyRangeReverse(ctx, start, end, limit)
+	})
+}
+
+// KeysWithPrefix returns up to limit live keys starting with prefix, in key
+// order. A limit of zero or less returns all of them.
+func (i *Instance) KeysWithPrefix(ctx context.Context, prefix []byte, limit int) ([][]byte, error) {
+	i.log.Debugw("KeysWithPrefix request received", "prefix", string(prefix), "limit", limit)
+
+	ctx, cancel := i.withDeadline(ctx)
+	defer cancel()
+
+	return bounded(i, ctx, "KeysWithPrefix", nil, func(ctx context.Context) ([][]byte, error) {
+		i.mu.RLock()
+		defer i.mu.RUnlock()
+		return i.engine.KeysWithPrefix(ctx, prefix, limit)
+	})
+}
+
+// FirstKey returns the smallest live key, reporting false when there are no
+// keys.
+func (i *Instance) FirstKey(ctx context.Context) ([]byte, bool, error) {
+	i.log.Debugw("FirstKey request received")
+	return i.edgeKey(ctx, "FirstKey", i.engine.FirstKey)
+}
+
+// LastKey returns the largest live key, reporting false when there are no
+// keys.
+func (i *Instance) LastKey(ctx context.Context) ([]byte, bool, error) {
+	i.log.Debugw("LastKey request received")
+	return i.edgeKey(ctx, "LastKey", i.engine.LastKey)
+}
+
+// edgeKey runs FirstKey or LastKey, given as lookup, as the operation name.
+func (i *Instance) edgeKey(
+	ctx context.Context, name string, lookup func(ctx context.Context) ([]byte, bool, error),
+) ([]byte, bool, error) {
+	ctx, cancel := i.withDeadline(ctx)
+	defer cancel()
+
+	type edgeResult struct {
+		key   []byte
+		found bool
+	}
+
+	result, err := bounded(i, ctx, name, nil, func(ctx context.Context) (edgeResult, error) {
+		i.mu.RLock()
+		defer i.mu.RUnlock()
+
+		key, found, err := lookup(ctx)
+		return edgeResult{key: key, found: found}, err
+	})
+	return result.key, result.found, err
+}
+
+func (i *Instance) MGet(ctx context.Context, keys [][]byte) ([]Result, error) {
+	i.log.Debugw("MGet request received", "keys", len(keys))
+
+	results := make([]Result, len(keys))
+	valid := make([][]byte, 0, len(keys))
+	positions := make([]int, 0, len(keys))
+
+	for idx, key := range keys {
+		if err := isValidKey(key); err != nil {
+			results[idx] = Result{Key: key, Err: err}
+			continue
+		}
+
+		valid = append(valid, key)
+		positions = append(positions, idx)
+	}
+
+	ctx, cancel := i.withDeadline(ctx)
+	defer cancel()
+
+	fetched, err := bounded(i, ctx, "MGet", nil, func(ctx context.Context) ([]Result, error) {
+		i.mu.RLock()
+		defer i.mu.RUnlock()
+		return i.engine.MGet(ctx, valid)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for idx, result := range fetched {
+		results[positions[idx]] = result
+	}
+
+	return results, nil
+}
+
+func (i *Instance) GetStale(ctx context.Context, key []byte) (*storage.Record, bool, error) {
+	i.log.Debugw("GetStale request received", "key", string(key))
+
+	if err := isValidKey(key); err != nil {
+		return nil, false, err
+	}
+
+	ctx, cancel := i.withDeadline(ctx)
+	defer cancel()
+
+	type staleResult struct {
+		record *storage.Record
+		stale  bool
+	}
+
+	result, err := bounded(i, ctx, "GetStale", key, func(ctx context.Context) (staleResult, error) {
+		i.mu.RLock()
+		defer i.mu.RUnlock()
+
+		record, stale, err := i.engine.GetStale(ctx, key)
+		return staleResult{record: record, stale: stale}, err
+	})
+	return result.record, result.stale, err
+}
+
+func (i *Instance) Exists(ctx context.Context, key []byte) (bool, error) {
+	i.log.Debugw("Exists request received", "key", string(key))
 
 	if err := isValidKey(key); err != nil {
 		return false, err
 	}
 
-	i.mu.RLock()
-	defer i.mu.RUnlock()
-	return i.engine.Exists(context, key)
+	ctx, cancel := i.withDeadline(ctx)
+	defer cancel()
+
+	return bounded(i, ctx, "Exists", key, func(ctx context.Context) (bool, error) {
+		i.mu.RLock()
+		defer i.mu.RUnlock()
+		return i.engine.Exists(ctx, key)
+	})
 }
 
-func (i *Instance) Delete(context context.Context, key []byte) (bool, error) {
-	i.log.Infow("Delete request received", "key", string(key))
+func (i *Instance) Delete(ctx context.Context, key []byte) (bool, error) {
+	i.log.Debugw("Delete request received", "key", string(key))
 
 	if err := isValidKey(key); err != nil {
 		return false, err
 	}
 
-	i.mu.Lock()
-	defer i.mu.Unlock()
-	return i.engine.Delete(context, key)
+	ctx, cancel := i.withDeadline(ctx)
+	defer cancel()
+
+	return bounded(i, ctx, "Delete", key, func(ctx context.Context) (bool, error) {
+		if i.node != nil {
+			return i.proposeBool(ctx, commandDelete, key, 0)
+		}
+
+		i.mu.RLock()
+		defer i.mu.RUnlock()
+		return i.engine.Delete(ctx, key)
+	})
+}
+
+func (i *Instance) TTL(ctx context.Context, key []byte) (time.Duration, error) {
+	i.log.Debugw("TTL request received", "key", string(key))
+
+	if err := isValidKey(key); err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := i.withDeadline(ctx)
+	defer cancel()
+
+	return bounded(i, ctx, "TTL", key, func(ctx context.Context) (time.Duration, error) {
+		i.mu.RLock()
+		defer i.mu.RUnlock()
+		return i.engine.TTL(ctx, key)
+	})
+}
+
+func (i *Instance) Expire(ctx context.Context, key []byte, ttl time.Duration) (bool, error) {
+	i.log.Debugw("Expire request received", "key", string(key))
+
+	if err := isValidKey(key); err != nil {
+		return false, err
+	}
+
+	if err := isValidTTL(ttl); err != nil {
+		return false, err
+	}
+
+	ctx, cancel := i.withDeadline(ctx)
+	defer cancel()
+
+	return bounded(i, ctx, "Expire", key, func(ctx context.Context) (bool, error) {
+		if i.node != nil {
+			return i.proposeBool(ctx, commandExpire, key, time.Now().Add(ttl).UnixNano())
+		}
+
+		i.mu.RLock()
+		defer i.mu.RUnlock()
+		return i.engine.Expire(ctx, key, ttl)
+	})
+}
+
+func (i *Instance) Touch(ctx context.Context, key []byte, ttl time.Duration) (bool, error) {
+	i.log.Debugw("Touch request received", "key", string(key))
+
+	if err := isValidKey(key); err != nil {
+		return false, err
+	}
+
+	if err := isValidTTL(ttl); err != nil {
+		return false, err
+	}
+
+	ctx, cancel := i.withDeadline(ctx)
+	defer cancel()
+
+	return bounded(i, ctx, "Touch", key, func(ctx context.Context) (bool, error) {
+		if i.node != nil {
+			return i.proposeBool(ctx, commandExpire, key, time.Now().Add(ttl).UnixNano())
+		}
+
+		i.mu.RLock()
+		defer i.mu.RUnlock()
+		return i.engine.Touch(ctx, key, ttl)
+	})
+}
+
+func (i *Instance) Persist(ctx context.Context, key []byte) (bool, error) {
+	i.log.Debugw("Persist request received", "key", string(key))
+
+	if err := isValidKey(key); err != nil {
+		return false, err
+	}
+
+	ctx, cancel := i.withDeadline(ctx)
+	defer cancel()
+
+	return bounded(i, ctx, "Persist", key, func(ctx context.Context) (bool, error) {
+		if i.node != nil {
+			return i.proposeBool(ctx, commandPersist, key, 0)
+		}
+
+		i.mu.RLock()
+		defer i.mu.RUnlock()
+		return i.engine.Persist(ctx, key)
+	})
+}
+
+// RegisterLoader registers loader for keys starting with prefix. The longest
+// matching prefix wins; a nil loader removes the registration.
+func (i *Instance) RegisterLoader(prefix string, loader Loader) {
+	i.engine.RegisterLoader(prefix, loader)
+}
+
+// Snapshot freezes the current keyspace. The snapshot stays readable while
+// writes continue and must be released when no longer needed.
+func (i *Instance) Snapshot(ctx context.Context) (*Snapshot, error) {
+	i.log.Debugw("Snapshot request received")
+
+	ctx, cancel := i.withDeadline(ctx)
+	defer cancel()
+
+	return boundedRelease(i, ctx, "Snapshot", nil, func(ctx context.Context) (*Snapshot, error) {
+		i.mu.RLock()
+		defer i.mu.RUnlock()
+		return i.engine.Snapshot(ctx)
+	}, (*Snapshot).Release)
+}
+
+// Iterator returns an iterator over the live keys starting with prefix, in
+// lexicographic order, as of the moment it is created. Writes made while it
+// is open are not seen, and compaction leaves the segments it reads alone
+// until it is closed, so it must be closed when no longer needed.
+func (i *Instance) Iterator(ctx context.Context, prefix []byte) (*Iterator, error) {
+	i.log.Debugw("Iterator request received", "prefix", string(prefix))
+
+	ctx, cancel := i.withDeadline(ctx)
+	defer cancel()
+
+	return boundedRelease(i, ctx, "Iterator", nil, func(ctx context.Context) (*Iterator, error) {
+		i.mu.RLock()
+		defer i.mu.RUnlock()
+		return i.engine.Iterator(ctx, prefix)
+	}, (*Iterator).Close)
+}
+
+// Watch returns a channel of set, delete and expire events for keys starting
+// with prefix, until ctx is done or the instance closes. A receiver that falls
+// engine.WatchBuffer events behind gets an EventOverflow and the channel is
+// closed; events are never allowed to slow down writers.
+func (i *Instance) Watch(ctx context.Context, prefix []byte) (<-chan Event, error) {
+	i.log.Debugw("Watch request received", "prefix", string(prefix))
+
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return i.engine.Watch(ctx, prefix)
+}
+
+// AddHooks registers hooks called as keys change and partitions are
+// compacted, and returns a function that unregisters them. Unlike Watch,
+// hooks run synchronously with each change; see Hooks.
+func (i *Instance) AddHooks(hooks Hooks) func() {
+	return i.engine.AddHooks(hooks)
+}
+
+// Changes replays the change feed from sequence from (zero for the oldest
+// retained change) and then follows new changes. The instance must be opened
+// WithChangeFeed. Consumers record the Sequence of the last event they
+// processed and resume from the one after it.
+func (i *Instance) Changes(ctx context.Context, from uint64) (*ChangeStream, error) {
+	i.log.Debugw("Changes request received", "from", from)
+
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return i.engine.Changes(ctx, from)
+}
+
+// ChangeRange returns the oldest retained sequence of the change feed and the
+// sequence the next change will get.
+func (i *Instance) ChangeRange() (uint64, uint64, error) {
+	return i.engine.ChangeRange()
+}
+
+// ServeReplication makes the instance a primary: it accepts replicas opened
+// WithReplicaOf on listener and ships them its segments, sealed ones and the
+// bytes appended to active ones, along with every index change. It returns
+// once ctx is done or the instance closes. Replicas that reconnect only
+// receive the segment bytes they lack.
+func (i *Instance) ServeReplication(ctx context.Context, listener net.Listener) error {
+	i.log.Infow("Replication requested", "addr", listener.Addr().String())
+	return i.engine.ServeReplication(ctx, listener)
+}
+
+// ReplicaStatus reports the state of a replica's link to its primary, and
+// false when the instance is not a replica.
+func (i *Instance) ReplicaStatus() (ReplicaStatus, bool) {
+	return i.engine.ReplicaStatus()
+}
+
+// Backup streams a consistent snapshot of the instance to w as a tar archive
+// without blocking writes.
+func (i *Instance) Backup(ctx context.Context, w io.Writer) error {
+	i.log.Infow("Backup request received")
+
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return i.engine.Backup(ctx, w)
+}
+
+// Export streams every live record to w as newline-delimited JSON with the
+// key, base64 value, remaining TTL in milliseconds and write timestamp. It
+// works from a snapshot, so writes continue while it runs.
+func (i *Instance) Export(ctx context.Context, w io.Writer) (int, error) {
+	i.log.Infow("Export request received")
+
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return i.engine.Export(ctx, w)
+}
+
+// Import bulk-loads NDJSON in the format produced by Export. Every record is
+// validated like a regular Set; the first invalid line aborts the import,
+// leaving the records before it written. WithOperationTimeout bounds the
+// whole import, so callers loading large files should pass a context with a
+// deadline of its own.
+func (i *Instance) Import(ctx context.Context, r io.Reader, policy ImportPolicy) (ImportResult, error) {
+	i.log.Infow("Import request received", "policy", policy)
+
+	if i.node != nil {
+		return ImportResult{}, errClusterImport()
+	}
+
+	ctx, cancel := i.withDeadline(ctx)
+	defer cancel()
+
+	return bounded(i, ctx, "Import", nil, func(ctx context.Context) (ImportResult, error) {
+		i.mu.RLock()
+		defer i.mu.RUnlock()
+		return i.engine.Import(ctx, r, policy, validateRecord)
+	})
+}
+
+// ImportRDB loads the string keys and TTLs of a Redis RDB dump. Other Redis
+// types are skipped and counted in the result; streams and module data are
+// rejected. Keys are validated like a regular Set.
+func (i *Instance) ImportRDB(ctx context.Context, r io.Reader, policy ImportPolicy) (ImportResult, error) {
+	i.log.Infow("RDB import request received", "policy", policy)
+
+	if i.node != nil {
+		return ImportResult{}, errClusterImport()
+	}
+
+	ctx, cancel := i.withDeadline(ctx)
+	defer cancel()
+
+	return bounded(i, ctx, "ImportRDB", nil, func(ctx context.Context) (ImportResult, error) {
+		i.mu.RLock()
+		defer i.mu.RUnlock()
+		return i.engine.ImportRDB(ctx, r, policy, validateRecord)
+	})
+}
+
+// Verify checks every segment record by record and cross-checks the index
+// against the result. With opts.Repair it also truncates unreadable segment
+// tails, drops index entries that point at damaged data and rewrites the index
+// hint. Writes are blocked while it runs.
+func (i *Instance) Verify(ctx context.Context, opts VerifyOptions) (*VerifyReport, error) {
+	i.log.Infow("Verify request received", "repair", opts.Repair)
+
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return i.engine.Verify(ctx, opts)
+}
+
+// Sync writes out any buffered writes and fsyncs the active segments and the
+// change feed, so that everything written before it survives a crash. It
+// lets applications that do not sync every write force durability at points
+// of their choosing, such as the end of a transaction.
+func (i *Instance) Sync(ctx context.Context) error {
+	i.log.Debugw("Sync request received")
+
+	ctx, cancel := i.withDeadline(ctx)
+	defer cancel()
+
+	return boundedErr(i, ctx, "Sync", nil, func(ctx context.Context) error {
+		i.mu.RLock()
+		defer i.mu.RUnlock()
+		return i.engine.Sync(ctx)
+	})
+}
+
+// RotateKey starts a new segment in every partition so that new records are
+// encrypted with the key provider's current key version. Older segments stay
+// readable with the versions they were written with.
+func (i *Instance) RotateKey(ctx context.Context) error {
+	i.log.Infow("Key rotation request received")
+
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return i.engine.RotateKey(ctx)
+}
+
+// Reencrypt rewrites every live record that is not encrypted with the
+// current key version, so keys of older versions can be retired once their
+// segments are reclaimed. It returns the number of records rewritten.
+func (i *Instance) Reencrypt(ctx context.Context) (int, error) {
+	i.log.Infow("Re-encryption request received")
+
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return i.engine.Reencrypt(ctx)
+}
+
+// Compact rewrites the live records of the sealed segments whose garbage
+// reached WithCompactionThreshold, as the background pass does every
+// WithCompactInterval, and returns the number of records moved. Segment
+// garbage collection deletes the segments it empties.
+func (i *Instance) Compact(ctx context.Context) (int, error) {
+	i.log.Infow("Compaction request received")
+
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return i.engine.Compact(ctx)
+}
+
+// PauseCompaction stops a compaction pass in progress after the record it is
+// moving and holds off further passes, scheduled or called, until
+// ResumeCompaction, for example during peak traffic.
+func (i *Instance) PauseCompaction() {
+	i.log.Infow("Compaction paused")
+	i.engine.PauseCompaction()
+}
+
+// ResumeCompaction lets compaction run again; the next pass picks up the
+// segments a paused one did not finish.
+func (i *Instance) ResumeCompaction() {
+	i.log.Infow("Compaction resumed")
+	i.engine.ResumeCompaction()
+}
+
+// Restore unpacks a backup produced by Backup into dataDir, which must be
+// empty or not exist. Every file is checked against the manifest checksums
+// before the directory is put in place. Open the restored data with
+// WithDataDir(dataDir) and WithSegmentDir(dataDir + "/segments") and the same
+// partition count as the backed up instance.
+func Restore(ctx context.Context, r io.Reader, dataDir string) error {
+	if _, err := backup.Restore(ctx, r, dataDir); err != nil {
+		return errors.NewStorageError(err, errors.ErrIOGeneral, fmt.Sprintf("Failed to restore backup: %v", err)).
+			WithPath(dataDir)
+	}
+	return nil
+}
+
+func (i *Instance) Stats(ctx context.Context) (*Stats, error) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return i.engine.Stats(ctx)
+}
+
+// SegmentStats reports, for every segment file, how many of its bytes belong
+// to live keys and how many to overwritten, deleted or expired records.
+func (i *Instance) SegmentStats(ctx context.Context) ([]SegmentStats, error) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return i.engine.SegmentStats(ctx)
+}
+
+// DiskUsage reports the bytes the instance holds on disk, how many are live
+// or reclaimable, the free space left and the per-segment breakdown.
+func (i *Instance) DiskUsage(ctx context.Context) (*DiskUsage, error) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return i.engine.DiskUsage(ctx)
+}
+
+// ArchivedSegments lists the segments WithArchive moved to object storage.
+func (i *Instance) ArchivedSegments() []ArchivedSegment {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return i.engine.ArchivedSegments()
+}
+
+// LogLevel returns the level below which the instance discards log entries.
+func (i *Instance) LogLevel() zapcore.Level {
+	return i.log.Level()
+}
+
+// SetLogLevel changes the log level while the instance runs, for example to
+// turn on per-operation Debug logs while investigating a problem. Instances
+// logging through WithLogger or a Manager do not own their level; change it
+// on that logger or with Manager.SetLogLevel instead.
+func (i *Instance) SetLogLevel(level zapcore.Level) error {
+	if err := validateLogLevel(level); err != nil {
+		return err
+	}
+
+	if i.level == nil {
+		return errors.NewValidationError(
+			nil, errors.ErrSystemInvalidInput, "Log level belongs to the logger the instance was given",
+		)
+	}
+
+	i.level.SetLevel(level)
+	i.log.Infow("Log level changed", "level", level)
+	return nil
+}
+
+func validateLogLevel(level zapcore.Level) error {
+	if level < zapcore.DebugLevel || level > zapcore.FatalLevel {
+		return errors.NewValidationError(nil, errors.ErrValidationInvalidData, "Unknown log level").
+			WithProvided(int8(level)).
+			WithExpected("debug to fatal")
+	}
+	return nil
 }
 
 func (i *Instance) Close() error {
@@ -127,5 +1200,34 @@ func (i *Instance) Close() error {
 
 	i.mu.Lock()
 	defer i.mu.Unlock()
-	return i.engine.Close()
+
+	var err error
+	if i.node != nil {
+		err = i.leaveCluster(i.engine.Close)
+	} else {
+		err = i.engine.Close()
+	}
+
+	if i.onClose != nil && !stdErrors.Is(err, engine.ErrEngineClosed) {
+		i.onClose()
+	}
+
+	if !stdErrors.Is(err, engine.ErrEngineClosed) {
+		releaseStackTraces(i.options)
+	}
+
+	if i.logFile != nil && !stdErrors.Is(err, engine.ErrEngineClosed) {
+		i.log.Sync()
+		if closeErr := i.logFile.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+
+	if i.ephemeralDir != "" && !stdErrors.Is(err, engine.ErrEngineClosed) {
+		if removeErr := os.RemoveAll(i.ephemeralDir); removeErr != nil && err == nil {
+			err = errors.NewStorageError(removeErr, errors.ErrIOGeneral, "Failed to remove ephemeral data directory").
+				WithPath(i.ephemeralDir)
+		}
+	}
+	return err
 }
@@ -0,0 +1,212 @@
+package kvix
+
+import (
+	"context"
+	stdErrors "errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/iamBelugaa/kvix/internal/engine"
+	"github.com/iamBelugaa/kvix/internal/scheduler"
+	"github.com/iamBelugaa/kvix/internal/storage/segmentpool"
+	"github.com/iamBelugaa/kvix/pkg/errors"
+	"github.com/iamBelugaa/kvix/pkg/logger"
+	"github.com/iamBelugaa/kvix/pkg/options"
+)
+
+var ErrManagerClosed = stdErrors.New("operation failed: manager has been closed")
+
+// Manager opens and supervises several instances, each with its own data
+// directory, in one process. Its instances share one logger, one goroutine
+// for background passes such as expiration sweeps and stats flushes, and one
+// budget of open segment handles.
+type Manager struct {
+	mu        sync.Mutex
+	closed    bool
+	log       *zap.SugaredLogger
+	level     zap.AtomicLevel
+	scheduler *scheduler.Scheduler
+	budget    *segmentpool.Budget
+	instances map[string]*Instance
+}
+
+// NewManager returns an empty manager. maxOpenSegments caps the sealed
+// segment handles kept open across all of its instances; zero or less leaves
+// them uncapped.
+func NewManager(service string, maxOpenSegments int) *Manager {
+	level := zap.NewAtomicLevelAt(zapcore.InfoLevel)
+	log := logger.NewAtomic(service, level, 0)
+	return &Manager{
+		log:       log,
+		level:     level,
+		scheduler: scheduler.New(log),
+		budget:    segmentpool.NewBudget(maxOpenSegments),
+		instances: make(map[string]*Instance),
+	}
+}
+
+// Open creates an instance registered under name. Names and data
+// directories must be unique among the manager's open instances.
+// Instances log through the manager's logger, or the one given with
+// WithLogger, tagged with their name; WithLogSampling and WithLogLevel have no
+// effect, and levels are changed with Manager.SetLogLevel.
+func (m *Manager) Open(context context.Context, name string, opts ...options.OptionFunc) (*Instance, error) {
+	if name == "" {
+		return nil, errors.NewValidationError(nil, errors.ErrSystemInvalidInput, "Instance name is required")
+	}
+
+	defaultOpts := options.DefaultOptions()
+	for _, opt := range opts {
+		opt(&defaultOpts)
+	}
+
+	ephemeralDir, err := useEphemeralDataDir(&defaultOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	instance, err := m.open(context, name, &defaultOpts)
+	if err != nil {
+		if ephemeralDir != "" {
+			os.RemoveAll(ephemeralDir)
+		}
+		return nil, err
+	}
+
+	instance.ephemeralDir = ephemeralDir
+	return instance, nil
+}
+
+func (m *Manager) open(context context.Context, name string, defaultOpts *options.Options) (*Instance, error) {
+	if err := defaultOpts.Validate(); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return nil, ErrManagerClosed
+	}
+
+	if _, exists := m.instances[name]; exists {
+		return nil, errors.NewValidationError(
+			nil, errors.ErrSystemInvalidInput, fmt.Sprintf("Instance %q is already open", name),
+		)
+	}
+
+	dataDir := filepath.Clean(defaultOpts.DataDir)
+	for other, instance := range m.instances {
+		if filepath.Clean(instance.options.DataDir) == dataDir {
+			return nil, errors.NewValidationError(
+				nil, errors.ErrSystemInvalidInput,
+				fmt.Sprintf("Data directory %s is already used by instance %q", dataDir, other),
+			)
+		}
+	}
+
+	log := m.log
+	if defaultOpts.Logger != nil {
+		log = defaultOpts.Logger
+	}
+
+	instance, err := openInstance(context, name, log.With("instance", name), defaultOpts, engine.Shared{
+		SegmentBudget: m.budget,
+		Scheduler:     m.scheduler,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	instance.onClose = func() { m.forget(name, instance) }
+	m.instances[name] = instance
+	return instance, nil
+}
+
+// Instance looks up an open instance by name.
+func (m *Manager) Instance(name string) (*Instance, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	instance, ok := m.instances[name]
+	return instance, ok
+}
+
+// Names lists the open instances in lexicographic order.
+func (m *Manager) Names() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	names := make([]string, 0, len(m.instances))
+	for name := range m.instances {
+		names = append(names, name)
+	}
+
+	slices.Sort(names)
+	return names
+}
+
+// SetLogLevel changes the log level of the manager and of every instance
+// logging through it, including ones opened later. Instances opened
+// WithLogger are unaffected.
+func (m *Manager) SetLogLevel(level zapcore.Level) error {
+	if err := validateLogLevel(level); err != nil {
+		return err
+	}
+
+	m.level.SetLevel(level)
+	m.log.Infow("Log level changed", "level", level)
+	return nil
+}
+
+// OpenSegments reports how many sealed segment handles are open across all
+// instances, and the cap, which is zero when uncapped.
+func (m *Manager) OpenSegments() (int, int) {
+	if m.budget == nil {
+		return 0, 0
+	}
+	return m.budget.Open(), m.budget.Limit()
+}
+
+// Close closes every instance, then stops the shared background worker.
+// All instances are closed even if some fail; their errors are joined.
+func (m *Manager) Close() error {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return ErrManagerClosed
+	}
+
+	m.closed = true
+	instances := make(map[string]*Instance, len(m.instances))
+	for name, instance := range m.instances {
+		instances[name] = instance
+	}
+	m.mu.Unlock()
+
+	var errs []error
+	for name, instance := range instances {
+		if err := instance.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("instance %q: %w", name, err))
+		}
+	}
+
+	m.scheduler.Close()
+	m.log.Infow("Manager closed", "instances", len(instances))
+	return stdErrors.Join(errs...)
+}
+
+func (m *Manager) forget(name string, instance *Instance) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.instances[name] == instance {
+		delete(m.instances, name)
+	}
+}
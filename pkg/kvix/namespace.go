@@ -0,0 +1,251 @@
+package kvix
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/iamBelugaa/kvix/internal/engine"
+	"github.com/iamBelugaa/kvix/internal/storage"
+	"github.com/iamBelugaa/kvix/pkg/errors"
+)
+
+// namespaceMarker starts every namespaced key. Keys of the instance itself
+// should not begin with it, or they show up inside namespaces.
+const namespaceMarker = 0x00
+
+const maxNamespaceName = 255
+
+// NamespaceStats summarizes the live keys of a namespace.
+type NamespaceStats = engine.KeyspaceStats
+
+// Namespace is a logical keyspace inside an instance. Its keys are stored
+// under a prefix of the marker byte, the length of the name and the name, so
+// they never collide with keys of other namespaces. A Namespace is as safe for
+// concurrent use as its instance and stays valid until the instance is closed.
+type Namespace struct {
+	instance *Instance
+	name     string
+	prefix   []byte
+}
+
+// Namespace returns the keyspace called name, which must be 1 to 255 bytes.
+// Namespaces need no setup; one exists for as long as it holds keys.
+func (i *Instance) Namespace(name string) (*Namespace, error) {
+	if len(name) == 0 || len(name) > maxNamespaceName {
+		return nil, errors.NewValidationError(
+			nil, errors.ErrSystemInvalidInput,
+			fmt.Sprintf("Namespace name must be 1 to %d bytes, got %d", maxNamespaceName, len(name)),
+		)
+	}
+
+	prefix := make([]byte, 0, 2+len(name))
+	prefix = append(prefix, namespaceMarker, byte(len(name)))
+	prefix = append(prefix, name...)
+	return &Namespace{instance: i, name: name, prefix: prefix}, nil
+}
+
+func (n *Namespace) Name() string {
+	return n.name
+}
+
+func (n *Namespace) Set(context context.Context, key []byte, value []byte) error {
+	if err := isValidKey(key); err != nil {
+		return err
+	}
+	return n.instance.Set(context, n.key(key), value)
+}
+
+func (n *Namespace) SetX(context context.Context, key []byte, value []byte, ttl time.Duration) error {
+	if err := isValidKey(key); err != nil {
+		return err
+	}
+	return n.instance.SetX(context, n.key(key), value, ttl)
+}
+
+func (n *Namespace) SetEXAt(context context.Context, key []byte, value []byte, expireAt time.Time) error {
+	if err := isValidKey(key); err != nil {
+		return err
+	}
+	return n.instance.SetEXAt(context, n.key(key), value, expireAt)
+}
+
+func (n *Namespace) SetWithMetadata(
+	context context.Context, key []byte, value []byte, metadata Metadata, ttl time.Duration,
+) error {
+	if err := isValidKey(key); err != nil {
+		return err
+	}
+	return n.instance.SetWithMetadata(context, n.key(key), value, metadata, ttl)
+}
+
+// Get returns the record of key with the namespace prefix stripped from
+// its Key.
+func (n *Namespace) Get(context context.Context, key []byte) (*storage.Record, error) {
+	if err := isValidKey(key); err != nil {
+		return nil, err
+	}
+
+	record, err := n.instance.Get(context, n.key(key))
+	if err != nil {
+		return nil, err
+	}
+
+	record.Key = key
+	return record, nil
+}
+
+func (n *Namespace) Exists(context context.Context, key []byte) (bool, error) {
+	if err := isValidKey(key); err != nil {
+		return false, err
+	}
+	return n.instance.Exists(context, n.key(key))
+}
+
+func (n *Namespace) Delete(context context.Context, key []byte) (bool, error) {
+	if err := isValidKey(key); err != nil {
+		return false, err
+	}
+	return n.instance.Delete(context, n.key(key))
+}
+
+func (n *Namespace) TTL(context context.Context, key []byte) (time.Duration, error) {
+	if err := isValidKey(key); err != nil {
+		return 0, err
+	}
+	return n.instance.TTL(context, n.key(key))
+}
+
+func (n *Namespace) Expire(context context.Context, key []byte, ttl time.Duration) (bool, error) {
+	if err := isValidKey(key); err != nil {
+		return false, err
+	}
+	return n.instance.Expire(context, n.key(key), ttl)
+}
+
+func (n *Namespace) Persist(context context.Context, key []byte) (bool, error) {
+	if err := isValidKey(key); err != nil {
+		return false, err
+	}
+	return n.instance.Persist(context, n.key(key))
+}
+
+// Keys returns the namespace's live keys in lexicographic order.
+func (n *Namespace) Keys(context context.Context) ([][]byte, error) {
+	snapshot, err := n.instance.Snapshot(context)
+	if err != nil {
+		return nil, err
+	}
+	defer snapshot.Release()
+
+	stored := snapshot.KeysWithPrefix(string(n.prefix))
+	keys := make([][]byte, 0, len(stored))
+	for _, key := range stored {
+		keys = append(keys, []byte(key[len(n.prefix):]))
+	}
+
+	return keys, nil
+}
+
+// Query is Instance.Query limited to the keys of the namespace.
+func (n *Namespace) Query(context context.Context, path, value string) ([][]byte, error) {
+	matched, err := n.instance.Query(context, path, value)
+	if err != nil {
+		return nil, err
+	}
+	return n.own(matched), nil
+}
+
+// FindByTag is Instance.FindByTag limited to the keys of the namespace.
+func (n *Namespace) FindByTag(context context.Context, tag string) ([][]byte, error) {
+	matched, err := n.instance.FindByTag(context, tag)
+	if err != nil {
+		return nil, err
+	}
+	return n.own(matched), nil
+}
+
+// own keeps the stored keys that belong to the namespace, without its prefix.
+func (n *Namespace) own(stored [][]byte) [][]byte {
+	keys := make([][]byte, 0, len(stored))
+	for _, key := range stored {
+		if bytes.HasPrefix(key, n.prefix) {
+			keys = append(keys, key[len(n.prefix):])
+		}
+	}
+	return keys
+}
+
+// Scan calls fn with every live record of the namespace, in key order, as of
+// the moment Scan starts. Writes made during the scan are not seen. Scanning
+// stops at the first error fn returns.
+func (n *Namespace) Scan(context context.Context, fn func(record *storage.Record) error) error {
+	snapshot, err := n.instance.Snapshot(context)
+	if err != nil {
+		return err
+	}
+	defer snapshot.Release()
+
+	for _, key := range snapshot.KeysWithPrefix(string(n.prefix)) {
+		if err := context.Err(); err != nil {
+			return err
+		}
+
+		record, err := snapshot.Get(context, []byte(key))
+		if err != nil {
+			return err
+		}
+
+		record.Key = []byte(key[len(n.prefix):])
+		if err := fn(record); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Flush deletes every key the namespace holds when Flush starts and returns
+// how many were deleted. Keys written concurrently may survive.
+func (n *Namespace) Flush(context context.Context) (int, error) {
+	snapshot, err := n.instance.Snapshot(context)
+	if err != nil {
+		return 0, err
+	}
+	keys := snapshot.KeysWithPrefix(string(n.prefix))
+	snapshot.Release()
+
+	n.instance.log.Infow("Namespace flush request received", "namespace", n.name, "keys", len(keys))
+
+	var deleted int
+	for _, key := range keys {
+		if err := context.Err(); err != nil {
+			return deleted, err
+		}
+
+		ok, err := n.instance.Delete(context, []byte(key))
+		if err != nil {
+			return deleted, err
+		}
+
+		if ok {
+			deleted++
+		}
+	}
+
+	return deleted, nil
+}
+
+// Stats counts the namespace's live keys and the bytes their records occupy.
+func (n *Namespace) Stats(context context.Context) (*NamespaceStats, error) {
+	n.instance.mu.RLock()
+	defer n.instance.mu.RUnlock()
+	return n.instance.engine.PrefixStats(context, string(n.prefix))
+}
+
+func (n *Namespace) key(key []byte) []byte {
+	namespaced := make([]byte, 0, len(n.prefix)+len(key))
+	namespaced = append(namespaced, n.prefix...)
+	return append(namespaced, key...)
+}
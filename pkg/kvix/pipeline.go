@@ -0,0 +1,346 @@
+package kvix
+
+import (
+	"context"
+	stdErrors "errors"
+	"sync"
+	"time"
+
+	"github.com/iamBelugaa/kvix/internal/engine"
+	"github.com/iamBelugaa/kvix/internal/storage"
+)
+
+// ErrPipelineClosed resolves operations queued on a closed pipeline.
+var ErrPipelineClosed = stdErrors.New("operation failed: pipeline has been closed")
+
+const (
+	defaultPipelineBatchSize     = 128
+	defaultPipelineFlushInterval = time.Millisecond
+)
+
+// PipelineOptions configure a Pipeline. Zero fields take their defaults.
+type PipelineOptions struct {
+	// BatchSize is how many queued operations trigger a flush; 128 by default.
+	BatchSize int
+	// FlushInterval is how long an operation may wait in the queue before it
+	// is flushed anyway; 1ms by default.
+	FlushInterval time.Duration
+}
+
+// Future holds the result of a pipelined operation, available once the
+// batch it belongs to has been flushed.
+type Future[T any] struct {
+	done  chan struct{}
+	value T
+	err   error
+}
+
+func newFuture[T any]() *Future[T] {
+	return &Future[T]{done: make(chan struct{})}
+}
+
+// Done is closed once the result is available.
+func (f *Future[T]) Done() <-chan struct{} {
+	return f.done
+}
+
+// Wait blocks until the result is available or ctx is done. Giving up on a
+// result does not cancel the operation.
+func (f *Future[T]) Wait(ctx context.Context) (T, error) {
+	select {
+	case <-f.done:
+		return f.value, f.err
+	case <-ctx.Done():
+		var zero T
+		return zero, ctx.Err()
+	}
+}
+
+func (f *Future[T]) resolve(value T, err error) {
+	f.value, f.err = value, err
+	close(f.done)
+}
+
+// pipelined is a queued operation. Gets carry their key and future so that
+// consecutive ones are read with a single MGet, and sets their value, TTL and
+// future so that consecutive ones are written with a single batch; every
+// other operation runs through exec.
+type pipelined struct {
+	key   []byte
+	get   *Future[*storage.Record]
+	value []byte
+	ttl   time.Duration
+	set   *Future[struct{}]
+	exec  func(ctx context.Context)
+	fail  func(err error)
+}
+
+// Pipeline queues operations on an instance and runs them in order, in
+// batches, from a background goroutine, so producers overlap their work with
+// the instance's I/O instead of blocking on every call. Consecutive sets are
+// written as one batch, which locks each partition once and, under
+// SyncAlways, fsyncs once for the whole batch. Each queued operation returns
+// a Future resolved when its batch is flushed. A Pipeline is safe for
+// concurrent use; operations queued from one goroutine run in the order they
+// were queued.
+type Pipeline struct {
+	instance      *Instance
+	ctx           context.Context
+	batchSize     int
+	flushInterval time.Duration
+
+	mu      sync.Mutex
+	queue   []pipelined
+	closed  bool
+	wake    chan struct{}
+	stopped chan struct{}
+}
+
+// Pipeline starts a pipeline on the instance. Its operations run with ctx;
+// once ctx is done, queued and later operations fail with its error. Close
+// flushes and stops the pipeline.
+func (i *Instance) Pipeline(ctx context.Context, opts PipelineOptions) *Pipeline {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = defaultPipelineBatchSize
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = defaultPipelineFlushInterval
+	}
+
+	p := &Pipeline{
+		instance:      i,
+		ctx:           ctx,
+		batchSize:     opts.BatchSize,
+		flushInterval: opts.FlushInterval,
+		wake:          make(chan struct{}, 1),
+		stopped:       make(chan struct{}),
+	}
+
+	go p.loop()
+	return p
+}
+
+// Set queues storing value under key without expiration.
+func (p *Pipeline) Set(key []byte, value []byte) *Future[struct{}] {
+	return p.SetX(key, value, 0)
+}
+
+// SetX queues storing value under key, expiring after ttl unless it is zero.
+func (p *Pipeline) SetX(key []byte, value []byte, ttl time.Duration) *Future[struct{}] {
+	future := newFuture[struct{}]()
+	p.enqueue(pipelined{
+		key:   key,
+		value: value,
+		ttl:   ttl,
+		set:   future,
+		fail:  func(err error) { future.resolve(struct{}{}, err) },
+	})
+	return future
+}
+
+// Get queues reading key. The read sees every operation queued before it.
+func (p *Pipeline) Get(key []byte) *Future[*storage.Record] {
+	future := newFuture[*storage.Record]()
+	p.enqueue(pipelined{
+		key:  key,
+		get:  future,
+		fail: func(err error) { future.resolve(nil, err) },
+	})
+	return future
+}
+
+// Delete queues deleting key; its future reports whether the key existed.
+func (p *Pipeline) Delete(key []byte) *Future[bool] {
+	future := newFuture[bool]()
+	p.enqueue(pipelined{
+		exec: func(ctx context.Context) {
+			future.resolve(p.instance.Delete(ctx, key))
+		},
+		fail: func(err error) { future.resolve(false, err) },
+	})
+	return future
+}
+
+// Flush waits until every operation queued before it has run, or ctx is
+// done.
+func (p *Pipeline) Flush(ctx context.Context) error {
+	future := newFuture[struct{}]()
+	p.enqueue(pipelined{
+		exec: func(context.Context) { future.resolve(struct{}{}, nil) },
+		fail: func(err error) { future.resolve(struct{}{}, err) },
+	})
+	p.signal()
+
+	_, err := future.Wait(ctx)
+	if stdErrors.Is(err, ErrPipelineClosed) {
+		return nil
+	}
+	return err
+}
+
+// Close runs the operations already queued and stops the pipeline.
+// Operations queued afterwards fail with ErrPipelineClosed.
+func (p *Pipeline) Close() error {
+	p.mu.Lock()
+	p.closed = true
+	p.mu.Unlock()
+
+	p.signal()
+	<-p.stopped
+	return nil
+}
+
+func (p *Pipeline) enqueue(op pipelined) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		op.fail(ErrPipelineClosed)
+		return
+	}
+
+	p.queue = append(p.queue, op)
+	full := len(p.queue) >= p.batchSize
+	p.mu.Unlock()
+
+	if full {
+		p.signal()
+	}
+}
+
+func (p *Pipeline) signal() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (p *Pipeline) loop() {
+	defer close(p.stopped)
+
+	ticker := time.NewTicker(p.flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.wake:
+		case <-ticker.C:
+		case <-p.ctx.Done():
+			p.mu.Lock()
+			p.closed = true
+			batch := p.queue
+			p.queue = nil
+			p.mu.Unlock()
+
+			for _, op := range batch {
+				op.fail(p.ctx.Err())
+			}
+			return
+		}
+
+		p.mu.Lock()
+		batch, closed := p.queue, p.closed
+		p.queue = nil
+		p.mu.Unlock()
+
+		p.run(batch)
+		if closed {
+			return
+		}
+	}
+}
+
+// run executes batch in order, reading each run of consecutive gets with a
+// single MGet and writing each run of consecutive sets with setBatch.
+func (p *Pipeline) run(batch []pipelined) {
+	for start := 0; start < len(batch); {
+		end := start + 1
+		switch {
+		case batch[start].get != nil:
+			for end < len(batch) && batch[end].get != nil {
+				end++
+			}
+			p.get(batch[start:end])
+		case batch[start].set != nil:
+			for end < len(batch) && batch[end].set != nil {
+				end++
+			}
+			p.setBatch(batch[start:end])
+		default:
+			batch[start].exec(p.ctx)
+		}
+		start = end
+	}
+}
+
+// get reads the keys of gets with a single MGet.
+func (p *Pipeline) get(gets []pipelined) {
+	keys := make([][]byte, len(gets))
+	for n, op := range gets {
+		keys[n] = op.key
+	}
+
+	results, err := p.instance.MGet(p.ctx, keys)
+	for n, op := range gets {
+		if err != nil {
+			op.get.resolve(nil, err)
+			continue
+		}
+		op.get.resolve(results[n].Entry, results[n].Err)
+	}
+}
+
+// setBatch writes sets as one engine batch. Interceptors see every operation
+// on its own and cluster members propose every write, so there the sets are
+// made one by one.
+func (p *Pipeline) setBatch(sets []pipelined) {
+	instance := p.instance
+	if instance.interceptor != nil || instance.node != nil {
+		for _, op := range sets {
+			var err error
+			if op.ttl == 0 {
+				err = instance.Set(p.ctx, op.key, op.value)
+			} else {
+				err = instance.SetX(p.ctx, op.key, op.value, op.ttl)
+			}
+			op.set.resolve(struct{}{}, err)
+		}
+		return
+	}
+
+	valid := make([]pipelined, 0, len(sets))
+	batch := make([]engine.BatchSet, 0, len(sets))
+	for _, op := range sets {
+		if err := isValidSet(op.key, op.value, op.ttl); err != nil {
+			op.set.resolve(struct{}{}, err)
+			continue
+		}
+
+		set := engine.BatchSet{Key: op.key, Value: op.value}
+		if op.ttl != 0 {
+			set.ExpiresAt = time.Now().Add(op.ttl).UnixNano()
+		}
+		valid = append(valid, op)
+		batch = append(batch, set)
+	}
+
+	if len(batch) == 0 {
+		return
+	}
+
+	ctx, cancel := instance.withDeadline(p.ctx)
+	defer cancel()
+
+	errs, err := bounded(instance, ctx, "SetBatch", nil, func(ctx context.Context) ([]error, error) {
+		instance.mu.RLock()
+		defer instance.mu.RUnlock()
+		return instance.engine.SetBatch(ctx, batch), nil
+	})
+
+	for n, op := range valid {
+		if err != nil {
+			op.set.resolve(struct{}{}, err)
+			continue
+		}
+		op.set.resolve(struct{}{}, errs[n])
+	}
+}
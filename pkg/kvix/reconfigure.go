@@ -0,0 +1,73 @@
+package kvix
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/iamBelugaa/kvix/pkg/errors"
+	"github.com/iamBelugaa/kvix/pkg/options"
+)
+
+// Reconfigure changes settings of the running instance without reopening
+// it, so the index stays in memory. opts apply over the settings in effect
+// and are validated as by NewInstance. Only the settings in
+// options.Reloadable can change: the log level, sync policy and interval,
+// eviction limits and policy, slow operation threshold, operation timeout,
+// read verification level, and compaction threshold and rates. Changes to
+// anything else fail the whole call with a ValidationError naming them, and
+// nothing is applied.
+func (i *Instance) Reconfigure(opts ...options.OptionFunc) error {
+	i.log.Debugw("Reconfigure request received", "options", len(opts))
+
+	i.reloadMu.Lock()
+	defer i.reloadMu.Unlock()
+
+	next := i.settings
+	for _, opt := range opts {
+		opt(&next)
+	}
+
+	reloadable, fixed := options.Changes(&i.settings, &next)
+	if len(fixed) > 0 {
+		return errors.NewValidationError(
+			nil, errors.ErrSystemInvalidInput,
+			fmt.Sprintf("Settings cannot change while the instance runs: %s", strings.Join(fixed, ", ")),
+		).
+			WithDetail("settings", fixed).
+			WithExpected(strings.Join(options.Reloadable, ", "))
+	}
+
+	if len(reloadable) == 0 {
+		return nil
+	}
+
+	if err := next.Validate(); err != nil {
+		return err
+	}
+
+	// Instances logging WithLogger leave the level to that logger.
+	setLevel := slices.Contains(reloadable, "LogLevel") && next.Logger == nil
+	if setLevel && i.level == nil {
+		return errors.NewValidationError(
+			nil, errors.ErrSystemInvalidInput, "Log level belongs to the logger the instance was given",
+		)
+	}
+
+	i.mu.RLock()
+	err := i.engine.Reconfigure(&next)
+	i.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	if setLevel {
+		i.level.SetLevel(next.LogLevel)
+	}
+
+	i.operationTimeout.Store(int64(next.OperationTimeout))
+	i.settings = next
+
+	i.log.Infow("Instance reconfigured", "settings", reloadable)
+	return nil
+}
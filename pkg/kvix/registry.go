@@ -0,0 +1,157 @@
+package kvix
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/iamBelugaa/kvix/pkg/errors"
+)
+
+// CodecRegistry holds codecs for T by content type. The content type stored
+// with every value names the codec that wrote it, so a Typed built on a
+// registry decodes values written by any registered codec. It is safe for
+// concurrent use.
+type CodecRegistry[T any] struct {
+	mu     sync.RWMutex
+	codecs map[string]Codec[T]
+}
+
+// NewCodecRegistry returns a registry holding codecs.
+func NewCodecRegistry[T any](codecs ...Codec[T]) (*CodecRegistry[T], error) {
+	registry := &CodecRegistry[T]{codecs: make(map[string]Codec[T], len(codecs))}
+	for _, codec := range codecs {
+		if err := registry.Register(codec); err != nil {
+			return nil, err
+		}
+	}
+	return registry, nil
+}
+
+// Register adds codec under its content type, which must be non-empty and
+// not already registered.
+func (r *CodecRegistry[T]) Register(codec Codec[T]) error {
+	contentType := codec.ContentType()
+	if contentType == "" {
+		return errors.NewValidationError(
+			nil, errors.ErrValidationInvalidData, "Codec must have a content type to be registered",
+		)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.codecs[contentType]; ok {
+		return errors.NewValidationError(
+			nil, errors.ErrValidationInvalidData, fmt.Sprintf("Codec %s is already registered", contentType),
+		).
+			WithProvided(contentType)
+	}
+
+	r.codecs[contentType] = codec
+	return nil
+}
+
+// Lookup returns the codec registered for contentType.
+func (r *CodecRegistry[T]) Lookup(contentType string) (Codec[T], bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	codec, ok := r.codecs[contentType]
+	return codec, ok
+}
+
+// ContentTypes returns the registered content types in order.
+func (r *CodecRegistry[T]) ContentTypes() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	contentTypes := make([]string, 0, len(r.codecs))
+	for contentType := range r.codecs {
+		contentTypes = append(contentTypes, contentType)
+	}
+
+	slices.Sort(contentTypes)
+	return contentTypes
+}
+
+// NewTypedWithRegistry returns a Typed that writes values with the codec
+// registered for contentType and reads values written by any codec in
+// registry. Values stored without a content type are read with the writing
+// codec.
+func NewTypedWithRegistry[T any](instance *Instance, registry *CodecRegistry[T], contentType string) (*Typed[T], error) {
+	codec, ok := registry.Lookup(contentType)
+	if !ok {
+		return nil, errors.NewValidationError(
+			nil, errors.ErrValidationInvalidData, fmt.Sprintf("Codec %s is not registered", contentType),
+		).
+			WithProvided(contentType).
+			WithExpected(fmt.Sprint(registry.ContentTypes()))
+	}
+	return &Typed[T]{instance: instance, codec: codec, registry: registry}, nil
+}
+
+// Recode rewrites the value of key with the writing codec if it was stored
+// with another one, keeping its tags and expiry, and reports whether it did.
+// The value is rewritten only if key was not written, deleted or given
+// another TTL while it was being recoded, so Recode never overwrites a newer
+// value; it then reports false and may be called again. Calling it for every
+// key migrates a dataset between codecs. Cluster members cannot recode, since
+// the check bypasses the replicated log.
+func (t *Typed[T]) Recode(ctx context.Context, key []byte) (bool, error) {
+	instance := t.instance
+	if err := isValidKey(key); err != nil {
+		return false, err
+	}
+
+	if instance.node != nil {
+		return false, errors.NewValidationError(
+			nil, errors.ErrSystemInvalidInput,
+			"Recoding bypasses the replicated log and is not supported on cluster members",
+		)
+	}
+
+	ctx, cancel := instance.withDeadline(ctx)
+	defer cancel()
+
+	return bounded(instance, ctx, "Recode", key, func(ctx context.Context) (bool, error) {
+		instance.mu.RLock()
+		defer instance.mu.RUnlock()
+		return instance.engine.Rewrite(ctx, key, func(record *Record) ([]byte, *Metadata, bool, error) {
+			return t.recode(key, record)
+		})
+	})
+}
+
+// recode re-encodes the value of record with the writing codec, unless it
+// already is, and carries its tags over.
+func (t *Typed[T]) recode(key []byte, record *Record) ([]byte, *Metadata, bool, error) {
+	contentType := t.codec.ContentType()
+	if recordContentType(record) == contentType {
+		return nil, nil, false, nil
+	}
+
+	value, err := t.decode(key, record)
+	if err != nil {
+		return nil, nil, false, err
+	}
+
+	data, err := t.codec.Encode(value)
+	if err != nil {
+		return nil, nil, false, errEncodeValue(err, key, contentType)
+	}
+
+	metadata := &Metadata{ContentType: contentType}
+	if record.Metadata != nil {
+		metadata.Tags = record.Metadata.Tags
+	}
+
+	if err := isValidValue(data); err != nil {
+		return nil, nil, false, err
+	}
+	if err := isValidMetadata(metadata, data); err != nil {
+		return nil, nil, false, err
+	}
+	return data, metadata, true, nil
+}
@@ -0,0 +1,69 @@
+package kvix
+
+import (
+	"context"
+	stdErrors "errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+
+	"github.com/iamBelugaa/kvix/internal/engine"
+	"github.com/iamBelugaa/kvix/pkg/errors"
+	"github.com/iamBelugaa/kvix/pkg/options"
+)
+
+// TestingT is the part of testing.TB that NewTestInstance uses.
+type TestingT interface {
+	Helper()
+	Cleanup(func())
+	Errorf(format string, args ...any)
+	Fatalf(format string, args ...any)
+}
+
+// NewTestInstance opens an instance for an integration test in a new
+// temporary directory, with the smallest segments allowed, quiet logging and
+// a frequent expiration sweep. opts apply on top. The instance is closed, and
+// its directory removed, when the test ends unless the test closes it first.
+func NewTestInstance(t TestingT, opts ...options.OptionFunc) *Instance {
+	t.Helper()
+
+	testOpts := append([]options.OptionFunc{
+		options.WithSegmentSize(options.MinSegmentSize),
+		options.WithLogLevel(zapcore.ErrorLevel),
+		options.WithExpirationInterval(100 * time.Millisecond),
+		options.WithStatsFlushInterval(-1),
+	}, opts...)
+	testOpts = append(testOpts, options.WithEphemeralDataDir())
+
+	instance, err := NewInstance(context.Background(), "kvix-test", testOpts...)
+	if err != nil {
+		t.Fatalf("failed to open test instance: %v", err)
+		return nil
+	}
+
+	t.Cleanup(func() {
+		if err := instance.Close(); err != nil && !stdErrors.Is(err, engine.ErrEngineClosed) {
+			t.Errorf("failed to close test instance: %v", err)
+		}
+	})
+	return instance
+}
+
+// useEphemeralDataDir points opts at a new temporary directory when they ask
+// for WithEphemeralDataDir, and returns it, or "" when they do not.
+func useEphemeralDataDir(opts *options.Options) (string, error) {
+	if !opts.EphemeralDataDir {
+		return "", nil
+	}
+
+	dir, err := os.MkdirTemp("", "kvix-")
+	if err != nil {
+		return "", errors.NewStorageError(err, errors.ErrIOGeneral, "Failed to create ephemeral data directory")
+	}
+
+	opts.DataDir = dir
+	opts.SegmentOptions.Directory = filepath.Join(dir, "segments")
+	return dir, nil
+}
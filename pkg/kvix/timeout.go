@@ -0,0 +1,129 @@
+package kvix
+
+import (
+	"context"
+	"time"
+
+	"github.com/iamBelugaa/kvix/pkg/options"
+)
+
+// withDeadline applies the timeout set by WithOperationTimeout to ctx,
+// unless none is set or ctx already carries a deadline of its own.
+func (i *Instance) withDeadline(ctx context.Context) (context.Context, context.CancelFunc) {
+	timeout := time.Duration(i.operationTimeout.Load())
+	if timeout <= 0 {
+		return ctx, func() {}
+	}
+
+	if _, ok := ctx.Deadline(); ok {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// bounded runs op, as the operation name on key, through the instance's
+// interceptors and then runBounded. op is given the context the innermost
+// interceptor passed on, which it must use instead of ctx.
+func bounded[T any](
+	i *Instance, ctx context.Context, name string, key []byte, op func(ctx context.Context) (T, error),
+) (T, error) {
+	return boundedRelease(i, ctx, name, key, op, nil)
+}
+
+// boundedRelease is bounded for operations returning something the caller
+// must release, such as a reader or a snapshot. One the caller never receives,
+// because it gave up first or an interceptor failed the call, is passed to
+// release rather than leaked.
+func boundedRelease[T any](
+	i *Instance, ctx context.Context, name string, key []byte, op func(ctx context.Context) (T, error), release func(T),
+) (T, error) {
+	if i.interceptor == nil {
+		return runBounded(i, ctx, op, release)
+	}
+
+	var (
+		value T
+		ok    bool
+	)
+	err := i.interceptor(ctx, options.Operation{Name: name, Key: key}, func(ctx context.Context) error {
+		var err error
+		value, err = runBounded(i, ctx, op, release)
+		ok = err == nil
+		return err
+	})
+	if err != nil && ok && release != nil {
+		release(value)
+	}
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+	return value, nil
+}
+
+// runBounded runs op and returns its result, or the context's error once ctx
+// is done, whichever comes first, so a caller is not held past its deadline
+// by op being stuck in a read or write to a hung disk. The abandoned op keeps
+// running and its result is dropped, or passed to release when that is set,
+// which means a timed-out write may still be applied. op takes i.mu itself so
+// that Close waits for it either way. Without WithOperationTimeout op runs on
+// the calling goroutine.
+func runBounded[T any](
+	i *Instance, ctx context.Context, op func(ctx context.Context) (T, error), release func(T),
+) (T, error) {
+	if i.operationTimeout.Load() <= 0 {
+		return op(ctx)
+	}
+
+	type result struct {
+		value T
+		err   error
+	}
+
+	// Unbuffered, so that op finds out whether the caller took its result.
+	done := make(chan result)
+	go func() {
+		value, err := op(ctx)
+		select {
+		case done <- result{value: value, err: err}:
+		case <-ctx.Done():
+			if err == nil && release != nil {
+				release(value)
+			}
+		}
+	}()
+
+	select {
+	case result := <-done:
+		return result.value, result.err
+	case <-ctx.Done():
+		var zero T
+		return zero, ctx.Err()
+	}
+}
+
+// boundedErr is bounded for operations that only return an error.
+func boundedErr(i *Instance, ctx context.Context, name string, key []byte, op func(ctx context.Context) error) error {
+	_, err := bounded(i, ctx, name, key, func(ctx context.Context) (struct{}, error) {
+		return struct{}{}, op(ctx)
+	})
+	return err
+}
+
+// chainInterceptors combines interceptors into one, the first outermost, or
+// returns nil when there are none.
+func chainInterceptors(interceptors []options.Interceptor) options.Interceptor {
+	if len(interceptors) == 0 {
+		return nil
+	}
+
+	return func(ctx context.Context, op options.Operation, invoke options.Invoker) error {
+		for n := len(interceptors) - 1; n >= 0; n-- {
+			interceptor, next := interceptors[n], invoke
+			invoke = func(ctx context.Context) error {
+				return interceptor(ctx, op, next)
+			}
+		}
+		return invoke(ctx)
+	}
+}
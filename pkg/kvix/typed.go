@@ -0,0 +1,209 @@
+package kvix
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/iamBelugaa/kvix/pkg/errors"
+)
+
+// Content types recorded by the built-in codecs.
+const (
+	ContentTypeJSON     = "application/json"
+	ContentTypeGob      = "application/x-gob"
+	ContentTypeProtobuf = "application/x-protobuf"
+)
+
+// Codec encodes values of T for storage and decodes them back. A non-empty
+// ContentType is recorded in the metadata of every value stored with it.
+type Codec[T any] interface {
+	ContentType() string
+	Encode(value T) ([]byte, error)
+	Decode(data []byte) (T, error)
+}
+
+// Typed stores values of T in an instance, encoded with a Codec, so callers
+// do not marshal by hand around every Set and Get. It is as safe for
+// concurrent use as its instance and its codec.
+type Typed[T any] struct {
+	instance *Instance
+	codec    Codec[T]
+	// registry, when set, decodes values written by other codecs.
+	registry *CodecRegistry[T]
+}
+
+// NewTyped returns a Typed storing values of T in instance with codec.
+func NewTyped[T any](instance *Instance, codec Codec[T]) *Typed[T] {
+	return &Typed[T]{instance: instance, codec: codec}
+}
+
+// Set stores value under key without expiration.
+func (t *Typed[T]) Set(context context.Context, key []byte, value T) error {
+	return t.SetX(context, key, value, 0)
+}
+
+// SetX stores value under key, expiring after ttl unless it is zero.
+func (t *Typed[T]) SetX(context context.Context, key []byte, value T, ttl time.Duration) error {
+	data, err := t.codec.Encode(value)
+	if err != nil {
+		return errEncodeValue(err, key, t.codec.ContentType())
+	}
+
+	return t.instance.SetWithMetadata(context, key, data, Metadata{ContentType: t.codec.ContentType()}, ttl)
+}
+
+// Get returns the value of key. A value recorded with another content type
+// than the codec's, unless a registry holds a codec for it, or one the codec
+// cannot decode, fails with a ValidationError.
+func (t *Typed[T]) Get(context context.Context, key []byte) (T, error) {
+	var zero T
+
+	record, err := t.instance.Get(context, key)
+	if err != nil {
+		return zero, err
+	}
+
+	return t.decode(key, record)
+}
+
+// decode decodes the value of record with the codec that wrote it.
+func (t *Typed[T]) decode(key []byte, record *Record) (T, error) {
+	var zero T
+
+	codec := t.codec
+	if t.registry != nil {
+		if registered, ok := t.registry.Lookup(recordContentType(record)); ok {
+			codec = registered
+		}
+	}
+
+	if err := checkContentType(key, record, codec.ContentType()); err != nil {
+		return zero, err
+	}
+
+	value, err := codec.Decode(record.Value)
+	if err != nil {
+		return zero, errDecodeValue(err, key, codec.ContentType())
+	}
+	return value, nil
+}
+
+func recordContentType(record *Record) string {
+	if record.Metadata == nil {
+		return ""
+	}
+	return record.Metadata.ContentType
+}
+
+// checkContentType fails when record was stored with a content type other
+// than expected. Values stored without one, or codecs without one, pass.
+func checkContentType(key []byte, record *Record, expected string) error {
+	contentType := recordContentType(record)
+	if contentType == "" || expected == "" {
+		return nil
+	}
+
+	if contentType != expected {
+		return errors.NewValidationError(
+			nil, errors.ErrRecordDeserialization,
+			fmt.Sprintf("Value of key %q is %s, not %s", key, contentType, expected),
+		).
+			WithProvided(contentType).
+			WithExpected(expected)
+	}
+	return nil
+}
+
+func errEncodeValue(err error, key []byte, contentType string) error {
+	return errors.NewValidationError(err, errors.ErrRecordSerialization, "Failed to encode value").
+		WithDetail("key", string(key)).
+		WithExpected(contentType)
+}
+
+func errDecodeValue(err error, key []byte, contentType string) error {
+	return errors.NewValidationError(err, errors.ErrRecordDeserialization, "Failed to decode value").
+		WithDetail("key", string(key)).
+		WithExpected(contentType)
+}
+
+// JSONCodec encodes values with encoding/json.
+func JSONCodec[T any]() Codec[T] {
+	return jsonCodec[T]{}
+}
+
+type jsonCodec[T any] struct{}
+
+func (jsonCodec[T]) ContentType() string {
+	return ContentTypeJSON
+}
+
+func (jsonCodec[T]) Encode(value T) ([]byte, error) {
+	return json.Marshal(value)
+}
+
+func (jsonCodec[T]) Decode(data []byte) (T, error) {
+	var value T
+	err := json.Unmarshal(data, &value)
+	return value, err
+}
+
+// GobCodec encodes values with encoding/gob. Every value is encoded on its
+// own, type information included.
+func GobCodec[T any]() Codec[T] {
+	return gobCodec[T]{}
+}
+
+type gobCodec[T any] struct{}
+
+func (gobCodec[T]) ContentType() string {
+	return ContentTypeGob
+}
+
+func (gobCodec[T]) Encode(value T) ([]byte, error) {
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(value); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func (gobCodec[T]) Decode(data []byte) (T, error) {
+	var value T
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&value)
+	return value, err
+}
+
+// ProtoCodec encodes protocol buffer messages in the wire format. T is a
+// generated message pointer, such as *pb.Session.
+func ProtoCodec[T proto.Message]() Codec[T] {
+	return protoCodec[T]{}
+}
+
+type protoCodec[T proto.Message] struct{}
+
+func (protoCodec[T]) ContentType() string {
+	return ContentTypeProtobuf
+}
+
+func (protoCodec[T]) Encode(value T) ([]byte, error) {
+	return proto.Marshal(value)
+}
+
+func (protoCodec[T]) Decode(data []byte) (T, error) {
+	var zero T
+	value, ok := zero.ProtoReflect().New().Interface().(T)
+	if !ok {
+		return zero, fmt.Errorf("cannot create a %T to decode into", zero)
+	}
+
+	if err := proto.Unmarshal(data, value); err != nil {
+		return zero, err
+	}
+	return value, nil
+}
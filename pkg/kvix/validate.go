@@ -2,6 +2,7 @@ package kvix
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/iamBelugaa/kvix/pkg/errors"
 	"github.com/iamBelugaa/kvix/pkg/options"
@@ -24,17 +25,77 @@ func isValidKey(key []byte) error {
 }
 
 func isValidValue(value []byte) error {
-	if len(value) == 0 {
+	return isValidValueSize(int64(len(value)))
+}
+
+func isValidValueSize(size int64) error {
+	if size <= 0 {
 		return errors.NewValidationError(nil, errors.ErrSystemInvalidInput, "Value is required")
 	}
 
-	if len(value) > int(options.MaxValueSize) {
+	if size > options.MaxChunkedValueSize {
 		return errors.NewValidationError(
 			nil, errors.ErrValidationInvalidData, fmt.Sprintf(
-				"Value size %d exceeds maximum allowed size of %d", len(value), options.MaxValueSize,
+				"Value size %d exceeds maximum allowed size of %d", size, options.MaxChunkedValueSize,
 			),
 		)
 	}
 
 	return nil
 }
+
+func isValidTTL(ttl time.Duration) error {
+	if ttl <= 0 {
+		return errors.NewValidationError(
+			nil, errors.ErrValidationInvalidData, fmt.Sprintf("ttl must be positive, got %v", ttl),
+		)
+	}
+	return nil
+}
+
+func isValidExpireAt(expireAt time.Time) error {
+	if !expireAt.After(time.Now()) {
+		return errors.NewValidationError(
+			nil, errors.ErrValidationInvalidData, fmt.Sprintf("expireAt must be in the future, got %s", expireAt.Format(time.RFC3339Nano)),
+		)
+	}
+	return nil
+}
+
+func isValidMetadata(metadata *Metadata, value []byte) error {
+	if err := metadata.Validate(); err != nil {
+		return errors.NewValidationError(nil, errors.ErrValidationInvalidData, err.Error())
+	}
+
+	if size := int64(metadata.EncodedSize() + len(value)); size > options.MaxChunkedValueSize {
+		return errors.NewValidationError(
+			nil, errors.ErrValidationInvalidData, fmt.Sprintf(
+				"Value and metadata size %d exceeds maximum allowed size of %d", size, options.MaxChunkedValueSize,
+			),
+		)
+	}
+	return nil
+}
+
+func validateRecord(key, value []byte) error {
+	if err := isValidKey(key); err != nil {
+		return err
+	}
+	return isValidValue(value)
+}
+
+// isValidSet checks a pipelined set as Set and SetX check theirs.
+func isValidSet(key, value []byte, ttl time.Duration) error {
+	if err := isValidKey(key); err != nil {
+		return err
+	}
+
+	if err := isValidValue(value); err != nil {
+		return err
+	}
+
+	if ttl != 0 {
+		return isValidTTL(ttl)
+	}
+	return nil
+}
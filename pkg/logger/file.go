@@ -0,0 +1,320 @@
+package logger
+
+import (
+	"compress/gzip"
+	stdErrors "errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultMaxFileSize is the size a log file is rotated at when Rotation
+// leaves MaxSize at zero.
+const DefaultMaxFileSize int64 = 100 * 1024 * 1024
+
+// backupTimeFormat names rotated files so they sort by when they were
+// rotated.
+const backupTimeFormat = "20060102T150405.000"
+
+// rotateRetryInterval is how long a log file that failed to rotate is written
+// to as it is before rotating it is tried again.
+const rotateRetryInterval = time.Minute
+
+// Rotation decides when a log file is rotated and what becomes of the files
+// it is rotated to. A rotated file keeps the log file's name with the time of
+// the rotation added before its extension, as in kvix-20250102T150405.000.log.
+type Rotation struct {
+	MaxSize    int64         // Bytes written before the file is rotated; zero means DefaultMaxFileSize
+	MaxAge     time.Duration // How long the file is written before it is rotated; zero never rotates by age
+	MaxBackups int           // Rotated files kept, oldest removed first; zero keeps them all
+	Compress   bool          // Gzip rotated files
+}
+
+// File is a log file that rotates itself as Rotation says. It is safe for
+// concurrent use and satisfies zapcore.WriteSyncer.
+type File struct {
+	mu       sync.Mutex
+	path     string
+	rotation Rotation
+	file     *os.File
+	size     int64
+	openedAt time.Time
+	failedAt time.Time
+	refs     int
+
+	// maintenance orders compression and pruning of rotated files, which run
+	// in the background so writers do not wait for them.
+	maintenance sync.Mutex
+	pending     sync.WaitGroup
+}
+
+var (
+	filesMu sync.Mutex
+	files   = make(map[string]*File)
+)
+
+// OpenFile opens the log file at path for appending, creating it and its
+// directory if needed. Loggers of a process that write to the same path
+// share one File, rotated as the first of them asked. Every OpenFile must be
+// matched by a Close.
+func OpenFile(path string, rotation Rotation) (*File, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	filesMu.Lock()
+	defer filesMu.Unlock()
+
+	if shared, ok := files[path]; ok {
+		shared.mu.Lock()
+		shared.refs++
+		shared.mu.Unlock()
+		return shared, nil
+	}
+
+	if rotation.MaxSize <= 0 {
+		rotation.MaxSize = DefaultMaxFileSize
+	}
+
+	f := &File{path: path, rotation: rotation, refs: 1}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+
+	files[path] = f
+	return f, nil
+}
+
+func (f *File) open() error {
+	if err := os.MkdirAll(filepath.Dir(f.path), 0755); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	f.file = file
+	f.size = stat.Size()
+	f.openedAt = time.Now()
+	return nil
+}
+
+// Path returns the absolute path of the log file.
+func (f *File) Path() string {
+	return f.path
+}
+
+func (f *File) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return 0, os.ErrClosed
+	}
+
+	due := f.size+int64(len(p)) > f.rotation.MaxSize ||
+		(f.rotation.MaxAge > 0 && time.Since(f.openedAt) >= f.rotation.MaxAge)
+	if f.size > 0 && due && time.Since(f.failedAt) >= rotateRetryInterval {
+		if err := f.rotate(); err != nil {
+			if f.file == nil {
+				return 0, err
+			}
+
+			// The log goes on in the file it was in rather than be lost.
+			f.failedAt = time.Now()
+			fmt.Fprintf(os.Stderr, "kvix: failed to rotate log %s: %v\n", f.path, err)
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *File) Sync() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return os.ErrClosed
+	}
+	return f.file.Sync()
+}
+
+// Close releases one OpenFile of the log file, and closes it with the last
+// one, after rotated files still being compressed are done.
+func (f *File) Close() error {
+	filesMu.Lock()
+	f.mu.Lock()
+	f.refs--
+	if f.refs > 0 {
+		f.mu.Unlock()
+		filesMu.Unlock()
+		return nil
+	}
+
+	delete(files, f.path)
+	filesMu.Unlock()
+
+	err := f.file.Close()
+	f.file = nil
+	f.mu.Unlock()
+
+	f.pending.Wait()
+	return err
+}
+
+// rotate renames the log file aside and starts a new one. Called with mu
+// held. When either step fails the file it was in is opened again, and f.file
+// is only left nil if that fails too.
+func (f *File) rotate() error {
+	closeErr := f.file.Close()
+	f.file = nil
+
+	backup := f.backupName(time.Now().UTC())
+	if err := os.Rename(f.path, backup); err != nil {
+		return stdErrors.Join(closeErr, err, f.open())
+	}
+
+	if err := f.open(); err != nil {
+		if renameErr := os.Rename(backup, f.path); renameErr != nil {
+			return stdErrors.Join(closeErr, err, renameErr)
+		}
+		return stdErrors.Join(closeErr, err, f.open())
+	}
+
+	f.pending.Add(1)
+	go func() {
+		defer f.pending.Done()
+		f.maintain()
+	}()
+	return closeErr
+}
+
+// backupName returns a name for the file rotated at now that no earlier
+// rotation used, moving a millisecond on for rotations in the same one.
+func (f *File) backupName(now time.Time) string {
+	extension := filepath.Ext(f.path)
+	for {
+		name := fmt.Sprintf("%s-%s%s", strings.TrimSuffix(f.path, extension), now.Format(backupTimeFormat), extension)
+		if _, err := os.Stat(name); os.IsNotExist(err) {
+			if _, err := os.Stat(name + ".gz"); os.IsNotExist(err) {
+				return name
+			}
+		}
+		now = now.Add(time.Millisecond)
+	}
+}
+
+// maintain compresses rotated files and removes the oldest ones past
+// MaxBackups. It handles every rotated file rather than the one its rotation
+// produced, so runs of it overtaking one another do no harm. Failures are
+// reported on stderr, since the log itself is what failed.
+func (f *File) maintain() {
+	f.maintenance.Lock()
+	defer f.maintenance.Unlock()
+
+	backups, err := f.backups()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "kvix: failed to list rotated logs of %s: %v\n", f.path, err)
+		return
+	}
+
+	if f.rotation.MaxBackups > 0 {
+		for _, old := range backups[:max(len(backups)-f.rotation.MaxBackups, 0)] {
+			if err := os.Remove(old); err != nil && !os.IsNotExist(err) {
+				fmt.Fprintf(os.Stderr, "kvix: failed to remove rotated log %s: %v\n", old, err)
+			}
+		}
+		backups = backups[max(len(backups)-f.rotation.MaxBackups, 0):]
+	}
+
+	if !f.rotation.Compress {
+		return
+	}
+
+	for _, backup := range backups {
+		if strings.HasSuffix(backup, ".gz") {
+			continue
+		}
+		if err := compressFile(backup); err != nil {
+			fmt.Fprintf(os.Stderr, "kvix: failed to compress rotated log %s: %v\n", backup, err)
+		}
+	}
+}
+
+// backups returns the rotated files of the log, oldest first.
+func (f *File) backups() ([]string, error) {
+	extension := filepath.Ext(f.path)
+	prefix := strings.TrimSuffix(filepath.Base(f.path), extension) + "-"
+
+	entries, err := os.ReadDir(filepath.Dir(f.path))
+	if err != nil {
+		return nil, err
+	}
+
+	var backups []string
+	for _, entry := range entries {
+		stamp, ok := strings.CutPrefix(strings.TrimSuffix(entry.Name(), ".gz"), prefix)
+		if !ok || entry.IsDir() {
+			continue
+		}
+
+		if _, err := time.Parse(backupTimeFormat, strings.TrimSuffix(stamp, extension)); err != nil {
+			continue
+		}
+		backups = append(backups, filepath.Join(filepath.Dir(f.path), entry.Name()))
+	}
+
+	slices.SortFunc(backups, func(a, b string) int {
+		return strings.Compare(strings.TrimSuffix(a, ".gz"), strings.TrimSuffix(b, ".gz"))
+	})
+	return backups, nil
+}
+
+// compressFile replaces path with a gzipped copy named path.gz.
+func compressFile(path string) error {
+	source, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	target, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	writer := gzip.NewWriter(target)
+	if _, err := io.Copy(writer, source); err != nil {
+		target.Close()
+		os.Remove(target.Name())
+		return err
+	}
+
+	if err := writer.Close(); err != nil {
+		target.Close()
+		os.Remove(target.Name())
+		return err
+	}
+
+	if err := target.Close(); err != nil {
+		os.Remove(target.Name())
+		return err
+	}
+	return os.Remove(path)
+}
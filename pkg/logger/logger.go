@@ -2,27 +2,41 @@ package logger
 
 import (
 	"os"
+	"time"
 
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
 
 func New(service string, outputPaths ...string) *zap.SugaredLogger {
-	encoderCfg := zap.NewProductionEncoderConfig()
+	return NewSampled(service, 0, outputPaths...)
+}
 
-	encoderCfg.TimeKey = "timestamp"
-	encoderCfg.EncodeTime = zapcore.ISO8601TimeEncoder
+// NewSampled builds a logger that keeps the first entry of each message every
+// second and then one in every sampleEvery entries. Entries at error level and
+// above are never sampled. A sampleEvery of 1 or less disables sampling.
+func NewSampled(service string, sampleEvery int, outputPaths ...string) *zap.SugaredLogger {
+	return NewLeveled(service, zapcore.InfoLevel, sampleEvery, outputPaths...)
+}
+
+// NewLeveled is NewSampled with entries below level discarded.
+func NewLeveled(service string, level zapcore.Level, sampleEvery int, outputPaths ...string) *zap.SugaredLogger {
+	return NewAtomic(service, zap.NewAtomicLevelAt(level), sampleEvery, outputPaths...)
+}
 
+// NewAtomic is NewLeveled with a level that can be changed while the logger
+// is in use through level.SetLevel.
+func NewAtomic(service string, level zap.AtomicLevel, sampleEvery int, outputPaths ...string) *zap.SugaredLogger {
 	config := zap.Config{
 		Development:       false,
 		DisableCaller:     false,
 		DisableStacktrace: false,
 		Sampling:          nil,
 		Encoding:          "json",
-		EncoderConfig:     encoderCfg,
+		EncoderConfig:     encoderConfig(),
 		OutputPaths:       []string{"stderr"},
 		ErrorOutputPaths:  []string{"stderr"},
-		Level:             zap.NewAtomicLevelAt(zap.InfoLevel),
+		Level:             level,
 		InitialFields:     map[string]any{"service": service, "pid": os.Getpid()},
 	}
 
@@ -30,5 +44,60 @@ func New(service string, outputPaths ...string) *zap.SugaredLogger {
 		config.OutputPaths = outputPaths
 	}
 
-	return zap.Must(config.Build()).Sugar()
+	return zap.Must(config.Build(samplingOptions(sampleEvery)...)).Sugar()
+}
+
+// NewFile is NewAtomic writing to file, which rotates itself, instead of
+// output paths. The logger does not own file; close it once the logger is
+// no longer used.
+func NewFile(service string, level zap.AtomicLevel, sampleEvery int, file *File) *zap.SugaredLogger {
+	core := zapcore.NewCore(zapcore.NewJSONEncoder(encoderConfig()), file, level)
+
+	// The options NewAtomic's production config builds with.
+	opts := append(
+		samplingOptions(sampleEvery),
+		zap.ErrorOutput(zapcore.Lock(os.Stderr)),
+		zap.AddCaller(),
+		zap.AddStacktrace(zapcore.ErrorLevel),
+		zap.Fields(zap.String("service", service), zap.Int("pid", os.Getpid())),
+	)
+	return zap.New(core, opts...).Sugar()
+}
+
+func encoderConfig() zapcore.EncoderConfig {
+	encoderCfg := zap.NewProductionEncoderConfig()
+	encoderCfg.TimeKey = "timestamp"
+	encoderCfg.EncodeTime = zapcore.ISO8601TimeEncoder
+	return encoderCfg
+}
+
+func samplingOptions(sampleEvery int) []zap.Option {
+	if sampleEvery <= 1 {
+		return nil
+	}
+
+	return []zap.Option{zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+		return &samplingCore{
+			Core:    core,
+			sampled: zapcore.NewSamplerWithOptions(core, time.Second, 1, sampleEvery),
+		}
+	})}
+}
+
+// samplingCore routes entries below error level through a sampler while
+// letting errors through untouched.
+type samplingCore struct {
+	zapcore.Core
+	sampled zapcore.Core
+}
+
+func (c *samplingCore) With(fields []zapcore.Field) zapcore.Core {
+	return &samplingCore{Core: c.Core.With(fields), sampled: c.sampled.With(fields)}
+}
+
+func (c *samplingCore) Check(entry zapcore.Entry, checked *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if entry.Level >= zapcore.ErrorLevel {
+		return c.Core.Check(entry, checked)
+	}
+	return c.sampled.Check(entry, checked)
 }
@@ -0,0 +1,36 @@
+package options
+
+import "fmt"
+
+// BackpressurePolicy decides what happens to a write that arrives while the
+// instance is over MaxWriteRate or MaxInflightWrites.
+type BackpressurePolicy uint8
+
+const (
+	// BackpressureBlock holds the write until it can proceed or its context
+	// is done.
+	BackpressureBlock BackpressurePolicy = iota
+	// BackpressureReject fails the write at once with ErrWriteThrottled.
+	BackpressureReject
+)
+
+func (p BackpressurePolicy) String() string {
+	switch p {
+	case BackpressureBlock:
+		return "block"
+	case BackpressureReject:
+		return "reject"
+	}
+	return fmt.Sprintf("policy(%d)", uint8(p))
+}
+
+// ParseBackpressurePolicy accepts the names printed by
+// BackpressurePolicy.String.
+func ParseBackpressurePolicy(name string) (BackpressurePolicy, error) {
+	for _, policy := range []BackpressurePolicy{BackpressureBlock, BackpressureReject} {
+		if policy.String() == name {
+			return policy, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown backpressure policy %q, expected block or reject", name)
+}
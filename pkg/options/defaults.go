@@ -1,6 +1,13 @@
 package options
 
-import "time"
+import (
+	"time"
+
+	"go.uber.org/zap/zapcore"
+
+	"github.com/iamBelugaa/kvix/pkg/checksum"
+	"github.com/iamBelugaa/kvix/pkg/filesys"
+)
 
 const (
 	DefaultDataDir string = "/var/lib/kvix"
@@ -8,6 +15,19 @@ const (
 	DefaultCompactInterval = time.Hour * 5
 	MaxCompactInterval     = 168 * time.Hour
 
+	DefaultCompactionThreshold = 0.6
+
+	DefaultExpirationInterval = time.Minute
+	DefaultSegmentGCInterval  = time.Minute
+	DefaultStatsFlushInterval = time.Minute
+	DefaultSyncInterval       = time.Second
+	DefaultWriteFlushInterval = 10 * time.Millisecond
+
+	DefaultRefreshLoaderTimeout = 30 * time.Second
+
+	DefaultArchiveMinIdle  = 24 * time.Hour
+	DefaultArchiveInterval = 10 * time.Minute
+
 	MinSegmentSize     uint64 = 512 * 1024 * 1024
 	MaxSegmentSize     uint64 = 4 * 1024 * 1024 * 1024
 	DefaultSegmentSize uint64 = 1 * 1024 * 1024 * 1024
@@ -15,17 +35,70 @@ const (
 	DefaultSegmentPrefix    string = "segment"
 	DefaultSegmentDirectory string = DefaultDataDir + "/segments"
 
+	MaxPartitions int = 64
+
+	MinChangeFeedRetention int64 = 1024 * 1024
+
+	MaxWriteBufferSize int = 64 * 1024 * 1024
+
+	DefaultReadAheadSize int = 1024 * 1024
+	MaxReadAheadSize     int = 64 * 1024 * 1024
+
+	DefaultLogFileSize int64 = 100 * 1024 * 1024
+
+	DefaultKeyIndexInterval int = 64
+	MaxKeyIndexInterval     int = 4096
+
+	DefaultIndexLogSize int64 = 64 * 1024 * 1024
+
 	MaxKeySize   uint16 = 65535
 	MaxValueSize uint32 = 100 * 1024 * 1024
+	// MaxChunkedValueSize is the largest value accepted at all. Values above
+	// MaxValueSize are split over several records, each within it, whose
+	// sizes together must still fit a uint32.
+	MaxChunkedValueSize int64 = 3840 * 1024 * 1024
+
+	// Record metadata is meant to be small: a content type and a handful of
+	// tags, stored with every version of the value.
+	MaxContentTypeSize int = 255
+	MaxMetadataTags    int = 64
+	MaxMetadataSize    int = 64 * 1024
+
+	MinSchemaVersion uint8 = 1
+	// ChecksumSchemaVersion headers are followed by a byte naming the checksum
+	// algorithm. Version 1 headers are always CRC32-IEEE.
+	ChecksumSchemaVersion uint8 = 2
+	// FlagsSchemaVersion headers add a flags byte after the algorithm byte.
+	FlagsSchemaVersion uint8 = 3
+	// MagicSchemaVersion headers always carry the algorithm and flags bytes,
+	// and end with a magic marker and a CRC32 of the header itself.
+	MagicSchemaVersion   uint8 = 4
+	CurrentSchemaVersion uint8 = MagicSchemaVersion
+	// CompactSchemaVersion records are only found in segments created with
+	// FramingCompact, and are laid out differently from the first byte on.
+	CompactSchemaVersion uint8 = 5
+	MaxSchemaVersion     uint8 = 5
 
-	MinSchemaVersion     uint8 = 1
-	CurrentSchemaVersion uint8 = 1
-	MaxSchemaVersion     uint8 = 255
+	DefaultChecksumAlgorithm = checksum.AlgorithmCRC32IEEE
 )
 
 var defaultOptions = Options{
-	DataDir:         DefaultDataDir,
-	CompactInterval: DefaultCompactInterval,
+	DataDir:              DefaultDataDir,
+	CompactInterval:      DefaultCompactInterval,
+	CompactionThreshold:  DefaultCompactionThreshold,
+	ExpirationInterval:   DefaultExpirationInterval,
+	SegmentGCInterval:    DefaultSegmentGCInterval,
+	StatsFlushInterval:   DefaultStatsFlushInterval,
+	RefreshLoaderTimeout: DefaultRefreshLoaderTimeout,
+	Partitions:           1,
+	ChecksumAlgorithm:    DefaultChecksumAlgorithm,
+	SyncInterval:         DefaultSyncInterval,
+	WriteFlushInterval:   DefaultWriteFlushInterval,
+	ReadAheadSize:        DefaultReadAheadSize,
+	KeyIndexInterval:     DefaultKeyIndexInterval,
+	IndexLogSize:         DefaultIndexLogSize,
+	LogLevel:             zapcore.InfoLevel,
+	FileSystem:           filesys.OS,
 	SegmentOptions: &SegmentOptions{
 		Size:      DefaultSegmentSize,
 		Prefix:    DefaultSegmentPrefix,
@@ -33,6 +106,12 @@ var defaultOptions = Options{
 	},
 }
 
+// DefaultOptions returns a copy of the defaults that shares nothing with
+// copies returned earlier, so option funcs of one instance cannot leak into
+// another.
 func DefaultOptions() Options {
-	return defaultOptions
+	opts := defaultOptions
+	segmentOptions := *defaultOptions.SegmentOptions
+	opts.SegmentOptions = &segmentOptions
+	return opts
 }
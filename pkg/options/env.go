@@ -0,0 +1,236 @@
+package options
+
+import (
+	stdErrors "errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+
+	"github.com/iamBelugaa/kvix/pkg/checksum"
+	"github.com/iamBelugaa/kvix/pkg/encryption"
+	"github.com/iamBelugaa/kvix/pkg/errors"
+)
+
+// FromEnv reads the environment variables below and returns an option func
+// applying the ones that are set, so it can be passed to NewInstance after
+// any options it should override and before those that should win over it.
+// Unset or empty variables leave their option alone. Durations use
+// time.ParseDuration syntax and sizes are in bytes. The error joins one
+// *errors.ValidationError per malformed variable, with a "variable" detail
+// naming it.
+//
+//	KVIX_DATA_DIR                WithDataDir
+//	KVIX_SEGMENT_DIR             WithSegmentDir
+//	KVIX_SEGMENT_PREFIX          WithSegmentPrefix
+//	KVIX_SEGMENT_SIZE            WithSegmentSize
+//	KVIX_PARTITIONS              WithPartitions
+//	KVIX_COMPACT_INTERVAL        WithCompactInterval
+//	KVIX_COMPACTION_THRESHOLD    WithCompactionThreshold
+//	KVIX_COMPACTION_RATE         WithCompactionRate (bytes per second)
+//	KVIX_COMPACTION_RECORD_RATE  WithCompactionRecordRate
+//	KVIX_EXPIRATION_INTERVAL     WithExpirationInterval
+//	KVIX_SEGMENT_GC_INTERVAL     WithSegmentGCInterval
+//	KVIX_SLIDING_TTL             WithSlidingTTL
+//	KVIX_STALE_GRACE_PERIOD      WithStaleGracePeriod
+//	KVIX_REFRESH_AHEAD           WithRefreshAhead
+//	KVIX_REFRESH_LOADER_TIMEOUT  WithRefreshLoaderTimeout
+//	KVIX_STATS_FLUSH_INTERVAL    WithStatsFlushInterval
+//	KVIX_SYNC_POLICY             WithSyncPolicy: none, always or interval
+//	KVIX_SYNC_INTERVAL           WithSyncInterval
+//	KVIX_WRITE_BUFFER_SIZE       WithWriteBuffer (bytes)
+//	KVIX_WRITE_FLUSH_INTERVAL    WithWriteFlushInterval
+//	KVIX_READ_AHEAD_SIZE         WithReadAhead (bytes)
+//	KVIX_OPERATION_TIMEOUT       WithOperationTimeout
+//	KVIX_SLOW_OP_THRESHOLD       WithSlowOpThreshold
+//	KVIX_MAX_WRITE_RATE          WithMaxWriteRate (bytes per second)
+//	KVIX_READ_VERIFICATION       WithReadVerification: full, checksum or none
+//	KVIX_MAX_INFLIGHT_WRITES     WithMaxInflightWrites
+//	KVIX_WRITE_BACKPRESSURE      WithWriteBackpressure: block or reject
+//	KVIX_LOG_LEVEL               WithLogLevel: debug, info, warn, error, ...
+//	KVIX_LOG_SAMPLING            WithLogSampling
+//	KVIX_LOG_FILE                WithLogFile (the path, rotated at 100MB)
+//	KVIX_ERROR_STACK_TRACES      WithErrorStackTraces: true or false
+//	KVIX_EXPVAR                  WithExpvar
+//	KVIX_CHECKSUM                WithChecksum: crc32-ieee, crc32c or xxhash64
+//	KVIX_RECORD_FRAMING          WithRecordFraming: standard or compact
+//	KVIX_COMPRESSION_THRESHOLD   WithCompression
+//	KVIX_MAX_RESIDENT_KEYS       WithMaxResidentKeys
+//	KVIX_INDEX_LAYOUT            WithIndexLayout: hashed or ordered
+//	KVIX_KEY_INDEX_INTERVAL      WithKeyIndexInterval
+//	KVIX_INDEX_LOG_SIZE          WithIndexLogSize (bytes)
+//	KVIX_MMAP_SEALED_SEGMENTS    WithMmapSealedSegments: true or false
+//	KVIX_DIRECT_IO               WithDirectIO: true or false
+//	KVIX_MAX_OPEN_SEGMENTS       WithMaxOpenSegments
+//	KVIX_DEDUPLICATION           WithDeduplication: true or false
+//	KVIX_ENCRYPTION_KEYS         WithEncryption, keys as for encryption.EnvKeys
+//	KVIX_CHANGE_FEED_RETENTION   WithChangeFeed (bytes)
+//	KVIX_REPLICA_OF              WithReplicaOf
+//	KVIX_MANIFEST_INTERVAL       WithManifest
+//	KVIX_FOLLOW_INTERVAL         WithFollower
+//	KVIX_MAX_KEYS                WithMaxKeys
+//	KVIX_MAX_LIVE_BYTES          WithMaxLiveBytes
+//	KVIX_EVICTION_POLICY         WithEvictionPolicy: lru or lfu
+//	KVIX_VERSION_HISTORY         WithVersionHistory
+//	KVIX_SECONDARY_INDEXES       WithSecondaryIndex: comma separated paths
+//	KVIX_TAG_INDEX               WithTagIndex: true or false
+func FromEnv() (OptionFunc, error) {
+	env := &envReader{}
+
+	readEnv(env, "KVIX_DATA_DIR", "a directory path", parseString, WithDataDir)
+	readEnv(env, "KVIX_SEGMENT_DIR", "a directory path", parseString, WithSegmentDir)
+	readEnv(env, "KVIX_SEGMENT_PREFIX", "a file name prefix", parseString, WithSegmentPrefix)
+	readEnv(env, "KVIX_SEGMENT_SIZE", "a size in bytes", parseUint, WithSegmentSize)
+	readEnv(env, "KVIX_PARTITIONS", "an integer", strconv.Atoi, WithPartitions)
+	readEnv(env, "KVIX_COMPACT_INTERVAL", "a duration", time.ParseDuration, WithCompactInterval)
+	readEnv(env, "KVIX_COMPACTION_THRESHOLD", "a ratio", parseFloat, WithCompactionThreshold)
+	readEnv(env, "KVIX_COMPACTION_RATE", "bytes per second", parseInt64, WithCompactionRate)
+	readEnv(env, "KVIX_COMPACTION_RECORD_RATE", "records per second", strconv.Atoi, WithCompactionRecordRate)
+	readEnv(env, "KVIX_EXPIRATION_INTERVAL", "a duration", time.ParseDuration, WithExpirationInterval)
+	readEnv(env, "KVIX_SEGMENT_GC_INTERVAL", "a duration", time.ParseDuration, WithSegmentGCInterval)
+	readEnv(env, "KVIX_SLIDING_TTL", "a duration", time.ParseDuration, WithSlidingTTL)
+	readEnv(env, "KVIX_STALE_GRACE_PERIOD", "a duration", time.ParseDuration, WithStaleGracePeriod)
+	readEnv(env, "KVIX_REFRESH_AHEAD", "a duration", time.ParseDuration, WithRefreshAhead)
+	readEnv(env, "KVIX_REFRESH_LOADER_TIMEOUT", "a duration", time.ParseDuration, WithRefreshLoaderTimeout)
+	readEnv(env, "KVIX_STATS_FLUSH_INTERVAL", "a duration", time.ParseDuration, WithStatsFlushInterval)
+	readEnv(env, "KVIX_SYNC_POLICY", "none, always or interval", ParseSyncPolicy, WithSyncPolicy)
+	readEnv(env, "KVIX_SYNC_INTERVAL", "a duration", time.ParseDuration, WithSyncInterval)
+	readEnv(env, "KVIX_WRITE_BUFFER_SIZE", "a size in bytes", strconv.Atoi, WithWriteBuffer)
+	readEnv(env, "KVIX_WRITE_FLUSH_INTERVAL", "a duration", time.ParseDuration, WithWriteFlushInterval)
+	readEnv(env, "KVIX_READ_AHEAD_SIZE", "a size in bytes", strconv.Atoi, WithReadAhead)
+	readEnv(env, "KVIX_OPERATION_TIMEOUT", "a duration", time.ParseDuration, WithOperationTimeout)
+	readEnv(env, "KVIX_SLOW_OP_THRESHOLD", "a duration", time.ParseDuration, WithSlowOpThreshold)
+	readEnv(env, "KVIX_MAX_WRITE_RATE", "bytes per second", parseInt64, WithMaxWriteRate)
+	readEnv(env, "KVIX_READ_VERIFICATION", "full, checksum or none", ParseVerifyLevel, WithReadVerification)
+	readEnv(env, "KVIX_MAX_INFLIGHT_WRITES", "an integer", strconv.Atoi, WithMaxInflightWrites)
+	readEnv(env, "KVIX_WRITE_BACKPRESSURE", "block or reject", ParseBackpressurePolicy, WithWriteBackpressure)
+	readEnv(env, "KVIX_LOG_LEVEL", "debug, info, warn, error, dpanic, panic or fatal", zapcore.ParseLevel, WithLogLevel)
+	readEnv(env, "KVIX_LOG_SAMPLING", "an integer", strconv.Atoi, WithLogSampling)
+	readEnv(env, "KVIX_EXPVAR", "a variable name", parseString, WithExpvar)
+	readEnv(env, "KVIX_CHECKSUM", "crc32-ieee, crc32c or xxhash64", parseChecksum, WithChecksum)
+	readEnv(env, "KVIX_RECORD_FRAMING", "standard or compact", ParseRecordFraming, WithRecordFraming)
+	readEnv(env, "KVIX_COMPRESSION_THRESHOLD", "an integer", strconv.Atoi, WithCompression)
+	readEnv(env, "KVIX_MAX_RESIDENT_KEYS", "an integer", strconv.Atoi, WithMaxResidentKeys)
+	readEnv(env, "KVIX_INDEX_LAYOUT", "hashed or ordered", ParseIndexLayout, WithIndexLayout)
+	readEnv(env, "KVIX_KEY_INDEX_INTERVAL", "an integer", strconv.Atoi, WithKeyIndexInterval)
+	readEnv(env, "KVIX_INDEX_LOG_SIZE", "a size in bytes", parseInt64, WithIndexLogSize)
+	readEnv(env, "KVIX_MAX_OPEN_SEGMENTS", "an integer", strconv.Atoi, WithMaxOpenSegments)
+	readEnv(env, "KVIX_CHANGE_FEED_RETENTION", "a size in bytes", parseInt64, WithChangeFeed)
+	readEnv(env, "KVIX_REPLICA_OF", "a host:port address", parseString, WithReplicaOf)
+	readEnv(env, "KVIX_MANIFEST_INTERVAL", "a duration", time.ParseDuration, WithManifest)
+	readEnv(env, "KVIX_FOLLOW_INTERVAL", "a duration", time.ParseDuration, WithFollower)
+	readEnv(env, "KVIX_MAX_KEYS", "an integer", strconv.Atoi, WithMaxKeys)
+	readEnv(env, "KVIX_MAX_LIVE_BYTES", "a size in bytes", parseInt64, WithMaxLiveBytes)
+	readEnv(env, "KVIX_EVICTION_POLICY", "lru or lfu", ParseEvictionPolicy, WithEvictionPolicy)
+	readEnv(env, "KVIX_VERSION_HISTORY", "an integer", strconv.Atoi, WithVersionHistory)
+	readEnv(env, "KVIX_SECONDARY_INDEXES", "comma separated paths", parseList, func(paths []string) OptionFunc {
+		return WithSecondaryIndex(paths...)
+	})
+	readEnv(env, "KVIX_MMAP_SEALED_SEGMENTS", "true or false", strconv.ParseBool, func(enabled bool) OptionFunc {
+		return func(o *Options) { o.MmapSealedSegments = enabled }
+	})
+	readEnv(env, "KVIX_DIRECT_IO", "true or false", strconv.ParseBool, func(enabled bool) OptionFunc {
+		return func(o *Options) { o.DirectIO = enabled }
+	})
+	readEnv(env, "KVIX_DEDUPLICATION", "true or false", strconv.ParseBool, func(enabled bool) OptionFunc {
+		return func(o *Options) { o.Deduplicate = enabled }
+	})
+	readEnv(env, "KVIX_LOG_FILE", "a file path", parseString, func(path string) OptionFunc {
+		return func(o *Options) {
+			if o.LogFile == nil {
+				WithLogFile(LogFileOptions{Path: path})(o)
+				return
+			}
+			o.LogFile.Path = path
+		}
+	})
+	readEnv(env, "KVIX_ERROR_STACK_TRACES", "true or false", strconv.ParseBool, func(enabled bool) OptionFunc {
+		return func(o *Options) { o.ErrorStackTraces = enabled }
+	})
+	readEnv(env, "KVIX_TAG_INDEX", "true or false", strconv.ParseBool, func(enabled bool) OptionFunc {
+		return func(o *Options) { o.TagIndex = enabled }
+	})
+
+	if value := os.Getenv("KVIX_ENCRYPTION_KEYS"); value != "" {
+		provider, err := encryption.EnvKeys("KVIX_ENCRYPTION_KEYS")
+		if err != nil {
+			// The value is key material, so it is not repeated in the error.
+			env.invalid("KVIX_ENCRYPTION_KEYS", "(redacted)", "version:base64-key pairs", err)
+		} else {
+			env.opts = append(env.opts, WithEncryption(provider))
+		}
+	}
+
+	if len(env.problems) > 0 {
+		return nil, stdErrors.Join(env.problems...)
+	}
+
+	opts := env.opts
+	return func(o *Options) {
+		for _, opt := range opts {
+			opt(o)
+		}
+	}, nil
+}
+
+type envReader struct {
+	opts     []OptionFunc
+	problems []error
+}
+
+func (r *envReader) invalid(name, value, expected string, err error) {
+	r.problems = append(r.problems, errors.NewValidationError(
+		err, errors.ErrValidationInvalidData, fmt.Sprintf("Invalid value %q for %s", value, name),
+	).
+		WithDetail("variable", name).
+		WithProvided(value).
+		WithExpected(expected))
+}
+
+// readEnv parses the variable name, when set, and queues the option that with
+// builds from its value.
+func readEnv[T any](r *envReader, name, expected string, parse func(string) (T, error), with func(T) OptionFunc) {
+	value := os.Getenv(name)
+	if value == "" {
+		return
+	}
+
+	parsed, err := parse(value)
+	if err != nil {
+		r.invalid(name, value, expected, err)
+		return
+	}
+	r.opts = append(r.opts, with(parsed))
+}
+
+func parseString(value string) (string, error) {
+	return value, nil
+}
+
+func parseList(value string) ([]string, error) {
+	return strings.Split(value, ","), nil
+}
+
+func parseUint(value string) (uint64, error) {
+	return strconv.ParseUint(value, 10, 64)
+}
+
+func parseInt64(value string) (int64, error) {
+	return strconv.ParseInt(value, 10, 64)
+}
+
+func parseFloat(value string) (float64, error) {
+	return strconv.ParseFloat(value, 64)
+}
+
+func parseChecksum(value string) (checksum.Algorithm, error) {
+	for _, algorithm := range checksum.Supported() {
+		if algorithm.String() == value {
+			return algorithm, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown checksum algorithm %q", value)
+}
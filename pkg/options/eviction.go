@@ -0,0 +1,35 @@
+package options
+
+import "fmt"
+
+// EvictionPolicy decides which keys a bounded instance sheds first once it
+// holds more than MaxKeys keys or MaxLiveBytes bytes.
+type EvictionPolicy uint8
+
+const (
+	// EvictLRU sheds the keys read or written least recently.
+	EvictLRU EvictionPolicy = iota
+	// EvictLFU sheds the keys used least often, counting recent use more than
+	// old.
+	EvictLFU
+)
+
+func (p EvictionPolicy) String() string {
+	switch p {
+	case EvictLRU:
+		return "lru"
+	case EvictLFU:
+		return "lfu"
+	}
+	return fmt.Sprintf("policy(%d)", uint8(p))
+}
+
+// ParseEvictionPolicy accepts the names printed by EvictionPolicy.String.
+func ParseEvictionPolicy(name string) (EvictionPolicy, error) {
+	for _, policy := range []EvictionPolicy{EvictLRU, EvictLFU} {
+		if policy.String() == name {
+			return policy, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown eviction policy %q, expected lru or lfu", name)
+}
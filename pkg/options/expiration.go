@@ -0,0 +1,19 @@
+package options
+
+import "time"
+
+// RecordMeta describes the record an expired key pointed at.
+type RecordMeta struct {
+	ExpiresAt time.Time // When the key's TTL ran out
+	Size      uint32    // Bytes the record takes in its segment
+}
+
+// ExpirationHandler is called with every key removed because its TTL ran
+// out, whether by the expiration sweeper or by a read that found it expired.
+// Calls are made one at a time, in the order the keys were removed, on a
+// goroutine of their own, so a handler may call back into the instance, for
+// instance to delete keys derived from the expired one. At most 65536 keys
+// are queued for a handler that falls behind; keys expiring while the queue
+// is full are not reported, which is logged. Keys still queued when the
+// instance closes are dropped.
+type ExpirationHandler func(key []byte, meta RecordMeta)
@@ -0,0 +1,38 @@
+package options
+
+import "fmt"
+
+// RecordFraming decides how records are laid out in the segments an instance
+// creates. Each segment records its framing in its header, so segments of
+// either kind are read whatever the instance is set to.
+type RecordFraming uint8
+
+const (
+	// FramingStandard writes a fixed binary header and a protobuf payload.
+	FramingStandard RecordFraming = iota
+	// FramingCompact writes a header of varint fields and a payload of the
+	// key's varint length, the key and the value, saving around ten bytes
+	// per record and the protobuf encoding. Releases that predate it refuse
+	// compact segments.
+	FramingCompact
+)
+
+func (f RecordFraming) String() string {
+	switch f {
+	case FramingStandard:
+		return "standard"
+	case FramingCompact:
+		return "compact"
+	}
+	return fmt.Sprintf("framing(%d)", uint8(f))
+}
+
+// ParseRecordFraming accepts the names printed by RecordFraming.String.
+func ParseRecordFraming(name string) (RecordFraming, error) {
+	for _, framing := range []RecordFraming{FramingStandard, FramingCompact} {
+		if framing.String() == name {
+			return framing, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown record framing %q, expected standard or compact", name)
+}
@@ -0,0 +1,22 @@
+package options
+
+import "context"
+
+// Operation identifies a call passing through an Interceptor.
+type Operation struct {
+	Name string // The Instance method, such as "Get" or "Set"
+	Key  []byte // The key operated on; nil for calls on several keys or none
+}
+
+// Invoker runs the intercepted operation and returns its error. With
+// WithOperationTimeout, the caller stops waiting for it once ctx is done.
+type Invoker func(ctx context.Context) error
+
+// Interceptor wraps the operations of an instance, much like a gRPC
+// interceptor, for concerns such as authorization, tracing, rate limiting or
+// request logging. It is called with the operation once its arguments are
+// validated and must either call invoke, at most once and with ctx or a
+// context derived from it, or return an error to reject the call. The error
+// it returns is the one the caller sees. The operation's key must not be
+// modified or kept past the call.
+type Interceptor func(ctx context.Context, op Operation, invoke Invoker) error
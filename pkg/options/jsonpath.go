@@ -0,0 +1,23 @@
+package options
+
+import (
+	"fmt"
+	"strings"
+)
+
+// SplitJSONPath splits a secondary index path such as $.address.city into the
+// object members it descends through. Only dotted member access is supported.
+func SplitJSONPath(path string) ([]string, error) {
+	members, ok := strings.CutPrefix(path, "$.")
+	if !ok {
+		return nil, fmt.Errorf("path %q must start with $.", path)
+	}
+
+	segments := strings.Split(members, ".")
+	for _, segment := range segments {
+		if segment == "" {
+			return nil, fmt.Errorf("path %q has an empty member name", path)
+		}
+	}
+	return segments, nil
+}
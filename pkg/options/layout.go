@@ -0,0 +1,38 @@
+package options
+
+import "fmt"
+
+// IndexLayout decides how the in-memory index arranges its keys. It only
+// affects memory and the cost of ordered queries, so it can change between
+// restarts.
+type IndexLayout uint8
+
+const (
+	// IndexHashed spreads keys over hash-partitioned maps. Lookups and writes
+	// are fastest, but ordered queries collect and sort the keys they cover.
+	IndexHashed IndexLayout = iota
+	// IndexOrdered also keeps every key in a B-tree in lexicographic order,
+	// so range and prefix queries and the smallest and largest key walk only
+	// the keys they return. Each write takes the tree's lock as well.
+	IndexOrdered
+)
+
+func (l IndexLayout) String() string {
+	switch l {
+	case IndexHashed:
+		return "hashed"
+	case IndexOrdered:
+		return "ordered"
+	}
+	return fmt.Sprintf("layout(%d)", uint8(l))
+}
+
+// ParseIndexLayout accepts the names printed by IndexLayout.String.
+func ParseIndexLayout(name string) (IndexLayout, error) {
+	for _, layout := range []IndexLayout{IndexHashed, IndexOrdered} {
+		if layout.String() == name {
+			return layout, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown index layout %q, expected hashed or ordered", name)
+}
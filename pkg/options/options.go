@@ -1,8 +1,19 @@
 package options
 
 import (
+	"path/filepath"
+	"slices"
 	"strings"
 	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/iamBelugaa/kvix/pkg/archive"
+	"github.com/iamBelugaa/kvix/pkg/checksum"
+	"github.com/iamBelugaa/kvix/pkg/encryption"
+	"github.com/iamBelugaa/kvix/pkg/filesys"
+	"github.com/iamBelugaa/kvix/pkg/raft"
 )
 
 type SegmentOptions struct {
@@ -11,10 +22,97 @@ type SegmentOptions struct {
 	Prefix    string `json:"prefix"`         // Default: "segment"
 }
 
+// ClusterOptions describe the raft cluster an instance belongs to. Every
+// member must be configured with the same Peers.
+type ClusterOptions struct {
+	NodeID            string            `json:"nodeId"`
+	Peers             map[string]string `json:"peers"`             // Node ID to raft host:port, this node included
+	Transport         raft.Transport    `json:"-"`                 // Default: nil (TCP between the Peers addresses)
+	ElectionTimeout   time.Duration     `json:"electionTimeout"`   // Default: 1s
+	HeartbeatInterval time.Duration     `json:"heartbeatInterval"` // Default: 100ms
+}
+
+// ArchiveOptions move sealed segments that have gone unread to object
+// storage, freeing their local disk space.
+type ArchiveOptions struct {
+	Uploader   archive.Uploader   `json:"-"`
+	Downloader archive.Downloader `json:"-"`        // Default: Uploader, if it is a Downloader - nil fails reads of archived segments
+	Prefix     string             `json:"prefix"`   // Default: "" - Prepended to object names
+	MinIdle    time.Duration      `json:"minIdle"`  // Default: 24h - How long a segment goes unread before it is archived
+	Interval   time.Duration      `json:"interval"` // Default: 10m
+}
+
+// LogFileOptions send an instance's logs to a file that is rotated as it
+// grows or ages, instead of to stderr.
+type LogFileOptions struct {
+	Path       string        `json:"path"`
+	MaxSize    int64         `json:"maxSize"`    // Default: 100MB
+	MaxAge     time.Duration `json:"maxAge"`     // Default: 0 (not rotated by age)
+	MaxBackups int           `json:"maxBackups"` // Default: 0 (every rotated file kept)
+	Compress   bool          `json:"compress"`   // Default: false
+}
+
 type Options struct {
-	SegmentOptions  *SegmentOptions `json:"segmentOptions"`
-	DataDir         string          `json:"dataDir"`         // Default: "/var/lib/kvix"
-	CompactInterval time.Duration   `json:"compactInterval"` // Default: 5h
+	SegmentOptions       *SegmentOptions        `json:"segmentOptions"`
+	DataDir              string                 `json:"dataDir"`              // Default: "/var/lib/kvix"
+	EphemeralDataDir     bool                   `json:"ephemeralDataDir"`     // Default: false
+	CompactInterval      time.Duration          `json:"compactInterval"`      // Default: 5h
+	CompactionThreshold  float64                `json:"compactionThreshold"`  // Default: 0.6
+	CompactionRate       int64                  `json:"compactionRate"`       // Default: 0 (unlimited) - Bytes per second
+	CompactionRecordRate int                    `json:"compactionRecordRate"` // Default: 0 (unlimited) - Records per second
+	SlidingTTL           time.Duration          `json:"slidingTTL"`           // Default: 0 (disabled)
+	Deduplicate          bool                   `json:"deduplicate"`          // Default: false
+	ExpirationInterval   time.Duration          `json:"expirationInterval"`   // Default: 1m - Negative disables the sweeper
+	StaleGracePeriod     time.Duration          `json:"staleGracePeriod"`     // Default: 0 (expired keys are never served)
+	ExpirationHandler    ExpirationHandler      `json:"-"`                    // Default: nil (expirations not reported)
+	RefreshAhead         time.Duration          `json:"refreshAhead"`         // Default: 0 (disabled)
+	RefreshLoaderTimeout time.Duration          `json:"refreshLoaderTimeout"` // Default: 30s - Per loader call
+	LogSampling          int                    `json:"logSampling"`          // Default: 0 (log every entry)
+	ExpvarPrefix         string                 `json:"expvarPrefix"`         // Default: "" (not published)
+	StatsFlushInterval   time.Duration          `json:"statsFlushInterval"`   // Default: 1m - Negative only persists on close
+	MmapSealedSegments   bool                   `json:"mmapSealedSegments"`   // Default: false
+	DirectIO             bool                   `json:"directIO"`             // Default: false - Buffered where unsupported
+	MaxOpenSegments      int                    `json:"maxOpenSegments"`      // Default: 0 (unlimited) - Ignored under a Manager
+	MaxResidentKeys      int                    `json:"maxResidentKeys"`      // Default: 0 (whole keydir in memory)
+	IndexLayout          IndexLayout            `json:"indexLayout"`          // Default: hashed
+	KeyIndexInterval     int                    `json:"keyIndexInterval"`     // Default: 64 - Maximum: 4096 - Negative disables the key index
+	IndexLogSize         int64                  `json:"indexLogSize"`         // Default: 64MB - Negative disables the index log - Ignored by followers
+	Partitions           int                    `json:"partitions"`           // Default: 1 - Maximum: 64
+	ChecksumAlgorithm    checksum.Algorithm     `json:"checksumAlgorithm"`    // Default: CRC32-IEEE
+	RecordFraming        RecordFraming          `json:"recordFraming"`        // Default: standard
+	CompressionThreshold int                    `json:"compressionThreshold"` // Default: 0 (disabled)
+	KeyProvider          encryption.KeyProvider `json:"-"`                    // Default: nil (values stored in plaintext)
+	SyncPolicy           SyncPolicy             `json:"syncPolicy"`           // Default: none
+	SyncInterval         time.Duration          `json:"syncInterval"`         // Default: 1s - Only used by SyncInterval
+	WriteBufferSize      int                    `json:"writeBufferSize"`      // Default: 0 (every write goes to the file) - Maximum: 64MB
+	WriteFlushInterval   time.Duration          `json:"writeFlushInterval"`   // Default: 10ms - Only used with a write buffer
+	ReadAheadSize        int                    `json:"readAheadSize"`        // Default: 1MB - Maximum: 64MB - Negative disables read-ahead
+	OperationTimeout     time.Duration          `json:"operationTimeout"`     // Default: 0 (no timeout)
+	SlowOpThreshold      time.Duration          `json:"slowOpThreshold"`      // Default: 0 (slow operations not logged)
+	Interceptors         []Interceptor          `json:"-"`                    // Default: nil (operations run directly)
+	MaxWriteRate         int64                  `json:"maxWriteRate"`         // Default: 0 (unlimited) - Bytes per second
+	MaxInflightWrites    int                    `json:"maxInflightWrites"`    // Default: 0 (unlimited)
+	WriteBackpressure    BackpressurePolicy     `json:"writeBackpressure"`    // Default: block - Only used when throttled
+	LogLevel             zapcore.Level          `json:"logLevel"`             // Default: info
+	ErrorStackTraces     bool                   `json:"errorStackTraces"`     // Default: false - Process-wide until closed
+	Logger               *zap.SugaredLogger     `json:"-"`                    // Default: nil (a JSON logger on stderr)
+	LogFile              *LogFileOptions        `json:"logFile"`              // Default: nil (logs go to stderr) - Ignored with a Logger or under a Manager
+	StartupProgress      StartupProgressFunc    `json:"-"`                    // Default: nil (not reported)
+	ChangeFeedRetention  int64                  `json:"changeFeedRetention"`  // Default: 0 (disabled) - Minimum: 1MB
+	ReplicaOf            string                 `json:"replicaOf"`            // Default: "" (not a replica)
+	Cluster              *ClusterOptions        `json:"cluster"`              // Default: nil (standalone)
+	ManifestInterval     time.Duration          `json:"manifestInterval"`     // Default: 0 (no manifest published)
+	FollowInterval       time.Duration          `json:"followInterval"`       // Default: 0 (not a follower)
+	MaxKeys              int                    `json:"maxKeys"`              // Default: 0 (unbounded)
+	MaxLiveBytes         int64                  `json:"maxLiveBytes"`         // Default: 0 (unbounded)
+	EvictionPolicy       EvictionPolicy         `json:"evictionPolicy"`       // Default: lru - Only used when bounded
+	VersionHistory       int                    `json:"versionHistory"`       // Default: 0 (no versions retained)
+	SecondaryIndexes     []string               `json:"secondaryIndexes"`     // Default: nil (no secondary indexes)
+	TagIndex             bool                   `json:"tagIndex"`             // Default: false
+	SegmentGCInterval    time.Duration          `json:"segmentGCInterval"`    // Default: 1m - Negative disables segment GC
+	Archive              *ArchiveOptions        `json:"archive"`              // Default: nil (segments stay local)
+	FileSystem           filesys.FileSystem     `json:"-"`                    // Default: filesys.OS
+	ReadVerification     VerifyLevel            `json:"readVerification"`     // Default: full
 }
 
 type OptionFunc func(*Options)
@@ -23,28 +121,134 @@ func WithDefaultOptions() OptionFunc {
 	return func(o *Options) {
 		opts := DefaultOptions()
 		o.DataDir = opts.DataDir
+		o.EphemeralDataDir = opts.EphemeralDataDir
 		o.SegmentOptions = opts.SegmentOptions
 		o.CompactInterval = opts.CompactInterval
+		o.CompactionThreshold = opts.CompactionThreshold
+		o.CompactionRate = opts.CompactionRate
+		o.CompactionRecordRate = opts.CompactionRecordRate
+		o.SlidingTTL = opts.SlidingTTL
+		o.Deduplicate = opts.Deduplicate
+		o.ExpirationInterval = opts.ExpirationInterval
+		o.StaleGracePeriod = opts.StaleGracePeriod
+		o.ExpirationHandler = opts.ExpirationHandler
+		o.RefreshAhead = opts.RefreshAhead
+		o.RefreshLoaderTimeout = opts.RefreshLoaderTimeout
+		o.LogSampling = opts.LogSampling
+		o.ExpvarPrefix = opts.ExpvarPrefix
+		o.StatsFlushInterval = opts.StatsFlushInterval
+		o.MmapSealedSegments = opts.MmapSealedSegments
+		o.DirectIO = opts.DirectIO
+		o.MaxOpenSegments = opts.MaxOpenSegments
+		o.MaxResidentKeys = opts.MaxResidentKeys
+		o.IndexLayout = opts.IndexLayout
+		o.KeyIndexInterval = opts.KeyIndexInterval
+		o.IndexLogSize = opts.IndexLogSize
+		o.Partitions = opts.Partitions
+		o.ChecksumAlgorithm = opts.ChecksumAlgorithm
+		o.RecordFraming = opts.RecordFraming
+		o.CompressionThreshold = opts.CompressionThreshold
+		o.KeyProvider = opts.KeyProvider
+		o.SyncPolicy = opts.SyncPolicy
+		o.SyncInterval = opts.SyncInterval
+		o.WriteBufferSize = opts.WriteBufferSize
+		o.WriteFlushInterval = opts.WriteFlushInterval
+		o.ReadAheadSize = opts.ReadAheadSize
+		o.OperationTimeout = opts.OperationTimeout
+		o.SlowOpThreshold = opts.SlowOpThreshold
+		o.Interceptors = opts.Interceptors
+		o.MaxWriteRate = opts.MaxWriteRate
+		o.MaxInflightWrites = opts.MaxInflightWrites
+		o.WriteBackpressure = opts.WriteBackpressure
+		o.LogLevel = opts.LogLevel
+		o.ErrorStackTraces = opts.ErrorStackTraces
+		o.Logger = opts.Logger
+		o.LogFile = opts.LogFile
+		o.StartupProgress = opts.StartupProgress
+		o.ChangeFeedRetention = opts.ChangeFeedRetention
+		o.ReplicaOf = opts.ReplicaOf
+		o.Cluster = opts.Cluster
+		o.ManifestInterval = opts.ManifestInterval
+		o.FollowInterval = opts.FollowInterval
+		o.MaxKeys = opts.MaxKeys
+		o.MaxLiveBytes = opts.MaxLiveBytes
+		o.EvictionPolicy = opts.EvictionPolicy
+		o.VersionHistory = opts.VersionHistory
+		o.SecondaryIndexes = opts.SecondaryIndexes
+		o.TagIndex = opts.TagIndex
+		o.SegmentGCInterval = opts.SegmentGCInterval
+		o.Archive = opts.Archive
+		o.FileSystem = opts.FileSystem
+		o.ReadVerification = opts.ReadVerification
 	}
 }
 
+// WithDataDir sets the data directory. A segment directory still at its
+// default moves along to {directory}/segments.
 func WithDataDir(directory string) OptionFunc {
 	return func(o *Options) {
 		directory = strings.TrimSpace(directory)
-		if directory != "" {
-			o.DataDir = directory
+		if directory == "" {
+			return
 		}
+
+		if o.SegmentOptions != nil && o.SegmentOptions.Directory == filepath.Join(o.DataDir, "segments") {
+			o.SegmentOptions.Directory = filepath.Join(directory, "segments")
+		}
+		o.DataDir = directory
+	}
+}
+
+// WithEphemeralDataDir opens the instance in a new temporary directory,
+// replacing the data and segment directories, and removes the directory when
+// the instance is closed. It is meant for tests.
+func WithEphemeralDataDir() OptionFunc {
+	return func(o *Options) {
+		o.EphemeralDataDir = true
 	}
 }
 
 func WithCompactInterval(interval time.Duration) OptionFunc {
 	return func(o *Options) {
-		if interval > DefaultCompactInterval {
+		if interval != 0 {
 			o.CompactInterval = interval
 		}
 	}
 }
 
+// WithCompactionThreshold sets the share of a sealed segment's bytes that must
+// be garbage, overwritten, deleted or expired, before compaction rewrites its
+// live records. Segments below it are left alone.
+func WithCompactionThreshold(ratio float64) OptionFunc {
+	return func(o *Options) {
+		if ratio != 0 {
+			o.CompactionThreshold = ratio
+		}
+	}
+}
+
+// WithCompactionRate limits compaction to bytesPerSecond bytes of records read
+// and written per second, averaged over a second, so reclaiming space leaves
+// the disk to foreground traffic.
+func WithCompactionRate(bytesPerSecond int64) OptionFunc {
+	return func(o *Options) {
+		if bytesPerSecond != 0 {
+			o.CompactionRate = bytesPerSecond
+		}
+	}
+}
+
+// WithCompactionRecordRate limits compaction to recordsPerSecond records
+// moved per second, which bounds the partition lock hand-offs it makes when
+// records are small.
+func WithCompactionRecordRate(recordsPerSecond int) OptionFunc {
+	return func(o *Options) {
+		if recordsPerSecond != 0 {
+			o.CompactionRecordRate = recordsPerSecond
+		}
+	}
+}
+
 func WithSegmentDir(directory string) OptionFunc {
 	return func(o *Options) {
 		directory = strings.TrimSpace(directory)
@@ -65,8 +269,545 @@ func WithSegmentPrefix(prefix string) OptionFunc {
 
 func WithSegmentSize(size uint64) OptionFunc {
 	return func(o *Options) {
-		if size > MinSegmentSize && size < MaxSegmentSize {
+		if size != 0 {
 			o.SegmentOptions.Size = size
 		}
 	}
 }
+
+func WithSlidingTTL(ttl time.Duration) OptionFunc {
+	return func(o *Options) {
+		if ttl > 0 {
+			o.SlidingTTL = ttl
+		}
+	}
+}
+
+func WithDeduplication() OptionFunc {
+	return func(o *Options) {
+		o.Deduplicate = true
+	}
+}
+
+func WithExpirationInterval(interval time.Duration) OptionFunc {
+	return func(o *Options) {
+		if interval != 0 {
+			o.ExpirationInterval = interval
+		}
+	}
+}
+
+// WithSegmentGCInterval sets how often sealed segments holding no live
+// records are looked for and deleted. A negative interval turns this off,
+// and scheduled compaction with it, as nothing would delete what it empties.
+func WithSegmentGCInterval(interval time.Duration) OptionFunc {
+	return func(o *Options) {
+		if interval != 0 {
+			o.SegmentGCInterval = interval
+		}
+	}
+}
+
+func WithStaleGracePeriod(grace time.Duration) OptionFunc {
+	return func(o *Options) {
+		if grace > 0 {
+			o.StaleGracePeriod = grace
+		}
+	}
+}
+
+// WithExpirationHandler calls handler with every key removed because its TTL
+// ran out. See ExpirationHandler.
+func WithExpirationHandler(handler ExpirationHandler) OptionFunc {
+	return func(o *Options) {
+		if handler != nil {
+			o.ExpirationHandler = handler
+		}
+	}
+}
+
+func WithRefreshAhead(window time.Duration) OptionFunc {
+	return func(o *Options) {
+		if window > 0 {
+			o.RefreshAhead = window
+		}
+	}
+}
+
+// WithRefreshLoaderTimeout bounds each loader call of the refresh-ahead
+// worker. A loader still running after timeout has its context cancelled and
+// the key is left to expire.
+func WithRefreshLoaderTimeout(timeout time.Duration) OptionFunc {
+	return func(o *Options) {
+		if timeout > 0 {
+			o.RefreshLoaderTimeout = timeout
+		}
+	}
+}
+
+func WithLogSampling(every int) OptionFunc {
+	return func(o *Options) {
+		if every > 1 {
+			o.LogSampling = every
+		}
+	}
+}
+
+func WithExpvar(prefix string) OptionFunc {
+	return func(o *Options) {
+		prefix = strings.TrimSpace(prefix)
+		if prefix != "" {
+			o.ExpvarPrefix = prefix
+		}
+	}
+}
+
+func WithStatsFlushInterval(interval time.Duration) OptionFunc {
+	return func(o *Options) {
+		if interval != 0 {
+			o.StatsFlushInterval = interval
+		}
+	}
+}
+
+func WithMmapSealedSegments() OptionFunc {
+	return func(o *Options) {
+		o.MmapSealedSegments = true
+	}
+}
+
+// WithDirectIO reads and writes segments bypassing the page cache: O_DIRECT
+// on Linux, F_NOCACHE on macOS. Segments on platforms or file systems without
+// direct I/O are read and written through the page cache as usual.
+func WithDirectIO() OptionFunc {
+	return func(o *Options) {
+		o.DirectIO = true
+	}
+}
+
+// WithFileSystem stores segments and the files of the data directory, such
+// as the index log, hints, change feed and manifest, on fsys instead of the
+// operating system's file system, such as filesys.NewMemFS() for hermetic
+// tests. A follower shares the primary's fsys. Cluster members keep their
+// raft log with the operating system and cannot be combined with another
+// file system.
+func WithFileSystem(fsys filesys.FileSystem) OptionFunc {
+	return func(o *Options) {
+		if fsys != nil {
+			o.FileSystem = fsys
+		}
+	}
+}
+
+// WithMaxOpenSegments caps the sealed segment files the instance keeps open
+// for reads, across all its partitions. When the cap is reached, the least
+// recently read idle handle is closed to make room. Instances opened by a
+// Manager share its cap instead.
+func WithMaxOpenSegments(limit int) OptionFunc {
+	return func(o *Options) {
+		if limit != 0 {
+			o.MaxOpenSegments = limit
+		}
+	}
+}
+
+// WithKeyIndexInterval sets how many keys each group of a sealed segment's
+// key table holds. The segment footer keeps the first key of every group,
+// so a larger interval makes footers smaller and lookups read more. A
+// negative interval seals segments without a key table.
+func WithKeyIndexInterval(interval int) OptionFunc {
+	return func(o *Options) {
+		if interval != 0 {
+			o.KeyIndexInterval = interval
+		}
+	}
+}
+
+// WithIndexLogSize sets how large the index log may grow before it is folded
+// into the index hint. Every change to the keydir is appended to the log and
+// fsynced as the sync policy says, so after a crash the keydir is recovered
+// by replaying the log over the hint. A negative size disables the log; the
+// keydir then only survives a clean Close.
+func WithIndexLogSize(size int64) OptionFunc {
+	return func(o *Options) {
+		if size != 0 {
+			o.IndexLogSize = size
+		}
+	}
+}
+
+func WithMaxResidentKeys(limit int) OptionFunc {
+	return func(o *Options) {
+		if limit > 0 {
+			o.MaxResidentKeys = limit
+		}
+	}
+}
+
+// WithIndexLayout selects how the in-memory index arranges its keys.
+// IndexOrdered keeps them sorted as well, for range and prefix queries that
+// do not scan the whole keydir.
+func WithIndexLayout(layout IndexLayout) OptionFunc {
+	return func(o *Options) {
+		o.IndexLayout = layout
+	}
+}
+
+func WithPartitions(count int) OptionFunc {
+	return func(o *Options) {
+		if count != 0 {
+			o.Partitions = count
+		}
+	}
+}
+
+// WithChecksum selects the checksum written with new records. Records already
+// on disk keep the algorithm they were written with and stay readable.
+func WithChecksum(algorithm checksum.Algorithm) OptionFunc {
+	return func(o *Options) {
+		if algorithm != 0 {
+			o.ChecksumAlgorithm = algorithm
+		}
+	}
+}
+
+// WithRecordFraming selects how records are laid out in new segments. The
+// active segment keeps the framing it was created with until it rotates.
+func WithRecordFraming(framing RecordFraming) OptionFunc {
+	return func(o *Options) {
+		o.RecordFraming = framing
+	}
+}
+
+// WithCompression compresses values of at least threshold bytes with DEFLATE.
+// A value is stored uncompressed whenever compressing it does not save space.
+func WithCompression(threshold int) OptionFunc {
+	return func(o *Options) {
+		if threshold > 0 {
+			o.CompressionThreshold = threshold
+		}
+	}
+}
+
+// WithEncryption encrypts values with AES-GCM under the keys of provider.
+// Segments are pinned to the key version that was current when they were
+// opened; records written under older versions stay readable as long as the
+// provider still serves those keys.
+func WithEncryption(provider encryption.KeyProvider) OptionFunc {
+	return func(o *Options) {
+		if provider != nil {
+			o.KeyProvider = provider
+		}
+	}
+}
+
+// WithReadVerification sets how much of each record reads check, VerifyFull
+// by default. Reads can lower it for themselves with kvix.WithVerifyLevel.
+func WithReadVerification(level VerifyLevel) OptionFunc {
+	return func(o *Options) {
+		o.ReadVerification = level
+	}
+}
+
+// WithSyncPolicy decides when writes are fsynced. See SyncPolicy.
+func WithSyncPolicy(policy SyncPolicy) OptionFunc {
+	return func(o *Options) {
+		o.SyncPolicy = policy
+	}
+}
+
+// WithSyncInterval sets how often SyncInterval fsyncs active segments.
+func WithSyncInterval(interval time.Duration) OptionFunc {
+	return func(o *Options) {
+		if interval != 0 {
+			o.SyncInterval = interval
+		}
+	}
+}
+
+// WithWriteBuffer collects up to size bytes of records in memory before
+// writing them to the active segment, which saves write calls for small
+// records. The buffer is also written out every WithWriteFlushInterval and
+// whenever the segment is synced, so SyncAlways writes every record at once.
+func WithWriteBuffer(size int) OptionFunc {
+	return func(o *Options) {
+		o.WriteBufferSize = size
+	}
+}
+
+// WithWriteFlushInterval sets how long records may wait in the write buffer.
+func WithWriteFlushInterval(interval time.Duration) OptionFunc {
+	return func(o *Options) {
+		if interval != 0 {
+			o.WriteFlushInterval = interval
+		}
+	}
+}
+
+// WithReadAhead sets how many bytes scans read from a segment at a time.
+// Verification and Snapshot.Scan read segments front to back, and large
+// sequential reads serve them at close to disk throughput. Negative sizes
+// read each record on its own.
+func WithReadAhead(size int) OptionFunc {
+	return func(o *Options) {
+		if size != 0 {
+			o.ReadAheadSize = size
+		}
+	}
+}
+
+// WithOperationTimeout bounds key operations such as Get, Set and Delete,
+// queries, snapshots, iterators and imports to timeout when the caller's
+// context carries no deadline of its own, so a stuck disk cannot hang the
+// calling goroutine. A timed-out call returns context.DeadlineExceeded; the
+// operation itself carries on in the background, so a timed-out write may
+// still be applied.
+func WithOperationTimeout(timeout time.Duration) OptionFunc {
+	return func(o *Options) {
+		if timeout != 0 {
+			o.OperationTimeout = timeout
+		}
+	}
+}
+
+// WithSlowOpThreshold logs, at Warn, every Get and Set, and every
+// partition's compaction, that takes longer than threshold, with a breakdown
+// of where the time went: index lookup, waiting for the partition or pacing,
+// segment open, disk read or write, decoding and checksum verification.
+func WithSlowOpThreshold(threshold time.Duration) OptionFunc {
+	return func(o *Options) {
+		if threshold != 0 {
+			o.SlowOpThreshold = threshold
+		}
+	}
+}
+
+// WithInterceptors wraps the operations WithOperationTimeout bounds, and
+// Sync, in interceptors, the first outermost. Each call adds to the
+// interceptors of earlier ones. See Interceptor.
+func WithInterceptors(interceptors ...Interceptor) OptionFunc {
+	return func(o *Options) {
+		for _, interceptor := range interceptors {
+			if interceptor != nil {
+				o.Interceptors = append(o.Interceptors, interceptor)
+			}
+		}
+	}
+}
+
+// WithMaxWriteRate limits writes to bytesPerSecond bytes of keys and values
+// per second, averaged over a second, so a bulk load leaves the disk enough
+// headroom to serve reads. Writes beyond it are held or rejected according
+// to WithWriteBackpressure.
+func WithMaxWriteRate(bytesPerSecond int64) OptionFunc {
+	return func(o *Options) {
+		if bytesPerSecond != 0 {
+			o.MaxWriteRate = bytesPerSecond
+		}
+	}
+}
+
+// WithMaxInflightWrites limits how many writes may be in progress at once,
+// queued on a partition or writing to disk, before new ones are held or
+// rejected according to WithWriteBackpressure.
+func WithMaxInflightWrites(limit int) OptionFunc {
+	return func(o *Options) {
+		if limit != 0 {
+			o.MaxInflightWrites = limit
+		}
+	}
+}
+
+// WithWriteBackpressure picks what happens to writes over WithMaxWriteRate
+// or WithMaxInflightWrites. See BackpressurePolicy.
+func WithWriteBackpressure(policy BackpressurePolicy) OptionFunc {
+	return func(o *Options) {
+		o.WriteBackpressure = policy
+	}
+}
+
+// WithLogLevel discards log entries below level.
+func WithLogLevel(level zapcore.Level) OptionFunc {
+	return func(o *Options) {
+		o.LogLevel = level
+	}
+}
+
+// WithErrorStackTraces makes every error kvix creates capture the call path
+// it was created on, available through its StackTrace method or
+// errors.GetStackTrace. Capturing costs a stack walk per error, and is
+// switched on for the whole process, so other instances in it capture too,
+// until the last instance opened with it closes.
+func WithErrorStackTraces() OptionFunc {
+	return func(o *Options) {
+		o.ErrorStackTraces = true
+	}
+}
+
+// WithLogger routes the instance's logs through log instead of a logger of
+// its own. The application then owns encoding, output, level and sampling, so
+// WithLogLevel and WithLogSampling have no effect.
+func WithLogger(log *zap.SugaredLogger) OptionFunc {
+	return func(o *Options) {
+		if log != nil {
+			o.Logger = log
+		}
+	}
+}
+
+// WithLogFile writes the instance's logs to config.Path instead of stderr,
+// rotating the file once it reaches config.MaxSize bytes or has been written
+// for config.MaxAge. Rotated files are named after the log file and the time
+// of rotation, gzipped with config.Compress, and the oldest are removed
+// beyond config.MaxBackups.
+func WithLogFile(config LogFileOptions) OptionFunc {
+	return func(o *Options) {
+		if config.MaxSize == 0 {
+			config.MaxSize = DefaultLogFileSize
+		}
+		o.LogFile = &config
+	}
+}
+
+// WithStartupProgress calls report while the instance is being opened, as
+// each phase of loading its data progresses. See StartupProgressFunc.
+func WithStartupProgress(report StartupProgressFunc) OptionFunc {
+	return func(o *Options) {
+		if report != nil {
+			o.StartupProgress = report
+		}
+	}
+}
+
+// WithChangeFeed records every change in a durable, sequenced log under
+// {DataDir}/changes, keeping roughly the most recent retention bytes of it.
+func WithChangeFeed(retention int64) OptionFunc {
+	return func(o *Options) {
+		if retention != 0 {
+			o.ChangeFeedRetention = retention
+		}
+	}
+}
+
+// WithReplicaOf makes the instance a read-only replica of the primary serving
+// replication at address (host:port). The replica copies the primary's
+// segments into its own segment directory and keeps its index in step with
+// the primary's; it must use the same partition count, segment prefix,
+// deduplication setting and encryption keys.
+func WithReplicaOf(address string) OptionFunc {
+	return func(o *Options) {
+		o.ReplicaOf = strings.TrimSpace(address)
+	}
+}
+
+// WithCluster makes the instance a member of a raft cluster. Writes are
+// committed to a replicated log kept under {DataDir}/raft before any member
+// applies them, so they must be sent to the leader; other members reject
+// them with raft.ErrNotLeader. Reads are served from local state.
+func WithCluster(cluster ClusterOptions) OptionFunc {
+	return func(o *Options) {
+		o.Cluster = &cluster
+	}
+}
+
+// WithArchive uploads sealed segments unread for config.MinIdle to
+// config.Uploader and deletes the local copies. Reading a record from an
+// archived segment downloads the segment back through config.Downloader.
+func WithArchive(config ArchiveOptions) OptionFunc {
+	return func(o *Options) {
+		if config.Downloader == nil {
+			config.Downloader, _ = config.Uploader.(archive.Downloader)
+		}
+		if config.MinIdle == 0 {
+			config.MinIdle = DefaultArchiveMinIdle
+		}
+		if config.Interval == 0 {
+			config.Interval = DefaultArchiveInterval
+		}
+		o.Archive = &config
+	}
+}
+
+// WithManifest publishes the index to {DataDir}/index.manifest every interval
+// when it has changed, and on Close, for followers opened on the same data
+// directory WithFollower.
+func WithManifest(interval time.Duration) OptionFunc {
+	return func(o *Options) {
+		if interval != 0 {
+			o.ManifestInterval = interval
+		}
+	}
+}
+
+// WithFollower opens an existing data directory read-only, next to the
+// primary writing it, and reloads the index from the manifest the primary
+// publishes WithManifest every interval. Reads are eventually consistent;
+// modifying calls fail. Use it where the directory is shared, such as on a
+// network filesystem.
+func WithFollower(interval time.Duration) OptionFunc {
+	return func(o *Options) {
+		if interval != 0 {
+			o.FollowInterval = interval
+		}
+	}
+}
+
+// WithMaxKeys bounds the instance to limit live keys. Writes past it evict
+// other keys, chosen by the EvictionPolicy, so the instance works as a
+// persistent cache instead of growing without limit.
+func WithMaxKeys(limit int) OptionFunc {
+	return func(o *Options) {
+		if limit != 0 {
+			o.MaxKeys = limit
+		}
+	}
+}
+
+// WithMaxLiveBytes bounds the bytes taken by the live records of the
+// instance, evicting keys as WithMaxKeys does.
+func WithMaxLiveBytes(limit int64) OptionFunc {
+	return func(o *Options) {
+		if limit != 0 {
+			o.MaxLiveBytes = limit
+		}
+	}
+}
+
+// WithEvictionPolicy picks which keys a bounded instance evicts first. See
+// EvictionPolicy.
+func WithEvictionPolicy(policy EvictionPolicy) OptionFunc {
+	return func(o *Options) {
+		o.EvictionPolicy = policy
+	}
+}
+
+// WithVersionHistory retains where the last versions writes of every key are
+// stored, deleted keys included, for History and GetVersion to read back.
+func WithVersionHistory(versions int) OptionFunc {
+	return func(o *Options) {
+		if versions != 0 {
+			o.VersionHistory = versions
+		}
+	}
+}
+
+// WithSecondaryIndex maintains an index of the JSON values found at each path,
+// such as $.email, for Query to look keys up by. Values that are not JSON
+// objects, or lack the path, are left out of the index.
+func WithSecondaryIndex(paths ...string) OptionFunc {
+	return func(o *Options) {
+		for _, path := range paths {
+			if path = strings.TrimSpace(path); path != "" && !slices.Contains(o.SecondaryIndexes, path) {
+				o.SecondaryIndexes = append(o.SecondaryIndexes, path)
+			}
+		}
+	}
+}
+
+// WithTagIndex maintains an index of the metadata tag names of every record,
+// for FindByTag to look keys up by.
+func WithTagIndex() OptionFunc {
+	return func(o *Options) {
+		o.TagIndex = true
+	}
+}
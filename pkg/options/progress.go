@@ -0,0 +1,29 @@
+package options
+
+// Phases reported to a StartupProgressFunc, in the order they run. Phases
+// with nothing to load are skipped.
+const (
+	// StartupIndex loads the index hint left by the last Close or a restore,
+	// or, on a follower, the primary's manifest. Progress is in bytes.
+	StartupIndex = "index"
+	// StartupRecovery replays the index log left by a crash over the index
+	// hint, with WithIndexLogSize. Progress is in bytes.
+	StartupRecovery = "recovery"
+	// StartupDedup reads back every record the index points at to rebuild
+	// the table of shared payloads, with WithDeduplication. Progress is in
+	// records.
+	StartupDedup = "dedup"
+	// StartupHistory loads the versions kept by WithVersionHistory. Progress
+	// is in bytes.
+	StartupHistory = "history"
+	// StartupSecondary builds the secondary and tag indexes from the live
+	// records. Progress is in keys.
+	StartupSecondary = "secondary"
+)
+
+// StartupProgressFunc receives the progress of a phase of opening an
+// instance: done out of total units of work. Every phase is reported once
+// with done at zero when it starts and once with done equal to total when it
+// ends, and at most every 100ms in between. It is called on the goroutine
+// opening the instance, which it holds up, so it should return quickly.
+type StartupProgressFunc func(phase string, done, total int64)
@@ -0,0 +1,63 @@
+package options
+
+import (
+	"reflect"
+	"slices"
+)
+
+// Reloadable names the Options fields a running instance can change with
+// Instance.Reconfigure. The rest are fixed when the instance is opened.
+var Reloadable = []string{
+	"LogLevel",
+	"SyncPolicy",
+	"SyncInterval",
+	"MaxKeys",
+	"MaxLiveBytes",
+	"EvictionPolicy",
+	"SlowOpThreshold",
+	"OperationTimeout",
+	"ReadVerification",
+	"CompactionThreshold",
+	"CompactionRate",
+	"CompactionRecordRate",
+}
+
+// Changes returns the names of the fields that differ between current and
+// next, split into those that are Reloadable and those that are not.
+func Changes(current, next *Options) (reloadable, fixed []string) {
+	currentValue, nextValue := reflect.ValueOf(current).Elem(), reflect.ValueOf(next).Elem()
+	for i := range currentValue.NumField() {
+		if sameValue(currentValue.Field(i), nextValue.Field(i)) {
+			continue
+		}
+
+		name := currentValue.Type().Field(i).Name
+		if slices.Contains(Reloadable, name) {
+			reloadable = append(reloadable, name)
+		} else {
+			fixed = append(fixed, name)
+		}
+	}
+	return reloadable, fixed
+}
+
+// sameValue reports whether two field values are equal. Functions, which
+// reflect.DeepEqual never finds equal unless nil, compare by identity, and
+// slices of them element by element.
+func sameValue(current, next reflect.Value) bool {
+	switch {
+	case current.Kind() == reflect.Func:
+		return current.Pointer() == next.Pointer()
+	case current.Kind() == reflect.Slice && current.Type().Elem().Kind() == reflect.Func:
+		if current.Len() != next.Len() {
+			return false
+		}
+		for i := range current.Len() {
+			if !sameValue(current.Index(i), next.Index(i)) {
+				return false
+			}
+		}
+		return true
+	}
+	return reflect.DeepEqual(current.Interface(), next.Interface())
+}
@@ -0,0 +1,39 @@
+package options
+
+import "fmt"
+
+// SyncPolicy decides when appended records are fsynced to disk.
+type SyncPolicy uint8
+
+const (
+	// SyncNone leaves flushing to the operating system. Segments are still
+	// fsynced when the instance is closed.
+	SyncNone SyncPolicy = iota
+	// SyncAlways fsyncs the active segment after every write.
+	SyncAlways
+	// SyncInterval fsyncs every active segment once per SyncInterval, so a
+	// crash loses at most that much of the most recent writes.
+	SyncInterval
+)
+
+func (p SyncPolicy) String() string {
+	switch p {
+	case SyncNone:
+		return "none"
+	case SyncAlways:
+		return "always"
+	case SyncInterval:
+		return "interval"
+	}
+	return fmt.Sprintf("policy(%d)", uint8(p))
+}
+
+// ParseSyncPolicy accepts the names printed by SyncPolicy.String.
+func ParseSyncPolicy(name string) (SyncPolicy, error) {
+	for _, policy := range []SyncPolicy{SyncNone, SyncAlways, SyncInterval} {
+		if policy.String() == name {
+			return policy, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown sync policy %q, expected none, always or interval", name)
+}
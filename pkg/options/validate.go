@@ -0,0 +1,415 @@
+package options
+
+import (
+	stdErrors "errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+
+	"go.uber.org/zap/zapcore"
+
+	"github.com/iamBelugaa/kvix/pkg/checksum"
+	"github.com/iamBelugaa/kvix/pkg/errors"
+	"github.com/iamBelugaa/kvix/pkg/filesys"
+)
+
+// Validate checks every option and returns nil or the joined list of
+// problems found, each a *errors.ValidationError whose "option" detail names
+// the offending field. Use the Unwrap() []error method of the result to
+// walk them.
+func (o *Options) Validate() error {
+	var problems []error
+	invalid := func(option string, provided, expected any, format string, args ...any) {
+		problems = append(problems, errors.NewValidationError(
+			nil, errors.ErrValidationInvalidData, fmt.Sprintf(format, args...),
+		).
+			WithDetail("option", option).
+			WithProvided(provided).
+			WithExpected(expected))
+	}
+
+	if strings.TrimSpace(o.DataDir) == "" {
+		invalid("DataDir", o.DataDir, "a directory path", "Data directory is required")
+	}
+
+	if o.SegmentOptions == nil {
+		invalid("SegmentOptions", nil, "segment options", "Segment options are required")
+	} else {
+		segments := o.SegmentOptions
+
+		if strings.TrimSpace(segments.Directory) == "" {
+			invalid("SegmentOptions.Directory", segments.Directory, "a directory path", "Segment directory is required")
+		} else if o.DataDir != "" && !within(o.DataDir, segments.Directory) {
+			invalid(
+				"SegmentOptions.Directory", segments.Directory, "a directory inside "+o.DataDir,
+				"Segment directory %s is not inside data directory %s", segments.Directory, o.DataDir,
+			)
+		}
+
+		if segments.Prefix == "" {
+			invalid("SegmentOptions.Prefix", segments.Prefix, "a non-empty file name prefix", "Segment prefix is required")
+		} else if strings.ContainsAny(segments.Prefix, `./\`) {
+			invalid(
+				"SegmentOptions.Prefix", segments.Prefix, "a prefix without '.', '/' or '\\'",
+				"Segment prefix %q may not contain '.', '/' or '\\'", segments.Prefix,
+			)
+		}
+
+		if segments.Size < MinSegmentSize || segments.Size > MaxSegmentSize {
+			invalid(
+				"SegmentOptions.Size", segments.Size, fmt.Sprintf("%d to %d bytes", MinSegmentSize, MaxSegmentSize),
+				"Segment size %d is outside %d to %d bytes", segments.Size, MinSegmentSize, MaxSegmentSize,
+			)
+		}
+	}
+
+	if o.CompactInterval < DefaultCompactInterval || o.CompactInterval > MaxCompactInterval {
+		invalid(
+			"CompactInterval", o.CompactInterval, fmt.Sprintf("%v to %v", DefaultCompactInterval, MaxCompactInterval),
+			"Compaction interval %v is outside %v to %v", o.CompactInterval, DefaultCompactInterval, MaxCompactInterval,
+		)
+	}
+
+	if o.CompactionThreshold <= 0 || o.CompactionThreshold > 1 {
+		invalid(
+			"CompactionThreshold", o.CompactionThreshold, "above 0 and at most 1",
+			"Compaction threshold %v is outside (0, 1]", o.CompactionThreshold,
+		)
+	}
+
+	if o.Partitions < 1 || o.Partitions > MaxPartitions {
+		invalid(
+			"Partitions", o.Partitions, fmt.Sprintf("1 to %d", MaxPartitions),
+			"Partition count %d is outside 1 to %d", o.Partitions, MaxPartitions,
+		)
+	}
+
+	if _, err := checksum.New(o.ChecksumAlgorithm); err != nil {
+		invalid(
+			"ChecksumAlgorithm", o.ChecksumAlgorithm, checksum.Supported(),
+			"Unsupported checksum algorithm %s", o.ChecksumAlgorithm,
+		)
+	}
+
+	if o.RecordFraming > FramingCompact {
+		invalid(
+			"RecordFraming", o.RecordFraming, "standard or compact",
+			"Unknown record framing %s", o.RecordFraming,
+		)
+	}
+
+	if o.IndexLayout > IndexOrdered {
+		invalid("IndexLayout", o.IndexLayout, "hashed or ordered", "Unknown index layout %s", o.IndexLayout)
+	}
+
+	// The ordered layout keeps every key in memory, which is what a bounded
+	// resident keydir avoids.
+	if o.IndexLayout == IndexOrdered && o.MaxResidentKeys != 0 {
+		invalid("IndexLayout", o.IndexLayout, "hashed", "Ordered indexes cannot use MaxResidentKeys")
+	}
+
+	if o.SyncPolicy > SyncInterval {
+		invalid("SyncPolicy", o.SyncPolicy, "none, always or interval", "Unknown sync policy %s", o.SyncPolicy)
+	}
+
+	if o.SyncPolicy == SyncInterval && o.SyncInterval <= 0 {
+		invalid("SyncInterval", o.SyncInterval, "a positive duration", "Sync interval must be positive, got %v", o.SyncInterval)
+	}
+
+	if o.WriteBufferSize < 0 || o.WriteBufferSize > MaxWriteBufferSize {
+		invalid(
+			"WriteBufferSize", o.WriteBufferSize, fmt.Sprintf("0 to %d bytes", MaxWriteBufferSize),
+			"Write buffer size %d is out of range", o.WriteBufferSize,
+		)
+	}
+
+	if o.ReadAheadSize > MaxReadAheadSize {
+		invalid(
+			"ReadAheadSize", o.ReadAheadSize, fmt.Sprintf("at most %d bytes", MaxReadAheadSize),
+			"Read-ahead size %d exceeds %d bytes", o.ReadAheadSize, MaxReadAheadSize,
+		)
+	}
+
+	if o.KeyIndexInterval > MaxKeyIndexInterval {
+		invalid(
+			"KeyIndexInterval", o.KeyIndexInterval, fmt.Sprintf("at most %d keys", MaxKeyIndexInterval),
+			"Key index interval %d exceeds %d keys", o.KeyIndexInterval, MaxKeyIndexInterval,
+		)
+	}
+
+	if o.OperationTimeout < 0 {
+		invalid(
+			"OperationTimeout", o.OperationTimeout, "a non-negative duration",
+			"Operation timeout must not be negative, got %v", o.OperationTimeout,
+		)
+	}
+
+	if o.WriteBufferSize > 0 && o.WriteFlushInterval <= 0 {
+		invalid(
+			"WriteFlushInterval", o.WriteFlushInterval, "a positive duration",
+			"Write flush interval must be positive, got %v", o.WriteFlushInterval,
+		)
+	}
+
+	if o.LogLevel < zapcore.DebugLevel || o.LogLevel > zapcore.FatalLevel {
+		invalid("LogLevel", o.LogLevel, "debug to fatal", "Unknown log level %d", int8(o.LogLevel))
+	}
+
+	if o.ChangeFeedRetention != 0 && o.ChangeFeedRetention < MinChangeFeedRetention {
+		invalid(
+			"ChangeFeedRetention", o.ChangeFeedRetention, fmt.Sprintf("0 or at least %d bytes", MinChangeFeedRetention),
+			"Change feed retention %d is below %d bytes", o.ChangeFeedRetention, MinChangeFeedRetention,
+		)
+	}
+
+	// Mappings are served from the page cache direct I/O bypasses.
+	if o.DirectIO && o.MmapSealedSegments {
+		invalid("MmapSealedSegments", o.MmapSealedSegments, false, "Direct I/O cannot be combined with mapped segments")
+	}
+
+	if o.ReplicaOf != "" {
+		if _, _, err := net.SplitHostPort(o.ReplicaOf); err != nil {
+			invalid("ReplicaOf", o.ReplicaOf, "a host:port address", "Invalid primary address %q: %v", o.ReplicaOf, err)
+		}
+
+		// Mapped segments have a fixed length, but a replica's segments keep
+		// growing while they are shipped.
+		if o.MmapSealedSegments {
+			invalid("MmapSealedSegments", o.MmapSealedSegments, false, "Replicas cannot map sealed segments")
+		}
+
+		if o.ChangeFeedRetention != 0 {
+			invalid("ChangeFeedRetention", o.ChangeFeedRetention, 0, "Replicas do not record a change feed")
+		}
+
+		if o.VersionHistory != 0 {
+			invalid("VersionHistory", o.VersionHistory, 0, "Replicas do not retain version history")
+		}
+
+		if len(o.SecondaryIndexes) != 0 {
+			invalid("SecondaryIndexes", o.SecondaryIndexes, "none", "Replicas do not maintain secondary indexes")
+		}
+
+		if o.TagIndex {
+			invalid("TagIndex", o.TagIndex, false, "Replicas do not maintain a tag index")
+		}
+	}
+
+	if logFile := o.LogFile; logFile != nil {
+		if strings.TrimSpace(logFile.Path) == "" {
+			invalid("LogFile.Path", logFile.Path, "a file path", "Log file path is required")
+		}
+
+		if logFile.MaxSize < 0 || logFile.MaxAge < 0 || logFile.MaxBackups < 0 {
+			invalid(
+				"LogFile", fmt.Sprintf("%d/%v/%d", logFile.MaxSize, logFile.MaxAge, logFile.MaxBackups), "zero or more",
+				"Log file size, age and backup limits cannot be negative",
+			)
+		}
+	}
+
+	if cluster := o.Cluster; cluster != nil {
+		if strings.TrimSpace(cluster.NodeID) == "" {
+			invalid("Cluster.NodeID", cluster.NodeID, "a node ID", "Cluster node ID is required")
+		} else if _, ok := cluster.Peers[cluster.NodeID]; !ok {
+			invalid(
+				"Cluster.Peers", cluster.Peers, "an entry for "+cluster.NodeID,
+				"Cluster peers do not include this node, %q", cluster.NodeID,
+			)
+		}
+
+		if cluster.Transport == nil {
+			for id, address := range cluster.Peers {
+				if _, _, err := net.SplitHostPort(address); err != nil {
+					invalid("Cluster.Peers", address, "a host:port address", "Invalid address %q for node %q: %v", address, id, err)
+				}
+			}
+		}
+
+		if cluster.ElectionTimeout < 0 || cluster.HeartbeatInterval < 0 {
+			invalid(
+				"Cluster", fmt.Sprintf("%v/%v", cluster.ElectionTimeout, cluster.HeartbeatInterval), "non-negative durations",
+				"Cluster election timeout and heartbeat interval cannot be negative",
+			)
+		} else if cluster.ElectionTimeout > 0 && cluster.HeartbeatInterval >= cluster.ElectionTimeout {
+			invalid(
+				"Cluster.HeartbeatInterval", cluster.HeartbeatInterval, "less than the election timeout",
+				"Heartbeat interval %v must be shorter than the election timeout %v",
+				cluster.HeartbeatInterval, cluster.ElectionTimeout,
+			)
+		}
+
+		// Each of these changes keys outside the replicated log, so members
+		// would drift apart.
+		if o.ReplicaOf != "" {
+			invalid("ReplicaOf", o.ReplicaOf, "", "Cluster members cannot also be replicas")
+		}
+
+		if o.SlidingTTL != 0 {
+			invalid("SlidingTTL", o.SlidingTTL, 0, "Cluster members cannot use sliding TTLs")
+		}
+
+		if o.RefreshAhead != 0 {
+			invalid("RefreshAhead", o.RefreshAhead, 0, "Cluster members cannot refresh ahead")
+		}
+	}
+
+	if o.FollowInterval != 0 {
+		if o.FollowInterval < 0 {
+			invalid("FollowInterval", o.FollowInterval, "a positive duration", "Follow interval must be positive, got %v", o.FollowInterval)
+		}
+
+		// A follower writes nothing to the directory it shares with its
+		// primary, and cannot map segments the primary is still appending to.
+		for _, conflict := range []struct {
+			option string
+			set    bool
+			value  any
+		}{
+			{"ReplicaOf", o.ReplicaOf != "", o.ReplicaOf},
+			{"Cluster", o.Cluster != nil, o.Cluster},
+			{"ManifestInterval", o.ManifestInterval != 0, o.ManifestInterval},
+			{"ChangeFeedRetention", o.ChangeFeedRetention != 0, o.ChangeFeedRetention},
+			{"MmapSealedSegments", o.MmapSealedSegments, o.MmapSealedSegments},
+			{"MaxResidentKeys", o.MaxResidentKeys != 0, o.MaxResidentKeys},
+			{"VersionHistory", o.VersionHistory != 0, o.VersionHistory},
+			{"SecondaryIndexes", len(o.SecondaryIndexes) != 0, o.SecondaryIndexes},
+			{"TagIndex", o.TagIndex, o.TagIndex},
+		} {
+			if conflict.set {
+				invalid(conflict.option, conflict.value, "unset", "Followers cannot use %s", conflict.option)
+			}
+		}
+	}
+
+	if o.ReadVerification > VerifyNone {
+		invalid(
+			"ReadVerification", o.ReadVerification, "full, checksum or none",
+			"Unknown verification level %s", o.ReadVerification,
+		)
+	}
+
+	if o.EvictionPolicy > EvictLFU {
+		invalid("EvictionPolicy", o.EvictionPolicy, "lru or lfu", "Unknown eviction policy %s", o.EvictionPolicy)
+	}
+
+	if o.WriteBackpressure > BackpressureReject {
+		invalid(
+			"WriteBackpressure", o.WriteBackpressure, "block or reject",
+			"Unknown backpressure policy %s", o.WriteBackpressure,
+		)
+	}
+
+	// Cluster members apply every committed write; one rejected on some
+	// members and not others would leave them apart.
+	throttled := o.MaxWriteRate != 0 || o.MaxInflightWrites != 0
+	if throttled && o.WriteBackpressure == BackpressureReject && o.Cluster != nil {
+		invalid("WriteBackpressure", o.WriteBackpressure, "block", "Cluster members cannot reject throttled writes")
+	}
+
+	if o.MaxKeys != 0 || o.MaxLiveBytes != 0 {
+		// Evictions sample keys at random, so every node evicting on its own
+		// would drift apart; replicas and followers evict what the primary
+		// does. Spilled keys are not tracked for eviction.
+		for _, conflict := range []struct {
+			option string
+			set    bool
+			value  any
+		}{
+			{"ReplicaOf", o.ReplicaOf != "", o.ReplicaOf},
+			{"Cluster", o.Cluster != nil, o.Cluster},
+			{"FollowInterval", o.FollowInterval != 0, o.FollowInterval},
+			{"MaxResidentKeys", o.MaxResidentKeys != 0, o.MaxResidentKeys},
+		} {
+			if conflict.set {
+				invalid(conflict.option, conflict.value, "unset", "Bounded instances cannot use %s", conflict.option)
+			}
+		}
+	}
+
+	if archive := o.Archive; archive != nil {
+		if archive.Uploader == nil {
+			invalid("Archive.Uploader", nil, "an uploader", "Archiving needs an uploader")
+		}
+
+		if archive.MinIdle < 0 || archive.Interval <= 0 {
+			invalid(
+				"Archive", fmt.Sprintf("%v/%v", archive.MinIdle, archive.Interval), "positive durations",
+				"Archive idle time and interval must be positive",
+			)
+		}
+
+		// Replicas and followers only ever mirror the primary's segments.
+		for _, conflict := range []struct {
+			option string
+			set    bool
+			value  any
+		}{
+			{"ReplicaOf", o.ReplicaOf != "", o.ReplicaOf},
+			{"FollowInterval", o.FollowInterval != 0, o.FollowInterval},
+			{"ManifestInterval", o.ManifestInterval != 0, o.ManifestInterval},
+		} {
+			if conflict.set {
+				invalid(conflict.option, conflict.value, "unset", "Archiving instances cannot use %s", conflict.option)
+			}
+		}
+	}
+
+	if o.FileSystem == nil {
+		invalid("FileSystem", nil, "a file system", "File system is required")
+	} else if o.FileSystem != filesys.OS && o.Cluster != nil {
+		// The raft log is kept with the operating system directly.
+		invalid("Cluster", o.Cluster, "unset", "Instances on a file system other than filesys.OS cannot use Cluster")
+	}
+
+	for _, path := range o.SecondaryIndexes {
+		if _, err := SplitJSONPath(path); err != nil {
+			invalid("SecondaryIndexes", path, "a path such as $.email", "Invalid secondary index path: %v", err)
+		}
+	}
+
+	if o.ManifestInterval < 0 {
+		invalid(
+			"ManifestInterval", o.ManifestInterval, "a positive duration",
+			"Manifest interval must be positive, got %v", o.ManifestInterval,
+		)
+	}
+
+	for _, field := range []struct {
+		option string
+		value  int64
+	}{
+		{"SlidingTTL", int64(o.SlidingTTL)},
+		{"StaleGracePeriod", int64(o.StaleGracePeriod)},
+		{"RefreshAhead", int64(o.RefreshAhead)},
+		{"RefreshLoaderTimeout", int64(o.RefreshLoaderTimeout)},
+		{"SlowOpThreshold", int64(o.SlowOpThreshold)},
+		{"LogSampling", int64(o.LogSampling)},
+		{"MaxResidentKeys", int64(o.MaxResidentKeys)},
+		{"MaxOpenSegments", int64(o.MaxOpenSegments)},
+		{"MaxKeys", int64(o.MaxKeys)},
+		{"MaxLiveBytes", o.MaxLiveBytes},
+		{"MaxWriteRate", o.MaxWriteRate},
+		{"CompactionRate", o.CompactionRate},
+		{"CompactionRecordRate", int64(o.CompactionRecordRate)},
+		{"MaxInflightWrites", int64(o.MaxInflightWrites)},
+		{"VersionHistory", int64(o.VersionHistory)},
+		{"CompressionThreshold", int64(o.CompressionThreshold)},
+	} {
+		if field.value < 0 {
+			invalid(field.option, field.value, "zero or more", "%s may not be negative, got %d", field.option, field.value)
+		}
+	}
+
+	return stdErrors.Join(problems...)
+}
+
+// within reports whether path is dir itself or lies below it.
+func within(dir, path string) bool {
+	relative, err := filepath.Rel(filepath.Clean(dir), filepath.Clean(path))
+	if err != nil {
+		return false
+	}
+	return relative == "." || (relative != ".." && !strings.HasPrefix(relative, ".."+string(filepath.Separator)))
+}
@@ -0,0 +1,43 @@
+package options
+
+import "fmt"
+
+// VerifyLevel decides how much of a record a read checks before returning
+// it. Lower levels trade detecting corruption for latency.
+type VerifyLevel uint8
+
+const (
+	// VerifyFull checks the payload checksum and that the record read is the
+	// one of the key asked for, which catches an index pointing at the wrong
+	// offset. Deduplicated instances skip the key check, since keys share
+	// records.
+	VerifyFull VerifyLevel = iota
+	// VerifyChecksum checks the payload checksum only.
+	VerifyChecksum
+	// VerifyNone trusts the payload. Record headers that carry their own
+	// checksum are still checked, since the payload size they hold decides
+	// how much is read.
+	VerifyNone
+)
+
+func (l VerifyLevel) String() string {
+	switch l {
+	case VerifyFull:
+		return "full"
+	case VerifyChecksum:
+		return "checksum"
+	case VerifyNone:
+		return "none"
+	}
+	return fmt.Sprintf("level(%d)", uint8(l))
+}
+
+// ParseVerifyLevel accepts the names printed by VerifyLevel.String.
+func ParseVerifyLevel(name string) (VerifyLevel, error) {
+	for _, level := range []VerifyLevel{VerifyFull, VerifyChecksum, VerifyNone} {
+		if level.String() == name {
+			return level, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown verification level %q, expected full, checksum or none", name)
+}
@@ -0,0 +1,234 @@
+package raft
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+)
+
+const (
+	logName   = "log"
+	stateName = "state"
+
+	// entryHeaderSize covers checksum, term and data length.
+	entryHeaderSize = 16
+)
+
+type entryMeta struct {
+	term   uint64
+	offset int64
+	length uint32
+}
+
+// raftLog keeps the entries in one append-only file of
+// [crc32][term][length][data] records, the checksum covering everything after
+// it. Only entry positions are held in memory; data is read back on demand.
+type raftLog struct {
+	file    *os.File
+	entries []entryMeta
+	size    int64
+}
+
+// openLog loads the log in dir. A torn or corrupt tail, left by a crash
+// mid-append, is cut off: it was never acknowledged to anyone.
+func openLog(dir string) (*raftLog, error) {
+	path := filepath.Join(dir, logName)
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	log := &raftLog{file: file}
+	header := make([]byte, entryHeaderSize)
+
+	for {
+		if _, err := file.ReadAt(header, log.size); err != nil {
+			break
+		}
+
+		term := binary.LittleEndian.Uint64(header[4:12])
+		length := binary.LittleEndian.Uint32(header[12:16])
+		if log.size+entryHeaderSize+int64(length) > info.Size() {
+			break
+		}
+
+		data := make([]byte, length)
+		if _, err := file.ReadAt(data, log.size+entryHeaderSize); err != nil {
+			break
+		}
+
+		checksum := crc32.ChecksumIEEE(header[4:])
+		checksum = crc32.Update(checksum, crc32.IEEETable, data)
+		if checksum != binary.LittleEndian.Uint32(header[0:4]) {
+			break
+		}
+
+		log.entries = append(log.entries, entryMeta{term: term, offset: log.size, length: length})
+		log.size += entryHeaderSize + int64(length)
+	}
+
+	if err := file.Truncate(log.size); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return log, nil
+}
+
+func (l *raftLog) lastIndex() uint64 {
+	return uint64(len(l.entries))
+}
+
+// term returns the term of the entry at index, or 0 when there is none.
+func (l *raftLog) term(index uint64) uint64 {
+	if index == 0 || index > l.lastIndex() {
+		return 0
+	}
+	return l.entries[index-1].term
+}
+
+func (l *raftLog) read(index uint64) (Entry, error) {
+	if index == 0 || index > l.lastIndex() {
+		return Entry{}, fmt.Errorf("raft: log has no entry %d", index)
+	}
+
+	meta := l.entries[index-1]
+	data := make([]byte, meta.length)
+	if _, err := l.file.ReadAt(data, meta.offset+entryHeaderSize); err != nil {
+		return Entry{}, err
+	}
+	return Entry{Index: index, Term: meta.term, Data: data}, nil
+}
+
+// append writes entries, which must follow the last one, and syncs them:
+// an entry acknowledged to a leader has to survive a crash.
+func (l *raftLog) append(entries []Entry) error {
+	var buffer bytes.Buffer
+	metas := make([]entryMeta, 0, len(entries))
+	header := make([]byte, entryHeaderSize)
+
+	for _, entry := range entries {
+		binary.LittleEndian.PutUint64(header[4:12], entry.Term)
+		binary.LittleEndian.PutUint32(header[12:16], uint32(len(entry.Data)))
+		checksum := crc32.ChecksumIEEE(header[4:])
+		binary.LittleEndian.PutUint32(header[0:4], crc32.Update(checksum, crc32.IEEETable, entry.Data))
+
+		metas = append(metas, entryMeta{
+			term:   entry.Term,
+			offset: l.size + int64(buffer.Len()),
+			length: uint32(len(entry.Data)),
+		})
+		buffer.Write(header)
+		buffer.Write(entry.Data)
+	}
+
+	if _, err := l.file.WriteAt(buffer.Bytes(), l.size); err != nil {
+		return err
+	}
+
+	if err := l.file.Sync(); err != nil {
+		return err
+	}
+
+	l.entries = append(l.entries, metas...)
+	l.size += int64(buffer.Len())
+	return nil
+}
+
+// truncate drops the entry at index and everything after it.
+func (l *raftLog) truncate(index uint64) error {
+	if index == 0 || index > l.lastIndex() {
+		return nil
+	}
+
+	size := l.entries[index-1].offset
+	if err := l.file.Truncate(size); err != nil {
+		return err
+	}
+
+	if err := l.file.Sync(); err != nil {
+		return err
+	}
+
+	l.entries = l.entries[:index-1]
+	l.size = size
+	return nil
+}
+
+func (l *raftLog) close() error {
+	return l.file.Close()
+}
+
+// loadState reads the term and vote saved by saveState.
+func loadState(dir string) (uint64, string, error) {
+	data, err := os.ReadFile(filepath.Join(dir, stateName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, "", nil
+		}
+		return 0, "", err
+	}
+
+	if len(data) < 14 || crc32.ChecksumIEEE(data[4:]) != binary.LittleEndian.Uint32(data[0:4]) {
+		return 0, "", fmt.Errorf("raft: state file %s is corrupt", filepath.Join(dir, stateName))
+	}
+
+	term := binary.LittleEndian.Uint64(data[4:12])
+	length := int(binary.LittleEndian.Uint16(data[12:14]))
+	if len(data) != 14+length {
+		return 0, "", fmt.Errorf("raft: state file %s is corrupt", filepath.Join(dir, stateName))
+	}
+	return term, string(data[14:]), nil
+}
+
+// saveState durably replaces the persisted term and vote.
+func saveState(dir string, term uint64, votedFor string) error {
+	data := make([]byte, 14+len(votedFor))
+	binary.LittleEndian.PutUint64(data[4:12], term)
+	binary.LittleEndian.PutUint16(data[12:14], uint16(len(votedFor)))
+	copy(data[14:], votedFor)
+	binary.LittleEndian.PutUint32(data[0:4], crc32.ChecksumIEEE(data[4:]))
+
+	path := filepath.Join(dir, stateName)
+	file, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+func syncDir(dir string) error {
+	directory, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer directory.Close()
+
+	return directory.Sync()
+}
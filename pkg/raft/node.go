@@ -0,0 +1,648 @@
+package raft
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+type result struct {
+	value any
+	err   error
+}
+
+// proposal waits for the entry a leader appended in term to be applied.
+type proposal struct {
+	term uint64
+	done chan result
+}
+
+// Node is one member of a cluster. All methods are safe for concurrent use.
+type Node struct {
+	mu     sync.Mutex
+	config Config
+	log    *zap.SugaredLogger
+	raft   *raftLog
+
+	state    State
+	term     uint64
+	votedFor string
+	leader   string
+	deadline time.Time
+
+	commitIndex uint64
+	lastApplied uint64
+
+	// nextIndex and matchIndex are only meaningful while leading.
+	nextIndex  map[string]uint64
+	matchIndex map[string]uint64
+	wake       map[string]chan struct{}
+	proposals  map[uint64]*proposal
+
+	applyWake chan struct{}
+	closed    bool
+	ctx       context.Context
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+}
+
+// New opens the node's log in config.Dir and starts it as a follower. A
+// cluster of one elects itself as soon as its election timeout lapses.
+func New(config Config) (*Node, error) {
+	if config.ID == "" {
+		return nil, fmt.Errorf("raft: node ID is required")
+	}
+
+	if config.Transport == nil || config.Apply == nil {
+		return nil, fmt.Errorf("raft: a transport and an apply function are required")
+	}
+
+	if config.ElectionTimeout <= 0 {
+		config.ElectionTimeout = DefaultElectionTimeout
+	}
+
+	if config.HeartbeatInterval <= 0 {
+		config.HeartbeatInterval = DefaultHeartbeatInterval
+	}
+
+	if config.Log == nil {
+		config.Log = zap.NewNop().Sugar()
+	}
+
+	if err := os.MkdirAll(config.Dir, 0755); err != nil {
+		return nil, err
+	}
+
+	term, votedFor, err := loadState(config.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	raftLog, err := openLog(config.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	applied := min(config.Applied, raftLog.lastIndex())
+	ctx, cancel := context.WithCancel(context.Background())
+
+	n := &Node{
+		config:      config,
+		log:         config.Log.With("node", config.ID),
+		raft:        raftLog,
+		term:        term,
+		votedFor:    votedFor,
+		commitIndex: applied,
+		lastApplied: applied,
+		nextIndex:   make(map[string]uint64, len(config.Peers)),
+		matchIndex:  make(map[string]uint64, len(config.Peers)),
+		wake:        make(map[string]chan struct{}, len(config.Peers)),
+		proposals:   make(map[uint64]*proposal),
+		applyWake:   make(chan struct{}, 1),
+		ctx:         ctx,
+		cancel:      cancel,
+	}
+	n.resetDeadline()
+	for _, peer := range config.Peers {
+		n.wake[peer] = make(chan struct{}, 1)
+	}
+
+	n.log.Infow("Raft node started", "term", term, "lastIndex", raftLog.lastIndex(), "applied", applied)
+
+	n.wg.Add(3 + len(config.Peers))
+	go n.serve()
+	go n.tick()
+	go n.applyCommitted()
+	for _, peer := range config.Peers {
+		go n.replicateTo(peer, n.wake[peer])
+	}
+	return n, nil
+}
+
+// Propose appends data to the log and waits until it is committed and
+// applied here, returning what Config.Apply returned. Only the leader
+// accepts proposals. A proposal whose ctx ends first may still be applied.
+func (n *Node) Propose(ctx context.Context, data []byte) (any, error) {
+	n.mu.Lock()
+	if n.closed {
+		n.mu.Unlock()
+		return nil, ErrClosed
+	}
+
+	if n.state != Leader {
+		leader := n.leader
+		n.mu.Unlock()
+
+		if leader == "" {
+			return nil, fmt.Errorf("%w; no leader is known", ErrNotLeader)
+		}
+		return nil, fmt.Errorf("%w; the leader is %s", ErrNotLeader, leader)
+	}
+
+	index := n.raft.lastIndex() + 1
+	if err := n.raft.append([]Entry{{Index: index, Term: n.term, Data: data}}); err != nil {
+		n.mu.Unlock()
+		return nil, fmt.Errorf("raft: failed to append to the log: %w", err)
+	}
+
+	waiter := &proposal{term: n.term, done: make(chan result, 1)}
+	n.proposals[index] = waiter
+	n.advanceCommit()
+	n.wakeReplicators()
+	n.mu.Unlock()
+
+	select {
+	case result := <-waiter.done:
+		return result.value, result.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-n.ctx.Done():
+		return nil, ErrClosed
+	}
+}
+
+// Barrier waits until every command committed before the call has been
+// applied here. On the leader that makes subsequent local reads
+// linearizable.
+func (n *Node) Barrier(ctx context.Context) error {
+	_, err := n.Propose(ctx, nil)
+	return err
+}
+
+func (n *Node) Status() Status {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return Status{
+		ID:          n.config.ID,
+		State:       n.state,
+		Term:        n.term,
+		Leader:      n.leader,
+		LastIndex:   n.raft.lastIndex(),
+		CommitIndex: n.commitIndex,
+		Applied:     n.lastApplied,
+	}
+}
+
+// Close stops the node and its transport. Pending proposals fail with
+// ErrClosed; Status().Applied is final once Close returns.
+func (n *Node) Close() error {
+	n.mu.Lock()
+	if n.closed {
+		n.mu.Unlock()
+		return ErrClosed
+	}
+	n.closed = true
+	n.mu.Unlock()
+
+	n.cancel()
+	err := n.config.Transport.Close()
+	n.wg.Wait()
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.failProposals(ErrClosed)
+	if closeErr := n.raft.close(); err == nil {
+		err = closeErr
+	}
+
+	n.log.Infow("Raft node stopped", "term", n.term, "applied", n.lastApplied)
+	return err
+}
+
+func (n *Node) HandleRequestVote(request *RequestVoteRequest) *RequestVoteResponse {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if request.Term > n.term {
+		n.stepDown(request.Term)
+	}
+
+	response := &RequestVoteResponse{Term: n.term}
+	if request.Term < n.term || (n.votedFor != "" && n.votedFor != request.CandidateID) {
+		return response
+	}
+
+	lastIndex := n.raft.lastIndex()
+	lastTerm := n.raft.term(lastIndex)
+	upToDate := request.LastLogTerm > lastTerm ||
+		(request.LastLogTerm == lastTerm && request.LastLogIndex >= lastIndex)
+	if !upToDate {
+		return response
+	}
+
+	if err := saveState(n.config.Dir, n.term, request.CandidateID); err != nil {
+		n.log.Errorw("Failed to persist vote", "term", n.term, "error", err)
+		return response
+	}
+
+	n.votedFor = request.CandidateID
+	n.resetDeadline()
+	response.VoteGranted = true
+	return response
+}
+
+func (n *Node) HandleAppendEntries(request *AppendEntriesRequest) *AppendEntriesResponse {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	response := &AppendEntriesResponse{Term: n.term}
+	if request.Term < n.term {
+		return response
+	}
+
+	if request.Term > n.term || n.state != Follower {
+		n.stepDown(request.Term)
+		response.Term = n.term
+	}
+	n.leader = request.LeaderID
+	n.resetDeadline()
+
+	lastIndex := n.raft.lastIndex()
+	if request.PrevLogIndex > lastIndex {
+		response.ConflictIndex = lastIndex + 1
+		return response
+	}
+
+	if conflictTerm := n.raft.term(request.PrevLogIndex); conflictTerm != request.PrevLogTerm {
+		// Skip the whole conflicting term rather than one entry per round
+		// trip.
+		index := request.PrevLogIndex
+		for index > n.commitIndex+1 && n.raft.term(index-1) == conflictTerm {
+			index--
+		}
+		response.ConflictIndex = index
+		return response
+	}
+
+	entries := request.Entries
+	for len(entries) > 0 && entries[0].Index <= n.raft.lastIndex() {
+		if n.raft.term(entries[0].Index) != entries[0].Term {
+			if entries[0].Index <= n.commitIndex {
+				n.log.Errorw("Leader sent a conflicting committed entry", "index", entries[0].Index, "leader", request.LeaderID)
+				return response
+			}
+
+			if err := n.raft.truncate(entries[0].Index); err != nil {
+				n.log.Errorw("Failed to truncate the log", "index", entries[0].Index, "error", err)
+				return response
+			}
+			break
+		}
+		entries = entries[1:]
+	}
+
+	if len(entries) > 0 {
+		if err := n.raft.append(entries); err != nil {
+			n.log.Errorw("Failed to append to the log", "index", entries[0].Index, "error", err)
+			response.ConflictIndex = n.raft.lastIndex() + 1
+			return response
+		}
+	}
+
+	lastNew := request.PrevLogIndex + uint64(len(request.Entries))
+	if request.LeaderCommit > n.commitIndex {
+		n.commitIndex = min(request.LeaderCommit, lastNew)
+		n.signal(n.applyWake)
+	}
+
+	response.Success = true
+	return response
+}
+
+func (n *Node) serve() {
+	defer n.wg.Done()
+
+	if err := n.config.Transport.Serve(n); err != nil && n.ctx.Err() == nil {
+		n.log.Errorw("Raft transport stopped serving", "error", err)
+	}
+}
+
+// tick drives heartbeats while leading and elections otherwise.
+func (n *Node) tick() {
+	defer n.wg.Done()
+
+	ticker := time.NewTicker(n.config.HeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-n.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		n.mu.Lock()
+		if n.state == Leader {
+			n.wakeReplicators()
+		} else if time.Now().After(n.deadline) {
+			n.campaign()
+		}
+		n.mu.Unlock()
+	}
+}
+
+// campaign stands for election in a new term. Callers hold mu.
+func (n *Node) campaign() {
+	if err := saveState(n.config.Dir, n.term+1, n.config.ID); err != nil {
+		n.log.Errorw("Failed to persist term for election", "term", n.term+1, "error", err)
+		n.resetDeadline()
+		return
+	}
+
+	n.term++
+	n.votedFor = n.config.ID
+	n.state = Candidate
+	n.leader = ""
+	n.resetDeadline()
+	n.log.Infow("Standing for election", "term", n.term)
+
+	if len(n.config.Peers) == 0 {
+		n.becomeLeader()
+		return
+	}
+
+	term := n.term
+	lastIndex := n.raft.lastIndex()
+	request := &RequestVoteRequest{
+		Term:         term,
+		CandidateID:  n.config.ID,
+		LastLogIndex: lastIndex,
+		LastLogTerm:  n.raft.term(lastIndex),
+	}
+
+	votes := 1
+	for _, peer := range n.config.Peers {
+		n.wg.Add(1)
+		go func() {
+			defer n.wg.Done()
+
+			ctx, cancel := context.WithTimeout(n.ctx, n.config.ElectionTimeout)
+			defer cancel()
+
+			response, err := n.config.Transport.RequestVote(ctx, peer, request)
+			if err != nil {
+				n.log.Debugw("Vote request failed", "peer", peer, "term", term, "error", err)
+				return
+			}
+
+			n.mu.Lock()
+			defer n.mu.Unlock()
+
+			if response.Term > n.term {
+				n.stepDown(response.Term)
+				return
+			}
+
+			if !response.VoteGranted || n.state != Candidate || n.term != term {
+				return
+			}
+
+			votes++
+			if n.isQuorum(votes) {
+				n.becomeLeader()
+			}
+		}()
+	}
+}
+
+// becomeLeader takes over and appends an empty entry, which commits
+// everything earlier terms left uncommitted. Callers hold mu.
+func (n *Node) becomeLeader() {
+	n.state = Leader
+	n.leader = n.config.ID
+
+	next := n.raft.lastIndex() + 1
+	for _, peer := range n.config.Peers {
+		n.nextIndex[peer] = next
+		n.matchIndex[peer] = 0
+	}
+
+	if err := n.raft.append([]Entry{{Index: next, Term: n.term}}); err != nil {
+		n.log.Errorw("Failed to append leader entry", "term", n.term, "error", err)
+		n.stepDown(n.term)
+		return
+	}
+
+	n.log.Infow("Elected leader", "term", n.term, "lastIndex", next)
+	n.advanceCommit()
+	n.wakeReplicators()
+}
+
+// stepDown follows whoever leads term. Proposals still waiting here fail:
+// the new leader may or may not commit them. Callers hold mu.
+func (n *Node) stepDown(term uint64) {
+	if term > n.term {
+		if err := saveState(n.config.Dir, term, ""); err != nil {
+			n.log.Errorw("Failed to persist term", "term", term, "error", err)
+		}
+		n.term = term
+		n.votedFor = ""
+		n.leader = ""
+	}
+
+	if n.state == Leader {
+		n.log.Infow("Stepping down as leader", "term", n.term)
+		n.failProposals(ErrLeadershipLost)
+	}
+
+	n.state = Follower
+	n.resetDeadline()
+}
+
+// replicateTo keeps peer's log in step with the leader's while leading.
+func (n *Node) replicateTo(peer string, wake <-chan struct{}) {
+	defer n.wg.Done()
+
+	for {
+		select {
+		case <-n.ctx.Done():
+			return
+		case <-wake:
+		}
+
+		for n.sendEntries(peer) {
+		}
+	}
+}
+
+// sendEntries sends peer one AppendEntries request and reports whether
+// another should follow right away.
+func (n *Node) sendEntries(peer string) bool {
+	n.mu.Lock()
+	if n.state != Leader {
+		n.mu.Unlock()
+		return false
+	}
+
+	term := n.term
+	next := n.nextIndex[peer]
+	request := &AppendEntriesRequest{
+		Term:         term,
+		LeaderID:     n.config.ID,
+		PrevLogIndex: next - 1,
+		PrevLogTerm:  n.raft.term(next - 1),
+		LeaderCommit: n.commitIndex,
+	}
+
+	var size int
+	for index := next; index <= n.raft.lastIndex(); index++ {
+		if len(request.Entries) == maxBatchEntries || size >= maxBatchBytes {
+			break
+		}
+
+		entry, err := n.raft.read(index)
+		if err != nil {
+			n.mu.Unlock()
+			n.log.Errorw("Failed to read log entry", "index", index, "error", err)
+			return false
+		}
+
+		request.Entries = append(request.Entries, entry)
+		size += len(entry.Data)
+	}
+	n.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(n.ctx, n.config.ElectionTimeout)
+	response, err := n.config.Transport.AppendEntries(ctx, peer, request)
+	cancel()
+
+	if err != nil {
+		n.log.Debugw("Append entries failed", "peer", peer, "term", term, "error", err)
+		return false
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if response.Term > n.term {
+		n.stepDown(response.Term)
+		return false
+	}
+
+	if n.state != Leader || n.term != term {
+		return false
+	}
+
+	if !response.Success {
+		n.nextIndex[peer] = max(1, min(response.ConflictIndex, next-1))
+		return true
+	}
+
+	match := request.PrevLogIndex + uint64(len(request.Entries))
+	n.matchIndex[peer] = max(n.matchIndex[peer], match)
+	n.nextIndex[peer] = match + 1
+	n.advanceCommit()
+
+	return n.nextIndex[peer] <= n.raft.lastIndex()
+}
+
+// advanceCommit commits the newest entry of the current term that a quorum
+// holds. Entries of earlier terms commit along with it. Callers hold mu.
+func (n *Node) advanceCommit() {
+	for index := n.raft.lastIndex(); index > n.commitIndex; index-- {
+		if n.raft.term(index) != n.term {
+			return
+		}
+
+		votes := 1
+		for _, peer := range n.config.Peers {
+			if n.matchIndex[peer] >= index {
+				votes++
+			}
+		}
+
+		if n.isQuorum(votes) {
+			n.commitIndex = index
+			n.signal(n.applyWake)
+			// Followers learn the new commit index without waiting for the
+			// next heartbeat.
+			n.wakeReplicators()
+			return
+		}
+	}
+}
+
+// applyCommitted feeds committed entries to Config.Apply in order.
+func (n *Node) applyCommitted() {
+	defer n.wg.Done()
+
+	for {
+		select {
+		case <-n.ctx.Done():
+			return
+		case <-n.applyWake:
+		}
+
+		for n.ctx.Err() == nil {
+			n.mu.Lock()
+			if n.lastApplied >= n.commitIndex {
+				n.mu.Unlock()
+				break
+			}
+
+			entry, err := n.raft.read(n.lastApplied + 1)
+			n.mu.Unlock()
+
+			if err != nil {
+				n.log.Errorw("Failed to read committed entry", "index", n.lastApplied+1, "error", err)
+				break
+			}
+
+			var value any
+			if len(entry.Data) > 0 {
+				value, err = n.config.Apply(entry.Index, entry.Data)
+			}
+
+			n.mu.Lock()
+			n.lastApplied = entry.Index
+			waiter, ok := n.proposals[entry.Index]
+			if ok {
+				delete(n.proposals, entry.Index)
+				if waiter.term == entry.Term {
+					waiter.done <- result{value: value, err: err}
+				} else {
+					waiter.done <- result{err: ErrLeadershipLost}
+				}
+			} else if err != nil {
+				n.log.Errorw("Failed to apply committed entry", "index", entry.Index, "error", err)
+			}
+			n.mu.Unlock()
+		}
+	}
+}
+
+func (n *Node) failProposals(err error) {
+	for index, waiter := range n.proposals {
+		waiter.done <- result{err: err}
+		delete(n.proposals, index)
+	}
+}
+
+func (n *Node) isQuorum(votes int) bool {
+	return votes*2 > len(n.config.Peers)+1
+}
+
+func (n *Node) resetDeadline() {
+	timeout := n.config.ElectionTimeout
+	n.deadline = time.Now().Add(timeout + rand.N(timeout))
+}
+
+func (n *Node) wakeReplicators() {
+	for _, wake := range n.wake {
+		n.signal(wake)
+	}
+}
+
+func (n *Node) signal(wake chan struct{}) {
+	select {
+	case wake <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,151 @@
+// Package raft implements the Raft consensus algorithm: a cluster of nodes
+// agrees on a replicated log of opaque commands, and every node applies the
+// committed commands in the same order. It covers leader election and log
+// replication; membership is fixed.
+//
+// There are no snapshots, so the log is never compacted: it keeps every
+// command ever committed, its file grows with each one and opening a node
+// reads all of it, holding the position of every entry in memory. A member
+// that falls behind, or starts over with an empty directory, is caught up by
+// replaying the log from the first entry it lacks.
+package raft
+
+import (
+	"context"
+	stdErrors "errors"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	DefaultElectionTimeout   = time.Second
+	DefaultHeartbeatInterval = 100 * time.Millisecond
+
+	// maxBatchEntries and maxBatchBytes cap one AppendEntries request.
+	maxBatchEntries = 512
+	maxBatchBytes   = 4 << 20
+)
+
+var (
+	// ErrNotLeader is returned by Propose on a node that is not the leader.
+	// The error names the leader when one is known.
+	ErrNotLeader = stdErrors.New("raft: not the leader")
+	// ErrLeadershipLost is returned for proposals whose leader stepped down
+	// before they were applied. They may or may not have been committed.
+	ErrLeadershipLost = stdErrors.New("raft: leadership lost before the proposal was applied")
+	// ErrClosed is returned once the node is closed.
+	ErrClosed = stdErrors.New("raft: node closed")
+)
+
+// State is the role a node currently plays.
+type State uint8
+
+const (
+	Follower State = iota
+	Candidate
+	Leader
+)
+
+func (s State) String() string {
+	switch s {
+	case Follower:
+		return "follower"
+	case Candidate:
+		return "candidate"
+	case Leader:
+		return "leader"
+	}
+	return "unknown"
+}
+
+// Entry is one slot of the replicated log. Leaders append an entry with no
+// Data when elected; it is never passed to Config.Apply.
+type Entry struct {
+	Index uint64
+	Term  uint64
+	Data  []byte
+}
+
+type RequestVoteRequest struct {
+	Term         uint64
+	CandidateID  string
+	LastLogIndex uint64
+	LastLogTerm  uint64
+}
+
+type RequestVoteResponse struct {
+	Term        uint64
+	VoteGranted bool
+}
+
+type AppendEntriesRequest struct {
+	Term         uint64
+	LeaderID     string
+	PrevLogIndex uint64
+	PrevLogTerm  uint64
+	Entries      []Entry
+	LeaderCommit uint64
+}
+
+type AppendEntriesResponse struct {
+	Term    uint64
+	Success bool
+	// ConflictIndex is where the leader should resume sending when Success
+	// is false.
+	ConflictIndex uint64
+}
+
+// Handler answers the RPCs a Transport receives.
+type Handler interface {
+	HandleRequestVote(request *RequestVoteRequest) *RequestVoteResponse
+	HandleAppendEntries(request *AppendEntriesRequest) *AppendEntriesResponse
+}
+
+// Transport carries RPCs between nodes, which it addresses by ID. Calls must
+// honour ctx and may fail; the node retries them.
+type Transport interface {
+	RequestVote(ctx context.Context, peer string, request *RequestVoteRequest) (*RequestVoteResponse, error)
+	AppendEntries(ctx context.Context, peer string, request *AppendEntriesRequest) (*AppendEntriesResponse, error)
+	// Serve delivers inbound RPCs to handler until the transport is closed.
+	Serve(handler Handler) error
+	Close() error
+}
+
+type Config struct {
+	// ID names this node. It must be unique within the cluster.
+	ID string
+	// Peers are the IDs of every other member.
+	Peers []string
+	// Dir holds the log and the persisted term and vote.
+	Dir string
+	// Transport is owned by the node from New on and closed with it.
+	Transport Transport
+	// Apply applies a committed command to the state machine. It is called
+	// from a single goroutine in log order, and its results are returned by
+	// the Propose call that submitted the command, if it was made here.
+	Apply func(index uint64, data []byte) (any, error)
+	// Applied is the last index the state machine already reflects; entries
+	// up to it are not applied again.
+	Applied uint64
+	// ElectionTimeout is how long a follower waits to hear from a leader
+	// before standing for election. Each wait is randomized between one and
+	// two timeouts. Default: 1s
+	ElectionTimeout time.Duration
+	// HeartbeatInterval is how often a leader contacts idle followers.
+	// Default: 100ms
+	HeartbeatInterval time.Duration
+	// Log defaults to a no-op logger.
+	Log *zap.SugaredLogger
+}
+
+// Status is a point-in-time view of a node.
+type Status struct {
+	ID          string
+	State       State
+	Term        uint64
+	Leader      string
+	LastIndex   uint64
+	CommitIndex uint64
+	Applied     uint64
+}
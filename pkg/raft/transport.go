@@ -0,0 +1,212 @@
+package raft
+
+import (
+	"context"
+	stdErrors "errors"
+	"fmt"
+	"net"
+	"net/rpc"
+	"sync"
+)
+
+// TCPTransport carries RPCs over TCP with net/rpc, keeping one connection
+// per peer and redialling it after a failure.
+type TCPTransport struct {
+	listener net.Listener
+	peers    map[string]string
+
+	mu      sync.Mutex
+	clients map[string]*rpc.Client
+	conns   map[net.Conn]struct{}
+	closed  bool
+}
+
+// NewTCPTransport listens on bind and reaches each peer, keyed by node ID,
+// at its host:port address.
+func NewTCPTransport(bind string, peers map[string]string) (*TCPTransport, error) {
+	listener, err := net.Listen("tcp", bind)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TCPTransport{
+		listener: listener,
+		peers:    peers,
+		clients:  make(map[string]*rpc.Client),
+		conns:    make(map[net.Conn]struct{}),
+	}, nil
+}
+
+func (t *TCPTransport) Addr() net.Addr {
+	return t.listener.Addr()
+}
+
+func (t *TCPTransport) RequestVote(
+	ctx context.Context, peer string, request *RequestVoteRequest,
+) (*RequestVoteResponse, error) {
+	response := &RequestVoteResponse{}
+	if err := t.call(ctx, peer, "Raft.RequestVote", request, response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+func (t *TCPTransport) AppendEntries(
+	ctx context.Context, peer string, request *AppendEntriesRequest,
+) (*AppendEntriesResponse, error) {
+	response := &AppendEntriesResponse{}
+	if err := t.call(ctx, peer, "Raft.AppendEntries", request, response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+func (t *TCPTransport) Serve(handler Handler) error {
+	server := rpc.NewServer()
+	if err := server.RegisterName("Raft", &rpcHandler{handler: handler}); err != nil {
+		return err
+	}
+
+	for {
+		conn, err := t.listener.Accept()
+		if err != nil {
+			t.mu.Lock()
+			closed := t.closed
+			t.mu.Unlock()
+
+			if closed {
+				return nil
+			}
+			return err
+		}
+
+		t.mu.Lock()
+		if t.closed {
+			t.mu.Unlock()
+			conn.Close()
+			return nil
+		}
+		t.conns[conn] = struct{}{}
+		t.mu.Unlock()
+
+		go func() {
+			server.ServeConn(conn)
+
+			t.mu.Lock()
+			delete(t.conns, conn)
+			t.mu.Unlock()
+		}()
+	}
+}
+
+func (t *TCPTransport) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return nil
+	}
+	t.closed = true
+
+	for conn := range t.conns {
+		conn.Close()
+	}
+
+	for peer, client := range t.clients {
+		client.Close()
+		delete(t.clients, peer)
+	}
+	return t.listener.Close()
+}
+
+func (t *TCPTransport) call(ctx context.Context, peer, method string, request, response any) error {
+	client, err := t.client(ctx, peer)
+	if err != nil {
+		return err
+	}
+
+	call := client.Go(method, request, response, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		var serverErr rpc.ServerError
+		if call.Error != nil && !stdErrors.As(call.Error, &serverErr) {
+			t.drop(peer, client)
+		}
+		return call.Error
+
+	case <-ctx.Done():
+		// The peer may be gone without the connection noticing; start over
+		// with a fresh one.
+		t.drop(peer, client)
+		return ctx.Err()
+	}
+}
+
+func (t *TCPTransport) client(ctx context.Context, peer string) (*rpc.Client, error) {
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return nil, ErrClosed
+	}
+
+	if client, ok := t.clients[peer]; ok {
+		t.mu.Unlock()
+		return client, nil
+	}
+
+	address, ok := t.peers[peer]
+	t.mu.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("raft: no address for peer %q", peer)
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	client := rpc.NewClient(conn)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		client.Close()
+		return nil, ErrClosed
+	}
+
+	if existing, ok := t.clients[peer]; ok {
+		client.Close()
+		return existing, nil
+	}
+
+	t.clients[peer] = client
+	return client, nil
+}
+
+func (t *TCPTransport) drop(peer string, client *rpc.Client) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.clients[peer] == client {
+		delete(t.clients, peer)
+		client.Close()
+	}
+}
+
+// rpcHandler adapts a Handler to the method set net/rpc expects.
+type rpcHandler struct {
+	handler Handler
+}
+
+func (h *rpcHandler) RequestVote(request *RequestVoteRequest, response *RequestVoteResponse) error {
+	*response = *h.handler.HandleRequestVote(request)
+	return nil
+}
+
+func (h *rpcHandler) AppendEntries(request *AppendEntriesRequest, response *AppendEntriesResponse) error {
+	*response = *h.handler.HandleAppendEntries(request)
+	return nil
+}
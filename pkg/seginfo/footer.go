@@ -0,0 +1,148 @@
+package seginfo
+
+import (
+	"bytes"
+	"encoding/binary"
+	stdErrors "errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"slices"
+)
+
+// footerTrailerSize is the fixed end of a footer: the size of the footer
+// body, a CRC32 of it and the magic.
+const footerTrailerSize = 4 + 4 + 4
+
+// footerFixedSize is the body of a footer without its offsets.
+const footerFixedSize = 4 + 8 + 8
+
+var footerMagic = [4]byte{'K', 'V', 'F', 'T'}
+
+var ErrFooterCorrupt = stdErrors.New("corrupt segment footer")
+
+// Footer summarizes the records of a sealed segment. It is appended after
+// the last record when the segment is sealed, and read back from the end of
+// the file, so tools can learn what a segment holds, and where each record
+// starts, without scanning it.
+type Footer struct {
+	Records uint32
+	// MinTimestamp and MaxTimestamp bound the record header timestamps, in
+	// seconds. Both are zero for a segment without records.
+	MinTimestamp int64
+	MaxTimestamp int64
+	// Offsets holds where each record starts, in file order.
+	Offsets []int64
+	// Keys is the index of the key table written before the footer. It is
+	// nil for segments sealed without one.
+	Keys *KeyIndex
+}
+
+// Add counts a record starting at offset and written at timestamp.
+func (f *Footer) Add(offset, timestamp int64) {
+	if f.Records == 0 || timestamp < f.MinTimestamp {
+		f.MinTimestamp = timestamp
+	}
+	if f.Records == 0 || timestamp > f.MaxTimestamp {
+		f.MaxTimestamp = timestamp
+	}
+
+	f.Records++
+	f.Offsets = append(f.Offsets, offset)
+}
+
+// MarshalBinary encodes the footer. Offsets are stored in 32 bits, which
+// covers the largest segment size. The key index, if any, follows the
+// offsets.
+func (f *Footer) MarshalBinary() ([]byte, error) {
+	buffer := make([]byte, 0, footerFixedSize+4*len(f.Offsets)+footerTrailerSize)
+
+	buffer = binary.LittleEndian.AppendUint32(buffer, f.Records)
+	buffer = binary.LittleEndian.AppendUint64(buffer, uint64(f.MinTimestamp))
+	buffer = binary.LittleEndian.AppendUint64(buffer, uint64(f.MaxTimestamp))
+	for _, offset := range f.Offsets {
+		if offset < 0 || offset > 1<<32-1 {
+			return nil, fmt.Errorf("record offset %d does not fit a segment footer", offset)
+		}
+		buffer = binary.LittleEndian.AppendUint32(buffer, uint32(offset))
+	}
+
+	if f.Keys != nil {
+		var err error
+		if buffer, err = appendKeyIndex(buffer, f.Keys); err != nil {
+			return nil, err
+		}
+	}
+
+	bodySize := len(buffer)
+	buffer = binary.LittleEndian.AppendUint32(buffer, uint32(bodySize))
+	buffer = binary.LittleEndian.AppendUint32(buffer, crc32.ChecksumIEEE(buffer[:bodySize]))
+	return append(buffer, footerMagic[:]...), nil
+}
+
+// ReadFooter reads the footer at the end of a segment of size bytes, and
+// returns it with the offset the segment's records end at: where its key
+// table starts, or the footer itself for segments sealed without one.
+// Segments that were never sealed have no footer; for them it returns nil
+// and size.
+func ReadFooter(r io.ReaderAt, size int64) (*Footer, int64, error) {
+	if size < footerTrailerSize {
+		return nil, size, nil
+	}
+
+	trailer := make([]byte, footerTrailerSize)
+	if _, err := r.ReadAt(trailer, size-footerTrailerSize); err != nil {
+		return nil, size, err
+	}
+
+	if !bytes.Equal(trailer[8:], footerMagic[:]) {
+		return nil, size, nil
+	}
+
+	bodySize := int64(binary.LittleEndian.Uint32(trailer))
+	if bodySize < footerFixedSize || bodySize > size-footerTrailerSize {
+		return nil, size, fmt.Errorf("%w: body of %d bytes", ErrFooterCorrupt, bodySize)
+	}
+
+	start := size - footerTrailerSize - bodySize
+	body := make([]byte, bodySize)
+	if _, err := r.ReadAt(body, start); err != nil {
+		return nil, size, err
+	}
+
+	if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(trailer[4:]) {
+		return nil, size, fmt.Errorf("%w: checksum mismatch", ErrFooterCorrupt)
+	}
+
+	footer := &Footer{
+		Records:      binary.LittleEndian.Uint32(body),
+		MinTimestamp: int64(binary.LittleEndian.Uint64(body[4:])),
+		MaxTimestamp: int64(binary.LittleEndian.Uint64(body[12:])),
+	}
+
+	offsetsEnd := footerFixedSize + 4*int64(footer.Records)
+	if offsetsEnd > bodySize {
+		return nil, size, fmt.Errorf("%w: %d records but %d offsets", ErrFooterCorrupt, footer.Records, (bodySize-footerFixedSize)/4)
+	}
+
+	recordsEnd := start
+	if offsetsEnd < bodySize {
+		keys, err := decodeKeyIndex(body[offsetsEnd:], start)
+		if err != nil {
+			return nil, size, fmt.Errorf("%w: %w", ErrFooterCorrupt, err)
+		}
+		footer.Keys = keys
+		recordsEnd = keys.Start()
+	}
+
+	footer.Offsets = make([]int64, footer.Records)
+	for i := range footer.Offsets {
+		footer.Offsets[i] = int64(binary.LittleEndian.Uint32(body[footerFixedSize+4*i:]))
+	}
+
+	if !slices.IsSorted(footer.Offsets) || (len(footer.Offsets) > 0 && footer.Offsets[len(footer.Offsets)-1] >= recordsEnd) {
+		return nil, size, fmt.Errorf("%w: offsets out of order or past the records", ErrFooterCorrupt)
+	}
+
+	return footer, recordsEnd, nil
+}
@@ -0,0 +1,182 @@
+package seginfo
+
+import (
+	"bytes"
+	"encoding/binary"
+	stdErrors "errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+
+	"github.com/iamBelugaa/kvix/pkg/checksum"
+)
+
+// HeaderSize is the length of the header that opens every segment created
+// since segment headers were introduced. Its first record follows it.
+// Segments created before start with their first record instead.
+const HeaderSize = 32
+
+const (
+	// FlagsFormatVersion headers carry Flags. Segments without flags are
+	// still written as version 1, so releases that predate flags read them.
+	FlagsFormatVersion uint16 = 2
+	// FormatVersion is the newest segment layout this release reads.
+	// Segments of a later version are refused rather than misread.
+	FormatVersion = FlagsFormatVersion
+)
+
+// HeaderFlags describe how the records of a segment are laid out.
+type HeaderFlags uint8
+
+const (
+	// FlagCompactRecords marks a segment whose records use the compact
+	// framing rather than a binary header and protobuf payload.
+	FlagCompactRecords HeaderFlags = 1 << iota
+)
+
+var headerMagic = [4]byte{'K', 'V', 'S', 'G'}
+
+var (
+	ErrHeaderCorrupt     = stdErrors.New("corrupt segment header")
+	ErrFormatUnsupported = stdErrors.New("unsupported segment format version")
+	ErrHeaderMismatch    = stdErrors.New("segment header does not match its file name")
+)
+
+// Header describes a segment. SegmentID and CreatedAt repeat the file name,
+// so a file renamed or copied over another is recognized.
+type Header struct {
+	FormatVersion uint16
+	SegmentID     uint16
+	// CreatedAt is the timestamp in the segment's file name, in nanoseconds.
+	CreatedAt int64
+	// ChecksumAlgorithm is the algorithm records were checksummed with when
+	// the segment was created. Each record still names its own.
+	ChecksumAlgorithm checksum.Algorithm
+	// Flags are only stored by FlagsFormatVersion headers.
+	Flags HeaderFlags
+}
+
+// encodedHeader is the layout on disk. Checksum is a CRC32 of the bytes
+// before it.
+type encodedHeader struct {
+	Magic             [4]byte
+	FormatVersion     uint16
+	SegmentID         uint16
+	CreatedAt         int64
+	ChecksumAlgorithm uint8
+	Flags             uint8
+	Reserved          [10]byte
+	Checksum          uint32
+}
+
+// NewHeader returns the header of a new segment.
+func NewHeader(segmentID uint16, createdAt int64, algorithm checksum.Algorithm, flags HeaderFlags) *Header {
+	version := uint16(1)
+	if flags != 0 {
+		version = FlagsFormatVersion
+	}
+
+	return &Header{
+		FormatVersion:     version,
+		SegmentID:         segmentID,
+		CreatedAt:         createdAt,
+		ChecksumAlgorithm: algorithm,
+		Flags:             flags,
+	}
+}
+
+// CompactRecords reports whether the records of h's segment use the compact
+// framing. Segments without a header, where h is nil, never do.
+func (h *Header) CompactRecords() bool {
+	return h != nil && h.Flags&FlagCompactRecords != 0
+}
+
+func (h *Header) MarshalBinary() ([]byte, error) {
+	encoded := encodedHeader{
+		Magic:             headerMagic,
+		FormatVersion:     h.FormatVersion,
+		SegmentID:         h.SegmentID,
+		CreatedAt:         h.CreatedAt,
+		ChecksumAlgorithm: uint8(h.ChecksumAlgorithm),
+		Flags:             uint8(h.Flags),
+	}
+
+	buffer, err := binary.Append(make([]byte, 0, HeaderSize), binary.LittleEndian, encoded)
+	if err != nil {
+		return nil, err
+	}
+
+	binary.LittleEndian.PutUint32(buffer[HeaderSize-4:], crc32.ChecksumIEEE(buffer[:HeaderSize-4]))
+	return buffer, nil
+}
+
+// ReadHeader reads the header at the start of a segment. It returns nil and
+// no error for segments that have none, because they were created before
+// segment headers or are still empty.
+func ReadHeader(r io.ReaderAt) (*Header, error) {
+	buffer := make([]byte, HeaderSize)
+	read, err := r.ReadAt(buffer, 0)
+	if err != nil && !stdErrors.Is(err, io.EOF) {
+		return nil, err
+	}
+
+	if read < len(headerMagic) || !bytes.Equal(buffer[:len(headerMagic)], headerMagic[:]) {
+		return nil, nil
+	}
+
+	if read < HeaderSize {
+		return nil, fmt.Errorf("%w: truncated to %d bytes", ErrHeaderCorrupt, read)
+	}
+
+	var encoded encodedHeader
+	if _, err := binary.Decode(buffer, binary.LittleEndian, &encoded); err != nil {
+		return nil, err
+	}
+
+	if crc32.ChecksumIEEE(buffer[:HeaderSize-4]) != encoded.Checksum {
+		return nil, fmt.Errorf("%w: checksum mismatch", ErrHeaderCorrupt)
+	}
+
+	if encoded.FormatVersion == 0 || encoded.FormatVersion > FormatVersion {
+		return nil, fmt.Errorf("%w: %d, this release reads up to %d", ErrFormatUnsupported, encoded.FormatVersion, FormatVersion)
+	}
+
+	header := &Header{
+		FormatVersion:     encoded.FormatVersion,
+		SegmentID:         encoded.SegmentID,
+		CreatedAt:         encoded.CreatedAt,
+		ChecksumAlgorithm: checksum.Algorithm(encoded.ChecksumAlgorithm),
+	}
+	if encoded.FormatVersion >= FlagsFormatVersion {
+		header.Flags = HeaderFlags(encoded.Flags)
+	}
+	return header, nil
+}
+
+// Validate checks that h belongs to the segment named by segmentID and
+// timestamp.
+func (h *Header) Validate(segmentID uint16, timestamp int64) error {
+	if h.SegmentID != segmentID || h.CreatedAt != timestamp {
+		return fmt.Errorf(
+			"%w: header names segment %d created at %d, file is segment %d created at %d",
+			ErrHeaderMismatch, h.SegmentID, h.CreatedAt, segmentID, timestamp,
+		)
+	}
+	return nil
+}
+
+// CheckHeader reads the header of the segment named by segmentID and
+// timestamp and validates it. It returns the header, nil for segments
+// without one, and where the segment's first record starts: HeaderSize, or
+// zero for segments without a header.
+func CheckHeader(r io.ReaderAt, segmentID uint16, timestamp int64) (*Header, int64, error) {
+	header, err := ReadHeader(r)
+	if err != nil || header == nil {
+		return nil, 0, err
+	}
+
+	if err := header.Validate(segmentID, timestamp); err != nil {
+		return nil, 0, err
+	}
+	return header, HeaderSize, nil
+}
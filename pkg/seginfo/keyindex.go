@@ -0,0 +1,231 @@
+package seginfo
+
+import (
+	"bytes"
+	"encoding/binary"
+	stdErrors "errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"slices"
+	"sort"
+)
+
+// keyEntryFixedSize is an entry of the key table without its key: the key
+// length and the record offset.
+const keyEntryFixedSize = 2 + 4
+
+// keyGroupFixedSize is a group of the sparse index without its first key:
+// the group's offset, size and CRC32, and the key length.
+const keyGroupFixedSize = 4 + 4 + 4 + 2
+
+var ErrKeyIndexCorrupt = stdErrors.New("corrupt segment key index")
+
+// KeyEntry is a key and the offset of its record.
+type KeyEntry struct {
+	Key    []byte
+	Offset int64
+}
+
+// KeyIndex is the sparse index of a sealed segment's key table. The table
+// sits between the last record and the footer and holds every key of the
+// segment with the offset of its latest record there, sorted by key and cut
+// into groups of Interval keys. The index keeps the first key of each group,
+// so a lookup binary-searches it and reads a single group instead of
+// scanning the segment.
+type KeyIndex struct {
+	Interval uint32
+	Groups   []KeyGroup
+}
+
+// KeyGroup locates one group of the key table.
+type KeyGroup struct {
+	FirstKey []byte
+	Offset   int64
+	Size     uint32
+	// Checksum is a CRC32 of the group, checked each time it is read.
+	Checksum uint32
+}
+
+// BuildKeyTable encodes the key table of entries, which is written at start,
+// and returns it with its index. Entries may come in any order and repeat a
+// key; the highest offset of a key is kept.
+func BuildKeyTable(entries []KeyEntry, start int64, interval int) ([]byte, *KeyIndex, error) {
+	if interval <= 0 {
+		return nil, nil, fmt.Errorf("key index interval %d is not positive", interval)
+	}
+
+	sorted := slices.Clone(entries)
+	slices.SortStableFunc(sorted, func(a, b KeyEntry) int {
+		return bytes.Compare(a.Key, b.Key)
+	})
+
+	unique := sorted[:0]
+	for _, entry := range sorted {
+		if n := len(unique); n > 0 && bytes.Equal(unique[n-1].Key, entry.Key) {
+			unique[n-1].Offset = max(unique[n-1].Offset, entry.Offset)
+			continue
+		}
+		unique = append(unique, entry)
+	}
+
+	index := &KeyIndex{Interval: uint32(interval)}
+	var table []byte
+
+	for first := 0; first < len(unique); first += interval {
+		group := KeyGroup{FirstKey: unique[first].Key, Offset: start + int64(len(table))}
+		groupStart := len(table)
+
+		for _, entry := range unique[first:min(first+interval, len(unique))] {
+			if len(entry.Key) > 1<<16-1 {
+				return nil, nil, fmt.Errorf("key of %d bytes does not fit a key table", len(entry.Key))
+			}
+			if entry.Offset < 0 || entry.Offset > 1<<32-1 {
+				return nil, nil, fmt.Errorf("record offset %d does not fit a key table", entry.Offset)
+			}
+
+			table = binary.LittleEndian.AppendUint16(table, uint16(len(entry.Key)))
+			table = append(table, entry.Key...)
+			table = binary.LittleEndian.AppendUint32(table, uint32(entry.Offset))
+		}
+
+		group.Size = uint32(len(table) - groupStart)
+		group.Checksum = crc32.ChecksumIEEE(table[groupStart:])
+		index.Groups = append(index.Groups, group)
+	}
+
+	if start+int64(len(table)) > 1<<32-1 {
+		return nil, nil, fmt.Errorf("key table ending at %d does not fit a segment footer", start+int64(len(table)))
+	}
+
+	return table, index, nil
+}
+
+// Start returns where the key table starts.
+func (ki *KeyIndex) Start() int64 {
+	return ki.Groups[0].Offset
+}
+
+// End returns where the key table ends.
+func (ki *KeyIndex) End() int64 {
+	last := ki.Groups[len(ki.Groups)-1]
+	return last.Offset + int64(last.Size)
+}
+
+// Search looks key up in the key table read through r and returns the
+// offset of its latest record, or false if the segment holds none.
+func (ki *KeyIndex) Search(r io.ReaderAt, key []byte) (int64, bool, error) {
+	i := sort.Search(len(ki.Groups), func(i int) bool {
+		return bytes.Compare(ki.Groups[i].FirstKey, key) > 0
+	}) - 1
+	if i < 0 {
+		return 0, false, nil
+	}
+
+	group := ki.Groups[i]
+	data := make([]byte, group.Size)
+	if _, err := r.ReadAt(data, group.Offset); err != nil {
+		return 0, false, err
+	}
+
+	if crc32.ChecksumIEEE(data) != group.Checksum {
+		return 0, false, fmt.Errorf("%w: checksum mismatch in group at %d", ErrKeyIndexCorrupt, group.Offset)
+	}
+
+	for len(data) > 0 {
+		if len(data) < keyEntryFixedSize {
+			return 0, false, fmt.Errorf("%w: truncated entry in group at %d", ErrKeyIndexCorrupt, group.Offset)
+		}
+
+		keyLength := int(binary.LittleEndian.Uint16(data))
+		if len(data) < keyEntryFixedSize+keyLength {
+			return 0, false, fmt.Errorf("%w: truncated entry in group at %d", ErrKeyIndexCorrupt, group.Offset)
+		}
+
+		candidate := data[2 : 2+keyLength]
+		switch bytes.Compare(candidate, key) {
+		case 0:
+			return int64(binary.LittleEndian.Uint32(data[2+keyLength:])), true, nil
+		case 1:
+			return 0, false, nil
+		}
+
+		data = data[keyEntryFixedSize+keyLength:]
+	}
+
+	return 0, false, nil
+}
+
+// appendKeyIndex encodes ki into a footer body.
+func appendKeyIndex(buffer []byte, ki *KeyIndex) ([]byte, error) {
+	buffer = binary.LittleEndian.AppendUint32(buffer, ki.Interval)
+	buffer = binary.LittleEndian.AppendUint32(buffer, uint32(len(ki.Groups)))
+
+	for _, group := range ki.Groups {
+		if group.Offset < 0 || group.Offset > 1<<32-1 {
+			return nil, fmt.Errorf("key group offset %d does not fit a segment footer", group.Offset)
+		}
+
+		buffer = binary.LittleEndian.AppendUint32(buffer, uint32(group.Offset))
+		buffer = binary.LittleEndian.AppendUint32(buffer, group.Size)
+		buffer = binary.LittleEndian.AppendUint32(buffer, group.Checksum)
+		buffer = binary.LittleEndian.AppendUint16(buffer, uint16(len(group.FirstKey)))
+		buffer = append(buffer, group.FirstKey...)
+	}
+
+	return buffer, nil
+}
+
+// decodeKeyIndex decodes the key index at the end of a footer body. The
+// groups must follow each other and end at footerStart.
+func decodeKeyIndex(data []byte, footerStart int64) (*KeyIndex, error) {
+	if len(data) < 8 {
+		return nil, fmt.Errorf("%w: truncated", ErrKeyIndexCorrupt)
+	}
+
+	index := &KeyIndex{Interval: binary.LittleEndian.Uint32(data)}
+	count := binary.LittleEndian.Uint32(data[4:])
+	data = data[8:]
+
+	if index.Interval == 0 || count == 0 || uint64(count)*keyGroupFixedSize > uint64(len(data)) {
+		return nil, fmt.Errorf("%w: %d groups of %d keys", ErrKeyIndexCorrupt, count, index.Interval)
+	}
+
+	index.Groups = make([]KeyGroup, 0, count)
+	for range count {
+		if len(data) < keyGroupFixedSize {
+			return nil, fmt.Errorf("%w: truncated", ErrKeyIndexCorrupt)
+		}
+
+		group := KeyGroup{
+			Offset:   int64(binary.LittleEndian.Uint32(data)),
+			Size:     binary.LittleEndian.Uint32(data[4:]),
+			Checksum: binary.LittleEndian.Uint32(data[8:]),
+		}
+
+		keyLength := int(binary.LittleEndian.Uint16(data[12:]))
+		if len(data) < keyGroupFixedSize+keyLength {
+			return nil, fmt.Errorf("%w: truncated", ErrKeyIndexCorrupt)
+		}
+		group.FirstKey = slices.Clone(data[keyGroupFixedSize : keyGroupFixedSize+keyLength])
+		data = data[keyGroupFixedSize+keyLength:]
+
+		if n := len(index.Groups); n > 0 {
+			previous := index.Groups[n-1]
+			if group.Offset != previous.Offset+int64(previous.Size) || bytes.Compare(previous.FirstKey, group.FirstKey) >= 0 {
+				return nil, fmt.Errorf("%w: groups out of order", ErrKeyIndexCorrupt)
+			}
+		}
+		index.Groups = append(index.Groups, group)
+	}
+
+	if len(data) != 0 {
+		return nil, fmt.Errorf("%w: %d bytes after the last group", ErrKeyIndexCorrupt, len(data))
+	}
+
+	if index.End() != footerStart {
+		return nil, fmt.Errorf("%w: key table ends at %d, footer starts at %d", ErrKeyIndexCorrupt, index.End(), footerStart)
+	}
+
+	return index, nil
+}
@@ -12,8 +12,8 @@ import (
 	"github.com/iamBelugaa/kvix/pkg/filesys"
 )
 
-func GetLastSegmentInfo(segmentDir, prefix string) (uint16, os.FileInfo, error) {
-	lastSegmentPath, err := GetLastSegmentName(segmentDir, prefix)
+func GetLastSegmentInfo(fsys filesys.FileSystem, segmentDir, prefix string) (uint16, os.FileInfo, error) {
+	lastSegmentPath, err := GetLastSegmentName(fsys, segmentDir, prefix)
 	if err != nil {
 		return 0, nil, err
 	}
@@ -27,12 +27,7 @@ func GetLastSegmentInfo(segmentDir, prefix string) (uint16, os.FileInfo, error)
 		return 0, nil, err
 	}
 
-	file, err := os.OpenFile(lastSegmentPath, os.O_RDONLY, 0644)
-	if err != nil {
-		return 0, nil, err
-	}
-
-	stat, err := file.Stat()
+	stat, err := fsys.Stat(lastSegmentPath)
 	if err != nil {
 		return 0, nil, fmt.Errorf("failed to get file info for %s: %w", lastSegmentPath, err)
 	}
@@ -40,9 +35,8 @@ func GetLastSegmentInfo(segmentDir, prefix string) (uint16, os.FileInfo, error)
 	return segmentID, stat, nil
 }
 
-func GetLastSegmentName(segmentDir, prefix string) (string, error) {
-	searchPattern := filepath.Join(segmentDir, prefix+"*.seg")
-	matchingFiles, err := filesys.ReadDir(searchPattern)
+func GetLastSegmentName(fsys filesys.FileSystem, segmentDir, prefix string) (string, error) {
+	matchingFiles, err := ListSegmentPaths(fsys, segmentDir, prefix)
 	if err != nil {
 		return "", err
 	}
@@ -51,10 +45,20 @@ func GetLastSegmentName(segmentDir, prefix string) (string, error) {
 		return "", nil
 	}
 
-	slices.Sort(matchingFiles)
 	return matchingFiles[len(matchingFiles)-1], nil
 }
 
+func ListSegmentPaths(fsys filesys.FileSystem, segmentDir, prefix string) ([]string, error) {
+	searchPattern := filepath.Join(segmentDir, prefix+"*.seg")
+	matchingFiles, err := filesys.ReadDir(fsys, searchPattern)
+	if err != nil {
+		return nil, err
+	}
+
+	slices.Sort(matchingFiles)
+	return matchingFiles, nil
+}
+
 func ParseSegmentID(fullPath, prefix string) (uint16, error) {
 	_, filename := filepath.Split(fullPath)
 